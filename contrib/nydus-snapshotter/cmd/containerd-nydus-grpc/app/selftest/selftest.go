@@ -0,0 +1,382 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package selftest exercises an end-to-end lazy mount of a nydus image with
+// a private snapshotter instance, the same way as containerd pulls image and
+// starts container, to smoke test the installation of snapshotter and nydusd.
+package selftest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/snapshot"
+)
+
+const (
+	// The OS feature of nydus manifest in image index
+	nydusOSFeature = "nydus.remoteimage.v1"
+	// The annotations with the prefix are passed to snapshotter as labels
+	// by containerd unpacker
+	inheritedLabelPrefix = "containerd.io/snapshot/"
+
+	containerKey = "selftest-container"
+
+	PhaseResolve = "resolve"
+	PhasePrepare = "prepare"
+	PhaseMount   = "mount"
+	PhaseRead    = "read"
+	PhaseUnmount = "unmount"
+)
+
+// Options configures self-test.
+type Options struct {
+	// Image is the reference of a small nydus image
+	Image string
+	// File is the sentinel file read from the mounted rootfs
+	File string
+}
+
+// Phase is the result of a phase of self-test.
+type Phase struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// Report records the phases of self-test in order.
+type Report struct {
+	Phases []Phase
+}
+
+// Failed returns the first failed phase, or nil if all phases succeed.
+func (r *Report) Failed() *Phase {
+	for idx := range r.Phases {
+		if r.Phases[idx].Err != nil {
+			return &r.Phases[idx]
+		}
+	}
+	return nil
+}
+
+// Print writes the report as a table.
+func (r *Report) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tDURATION\tRESULT")
+	for _, phase := range r.Phases {
+		result := "ok"
+		if phase.Err != nil {
+			result = fmt.Sprintf("failed: %v", phase.Err)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", phase.Name, phase.Duration.Round(time.Millisecond), result)
+	}
+	tw.Flush()
+}
+
+func (r *Report) run(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	r.Phases = append(r.Phases, Phase{Name: name, Duration: time.Since(start), Err: err})
+	return err
+}
+
+type tester struct {
+	opts      Options
+	image     v1.Image
+	manifest  *v1.Manifest
+	diffIDs   []v1.Hash
+	keychain  authn.Keychain
+	authLabel map[string]string
+	sn        snapshots.Snapshotter
+	// The keys of prepared snapshots, removed in reverse order
+	keys []string
+}
+
+// Run runs the self-test with a private snapshotter instance rooted in a
+// temporary directory under the root directory of cfg, so that it doesn't
+// disturb the running snapshotter. The snapshots and nydusd are cleaned up
+// even if a phase fails.
+func Run(ctx context.Context, cfg config.Config, opts Options) (*Report, error) {
+	report := &Report{}
+	t := &tester{opts: opts, keychain: authn.DefaultKeychain}
+
+	if err := report.run(PhaseResolve, func() error {
+		return t.resolve()
+	}); err != nil {
+		return report, err
+	}
+
+	if err := os.MkdirAll(cfg.RootDir, 0700); err != nil {
+		return report, errors.Wrapf(err, "failed to create root directory %s", cfg.RootDir)
+	}
+	root, err := ioutil.TempDir(cfg.RootDir, "selftest-")
+	if err != nil {
+		return report, errors.Wrap(err, "failed to create self-test directory")
+	}
+	defer os.RemoveAll(root)
+	cfg.RootDir = root
+	cfg.CacheDir = filepath.Join(root, "cache")
+	cfg.Address = filepath.Join(root, "containerd-nydus-grpc.sock")
+	cfg.EnableMetrics = false
+	cfg.MeasureLatency = false
+	cfg.BootstrapContentStore = false
+	cfg.PinnedImages = nil
+
+	sn, err := snapshot.NewSnapshotter(ctx, &cfg)
+	if err != nil {
+		return report, errors.Wrap(err, "failed to initialize snapshotter")
+	}
+	t.sn = sn
+
+	var mounts []mount.Mount
+	err = report.run(PhasePrepare, func() error {
+		return t.prepareLayers(ctx)
+	})
+	if err == nil {
+		err = report.run(PhaseMount, func() error {
+			mounts, err = t.prepareContainer(ctx)
+			return err
+		})
+	}
+	if err == nil {
+		err = report.run(PhaseRead, func() error {
+			return t.read(ctx, mounts)
+		})
+	}
+	if cleanupErr := report.run(PhaseUnmount, func() error {
+		return t.cleanup(ctx)
+	}); err == nil {
+		err = cleanupErr
+	}
+
+	return report, err
+}
+
+// findNydusManifest returns the digest of nydus manifest for current
+// platform in image index.
+func findNydusManifest(index *v1.IndexManifest) (v1.Hash, error) {
+	for _, desc := range index.Manifests {
+		if desc.Platform == nil || desc.Platform.OS != "linux" ||
+			desc.Platform.Architecture != runtime.GOARCH {
+			continue
+		}
+		for _, feature := range desc.Platform.OSFeatures {
+			if feature == nydusOSFeature {
+				return desc.Digest, nil
+			}
+		}
+	}
+	return v1.Hash{}, fmt.Errorf("no nydus manifest for linux/%s in image index", runtime.GOARCH)
+}
+
+// resolve fetches the nydus manifest and config of image, the credential
+// in docker config is passed to nydusd by labels as well.
+func (t *tester) resolve() error {
+	ref, err := name.ParseReference(t.opts.Image)
+	if err != nil {
+		return errors.Wrapf(err, "invalid image reference %s", t.opts.Image)
+	}
+
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(t.keychain))
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch image %s", ref)
+	}
+	if desc.MediaType == types.OCIImageIndex || desc.MediaType == types.DockerManifestList {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return errors.Wrap(err, "failed to parse image index")
+		}
+		indexManifest, err := index.IndexManifest()
+		if err != nil {
+			return errors.Wrap(err, "failed to parse image index")
+		}
+		dgst, err := findNydusManifest(indexManifest)
+		if err != nil {
+			return err
+		}
+		if t.image, err = index.Image(dgst); err != nil {
+			return errors.Wrapf(err, "failed to fetch nydus manifest %s", dgst)
+		}
+	} else if t.image, err = desc.Image(); err != nil {
+		return errors.Wrap(err, "failed to parse image manifest")
+	}
+
+	if t.manifest, err = t.image.Manifest(); err != nil {
+		return errors.Wrap(err, "failed to fetch image manifest")
+	}
+	layers := t.manifest.Layers
+	if len(layers) == 0 || layers[len(layers)-1].Annotations[label.NydusMetaLayer] != "true" {
+		return fmt.Errorf("image %s isn't a nydus image", ref)
+	}
+	configFile, err := t.image.ConfigFile()
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch image config")
+	}
+	t.diffIDs = configFile.RootFS.DiffIDs
+	if len(t.diffIDs) != len(layers) {
+		return fmt.Errorf("mismatched layers (%d) and diff ids (%d)", len(layers), len(t.diffIDs))
+	}
+
+	t.authLabel = map[string]string{}
+	authenticator, err := t.keychain.Resolve(ref.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve registry credential")
+	}
+	if auth, err := authenticator.Authorization(); err == nil {
+		if auth.Username != "" || auth.Password != "" {
+			t.authLabel[label.ImagePullUsername] = auth.Username
+			t.authLabel[label.ImagePullSecret] = auth.Password
+		} else if auth.RegistryToken != "" {
+			t.authLabel[label.ImagePullSecret] = auth.RegistryToken
+		}
+	}
+
+	return nil
+}
+
+// prepareLayers unpacks the image layers like containerd, the nydus blob
+// layers are committed by snapshotter without download, only the bootstrap
+// layer is downloaded and applied.
+func (t *tester) prepareLayers(ctx context.Context) error {
+	layerDigests := []string{}
+	for _, layer := range t.manifest.Layers {
+		layerDigests = append(layerDigests, layer.Digest.String())
+	}
+
+	diffIDs := []digest.Digest{}
+	var parent string
+	for idx, layer := range t.manifest.Layers {
+		diffIDs = append(diffIDs, digest.Digest(t.diffIDs[idx].String()))
+		chainID := identity.ChainID(diffIDs).String()
+
+		labels := map[string]string{
+			label.TargetSnapshotLabel: chainID,
+			label.ImageRef:            t.opts.Image,
+			label.CRIDigest:           layer.Digest.String(),
+			label.CRIImageLayer:       strings.Join(layerDigests, ","),
+		}
+		for key, value := range layer.Annotations {
+			if strings.HasPrefix(key, inheritedLabelPrefix) {
+				labels[key] = value
+			}
+		}
+		for key, value := range t.authLabel {
+			labels[key] = value
+		}
+
+		key := fmt.Sprintf("selftest-extract-%s", chainID)
+		mounts, err := t.sn.Prepare(ctx, key, parent, snapshots.WithLabels(labels))
+		if err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return errors.Wrapf(err, "failed to prepare layer %s", layer.Digest)
+			}
+			// The remote layer is committed by snapshotter
+			t.keys = append(t.keys, chainID)
+			parent = chainID
+			continue
+		}
+		t.keys = append(t.keys, key)
+
+		if err := t.apply(ctx, layer, mounts); err != nil {
+			return errors.Wrapf(err, "failed to apply layer %s", layer.Digest)
+		}
+		if err := t.sn.Commit(ctx, chainID, key, snapshots.WithLabels(labels)); err != nil {
+			return errors.Wrapf(err, "failed to commit layer %s", layer.Digest)
+		}
+		t.keys[len(t.keys)-1] = chainID
+		parent = chainID
+	}
+
+	return nil
+}
+
+func (t *tester) apply(ctx context.Context, desc v1.Descriptor, mounts []mount.Mount) error {
+	layer, err := t.image.LayerByDigest(desc.Digest)
+	if err != nil {
+		return err
+	}
+	reader, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decompressed, err := compression.DecompressStream(reader)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	return mount.WithTempMount(ctx, mounts, func(root string) error {
+		_, err := archive.Apply(ctx, root, decompressed)
+		return err
+	})
+}
+
+// prepareContainer prepares the container rootfs on the top layer, which
+// starts nydusd to mount the image lazily.
+func (t *tester) prepareContainer(ctx context.Context) ([]mount.Mount, error) {
+	mounts, err := t.sn.Prepare(ctx, containerKey, t.keys[len(t.keys)-1])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare container snapshot")
+	}
+	t.keys = append(t.keys, containerKey)
+	return mounts, nil
+}
+
+// read reads the sentinel file from the mounted container rootfs, the
+// data is fetched from registry by nydusd on demand.
+func (t *tester) read(ctx context.Context, mounts []mount.Mount) error {
+	return mount.WithTempMount(ctx, mounts, func(root string) error {
+		file, err := os.Open(filepath.Join(root, t.opts.File))
+		if err != nil {
+			return errors.Wrapf(err, "failed to open sentinel file %s", t.opts.File)
+		}
+		defer file.Close()
+		if _, err := io.Copy(ioutil.Discard, file); err != nil {
+			return errors.Wrapf(err, "failed to read sentinel file %s", t.opts.File)
+		}
+		return nil
+	})
+}
+
+// cleanup removes the snapshots from top to bottom, then closes snapshotter,
+// which umounts nydusd.
+func (t *tester) cleanup(ctx context.Context) error {
+	var firstErr error
+	for idx := len(t.keys) - 1; idx >= 0; idx-- {
+		if err := t.sn.Remove(ctx, t.keys[idx]); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "failed to remove snapshot %s", t.keys[idx])
+		}
+	}
+	if err := t.sn.Close(); err != nil && firstErr == nil {
+		firstErr = errors.Wrap(err, "failed to close snapshotter")
+	}
+	return firstErr
+}
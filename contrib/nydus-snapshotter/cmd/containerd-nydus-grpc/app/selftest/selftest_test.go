@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package selftest
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindNydusManifest(t *testing.T) {
+	ociHash := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	nydusHash := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("b", 64)}
+	index := &v1.IndexManifest{
+		Manifests: []v1.Descriptor{
+			{Digest: ociHash, Platform: &v1.Platform{OS: "linux", Architecture: runtime.GOARCH}},
+			{Digest: nydusHash, Platform: &v1.Platform{OS: "linux", Architecture: runtime.GOARCH, OSFeatures: []string{nydusOSFeature}}},
+		},
+	}
+	dgst, err := findNydusManifest(index)
+	require.Nil(t, err)
+	assert.Equal(t, nydusHash, dgst)
+
+	index.Manifests = index.Manifests[:1]
+	_, err = findNydusManifest(index)
+	assert.NotNil(t, err)
+}
+
+func TestReport(t *testing.T) {
+	report := &Report{}
+	assert.Nil(t, report.run(PhaseResolve, func() error { return nil }))
+	assert.NotNil(t, report.run(PhasePrepare, func() error { return errors.New("no such layer") }))
+	assert.Nil(t, report.run(PhaseUnmount, func() error { return nil }))
+
+	failed := report.Failed()
+	require.NotNil(t, failed)
+	assert.Equal(t, PhasePrepare, failed.Name)
+
+	buf := bytes.NewBuffer(nil)
+	report.Print(buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 4)
+	assert.True(t, strings.HasPrefix(lines[0], "PHASE"))
+	assert.Contains(t, lines[2], "failed: no such layer")
+	assert.True(t, strings.HasSuffix(lines[3], "ok"))
+
+	report.Phases[1].Err = nil
+	report.Phases[1].Duration = time.Second
+	assert.Nil(t, report.Failed())
+}
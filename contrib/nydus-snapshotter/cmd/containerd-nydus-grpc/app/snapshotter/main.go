@@ -9,9 +9,11 @@ package snapshotter
 import (
 	"context"
 
+	"github.com/containerd/containerd/log"
 	"github.com/pkg/errors"
 
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/utils/signals"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/snapshot"
 )
@@ -23,8 +25,17 @@ func Start(ctx context.Context, cfg config.Config) error {
 	}
 
 	stopSignal := signals.SetupSignalHandler()
+	// Cycle the log level on SIGUSR1 for debugging without restart
+	logging.WatchSignal(ctx)
 	opt := ServeOptions{
 		ListeningSocketPath: cfg.Address,
 	}
-	return Serve(ctx, rs, opt, stopSignal)
+	err = Serve(ctx, rs, opt, stopSignal)
+	// Mark the node unavailable until the snapshotter recovers
+	if drainer, ok := rs.(snapshot.Drainer); ok {
+		if err := drainer.Drain(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to drain node")
+		}
+	}
+	return err
 }
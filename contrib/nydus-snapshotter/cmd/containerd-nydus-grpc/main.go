@@ -7,12 +7,15 @@
 package main
 
 import (
+	"context"
 	"os"
+	"time"
 
 	"github.com/containerd/containerd/log"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/cmd/containerd-nydus-grpc/app/selftest"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/cmd/containerd-nydus-grpc/app/snapshotter"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/cmd/containerd-nydus-grpc/pkg/command"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/cmd/containerd-nydus-grpc/pkg/logging"
@@ -39,6 +42,40 @@ func main() {
 			}
 			return snapshotter.Start(ctx, cfg)
 		},
+		Commands: []*cli.Command{
+			{
+				Name:  "selftest",
+				Usage: "prepare and mount a small nydus image end to end with the snapshotter flags, report per-phase timings",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "image", Required: true, Usage: "reference of a small nydus image"},
+					&cli.StringFlag{Name: "file", Value: "/etc/passwd", Usage: "sentinel file read from the mounted image"},
+					&cli.DurationFlag{Name: "timeout", Value: 5 * time.Minute, Usage: "timeout of the whole self-test"},
+				},
+				Action: func(c *cli.Context) error {
+					ctx := logging.WithContext()
+					if err := logging.SetUp(flags.Args.LogLevel); err != nil {
+						return errors.Wrap(err, "failed to prepare logger")
+					}
+
+					var cfg config.Config
+					if err := command.Validate(flags.Args, &cfg); err != nil {
+						return errors.Wrap(err, "invalid argument")
+					}
+					ctx, cancel := context.WithTimeout(ctx, c.Duration("timeout"))
+					defer cancel()
+
+					report, err := selftest.Run(ctx, cfg, selftest.Options{
+						Image: c.String("image"),
+						File:  c.String("file"),
+					})
+					report.Print(os.Stdout)
+					if err != nil {
+						return errors.Wrap(err, "self-test failed")
+					}
+					return nil
+				},
+			},
+		},
 	}
 	if err := app.Run(os.Args); err != nil {
 		if errdefs.IsConnectionClosed(err) {
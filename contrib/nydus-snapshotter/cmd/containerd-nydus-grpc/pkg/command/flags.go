@@ -9,9 +9,12 @@ package command
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/contentstore"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/process"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -25,16 +28,22 @@ const (
 	defaultPublicKey      = "/signing/nydus-image-signing-public.key"
 	defaultNydusdPath     = "/bin/nydusd"
 	defaultNydusImagePath = "/bin/nydusd-img"
+	defaultSocketMode     = "0600"
+	defaultContainerd     = "/run/containerd/containerd.sock"
 )
 
 type Args struct {
 	Address              string
 	LogLevel             string
 	ConfigPath           string
+	HostConfigDir        string
+	SizeClassConfig      string
 	RootDir              string
 	CacheDir             string
 	GCPeriod             string
 	ValidateSignature    bool
+	DigestValidate       bool
+	MergedView           bool
 	PublicKeyFile        string
 	ConvertVpcRegistry   bool
 	NydusdBinaryPath     string
@@ -44,7 +53,55 @@ type Args struct {
 	AsyncRemove          bool
 	EnableMetrics        bool
 	MetricsFile          string
+	MetricsAddress       string
+	MetricsSocketMode    string
+	MetricsTokenFile     string
 	EnableStargz         bool
+	ContainerdAddress    string
+	ContainerdVersion    string
+	PinnedImages         cli.StringSlice
+	MeasureLatency       bool
+	// Import bootstraps to the content store of containerd
+	BootstrapContentStore bool
+	ContentNamespace      string
+	ContainerdRoot        string
+	// Convert the images without nydus companion on node
+	ConvertOnNode     bool
+	ConvertTargetRepo string
+	ConvertInsecure   bool
+	// Report the health of snapshotter to the node object in Kubernetes
+	ReportNodeStatus   bool
+	NodeName           string
+	NodeTaint          bool
+	NodeStatusInterval time.Duration
+	// Probe the liveness of nydusd through its API and FUSE mountpoint
+	DaemonLivenessProbe         bool
+	DaemonLivenessAction        string
+	DaemonProbeInterval         time.Duration
+	DaemonProbeTimeout          time.Duration
+	DaemonProbeFailureThreshold int
+	DaemonServerUIDs            cli.StringSlice
+	// Serve the cached chunks only when the backend of nydusd keeps failing
+	DaemonDegradedMode           bool
+	DaemonDegradedInterval       time.Duration
+	DaemonDegradedErrorThreshold int
+	DaemonDegradedRetryLimit     int
+	DaemonDegradedTimeout        time.Duration
+	// Serve the blob data of registry to nydusd from a node-local cache proxy
+	BlobProxyAddress   string
+	BlobProxyCacheSize int64
+	// Preheat the blob caches of images before they are pulled
+	EnablePreheat      bool
+	PreheatConcurrency int
+	PreheatTimeout     time.Duration
+	PreheatInsecure    bool
+	WatchImagePrePull  bool
+	// Mount RAFS data artifacts at host paths
+	EnableArtifactMount bool
+	ArtifactMountPaths  cli.StringSlice
+	ArtifactInsecure    bool
+	// Wait for the instance running on the same root dir to exit
+	InstanceLockTimeout time.Duration
 }
 
 type Flags struct {
@@ -71,6 +128,17 @@ func buildFlags(args *Args) []cli.Flag {
 			Usage:       "path to the configuration file",
 			Destination: &args.ConfigPath,
 		},
+		&cli.StringFlag{
+			Name:        "host-config-dir",
+			Value:       config.DefaultHostConfigDir,
+			Usage:       "directory of nydusd config templates per registry host, in layout of \"<dir>/<host>/config.json\"",
+			Destination: &args.HostConfigDir,
+		},
+		&cli.StringFlag{
+			Name:        "size-class-config",
+			Usage:       "path to the JSON file of image size classes, tuning FUSE threads and prefetch workers of nydusd by the size of image",
+			Destination: &args.SizeClassConfig,
+		},
 		&cli.StringFlag{
 			Name:        "root",
 			Value:       defaultRootDir,
@@ -95,6 +163,18 @@ func buildFlags(args *Args) []cli.Flag {
 			Usage:       "whether force validate image bootstrap",
 			Destination: &args.ValidateSignature,
 		},
+		&cli.BoolFlag{
+			Name:        "digest-validate",
+			Value:       false,
+			Usage:       "whether to require nydusd to validate the digest of chunks for all images, overriding nydusd config and the templates per registry host",
+			Destination: &args.DigestValidate,
+		},
+		&cli.BoolFlag{
+			Name:        "merged-view",
+			Value:       false,
+			Usage:       "whether to mount the views of fully lazy images by binding the RAFS mount merged by nydusd instead of overlayfs",
+			Destination: &args.MergedView,
+		},
 		&cli.StringFlag{
 			Name:        "publickey-file",
 			Value:       defaultPublicKey,
@@ -148,12 +228,238 @@ func buildFlags(args *Args) []cli.Flag {
 			Usage:       "file path to output metrics",
 			Destination: &args.MetricsFile,
 		},
+		&cli.StringFlag{
+			Name:        "metrics-address",
+			Usage:       "address of metrics and management API server, could be a unix socket path or \"tcp://host:port\", default to metrics.sock in root dir",
+			Destination: &args.MetricsAddress,
+		},
+		&cli.StringFlag{
+			Name:        "metrics-socket-mode",
+			Value:       defaultSocketMode,
+			Usage:       "file permission of metrics unix socket in octal",
+			Destination: &args.MetricsSocketMode,
+		},
+		&cli.StringFlag{
+			Name:        "metrics-token-file",
+			Usage:       "path to the bearer token file, requests to metrics server are required to carry the token if specified",
+			Destination: &args.MetricsTokenFile,
+		},
 		&cli.BoolFlag{
 			Name:        "enable-stargz",
 			Value:       false,
 			Usage:       "whether to support stargz image",
 			Destination: &args.EnableStargz,
 		},
+		&cli.StringFlag{
+			Name:        "containerd-address",
+			Value:       defaultContainerd,
+			Usage:       "containerd grpc socket path, used to negotiate containerd version",
+			Destination: &args.ContainerdAddress,
+		},
+		&cli.StringFlag{
+			Name:        "containerd-version",
+			Usage:       "containerd version, e.g. \"1.6\", skip the version negotiation if specified",
+			Destination: &args.ContainerdVersion,
+		},
+		&cli.StringSliceFlag{
+			Name:        "pinned-images",
+			Usage:       "digests or references of images whose blob caches are never removed by GC, the images dropped from the list are unpinned on restart",
+			Destination: &args.PinnedImages,
+		},
+		&cli.BoolFlag{
+			Name:        "measure-latency",
+			Value:       false,
+			Usage:       "whether to record pod start latencies for comparing nydus and non-nydus images, the report is served by metrics server",
+			Destination: &args.MeasureLatency,
+		},
+		&cli.BoolFlag{
+			Name:        "bootstrap-content-store",
+			Value:       false,
+			Usage:       "whether to store bootstraps in containerd content store with leases, so containerd GC and image tooling see them",
+			Destination: &args.BootstrapContentStore,
+		},
+		&cli.StringFlag{
+			Name:        "content-namespace",
+			Value:       contentstore.DefaultNamespace,
+			Usage:       "containerd namespace holding the bootstrap contents and leases",
+			Destination: &args.ContentNamespace,
+		},
+		&cli.StringFlag{
+			Name:        "containerd-root",
+			Value:       contentstore.DefaultContainerdRoot,
+			Usage:       "containerd root directory, bootstraps are hard linked to its content blobs to share a single copy",
+			Destination: &args.ContainerdRoot,
+		},
+		&cli.BoolFlag{
+			Name:        "convert-on-node",
+			Value:       false,
+			Usage:       "whether to convert the images without nydus companion to nydus on node in background, so that the subsequent containers are lazily mounted",
+			Destination: &args.ConvertOnNode,
+		},
+		&cli.StringFlag{
+			Name:        "convert-target-repo",
+			Usage:       "companion repository prefix to push the images converted on node, e.g. \"registry.example.com/nydus\"",
+			Destination: &args.ConvertTargetRepo,
+		},
+		&cli.BoolFlag{
+			Name:        "convert-insecure",
+			Value:       false,
+			Usage:       "whether to access registries over http or with insecure https when pushing the images converted on node",
+			Destination: &args.ConvertInsecure,
+		},
+		&cli.BoolFlag{
+			Name:        "report-node-status",
+			Value:       false,
+			Usage:       "whether to report the health of snapshotter as a node condition through Kubernetes API with the mounted service account",
+			Destination: &args.ReportNodeStatus,
+		},
+		&cli.StringFlag{
+			Name:        "node-name",
+			Usage:       "name of the node object the snapshotter runs on, e.g. from the downward API",
+			EnvVars:     []string{"NODE_NAME"},
+			Destination: &args.NodeName,
+		},
+		&cli.BoolFlag{
+			Name:        "node-taint",
+			Value:       false,
+			Usage:       "whether to taint the node with NoSchedule while the snapshotter is unhealthy or draining, so that the scheduler stops placing workloads on it",
+			Destination: &args.NodeTaint,
+		},
+		&cli.DurationFlag{
+			Name:        "node-status-interval",
+			Value:       30 * time.Second,
+			Usage:       "period for checking the health of snapshotter and reporting the node status",
+			Destination: &args.NodeStatusInterval,
+		},
+		&cli.BoolFlag{
+			Name:        "daemon-liveness-probe",
+			Value:       false,
+			Usage:       "whether to probe the liveness of nydusd through its API and FUSE mountpoint, to detect the daemons wedged but not exited",
+			Destination: &args.DaemonLivenessProbe,
+		},
+		&cli.StringFlag{
+			Name:        "daemon-liveness-action",
+			Value:       process.LivenessActionNone,
+			Usage:       "action on nydusd failing liveness probes, could be \"none\" (report by log and metrics only) or \"restart\"",
+			Destination: &args.DaemonLivenessAction,
+		},
+		&cli.DurationFlag{
+			Name:        "daemon-probe-interval",
+			Value:       10 * time.Second,
+			Usage:       "period for probing the liveness of nydusd",
+			Destination: &args.DaemonProbeInterval,
+		},
+		&cli.DurationFlag{
+			Name:        "daemon-probe-timeout",
+			Value:       5 * time.Second,
+			Usage:       "timeout of each liveness probe of nydusd",
+			Destination: &args.DaemonProbeTimeout,
+		},
+		&cli.IntFlag{
+			Name:        "daemon-probe-failure-threshold",
+			Value:       3,
+			Usage:       "number of consecutive failed liveness probes before taking the action on nydusd",
+			Destination: &args.DaemonProbeFailureThreshold,
+		},
+		&cli.StringSliceFlag{
+			Name:        "daemon-server-uids",
+			Usage:       "UIDs nydusd is allowed to run as, the API socket served by a process of other UIDs is rejected by peer credentials, defaults to the UID of snapshotter. It doesn't restrict the clients of API socket",
+			Destination: &args.DaemonServerUIDs,
+		},
+		&cli.BoolFlag{
+			Name:        "daemon-degraded-mode",
+			Value:       false,
+			Usage:       "whether to switch the image whose nydusd backend keeps failing to degraded mode, where the chunks in blob cache are still served and the reads of uncached ranges fail fast with EIO",
+			Destination: &args.DaemonDegradedMode,
+		},
+		&cli.DurationFlag{
+			Name:        "daemon-degraded-interval",
+			Value:       10 * time.Second,
+			Usage:       "period for checking the backend metrics of nydusd",
+			Destination: &args.DaemonDegradedInterval,
+		},
+		&cli.IntFlag{
+			Name:        "daemon-degraded-error-threshold",
+			Value:       3,
+			Usage:       "number of backend read errors within a check period to switch the image to degraded mode",
+			Destination: &args.DaemonDegradedErrorThreshold,
+		},
+		&cli.IntFlag{
+			Name:        "daemon-degraded-retry-limit",
+			Value:       0,
+			Usage:       "retry limit of the backend reads of uncached ranges in degraded mode",
+			Destination: &args.DaemonDegradedRetryLimit,
+		},
+		&cli.DurationFlag{
+			Name:        "daemon-degraded-timeout",
+			Value:       2 * time.Second,
+			Usage:       "timeout of the backend reads of uncached ranges in degraded mode, rounded up to seconds",
+			Destination: &args.DaemonDegradedTimeout,
+		},
+		&cli.StringFlag{
+			Name:        "blob-proxy-address",
+			Usage:       "loopback TCP address of the node-local proxy caching the blob data of registry for all nydusd, e.g. 127.0.0.1:65001, disabled if empty",
+			Destination: &args.BlobProxyAddress,
+		},
+		&cli.Int64Flag{
+			Name:        "blob-proxy-cache-size",
+			Value:       10 << 30,
+			Usage:       "capacity in bytes of the blob data cached by blob proxy, 0 is unlimited",
+			Destination: &args.BlobProxyCacheSize,
+		},
+		&cli.BoolFlag{
+			Name:        "enable-preheat",
+			Value:       false,
+			Usage:       "whether to serve the preheat API by metrics server, which fetches the blob data of nydus images into blob cache before they are pulled",
+			Destination: &args.EnablePreheat,
+		},
+		&cli.IntFlag{
+			Name:        "preheat-concurrency",
+			Value:       1,
+			Usage:       "number of images preheated at the same time",
+			Destination: &args.PreheatConcurrency,
+		},
+		&cli.DurationFlag{
+			Name:        "preheat-timeout",
+			Value:       30 * time.Minute,
+			Usage:       "timeout of preheating an image",
+			Destination: &args.PreheatTimeout,
+		},
+		&cli.BoolFlag{
+			Name:        "preheat-insecure",
+			Value:       false,
+			Usage:       "whether to access registries over http or with insecure https when pulling the bootstraps of preheated images",
+			Destination: &args.PreheatInsecure,
+		},
+		&cli.BoolFlag{
+			Name:        "watch-image-prepull",
+			Value:       false,
+			Usage:       "whether to preheat the images of ImagePrePull resources selecting the node, through Kubernetes API with the mounted service account",
+			Destination: &args.WatchImagePrePull,
+		},
+		&cli.BoolFlag{
+			Name:        "enable-artifact-mount",
+			Value:       false,
+			Usage:       "whether to serve the artifact API by metrics server, which mounts RAFS data artifacts at host paths outside the snapshot lifecycle",
+			Destination: &args.EnableArtifactMount,
+		},
+		&cli.StringSliceFlag{
+			Name:        "artifact-mount-path",
+			Usage:       "absolute directory under which RAFS data artifacts are allowed to be mounted, can be specified multiple times",
+			Destination: &args.ArtifactMountPaths,
+		},
+		&cli.BoolFlag{
+			Name:        "artifact-insecure",
+			Value:       false,
+			Usage:       "whether to access registries over http or with insecure https when pulling the bootstraps of mounted artifacts",
+			Destination: &args.ArtifactInsecure,
+		},
+		&cli.DurationFlag{
+			Name:        "instance-lock-timeout",
+			Value:       0,
+			Usage:       "how long to wait for the snapshotter instance running on the same root dir to exit before taking over, e.g. in blue/green deployment, wait forever if it's 0",
+			Destination: &args.InstanceLockTimeout,
+		},
 	}
 }
 
@@ -177,6 +483,15 @@ func Validate(args *Args, cfg *config.Config) error {
 		}
 	}
 	cfg.DaemonCfg = daemonCfg
+	cfg.HostConfigDir = args.HostConfigDir
+	if args.SizeClassConfig != "" {
+		classes, err := config.LoadSizeClasses(args.SizeClassConfig)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load size classes %q", args.SizeClassConfig)
+		}
+		cfg.SizeClassConfig = args.SizeClassConfig
+		cfg.SizeClasses = classes
+	}
 	cfg.RootDir = args.RootDir
 
 	cfg.CacheDir = args.CacheDir
@@ -184,6 +499,8 @@ func Validate(args *Args, cfg *config.Config) error {
 		cfg.CacheDir = filepath.Join(cfg.RootDir, "cache")
 	}
 	cfg.ValidateSignature = args.ValidateSignature
+	cfg.DigestValidate = args.DigestValidate
+	cfg.MergedView = args.MergedView
 	cfg.PublicKeyFile = args.PublicKeyFile
 	cfg.ConvertVpcRegistry = args.ConvertVpcRegistry
 	cfg.Address = args.Address
@@ -197,7 +514,109 @@ func Validate(args *Args, cfg *config.Config) error {
 	cfg.AsyncRemove = args.AsyncRemove
 	cfg.EnableMetrics = args.EnableMetrics
 	cfg.MetricsFile = args.MetricsFile
+	cfg.MetricsAddress = args.MetricsAddress
+	cfg.MetricsTokenFile = args.MetricsTokenFile
+	mode, err := strconv.ParseUint(args.MetricsSocketMode, 8, 32)
+	if err != nil {
+		return errors.Wrapf(err, "parse metrics socket mode %v failed", args.MetricsSocketMode)
+	}
+	cfg.MetricsSocketMode = os.FileMode(mode)
 	cfg.EnableStargz = args.EnableStargz
+	cfg.ContainerdAddress = args.ContainerdAddress
+	cfg.ContainerdVersion = args.ContainerdVersion
+	cfg.PinnedImages = args.PinnedImages.Value()
+	if args.MeasureLatency && !args.EnableMetrics {
+		return errors.New("--measure-latency requires --enable-metrics")
+	}
+	cfg.MeasureLatency = args.MeasureLatency
+	if args.BootstrapContentStore && args.ContainerdAddress == "" {
+		return errors.New("--bootstrap-content-store requires --containerd-address")
+	}
+	cfg.BootstrapContentStore = args.BootstrapContentStore
+	cfg.ContentNamespace = args.ContentNamespace
+	cfg.ContainerdRoot = args.ContainerdRoot
+	if args.ConvertTargetRepo != "" && !args.ConvertOnNode {
+		return errors.New("--convert-target-repo requires --convert-on-node")
+	}
+	cfg.ConvertOnNode = args.ConvertOnNode
+	cfg.ConvertTargetRepo = args.ConvertTargetRepo
+	cfg.ConvertInsecure = args.ConvertInsecure
+	if args.ReportNodeStatus && args.NodeName == "" {
+		return errors.New("--report-node-status requires --node-name")
+	}
+	if args.NodeTaint && !args.ReportNodeStatus {
+		return errors.New("--node-taint requires --report-node-status")
+	}
+	cfg.ReportNodeStatus = args.ReportNodeStatus
+	cfg.NodeName = args.NodeName
+	cfg.NodeTaint = args.NodeTaint
+	cfg.NodeStatusInterval = args.NodeStatusInterval
+	if args.DaemonLivenessAction != process.LivenessActionNone && args.DaemonLivenessAction != process.LivenessActionRestart {
+		return errors.Errorf("invalid --daemon-liveness-action %s", args.DaemonLivenessAction)
+	}
+	if args.DaemonProbeInterval <= 0 || args.DaemonProbeTimeout <= 0 || args.DaemonProbeFailureThreshold <= 0 {
+		return errors.New("--daemon-probe-interval, --daemon-probe-timeout and --daemon-probe-failure-threshold should be positive")
+	}
+	cfg.DaemonLivenessProbe = args.DaemonLivenessProbe
+	cfg.DaemonLivenessAction = args.DaemonLivenessAction
+	cfg.DaemonProbeInterval = args.DaemonProbeInterval
+	cfg.DaemonProbeTimeout = args.DaemonProbeTimeout
+	cfg.DaemonProbeFailureThreshold = args.DaemonProbeFailureThreshold
+	for _, value := range args.DaemonServerUIDs.Value() {
+		uid, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return errors.Wrapf(err, "invalid --daemon-server-uids %s", value)
+		}
+		cfg.DaemonServerUIDs = append(cfg.DaemonServerUIDs, uint32(uid))
+	}
+	if args.DaemonDegradedInterval <= 0 || args.DaemonDegradedErrorThreshold <= 0 || args.DaemonDegradedTimeout <= 0 {
+		return errors.New("--daemon-degraded-interval, --daemon-degraded-error-threshold and --daemon-degraded-timeout should be positive")
+	}
+	if args.DaemonDegradedRetryLimit < 0 {
+		return errors.New("--daemon-degraded-retry-limit should not be negative")
+	}
+	cfg.DaemonDegradedMode = args.DaemonDegradedMode
+	cfg.DaemonDegradedInterval = args.DaemonDegradedInterval
+	cfg.DaemonDegradedErrorThreshold = args.DaemonDegradedErrorThreshold
+	cfg.DaemonDegradedRetryLimit = args.DaemonDegradedRetryLimit
+	cfg.DaemonDegradedTimeout = args.DaemonDegradedTimeout
+	if args.BlobProxyCacheSize < 0 {
+		return errors.New("--blob-proxy-cache-size should not be negative")
+	}
+	cfg.BlobProxyAddress = args.BlobProxyAddress
+	cfg.BlobProxyCacheSize = args.BlobProxyCacheSize
+	if args.EnablePreheat && !args.EnableMetrics {
+		return errors.New("--enable-preheat requires --enable-metrics")
+	}
+	if args.WatchImagePrePull && (!args.EnablePreheat || args.NodeName == "") {
+		return errors.New("--watch-image-prepull requires --enable-preheat and --node-name")
+	}
+	if args.PreheatConcurrency <= 0 || args.PreheatTimeout <= 0 {
+		return errors.New("--preheat-concurrency and --preheat-timeout should be positive")
+	}
+	cfg.EnablePreheat = args.EnablePreheat
+	cfg.PreheatConcurrency = args.PreheatConcurrency
+	cfg.PreheatTimeout = args.PreheatTimeout
+	cfg.PreheatInsecure = args.PreheatInsecure
+	cfg.WatchImagePrePull = args.WatchImagePrePull
+	if args.EnableArtifactMount && !args.EnableMetrics {
+		return errors.New("--enable-artifact-mount requires --enable-metrics")
+	}
+	if args.EnableArtifactMount && len(args.ArtifactMountPaths.Value()) == 0 {
+		return errors.New("--enable-artifact-mount requires --artifact-mount-path")
+	}
+	for _, path := range args.ArtifactMountPaths.Value() {
+		if !filepath.IsAbs(path) {
+			return errors.Errorf("--artifact-mount-path %s should be absolute", path)
+		}
+	}
+	cfg.EnableArtifactMount = args.EnableArtifactMount
+	cfg.ArtifactMountPaths = args.ArtifactMountPaths.Value()
+	cfg.ArtifactInsecure = args.ArtifactInsecure
+	if args.InstanceLockTimeout < 0 {
+		return errors.New("--instance-lock-timeout should not be negative")
+	}
+	cfg.InstanceLockTimeout = args.InstanceLockTimeout
 
 	d, err := time.ParseDuration(args.GCPeriod)
 	if err != nil {
@@ -11,6 +11,8 @@ import (
 
 	"github.com/containerd/containerd/log"
 	"github.com/sirupsen/logrus"
+
+	loglevel "github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
 )
 
 func SetUp(logLevel string) error {
@@ -18,7 +20,7 @@ func SetUp(logLevel string) error {
 	if err != nil {
 		return err
 	}
-	logrus.SetLevel(lvl)
+	loglevel.SetUp(lvl)
 	logrus.SetFormatter(&logrus.JSONFormatter{
 		TimestampFormat: log.RFC3339NanoFixed,
 	})
@@ -0,0 +1,386 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/compat"
+	metrics "github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/metric"
+)
+
+const defaultAddress = "/var/lib/containerd-nydus-grpc/metrics.sock"
+
+func newClient(c *cli.Context) (*metrics.Client, error) {
+	var token string
+	if tokenFile := c.String("token-file"); tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read token file %s", tokenFile)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	return metrics.NewClient(c.String("address"), token)
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func newTable(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+}
+
+// humanSize formats the size in bytes with binary units.
+func humanSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	idx := 0
+	for value >= 1024 && idx < len(units)-1 {
+		value /= 1024
+		idx++
+	}
+	if idx == 0 {
+		return fmt.Sprintf("%d%s", size, units[idx])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[idx])
+}
+
+func listDaemons(c *cli.Context) error {
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	daemons, err := client.ListDaemons()
+	if err != nil {
+		return errors.Wrap(err, "failed to list daemons")
+	}
+	if c.Bool("json") {
+		return printJSON(os.Stdout, daemons)
+	}
+
+	tw := newTable(os.Stdout)
+	fmt.Fprintln(tw, "ID\tSNAPSHOT\tPID\tIMAGE\tPINNED\tDEGRADED\tMOUNTPOINT")
+	for _, d := range daemons {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%t\t%t\t%s\n", d.ID, d.SnapshotID, d.Pid, d.ImageID, d.Pinned, d.Degraded, d.MountPoint)
+	}
+	return tw.Flush()
+}
+
+func showCache(c *cli.Context) error {
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	usage, err := client.CacheUsage()
+	if err != nil {
+		return errors.Wrap(err, "failed to get cache usage")
+	}
+	if c.Bool("json") {
+		return printJSON(os.Stdout, usage)
+	}
+
+	tw := newTable(os.Stdout)
+	fmt.Fprintln(tw, "IMAGE\tBLOBS\tSIZE\tPINNED")
+	for _, image := range usage.Images {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%t\n", image.Image, len(image.Blobs), humanSize(image.Size), image.Pinned)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\nTotal: %s\n", humanSize(usage.TotalSize))
+	return nil
+}
+
+func runGC(c *cli.Context) error {
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	result, err := client.CacheGC()
+	if err != nil {
+		return errors.Wrap(err, "failed to gc blob cache")
+	}
+	if c.Bool("json") {
+		return printJSON(os.Stdout, result)
+	}
+	for _, blob := range result.RemovedBlobs {
+		fmt.Println(blob)
+	}
+	fmt.Printf("%d blobs removed\n", len(result.RemovedBlobs))
+	return nil
+}
+
+func drain(c *cli.Context) error {
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	var status *metrics.DrainStatus
+	switch {
+	case c.Bool("status"):
+		status, err = client.DrainStatus()
+	default:
+		status, err = client.Drain(!c.Bool("stop"))
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to drain snapshotter")
+	}
+	if c.Bool("json") {
+		return printJSON(os.Stdout, status)
+	}
+	fmt.Printf("draining: %t, running daemons: %d\n", status.Draining, status.Daemons)
+	return nil
+}
+
+func flushMetrics(c *cli.Context) error {
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	if err := client.FlushMetrics(); err != nil {
+		return errors.Wrap(err, "failed to flush metrics")
+	}
+	return nil
+}
+
+func showReads(c *cli.Context) error {
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	summary, err := client.ImageReads()
+	if err != nil {
+		return errors.Wrap(err, "failed to get image reads")
+	}
+	if c.Bool("json") {
+		return printJSON(os.Stdout, summary)
+	}
+
+	tw := newTable(os.Stdout)
+	fmt.Fprintln(tw, "IMAGE\tREAD\tREMOTE\tCACHE\tHIT RATIO")
+	for _, image := range summary.Images {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.1f%%\n", image.Image, humanSize(int64(image.ReadBytes)),
+			humanSize(int64(image.RemoteBytes)), humanSize(int64(image.CacheBytes)), image.CacheHitRatio*100)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\nTotal: read %s, remote %s, cache %s, hit ratio %.1f%%\n", humanSize(int64(summary.ReadBytes)),
+		humanSize(int64(summary.RemoteBytes)), humanSize(int64(summary.CacheBytes)), summary.CacheHitRatio*100)
+	return nil
+}
+
+func showIntegrity(c *cli.Context) error {
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	events, err := client.IntegrityEvents()
+	if err != nil {
+		return errors.Wrap(err, "failed to get integrity events")
+	}
+	if c.Bool("json") {
+		return printJSON(os.Stdout, events)
+	}
+
+	tw := newTable(os.Stdout)
+	fmt.Fprintln(tw, "TIME\tTYPE\tIMAGE\tDAEMON\tFAILURES")
+	for _, event := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", event.Time.Format(time.RFC3339), event.Type, event.Image, event.DaemonID, event.Failures)
+	}
+	return tw.Flush()
+}
+
+func dumpConfig(c *cli.Context) error {
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	cfg, err := client.Config()
+	if err != nil {
+		return errors.Wrap(err, "failed to get config")
+	}
+	return printJSON(os.Stdout, cfg)
+}
+
+func printContainerdConfig(c *cli.Context) error {
+	version, err := compat.ParseVersion(c.String("containerd-version"))
+	if err != nil {
+		return err
+	}
+	fmt.Print(compat.ContainerdConfig(version, compat.PluginOpt{
+		Name:     c.String("name"),
+		Address:  c.String("snapshotter-address"),
+		Platform: c.String("platform"),
+	}))
+	return nil
+}
+
+func listArtifacts(c *cli.Context) error {
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	mounts, err := client.ListArtifacts()
+	if err != nil {
+		return errors.Wrap(err, "failed to list artifacts")
+	}
+	if c.Bool("json") {
+		return printJSON(os.Stdout, mounts)
+	}
+
+	tw := newTable(os.Stdout)
+	fmt.Fprintln(tw, "MOUNTPOINT	PID	REF	CREATED")
+	for _, mnt := range mounts {
+		fmt.Fprintf(tw, "%s	%d	%s	%s\n", mnt.Mountpoint, mnt.Pid, mnt.Ref, mnt.CreatedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func mountArtifact(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return errors.New("artifact reference and mountpoint are required")
+	}
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	mnt, err := client.MountArtifact(c.Args().Get(0), c.Args().Get(1))
+	if err != nil {
+		return errors.Wrap(err, "failed to mount artifact")
+	}
+	if c.Bool("json") {
+		return printJSON(os.Stdout, mnt)
+	}
+	fmt.Printf("mounted %s at %s\n", mnt.Ref, mnt.Mountpoint)
+	return nil
+}
+
+func umountArtifact(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("mountpoint is required")
+	}
+	client, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	if err := client.UmountArtifact(c.Args().First()); err != nil {
+		return errors.Wrap(err, "failed to umount artifact")
+	}
+	return nil
+}
+
+func main() {
+	app := &cli.App{
+		Name:    "nydus-snapshotter-ctl",
+		Usage:   "operate nydus snapshotter on node through its management API",
+		Version: Version,
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "address", Value: defaultAddress, Usage: "address of management API server, could be a unix socket path or \"tcp://host:port\"", EnvVars: []string{"NYDUS_SNAPSHOTTER_ADDRESS"}},
+			&cli.StringFlag{Name: "token-file", Usage: "file containing the bearer token of management API", EnvVars: []string{"NYDUS_SNAPSHOTTER_TOKEN_FILE"}},
+			&cli.BoolFlag{Name: "json", Usage: "print output in JSON"},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:   "daemons",
+				Usage:  "list the nydusd instances managed by snapshotter",
+				Action: listDaemons,
+			},
+			{
+				Name:   "cache",
+				Usage:  "show the blob cache usage of images",
+				Action: showCache,
+			},
+			{
+				Name:   "gc",
+				Usage:  "remove the blob caches not used by any image",
+				Action: runGC,
+			},
+			{
+				Name:  "drain",
+				Usage: "stop starting new nydusd instances, e.g. before upgrading snapshotter",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "stop", Usage: "stop draining"},
+					&cli.BoolFlag{Name: "status", Usage: "show whether snapshotter is draining only"},
+				},
+				Action: drain,
+			},
+			{
+				Name:   "flush-metrics",
+				Usage:  "collect and export the metrics of nydusd instances right now",
+				Action: flushMetrics,
+			},
+			{
+				Name:   "reads",
+				Usage:  "show the data read of images served from blob cache or fetched from storage backend",
+				Action: showReads,
+			},
+			{
+				Name:   "integrity",
+				Usage:  "show the latest digest validation failures of images",
+				Action: showIntegrity,
+			},
+			{
+				Name:   "config",
+				Usage:  "dump the effective config of snapshotter, credentials are redacted",
+				Action: dumpConfig,
+			},
+			{
+				Name:  "containerd-config",
+				Usage: "print the containerd config registering the snapshotter for the containerd version",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "containerd-version", Required: true, Usage: "version of containerd, e.g. \"1.6\", \"1.7\" or \"2.0\""},
+					&cli.StringFlag{Name: "name", Value: "nydus", Usage: "name of the snapshotter proxy plugin"},
+					&cli.StringFlag{Name: "snapshotter-address", Value: "/run/containerd-nydus-grpc/containerd-nydus-grpc.sock", Usage: "socket address the snapshotter listens on"},
+					&cli.StringFlag{Name: "platform", Value: runtime.GOOS + "/" + runtime.GOARCH, Usage: "platform unpacked by transfer service of containerd 1.7 and newer"},
+				},
+				Action: printContainerdConfig,
+			},
+			{
+				Name:  "artifact",
+				Usage: "mount RAFS data artifacts at host paths",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "ls",
+						Usage:  "list the mounted artifacts",
+						Action: listArtifacts,
+					},
+					{
+						Name:      "mount",
+						Usage:     "mount an artifact at a path under --artifact-mount-path of snapshotter",
+						ArgsUsage: "<ref> <mountpoint>",
+						Action:    mountArtifact,
+					},
+					{
+						Name:      "umount",
+						Usage:     "umount the artifact mounted at the path",
+						ArgsUsage: "<mountpoint>",
+						Action:    umountArtifact,
+					},
+				},
+			},
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,11 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+var (
+	Version = "development"
+)
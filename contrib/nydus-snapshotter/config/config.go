@@ -7,6 +7,7 @@
 package config
 
 import (
+	"os"
 	"path/filepath"
 	"time"
 
@@ -31,18 +32,76 @@ type Config struct {
 	ConvertVpcRegistry   bool          `toml:"-"`
 	DaemonCfgPath        string        `toml:"daemon_cfg_path"`
 	DaemonCfg            DaemonConfig  `toml:"-"`
+	HostConfigDir        string        `toml:"host_config_dir"`
+	SizeClassConfig      string        `toml:"size_class_config"`
+	SizeClasses          SizeClasses   `toml:"-"`
 	PublicKeyFile        string        `toml:"-"`
 	RootDir              string        `toml:"-"`
 	CacheDir             string        `toml:"cache_dir"`
 	GCPeriod             time.Duration `toml:"gc_period"`
 	ValidateSignature    bool          `toml:"validate_signature"`
+	DigestValidate       bool          `toml:"digest_validate"`
+	MergedView           bool          `toml:"merged_view"`
 	NydusdBinaryPath     string        `toml:"nydusd_binary_path"`
 	NydusImageBinaryPath string        `toml:"nydus_image_binary"`
 	DaemonMode           string        `toml:"daemon_mode"`
 	AsyncRemove          bool          `toml:"async_remove"`
 	EnableMetrics        bool          `toml:"enable_metrics"`
 	MetricsFile          string        `toml:"metrics_file"`
+	MetricsAddress       string        `toml:"metrics_address"`
+	MetricsSocketMode    os.FileMode   `toml:"metrics_socket_mode"`
+	MetricsTokenFile     string        `toml:"metrics_token_file"`
 	EnableStargz         bool          `toml:"enable_stargz"`
+	ContainerdAddress    string        `toml:"containerd_address"`
+	ContainerdVersion    string        `toml:"containerd_version"`
+	PinnedImages         []string      `toml:"pinned_images"`
+	MeasureLatency       bool          `toml:"measure_latency"`
+	// Share bootstraps with containerd by importing them to its content store
+	BootstrapContentStore bool   `toml:"bootstrap_content_store"`
+	ContentNamespace      string `toml:"content_namespace"`
+	ContainerdRoot        string `toml:"containerd_root"`
+	// Convert the images without nydus companion on node in background
+	ConvertOnNode     bool   `toml:"convert_on_node"`
+	ConvertTargetRepo string `toml:"convert_target_repo"`
+	ConvertInsecure   bool   `toml:"convert_insecure"`
+	// Report the health of snapshotter to the node object in Kubernetes
+	ReportNodeStatus   bool          `toml:"report_node_status"`
+	NodeName           string        `toml:"node_name"`
+	NodeTaint          bool          `toml:"node_taint"`
+	NodeStatusInterval time.Duration `toml:"node_status_interval"`
+	// Probe the liveness of nydusd through its API and FUSE mountpoint
+	DaemonLivenessProbe         bool          `toml:"daemon_liveness_probe"`
+	DaemonLivenessAction        string        `toml:"daemon_liveness_action"`
+	DaemonProbeInterval         time.Duration `toml:"daemon_probe_interval"`
+	DaemonProbeTimeout          time.Duration `toml:"daemon_probe_timeout"`
+	DaemonProbeFailureThreshold int           `toml:"daemon_probe_failure_threshold"`
+	// DaemonServerUIDs are the UIDs nydusd is allowed to run as, the
+	// process serving its API socket is checked by peer credentials
+	DaemonServerUIDs []uint32 `toml:"daemon_server_uids"`
+	// Serve the cached chunks only in degraded mode when the backend of
+	// nydusd keeps failing, e.g. registry is unreachable
+	DaemonDegradedMode           bool          `toml:"daemon_degraded_mode"`
+	DaemonDegradedInterval       time.Duration `toml:"daemon_degraded_interval"`
+	DaemonDegradedErrorThreshold int           `toml:"daemon_degraded_error_threshold"`
+	DaemonDegradedRetryLimit     int           `toml:"daemon_degraded_retry_limit"`
+	DaemonDegradedTimeout        time.Duration `toml:"daemon_degraded_timeout"`
+	// Serve the blob data of registry to nydusd from a node-local cache proxy
+	BlobProxyAddress   string `toml:"blob_proxy_address"`
+	BlobProxyCacheSize int64  `toml:"blob_proxy_cache_size"`
+	// Preheat the blob caches of images through management API, or by the
+	// ImagePrePull resources in Kubernetes
+	EnablePreheat      bool          `toml:"enable_preheat"`
+	PreheatConcurrency int           `toml:"preheat_concurrency"`
+	PreheatTimeout     time.Duration `toml:"preheat_timeout"`
+	PreheatInsecure    bool          `toml:"preheat_insecure"`
+	WatchImagePrePull  bool          `toml:"watch_image_prepull"`
+	// Mount RAFS data artifacts at host paths through management API
+	EnableArtifactMount bool     `toml:"enable_artifact_mount"`
+	ArtifactMountPaths  []string `toml:"artifact_mount_paths"`
+	ArtifactInsecure    bool     `toml:"artifact_insecure"`
+	// Wait for the instance running on the same root dir to exit before
+	// opening the metastores, it waits forever if it's 0
+	InstanceLockTimeout time.Duration `toml:"instance_lock_timeout"`
 }
 
 func (c *Config) FillupWithDefaults() error {
@@ -50,6 +109,10 @@ func (c *Config) FillupWithDefaults() error {
 		c.DaemonCfgPath = defaultNydusDaemonConfigPath
 	}
 
+	if c.HostConfigDir == "" {
+		c.HostConfigDir = DefaultHostConfigDir
+	}
+
 	if c.NydusdBinaryPath == "" {
 		c.NydusdBinaryPath = defaultNydusdBinaryPath
 	}
@@ -74,5 +137,12 @@ func (c *Config) FillupWithDefaults() error {
 		return errors.Wrapf(err, "failed to load config file %q", c.DaemonCfgPath)
 	}
 	c.DaemonCfg = daemonCfg
+	if c.SizeClassConfig != "" {
+		classes, err := LoadSizeClasses(c.SizeClassConfig)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load size classes %q", c.SizeClassConfig)
+		}
+		c.SizeClasses = classes
+	}
 	return nil
 }
@@ -15,6 +15,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/auth"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/utils/registry"
 )
 
@@ -25,6 +26,8 @@ const (
 )
 
 type DaemonConfig struct {
+	// Version is the schema version of stored config, see ConfigVersion
+	Version        int          `json:"version,omitempty"`
 	Device         DeviceConfig `json:"device"`
 	Mode           string       `json:"mode"`
 	DigestValidate bool         `json:"digest_validate"`
@@ -63,6 +66,7 @@ type DeviceConfig struct {
 
 			// Shared by registry and oss backend
 			Scheme        string `json:"scheme,omitempty"`
+			SkipVerify    bool   `json:"skip_verify,omitempty"`
 
 			// Below configs are common configs shared by all backends
 			Proxy         struct {
@@ -85,30 +89,47 @@ type DeviceConfig struct {
 	} `json:"cache"`
 }
 
+// LoadConfig loads the config in any supported version, the config of
+// older version is migrated to ConfigVersion in memory.
 func LoadConfig(configFile string, cfg *DaemonConfig) error {
-	b, err := ioutil.ReadFile(configFile)
+	raw, err := readRawConfig(configFile)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(b, cfg); err != nil {
+	if _, err := migrateRawConfig(raw); err != nil {
+		return errors.Wrapf(err, "failed to migrate config %s", configFile)
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
 		return err
 	}
-	return nil
+	return json.Unmarshal(b, cfg)
 }
 
+// SaveConfig saves the generated config stamped with ConfigVersion.
 func SaveConfig(c DaemonConfig, configFile string) error {
+	c.Version = ConfigVersion
 	b, err := json.Marshal(c)
 	if err != nil {
-		return nil
+		return err
 	}
 	return ioutil.WriteFile(configFile, b, 0755)
 }
 
-func NewDaemonConfig(cfg DaemonConfig, imageID string, vpcRegistry bool, labels map[string]string) (DaemonConfig, error) {
+// NewDaemonConfig generates the nydusd config of image from cfg, or from
+// the template of image's registry host in hostConfigDir if there is one.
+func NewDaemonConfig(cfg DaemonConfig, imageID string, vpcRegistry bool, labels map[string]string, hostConfigDir string) (DaemonConfig, error) {
 	image, err := registry.ParseImage(imageID)
 	if err != nil {
 		return DaemonConfig{}, errors.Wrapf(err, "failed to parse image %s", imageID)
 	}
+	found, err := LoadHostConfig(hostConfigDir, image.Host, &cfg)
+	if err != nil {
+		return DaemonConfig{}, err
+	}
+	if found {
+		logging.Config.L().Debugf("use config template of host %s for image %s", image.Host, imageID)
+	}
 
 	switch backend := cfg.Device.Backend.BackendType; backend {
 	case backendTypeRegistry:
@@ -116,11 +137,13 @@ func NewDaemonConfig(cfg DaemonConfig, imageID string, vpcRegistry bool, labels
 		if vpcRegistry {
 			registryHost = registry.ConvertToVPCHost(registryHost)
 		}
+		// The credentials in labels take precedence over the static ones
+		// in template, e.g. in the template of a private registry host
 		keyChain := auth.FromLabels(labels)
 		if keyChain.TokenBase() {
 			cfg.Device.Backend.Config.RegistryToken = keyChain.Password
-		} else {
-			cfg.Device.Backend.Config.Auth = keyChain.ToBase64()
+		} else if encoded := keyChain.ToBase64(); encoded != "" || !found {
+			cfg.Device.Backend.Config.Auth = encoded
 		}
 		cfg.Device.Backend.Config.Host = registryHost
 		cfg.Device.Backend.Config.Repo = image.Repo
@@ -130,6 +153,8 @@ func NewDaemonConfig(cfg DaemonConfig, imageID string, vpcRegistry bool, labels
 	default:
 		return DaemonConfig{}, errors.New(fmt.Sprintf("unknown backend type %s", backend))
 	}
+	logging.Config.L().Debugf("generated nydusd config of image %s with %s backend, host %s, repo %s",
+		imageID, cfg.Device.Backend.BackendType, cfg.Device.Backend.Config.Host, cfg.Device.Backend.Config.Repo)
 
 	return cfg, nil
 }
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultHostConfigDir string = "/etc/nydus/certs.d"
+
+	hostConfigFile = "config.json"
+)
+
+// hostConfigPath returns the path of config template for registry host in
+// the layout of `<dir>/<host>/config.json`, the host includes the port if
+// any, e.g. `/etc/nydus/certs.d/localhost:5000/config.json`.
+func hostConfigPath(dir, host string) (string, error) {
+	if host == "" || host == "." || host == ".." || strings.ContainsAny(host, `/\`) {
+		return "", errors.Errorf("invalid registry host %q", host)
+	}
+	return filepath.Join(dir, host, hostConfigFile), nil
+}
+
+// LoadHostConfig loads the config template of registry host from dir, it
+// returns false if the host has no template, so that the default template
+// is used.
+func LoadHostConfig(dir, host string, cfg *DaemonConfig) (bool, error) {
+	if dir == "" {
+		return false, nil
+	}
+	configFile, err := hostConfigPath(dir, host)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to stat config of host %s", host)
+	}
+
+	var hostCfg DaemonConfig
+	if err := LoadConfig(configFile, &hostCfg); err != nil {
+		return false, errors.Wrapf(err, "failed to load config of host %s", host)
+	}
+	*cfg = hostCfg
+	return true, nil
+}
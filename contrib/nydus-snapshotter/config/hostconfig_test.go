@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+const hostConfig = `{
+  "device": {
+    "backend": {
+      "type": "registry",
+      "config": {
+        "scheme": "http",
+        "skip_verify": true,
+        "auth": "dXNlcjpwYXNz",
+        "proxy": {
+          "url": "http://mirror.example.com:65001",
+          "fallback": true
+        }
+      }
+    },
+    "cache": {
+      "type": "blobcache",
+      "config": {
+        "work_dir": "/cache"
+      }
+    }
+  },
+  "mode": "direct"
+}`
+
+func TestNewDaemonConfigWithHostConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-host-config-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hostDir := filepath.Join(dir, "localhost:5000")
+	require.Nil(t, os.MkdirAll(hostDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(hostDir, "config.json"), []byte(hostConfig), 0644))
+
+	var defaultCfg DaemonConfig
+	defaultCfg.Device.Backend.BackendType = backendTypeRegistry
+	defaultCfg.Device.Backend.Config.Scheme = "https"
+
+	// The template of image's registry host is used with static credentials
+	cfg, err := NewDaemonConfig(defaultCfg, "localhost:5000/app:latest", false, map[string]string{}, dir)
+	require.Nil(t, err)
+	assert.Equal(t, "http", cfg.Device.Backend.Config.Scheme)
+	assert.True(t, cfg.Device.Backend.Config.SkipVerify)
+	assert.Equal(t, "http://mirror.example.com:65001", cfg.Device.Backend.Config.Proxy.URL)
+	assert.Equal(t, "localhost:5000", cfg.Device.Backend.Config.Host)
+	assert.Equal(t, "app", cfg.Device.Backend.Config.Repo)
+	assert.Equal(t, "dXNlcjpwYXNz", cfg.Device.Backend.Config.Auth)
+
+	// The credentials in labels take precedence
+	cfg, err = NewDaemonConfig(defaultCfg, "localhost:5000/app:latest", false, map[string]string{
+		label.ImagePullUsername: "foo",
+		label.ImagePullSecret:   "bar",
+	}, dir)
+	require.Nil(t, err)
+	assert.Equal(t, "Zm9vOmJhcg==", cfg.Device.Backend.Config.Auth)
+
+	// The other hosts use the default template
+	cfg, err = NewDaemonConfig(defaultCfg, "docker.io/library/busybox:latest", false, map[string]string{}, dir)
+	require.Nil(t, err)
+	assert.Equal(t, "https", cfg.Device.Backend.Config.Scheme)
+	assert.False(t, cfg.Device.Backend.Config.SkipVerify)
+	assert.Equal(t, "docker.io", cfg.Device.Backend.Config.Host)
+
+	// Broken template fails the generation rather than falling back silently
+	require.Nil(t, ioutil.WriteFile(filepath.Join(hostDir, "config.json"), []byte("{"), 0644))
+	_, err = NewDaemonConfig(defaultCfg, "localhost:5000/app:latest", false, map[string]string{}, dir)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ConfigVersion is the schema version of the nydusd config generated by
+// this release, it's bumped together with a migration from the previous
+// version whenever the format of stored config changes.
+const ConfigVersion = 1
+
+// The configs written by the releases before the schema version is
+// introduced have no `version` field, they are regarded as version 0.
+const legacyConfigVersion = 0
+
+// migration rewrites the raw config of version N to version N+1 in place,
+// the config is kept as raw JSON object so that the fields unknown to this
+// release are preserved.
+type migration func(raw map[string]interface{}) error
+
+// migrations are indexed by the version they migrate from.
+var migrations = map[int]migration{
+	// Version 1 only stamps the schema version, the format is unchanged
+	legacyConfigVersion: func(raw map[string]interface{}) error { return nil },
+}
+
+func rawConfigVersion(raw map[string]interface{}) (int, error) {
+	value, ok := raw["version"]
+	if !ok {
+		return legacyConfigVersion, nil
+	}
+	version, ok := value.(float64)
+	if !ok || version < 0 || version != float64(int(version)) {
+		return 0, fmt.Errorf("invalid config version %v", value)
+	}
+	return int(version), nil
+}
+
+// migrateRawConfig migrates the raw config to ConfigVersion, it returns
+// false if the config is in ConfigVersion already.
+func migrateRawConfig(raw map[string]interface{}) (bool, error) {
+	version, err := rawConfigVersion(raw)
+	if err != nil {
+		return false, err
+	}
+	if version > ConfigVersion {
+		return false, fmt.Errorf("config version %d is newer than supported version %d", version, ConfigVersion)
+	}
+	if version == ConfigVersion {
+		return false, nil
+	}
+	for ; version < ConfigVersion; version++ {
+		migrate, ok := migrations[version]
+		if !ok {
+			return false, fmt.Errorf("no migration from config version %d", version)
+		}
+		if err := migrate(raw); err != nil {
+			return false, errors.Wrapf(err, "failed to migrate config from version %d", version)
+		}
+		raw["version"] = version + 1
+	}
+	return true, nil
+}
+
+func readRawConfig(configFile string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config %s", configFile)
+	}
+	return raw, nil
+}
+
+// writeConfigFile replaces configFile atomically, so that a crash during
+// rewriting never leaves a truncated config.
+func writeConfigFile(configFile string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(configFile), filepath.Base(configFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configFile)
+}
+
+// MigrateConfig rewrites the stored nydusd config written by an older
+// release to ConfigVersion, it's called on recovery after upgrading the
+// snapshotter. It returns false if the config doesn't exist or is in
+// ConfigVersion already.
+func MigrateConfig(configFile string) (bool, error) {
+	raw, err := readRawConfig(configFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	migrated, err := migrateRawConfig(raw)
+	if err != nil || !migrated {
+		return false, err
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return false, err
+	}
+	if err := writeConfigFile(configFile, b); err != nil {
+		return false, errors.Wrapf(err, "failed to rewrite config %s", configFile)
+	}
+	return true, nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The config written by the releases before the schema version is introduced
+const legacyConfig = `{
+  "device": {
+    "backend": {
+      "type": "registry",
+      "config": {
+        "host": "docker.io",
+        "repo": "library/busybox",
+        "readahead": false
+      }
+    },
+    "cache": {
+      "type": "blobcache",
+      "config": {
+        "work_dir": "/cache"
+      }
+    }
+  },
+  "mode": "direct",
+  "digest_validate": false,
+  "latest_read_files": true
+}`
+
+func TestMigrateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-config-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.json")
+	require.Nil(t, ioutil.WriteFile(configFile, []byte(legacyConfig), 0755))
+
+	migrated, err := MigrateConfig(configFile)
+	require.Nil(t, err)
+	assert.True(t, migrated)
+
+	// The fields unknown to this release are preserved
+	b, err := ioutil.ReadFile(configFile)
+	require.Nil(t, err)
+	var raw map[string]interface{}
+	require.Nil(t, json.Unmarshal(b, &raw))
+	assert.Equal(t, float64(ConfigVersion), raw["version"])
+	assert.Equal(t, true, raw["latest_read_files"])
+
+	var cfg DaemonConfig
+	require.Nil(t, LoadConfig(configFile, &cfg))
+	assert.Equal(t, ConfigVersion, cfg.Version)
+	assert.Equal(t, "docker.io", cfg.Device.Backend.Config.Host)
+
+	// The config in current version isn't rewritten
+	migrated, err = MigrateConfig(configFile)
+	require.Nil(t, err)
+	assert.False(t, migrated)
+
+	// Nothing to migrate for the daemon without config
+	migrated, err = MigrateConfig(filepath.Join(dir, "nonexistent.json"))
+	require.Nil(t, err)
+	assert.False(t, migrated)
+}
+
+func TestLoadLegacyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-config-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The legacy config is migrated in memory without rewriting
+	configFile := filepath.Join(dir, "config.json")
+	require.Nil(t, ioutil.WriteFile(configFile, []byte(legacyConfig), 0755))
+	var cfg DaemonConfig
+	require.Nil(t, LoadConfig(configFile, &cfg))
+	assert.Equal(t, ConfigVersion, cfg.Version)
+	assert.Equal(t, "library/busybox", cfg.Device.Backend.Config.Repo)
+	b, err := ioutil.ReadFile(configFile)
+	require.Nil(t, err)
+	assert.Equal(t, legacyConfig, string(b))
+
+	// The saved config is stamped with current version
+	cfg.Version = 0
+	require.Nil(t, SaveConfig(cfg, configFile))
+	var saved DaemonConfig
+	require.Nil(t, LoadConfig(configFile, &saved))
+	assert.Equal(t, ConfigVersion, saved.Version)
+}
+
+func TestMigrateRawConfig(t *testing.T) {
+	_, err := migrateRawConfig(map[string]interface{}{"version": float64(ConfigVersion + 1)})
+	assert.NotNil(t, err)
+
+	_, err = migrateRawConfig(map[string]interface{}{"version": "1"})
+	assert.NotNil(t, err)
+
+	_, err = migrateRawConfig(map[string]interface{}{"version": 1.5})
+	assert.NotNil(t, err)
+
+	raw := map[string]interface{}{}
+	migrated, err := migrateRawConfig(raw)
+	require.Nil(t, err)
+	assert.True(t, migrated)
+	assert.Equal(t, ConfigVersion, raw["version"])
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package config
+
+import (
+	"strconv"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+)
+
+// The readahead policies of image selected by label.NydusReadahead, which
+// are presets of the merging size.
+const (
+	// ReadaheadSequential merges the continuous chunks into requests of
+	// MaxMergingSize, e.g. for database images scanning large files.
+	ReadaheadSequential = "sequential"
+	// ReadaheadRandom fetches the chunks one by one without merging, e.g.
+	// for interpreter-heavy images reading many small files.
+	ReadaheadRandom = "random"
+)
+
+// MaxMergingSize is the largest fs_prefetch.merging_size accepted by nydusd,
+// which is the chunk size of RAFS.
+const MaxMergingSize = 0x100000
+
+// ApplyMergingSize overrides the merging size of nydusd config by the
+// readahead policy and merging size in labels of nydus meta layer, the
+// merging size takes precedence over the policy. The invalid labels are
+// ignored with warning rather than failing the mount. The merging size is
+// the only readahead knob of nydusd, which doesn't detect sequential reads.
+func ApplyMergingSize(labels map[string]string, cfg *DaemonConfig) {
+	switch policy := labels[label.NydusReadahead]; policy {
+	case "":
+	case ReadaheadSequential:
+		cfg.FSPrefetch.MergingSize = MaxMergingSize
+	case ReadaheadRandom:
+		cfg.FSPrefetch.MergingSize = 0
+	default:
+		logging.Config.L().Warnf("ignore unknown readahead policy %q in label %s", policy, label.NydusReadahead)
+	}
+
+	value, ok := labels[label.NydusMergingSize]
+	if !ok {
+		return
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 || size > MaxMergingSize {
+		logging.Config.L().Warnf("ignore invalid merging size %q in label %s, should be between 0 and %d",
+			value, label.NydusMergingSize, MaxMergingSize)
+		return
+	}
+	cfg.FSPrefetch.MergingSize = size
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+func TestApplyMergingSize(t *testing.T) {
+	mergingSize := func(labels map[string]string) int {
+		var cfg DaemonConfig
+		cfg.FSPrefetch.MergingSize = 131072
+		ApplyMergingSize(labels, &cfg)
+		return cfg.FSPrefetch.MergingSize
+	}
+
+	assert.Equal(t, 131072, mergingSize(map[string]string{}))
+	assert.Equal(t, MaxMergingSize, mergingSize(map[string]string{label.NydusReadahead: ReadaheadSequential}))
+	assert.Equal(t, 0, mergingSize(map[string]string{label.NydusReadahead: ReadaheadRandom}))
+	assert.Equal(t, 262144, mergingSize(map[string]string{label.NydusMergingSize: "262144"}))
+	// The merging size takes precedence over policy
+	assert.Equal(t, 4096, mergingSize(map[string]string{
+		label.NydusReadahead:   ReadaheadSequential,
+		label.NydusMergingSize: "4096",
+	}))
+
+	// The invalid labels are ignored
+	assert.Equal(t, 131072, mergingSize(map[string]string{label.NydusReadahead: "adaptive"}))
+	assert.Equal(t, 131072, mergingSize(map[string]string{label.NydusMergingSize: "2097152"}))
+	assert.Equal(t, 131072, mergingSize(map[string]string{label.NydusMergingSize: "-1"}))
+	assert.Equal(t, MaxMergingSize, mergingSize(map[string]string{
+		label.NydusReadahead:   ReadaheadSequential,
+		label.NydusMergingSize: "1MiB",
+	}))
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+// SizeClass tunes the IO concurrency of nydusd for the images not smaller
+// than MinSize, so that the large images, e.g. AI models, get more FUSE
+// threads and prefetch workers than the small ones. The zero values keep
+// the settings of default config.
+type SizeClass struct {
+	Name string `json:"name"`
+	// MinSize is the minimal total size of blobs in the image, in bytes.
+	MinSize int64 `json:"min_size"`
+	// FuseThreads is the number of FUSE threads of nydusd, it only takes
+	// effect in multiple daemon mode, as the shared daemon serves images
+	// of all classes.
+	FuseThreads int `json:"fuse_threads,omitempty"`
+	// PrefetchThreads and MergingSize are fs_prefetch.threads_count and
+	// fs_prefetch.merging_size of nydusd config.
+	PrefetchThreads int `json:"prefetch_threads,omitempty"`
+	MergingSize     int `json:"merging_size,omitempty"`
+	// DigestValidate makes nydusd validate the digest of chunks read from
+	// blob cache or storage backend, it only enables the validation for the
+	// class, the default config is kept otherwise.
+	DigestValidate bool `json:"digest_validate,omitempty"`
+}
+
+// SizeClasses are sorted by MinSize.
+type SizeClasses []SizeClass
+
+// LoadSizeClasses loads the size classes from a JSON array.
+func LoadSizeClasses(file string) (SizeClasses, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var classes SizeClasses
+	if err := json.Unmarshal(b, &classes); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse size classes %s", file)
+	}
+
+	names := make(map[string]bool)
+	for _, class := range classes {
+		if class.Name == "" || names[class.Name] {
+			return nil, errors.Errorf("empty or duplicated name of size class %q", class.Name)
+		}
+		names[class.Name] = true
+		if class.MinSize < 0 || class.FuseThreads < 0 || class.PrefetchThreads < 0 || class.MergingSize < 0 {
+			return nil, errors.Errorf("negative setting in size class %s", class.Name)
+		}
+		if class.MergingSize > MaxMergingSize {
+			return nil, errors.Errorf("merging size of size class %s exceeds %d", class.Name, MaxMergingSize)
+		}
+	}
+	sort.SliceStable(classes, func(i, j int) bool {
+		return classes[i].MinSize < classes[j].MinSize
+	})
+	return classes, nil
+}
+
+// Match returns the largest class the image fits in by the image size in
+// labels of nydus meta layer, it returns nil if the image has no size,
+// e.g. converted by the older nydusify, or is smaller than all classes.
+func (classes SizeClasses) Match(labels map[string]string) *SizeClass {
+	size, err := strconv.ParseInt(labels[label.NydusImageSize], 10, 64)
+	if err != nil {
+		return nil
+	}
+	var matched *SizeClass
+	for idx := range classes {
+		if classes[idx].MinSize > size {
+			break
+		}
+		matched = &classes[idx]
+	}
+	return matched
+}
+
+// Apply overrides the prefetch and digest validation settings of nydusd
+// config.
+func (c *SizeClass) Apply(cfg *DaemonConfig) {
+	if c == nil {
+		return
+	}
+	if c.PrefetchThreads > 0 {
+		cfg.FSPrefetch.ThreadsCount = c.PrefetchThreads
+	}
+	if c.MergingSize > 0 {
+		cfg.FSPrefetch.MergingSize = c.MergingSize
+	}
+	if c.DigestValidate {
+		cfg.DigestValidate = true
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+func TestSizeClasses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-size-class-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "size-classes.json")
+	require.Nil(t, ioutil.WriteFile(file, []byte(`[
+  {"name": "large", "min_size": 10737418240, "fuse_threads": 32, "prefetch_threads": 16, "merging_size": 1048576, "digest_validate": true},
+  {"name": "small", "min_size": 0, "fuse_threads": 4},
+  {"name": "medium", "min_size": 1073741824, "fuse_threads": 10, "prefetch_threads": 8}
+]`), 0644))
+	classes, err := LoadSizeClasses(file)
+	require.Nil(t, err)
+	require.Len(t, classes, 3)
+
+	match := func(size string) string {
+		class := classes.Match(map[string]string{label.NydusImageSize: size})
+		if class == nil {
+			return ""
+		}
+		return class.Name
+	}
+	assert.Equal(t, "small", match("1024"))
+	assert.Equal(t, "medium", match("1073741824"))
+	assert.Equal(t, "large", match("107374182400"))
+	assert.Equal(t, "", match(""))
+	assert.Nil(t, classes[1:].Match(map[string]string{label.NydusImageSize: "1024"}))
+
+	var cfg DaemonConfig
+	cfg.FSPrefetch.ThreadsCount = 4
+	cfg.FSPrefetch.MergingSize = 131072
+	classes.Match(map[string]string{label.NydusImageSize: "2147483648"}).Apply(&cfg)
+	assert.Equal(t, 8, cfg.FSPrefetch.ThreadsCount)
+	assert.Equal(t, 131072, cfg.FSPrefetch.MergingSize)
+	assert.False(t, cfg.DigestValidate)
+	// No class changes nothing
+	classes.Match(map[string]string{}).Apply(&cfg)
+	assert.Equal(t, 8, cfg.FSPrefetch.ThreadsCount)
+	classes.Match(map[string]string{label.NydusImageSize: "107374182400"}).Apply(&cfg)
+	assert.True(t, cfg.DigestValidate)
+
+	for _, content := range []string{
+		`[{"name": "small"}, {"name": "small", "min_size": 1}]`,
+		`[{"name": "small", "fuse_threads": -1}]`,
+		`[{"name": "small", "merging_size": 2097152}]`,
+		`{"name": "small"}`,
+	} {
+		require.Nil(t, ioutil.WriteFile(file, []byte(content), 0644))
+		_, err := LoadSizeClasses(file)
+		assert.NotNil(t, err)
+	}
+}
@@ -25,6 +25,9 @@ func init() {
 			if cfg.RootDir == "" {
 				cfg.RootDir = ic.Root
 			}
+			if cfg.ContainerdAddress == "" {
+				cfg.ContainerdAddress = ic.Address
+			}
 			if err := cfg.FillupWithDefaults(); err != nil {
 				return nil, errors.New("failed to fillup nydus configuration with defaults")
 			}
@@ -0,0 +1,387 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package artifact mounts RAFS data artifacts, e.g. the models and datasets
+// packed by `nydusify pack`, to host paths outside the snapshot lifecycle,
+// so that pods reference them by hostPath or CSI volume and load the data
+// lazily. Each artifact is served by a dedicated nydusd, the mounts are
+// persisted and recovered when snapshotter restarts.
+package artifact
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/cache"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+)
+
+const (
+	stateFileName     = "mounts.json"
+	bootstrapFileName = "artifact.boot"
+	configFileName    = "config.json"
+	// cacheKeyPrefix prefixes the mountpoint as the image ID of artifact
+	// tracked by cache manager.
+	cacheKeyPrefix = "artifact:"
+)
+
+var (
+	// ErrNotFound is returned if there is no artifact mounted at the path.
+	ErrNotFound = errors.New("artifact mount not found")
+	// ErrAlreadyMounted is returned if an artifact is mounted at the path.
+	ErrAlreadyMounted = errors.New("artifact is already mounted at the path")
+	// ErrInvalidArgument is returned if the reference or mountpoint of
+	// artifact is invalid.
+	ErrInvalidArgument = errors.New("invalid argument")
+)
+
+// Mount is an artifact mounted at host path.
+type Mount struct {
+	ID         string    `json:"id"`
+	Ref        string    `json:"ref"`
+	Mountpoint string    `json:"mountpoint"`
+	Pid        int       `json:"pid"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Opt struct {
+	// RootDir holds the bootstraps, configs and API sockets of the nydusd
+	// serving artifacts, and the state of mounts.
+	RootDir    string
+	NydusdPath string
+	Insecure   bool
+	// DaemonConfig generates the nydusd config of artifact.
+	DaemonConfig func(ref string) (config.DaemonConfig, error)
+	// CacheManager tracks the blob caches of mounted artifacts for GC,
+	// it's optional.
+	CacheManager *cache.Manager
+	// AllowedPaths are the directories under which artifacts are allowed
+	// to be mounted.
+	AllowedPaths []string
+}
+
+// mounted is a mounted artifact and its nydusd.
+type mounted struct {
+	Mount
+	daemon *daemon
+}
+
+// Manager mounts and umounts artifacts.
+type Manager struct {
+	Opt
+	// pull pulls the bootstrap of artifact to target and returns its blob
+	// IDs, replaced in tests.
+	pull func(ctx context.Context, ref, target string) ([]string, error)
+	// start starts the nydusd with the bootstrap and config in dir, and
+	// waits until it's running, replaced in tests.
+	start func(ctx context.Context, dir, mountpoint string) (*daemon, error)
+
+	mu     sync.Mutex
+	mounts map[string]*mounted
+	// pending are the mountpoints reserved by the mounts in progress.
+	pending map[string]bool
+}
+
+// New creates an artifact manager, the persisted mounts are recovered, and
+// the nydusd of them are restarted if not alive.
+func New(ctx context.Context, opt Opt) (*Manager, error) {
+	m, err := newManager(opt)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.recover(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func newManager(opt Opt) (*Manager, error) {
+	if opt.RootDir == "" {
+		return nil, errors.New("root dir is required")
+	}
+	if opt.NydusdPath == "" {
+		return nil, errors.New("nydusd binary path is required")
+	}
+	if opt.DaemonConfig == nil {
+		return nil, errors.New("daemon config generator is required")
+	}
+	if len(opt.AllowedPaths) == 0 {
+		return nil, errors.New("allowed paths are required")
+	}
+	for idx, path := range opt.AllowedPaths {
+		if !filepath.IsAbs(path) {
+			return nil, errors.Errorf("allowed path %s is not absolute", path)
+		}
+		opt.AllowedPaths[idx] = filepath.Clean(path)
+	}
+	if err := os.MkdirAll(opt.RootDir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create root dir %s", opt.RootDir)
+	}
+
+	m := &Manager{
+		Opt:     opt,
+		mounts:  make(map[string]*mounted),
+		pending: make(map[string]bool),
+	}
+	m.pull = m.pullBootstrap
+	m.start = m.startDaemon
+	return m, nil
+}
+
+func (m *Manager) dir(id string) string {
+	return filepath.Join(m.RootDir, id)
+}
+
+// recover loads the persisted mounts, the nydusd still alive are adopted,
+// and the others are restarted with the saved bootstrap and config.
+func (m *Manager) recover(ctx context.Context) error {
+	data, err := ioutil.ReadFile(filepath.Join(m.RootDir, stateFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read artifact mounts")
+	}
+	var mounts []Mount
+	if err := json.Unmarshal(data, &mounts); err != nil {
+		return errors.Wrap(err, "failed to unmarshal artifact mounts")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, saved := range mounts {
+		if saved.Pid > 0 && syscall.Kill(saved.Pid, 0) == nil {
+			m.mounts[saved.Mountpoint] = &mounted{Mount: saved, daemon: &daemon{pid: saved.Pid}}
+			logging.Artifact.L().Infof("recovered artifact %s mounted at %s", saved.Ref, saved.Mountpoint)
+			continue
+		}
+		// The stale FUSE mount left by the dead nydusd is replaced
+		umount(saved.Mountpoint)
+		d, err := m.start(ctx, m.dir(saved.ID), saved.Mountpoint)
+		if err != nil {
+			logging.Artifact.L().WithError(err).Errorf("failed to remount artifact %s at %s", saved.Ref, saved.Mountpoint)
+			m.release(&saved)
+			continue
+		}
+		saved.Pid = d.pid
+		m.mounts[saved.Mountpoint] = &mounted{Mount: saved, daemon: d}
+		logging.Artifact.L().Infof("remounted artifact %s at %s", saved.Ref, saved.Mountpoint)
+	}
+	return m.save()
+}
+
+// save persists the mounts, it's called with lock held.
+func (m *Manager) save() error {
+	mounts := m.list()
+	data, err := json.Marshal(mounts)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal artifact mounts")
+	}
+	path := filepath.Join(m.RootDir, stateFileName)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write artifact mounts")
+	}
+	return errors.Wrap(os.Rename(path+".tmp", path), "failed to save artifact mounts")
+}
+
+// resolvePath resolves the symlinks of the deepest existing ancestor of
+// path, the components not existing yet are appended as they are.
+func resolvePath(path string) (string, error) {
+	existing, rest := path, ""
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, rest), nil
+}
+
+// validateMountpoint returns the clean mountpoint if it's under one of the
+// allowed paths. The mountpoint is created and mounted by following the
+// symlinks, so its components under the allowed path mustn't be symlinks.
+func (m *Manager) validateMountpoint(mountpoint string) (string, error) {
+	if !filepath.IsAbs(mountpoint) {
+		return "", errors.Wrapf(ErrInvalidArgument, "mountpoint %s is not absolute", mountpoint)
+	}
+	mountpoint = filepath.Clean(mountpoint)
+	resolved, err := resolvePath(mountpoint)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve mountpoint %s", mountpoint)
+	}
+	for _, allowed := range m.AllowedPaths {
+		if !strings.HasPrefix(mountpoint, allowed+string(filepath.Separator)) {
+			continue
+		}
+		resolvedAllowed, err := resolvePath(allowed)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to resolve allowed path %s", allowed)
+		}
+		if resolved != filepath.Join(resolvedAllowed, strings.TrimPrefix(mountpoint, allowed)) {
+			return "", errors.Wrapf(ErrInvalidArgument, "mountpoint %s is resolved to %s by symlinks", mountpoint, resolved)
+		}
+		return mountpoint, nil
+	}
+	return "", errors.Wrapf(ErrInvalidArgument, "mountpoint %s is not under allowed paths %v", mountpoint, m.AllowedPaths)
+}
+
+// Mount mounts the artifact of ref at mountpoint, the mountpoint is created
+// if it doesn't exist. The lock is only held to reserve the mountpoint, so
+// the other mounts aren't blocked by pulling the artifact and starting its
+// nydusd.
+func (m *Manager) Mount(ctx context.Context, ref, mountpoint string) (*Mount, error) {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidArgument, "invalid artifact reference %s: %v", ref, err)
+	}
+	ref = named.String()
+	mountpoint, err = m.validateMountpoint(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if _, ok := m.mounts[mountpoint]; ok || m.pending[mountpoint] {
+		m.mu.Unlock()
+		return nil, ErrAlreadyMounted
+	}
+	m.pending[mountpoint] = true
+	m.mu.Unlock()
+
+	mnt := Mount{
+		ID:         digest.FromString(mountpoint).Hex()[:16],
+		Ref:        ref,
+		Mountpoint: mountpoint,
+		CreatedAt:  time.Now().UTC(),
+	}
+	d, err := m.mount(ctx, &mnt)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, mountpoint)
+	if err != nil {
+		m.release(&mnt)
+		return nil, err
+	}
+	mnt.Pid = d.pid
+	m.mounts[mountpoint] = &mounted{Mount: mnt, daemon: d}
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+	logging.Artifact.L().Infof("mounted artifact %s at %s", ref, mountpoint)
+
+	copied := mnt
+	return &copied, nil
+}
+
+func (m *Manager) mount(ctx context.Context, mnt *Mount) (*daemon, error) {
+	dir := m.dir(mnt.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(mnt.Mountpoint, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create mountpoint %s", mnt.Mountpoint)
+	}
+	// The symlinks may be created during validation and creation
+	if _, err := m.validateMountpoint(mnt.Mountpoint); err != nil {
+		return nil, err
+	}
+
+	blobs, err := m.pull(ctx, mnt.Ref, filepath.Join(dir, bootstrapFileName))
+	if err != nil {
+		return nil, err
+	}
+	if m.CacheManager != nil {
+		if err := m.CacheManager.AddSnapshot(cacheKeyPrefix+mnt.Mountpoint, blobs); err != nil {
+			return nil, errors.Wrapf(err, "failed to add blob caches of artifact %s", mnt.Ref)
+		}
+	}
+
+	cfg, err := m.DaemonConfig(mnt.Ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate nydusd config of artifact %s", mnt.Ref)
+	}
+	// The data is loaded on demand by the workloads reading it
+	cfg.FSPrefetch.Enable = false
+	if err := config.SaveConfig(cfg, filepath.Join(dir, configFileName)); err != nil {
+		return nil, errors.Wrap(err, "failed to save nydusd config")
+	}
+
+	return m.start(ctx, dir, mnt.Mountpoint)
+}
+
+// release removes the files and blob cache references of mount.
+func (m *Manager) release(mnt *Mount) {
+	if m.CacheManager != nil {
+		if err := m.CacheManager.DelSnapshot(cacheKeyPrefix + mnt.Mountpoint); err != nil {
+			logging.Artifact.L().WithError(err).Warnf("failed to delete blob caches of artifact %s", mnt.Ref)
+		}
+	}
+	os.RemoveAll(m.dir(mnt.ID))
+	os.Remove(filepath.Join(m.RootDir, mnt.ID+".log"))
+	// Only the empty mountpoint is removed
+	os.Remove(mnt.Mountpoint)
+}
+
+// Umount stops the nydusd serving the artifact mounted at mountpoint.
+func (m *Manager) Umount(mountpoint string) error {
+	mountpoint = filepath.Clean(mountpoint)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mnt, ok := m.mounts[mountpoint]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := mnt.daemon.stop(); err != nil {
+		return errors.Wrapf(err, "failed to stop nydusd %d", mnt.Pid)
+	}
+	umount(mountpoint)
+	delete(m.mounts, mountpoint)
+	m.release(&mnt.Mount)
+	logging.Artifact.L().Infof("umounted artifact %s from %s", mnt.Ref, mountpoint)
+	return m.save()
+}
+
+// List returns the mounted artifacts ordered by mountpoint.
+func (m *Manager) List() []Mount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.list()
+}
+
+func (m *Manager) list() []Mount {
+	mounts := make([]Mount, 0, len(m.mounts))
+	for _, mnt := range m.mounts {
+		mounts = append(mounts, mnt.Mount)
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Mountpoint < mounts[j].Mountpoint
+	})
+	return mounts
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package artifact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+)
+
+func newOpt(dir string) Opt {
+	return Opt{
+		RootDir:    filepath.Join(dir, "root"),
+		NydusdPath: filepath.Join(dir, "nydusd"),
+		DaemonConfig: func(ref string) (config.DaemonConfig, error) {
+			return config.DaemonConfig{}, nil
+		},
+		AllowedPaths: []string{filepath.Join(dir, "models")},
+	}
+}
+
+// newFakeManager creates a manager serving artifacts by sleep processes,
+// and recovers the persisted mounts.
+func newFakeManager(t *testing.T, dir string) *Manager {
+	m, err := newManager(newOpt(dir))
+	require.Nil(t, err)
+	m.pull = func(ctx context.Context, ref, target string) ([]string, error) {
+		return []string{"blob"}, ioutil.WriteFile(target, []byte(ref), 0600)
+	}
+	m.start = func(ctx context.Context, dir, mountpoint string) (*daemon, error) {
+		if _, err := os.Stat(filepath.Join(dir, bootstrapFileName)); err != nil {
+			return nil, err
+		}
+		return spawn(exec.Command("sleep", "60"))
+	}
+	require.Nil(t, m.recover(context.Background()))
+	return m
+}
+
+func TestManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-artifact-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = New(context.Background(), Opt{RootDir: dir, NydusdPath: "/bin/nydusd"})
+	assert.NotNil(t, err)
+	opt := newOpt(dir)
+	opt.AllowedPaths = []string{"models"}
+	_, err = New(context.Background(), opt)
+	assert.NotNil(t, err)
+
+	m := newFakeManager(t, dir)
+	ctx := context.Background()
+	mountpoint := filepath.Join(dir, "models", "bert")
+
+	for _, invalid := range [][2]string{
+		{"INVALID", mountpoint},
+		{"models/bert:v1", "models/bert"},
+		{"models/bert:v1", filepath.Join(dir, "models")},
+		{"models/bert:v1", filepath.Join(dir, "models", "..", "etc")},
+	} {
+		_, err = m.Mount(ctx, invalid[0], invalid[1])
+		assert.True(t, errors.Is(err, ErrInvalidArgument), invalid)
+	}
+
+	mnt, err := m.Mount(ctx, "models/bert:v1", mountpoint+"/")
+	require.Nil(t, err)
+	assert.Equal(t, "docker.io/models/bert:v1", mnt.Ref)
+	assert.Equal(t, mountpoint, mnt.Mountpoint)
+	assert.True(t, mnt.Pid > 0)
+	_, err = os.Stat(mountpoint)
+	assert.Nil(t, err)
+
+	_, err = m.Mount(ctx, "models/bert:v2", mountpoint)
+	assert.Equal(t, ErrAlreadyMounted, err)
+	assert.Equal(t, []Mount{*mnt}, m.List())
+
+	// The mount with alive daemon is adopted on restart
+	recovered := newFakeManager(t, dir)
+	require.Len(t, recovered.List(), 1)
+	assert.Equal(t, mnt.Pid, recovered.List()[0].Pid)
+
+	// The mount with dead daemon is remounted on restart
+	require.Nil(t, syscall.Kill(mnt.Pid, syscall.SIGKILL))
+	require.Nil(t, m.mounts[mountpoint].daemon.stop())
+	remounted := newFakeManager(t, dir)
+	mounts := remounted.List()
+	require.Len(t, mounts, 1)
+	assert.NotEqual(t, mnt.Pid, mounts[0].Pid)
+
+	assert.Equal(t, ErrNotFound, remounted.Umount(filepath.Join(dir, "models", "unknown")))
+	require.Nil(t, remounted.Umount(mountpoint))
+	assert.Len(t, remounted.List(), 0)
+	_, err = os.Stat(mountpoint)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(remounted.dir(mnt.ID))
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, newFakeManager(t, dir).List(), 0)
+}
+
+func TestMountpointSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-artifact-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m := newFakeManager(t, dir)
+	ctx := context.Background()
+	models := filepath.Join(dir, "models")
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "etc"), 0755))
+	require.Nil(t, os.MkdirAll(models, 0755))
+	require.Nil(t, os.Symlink(filepath.Join(dir, "etc"), filepath.Join(models, "escape")))
+
+	// The symlinks under allowed path escape it
+	for _, mountpoint := range []string{
+		filepath.Join(models, "escape"),
+		filepath.Join(models, "escape", "bert"),
+	} {
+		_, err = m.Mount(ctx, "models/bert:v1", mountpoint)
+		assert.True(t, errors.Is(err, ErrInvalidArgument), mountpoint)
+	}
+	_, err = os.Stat(filepath.Join(dir, "etc", "bert"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The allowed path itself may be a symlink
+	require.Nil(t, os.Symlink(models, filepath.Join(dir, "link")))
+	m.AllowedPaths = []string{filepath.Join(dir, "link")}
+	mnt, err := m.Mount(ctx, "models/bert:v1", filepath.Join(dir, "link", "bert"))
+	require.Nil(t, err)
+	_, err = os.Stat(filepath.Join(models, "bert"))
+	assert.Nil(t, err)
+	require.Nil(t, m.Umount(mnt.Mountpoint))
+}
+
+func TestMountNotBlocking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-artifact-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m := newFakeManager(t, dir)
+	ctx := context.Background()
+	pulling, release := make(chan struct{}), make(chan struct{})
+	pull := m.pull
+	m.pull = func(ctx context.Context, ref, target string) ([]string, error) {
+		close(pulling)
+		<-release
+		return pull(ctx, ref, target)
+	}
+
+	mountpoint := filepath.Join(dir, "models", "bert")
+	done := make(chan error)
+	go func() {
+		_, err := m.Mount(ctx, "models/bert:v1", mountpoint)
+		done <- err
+	}()
+	<-pulling
+
+	// The mountpoint is reserved, and the others aren't blocked by the
+	// pulling artifact
+	_, err = m.Mount(ctx, "models/bert:v2", mountpoint)
+	assert.Equal(t, ErrAlreadyMounted, err)
+	assert.Len(t, m.List(), 0)
+	assert.Equal(t, ErrNotFound, m.Umount(mountpoint))
+
+	close(release)
+	require.Nil(t, <-done)
+	assert.Len(t, m.List(), 1)
+	require.Nil(t, m.Umount(mountpoint))
+}
+
+func TestRecoverFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-artifact-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m := newFakeManager(t, dir)
+	mountpoint := filepath.Join(dir, "models", "bert")
+	mnt, err := m.Mount(context.Background(), "models/bert:v1", mountpoint)
+	require.Nil(t, err)
+	require.Nil(t, m.mounts[mountpoint].daemon.stop())
+
+	// The mount is dropped if nydusd can't be restarted
+	m, err = New(context.Background(), newOpt(dir))
+	require.Nil(t, err)
+	assert.Len(t, m.List(), 0)
+	_, err = os.Stat(m.dir(mnt.ID))
+	assert.True(t, os.IsNotExist(err))
+}
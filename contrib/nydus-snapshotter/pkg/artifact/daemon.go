@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package artifact
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/nydussdk"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/utils/mount"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	daemonStateRunning = "RUNNING"
+	pollInterval       = time.Second
+	startTimeout       = time.Minute
+	stopTimeout        = 10 * time.Second
+)
+
+// daemon is the nydusd serving an artifact.
+type daemon struct {
+	pid int
+	// exited is closed once nydusd exits, it's nil for the nydusd not
+	// started by this process, i.e. recovered after restart.
+	exited <-chan struct{}
+}
+
+// spawn starts the command as daemon and reaps it in background.
+func spawn(cmd *exec.Cmd) (*daemon, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	return &daemon{pid: cmd.Process.Pid, exited: exited}, nil
+}
+
+func (d *daemon) alive() bool {
+	if d.exited != nil {
+		select {
+		case <-d.exited:
+			return false
+		default:
+			return true
+		}
+	}
+	return syscall.Kill(d.pid, 0) == nil
+}
+
+// stop terminates nydusd and waits until it exits.
+func (d *daemon) stop() error {
+	if !d.alive() {
+		return nil
+	}
+	if err := syscall.Kill(d.pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	deadline := time.Now().Add(stopTimeout)
+	for d.alive() {
+		if time.Now().After(deadline) {
+			return errors.New("timeout waiting for nydusd to exit")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+func umount(mountpoint string) {
+	mounter := mount.Mounter{}
+	if err := mounter.Umount(mountpoint); err != nil && err != syscall.EINVAL && !os.IsNotExist(err) {
+		logging.Artifact.L().WithError(err).Warnf("failed to umount %s", mountpoint)
+	}
+}
+
+// pullBootstrap pulls the bootstrap of artifact to target, and returns the
+// blob IDs of artifact.
+func (m *Manager) pullBootstrap(ctx context.Context, ref, target string) ([]string, error) {
+	remote, err := provider.DefaultRemote(ref, m.Insecure)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create remote of artifact %s", ref)
+	}
+	artifactParser := parser.New(remote)
+	parsed, err := artifactParser.Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse artifact %s", ref)
+	}
+	if parsed.NydusImage == nil {
+		return nil, fmt.Errorf("%s is not a RAFS artifact", ref)
+	}
+
+	reader, err := artifactParser.PullNydusBootstrap(ctx, parsed.NydusImage)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to pull bootstrap of artifact %s", ref)
+	}
+	defer reader.Close()
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, target); err != nil {
+		return nil, errors.Wrapf(err, "failed to unpack bootstrap of artifact %s", ref)
+	}
+
+	var blobs []string
+	for _, layer := range parsed.NydusImage.Manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBlob] == "true" {
+			blobs = append(blobs, layer.Digest.Hex())
+		}
+	}
+	return blobs, nil
+}
+
+// startDaemon starts nydusd with the bootstrap and config in dir, and waits
+// until it's running. The nydusd is started in its own session so that it
+// keeps serving the artifact when snapshotter restarts.
+func (m *Manager) startDaemon(ctx context.Context, dir, mountpoint string) (*daemon, error) {
+	apiSock := filepath.Join(dir, "api.sock")
+	os.Remove(apiSock)
+	logFile := filepath.Join(m.RootDir, filepath.Base(dir)+".log")
+
+	cmd := exec.Command(m.NydusdPath,
+		"--config", filepath.Join(dir, configFileName),
+		"--bootstrap", filepath.Join(dir, bootstrapFileName),
+		"--mountpoint", mountpoint,
+		"--apisock", apiSock,
+		"--log-level", "info",
+		"--log-file", logFile,
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	d, err := spawn(cmd)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start nydusd")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	var client nydussdk.Interface
+	for {
+		select {
+		case <-ctx.Done():
+			d.stop()
+			umount(mountpoint)
+			return nil, errors.Wrap(ctx.Err(), "nydusd is not running")
+		case <-d.exited:
+			return nil, errors.Errorf("nydusd exited unexpectedly, see log %s", logFile)
+		case <-ticker.C:
+		}
+
+		if client == nil {
+			c, err := nydussdk.NewNydusClient(apiSock, nydussdk.WithPeerPid(d.pid))
+			if err != nil {
+				continue
+			}
+			client = c
+		}
+		info, err := client.CheckStatus()
+		if err == nil && info.State == daemonStateRunning {
+			return d, nil
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package blobproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+)
+
+// The blob is cached in segments of segmentSize aligned, so that the
+// ranges of blob are cached independently.
+const segmentSize = 1 << 20
+
+const sizeFile = "size"
+
+// blobRef identifies the cached blob by the registry host and repository
+// it's fetched from in addition to its digest. The data is never verified
+// against the digest, so a blob fetched from one repository mustn't be
+// served for the same digest in others, e.g. from a registry controlled by
+// attacker to the images of a trusted one.
+type blobRef struct {
+	host string
+	repo string
+	dgst digest.Digest
+}
+
+// segmentCache stores the segments of blobs in
+// `<dir>/<sha256 of host/repo>/<algorithm>-<hex>/`, each segment is a file
+// named by its index, and the size of blob is in file `size`. The blobs are
+// evicted by LRU when the capacity is exceeded.
+type segmentCache struct {
+	dir      string
+	capacity int64
+	mu       sync.Mutex
+	usage    int64
+}
+
+func newSegmentCache(dir string, capacity int64) (*segmentCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create cache dir %s", dir)
+	}
+	c := &segmentCache{dir: dir, capacity: capacity}
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			c.usage += info.Size()
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to walk cache dir %s", dir)
+	}
+	return c, nil
+}
+
+func (c *segmentCache) blobDir(ref blobRef) string {
+	scope := sha256.Sum256([]byte(ref.host + "/" + ref.repo))
+	return filepath.Join(c.dir, hex.EncodeToString(scope[:]), ref.dgst.Algorithm().String()+"-"+ref.dgst.Hex())
+}
+
+// size returns the size of blob, or -1 if it's unknown yet.
+func (c *segmentCache) size(ref blobRef) int64 {
+	b, err := ioutil.ReadFile(filepath.Join(c.blobDir(ref), sizeFile))
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (c *segmentCache) has(ref blobRef, index int64) bool {
+	_, err := os.Stat(filepath.Join(c.blobDir(ref), strconv.FormatInt(index, 10)))
+	return err == nil
+}
+
+// open opens the segment and touches the blob for LRU.
+func (c *segmentCache) open(ref blobRef, index int64) (*os.File, error) {
+	now := time.Now()
+	_ = os.Chtimes(c.blobDir(ref), now, now)
+	return os.Open(filepath.Join(c.blobDir(ref), strconv.FormatInt(index, 10)))
+}
+
+func (c *segmentCache) writeFile(ref blobRef, name string, reader io.Reader) (int64, error) {
+	dir := c.blobDir(ref)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, reader)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.usage += n
+	c.mu.Unlock()
+	return n, nil
+}
+
+func (c *segmentCache) setSize(ref blobRef, size int64) error {
+	if c.size(ref) == size {
+		return nil
+	}
+	_, err := c.writeFile(ref, sizeFile, stringReader(strconv.FormatInt(size, 10)))
+	return err
+}
+
+// put stores the segments read from reader, which starts at the segment
+// of index first and ends at the end of blob or the segment of index last.
+func (c *segmentCache) put(ref blobRef, size, first, last int64, reader io.Reader) error {
+	if err := c.setSize(ref, size); err != nil {
+		return errors.Wrap(err, "failed to store blob size")
+	}
+	for index := first; index <= last; index++ {
+		length := segmentLength(size, index)
+		if length <= 0 {
+			break
+		}
+		n, err := c.writeFile(ref, strconv.FormatInt(index, 10), io.LimitReader(reader, length))
+		if err != nil {
+			return errors.Wrapf(err, "failed to store segment %d", index)
+		}
+		if n != length {
+			return errors.Errorf("short segment %d, expected %d bytes, got %d", index, length, n)
+		}
+	}
+	c.gc()
+	return nil
+}
+
+// gc removes the least recently used blobs until the usage is under
+// capacity.
+func (c *segmentCache) gc() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 || c.usage <= c.capacity {
+		return
+	}
+
+	type blob struct {
+		dir     string
+		modTime time.Time
+	}
+	blobs := []blob{}
+	scopes, _ := ioutil.ReadDir(c.dir)
+	for _, scope := range scopes {
+		entries, _ := ioutil.ReadDir(filepath.Join(c.dir, scope.Name()))
+		for _, entry := range entries {
+			blobs = append(blobs, blob{
+				dir:     filepath.Join(c.dir, scope.Name(), entry.Name()),
+				modTime: entry.ModTime(),
+			})
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].modTime.Before(blobs[j].modTime)
+	})
+
+	for _, blob := range blobs {
+		if c.usage <= c.capacity {
+			break
+		}
+		var size int64
+		files, _ := ioutil.ReadDir(blob.dir)
+		for _, file := range files {
+			size += file.Size()
+		}
+		if err := os.RemoveAll(blob.dir); err != nil {
+			logging.Snapshots.L().WithError(err).Warnf("failed to evict blob %s", blob.dir)
+			continue
+		}
+		c.usage -= size
+	}
+}
+
+// segmentLength returns the length of segment, the last segment may be
+// shorter than segmentSize.
+func segmentLength(size, index int64) int64 {
+	length := size - index*segmentSize
+	if length > segmentSize {
+		length = segmentSize
+	}
+	return length
+}
+
+type stringReader string
+
+func (s stringReader) Read(p []byte) (int, error) {
+	return copy(p, s), io.EOF
+}
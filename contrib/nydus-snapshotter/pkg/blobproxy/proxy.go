@@ -0,0 +1,587 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package blobproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+)
+
+const (
+	upstreamsFile = "upstreams.json"
+	// The authorization of a client to read the cached blobs of repository
+	// is checked against upstream again after authCacheTTL.
+	authCacheTTL = 5 * time.Minute
+)
+
+var (
+	blobPathRegexp = regexp.MustCompile(`^/v2/(.+)/blobs/([a-z0-9]+:[a-f0-9]+)$`)
+	rangeRegexp    = regexp.MustCompile(`^bytes=(\d+)-(\d+)$`)
+	contentRegexp  = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+	realmRegexp    = regexp.MustCompile(`realm="([^"]+)"`)
+)
+
+// The headers only meaningful to a single connection, which aren't
+// forwarded by proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type Opt struct {
+	// RootDir stores the cached blobs and the upstreams of registries.
+	RootDir string
+	// Address is the TCP address listened on, e.g. 127.0.0.1:65001, which
+	// must be a loopback address.
+	Address string
+	// CacheSize is the capacity of cached blobs in bytes, 0 is unlimited.
+	CacheSize int64
+}
+
+// upstream is the original scheme of registry host, as nydusd talks to the
+// proxy in plain HTTP.
+type upstream struct {
+	Scheme     string `json:"scheme"`
+	SkipVerify bool   `json:"skip_verify,omitempty"`
+}
+
+// Proxy is a forward HTTP proxy shared by all nydusd on the node, which
+// caches the ranged blob reads of registry backend on local disk. So the
+// blob data fetched by one nydusd is reused by the others, and by the
+// nydusd restarted or recreated for the same image.
+//
+// Only the registered registries, and the auth servers and blob storages
+// they point nydusd to, are reachable via proxy.
+type Proxy struct {
+	opt   Opt
+	cache *segmentCache
+
+	// follow follows the redirects to blob storage when filling the cache,
+	// pass returns the redirects to nydusd as they are.
+	follow map[bool]*http.Client
+	pass   map[bool]*http.Client
+
+	mu        sync.Mutex
+	upstreams map[string]upstream
+	// related are the hosts of auth realms and redirects in the responses
+	// of upstreams.
+	related    map[string]bool
+	authorized map[string]time.Time
+	fetching   map[blobRef]*sync.Mutex
+}
+
+func New(opt Opt) (*Proxy, error) {
+	if opt.RootDir == "" || opt.Address == "" {
+		return nil, errors.New("root dir and address of blob proxy are required")
+	}
+	if !isLoopback(opt.Address) {
+		return nil, errors.Errorf("blob proxy address %s is not a loopback address", opt.Address)
+	}
+	cache, err := newSegmentCache(filepath.Join(opt.RootDir, "blobs"), opt.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		opt:        opt,
+		cache:      cache,
+		follow:     make(map[bool]*http.Client),
+		pass:       make(map[bool]*http.Client),
+		upstreams:  make(map[string]upstream),
+		related:    make(map[string]bool),
+		authorized: make(map[string]time.Time),
+		fetching:   make(map[blobRef]*sync.Mutex),
+	}
+	for _, skipVerify := range []bool{false, true} {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: skipVerify}
+		p.follow[skipVerify] = &http.Client{Transport: transport}
+		p.pass[skipVerify] = &http.Client{
+			Transport: transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(opt.RootDir, upstreamsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &p.upstreams); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", upstreamsFile)
+		}
+	}
+	return p, nil
+}
+
+// URL returns the proxy URL for nydusd.
+func (p *Proxy) URL() string {
+	return "http://" + p.opt.Address
+}
+
+// Serve serves the proxy until ctx is done.
+func (p *Proxy) Serve(ctx context.Context) error {
+	listener, err := net.Listen("tcp", p.opt.Address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", p.opt.Address)
+	}
+	server := &http.Server{Handler: p}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logging.Snapshots.L().WithError(err).Errorf("blob proxy exited")
+		}
+	}()
+	logging.Snapshots.L().Infof("blob proxy serves on %s", p.opt.Address)
+	return nil
+}
+
+// Rewrite points the registry backend of nydusd config to the proxy. The
+// original scheme of registry is kept by proxy, and nydusd requests the
+// registry in plain HTTP via proxy, so that the blob data can be cached.
+// The config with its own proxy, e.g. a mirror, is left as it is.
+func (p *Proxy) Rewrite(cfg *config.DaemonConfig) error {
+	backend := &cfg.Device.Backend
+	if backend.BackendType != "registry" || backend.Config.Proxy.URL != "" {
+		return nil
+	}
+	up := upstream{Scheme: backend.Config.Scheme, SkipVerify: backend.Config.SkipVerify}
+	if up.Scheme == "" {
+		up.Scheme = "https"
+	}
+	if err := p.register(backend.Config.Host, up); err != nil {
+		return err
+	}
+
+	backend.Config.Scheme = "http"
+	backend.Config.SkipVerify = false
+	// The redirected blob URLs are followed by proxy
+	backend.Config.BlobUrlScheme = ""
+	backend.Config.Proxy.URL = p.URL()
+	// nydusd can't fall back to registry with the rewritten scheme
+	backend.Config.Proxy.Fallback = false
+	backend.Config.Proxy.PingURL = ""
+	return nil
+}
+
+func (p *Proxy) register(host string, up upstream) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.upstreams[host]; ok && old == up {
+		return nil
+	}
+	p.upstreams[host] = up
+	b, err := json.Marshal(p.upstreams)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(p.opt.RootDir, upstreamsFile)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp)
+	}
+	return os.Rename(tmp, file)
+}
+
+func (p *Proxy) upstream(host string) upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.upstreams[host]
+}
+
+// allowed checks if host is a registered upstream or related to one. The
+// default port of host is optional, e.g. in the CONNECT requests.
+func (p *Proxy) allowed(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hosts := []string{host}
+	if name, port, err := net.SplitHostPort(host); err == nil && (port == "443" || port == "80") {
+		hosts = append(hosts, name)
+	}
+	for _, h := range hosts {
+		if _, ok := p.upstreams[h]; ok || p.related[h] {
+			return true
+		}
+	}
+	return false
+}
+
+// relate allows the hosts of auth realm and redirect in the response of an
+// upstream, for nydusd to request them via proxy later.
+func (p *Proxy) relate(r *http.Request, resp *http.Response) {
+	if p.upstream(r.URL.Host).Scheme == "" {
+		return
+	}
+	urls := []string{resp.Header.Get("Location")}
+	if matches := realmRegexp.FindStringSubmatch(resp.Header.Get("Www-Authenticate")); matches != nil {
+		urls = append(urls, matches[1])
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, raw := range urls {
+		if u, err := r.URL.Parse(raw); err == nil && raw != "" && u.Host != "" {
+			p.related[u.Host] = true
+		}
+	}
+}
+
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		if !p.allowed(r.Host) {
+			http.Error(w, fmt.Sprintf("host %s is not allowed", r.Host), http.StatusForbidden)
+			return
+		}
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Error(w, "absolute URL is required", http.StatusBadRequest)
+		return
+	}
+	if !p.allowed(r.URL.Host) {
+		http.Error(w, fmt.Sprintf("host %s is not allowed", r.URL.Host), http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		matches := blobPathRegexp.FindStringSubmatch(r.URL.Path)
+		ranges := rangeRegexp.FindStringSubmatch(r.Header.Get("Range"))
+		if matches != nil && ranges != nil {
+			dgst, err := digest.Parse(matches[2])
+			start, _ := strconv.ParseInt(ranges[1], 10, 64)
+			end, _ := strconv.ParseInt(ranges[2], 10, 64)
+			if err == nil && start <= end {
+				p.serveBlob(w, r, blobRef{host: r.URL.Host, repo: matches[1], dgst: dgst}, start, end)
+				return
+			}
+		}
+	}
+	p.forward(w, r)
+}
+
+// upstreamRequest creates the request to registry in its original scheme.
+func (p *Proxy) upstreamRequest(r *http.Request, method string) (*http.Request, upstream, error) {
+	up := p.upstream(r.URL.Host)
+	u := *r.URL
+	// The related hosts, e.g. the auth server, are requested as they are
+	if up.Scheme != "" {
+		u.Scheme = up.Scheme
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, u.String(), nil)
+	if err != nil {
+		return nil, up, err
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return req, up, nil
+}
+
+// forward passes the request to registry, the redirects are returned to
+// client as they are.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request) {
+	req, up, err := p.upstreamRequest(r, r.Method)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Body = r.Body
+	req.ContentLength = r.ContentLength
+
+	resp, err := p.pass[up.SkipVerify].Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	p.relate(r, resp)
+	copyResponse(w, resp)
+}
+
+// tunnel serves the HTTPS requests not cached, e.g. to the auth server of
+// registry.
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	conn, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		conn.Close()
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go func() {
+		_, _ = io.Copy(conn, client)
+		conn.Close()
+	}()
+	_, _ = io.Copy(client, conn)
+	client.Close()
+}
+
+// serveBlob serves the range [start, end] of blob from cache, the missing
+// segments are fetched from registry first.
+func (p *Proxy) serveBlob(w http.ResponseWriter, r *http.Request, ref blobRef, start, end int64) {
+	first, last := start/segmentSize, end/segmentSize
+
+	lock := p.fetchLock(ref)
+	lock.Lock()
+	size := p.cache.size(ref)
+	if size >= 0 && end >= size {
+		end = size - 1
+		last = end / segmentSize
+	}
+	missing := size < 0
+	for index := first; !missing && index <= last; index++ {
+		missing = !p.cache.has(ref, index)
+	}
+	if missing {
+		resp, err := p.fetch(r, ref, first, last)
+		lock.Unlock()
+		if err != nil {
+			logging.Snapshots.L().WithError(err).Warnf("failed to fetch blob %s", ref.dgst)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if resp != nil {
+			defer resp.Body.Close()
+			copyResponse(w, resp)
+			return
+		}
+		size = p.cache.size(ref)
+		if end >= size {
+			end = size - 1
+			last = end / segmentSize
+		}
+	} else {
+		lock.Unlock()
+		// The cached data is shared by clients, so the client is checked
+		// if it's allowed to read the blob from repository.
+		resp, err := p.authorize(r, ref.repo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if resp != nil {
+			defer resp.Body.Close()
+			copyResponse(w, resp)
+			return
+		}
+	}
+
+	if start > end {
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	segments := make([]*os.File, 0, last-first+1)
+	defer func() {
+		for _, f := range segments {
+			f.Close()
+		}
+	}()
+	for index := first; index <= last; index++ {
+		f, err := p.cache.open(ref, index)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		segments = append(segments, f)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.WriteHeader(http.StatusPartialContent)
+	offset := start - first*segmentSize
+	remain := end - start + 1
+	for _, f := range segments {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return
+		}
+		n, err := io.Copy(w, io.LimitReader(f, remain))
+		if err != nil {
+			return
+		}
+		remain -= n
+		offset = 0
+	}
+}
+
+func (p *Proxy) fetchLock(ref blobRef) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lock, ok := p.fetching[ref]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.fetching[ref] = lock
+	}
+	return lock
+}
+
+// fetch fetches the segments [first, last] of blob into cache. The
+// response of registry is returned if it's not successful, e.g. 401 with
+// the challenge of token auth, to be passed to client.
+func (p *Proxy) fetch(r *http.Request, ref blobRef, first, last int64) (*http.Response, error) {
+	req, up, err := p.upstreamRequest(r, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first*segmentSize, (last+1)*segmentSize-1))
+	resp, err := p.follow[up.SkipVerify].Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	var reader io.Reader = resp.Body
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		matches := contentRegexp.FindStringSubmatch(resp.Header.Get("Content-Range"))
+		if matches == nil {
+			resp.Body.Close()
+			return nil, errors.Errorf("invalid content range %q", resp.Header.Get("Content-Range"))
+		}
+		offset, _ := strconv.ParseInt(matches[1], 10, 64)
+		if offset != first*segmentSize {
+			resp.Body.Close()
+			return nil, errors.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+		}
+		size, _ = strconv.ParseInt(matches[3], 10, 64)
+	case http.StatusOK:
+		// The range isn't supported by blob storage, skip to the segments
+		if resp.ContentLength < 0 {
+			resp.Body.Close()
+			return nil, errors.New("unknown blob size")
+		}
+		size = resp.ContentLength
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, first*segmentSize); err != nil {
+			resp.Body.Close()
+			return nil, errors.Wrap(err, "failed to skip blob data")
+		}
+	default:
+		p.relate(r, resp)
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if err := p.cache.put(ref, size, first, last, reader); err != nil {
+		return nil, err
+	}
+	p.setAuthorized(r, ref.host, ref.repo)
+	return nil, nil
+}
+
+func authKey(r *http.Request, host, repo string) string {
+	sum := sha256.Sum256([]byte(host + "/" + repo + "\n" + r.Header.Get("Authorization")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *Proxy) setAuthorized(r *http.Request, host, repo string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.authorized[authKey(r, host, repo)] = time.Now().Add(authCacheTTL)
+}
+
+// authorize checks the client against registry by a HEAD request of blob
+// with its credentials, the response of registry is returned if it's
+// rejected.
+func (p *Proxy) authorize(r *http.Request, repo string) (*http.Response, error) {
+	key := authKey(r, r.URL.Host, repo)
+	p.mu.Lock()
+	expiry, ok := p.authorized[key]
+	p.mu.Unlock()
+	if ok && time.Now().Before(expiry) {
+		return nil, nil
+	}
+
+	req, up, err := p.upstreamRequest(r, http.MethodHead)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.pass[up.SkipVerify].Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		p.relate(r, resp)
+		return resp, nil
+	}
+	resp.Body.Close()
+	p.setAuthorized(r, r.URL.Host, repo)
+	return nil, nil
+}
+
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
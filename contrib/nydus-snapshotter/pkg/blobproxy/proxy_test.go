@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package blobproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+)
+
+func TestProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-blob-proxy-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	blob := make([]byte, 3*segmentSize+100)
+	rand.Read(blob)
+	dgst := digest.FromBytes(blob)
+	blobPath := fmt.Sprintf("/v2/app/blobs/%s", dgst)
+
+	var gets, heads int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="https://auth.example.com/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case blobPath:
+			if r.Method == http.MethodHead {
+				atomic.AddInt32(&heads, 1)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			atomic.AddInt32(&gets, 1)
+			// The blob storage is redirected to
+			http.Redirect(w, r, "/storage", http.StatusTemporaryRedirect)
+		case "/storage":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+	registryURL, err := url.Parse(registry.URL)
+	require.Nil(t, err)
+
+	proxy, err := New(Opt{RootDir: dir, Address: "127.0.0.1:0"})
+	require.Nil(t, err)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	var cfg config.DaemonConfig
+	cfg.Device.Backend.BackendType = "registry"
+	cfg.Device.Backend.Config.Host = registryURL.Host
+	cfg.Device.Backend.Config.Scheme = "http"
+	proxy.opt.Address = strings.TrimPrefix(server.URL, "http://")
+	require.Nil(t, proxy.Rewrite(&cfg))
+	assert.Equal(t, "http", cfg.Device.Backend.Config.Scheme)
+	assert.Equal(t, server.URL, cfg.Device.Backend.Config.Proxy.URL)
+	assert.False(t, cfg.Device.Backend.Config.Proxy.Fallback)
+
+	serverURL, err := url.Parse(server.URL)
+	require.Nil(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(serverURL)}}
+	read := func(auth string, start, end int) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, registry.URL+blobPath, nil)
+		require.Nil(t, err)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+	check := func(start, end int) {
+		resp := read("Bearer token", start, end)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		if end >= len(blob) {
+			end = len(blob) - 1
+		}
+		assert.Equal(t, fmt.Sprintf("bytes %d-%d/%d", start, end, len(blob)), resp.Header.Get("Content-Range"))
+		data, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		assert.Equal(t, blob[start:end+1], data)
+	}
+
+	// The challenge of registry is passed to client
+	resp := read("", 0, 100)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Www-Authenticate"))
+	// The auth server of registry is allowed to be tunneled to
+	assert.True(t, proxy.allowed("auth.example.com:443"))
+
+	// The range across segments is fetched once and cached
+	check(segmentSize-10, segmentSize+10)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+	check(segmentSize+100, segmentSize+200)
+	check(0, 10)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+	// The range beyond blob is truncated
+	check(3*segmentSize, 4*segmentSize)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&heads))
+
+	// The cached data is served to the client authorized by registry only
+	resp = read("Bearer stolen", 0, 10)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The cached blob isn't shared with other repositories of same digest
+	req, err := http.NewRequest(http.MethodGet, registry.URL+"/v2/other/blobs/"+dgst.String(), nil)
+	require.Nil(t, err)
+	req.Header.Set("Range", "bytes=0-10")
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// The hosts not related to registries aren't reachable via proxy
+	resp, err = client.Get("http://example.com/")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodConnect, "example.com:22", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// The cache and upstreams survive the restart of proxy
+	proxy, err = New(Opt{RootDir: dir, Address: proxy.opt.Address})
+	require.Nil(t, err)
+	server.Config.Handler = proxy
+	check(10, 2*segmentSize-1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&heads))
+}
+
+func TestLoopbackAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-blob-proxy-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, address := range []string{"127.0.0.1:65001", "[::1]:65001", "localhost:65001"} {
+		_, err := New(Opt{RootDir: dir, Address: address})
+		assert.Nil(t, err, address)
+	}
+	for _, address := range []string{"0.0.0.0:65001", ":65001", "192.168.1.1:65001", "127.0.0.1"} {
+		_, err := New(Opt{RootDir: dir, Address: address})
+		assert.NotNil(t, err, address)
+	}
+}
+
+func TestCacheGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-blob-proxy-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := newSegmentCache(dir, 2*segmentSize+100)
+	require.Nil(t, err)
+	blob := make([]byte, segmentSize)
+	ref := func(host, s string) blobRef {
+		return blobRef{host: host, repo: "app", dgst: digest.FromString(s)}
+	}
+	old, recent, other := ref("a.com", "old"), ref("a.com", "recent"), ref("b.com", "recent")
+	require.Nil(t, cache.put(old, segmentSize, 0, 0, bytes.NewReader(blob)))
+	require.Nil(t, cache.put(recent, segmentSize, 0, 0, bytes.NewReader(blob)))
+	assert.False(t, cache.has(other, 0))
+	past := time.Now().Add(-time.Hour)
+	require.Nil(t, os.Chtimes(cache.blobDir(old), past, past))
+
+	require.Nil(t, cache.put(ref("b.com", "new"), segmentSize, 0, 0, bytes.NewReader(blob)))
+	assert.False(t, cache.has(old, 0))
+	assert.True(t, cache.has(recent, 0))
+	assert.True(t, cache.has(ref("b.com", "new"), 0))
+}
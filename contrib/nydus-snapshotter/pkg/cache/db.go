@@ -8,6 +8,12 @@ type DB interface {
 	AddSnapshot(imageID string, blobs []string) error
 	DelSnapshot(imageID string) error
 	GC(delFunc func(blob string) error) ([]string, error)
+	Pin(image string) error
+	Unpin(image string) error
+	ReconcilePins(images []string) error
+	IsPinned(imageRef string) (bool, error)
+	ListPins() ([]store.Pin, error)
+	ListSnapshots() ([]store.Snapshot, error)
 }
 
 var _ DB = &store.CacheStore{}
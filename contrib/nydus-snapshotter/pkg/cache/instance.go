@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/lock"
+)
+
+const (
+	// instancesDirName holds a lease file per snapshotter instance using
+	// the cache dir, locked by the instance as long as it's alive.
+	instancesDirName = ".instances"
+	// gcLockFileName serializes GC with the registration of instances, so
+	// that no instance starts using the cache dir in the middle of GC.
+	gcLockFileName    = ".gc.lock"
+	leaseSuffix       = ".lock"
+	gcLockRetryPeriod = 100 * time.Millisecond
+)
+
+func (m *Manager) lockGC() (*lock.Lock, error) {
+	return lock.Wait(context.Background(), filepath.Join(m.cacheDir, gcLockFileName), gcLockRetryPeriod)
+}
+
+// register takes the lease of instance on cache dir, it fails if another
+// instance with the same name is alive.
+func (m *Manager) register() error {
+	gcLock, err := m.lockGC()
+	if err != nil {
+		return err
+	}
+	defer gcLock.Unlock()
+
+	path := filepath.Join(m.cacheDir, instancesDirName, m.instance+leaseSuffix)
+	lease, err := lock.TryLock(path)
+	if err == lock.ErrLocked {
+		holder, _ := lock.ReadHolder(path)
+		if holder != nil {
+			return errors.Errorf("cache dir %s is used by instance %s in pid %d", m.cacheDir, m.instance, holder.Pid)
+		}
+		return errors.Errorf("cache dir %s is used by instance %s", m.cacheDir, m.instance)
+	}
+	if err != nil {
+		return err
+	}
+	m.lease = lease
+	return nil
+}
+
+// aliveInstances returns the other instances alive using cache dir, the
+// leases of dead instances are removed, it's called with GC lock held.
+func (m *Manager) aliveInstances() ([]string, error) {
+	leases, err := filepath.Glob(filepath.Join(m.cacheDir, instancesDirName, "*"+leaseSuffix))
+	if err != nil {
+		return nil, err
+	}
+	alive := []string{}
+	for _, path := range leases {
+		instance := strings.TrimSuffix(filepath.Base(path), leaseSuffix)
+		if instance == m.instance {
+			continue
+		}
+		lease, err := lock.TryLock(path)
+		if err == lock.ErrLocked {
+			alive = append(alive, instance)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.L.Infof("remove lease of dead instance %s on cache dir", instance)
+		os.Remove(path)
+		lease.Unlock()
+	}
+	return alive, nil
+}
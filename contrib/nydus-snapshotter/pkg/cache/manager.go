@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/containerd/containerd/log"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/lock"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/store"
 	"github.com/pkg/errors"
 )
@@ -14,12 +15,19 @@ type Manager struct {
 	cacheDir string
 	period   time.Duration
 	eventCh  chan struct{}
+	instance string
+	lease    *lock.Lock
 }
 
 type Opt struct {
 	CacheDir string
 	Period   time.Duration
 	Database *store.Database
+	// Instance names the snapshotter instance among the ones sharing the
+	// cache dir, e.g. in blue/green deployment, the blob caches are only
+	// collected when no other instance is alive. The cache dir isn't
+	// coordinated with other instances if it's empty.
+	Instance string
 }
 
 func NewManager(opt Opt) (*Manager, error) {
@@ -36,6 +44,12 @@ func NewManager(opt Opt) (*Manager, error) {
 		cacheDir: opt.CacheDir,
 		period:   opt.Period,
 		eventCh:  eventCh,
+		instance: opt.Instance,
+	}
+	if m.instance != "" {
+		if err := m.register(); err != nil {
+			return nil, errors.Wrap(err, "failed to register instance on cache dir")
+		}
 	}
 	go m.runGC()
 	log.L.Info("gc goroutine start...")
@@ -69,12 +83,117 @@ func (m *Manager) runGC() {
 }
 
 func (m *Manager) gc() error {
+	_, err := m.GC()
+	return err
+}
+
+// GC removes the blob caches not used by any snapshot or pin right now,
+// and returns the removed blobs.
+func (m *Manager) GC() ([]string, error) {
+	if m.instance != "" {
+		gcLock, err := m.lockGC()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to lock cache gc")
+		}
+		defer gcLock.Unlock()
+		// The blob caches used by other instances are unknown
+		alive, err := m.aliveInstances()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to check instances on cache dir")
+		}
+		if len(alive) > 0 {
+			log.L.Infof("skip cache gc since the cache dir is shared with alive instances %v", alive)
+			return []string{}, nil
+		}
+	}
 	delBlobs, err := m.db.GC(m.store.DelBlob)
 	if err != nil {
-		return errors.Wrapf(err, "cache gc err")
+		return nil, errors.Wrapf(err, "cache gc err")
 	}
 	log.L.Debugf("remove %d unused blobs successfully", len(delBlobs))
-	return nil
+	return delBlobs, nil
+}
+
+// ImageUsage is the blob cache usage of an image.
+type ImageUsage struct {
+	Image string
+	Blobs []string
+	// Size is the disk usage in bytes of the blob caches of image, the
+	// blobs shared by images are counted in each of them.
+	Size   int64
+	Pinned bool
+}
+
+// Usage returns the blob cache usage of each image used by snapshots or
+// pinned, and the total disk usage of their blob caches.
+func (m *Manager) Usage() ([]ImageUsage, int64, error) {
+	snapshots, err := m.db.ListSnapshots()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to list snapshots")
+	}
+	pins, err := m.db.ListPins()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to list pins")
+	}
+
+	blobUsage := make(map[string]int64)
+	usageOf := func(blobs []string) (int64, error) {
+		var size int64
+		for _, blob := range blobs {
+			usage, ok := blobUsage[blob]
+			if !ok {
+				if usage, err = m.store.BlobUsage(blob); err != nil {
+					return 0, errors.Wrapf(err, "failed to get usage of blob %s", blob)
+				}
+				blobUsage[blob] = usage
+			}
+			size += usage
+		}
+		return size, nil
+	}
+
+	usages := []ImageUsage{}
+	for _, snapshot := range snapshots {
+		size, err := usageOf(snapshot.Blobs)
+		if err != nil {
+			return nil, 0, err
+		}
+		usages = append(usages, ImageUsage{
+			Image:  snapshot.ImageID,
+			Blobs:  snapshot.Blobs,
+			Size:   size,
+			Pinned: m.IsPinned(snapshot.ImageID),
+		})
+	}
+	// The pinned images may have no snapshot on node
+	for _, pin := range pins {
+		found := false
+		for _, usage := range usages {
+			if pin.Match(usage.Image) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		size, err := usageOf(pin.Blobs)
+		if err != nil {
+			return nil, 0, err
+		}
+		usages = append(usages, ImageUsage{
+			Image:  pin.Image,
+			Blobs:  pin.Blobs,
+			Size:   size,
+			Pinned: true,
+		})
+	}
+
+	var total int64
+	for _, usage := range blobUsage {
+		total += usage
+	}
+	return usages, total, nil
 }
 
 func (m *Manager) AddSnapshot(imageID string, blobs []string) error {
@@ -84,3 +203,35 @@ func (m *Manager) AddSnapshot(imageID string, blobs []string) error {
 func (m *Manager) DelSnapshot(imageID string) error {
 	return m.db.DelSnapshot(imageID)
 }
+
+// Pin protects the blob caches of image from GC, the image could be
+// specified by digest or reference.
+func (m *Manager) Pin(image string) error {
+	return m.db.Pin(image)
+}
+
+// ReconcilePins pins the images from configuration, and unpins the images
+// pinned by previous configuration but no longer listed.
+func (m *Manager) ReconcilePins(images []string) error {
+	return m.db.ReconcilePins(images)
+}
+
+// Unpin removes the pin of image.
+func (m *Manager) Unpin(image string) error {
+	return m.db.Unpin(image)
+}
+
+// IsPinned returns true if the image reference is pinned.
+func (m *Manager) IsPinned(imageRef string) bool {
+	pinned, err := m.db.IsPinned(imageRef)
+	if err != nil {
+		log.L.WithError(err).Warnf("failed to check pin of image %s", imageRef)
+		return false
+	}
+	return pinned
+}
+
+// ListPins returns all pinned images.
+func (m *Manager) ListPins() ([]store.Pin, error) {
+	return m.db.ListPins()
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/store"
+)
+
+func TestPin(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "nydus-cache-")
+	require.Nil(t, err)
+	defer os.RemoveAll(rootDir)
+
+	db, err := store.NewDatabase(rootDir)
+	require.Nil(t, err)
+	cacheDir := filepath.Join(rootDir, "cache")
+	require.Nil(t, os.MkdirAll(cacheDir, 0755))
+	m, err := NewManager(Opt{
+		CacheDir: cacheDir,
+		Period:   time.Hour,
+		Database: db,
+	})
+	require.Nil(t, err)
+
+	image := "docker.io/library/busybox@sha256:abc"
+	blobs := []string{"blob1", "blob2"}
+	for _, blob := range blobs {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(cacheDir, blob), nil, 0644))
+	}
+	require.Nil(t, m.AddSnapshot(image, blobs))
+
+	// Pin by digest of image
+	require.Nil(t, m.Pin("sha256:abc"))
+	require.Nil(t, m.Pin("sha256:abc"))
+	assert.True(t, m.IsPinned(image))
+	assert.False(t, m.IsPinned("docker.io/library/busybox:latest"))
+	pins, err := m.ListPins()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(pins))
+	assert.Equal(t, blobs, pins[0].Blobs)
+
+	// Blobs of pinned image are kept after snapshot is removed
+	require.Nil(t, m.DelSnapshot(image))
+	require.Nil(t, m.gc())
+	for _, blob := range blobs {
+		_, err := os.Stat(filepath.Join(cacheDir, blob))
+		assert.Nil(t, err)
+	}
+
+	require.Nil(t, m.Unpin("sha256:abc"))
+	assert.NotNil(t, m.Unpin("sha256:abc"))
+	assert.False(t, m.IsPinned(image))
+	require.Nil(t, m.gc())
+	for _, blob := range blobs {
+		_, err := os.Stat(filepath.Join(cacheDir, blob))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestUsage(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "nydus-cache-")
+	require.Nil(t, err)
+	defer os.RemoveAll(rootDir)
+
+	db, err := store.NewDatabase(rootDir)
+	require.Nil(t, err)
+	cacheDir := filepath.Join(rootDir, "cache")
+	require.Nil(t, os.MkdirAll(cacheDir, 0755))
+	m, err := NewManager(Opt{
+		CacheDir: cacheDir,
+		Period:   time.Hour,
+		Database: db,
+	})
+	require.Nil(t, err)
+
+	data := make([]byte, 8192)
+	for _, blob := range []string{"blob1", "blob2", "blob3"} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(cacheDir, blob), data, 0644))
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(cacheDir, "blob1.chunk_map"), data, 0644))
+	blobUsage, err := m.store.BlobUsage("blob1")
+	require.Nil(t, err)
+	assert.True(t, blobUsage >= 2*int64(len(data)))
+
+	require.Nil(t, m.AddSnapshot("docker.io/library/busybox@sha256:abc", []string{"blob1", "blob2"}))
+	require.Nil(t, m.AddSnapshot("docker.io/library/nginx@sha256:def", []string{"blob2"}))
+	// Pinned image without snapshot
+	require.Nil(t, m.AddSnapshot("docker.io/library/redis@sha256:123", []string{"blob3"}))
+	require.Nil(t, m.Pin("sha256:123"))
+	require.Nil(t, m.DelSnapshot("docker.io/library/redis@sha256:123"))
+
+	usages, total, err := m.Usage()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(usages))
+	sizes := make(map[string]int64)
+	for _, usage := range usages {
+		sizes[usage.Image] = usage.Size
+		assert.Equal(t, usage.Image == "sha256:123", usage.Pinned)
+	}
+	assert.Equal(t, sizes["sha256:123"], sizes["docker.io/library/nginx@sha256:def"])
+	assert.Equal(t, blobUsage+sizes["docker.io/library/nginx@sha256:def"], sizes["docker.io/library/busybox@sha256:abc"])
+	assert.Equal(t, sizes["docker.io/library/busybox@sha256:abc"]+sizes["sha256:123"], total)
+
+	// Nothing is removed since all blobs are in use
+	removed, err := m.GC()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(removed))
+	require.Nil(t, m.DelSnapshot("docker.io/library/nginx@sha256:def"))
+	require.Nil(t, m.DelSnapshot("docker.io/library/busybox@sha256:abc"))
+	removed, err = m.GC()
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"blob1", "blob2"}, removed)
+}
+
+func TestSharedCacheDir(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "nydus-cache-")
+	require.Nil(t, err)
+	defer os.RemoveAll(rootDir)
+
+	cacheDir := filepath.Join(rootDir, "cache")
+	require.Nil(t, os.MkdirAll(cacheDir, 0755))
+	newManager := func(instance, dbDir string) (*Manager, error) {
+		db, err := store.NewDatabase(filepath.Join(rootDir, dbDir))
+		require.Nil(t, err)
+		return NewManager(Opt{
+			CacheDir: cacheDir,
+			Period:   time.Hour,
+			Database: db,
+			Instance: instance,
+		})
+	}
+	blue, err := newManager("blue", "blue")
+	require.Nil(t, err)
+	green, err := newManager("green", "green")
+	require.Nil(t, err)
+	_, err = newManager("blue", "blue-2")
+	assert.NotNil(t, err)
+
+	// The blob used by green is unknown to blue
+	require.Nil(t, ioutil.WriteFile(filepath.Join(cacheDir, "blob1"), nil, 0644))
+	require.Nil(t, green.AddSnapshot("docker.io/library/busybox@sha256:abc", []string{"blob1"}))
+	require.Nil(t, blue.AddSnapshot("docker.io/library/busybox@sha256:abc", []string{"blob1"}))
+	require.Nil(t, blue.DelSnapshot("docker.io/library/busybox@sha256:abc"))
+	removed, err := blue.GC()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(removed))
+	_, err = os.Stat(filepath.Join(cacheDir, "blob1"))
+	assert.Nil(t, err)
+
+	// The lease of exited instance is removed on GC
+	require.Nil(t, green.lease.Unlock())
+	removed, err = blue.GC()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"blob1"}, removed)
+	_, err = os.Stat(filepath.Join(cacheDir, instancesDirName, "green"+leaseSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReconcilePins(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "nydus-cache-")
+	require.Nil(t, err)
+	defer os.RemoveAll(rootDir)
+
+	db, err := store.NewDatabase(rootDir)
+	require.Nil(t, err)
+	m, err := NewManager(Opt{
+		CacheDir: rootDir,
+		Period:   time.Hour,
+		Database: db,
+	})
+	require.Nil(t, err)
+
+	images := func() []string {
+		pins, err := m.ListPins()
+		require.Nil(t, err)
+		images := []string{}
+		for _, pin := range pins {
+			images = append(images, pin.Image)
+		}
+		return images
+	}
+
+	require.Nil(t, m.Pin("sha256:api"))
+	require.Nil(t, m.ReconcilePins([]string{"sha256:abc", "sha256:def"}))
+	assert.ElementsMatch(t, []string{"sha256:abc", "sha256:def", "sha256:api"}, images())
+
+	// Images dropped from configuration are unpinned on restart, the pin
+	// added by management API is kept
+	require.Nil(t, m.ReconcilePins([]string{"sha256:abc"}))
+	assert.ElementsMatch(t, []string{"sha256:abc", "sha256:api"}, images())
+	require.Nil(t, m.ReconcilePins([]string{"sha256:api"}))
+	assert.ElementsMatch(t, []string{"sha256:api"}, images())
+	require.Nil(t, m.ReconcilePins(nil))
+	assert.ElementsMatch(t, []string{"sha256:api"}, images())
+}
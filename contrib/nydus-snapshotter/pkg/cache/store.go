@@ -3,12 +3,15 @@ package cache
 import (
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/pkg/errors"
 )
 
 type Store interface {
 	DelBlob(blob string) error
+	// BlobUsage returns the disk usage in bytes of the cache files of blob.
+	BlobUsage(blob string) (int64, error)
 }
 
 type CacheStore struct {
@@ -30,3 +33,28 @@ func (cs *CacheStore) DelBlob(blob string) error {
 func (cs *CacheStore) blobPath(blob string) string {
 	return filepath.Join(cs.cacheDir, blob)
 }
+
+// BlobUsage sums the allocated blocks of blob cache file and its chunk map
+// files, the cache file is sparse until all the chunks are fetched.
+func (cs *CacheStore) BlobUsage(blob string) (int64, error) {
+	files, err := filepath.Glob(cs.blobPath(blob) + "*")
+	if err != nil {
+		return 0, err
+	}
+	var usage int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			usage += int64(stat.Blocks) * 512
+		} else {
+			usage += info.Size()
+		}
+	}
+	return usage, nil
+}
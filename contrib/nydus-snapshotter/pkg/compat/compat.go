@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package compat handles the snapshots API and label behavior differences
+// across the maintained containerd lines, the behavior is selected at runtime
+// by the version negotiated with containerd, so that one snapshotter binary
+// can serve containerd 1.4 to 2.0.
+package compat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
+	"github.com/containerd/containerd/log"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+const (
+	defaultDialTimeout       = 5 * time.Second
+	defaultNegotiateInterval = 5 * time.Second
+)
+
+// Version is the version of containerd, only the major and minor
+// version are concerned, the behaviors don't change in patch releases.
+type Version struct {
+	Major int
+	Minor int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// AtLeast returns true if the version is equal to or newer than major.minor.
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// ParseVersion parses the version reported by containerd, e.g. "v1.6.21",
+// "1.7.0-rc.1" or "2.0.0".
+func ParseVersion(version string) (Version, error) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if idx := strings.IndexAny(trimmed, "-+"); idx >= 0 {
+		trimmed = trimmed[:idx]
+	}
+	parts := strings.Split(trimmed, ".")
+	if len(parts) < 2 {
+		return Version{}, errors.Errorf("invalid containerd version %q", version)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Version{}, errors.Wrapf(err, "invalid containerd version %q", version)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Version{}, errors.Wrapf(err, "invalid containerd version %q", version)
+	}
+	return Version{Major: major, Minor: minor}, nil
+}
+
+// Dial connects to containerd grpc socket at address.
+func Dial(ctx context.Context, address string) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultDialTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, address,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial containerd %s", address)
+	}
+	return conn, nil
+}
+
+// QueryVersion asks containerd listening on address for its version.
+func QueryVersion(ctx context.Context, address string) (Version, error) {
+	conn, err := Dial(ctx, address)
+	if err != nil {
+		return Version{}, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, defaultDialTimeout)
+	defer cancel()
+
+	resp, err := versionapi.NewVersionClient(conn).Version(ctx, &ptypes.Empty{})
+	if err != nil {
+		return Version{}, errors.Wrap(err, "failed to query containerd version")
+	}
+
+	return ParseVersion(resp.Version)
+}
+
+// Shim selects the behaviors by the negotiated containerd version, the
+// legacy behaviors are used until the version is known.
+type Shim struct {
+	mu      sync.RWMutex
+	version *Version
+}
+
+// NewShim creates a shim, the version is negotiated with containerd later
+// if it's empty.
+func NewShim(version string) (*Shim, error) {
+	shim := &Shim{}
+	if version != "" {
+		v, err := ParseVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		shim.version = &v
+	}
+	return shim, nil
+}
+
+// Version returns the negotiated containerd version.
+func (s *Shim) Version() (Version, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.version == nil {
+		return Version{}, false
+	}
+	return *s.version, true
+}
+
+func (s *Shim) setVersion(v Version) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = &v
+}
+
+// Negotiate queries containerd version until success or context is done,
+// containerd may be started after snapshotter since the snapshotter is
+// running as a proxy plugin.
+func (s *Shim) Negotiate(ctx context.Context, address string) {
+	if _, ok := s.Version(); ok {
+		return
+	}
+
+	ticker := time.NewTicker(defaultNegotiateInterval)
+	defer ticker.Stop()
+	for {
+		v, err := QueryVersion(ctx, address)
+		if err == nil {
+			s.setVersion(v)
+			log.G(ctx).Infof("negotiated containerd version %s", v)
+			return
+		}
+		log.G(ctx).WithError(err).Debug("failed to negotiate containerd version")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsImageLayer returns true if the snapshot is prepared for unpacking
+// an image layer rather than for a container rootfs.
+//
+// CRI marks image layers with the cri.image-layers label in all versions.
+// Since containerd 1.7, image may be unpacked by transfer service, e.g.
+// `ctr image pull --snapshotter nydus`, which doesn't go through the CRI
+// label handler unless the remote snapshot annotations are enabled, so the
+// target snapshot label set by unpacker is used to recognize image layers
+// as well.
+func (s *Shim) IsImageLayer(labels map[string]string) bool {
+	if _, ok := labels[label.CRIImageLayer]; ok {
+		return true
+	}
+	if v, ok := s.Version(); ok && v.AtLeast(1, 7) {
+		_, ok := labels[label.TargetSnapshotLabel]
+		return ok
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package compat
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+type fakeVersionServer struct {
+	version string
+}
+
+func (s *fakeVersionServer) Version(context.Context, *ptypes.Empty) (*versionapi.VersionResponse, error) {
+	return &versionapi.VersionResponse{Version: s.version}, nil
+}
+
+func TestParseVersion(t *testing.T) {
+	for version, expected := range map[string]Version{
+		"v1.4.3":        {1, 4},
+		"1.6.21":        {1, 6},
+		"v1.7.0-rc.1":   {1, 7},
+		"2.0.0+unknown": {2, 0},
+	} {
+		v, err := ParseVersion(version)
+		require.Nil(t, err, version)
+		assert.Equal(t, expected, v, version)
+	}
+
+	_, err := ParseVersion("dev")
+	assert.NotNil(t, err)
+}
+
+func TestIsImageLayer(t *testing.T) {
+	criLabels := map[string]string{
+		label.TargetSnapshotLabel: "sha256:abc",
+		label.CRIImageLayer:       "sha256:abc",
+	}
+	transferLabels := map[string]string{
+		label.TargetSnapshotLabel: "sha256:abc",
+	}
+	containerLabels := map[string]string{}
+
+	for _, tc := range []struct {
+		version  string
+		labels   map[string]string
+		expected bool
+	}{
+		{"", criLabels, true},
+		{"", transferLabels, false},
+		{"1.4.3", transferLabels, false},
+		{"1.6.0", criLabels, true},
+		{"1.6.0", transferLabels, false},
+		{"1.7.0", transferLabels, true},
+		{"1.7.0", containerLabels, false},
+		{"2.0.0", criLabels, true},
+		{"2.0.0", transferLabels, true},
+		{"2.0.0", containerLabels, false},
+	} {
+		shim, err := NewShim(tc.version)
+		require.Nil(t, err)
+		assert.Equal(t, tc.expected, shim.IsImageLayer(tc.labels), "version %q labels %v", tc.version, tc.labels)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-compat-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	address := filepath.Join(dir, "containerd.sock")
+	l, err := net.Listen("unix", address)
+	require.Nil(t, err)
+	server := grpc.NewServer()
+	versionapi.RegisterVersionServer(server, &fakeVersionServer{version: "v2.0.0"})
+	go server.Serve(l)
+	defer server.Stop()
+
+	shim, err := NewShim("")
+	require.Nil(t, err)
+	_, ok := shim.Version()
+	assert.False(t, ok)
+
+	shim.Negotiate(context.Background(), address)
+	v, ok := shim.Version()
+	assert.True(t, ok)
+	assert.Equal(t, Version{2, 0}, v)
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package compat
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// criPluginV1 is the CRI plugin selecting the snapshotter of pods
+	// before containerd 2.0, with config version 2.
+	criPluginV1 = "io.containerd.grpc.v1.cri"
+	// criImagesPlugin is the CRI image service plugin selecting the
+	// snapshotter of pods since containerd 2.0, with config version 3.
+	criImagesPlugin = "io.containerd.cri.v1.images"
+	// transferPlugin is the transfer service plugin unpacking the images
+	// pulled by `ctr image pull` since containerd 1.7.
+	transferPlugin = "io.containerd.transfer.v1.local"
+)
+
+// PluginOpt describes how the snapshotter is registered to containerd.
+type PluginOpt struct {
+	// Name is the name of proxy plugin, e.g. "nydus".
+	Name string
+	// Address is the socket address the snapshotter listens on.
+	Address string
+	// Platform is the platform unpacked by transfer service, e.g.
+	// "linux/amd64".
+	Platform string
+}
+
+// ContainerdConfig returns the containerd config registering the
+// snapshotter as a proxy plugin and selecting it for CRI, in the config
+// version and the plugin IDs of the containerd line:
+//
+//   - containerd 1.4 to 1.6 only unpack images for CRI, which is
+//     configured in the plugin "io.containerd.grpc.v1.cri".
+//   - containerd 1.7 unpacks images pulled by `ctr image pull` with the
+//     transfer service as well, which labels the layers for remote
+//     snapshotter only if the proxy plugin exports
+//     enable_remote_snapshot_annotations.
+//   - containerd 2.0 reads config version 3, the CRI snapshotter is moved
+//     to the plugin "io.containerd.cri.v1.images".
+func ContainerdConfig(v Version, opt PluginOpt) string {
+	var b strings.Builder
+	configVersion := 2
+	criPlugin := criPluginV1
+	criSection := fmt.Sprintf("[plugins.%q.containerd]", criPlugin)
+	if v.AtLeast(2, 0) {
+		configVersion = 3
+		criPlugin = criImagesPlugin
+		criSection = fmt.Sprintf("[plugins.%q]", criPlugin)
+	}
+	transfer := v.AtLeast(1, 7)
+
+	fmt.Fprintf(&b, "version = %d\n\n", configVersion)
+	fmt.Fprintf(&b, "[proxy_plugins]\n")
+	fmt.Fprintf(&b, "  [proxy_plugins.%s]\n", opt.Name)
+	fmt.Fprintf(&b, "    type = \"snapshot\"\n")
+	fmt.Fprintf(&b, "    address = %q\n", opt.Address)
+	if transfer {
+		fmt.Fprintf(&b, "    [proxy_plugins.%s.exports]\n", opt.Name)
+		fmt.Fprintf(&b, "      enable_remote_snapshot_annotations = \"true\"\n")
+	}
+	fmt.Fprintf(&b, "\n%s\n", criSection)
+	fmt.Fprintf(&b, "  snapshotter = %q\n", opt.Name)
+	fmt.Fprintf(&b, "  disable_snapshot_annotations = false\n")
+	if transfer {
+		fmt.Fprintf(&b, "\n[[plugins.%q.unpack_config]]\n", transferPlugin)
+		fmt.Fprintf(&b, "  platform = %q\n", opt.Platform)
+		fmt.Fprintf(&b, "  snapshotter = %q\n", opt.Name)
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package compat
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type proxyPlugin struct {
+	Type    string            `toml:"type"`
+	Address string            `toml:"address"`
+	Exports map[string]string `toml:"exports"`
+}
+
+type unpackConfig struct {
+	Platform    string `toml:"platform"`
+	Snapshotter string `toml:"snapshotter"`
+}
+
+type containerdConfig struct {
+	Version      int                    `toml:"version"`
+	ProxyPlugins map[string]proxyPlugin `toml:"proxy_plugins"`
+	Plugins      map[string]toml.Primitive
+}
+
+func TestContainerdConfig(t *testing.T) {
+	opt := PluginOpt{Name: "nydus", Address: "/run/nydus.sock", Platform: "linux/amd64"}
+	exports := map[string]string{"enable_remote_snapshot_annotations": "true"}
+
+	for _, tc := range []struct {
+		version       string
+		configVersion int
+		criPlugin     string
+		transfer      bool
+	}{
+		{"1.4", 2, criPluginV1, false},
+		{"1.6", 2, criPluginV1, false},
+		{"1.7", 2, criPluginV1, true},
+		{"2.0", 3, criImagesPlugin, true},
+	} {
+		v, err := ParseVersion(tc.version)
+		require.Nil(t, err)
+		var config containerdConfig
+		md, err := toml.Decode(ContainerdConfig(v, opt), &config)
+		require.Nil(t, err, tc.version)
+
+		assert.Equal(t, tc.configVersion, config.Version, tc.version)
+		plugin := config.ProxyPlugins["nydus"]
+		assert.Equal(t, "snapshot", plugin.Type, tc.version)
+		assert.Equal(t, "/run/nydus.sock", plugin.Address, tc.version)
+
+		// The snapshotter of CRI is configured in the containerd section of
+		// CRI plugin before containerd 2.0
+		var cri struct {
+			Snapshotter                string `toml:"snapshotter"`
+			DisableSnapshotAnnotations bool   `toml:"disable_snapshot_annotations"`
+			Containerd                 struct {
+				Snapshotter                string `toml:"snapshotter"`
+				DisableSnapshotAnnotations bool   `toml:"disable_snapshot_annotations"`
+			} `toml:"containerd"`
+		}
+		require.Contains(t, config.Plugins, tc.criPlugin, tc.version)
+		require.Nil(t, md.PrimitiveDecode(config.Plugins[tc.criPlugin], &cri))
+		if tc.criPlugin == criPluginV1 {
+			assert.Equal(t, "nydus", cri.Containerd.Snapshotter, tc.version)
+			assert.Empty(t, cri.Snapshotter, tc.version)
+		} else {
+			assert.Equal(t, "nydus", cri.Snapshotter, tc.version)
+			assert.Empty(t, cri.Containerd.Snapshotter, tc.version)
+		}
+
+		if !tc.transfer {
+			assert.Empty(t, plugin.Exports, tc.version)
+			assert.NotContains(t, config.Plugins, transferPlugin, tc.version)
+			continue
+		}
+		assert.Equal(t, exports, plugin.Exports, tc.version)
+		var transfer struct {
+			UnpackConfig []unpackConfig `toml:"unpack_config"`
+		}
+		require.Nil(t, md.PrimitiveDecode(config.Plugins[transferPlugin], &transfer))
+		assert.Equal(t, []unpackConfig{{Platform: "linux/amd64", Snapshotter: "nydus"}}, transfer.UnpackConfig, tc.version)
+	}
+}
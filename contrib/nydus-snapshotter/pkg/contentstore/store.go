@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package contentstore shares the bootstrap files of nydus images with the
+// content store of containerd, so that containerd GC, disk usage accounting
+// and image export tooling see them. The bootstrap of each snapshot is
+// protected by a lease of containerd, and the private bootstrap file is
+// replaced by a hard link to the content blob, the snapshots having the
+// same bootstrap share a single copy verified by containerd.
+package contentstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	leasesapi "github.com/containerd/containerd/api/services/leases/v1"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/proxy"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	leasesproxy "github.com/containerd/containerd/leases/proxy"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/compat"
+)
+
+const (
+	DefaultNamespace      = "nydus"
+	DefaultContainerdRoot = "/var/lib/containerd"
+
+	leasePrefix      = "nydus-snapshotter/"
+	snapshotIDLabel  = "containerd.io/snapshot/nydus-snapshot-id"
+	contentPluginDir = "io.containerd.content.v1.content"
+)
+
+// Store imports the bootstrap files into the content store of containerd,
+// all methods are no-op on nil store.
+type Store struct {
+	mu        sync.Mutex
+	address   string
+	namespace string
+	// The blobs directory of containerd content store, the blob file
+	// path is <blobDir>/<algorithm>/<encoded digest>.
+	blobDir string
+	content content.Store
+	leases  leases.Manager
+}
+
+// New creates a store of containerd at address, the connection is
+// established on first use because containerd may start after snapshotter.
+func New(address, namespace, containerdRoot string) *Store {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	if containerdRoot == "" {
+		containerdRoot = DefaultContainerdRoot
+	}
+	return &Store{
+		address:   address,
+		namespace: namespace,
+		blobDir:   filepath.Join(containerdRoot, contentPluginDir, "blobs"),
+	}
+}
+
+func (s *Store) connect(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.content != nil {
+		return nil
+	}
+	conn, err := compat.Dial(ctx, s.address)
+	if err != nil {
+		return err
+	}
+	s.content = proxy.NewContentStore(contentapi.NewContentClient(conn))
+	s.leases = leasesproxy.NewLeaseManager(leasesapi.NewLeasesClient(conn))
+	return nil
+}
+
+func leaseID(snapshotID string) string {
+	return leasePrefix + snapshotID
+}
+
+func (s *Store) blobPath(dgst digest.Digest) string {
+	return filepath.Join(s.blobDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func digestFile(path string) (ocispec.Descriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.NewDigest(digest.SHA256, h),
+		Size:      size,
+	}, nil
+}
+
+// Import writes the bootstrap of snapshot to content store under the lease
+// of snapshot, then replaces the bootstrap file by a hard link to the
+// content blob, the private file is kept if the blob isn't on the same
+// filesystem with bootstrap.
+func (s *Store) Import(ctx context.Context, snapshotID, bootstrap string) (digest.Digest, error) {
+	if s == nil {
+		return "", nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return "", err
+	}
+
+	desc, err := digestFile(bootstrap)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to digest bootstrap %s", bootstrap)
+	}
+
+	ctx = namespaces.WithNamespace(ctx, s.namespace)
+	lease := leases.Lease{ID: leaseID(snapshotID)}
+	if _, err := s.leases.Create(ctx, leases.WithID(lease.ID), leases.WithLabels(map[string]string{
+		snapshotIDLabel: snapshotID,
+	})); err != nil && !errdefs.IsAlreadyExists(err) {
+		return "", errors.Wrapf(err, "failed to create lease %s", lease.ID)
+	}
+
+	f, err := os.Open(bootstrap)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// The content is verified against the digest by containerd on commit
+	ref := fmt.Sprintf("nydus-bootstrap-%s", desc.Digest.Encoded())
+	if err := content.WriteBlob(leases.WithLease(ctx, lease.ID), s.content, ref, f, desc); err != nil {
+		return "", errors.Wrapf(err, "failed to write bootstrap %s to content store", bootstrap)
+	}
+	// The content already existed isn't added to the lease by writer
+	if err := s.leases.AddResource(ctx, lease, leases.Resource{
+		ID:   desc.Digest.String(),
+		Type: "content",
+	}); err != nil {
+		return "", errors.Wrapf(err, "failed to add bootstrap %s to lease %s", desc.Digest, lease.ID)
+	}
+
+	if err := s.link(desc.Digest, bootstrap); err != nil {
+		log.G(ctx).WithError(err).Debugf("keep private bootstrap file %s", bootstrap)
+	}
+
+	return desc.Digest, nil
+}
+
+// link replaces the bootstrap file by a hard link to the content blob.
+func (s *Store) link(dgst digest.Digest, bootstrap string) error {
+	blob := s.blobPath(dgst)
+	blobInfo, err := os.Stat(blob)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(bootstrap)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(blobInfo, info) {
+		return nil
+	}
+
+	tmp := bootstrap + ".link"
+	_ = os.Remove(tmp)
+	if err := os.Link(blob, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, bootstrap); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Release deletes the lease of snapshot, the bootstrap will be removed by
+// containerd GC if it's not referenced by other snapshots or images.
+func (s *Store) Release(ctx context.Context, snapshotID string) error {
+	if s == nil {
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return err
+	}
+
+	ctx = namespaces.WithNamespace(ctx, s.namespace)
+	err := s.leases.Delete(ctx, leases.Lease{ID: leaseID(snapshotID)})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete lease of snapshot %s", snapshotID)
+	}
+	return nil
+}
+
+// Migrate imports the existing private bootstrap files, which is a map
+// from snapshot ID to bootstrap path, the bootstrap failed to import is
+// skipped, returns the count of migrated files. An error is returned only
+// if containerd isn't reachable, so that the caller can retry later.
+func (s *Store) Migrate(ctx context.Context, bootstraps map[string]string) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for id, bootstrap := range bootstraps {
+		if _, err := s.Import(ctx, id, bootstrap); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to migrate bootstrap of snapshot %s", id)
+			continue
+		}
+		migrated++
+	}
+	return migrated, nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package contentstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLeases struct {
+	sync.Mutex
+	resources map[string][]leases.Resource
+}
+
+func (m *fakeLeases) Create(ctx context.Context, opts ...leases.Opt) (leases.Lease, error) {
+	m.Lock()
+	defer m.Unlock()
+	var l leases.Lease
+	for _, opt := range opts {
+		if err := opt(&l); err != nil {
+			return leases.Lease{}, err
+		}
+	}
+	if ns, _ := namespaces.Namespace(ctx); ns != DefaultNamespace {
+		return leases.Lease{}, errors.Errorf("unexpected namespace %q", ns)
+	}
+	if _, ok := m.resources[l.ID]; ok {
+		return leases.Lease{}, errdefs.ErrAlreadyExists
+	}
+	m.resources[l.ID] = []leases.Resource{}
+	return l, nil
+}
+
+func (m *fakeLeases) Delete(ctx context.Context, l leases.Lease, opts ...leases.DeleteOpt) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.resources[l.ID]; !ok {
+		return errdefs.ErrNotFound
+	}
+	delete(m.resources, l.ID)
+	return nil
+}
+
+func (m *fakeLeases) List(ctx context.Context, filters ...string) ([]leases.Lease, error) {
+	return nil, errdefs.ErrNotImplemented
+}
+
+func (m *fakeLeases) AddResource(ctx context.Context, l leases.Lease, r leases.Resource) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.resources[l.ID]; !ok {
+		return errdefs.ErrNotFound
+	}
+	m.resources[l.ID] = append(m.resources[l.ID], r)
+	return nil
+}
+
+func (m *fakeLeases) DeleteResource(ctx context.Context, l leases.Lease, r leases.Resource) error {
+	return errdefs.ErrNotImplemented
+}
+
+func (m *fakeLeases) ListResources(ctx context.Context, l leases.Lease) ([]leases.Resource, error) {
+	return nil, errdefs.ErrNotImplemented
+}
+
+func TestStore(t *testing.T) {
+	var nilStore *Store
+	_, err := nilStore.Import(context.Background(), "1", "not-exist")
+	assert.Nil(t, err)
+	assert.Nil(t, nilStore.Release(context.Background(), "1"))
+
+	root, err := ioutil.TempDir("", "nydus-contentstore-")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	containerdRoot := filepath.Join(root, "containerd")
+	cs, err := local.NewStore(filepath.Join(containerdRoot, contentPluginDir))
+	require.Nil(t, err)
+	lm := &fakeLeases{resources: make(map[string][]leases.Resource)}
+	s := New("", "", containerdRoot)
+	s.content = cs
+	s.leases = lm
+
+	data := []byte("bootstrap")
+	dgst := digest.FromBytes(data)
+	bootstraps := make(map[string]string)
+	for _, id := range []string{"1", "2"} {
+		bootstrap := filepath.Join(root, "snapshots", id, "fs", "image", "image.boot")
+		require.Nil(t, os.MkdirAll(filepath.Dir(bootstrap), 0755))
+		require.Nil(t, ioutil.WriteFile(bootstrap, data, 0644))
+		bootstraps[id] = bootstrap
+	}
+	bootstraps["3"] = filepath.Join(root, "not-exist")
+
+	ctx := context.Background()
+	migrated, err := s.Migrate(ctx, bootstraps)
+	require.Nil(t, err)
+	assert.Equal(t, 2, migrated)
+
+	// Both snapshots hold the content by lease, and share the blob file
+	blobInfo, err := os.Stat(s.blobPath(dgst))
+	require.Nil(t, err)
+	for _, id := range []string{"1", "2"} {
+		assert.Equal(t, []leases.Resource{{ID: dgst.String(), Type: "content"}}, lm.resources[leaseID(id)])
+		info, err := os.Stat(bootstraps[id])
+		require.Nil(t, err)
+		assert.True(t, os.SameFile(blobInfo, info))
+		read, err := ioutil.ReadFile(bootstraps[id])
+		require.Nil(t, err)
+		assert.Equal(t, data, read)
+	}
+
+	// Import again is no-op
+	imported, err := s.Import(ctx, "1", bootstraps["1"])
+	require.Nil(t, err)
+	assert.Equal(t, dgst, imported)
+
+	require.Nil(t, s.Release(ctx, "1"))
+	require.Nil(t, s.Release(ctx, "1"))
+	_, ok := lm.resources[leaseID("1")]
+	assert.False(t, ok)
+}
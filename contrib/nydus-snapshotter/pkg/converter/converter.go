@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package converter converts the unpacked layers of the images without
+// nydus companion to nydus on node in background, the converted bootstraps
+// and blobs are cached locally, so that the subsequent containers of the
+// image can be lazily mounted by nydusd with localfs backend. The image is
+// also converted and pushed to companion repository if it's configured.
+package converter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	nydusify "github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+)
+
+// The unpacked layers of overlayfs snapshotter keep the whiteouts in
+// overlayfs spec.
+const whiteoutSpec = "overlayfs"
+
+// Layer is an unpacked image layer.
+type Layer struct {
+	// Key is the key of layer chain, see Key
+	Key string
+	// Path is the directory of unpacked layer
+	Path string
+}
+
+// Key returns the key of converted layer chain from the name of committed
+// image layer snapshot, which is the chain ID of layer. The converted
+// bootstraps are indexed by content rather than snapshot ID, so they are
+// shared by the identical layer chains.
+func Key(name string) (string, bool) {
+	dgst, err := digest.Parse(name)
+	if err != nil {
+		return "", false
+	}
+	return dgst.Encoded(), true
+}
+
+type Opt struct {
+	// RootDir holds the converted bootstraps and blobs
+	RootDir        string
+	NydusImagePath string
+	// TargetRepo is the companion repository prefix, the converted image
+	// of `<host>/<repo>:<tag>` is pushed to `<TargetRepo>/<repo>:<tag>`,
+	// the image isn't pushed if it's empty.
+	TargetRepo string
+	Insecure   bool
+}
+
+type Converter struct {
+	Opt
+	mu      sync.Mutex
+	pending map[string]struct{}
+	// Only one conversion runs at a time to bound the resource usage on node
+	sem chan struct{}
+}
+
+func New(opt Opt) (*Converter, error) {
+	if opt.RootDir == "" {
+		return nil, errors.New("root dir is required")
+	}
+	if opt.NydusImagePath == "" {
+		return nil, errors.New("nydus image binary path is required")
+	}
+	if opt.TargetRepo != "" {
+		if _, err := docker.ParseNormalizedNamed(opt.TargetRepo); err != nil {
+			return nil, errors.Wrapf(err, "invalid target repository %s", opt.TargetRepo)
+		}
+	}
+	for _, dir := range []string{opt.RootDir, filepath.Join(opt.RootDir, "blobs"), filepath.Join(opt.RootDir, "work")} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &Converter{
+		Opt:     opt,
+		pending: make(map[string]struct{}),
+		sem:     make(chan struct{}, 1),
+	}, nil
+}
+
+// SnapshotRoot is the directory of converted bootstraps, the bootstrap of
+// layer chain is placed in the same way as nydus meta layer snapshot.
+func (c *Converter) SnapshotRoot() string {
+	return filepath.Join(c.RootDir, "snapshots")
+}
+
+// BlobDir is the directory of converted blobs, which are shared by all
+// converted images.
+func (c *Converter) BlobDir() string {
+	return filepath.Join(c.RootDir, "blobs")
+}
+
+func (c *Converter) bootstrapPath(key string) string {
+	return filepath.Join(c.SnapshotRoot(), key, "fs", "image", "image.boot")
+}
+
+// IsConverted checks if the layer chain of key has been converted.
+func (c *Converter) IsConverted(key string) bool {
+	_, err := daemon.GetBootstrapFile(c.SnapshotRoot(), key)
+	return err == nil
+}
+
+// Remove removes the converted bootstrap of layer chain, the blobs are
+// kept since they may be referenced by other bootstraps.
+func (c *Converter) Remove(key string) error {
+	return os.RemoveAll(filepath.Join(c.SnapshotRoot(), key))
+}
+
+// Schedule converts the layers from bottom to top in background, auth is
+// the base64 encoded registry credential to pull the image for pushing to
+// companion repository. It returns false if the layers have been converted
+// or the conversion is in progress.
+func (c *Converter) Schedule(ctx context.Context, image, auth string, layers []Layer) bool {
+	if len(layers) == 0 {
+		return false
+	}
+	top := layers[len(layers)-1].Key
+	if c.IsConverted(top) {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pending[top]; ok {
+		return false
+	}
+	c.pending[top] = struct{}{}
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.pending, top)
+			c.mu.Unlock()
+		}()
+
+		c.sem <- struct{}{}
+		defer func() { <-c.sem }()
+
+		log := logging.Snapshots.G(ctx).WithField("image", image)
+		log.Infof("converting image on node, layer chain %s", top)
+		if err := c.convert(layers); err != nil {
+			log.WithError(err).Error("failed to convert image on node")
+			return
+		}
+		log.Infof("converted image on node, layer chain %s", top)
+
+		if c.TargetRepo != "" {
+			if err := c.push(ctx, image, auth); err != nil {
+				log.WithError(err).Error("failed to push converted image to companion repository")
+			}
+		}
+	}()
+
+	return true
+}
+
+// convert builds the bootstrap of each layer with the parent bootstrap,
+// the bootstraps are moved into place after the blobs, so the existence of
+// bootstrap means the layer chain is converted.
+func (c *Converter) convert(layers []Layer) error {
+	workDir, err := ioutil.TempDir(filepath.Join(c.RootDir, "work"), "")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	workflow, err := build.NewWorkflow(build.WorkflowOption{
+		TargetDir:      workDir,
+		NydusImagePath: c.NydusImagePath,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create build workflow")
+	}
+
+	parentBootstrap := ""
+	for idx, layer := range layers {
+		bootstrap := filepath.Join(workDir, fmt.Sprintf("bootstrap-%d", idx))
+		blobPath, err := workflow.Build(layer.Path, whiteoutSpec, parentBootstrap, bootstrap)
+		if err != nil {
+			return errors.Wrapf(err, "failed to build layer chain %s", layer.Key)
+		}
+		if blobPath != "" {
+			if err := os.Rename(blobPath, filepath.Join(c.BlobDir(), filepath.Base(blobPath))); err != nil {
+				return errors.Wrap(err, "failed to move blob")
+			}
+		}
+		parentBootstrap = bootstrap
+	}
+
+	for idx, layer := range layers {
+		// The converted one may be mounted by nydusd already
+		if c.IsConverted(layer.Key) {
+			continue
+		}
+		target := c.bootstrapPath(layer.Key)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(workDir, fmt.Sprintf("bootstrap-%d", idx)), target); err != nil {
+			return errors.Wrapf(err, "failed to move bootstrap of layer chain %s", layer.Key)
+		}
+	}
+
+	return nil
+}
+
+// targetRef returns the reference of the companion image in target
+// repository, the tag of source image is kept, and the digest is turned
+// into tag in the form of `sha256-<hex>`.
+func (c *Converter) targetRef(image string) (string, error) {
+	named, err := docker.ParseDockerRef(image)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse image %s", image)
+	}
+	tag := "latest"
+	if tagged, ok := named.(docker.Tagged); ok {
+		tag = tagged.Tag()
+	} else if digested, ok := named.(docker.Digested); ok {
+		tag = strings.Replace(digested.Digest().String(), ":", "-", 1)
+	}
+	return fmt.Sprintf("%s/%s:%s", strings.TrimSuffix(c.TargetRepo, "/"), docker.Path(named), tag), nil
+}
+
+// push converts the image pulled from source registry by nydusify and
+// pushes it to companion repository, the credential of target registry is
+// read from docker config on node.
+func (c *Converter) push(ctx context.Context, image, auth string) error {
+	target, err := c.targetRef(image)
+	if err != nil {
+		return err
+	}
+
+	workDir, err := ioutil.TempDir(filepath.Join(c.RootDir, "work"), "")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	sourceRemote, err := provider.DefaultRemoteWithAuth(image, c.Insecure, auth)
+	if err != nil {
+		return errors.Wrap(err, "failed to create source remote")
+	}
+	sourceProviders, err := provider.DefaultSource(ctx, sourceRemote, workDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to create source provider")
+	}
+	targetRemote, err := provider.DefaultRemote(target, c.Insecure)
+	if err != nil {
+		return errors.Wrap(err, "failed to create target remote")
+	}
+	logger, err := provider.DefaultLogger()
+	if err != nil {
+		return err
+	}
+
+	cvt, err := nydusify.New(nydusify.Opt{
+		Logger:          logger,
+		SourceProviders: sourceProviders,
+		TargetRemote:    targetRemote,
+		NydusImagePath:  c.NydusImagePath,
+		WorkDir:         workDir,
+		BackendType:     "registry",
+	})
+	if err != nil {
+		return err
+	}
+	if err := cvt.Convert(ctx); err != nil {
+		return err
+	}
+	logging.Snapshots.G(ctx).Infof("pushed converted image of %s to %s", image, target)
+
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package converter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testChainID = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+func TestKey(t *testing.T) {
+	key, ok := Key(testChainID)
+	assert.True(t, ok)
+	assert.Equal(t, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", key)
+
+	_, ok = Key("extract-123-sha256:abc")
+	assert.False(t, ok)
+}
+
+func TestTargetRef(t *testing.T) {
+	c := Converter{Opt: Opt{TargetRepo: "registry.example.com/nydus/"}}
+
+	ref, err := c.targetRef("docker.io/library/nginx:1.21")
+	require.Nil(t, err)
+	assert.Equal(t, "registry.example.com/nydus/library/nginx:1.21", ref)
+
+	ref, err = c.targetRef("busybox")
+	require.Nil(t, err)
+	assert.Equal(t, "registry.example.com/nydus/library/busybox:latest", ref)
+
+	ref, err = c.targetRef("localhost:5000/app@" + testChainID)
+	require.Nil(t, err)
+	assert.Equal(t, "registry.example.com/nydus/app:sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", ref)
+}
+
+func TestSchedule(t *testing.T) {
+	root, err := ioutil.TempDir("", "nydus-converter-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	c, err := New(Opt{RootDir: root, NydusImagePath: "nydus-image"})
+	require.Nil(t, err)
+
+	key, _ := Key(testChainID)
+	assert.False(t, c.IsConverted(key))
+	assert.False(t, c.Schedule(context.TODO(), "busybox", "", nil))
+
+	// The converted layer chain is not scheduled again
+	require.Nil(t, os.MkdirAll(filepath.Dir(c.bootstrapPath(key)), 0700))
+	require.Nil(t, ioutil.WriteFile(c.bootstrapPath(key), []byte("bootstrap"), 0600))
+	assert.True(t, c.IsConverted(key))
+	assert.False(t, c.Schedule(context.TODO(), "busybox", "", []Layer{{Key: key, Path: root}}))
+
+	require.Nil(t, c.Remove(key))
+	assert.False(t, c.IsConverted(key))
+}
@@ -40,13 +40,22 @@ func WithConfigDir(dir string) NewDaemonOpt {
 	}
 }
 
+// WithSocketDir places the API socket of daemon in its own directory under
+// dir, the directories are only accessible by the owner, so that other
+// users on node can't connect to the socket.
 func WithSocketDir(dir string) NewDaemonOpt {
 	return func(d *Daemon) error {
 		s := filepath.Join(dir, d.ID)
 		// this may be failed, should handle that
-		if err := os.MkdirAll(s, 0755); err != nil {
+		if err := os.MkdirAll(s, 0700); err != nil {
 			return errors.Wrapf(err, "failed to create socket dir %s", s)
 		}
+		// The directories created by older versions are tightened too
+		for _, p := range []string{dir, s} {
+			if err := os.Chmod(p, 0700); err != nil {
+				return errors.Wrapf(err, "failed to change mode of socket dir %s", p)
+			}
+		}
 		d.SocketDir = s
 		return nil
 	}
@@ -102,6 +111,20 @@ func WithSharedDaemon() NewDaemonOpt {
 	}
 }
 
+func WithFuseThreads(threads int) NewDaemonOpt {
+	return func(d *Daemon) error {
+		d.FuseThreads = threads
+		return nil
+	}
+}
+
+func WithDigestValidate(validate bool) NewDaemonOpt {
+	return func(d *Daemon) error {
+		d.DigestValidate = validate
+		return nil
+	}
+}
+
 func WithAPISock(apiSock string) NewDaemonOpt {
 	return func(d *Daemon) error {
 		d.ApiSock = &apiSock
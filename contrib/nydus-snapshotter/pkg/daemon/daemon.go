@@ -38,6 +38,16 @@ type Daemon struct {
 	DaemonMode     string
 	ApiSock        *string
 	RootMountPoint *string
+	// FuseThreads is the number of FUSE threads, uses the default if 0
+	FuseThreads int
+	// DigestValidate is true if the chunks of image are validated by their
+	// digests, the read errors not caused by backend are integrity failures
+	DigestValidate bool
+	// ServerUIDs are the UIDs nydusd is allowed to run as, the process
+	// serving the API socket is verified by peer credentials, see
+	// nydussdk.WithServerUIDs. It's set by process manager rather than
+	// persisted.
+	ServerUIDs []uint32 `json:"-"`
 }
 
 func (d *Daemon) SharedMountPoint() string {
@@ -70,8 +80,14 @@ func (d *Daemon) LogFile() string {
 	return filepath.Join(d.LogDir, "stderr.log")
 }
 
+// Client returns the client of API socket, which requires the socket to be
+// served by the nydusd process of daemon.
+func (d *Daemon) Client() (nydussdk.Interface, error) {
+	return nydussdk.NewNydusClient(d.APISock(), nydussdk.WithPeerPid(d.Pid), nydussdk.WithServerUIDs(d.ServerUIDs))
+}
+
 func (d *Daemon) CheckStatus() (model.DaemonInfo, error) {
-	client, err := nydussdk.NewNydusClient(d.APISock())
+	client, err := d.Client()
 	if err != nil {
 		return model.DaemonInfo{}, errors.Wrap(err, "failed to check status, client has not been initialized")
 	}
@@ -79,7 +95,7 @@ func (d *Daemon) CheckStatus() (model.DaemonInfo, error) {
 }
 
 func (d *Daemon) SharedMount() error {
-	client, err := nydussdk.NewNydusClient(d.APISock())
+	client, err := d.Client()
 	if err != nil {
 		return errors.Wrap(err, "failed to mount")
 	}
@@ -90,8 +106,35 @@ func (d *Daemon) SharedMount() error {
 	return client.SharedMount(d.MountPoint(), bootstrap, d.ConfigFile())
 }
 
+// Remount replaces the config of the mounted instance with configFile, the
+// instance of dedicated daemon is mounted at the root of its daemon.
+func (d *Daemon) Remount(configFile string) error {
+	client, err := d.Client()
+	if err != nil {
+		return errors.Wrap(err, "failed to remount")
+	}
+	bootstrap, err := d.BootstrapFile()
+	if err != nil {
+		return err
+	}
+	mountPoint := "/"
+	if d.IsSharedDaemon() {
+		mountPoint = d.MountPoint()
+	}
+	return client.Remount(mountPoint, bootstrap, configFile)
+}
+
+// GetBackendMetric returns the metric of the storage backend of instance.
+func (d *Daemon) GetBackendMetric() (*model.BackendMetric, error) {
+	client, err := d.Client()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get backend metric")
+	}
+	return client.GetBackendMetric(d.IsSharedDaemon(), d.SnapshotID)
+}
+
 func (d *Daemon) SharedUmount() error {
-	client, err := nydussdk.NewNydusClient(d.APISock())
+	client, err := d.Client()
 	if err != nil {
 		return errors.Wrap(err, "failed to mount")
 	}
@@ -14,6 +14,9 @@ import (
 
 var (
 	ErrAlreadyExists = errors.New("already exists")
+	// ErrDraining is returned when creating nydusd instance for image
+	// while snapshotter is draining
+	ErrDraining = errors.New("snapshotter is draining")
 )
 
 // IsAlreadyExists returns true if the error is due to already exists
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package converted
+
+import (
+	"errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/process"
+)
+
+func WithConverter(c *converter.Converter) NewFSOpt {
+	return func(d *filesystem) error {
+		if c == nil {
+			return errors.New("converter cannot be nil")
+		}
+		d.converter = c
+		return nil
+	}
+}
+
+func WithProcessManager(pm *process.Manager) NewFSOpt {
+	return func(d *filesystem) error {
+		if pm == nil {
+			return errors.New("process manager cannot be nil")
+		}
+		d.manager = pm
+		return nil
+	}
+}
+
+func WithDaemonConfig(cfg config.DaemonConfig) NewFSOpt {
+	return func(d *filesystem) error {
+		if (config.DaemonConfig{}) == cfg {
+			return errors.New("daemon config is empty")
+		}
+		d.daemonCfg = cfg
+		return nil
+	}
+}
+
+type NewFSOpt func(d *filesystem) error
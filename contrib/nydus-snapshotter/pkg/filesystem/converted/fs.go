@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package converted mounts the images converted on node by nydusd, the
+// blobs are read from local converted blob directory.
+package converted
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/errdefs"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/fs"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/meta"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/process"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/utils/retry"
+)
+
+const backendTypeLocalfs = "localfs"
+
+// filesystem is indexed by the key of converted layer chain rather than
+// snapshot ID, see converter.Key.
+type filesystem struct {
+	meta.FileSystemMeta
+	manager   *process.Manager
+	daemonCfg config.DaemonConfig
+	converter *converter.Converter
+}
+
+func NewFileSystem(ctx context.Context, opt ...NewFSOpt) (fs.FileSystem, error) {
+	var fs filesystem
+	for _, o := range opt {
+		err := o(&fs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fs.converter == nil {
+		return nil, errors.New("converter is required")
+	}
+	fs.FileSystemMeta = meta.FileSystemMeta{
+		RootDir: fs.converter.RootDir,
+	}
+
+	return &fs, nil
+}
+
+// Support always returns false, the image layers are unpacked as usual
+// and converted after that.
+func (f *filesystem) Support(ctx context.Context, labels map[string]string) bool {
+	return false
+}
+
+func (f *filesystem) PrepareLayer(context.Context, storage.Snapshot, map[string]string) error {
+	panic("converted image has no layer to prepare")
+}
+
+func (f *filesystem) createNewDaemon(key string, imageID string) (*daemon.Daemon, error) {
+	d, err := daemon.NewDaemon(
+		daemon.WithSnapshotID(key),
+		daemon.WithSocketDir(f.SocketRoot()),
+		daemon.WithConfigDir(f.ConfigRoot()),
+		daemon.WithSnapshotDir(f.SnapshotRoot()),
+		daemon.WithLogDir(f.LogRoot()),
+		daemon.WithCacheDir(f.CacheRoot()),
+		daemon.WithImageID(imageID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = f.manager.NewDaemon(d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Mount starts nydusd for the converted layer chain of key, the daemon is
+// shared by all containers of the image.
+func (f *filesystem) Mount(ctx context.Context, key string, labels map[string]string) (err error) {
+	imageID, ok := labels[label.ImageRef]
+	if !ok {
+		return fmt.Errorf("failed to find image ref of layer chain %s, labels %v", key, labels)
+	}
+	if !f.converter.IsConverted(key) {
+		return fmt.Errorf("layer chain %s is not converted", key)
+	}
+	d, err := f.createNewDaemon(key, imageID)
+	// if daemon already exists for key, just return
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.manager.DestroyDaemon(d)
+		}
+	}()
+	if err = f.generateDaemonConfig(d); err != nil {
+		return err
+	}
+	if err = f.manager.StartDaemon(d); err != nil {
+		return errors.Wrapf(err, "failed to start daemon %s", d.ID)
+	}
+	return nil
+}
+
+func (f *filesystem) BootstrapFile(key string) (string, error) {
+	return daemon.GetBootstrapFile(f.SnapshotRoot(), key)
+}
+
+func (f *filesystem) NewDaemonConfig(labels map[string]string) (config.DaemonConfig, error) {
+	panic("converted image requires nydusd")
+}
+
+// generateDaemonConfig reads blobs from the local converted blob directory,
+// so the blob cache is disabled.
+func (f *filesystem) generateDaemonConfig(d *daemon.Daemon) error {
+	cfg := f.daemonCfg
+	cfg.Device.Backend.BackendType = backendTypeLocalfs
+	cfg.Device.Backend.Config.Dir = f.converter.BlobDir()
+	cfg.Device.Backend.Config.Host = ""
+	cfg.Device.Backend.Config.Repo = ""
+	cfg.Device.Backend.Config.Auth = ""
+	cfg.Device.Backend.Config.RegistryToken = ""
+	cfg.Device.Cache.CacheType = ""
+	return config.SaveConfig(cfg, d.ConfigFile())
+}
+
+func (f *filesystem) WaitUntilReady(ctx context.Context, key string) error {
+	s, err := f.manager.GetBySnapshotID(key)
+	if err != nil {
+		return err
+	}
+	return retry.Do(func() error {
+		info, err := s.CheckStatus()
+		if err != nil {
+			return err
+		}
+		logging.FS.G(ctx).Infof("daemon %s layer chain %s info %v", s.ID, key, info)
+		if info.State != "Running" {
+			return errors.Wrap(err, fmt.Sprintf("daemon %s layer chain %s is not ready", s.ID, key))
+		}
+		return nil
+	},
+		retry.Attempts(3),
+		retry.LastErrorOnly(true),
+		retry.Delay(100*time.Millisecond),
+	)
+}
+
+// Umount destroys nydusd of the converted layer chain, mountPoint is in
+// the form of `<root>/snapshots/<key>`.
+func (f *filesystem) Umount(ctx context.Context, mountPoint string) error {
+	key := filepath.Base(mountPoint)
+	logging.FS.G(ctx).Infof("umount nydus daemon of layer chain %s, mountpoint %s", key, mountPoint)
+	return f.manager.DestroyBySnapshotID(key)
+}
+
+func (f *filesystem) Cleanup(ctx context.Context) error {
+	for _, d := range f.manager.ListDaemons() {
+		if d.SnapshotDir != f.SnapshotRoot() {
+			continue
+		}
+		err := f.Umount(ctx, filepath.Dir(d.MountPoint()))
+		if err != nil {
+			logging.FS.G(ctx).Infof("failed to umount %s err %+v", d.MountPoint(), err)
+		}
+	}
+	return nil
+}
+
+func (f *filesystem) MountPoint(key string) (string, error) {
+	if d, err := f.manager.GetBySnapshotID(key); err == nil && d.SnapshotDir == f.SnapshotRoot() {
+		return d.MountPoint(), nil
+	}
+	return "", fmt.Errorf("failed to find mountpoint of layer chain %s", key)
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/blobproxy"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/cache"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/fs"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/meta"
@@ -88,6 +89,42 @@ func WithVPCRegistry(vpcRegistry bool) NewFSOpt {
 	}
 }
 
+// WithHostConfigDir sets the directory of nydusd config templates per
+// registry host, see config.LoadHostConfig.
+func WithHostConfigDir(dir string) NewFSOpt {
+	return func(d *filesystem) error {
+		d.hostConfigDir = dir
+		return nil
+	}
+}
+
+// WithSizeClasses sets the classes tuning the IO concurrency of nydusd by
+// the size of image.
+func WithSizeClasses(classes config.SizeClasses) NewFSOpt {
+	return func(d *filesystem) error {
+		d.sizeClasses = classes
+		return nil
+	}
+}
+
+// WithDigestValidate requires nydusd to validate the digest of chunks for
+// all images, even if it's disabled by the config template.
+func WithDigestValidate(validate bool) NewFSOpt {
+	return func(d *filesystem) error {
+		d.digestValidate = validate
+		return nil
+	}
+}
+
+// WithBlobProxy redirects the registry backend of nydusd to the node-local
+// blob proxy.
+func WithBlobProxy(proxy *blobproxy.Proxy) NewFSOpt {
+	return func(d *filesystem) error {
+		d.blobProxy = proxy
+		return nil
+	}
+}
+
 func WithDaemonMode(daemonMode string) NewFSOpt {
 	return func(d *filesystem) error {
 		mode := strings.ToLower(daemonMode)
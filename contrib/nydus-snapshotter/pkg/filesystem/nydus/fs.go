@@ -13,17 +13,18 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/pkg/errors"
 
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/blobproxy"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/cache"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/errdefs"
 	fspkg "github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/fs"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/meta"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/process"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/signature"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/utils/retry"
@@ -37,6 +38,10 @@ type filesystem struct {
 	verifier         *signature.Verifier
 	daemonCfg        config.DaemonConfig
 	vpcRegistry      bool
+	hostConfigDir    string
+	sizeClasses      config.SizeClasses
+	digestValidate   bool
+	blobProxy        *blobproxy.Proxy
 	nydusdBinaryPath string
 	mode             fspkg.FSMode
 }
@@ -60,7 +65,7 @@ func NewFileSystem(ctx context.Context, opt ...NewFSOpt) (_ fspkg.FileSystem, re
 		// Check if daemon is already running
 		d, err := fs.manager.GetByID(daemon.SharedNydusDaemonID)
 		if err == nil && d != nil {
-			log.G(ctx).Infof("daemon(ID=%s) is already running and reconnected", daemon.SharedNydusDaemonID)
+			logging.FS.G(ctx).Infof("daemon(ID=%s) is already running and reconnected", daemon.SharedNydusDaemonID)
 			return &fs, nil
 		}
 
@@ -125,7 +130,9 @@ func (fs *filesystem) Mount(ctx context.Context, snapshotID string, labels map[s
 	if !ok {
 		return fmt.Errorf("failed to find image ref of snapshot %s, labels %v", snapshotID, labels)
 	}
-	d, err := fs.newDaemon(snapshotID, imageID)
+	class := fs.sizeClasses.Match(labels)
+	validate := fs.digestValidate || fs.daemonCfg.DigestValidate || (class != nil && class.DigestValidate)
+	d, err := fs.newDaemon(snapshotID, imageID, class, validate)
 	// if daemon already exists for snapshotID, just return
 	if err != nil {
 		if errdefs.IsAlreadyExists(err) {
@@ -149,7 +156,7 @@ func (fs *filesystem) Mount(ctx context.Context, snapshotID string, labels map[s
 	}
 	err = fs.mount(d, labels)
 	if err != nil {
-		log.G(ctx).Errorf("failed to mount %s, %v", d.MountPoint(), err)
+		logging.FS.G(ctx).Errorf("failed to mount %s, %v", d.MountPoint(), err)
 		return errors.Wrap(err, fmt.Sprintf("failed to mount daemon %s", d.ID))
 	}
 	return nil
@@ -172,7 +179,7 @@ func (fs *filesystem) WaitUntilReady(ctx context.Context, snapshotID string) err
 		if err != nil {
 			return err
 		}
-		log.G(ctx).Infof("daemon %s snapshotID %s info %v", s.ID, snapshotID, info)
+		logging.FS.G(ctx).Infof("daemon %s snapshotID %s info %v", s.ID, snapshotID, info)
 		if info.State != "Running" {
 			return errors.Wrap(err, fmt.Sprintf("daemon %s snapshotID %s is not ready", s.ID, snapshotID))
 		}
@@ -200,7 +207,7 @@ func (fs *filesystem) Umount(ctx context.Context, mountPoint string) error {
 	if err := fs.cacheMgr.DelSnapshot(daemon.ImageID); err != nil {
 		return errors.Wrap(err, "del snapshot err")
 	}
-	log.L.Debugf("remove snapshot %s\n", daemon.ImageID)
+	logging.FS.L().Debugf("remove snapshot %s\n", daemon.ImageID)
 	fs.cacheMgr.SchedGC()
 	return nil
 }
@@ -213,7 +220,7 @@ func (fs *filesystem) Cleanup(ctx context.Context) error {
 	for _, d := range fs.manager.ListDaemons() {
 		err := fs.Umount(ctx, filepath.Dir(d.MountPoint()))
 		if err != nil {
-			log.G(ctx).Infof("failed to umount %s err %+v", d.MountPoint(), err)
+			logging.FS.G(ctx).Infof("failed to umount %s err %+v", d.MountPoint(), err)
 		}
 	}
 	return nil
@@ -245,13 +252,18 @@ func (fs *filesystem) NewDaemonConfig(labels map[string]string) (config.DaemonCo
 		return config.DaemonConfig{}, fmt.Errorf("no image ID found in label")
 	}
 
-	cfg, err := config.NewDaemonConfig(fs.daemonCfg, imageID, fs.vpcRegistry, labels)
+	cfg, err := config.NewDaemonConfig(fs.daemonCfg, imageID, fs.vpcRegistry, labels, fs.hostConfigDir)
 	if err != nil {
 		return config.DaemonConfig{}, err
 	}
 	// Overriding work_dir option of nyudsd config as we want to set it
 	// via snapshotter config option to let snapshotter handle blob cache GC.
 	cfg.Device.Cache.Config.WorkDir = fs.cacheMgr.CacheDir()
+	fs.sizeClasses.Match(labels).Apply(&cfg)
+	config.ApplyMergingSize(labels, &cfg)
+	if fs.digestValidate {
+		cfg.DigestValidate = true
+	}
 	return cfg, nil
 }
 
@@ -278,23 +290,29 @@ func (fs *filesystem) addSnapshot(imageID string, labels map[string]string) erro
 	if err != nil {
 		return err
 	}
-	log.L.Infof("image %s with blob caches %v", imageID, blobs)
+	logging.FS.L().Infof("image %s with blob caches %v", imageID, blobs)
 	return fs.cacheMgr.AddSnapshot(imageID, blobs)
 }
 
-func (fs *filesystem) newDaemon(snapshotID string, imageID string) (*daemon.Daemon, error) {
+// newDaemon creates the daemon serving image, validate decides whether the
+// chunks of image are validated by their digests.
+func (fs *filesystem) newDaemon(snapshotID string, imageID string, class *config.SizeClass, validate bool) (*daemon.Daemon, error) {
 	if fs.mode == fspkg.SingleInstance {
-		return fs.createSharedDaemon(snapshotID, imageID)
+		return fs.createSharedDaemon(snapshotID, imageID, validate)
 	}
-	return fs.createNewDaemon(snapshotID, imageID)
+	return fs.createNewDaemon(snapshotID, imageID, class, validate)
 }
 
 // createNewDaemon create new nydus daemon by snapshotID and imageID
-func (fs *filesystem) createNewDaemon(snapshotID string, imageID string) (*daemon.Daemon, error) {
+func (fs *filesystem) createNewDaemon(snapshotID string, imageID string, class *config.SizeClass, validate bool) (*daemon.Daemon, error) {
 	var (
-		d   *daemon.Daemon
-		err error
+		d           *daemon.Daemon
+		err         error
+		fuseThreads int
 	)
+	if class != nil {
+		fuseThreads = class.FuseThreads
+	}
 	if d, err = daemon.NewDaemon(
 		daemon.WithSnapshotID(snapshotID),
 		daemon.WithSocketDir(fs.SocketRoot()),
@@ -303,6 +321,8 @@ func (fs *filesystem) createNewDaemon(snapshotID string, imageID string) (*daemo
 		daemon.WithLogDir(fs.LogRoot()),
 		daemon.WithCacheDir(fs.cacheMgr.CacheDir()),
 		daemon.WithImageID(imageID),
+		daemon.WithFuseThreads(fuseThreads),
+		daemon.WithDigestValidate(validate),
 	); err != nil {
 		return nil, err
 	}
@@ -315,7 +335,7 @@ func (fs *filesystem) createNewDaemon(snapshotID string, imageID string) (*daemo
 // createSharedDaemon create an virtual daemon from global shared daemon instance
 // the global shared daemon with an special ID "shared_daemon", all virtual daemons are
 // created from this daemon with api invocation
-func (fs *filesystem) createSharedDaemon(snapshotID string, imageID string) (*daemon.Daemon, error) {
+func (fs *filesystem) createSharedDaemon(snapshotID string, imageID string, validate bool) (*daemon.Daemon, error) {
 	var (
 		sharedDaemon *daemon.Daemon
 		d            *daemon.Daemon
@@ -333,6 +353,7 @@ func (fs *filesystem) createSharedDaemon(snapshotID string, imageID string) (*da
 		daemon.WithLogDir(fs.LogRoot()),
 		daemon.WithCacheDir(fs.cacheMgr.CacheDir()),
 		daemon.WithImageID(imageID),
+		daemon.WithDigestValidate(validate),
 	); err != nil {
 		return nil, err
 	}
@@ -344,13 +365,23 @@ func (fs *filesystem) createSharedDaemon(snapshotID string, imageID string) (*da
 
 // generateDaemonConfig generate Daemon configuration
 func (fs *filesystem) generateDaemonConfig(d *daemon.Daemon, labels map[string]string) error {
-	cfg, err := config.NewDaemonConfig(fs.daemonCfg, d.ImageID, fs.vpcRegistry, labels)
+	cfg, err := config.NewDaemonConfig(fs.daemonCfg, d.ImageID, fs.vpcRegistry, labels, fs.hostConfigDir)
 	if err != nil {
 		return errors.Wrapf(err, "failed to generate daemon config for daemon %s", d.ID)
 	}
 	// Overriding work_dir option of nyudsd config as we want to set it
 	// via snapshotter config option to let snapshotter handle blob cache GC.
 	cfg.Device.Cache.Config.WorkDir = fs.cacheMgr.CacheDir()
+	fs.sizeClasses.Match(labels).Apply(&cfg)
+	config.ApplyMergingSize(labels, &cfg)
+	if d.DigestValidate {
+		cfg.DigestValidate = true
+	}
+	if fs.blobProxy != nil {
+		if err := fs.blobProxy.Rewrite(&cfg); err != nil {
+			return errors.Wrapf(err, "failed to redirect daemon %s to blob proxy", d.ID)
+		}
+	}
 	return config.SaveConfig(cfg, d.ConfigFile())
 }
 
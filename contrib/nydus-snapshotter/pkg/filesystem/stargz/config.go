@@ -67,4 +67,13 @@ func WithDaemonConfig(cfg config.DaemonConfig) NewFSOpt {
 	}
 }
 
+// WithHostConfigDir sets the directory of nydusd config templates per
+// registry host, see config.LoadHostConfig.
+func WithHostConfigDir(dir string) NewFSOpt {
+	return func(d *filesystem) error {
+		d.hostConfigDir = dir
+		return nil
+	}
+}
+
 type NewFSOpt func(d *filesystem) error
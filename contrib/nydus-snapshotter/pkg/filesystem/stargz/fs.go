@@ -15,8 +15,8 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots/storage"
+	godigest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
@@ -26,6 +26,7 @@ import (
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/fs"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/meta"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/process"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/utils/retry"
 )
@@ -36,6 +37,7 @@ type filesystem struct {
 	daemonCfg             config.DaemonConfig
 	resolver              *Resolver
 	vpcRegistry           bool
+	hostConfigDir         string
 	nydusdBinaryPath      string
 	nydusdImageBinaryPath string
 }
@@ -67,7 +69,7 @@ func (f *filesystem) PrepareLayer(ctx context.Context, s storage.Snapshot, label
 	start := time.Now()
 	defer func() {
 		duration := time.Since(start)
-		log.G(ctx).Infof("total stargz prepare layer duration %d", duration.Milliseconds())
+		logging.FS.G(ctx).Infof("total stargz prepare layer duration %d", duration.Milliseconds())
 	}()
 	ref, layerDigest := parseLabels(labels)
 	if ref == "" || layerDigest == "" {
@@ -82,14 +84,29 @@ func (f *filesystem) PrepareLayer(ctx context.Context, s storage.Snapshot, label
 	if err != nil {
 		return errors.Wrapf(err, "failed to read toc from ref %s, digest %s", ref, layerDigest)
 	}
+	// The toc digest annotation is optional, the toc located by footer is
+	// verified only if it's passed down
+	var verifier godigest.Verifier
+	if tocDigest, ok := labels[label.StargzTocDigest]; ok {
+		expected, err := godigest.Parse(tocDigest)
+		if err != nil {
+			return errors.Wrapf(err, "invalid toc digest %s", tocDigest)
+		}
+		verifier = expected.Verifier()
+		r = io.TeeReader(r, verifier)
+	}
 	starGzToc, err := os.OpenFile(filepath.Join(f.UpperPath(s.ID), stargzToc), os.O_CREATE|os.O_RDWR, 0755)
 	if err != nil {
 		return errors.Wrap(err, "failed to create stargz index")
 	}
 	_, err = io.Copy(starGzToc, r)
+	starGzToc.Close()
 	if err != nil {
 		return errors.Wrap(err, "failed to save stargz index")
 	}
+	if verifier != nil && !verifier.Verified() {
+		return fmt.Errorf("toc of ref %s, digest %s doesn't match digest %s", ref, layerDigest, labels[label.StargzTocDigest])
+	}
 	options := []string{
 		"create",
 		"--source-type", "stargz_index",
@@ -107,7 +124,7 @@ func (f *filesystem) PrepareLayer(ctx context.Context, s storage.Snapshot, label
 			"--parent-bootstrap", parentBootstrap)
 	}
 	options = append(options, filepath.Join(f.UpperPath(s.ID), stargzToc))
-	log.G(ctx).Infof("nydus image command %v", options)
+	logging.FS.G(ctx).Infof("nydus image command %v", options)
 	cmd := exec.Command(f.nydusdImageBinaryPath, options...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
@@ -126,7 +143,7 @@ func (f *filesystem) Support(ctx context.Context, labels map[string]string) bool
 	if ref == "" || layerDigest == "" {
 		return false
 	}
-	log.G(ctx).Infof("image ref %s digest %s", ref, layerDigest)
+	logging.FS.G(ctx).Infof("image ref %s digest %s", ref, layerDigest)
 	keychain := auth.FromLabels(labels)
 	blob, err := f.resolver.GetBlob(ref, layerDigest, keychain)
 	if err != nil {
@@ -198,7 +215,7 @@ func (f *filesystem) mount(d *daemon.Daemon, labels map[string]string) error {
 }
 
 func (f *filesystem) generateDaemonConfig(d *daemon.Daemon, labels map[string]string) error {
-	cfg, err := config.NewDaemonConfig(f.daemonCfg, d.ImageID, f.vpcRegistry, labels)
+	cfg, err := config.NewDaemonConfig(f.daemonCfg, d.ImageID, f.vpcRegistry, labels, f.hostConfigDir)
 	if err != nil {
 		return errors.Wrapf(err, "failed to generate daemon config for daemon %s", d.ID)
 	}
@@ -217,7 +234,7 @@ func (f *filesystem) WaitUntilReady(ctx context.Context, snapshotID string) erro
 		if err != nil {
 			return err
 		}
-		log.G(ctx).Infof("daemon %s snapshotID %s info %v", s.ID, snapshotID, info)
+		logging.FS.G(ctx).Infof("daemon %s snapshotID %s info %v", s.ID, snapshotID, info)
 		if info.State != "Running" {
 			return errors.Wrap(err, fmt.Sprintf("daemon %s snapshotID %s is not ready", s.ID, snapshotID))
 		}
@@ -231,7 +248,7 @@ func (f *filesystem) WaitUntilReady(ctx context.Context, snapshotID string) erro
 
 func (f *filesystem) Umount(ctx context.Context, mountPoint string) error {
 	id := filepath.Base(mountPoint)
-	log.G(ctx).Infof("umount nydus daemon of id %s, mountpoint %s", id, mountPoint)
+	logging.FS.G(ctx).Infof("umount nydus daemon of id %s, mountpoint %s", id, mountPoint)
 	return f.manager.DestroyBySnapshotID(id)
 }
 
@@ -239,7 +256,7 @@ func (f *filesystem) Cleanup(ctx context.Context) error {
 	for _, d := range f.manager.ListDaemons() {
 		err := f.Umount(ctx, filepath.Dir(d.MountPoint()))
 		if err != nil {
-			log.G(ctx).Infof("failed to umount %s err %+v", d.MountPoint(), err)
+			logging.FS.G(ctx).Infof("failed to umount %s err %+v", d.MountPoint(), err)
 		}
 	}
 	return nil
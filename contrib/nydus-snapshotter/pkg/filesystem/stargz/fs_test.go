@@ -17,10 +17,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/meta"
-	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/nydus"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/process"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/store"
 )
 
 func ensureExists(path string) error {
@@ -31,26 +32,31 @@ func ensureExists(path string) error {
 	return nil
 }
 
-func Test_filesystem_createNewDaemon(t *testing.T) {
-	snapshotRoot := "testdata/snapshot"
-	err := os.MkdirAll(snapshotRoot, 0755)
+func newManager(t *testing.T, rootDir string) *process.Manager {
+	db, err := store.NewDatabase(rootDir)
 	require.Nil(t, err)
-	defer func() {
-		_ = os.RemoveAll(snapshotRoot)
-	}()
-
 	mgr, err := process.NewManager(process.Opt{
 		NydusdBinaryPath: "",
-		RootDir:          snapshotRoot,
+		Database:         db,
+		DaemonMode:       config.DaemonModeMultiple,
 	})
 	require.Nil(t, err)
+	return mgr
+}
+
+func Test_filesystem_createNewDaemon(t *testing.T) {
+	snapshotRoot, err := ioutil.TempDir("", "nydus-stargz-")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapshotRoot)
+
+	mgr := newManager(t, snapshotRoot)
 
 	f := filesystem{
 		FileSystemMeta: meta.FileSystemMeta{
 			RootDir: snapshotRoot,
 		},
 		manager:     mgr,
-		daemonCfg:   nydus.DaemonConfig{},
+		daemonCfg:   config.DaemonConfig{},
 		resolver:    nil,
 		vpcRegistry: false,
 	}
@@ -59,24 +65,17 @@ func Test_filesystem_createNewDaemon(t *testing.T) {
 }
 
 func Test_filesystem_generateDaemonConfig(t *testing.T) {
-	snapshotRoot := "testdata/snapshot"
-	err := os.MkdirAll(snapshotRoot, 0755)
+	snapshotRoot, err := ioutil.TempDir("", "nydus-stargz-")
 	require.Nil(t, err)
-	defer func() {
-		_ = os.RemoveAll(snapshotRoot)
-	}()
+	defer os.RemoveAll(snapshotRoot)
 
 	content, err := ioutil.ReadFile("testdata/config/nydus.json")
 	require.Nil(t, err)
-	var cfg nydus.DaemonConfig
+	var cfg config.DaemonConfig
 	err = json.Unmarshal(content, &cfg)
 	require.Nil(t, err)
 
-	mgr, err := process.NewManager(process.Opt{
-		NydusdBinaryPath: "",
-		RootDir:          snapshotRoot,
-	})
-	require.Nil(t, err)
+	mgr := newManager(t, snapshotRoot)
 
 	f := filesystem{
 		FileSystemMeta: meta.FileSystemMeta{
@@ -88,6 +87,7 @@ func Test_filesystem_generateDaemonConfig(t *testing.T) {
 		vpcRegistry: false,
 	}
 	d, err := f.createNewDaemon("1", "example.com/test/testimage:0.1")
+	require.Nil(t, err)
 	err = f.generateDaemonConfig(d, map[string]string{
 		label.ImagePullUsername: "mock",
 		label.ImagePullSecret:   "mock",
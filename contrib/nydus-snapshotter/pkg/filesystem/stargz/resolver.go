@@ -11,6 +11,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,18 +21,28 @@ import (
 	"sync"
 	"time"
 
-	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference/docker"
 	"github.com/golang/groupcache/lru"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
 )
 
 const (
+	// The footer of legacy stargz is an empty gzip stream of 47 bytes,
+	// whose extra field is the TOC offset in hex followed by "STARGZ"
 	stargzFooterSize = 47
-	stargzToc        = "stargz.index.json"
+	// The footer of eStargz is 51 bytes, the extra field is wrapped in
+	// a subfield with id "SG"
+	estargzFooterSize = 51
+	// tailFetchSize is the size of trailing bytes fetched by one Range
+	// request to locate TOC, the TOC of small layers is included in it
+	// so that it's read without another request
+	tailFetchSize = 64 << 10
+	stargzToc     = "stargz.index.json"
 )
 
 type Resolver struct {
@@ -54,17 +65,45 @@ type Blob struct {
 	sr     *io.SectionReader
 }
 
+// readTail reads at most n trailing bytes of blob, returns them and the
+// offset of them in blob
+func (bb *Blob) readTail(n int64) ([]byte, int64, error) {
+	size := bb.sr.Size()
+	if n > size {
+		n = size
+	}
+	b := make([]byte, n)
+	_, err := bb.sr.ReadAt(b, size-n)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	return b, size - n, nil
+}
+
+// parseTail extracts toc offset and footer size from the trailing bytes of
+// eStargz or legacy stargz blob
+func (bb *Blob) parseTail(tail []byte) (tocOffset int64, footerSize int64, err error) {
+	if len(tail) >= estargzFooterSize {
+		if tocOffset, ok := parseEstargzFooter(tail[len(tail)-estargzFooterSize:]); ok {
+			return tocOffset, estargzFooterSize, nil
+		}
+	}
+	if len(tail) >= stargzFooterSize {
+		if tocOffset, ok := parseFooter(tail[len(tail)-stargzFooterSize:]); ok {
+			return tocOffset, stargzFooterSize, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("failed to parse stargz footer of ref %s digest %s", bb.ref, bb.digest)
+}
+
 // getTocOffset get toc offset from stargz footer
 func (bb *Blob) getTocOffset() (int64, error) {
-	b := make([]byte, stargzFooterSize)
-	_, err := bb.sr.ReadAt(b[:], bb.sr.Size()-stargzFooterSize)
-	if err != nil && err != io.EOF {
+	tail, _, err := bb.readTail(estargzFooterSize)
+	if err != nil {
 		return 0, err
 	}
-	if tocOffset, ok := parseFooter(b); ok {
-		return tocOffset, nil
-	}
-	return 0, fmt.Errorf("failed to parse stargz footer of ref %s digest %s", bb.ref, bb.digest)
+	tocOffset, _, err := bb.parseTail(tail)
+	return tocOffset, err
 }
 
 // ReadToc read stargz toc content from blob
@@ -72,18 +111,35 @@ func (bb *Blob) ReadToc() (io.Reader, error) {
 	start := time.Now()
 	defer func() {
 		duration := time.Since(start)
-		log.L.Infof("read toc duration %d", duration.Milliseconds())
+		logging.FS.L().Infof("read toc duration %d", duration.Milliseconds())
 	}()
 
-	tocOffset, err := bb.getTocOffset()
+	// Locate toc by the trailing bytes of blob, so that it doesn't depend
+	// on the toc digest annotation of eStargz layer
+	tail, tailOffset, err := bb.readTail(tailFetchSize)
 	if err != nil {
 		return nil, err
 	}
-	tocBuf := make([]byte, bb.sr.Size()-tocOffset-stargzFooterSize)
-	_, err = bb.sr.ReadAt(tocBuf, tocOffset)
+	tocOffset, footerSize, err := bb.parseTail(tail)
 	if err != nil {
 		return nil, err
 	}
+	tocEnd := bb.sr.Size() - footerSize
+	if tocOffset < 0 || tocOffset >= tocEnd {
+		return nil, fmt.Errorf("invalid toc offset %d of ref %s digest %s", tocOffset, bb.ref, bb.digest)
+	}
+	var tocBuf []byte
+	if tocOffset >= tailOffset {
+		tocBuf = tail[tocOffset-tailOffset : tocEnd-tailOffset]
+	} else {
+		// Only read the part of toc not in trailing bytes
+		tocBuf = make([]byte, tocEnd-tocOffset)
+		copy(tocBuf[tailOffset-tocOffset:], tail[:tocEnd-tailOffset])
+		_, err = bb.sr.ReadAt(tocBuf[:tailOffset-tocOffset], tocOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
 	zr, err := gzip.NewReader(bytes.NewReader(tocBuf))
 	if err != nil {
 		return nil, err
@@ -109,7 +165,7 @@ func (r *Resolver) GetBlob(ref, digest string, keychain authn.Keychain) (*Blob,
 	start := time.Now()
 	defer func() {
 		duration := time.Since(start)
-		log.L.Infof("get blob duration %d", duration.Milliseconds())
+		logging.FS.L().Infof("get blob duration %d", duration.Milliseconds())
 	}()
 
 	sr, err := r.resolve(ref, digest, keychain)
@@ -147,6 +203,30 @@ func parseFooter(p []byte) (tocOffset int64, ok bool) {
 	return tocOffset, err == nil
 }
 
+// parseEstargzFooter extract toc offset from eStargz footer, whose extra
+// field is a subfield of "SG" id and the payload of legacy stargz footer
+func parseEstargzFooter(p []byte) (tocOffset int64, ok bool) {
+	if len(p) != estargzFooterSize {
+		return 0, false
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return 0, false
+	}
+	extra := zr.Header.Extra
+	if len(extra) != 4+16+len("STARGZ") {
+		return 0, false
+	}
+	if extra[0] != 'S' || extra[1] != 'G' || binary.LittleEndian.Uint16(extra[2:4]) != 16+uint16(len("STARGZ")) {
+		return 0, false
+	}
+	if string(extra[20:]) != "STARGZ" {
+		return 0, false
+	}
+	tocOffset, err = strconv.ParseInt(string(extra[4:20]), 16, 64)
+	return tocOffset, err == nil
+}
+
 func (r *Resolver) resolve(ref, digest string, keychain authn.Keychain) (*io.SectionReader, error) {
 	named, err := docker.ParseDockerRef(ref)
 	if err != nil {
@@ -168,7 +248,7 @@ func (r *Resolver) resolve(ref, digest string, keychain authn.Keychain) (*io.Sec
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get size from url %s", url)
 	}
-	log.L.Infof("get size %d", size)
+	logging.FS.L().Infof("get size %d", size)
 
 	sr := io.NewSectionReader(readerAtFunc(func(b []byte, offset int64) (int, error) {
 		length := len(b)
@@ -85,6 +85,53 @@ func TestResolver_getToc(t *testing.T) {
 	assert.Equal(t, expect, actual)
 }
 
+// mockBlobRange returns the range of blob, which consists of zeros, the toc
+// at tocOffset and the footer.
+func mockBlobRange(tocOffset int64, toc, footer []byte, start, end int64) []byte {
+	tocEnd := tocOffset + int64(len(toc))
+	b := make([]byte, end-start+1)
+	for idx := range b {
+		off := start + int64(idx)
+		if off >= tocOffset && off < tocEnd {
+			b[idx] = toc[off-tocOffset]
+		} else if off >= tocEnd && off-tocEnd < int64(len(footer)) {
+			b[idx] = footer[off-tocEnd]
+		}
+	}
+	return b
+}
+
+func TestParseEstargzFooter(t *testing.T) {
+	// The eStargz footer of toc offset 0x1234: gzip header with extra
+	// field, an empty stored block and the trailer
+	var buf bytes.Buffer
+	buf.Write([]byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0})
+	buf.WriteString(fmt.Sprintf("%016xSTARGZ", 0x1234))
+	buf.Write([]byte{1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0})
+	require.Equal(t, estargzFooterSize, buf.Len())
+
+	tocOffset, ok := parseEstargzFooter(buf.Bytes())
+	assert.True(t, ok)
+	assert.Equal(t, int64(0x1234), tocOffset)
+	_, ok = parseFooter(buf.Bytes()[estargzFooterSize-stargzFooterSize:])
+	assert.False(t, ok)
+
+	blob := &Blob{}
+	tocOffset, footerSize, err := blob.parseTail(append([]byte("data"), buf.Bytes()...))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0x1234), tocOffset)
+	assert.Equal(t, int64(estargzFooterSize), footerSize)
+
+	footer, err := ioutil.ReadFile(filepath.Join("testdata", "stargzfooter.bin"))
+	require.Nil(t, err)
+	_, ok = parseEstargzFooter(append([]byte("data"), footer...))
+	assert.False(t, ok)
+	tocOffset, footerSize, err = blob.parseTail(append([]byte("data"), footer...))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(24442675), tocOffset)
+	assert.Equal(t, int64(stargzFooterSize), footerSize)
+}
+
 type mockRoundTripper struct{}
 
 func (tr *mockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -116,19 +163,14 @@ func (tr *mockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 				Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
 			}, nil
 		}
-		// get footer
-		if rangeHeader == "bytes=24613139-24613185" {
+		// get the ranges of footer and toc
+		var start, end int64
+		if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end); err == nil {
 			footer, _ := ioutil.ReadFile("testdata/stargzfooter.bin")
-			return &http.Response{
-				StatusCode: http.StatusPartialContent,
-				Body:       ioutil.NopCloser(bytes.NewReader(footer[:])),
-			}, nil
-		}
-		if rangeHeader == "bytes=24442675-24613138" {
 			toc, _ := ioutil.ReadFile("testdata/stargztoc.bin")
 			return &http.Response{
 				StatusCode: http.StatusPartialContent,
-				Body:       ioutil.NopCloser(bytes.NewReader(toc[:])),
+				Body:       ioutil.NopCloser(bytes.NewReader(mockBlobRange(24442675, toc, footer, start, end))),
 			}, nil
 		}
 	}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package kubeclient is a minimal Kubernetes API client shared by the
+// components running in cluster, it authenticates with the service account
+// mounted in pod, and reads and patches the objects as JSON.
+package kubeclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MergePatchType          = "application/merge-patch+json"
+	StrategicMergePatchType = "application/strategic-merge-patch+json"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	requestTimeout    = 10 * time.Second
+)
+
+// ErrConflict is returned when the object is modified by others between
+// getting and patching it.
+var ErrConflict = errors.New("object is modified concurrently")
+
+// Client sends the requests to api server.
+type Client struct {
+	server     string
+	tokenFile  string
+	httpClient *http.Client
+}
+
+// New creates the client of api server at server without authentication.
+func New(server string, httpClient *http.Client) *Client {
+	return &Client{server: server, httpClient: httpClient}
+}
+
+// NewInCluster creates the client from the service account mounted in pod,
+// the api server is read from the environment of pod.
+func NewInCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read service account ca")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account ca")
+	}
+	return &Client{
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+		httpClient: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// Do sends the request of body in JSON with contentType to path, and
+// decodes the response to out if it's not nil. ErrConflict is returned
+// if api server responds 409 Conflict.
+func (c *Client) Do(ctx context.Context, method, path, contentType string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = b
+	}
+	req, err := http.NewRequest(method, c.server+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	// The token is rotated by kubelet, so it's read for each request
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read service account token")
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return ErrConflict
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: unexpected status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package kubeclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/conflict":
+			w.WriteHeader(http.StatusConflict)
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("forbidden\n"))
+		default:
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(`{"authorization":"` + r.Header.Get("Authorization") + `","contentType":"` + r.Header.Get("Content-Type") + `","body":` + string(body) + `}`))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kubeclient-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := New(server.URL, server.Client())
+	c.tokenFile = filepath.Join(dir, "token")
+	ctx := context.Background()
+
+	// The token is read for each request
+	var out struct {
+		Authorization string            `json:"authorization"`
+		ContentType   string            `json:"contentType"`
+		Body          map[string]string `json:"body"`
+	}
+	assert.Error(t, c.Do(ctx, http.MethodGet, "/", "", nil, &out))
+	require.NoError(t, ioutil.WriteFile(c.tokenFile, []byte("token\n"), 0600))
+	require.NoError(t, c.Do(ctx, http.MethodPatch, "/", MergePatchType, map[string]string{"key": "value"}, &out))
+	assert.Equal(t, "Bearer token", out.Authorization)
+	assert.Equal(t, MergePatchType, out.ContentType)
+	assert.Equal(t, map[string]string{"key": "value"}, out.Body)
+
+	assert.Equal(t, ErrConflict, c.Do(ctx, http.MethodPatch, "/conflict", MergePatchType, nil, nil))
+	err = c.Do(ctx, http.MethodGet, "/forbidden", "", nil, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected status 403: forbidden")
+}
@@ -19,4 +19,31 @@ const (
 	RemoteLabel         = "containerd.io/snapshot/remote"
 	NydusMetaLayer      = "containerd.io/snapshot/nydus-bootstrap"
 	NydusDataLayer      = "containerd.io/snapshot/nydus-blob"
+	// The key of layer chain converted on node, it's set on the container
+	// snapshot mounted from converted image
+	NydusConvertedLayer = "containerd.io/snapshot/nydus-converted"
+	// Set to "true" to force the OCI path rather than lazy pulling, on the
+	// container snapshot (inherited from the annotation of container by
+	// CRI) or on the image layers
+	ForceOCI = "containerd.io/snapshot/nydus-force-oci"
+	// The total size of blobs in nydus image, set on the meta layer
+	NydusImageSize = "containerd.io/snapshot/nydus-image-size"
+	// The readahead policy (`sequential` or `random`) presetting merging
+	// size and merging size in bytes of nydusd for the image, set on the
+	// meta layer
+	NydusReadahead   = "containerd.io/snapshot/nydus-readahead"
+	NydusMergingSize = "containerd.io/snapshot/nydus-merging-size"
+	// Set to "true" or "false" on the meta layer to override whether the
+	// views of image are bind mounts of the RAFS mount merged by nydusd
+	// rather than overlayfs, i.e. --merged-view
+	NydusMergedView = "containerd.io/snapshot/nydus-merged-view"
+	// Written back on the committed snapshots of lazily loaded layers,
+	// they are merged into the snapshot info of containerd metadata for
+	// reporting
+	NydusLazy                = "containerd.io/snapshot/nydus-lazy"
+	NydusBackend             = "containerd.io/snapshot/nydus-backend"
+	NydusEstimatedSavedBytes = "containerd.io/snapshot/nydus-estimated-saved-bytes"
+	// The digest of uncompressed TOC JSON of eStargz layer, it's optional,
+	// the TOC is located by the footer of layer and verified if it's set
+	StargzTocDigest = "containerd.io/snapshot/stargz/toc.digest"
 )
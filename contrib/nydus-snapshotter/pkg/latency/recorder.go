@@ -0,0 +1,347 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package latency records the timing segments of container start on the
+// node for both nydus and non-nydus images, so that operators can compare
+// the pod start latencies with hard data during gradual rollouts.
+package latency
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	apievents "github.com/containerd/containerd/api/events"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	"github.com/containerd/containerd/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/compat"
+)
+
+// Segment is a timing segment of container start.
+type Segment string
+
+const (
+	// SegmentPull is from preparing the first layer to committing the
+	// last layer of image, includes downloading and unpacking layers.
+	SegmentPull Segment = "pull"
+	// SegmentPrepare is the time to prepare container rootfs snapshot,
+	// includes starting nydusd for nydus image.
+	SegmentPrepare Segment = "prepare"
+	// SegmentMount is the time to get the mounts of container rootfs,
+	// includes waiting for nydusd to be ready for nydus image.
+	SegmentMount Segment = "mount"
+	// SegmentStart is from mounting rootfs to the task start event.
+	SegmentStart Segment = "start"
+	// SegmentTotal is the sum of segments.
+	SegmentTotal Segment = "total"
+
+	defaultMaxRecords = 1000
+	retryInterval     = 5 * time.Second
+	taskStartTopic    = "/tasks/start"
+)
+
+var segments = []Segment{SegmentPull, SegmentPrepare, SegmentMount, SegmentStart, SegmentTotal}
+
+// Record is the timing segments of a container, in milliseconds.
+type Record struct {
+	ContainerID string            `json:"container_id"`
+	Image       string            `json:"image"`
+	Nydus       bool              `json:"nydus"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Segments    map[Segment]int64 `json:"segments"`
+
+	preparedAt time.Time
+	mountedAt  time.Time
+}
+
+// Stats is the statistics of a segment, in milliseconds.
+type Stats struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   int64   `json:"p50"`
+	P90   int64   `json:"p90"`
+	P99   int64   `json:"p99"`
+}
+
+// Report compares the timing segments of nydus and non-nydus images.
+type Report struct {
+	Nydus map[Segment]Stats `json:"nydus"`
+	OCI   map[Segment]Stats `json:"oci"`
+	// Speedup is the ratio of OCI P50 to nydus P50 of each segment.
+	Speedup map[Segment]float64 `json:"speedup"`
+	Records []Record            `json:"records,omitempty"`
+}
+
+type pull struct {
+	nydus    bool
+	start    time.Time
+	end      time.Time
+	consumed bool
+}
+
+// Recorder records the timing segments, all methods are no-op on
+// nil recorder, so that the callers don't need to check if it's enabled.
+type Recorder struct {
+	mu         sync.Mutex
+	maxRecords int
+	now        func() time.Time
+	pulls      map[string]*pull
+	records    map[string]*Record
+	// Container IDs in creation order, used to evict the oldest records.
+	order []string
+}
+
+// NewRecorder creates a recorder keeps at most maxRecords records.
+func NewRecorder(maxRecords int) *Recorder {
+	if maxRecords <= 0 {
+		maxRecords = defaultMaxRecords
+	}
+	return &Recorder{
+		maxRecords: maxRecords,
+		now:        time.Now,
+		pulls:      map[string]*pull{},
+		records:    map[string]*Record{},
+	}
+}
+
+func ms(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// StartPull is called when a layer of image is being prepared.
+func (r *Recorder) StartPull(image string, nydus bool) {
+	if r == nil || image == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.pulls[image]
+	if !ok || p.consumed {
+		p = &pull{start: r.now()}
+		r.pulls[image] = p
+	}
+	p.nydus = p.nydus || nydus
+}
+
+// EndPull is called when a layer of image is committed.
+func (r *Recorder) EndPull(image string) {
+	if r == nil || image == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p, ok := r.pulls[image]; ok && !p.consumed {
+		p.end = r.now()
+	}
+}
+
+// Prepared is called when the rootfs snapshot of container is prepared,
+// the pull segment is only attributed to the first container of image.
+func (r *Recorder) Prepared(containerID, image string, nydus bool, start time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	record := &Record{
+		ContainerID: containerID,
+		Image:       image,
+		Nydus:       nydus,
+		CreatedAt:   start,
+		Segments:    map[Segment]int64{SegmentPrepare: ms(now.Sub(start))},
+		preparedAt:  now,
+	}
+	if p, ok := r.pulls[image]; ok && !p.consumed && !p.end.IsZero() {
+		record.Segments[SegmentPull] = ms(p.end.Sub(p.start))
+		p.consumed = true
+	}
+
+	if _, ok := r.records[containerID]; !ok {
+		r.order = append(r.order, containerID)
+	}
+	r.records[containerID] = record
+	for len(r.order) > r.maxRecords {
+		delete(r.records, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// Mounted is called when the mounts of container rootfs is returned.
+func (r *Recorder) Mounted(containerID string, start time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[containerID]
+	if !ok || !record.mountedAt.IsZero() {
+		return
+	}
+	record.mountedAt = r.now()
+	record.Segments[SegmentMount] = ms(record.mountedAt.Sub(start))
+}
+
+// Started is called when the task of container is started.
+func (r *Recorder) Started(containerID string, at time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[containerID]
+	if !ok {
+		return
+	}
+	if _, ok := record.Segments[SegmentStart]; ok {
+		return
+	}
+	from := record.mountedAt
+	if from.IsZero() {
+		from = record.preparedAt
+	}
+	record.Segments[SegmentStart] = ms(at.Sub(from))
+
+	var total int64
+	for _, segment := range []Segment{SegmentPull, SegmentPrepare, SegmentMount, SegmentStart} {
+		total += record.Segments[segment]
+	}
+	record.Segments[SegmentTotal] = total
+}
+
+func percentile(sorted []int64, p int) int64 {
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+func statistics(values map[Segment][]int64) map[Segment]Stats {
+	stats := map[Segment]Stats{}
+	for segment, durations := range values {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		var sum int64
+		for _, d := range durations {
+			sum += d
+		}
+		stats[segment] = Stats{
+			Count: len(durations),
+			Mean:  float64(sum) / float64(len(durations)),
+			P50:   percentile(durations, 50),
+			P90:   percentile(durations, 90),
+			P99:   percentile(durations, 99),
+		}
+	}
+	return stats
+}
+
+// Report generates the comparative report, only the started containers
+// are counted, the records are included if withRecords is true.
+func (r *Recorder) Report(withRecords bool) Report {
+	report := Report{
+		Nydus:   map[Segment]Stats{},
+		OCI:     map[Segment]Stats{},
+		Speedup: map[Segment]float64{},
+	}
+	if r == nil {
+		return report
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nydus := map[Segment][]int64{}
+	oci := map[Segment][]int64{}
+	for _, id := range r.order {
+		record := r.records[id]
+		if withRecords {
+			report.Records = append(report.Records, *record)
+		}
+		if _, ok := record.Segments[SegmentTotal]; !ok {
+			continue
+		}
+		values := oci
+		if record.Nydus {
+			values = nydus
+		}
+		for segment, d := range record.Segments {
+			values[segment] = append(values[segment], d)
+		}
+	}
+	report.Nydus = statistics(nydus)
+	report.OCI = statistics(oci)
+
+	for _, segment := range segments {
+		n, nok := report.Nydus[segment]
+		o, ook := report.OCI[segment]
+		if nok && ook && n.P50 > 0 {
+			report.Speedup[segment] = float64(o.P50) / float64(n.P50)
+		}
+	}
+
+	return report
+}
+
+func (r *Recorder) watch(ctx context.Context, address string) error {
+	conn, err := compat.Dial(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream, err := eventsapi.NewEventsClient(conn).Subscribe(ctx, &eventsapi.SubscribeRequest{
+		Filters: []string{`topic=="` + taskStartTopic + `"`},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to subscribe containerd events")
+	}
+
+	for {
+		envelope, err := stream.Recv()
+		if err != nil {
+			return errors.Wrap(err, "failed to receive containerd event")
+		}
+		if envelope.Event == nil {
+			continue
+		}
+		var event apievents.TaskStart
+		if err := proto.Unmarshal(envelope.Event.Value, &event); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to unmarshal task start event")
+			continue
+		}
+		r.Started(event.ContainerID, envelope.Timestamp)
+	}
+}
+
+// Watch subscribes the task start events of containerd listening on address
+// until context is done, the CRI uses container ID as the key of rootfs
+// snapshot, so that the event can be matched with the snapshot.
+func (r *Recorder) Watch(ctx context.Context, address string) {
+	if r == nil {
+		return
+	}
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.watch(ctx, address); err != nil {
+			log.G(ctx).WithError(err).Debug("failed to watch containerd task events")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package latency
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(0)
+	now := time.Unix(0, 0)
+	r.now = func() time.Time { return now }
+	tick := func(ms int) {
+		now = now.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	start := func(id, image string, nydus bool, pull, prepare, mount, run int) {
+		if pull > 0 {
+			r.StartPull(image, nydus)
+			tick(pull)
+			r.EndPull(image)
+		}
+		begin := now
+		tick(prepare)
+		r.Prepared(id, image, nydus, begin)
+		begin = now
+		tick(mount)
+		r.Mounted(id, begin)
+		tick(run)
+		r.Started(id, now)
+	}
+
+	start("c1", "oci:v1", false, 10000, 100, 10, 500)
+	start("c2", "oci:v1", false, 0, 100, 10, 500)
+	start("c3", "nydus:v1", true, 500, 1000, 100, 500)
+	start("c4", "nydus:v1", true, 0, 1000, 100, 500)
+
+	// Created but not started container isn't counted
+	r.Prepared("c5", "oci:v1", false, now)
+
+	report := r.Report(true)
+	require.Equal(t, 5, len(report.Records))
+	assert.Equal(t, map[Segment]int64{
+		SegmentPull: 10000, SegmentPrepare: 100, SegmentMount: 10, SegmentStart: 500, SegmentTotal: 10610,
+	}, report.Records[0].Segments)
+	_, ok := report.Records[1].Segments[SegmentPull]
+	assert.False(t, ok)
+
+	assert.Equal(t, 2, report.OCI[SegmentTotal].Count)
+	assert.Equal(t, 1, report.OCI[SegmentPull].Count)
+	assert.Equal(t, float64(5610), report.OCI[SegmentTotal].Mean)
+	assert.Equal(t, int64(610), report.OCI[SegmentTotal].P50)
+	assert.Equal(t, int64(10610), report.OCI[SegmentTotal].P90)
+	assert.Equal(t, int64(500), report.Nydus[SegmentPull].P50)
+	assert.Equal(t, float64(20), report.Speedup[SegmentPull])
+	assert.Equal(t, 0.1, report.Speedup[SegmentPrepare])
+
+	assert.Nil(t, r.Report(false).Records)
+}
+
+func TestRecorderEviction(t *testing.T) {
+	r := NewRecorder(2)
+	for _, id := range []string{"c1", "c2", "c3"} {
+		r.Prepared(id, "image", false, time.Now())
+	}
+	report := r.Report(true)
+	require.Equal(t, 2, len(report.Records))
+	assert.Equal(t, "c2", report.Records[0].ContainerID)
+
+	// All methods are no-op on nil recorder
+	var nilRecorder *Recorder
+	nilRecorder.StartPull("image", true)
+	nilRecorder.Prepared("c1", "image", true, time.Now())
+	assert.Equal(t, 0, len(nilRecorder.Report(true).Records))
+}
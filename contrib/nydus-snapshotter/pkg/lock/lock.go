@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package lock coordinates the snapshotter instances running concurrently
+// on a node, e.g. in blue/green deployment, by advisory file locks. The
+// locks are released by kernel once the holder exits, so a crashed instance
+// never leaves a stale lock behind.
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+)
+
+// ErrLocked is returned if the lock is held by another instance.
+var ErrLocked = errors.New("locked by another instance")
+
+// Holder is the instance holding the lock, recorded in the lock file.
+type Holder struct {
+	Pid   int       `json:"pid"`
+	Since time.Time `json:"since"`
+}
+
+// Lock is an exclusive lock on file.
+type Lock struct {
+	path string
+	file *os.File
+}
+
+// TryLock takes the exclusive lock on path without blocking, the file is
+// created if it doesn't exist, ErrLocked is returned if the lock is held.
+func TryLock(path string) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create directory of lock %s", path)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open lock %s", path)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, errors.Wrapf(err, "failed to lock %s", path)
+	}
+
+	data, err := json.Marshal(Holder{Pid: os.Getpid(), Since: time.Now().UTC()})
+	if err == nil {
+		if err = file.Truncate(0); err == nil {
+			_, err = file.WriteAt(data, 0)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to record holder of lock %s", path)
+	}
+
+	return &Lock{path: path, file: file}, nil
+}
+
+// Wait waits until the exclusive lock on path is taken or ctx is done, the
+// lock is retried every interval.
+func Wait(ctx context.Context, path string, interval time.Duration) (*Lock, error) {
+	logged := false
+	for {
+		l, err := TryLock(path)
+		if err != ErrLocked {
+			return l, err
+		}
+		if !logged {
+			if holder, err := ReadHolder(path); err == nil {
+				logging.Snapshots.L().Infof("waiting for lock %s held by pid %d since %s", path, holder.Pid, holder.Since)
+			}
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "failed to wait for lock %s", path)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ReadHolder returns the instance holding or last held the lock on path.
+func ReadHolder(path string) (*Holder, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var holder Holder
+	if err := json.Unmarshal(data, &holder); err != nil {
+		return nil, errors.Wrapf(err, "invalid holder of lock %s", path)
+	}
+	return &holder, nil
+}
+
+// Path returns the path of locked file.
+func (l *Lock) Path() string {
+	return l.path
+}
+
+// Unlock releases the lock, the lock file is kept.
+func (l *Lock) Unlock() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return errors.Wrapf(err, "failed to unlock %s", l.path)
+	}
+	return l.file.Close()
+}
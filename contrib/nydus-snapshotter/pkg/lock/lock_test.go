@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package lock
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-lock-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "root", "snapshotter.lock")
+	l, err := TryLock(path)
+	require.Nil(t, err)
+	assert.Equal(t, path, l.Path())
+	holder, err := ReadHolder(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.Getpid(), holder.Pid)
+
+	_, err = TryLock(path)
+	assert.Equal(t, ErrLocked, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = Wait(ctx, path, 10*time.Millisecond)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// The waiting instance takes over once the lock is released
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.Unlock()
+	}()
+	l, err = Wait(context.Background(), path, 10*time.Millisecond)
+	require.Nil(t, err)
+	require.Nil(t, l.Unlock())
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package logging controls the log levels of snapshotter at runtime, the
+// modules log through their own loggers, which follow the global level
+// unless the module level is overridden, so that a module can be debugged
+// without restarting snapshotter or flooding the log with other modules.
+package logging
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ModuleField is the log field of module name.
+const ModuleField = "module"
+
+var (
+	// Snapshots logs the snapshot operations.
+	Snapshots = newModule("snapshots")
+	// Manager logs the lifecycle of nydusd daemons.
+	Manager = newModule("manager")
+	// FS logs the filesystem drivers mounting images.
+	FS = newModule("fs")
+	// Config logs the generation of nydusd configs.
+	Config = newModule("config")
+	// Preheat logs the preheating of blob caches.
+	Preheat = newModule("preheat")
+	// Artifact logs the mounts of RAFS data artifacts.
+	Artifact = newModule("artifact")
+)
+
+var (
+	mu      sync.Mutex
+	modules = map[string]*Module{}
+	// baseLevel is the level set on startup, SIGUSR1 cycles the global
+	// level from it to trace.
+	baseLevel = logrus.InfoLevel
+)
+
+// Module is a logger of snapshotter module.
+type Module struct {
+	name     string
+	logger   *logrus.Logger
+	override bool
+}
+
+// stdFormatter formats the entries of module loggers with the formatter
+// of standard logger, which is set on startup.
+type stdFormatter struct{}
+
+func (stdFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return logrus.StandardLogger().Formatter.Format(entry)
+}
+
+// stdWriter writes the entries of module loggers to the output of
+// standard logger.
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	return logrus.StandardLogger().Out.Write(p)
+}
+
+func newModule(name string) *Module {
+	logger := logrus.New()
+	logger.Out = stdWriter{}
+	logger.Formatter = stdFormatter{}
+	logger.Hooks = logrus.StandardLogger().Hooks
+	logger.SetLevel(logrus.GetLevel())
+
+	m := &Module{name: name, logger: logger}
+	modules[name] = m
+
+	return m
+}
+
+// G returns the logger entry of module carrying the fields of logger in
+// context.
+func (m *Module) G(ctx context.Context) *logrus.Entry {
+	return m.logger.WithFields(log.G(ctx).Data).WithField(ModuleField, m.name)
+}
+
+// L returns the logger entry of module without context.
+func (m *Module) L() *logrus.Entry {
+	return m.logger.WithField(ModuleField, m.name)
+}
+
+// Levels is the global log level and the effective log levels of modules.
+type Levels struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+// SetUp sets the global level on startup, it's also the base level of
+// SIGUSR1 cycling.
+func SetUp(level logrus.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	baseLevel = level
+	setLevel(level)
+}
+
+func setLevel(level logrus.Level) {
+	logrus.SetLevel(level)
+	for _, m := range modules {
+		if !m.override {
+			m.logger.SetLevel(level)
+		}
+	}
+}
+
+// SetLevel sets the global level, or the level of module if module isn't
+// empty.
+func SetLevel(module string, level logrus.Level) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if module == "" {
+		setLevel(level)
+		return nil
+	}
+	m, ok := modules[module]
+	if !ok {
+		return errors.Errorf("unknown log module %q, should be one of %v", module, moduleNames())
+	}
+	m.override = true
+	m.logger.SetLevel(level)
+
+	return nil
+}
+
+// ResetLevel makes the module follow the global level again.
+func ResetLevel(module string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	m, ok := modules[module]
+	if !ok {
+		return errors.Errorf("unknown log module %q, should be one of %v", module, moduleNames())
+	}
+	m.override = false
+	m.logger.SetLevel(logrus.GetLevel())
+
+	return nil
+}
+
+// CycleLevel switches the global level to the next more verbose one in
+// the order of base level, debug and trace, back to base level after
+// trace, returns the new level.
+func CycleLevel() logrus.Level {
+	mu.Lock()
+	defer mu.Unlock()
+
+	next := baseLevel
+	switch current := logrus.GetLevel(); {
+	case current < baseLevel:
+	case current < logrus.DebugLevel:
+		next = logrus.DebugLevel
+	case current < logrus.TraceLevel:
+		next = logrus.TraceLevel
+	}
+	setLevel(next)
+
+	return next
+}
+
+// GetLevels returns the current log levels.
+func GetLevels() Levels {
+	mu.Lock()
+	defer mu.Unlock()
+
+	levels := Levels{
+		Level:   logrus.GetLevel().String(),
+		Modules: make(map[string]string),
+	}
+	for name, m := range modules {
+		levels.Modules[name] = m.logger.GetLevel().String()
+	}
+
+	return levels
+}
+
+func moduleNames() []string {
+	names := []string{}
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
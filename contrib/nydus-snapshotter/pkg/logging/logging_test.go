@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleLevels(t *testing.T) {
+	out := logrus.StandardLogger().Out
+	defer logrus.SetOutput(out)
+	defer SetUp(logrus.InfoLevel)
+	buf := bytes.NewBuffer(nil)
+	logrus.SetOutput(buf)
+
+	SetUp(logrus.InfoLevel)
+	require.Nil(t, SetLevel("snapshots", logrus.DebugLevel))
+	assert.NotNil(t, SetLevel("unknown", logrus.DebugLevel))
+
+	Snapshots.G(context.Background()).Debug("snapshots debug")
+	FS.L().Debug("fs debug")
+	FS.L().Info("fs info")
+	assert.Contains(t, buf.String(), "snapshots debug")
+	assert.Contains(t, buf.String(), "module=snapshots")
+	assert.NotContains(t, buf.String(), "fs debug")
+	assert.Contains(t, buf.String(), "fs info")
+
+	levels := GetLevels()
+	assert.Equal(t, "info", levels.Level)
+	assert.Equal(t, "debug", levels.Modules["snapshots"])
+	assert.Equal(t, "info", levels.Modules["fs"])
+
+	// The overridden module doesn't follow the global level
+	require.Nil(t, SetLevel("", logrus.WarnLevel))
+	levels = GetLevels()
+	assert.Equal(t, "warning", levels.Modules["fs"])
+	assert.Equal(t, "debug", levels.Modules["snapshots"])
+	require.Nil(t, ResetLevel("snapshots"))
+	assert.Equal(t, "warning", GetLevels().Modules["snapshots"])
+
+	// Cycle from the base level
+	assert.Equal(t, logrus.InfoLevel, CycleLevel())
+	assert.Equal(t, logrus.DebugLevel, CycleLevel())
+	assert.Equal(t, logrus.TraceLevel, CycleLevel())
+	assert.Equal(t, logrus.InfoLevel, CycleLevel())
+	assert.Equal(t, "info", GetLevels().Modules["manager"])
+}
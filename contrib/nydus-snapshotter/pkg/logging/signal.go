@@ -0,0 +1,35 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package logging
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+)
+
+// WatchSignal cycles the global level on SIGUSR1 until the context is
+// done, it's the way to turn on debug log without management API.
+func WatchSignal(ctx context.Context) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-c:
+				level := CycleLevel()
+				log.G(ctx).Warnf("log level is switched to %s by SIGUSR1", level)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,387 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/artifact"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/latency"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/preheat"
+)
+
+const defaultClientTimeout = 30 * time.Second
+
+// Client talks to the metrics and management API server of snapshotter,
+// it's the transport used by the command line tools like nydus-snapshotter-ctl.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	token      string
+}
+
+// NewClient creates a client for the server listening on the address, see
+// ParseAddress for the address format. The token is sent as bearer token
+// if it's not empty.
+func NewClient(address, token string) (*Client, error) {
+	if address == "" {
+		return nil, errors.New("address is required")
+	}
+	network, addr := ParseAddress(address)
+
+	baseURL := fmt.Sprintf("http://%s", addr)
+	transport := &http.Transport{
+		MaxIdleConns:          10,
+		IdleConnTimeout:       10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if network == "unix" {
+		baseURL = "http://unix"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 5 * time.Second,
+			}
+			return dialer.DialContext(ctx, "unix", addr)
+		}
+	}
+
+	return &Client{
+		httpClient: &http.Client{
+			Timeout:   defaultClientTimeout,
+			Transport: transport,
+		},
+		baseURL: baseURL,
+		token:   token,
+	}, nil
+}
+
+func (c *Client) get(endpoint string) ([]byte, error) {
+	return c.do(http.MethodGet, endpoint, http.StatusOK)
+}
+
+func (c *Client) do(method, endpoint string, expectedStatus int) ([]byte, error) {
+	return c.doWithBody(method, endpoint, nil, expectedStatus)
+}
+
+func (c *Client) doWithBody(method, endpoint string, body interface{}, expectedStatus int) ([]byte, error) {
+	var payload []byte
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = b
+	}
+	req, err := http.NewRequest(method, c.baseURL+endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", bearerPrefix+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to request %s", endpoint)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read response of %s", endpoint)
+	}
+	if resp.StatusCode != expectedStatus {
+		return nil, errors.Errorf("unexpected status %d of %s: %s", resp.StatusCode, endpoint, string(respBody))
+	}
+
+	return respBody, nil
+}
+
+// Metrics returns the metrics in prometheus text format.
+func (c *Client) Metrics() (string, error) {
+	body, err := c.get(metricsEndpoint)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// ListDaemons returns the nydusd instances managed by snapshotter.
+func (c *Client) ListDaemons() ([]DaemonInfo, error) {
+	body, err := c.get(daemonsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	var infos []DaemonInfo
+	if err := json.Unmarshal(body, &infos); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal daemon list")
+	}
+	return infos, nil
+}
+
+// Pin protects the blob caches of image from GC, the image could be
+// specified by digest or reference.
+func (c *Client) Pin(image string) error {
+	_, err := c.do(http.MethodPut, pinsEndpoint+"?image="+url.QueryEscape(image), http.StatusNoContent)
+	return err
+}
+
+// Unpin removes the pin of image.
+func (c *Client) Unpin(image string) error {
+	_, err := c.do(http.MethodDelete, pinsEndpoint+"?image="+url.QueryEscape(image), http.StatusNoContent)
+	return err
+}
+
+// ListPins returns the pinned images.
+func (c *Client) ListPins() ([]PinInfo, error) {
+	body, err := c.get(pinsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	var infos []PinInfo
+	if err := json.Unmarshal(body, &infos); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal pin list")
+	}
+	return infos, nil
+}
+
+// LatencyReport returns the comparative report of pod start latencies,
+// the timing records of containers are included if withRecords is true.
+func (c *Client) LatencyReport(withRecords bool) (*latency.Report, error) {
+	body, err := c.get(fmt.Sprintf("%s?records=%t", latencyEndpoint, withRecords))
+	if err != nil {
+		return nil, err
+	}
+	var report latency.Report
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal latency report")
+	}
+	return &report, nil
+}
+
+// LogLevels returns the global log level and the levels of modules.
+func (c *Client) LogLevels() (*logging.Levels, error) {
+	body, err := c.get(logLevelEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	var levels logging.Levels
+	if err := json.Unmarshal(body, &levels); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal log levels")
+	}
+	return &levels, nil
+}
+
+// SetLogLevel sets the log level of module, or the global level if module
+// is empty.
+func (c *Client) SetLogLevel(module, level string) error {
+	query := url.Values{}
+	query.Set("level", level)
+	if module != "" {
+		query.Set("module", module)
+	}
+	_, err := c.do(http.MethodPut, logLevelEndpoint+"?"+query.Encode(), http.StatusNoContent)
+	return err
+}
+
+// ResetLogLevel makes the module follow the global level again.
+func (c *Client) ResetLogLevel(module string) error {
+	_, err := c.do(http.MethodDelete, logLevelEndpoint+"?module="+url.QueryEscape(module), http.StatusNoContent)
+	return err
+}
+
+// Preheat creates a task fetching the blob data of images into blob cache,
+// the task runs in background.
+func (c *Client) Preheat(images []string) (*preheat.Task, error) {
+	body, err := c.doWithBody(http.MethodPost, preheatEndpoint, PreheatRequest{Images: images}, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	var task preheat.Task
+	if err := json.Unmarshal(body, &task); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal preheat task")
+	}
+	return &task, nil
+}
+
+// PreheatTask returns the preheat task of id.
+func (c *Client) PreheatTask(id string) (*preheat.Task, error) {
+	body, err := c.get(preheatEndpoint + "?id=" + url.QueryEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	var task preheat.Task
+	if err := json.Unmarshal(body, &task); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal preheat task")
+	}
+	return &task, nil
+}
+
+// ListPreheatTasks returns the preheat tasks, the oldest finished tasks
+// are dropped.
+func (c *Client) ListPreheatTasks() ([]preheat.Task, error) {
+	body, err := c.get(preheatEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []preheat.Task
+	if err := json.Unmarshal(body, &tasks); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal preheat tasks")
+	}
+	return tasks, nil
+}
+
+// MountArtifact mounts the RAFS data artifact of ref at mountpoint.
+func (c *Client) MountArtifact(ref, mountpoint string) (*artifact.Mount, error) {
+	body, err := c.doWithBody(http.MethodPost, artifactEndpoint, ArtifactRequest{Ref: ref, Mountpoint: mountpoint}, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	var mnt artifact.Mount
+	if err := json.Unmarshal(body, &mnt); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal artifact mount")
+	}
+	return &mnt, nil
+}
+
+// UmountArtifact umounts the artifact mounted at mountpoint.
+func (c *Client) UmountArtifact(mountpoint string) error {
+	_, err := c.do(http.MethodDelete, artifactEndpoint+"?mountpoint="+url.QueryEscape(mountpoint), http.StatusNoContent)
+	return err
+}
+
+// ListArtifacts returns the mounted artifacts.
+func (c *Client) ListArtifacts() ([]artifact.Mount, error) {
+	body, err := c.get(artifactEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	var mounts []artifact.Mount
+	if err := json.Unmarshal(body, &mounts); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal artifact mounts")
+	}
+	return mounts, nil
+}
+
+// CacheUsage returns the blob cache usage of images on node.
+func (c *Client) CacheUsage() (*CacheUsage, error) {
+	body, err := c.get(cacheEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	var usage CacheUsage
+	if err := json.Unmarshal(body, &usage); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal cache usage")
+	}
+	return &usage, nil
+}
+
+// CacheGC removes the blob caches not used by any image right now, and
+// returns the removed blobs.
+func (c *Client) CacheGC() (*GCResult, error) {
+	body, err := c.do(http.MethodPost, cacheGCEndpoint, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var result GCResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal gc result")
+	}
+	return &result, nil
+}
+
+// Drain starts draining if draining is true, no new nydusd is started
+// while draining, or stops draining.
+func (c *Client) Drain(draining bool) (*DrainStatus, error) {
+	method := http.MethodPut
+	if !draining {
+		method = http.MethodDelete
+	}
+	return c.drain(method)
+}
+
+// DrainStatus returns whether snapshotter is draining.
+func (c *Client) DrainStatus() (*DrainStatus, error) {
+	return c.drain(http.MethodGet)
+}
+
+func (c *Client) drain(method string) (*DrainStatus, error) {
+	body, err := c.do(method, drainEndpoint, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var status DrainStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal drain status")
+	}
+	return &status, nil
+}
+
+// FlushMetrics makes snapshotter collect and export the metrics of
+// nydusd instances right now.
+func (c *Client) FlushMetrics() error {
+	_, err := c.do(http.MethodPost, flushEndpoint, http.StatusNoContent)
+	return err
+}
+
+// ImageReads returns the data read of images, served from blob cache or
+// fetched from storage backend.
+func (c *Client) ImageReads() (*ReadSummary, error) {
+	body, err := c.get(readsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	var summary ReadSummary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal image reads")
+	}
+	return &summary, nil
+}
+
+// IntegrityEvents returns the latest integrity events of images with digest
+// validation.
+func (c *Client) IntegrityEvents() ([]IntegrityEvent, error) {
+	body, err := c.get(integrityEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	var events []IntegrityEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal integrity events")
+	}
+	return events, nil
+}
+
+// Config returns the effective config of snapshotter, the credentials in
+// nydusd config are redacted.
+func (c *Client) Config() (*config.Config, error) {
+	body, err := c.get(configEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config.Config
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal config")
+	}
+	return &cfg, nil
+}
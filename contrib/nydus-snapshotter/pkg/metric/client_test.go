@@ -0,0 +1,235 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/artifact"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/cache"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/errdefs"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/process"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/store"
+)
+
+func TestParseAddress(t *testing.T) {
+	network, addr := ParseAddress("unix:///run/nydus/metrics.sock")
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/nydus/metrics.sock", addr)
+
+	network, addr = ParseAddress("/run/nydus/metrics.sock")
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/nydus/metrics.sock", addr)
+
+	network, addr = ParseAddress("tcp://127.0.0.1:8080")
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "127.0.0.1:8080", addr)
+
+	network, addr = ParseAddress(":8080")
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, ":8080", addr)
+}
+
+func TestClientWithAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-metrics-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "metrics.sock")
+	ln, err := NewListener(sock, 0660)
+	require.Nil(t, err)
+
+	info, err := os.Stat(sock)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(daemonsEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]DaemonInfo{{ID: "daemon-1", SnapshotID: "1"}})
+	})
+	server := http.Server{Handler: withAuth("secret", mux)}
+	go server.Serve(ln)
+	defer server.Close()
+
+	client, err := NewClient(sock, "")
+	require.Nil(t, err)
+	_, err = client.ListDaemons()
+	assert.NotNil(t, err)
+
+	client, err = NewClient("unix://"+sock, "invalid")
+	require.Nil(t, err)
+	_, err = client.ListDaemons()
+	assert.NotNil(t, err)
+
+	client, err = NewClient("unix://"+sock, "secret")
+	require.Nil(t, err)
+	daemons, err := client.ListDaemons()
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(daemons))
+	assert.Equal(t, "daemon-1", daemons[0].ID)
+}
+
+func TestClientLogLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-metrics-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "metrics.sock")
+	ln, err := NewListener(sock, 0600)
+	require.Nil(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc(logLevelEndpoint, (&Server{}).logLevel)
+	server := http.Server{Handler: mux}
+	go server.Serve(ln)
+	defer server.Close()
+
+	client, err := NewClient(sock, "")
+	require.Nil(t, err)
+	defer client.SetLogLevel("", "info")
+
+	require.Nil(t, client.SetLogLevel("fs", "debug"))
+	assert.NotNil(t, client.SetLogLevel("fs", "invalid"))
+	assert.NotNil(t, client.SetLogLevel("unknown", "debug"))
+	levels, err := client.LogLevels()
+	require.Nil(t, err)
+	assert.Equal(t, "debug", levels.Modules["fs"])
+
+	require.Nil(t, client.SetLogLevel("", "warn"))
+	require.Nil(t, client.ResetLogLevel("fs"))
+	assert.NotNil(t, client.ResetLogLevel(""))
+	levels, err = client.LogLevels()
+	require.Nil(t, err)
+	assert.Equal(t, "warning", levels.Level)
+	assert.Equal(t, "warning", levels.Modules["fs"])
+}
+
+func TestClientManagement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-metrics-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := store.NewDatabase(dir)
+	require.Nil(t, err)
+	cacheDir := filepath.Join(dir, "cache")
+	require.Nil(t, os.MkdirAll(cacheDir, 0755))
+	cm, err := cache.NewManager(cache.Opt{CacheDir: cacheDir, Period: time.Hour, Database: db})
+	require.Nil(t, err)
+	pm, err := process.NewManager(process.Opt{Database: db, DaemonMode: config.DaemonModeMultiple})
+	require.Nil(t, err)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(cacheDir, "blob1"), make([]byte, 4096), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(cacheDir, "blob2"), make([]byte, 4096), 0644))
+	require.Nil(t, cm.AddSnapshot("docker.io/library/busybox:latest", []string{"blob1"}))
+	require.Nil(t, cm.AddSnapshot("docker.io/library/nginx:latest", []string{"blob2"}))
+	require.Nil(t, cm.DelSnapshot("docker.io/library/nginx:latest"))
+
+	cfg := config.Config{RootDir: dir, DaemonMode: config.DaemonModeMultiple}
+	cfg.DaemonCfg.Device.Backend.Config.Auth = "dXNlcjpwYXNz"
+	cfg.DaemonCfg.Device.Backend.Config.Host = "registry.example.com"
+	s := &Server{pm: pm, cm: cm}
+	require.Nil(t, WithConfig(cfg)(s))
+	// The config of caller is kept as is
+	assert.Equal(t, "dXNlcjpwYXNz", cfg.DaemonCfg.Device.Backend.Config.Auth)
+
+	sock := filepath.Join(dir, "metrics.sock")
+	ln, err := NewListener(sock, 0600)
+	require.Nil(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc(cacheEndpoint, s.cacheUsage)
+	mux.HandleFunc(cacheGCEndpoint, s.cacheGC)
+	mux.HandleFunc(drainEndpoint, s.drain)
+	mux.HandleFunc(configEndpoint, s.dumpConfig)
+	server := http.Server{Handler: mux}
+	go server.Serve(ln)
+	defer server.Close()
+
+	client, err := NewClient(sock, "")
+	require.Nil(t, err)
+
+	usage, err := client.CacheUsage()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(usage.Images))
+	assert.Equal(t, "docker.io/library/busybox:latest", usage.Images[0].Image)
+	assert.Equal(t, []string{"blob1"}, usage.Images[0].Blobs)
+	assert.Equal(t, usage.Images[0].Size, usage.TotalSize)
+
+	result, err := client.CacheGC()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"blob2"}, result.RemovedBlobs)
+
+	status, err := client.Drain(true)
+	require.Nil(t, err)
+	assert.True(t, status.Draining)
+	d, err := daemon.NewDaemon(daemon.WithSnapshotID("1"), daemon.WithSnapshotDir(dir))
+	require.Nil(t, err)
+	assert.Equal(t, errdefs.ErrDraining, pm.NewDaemon(d))
+	status, err = client.Drain(false)
+	require.Nil(t, err)
+	assert.False(t, status.Draining)
+	status, err = client.DrainStatus()
+	require.Nil(t, err)
+	assert.False(t, status.Draining)
+
+	dumped, err := client.Config()
+	require.Nil(t, err)
+	assert.Equal(t, dir, dumped.RootDir)
+	assert.Equal(t, "", dumped.DaemonCfg.Device.Backend.Config.Auth)
+	assert.Equal(t, "registry.example.com", dumped.DaemonCfg.Device.Backend.Config.Host)
+}
+
+func TestClientArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-metrics-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &Server{}
+	sock := filepath.Join(dir, "metrics.sock")
+	ln, err := NewListener(sock, 0600)
+	require.Nil(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc(artifactEndpoint, s.artifactMounts)
+	server := http.Server{Handler: mux}
+	go server.Serve(ln)
+	defer server.Close()
+
+	client, err := NewClient(sock, "")
+	require.Nil(t, err)
+	_, err = client.ListArtifacts()
+	assert.NotNil(t, err)
+
+	s.artifacts, err = artifact.New(context.Background(), artifact.Opt{
+		RootDir:    filepath.Join(dir, "artifacts"),
+		NydusdPath: filepath.Join(dir, "nydusd"),
+		DaemonConfig: func(ref string) (config.DaemonConfig, error) {
+			return config.DaemonConfig{}, nil
+		},
+		AllowedPaths: []string{filepath.Join(dir, "models")},
+	})
+	require.Nil(t, err)
+	mounts, err := client.ListArtifacts()
+	require.Nil(t, err)
+	assert.Len(t, mounts, 0)
+
+	_, err = client.MountArtifact("models/bert:v1", "/etc")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "400")
+	err = client.UmountArtifact(filepath.Join(dir, "models", "bert"))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "404")
+}
@@ -16,6 +16,9 @@ import (
 
 var (
 	imageRefLabel = "image_ref"
+	daemonIDLabel = "daemon_id"
+	probeLabel    = "probe"
+	resultLabel   = "result"
 	defaultTTL    = 3 * time.Minute
 )
 
@@ -56,6 +59,78 @@ var (
 		[]string{imageRefLabel},
 		defaultTTL,
 	)
+
+	ImagePinned = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nydus_snapshotter_image_pinned",
+			Help: "Pinned image whose blob caches are protected from GC.",
+		},
+		[]string{imageRefLabel},
+	)
+
+	ImageDegraded = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nydus_snapshotter_image_degraded",
+			Help: "Image served in degraded mode, where only the chunks in blob cache are readable.",
+		},
+		[]string{imageRefLabel},
+	)
+
+	ImageReadBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nydus_snapshotter_image_read_bytes_total",
+			Help: "Data read by containers from the filesystem of image, in Byte.",
+		},
+		[]string{imageRefLabel},
+	)
+
+	ImageRemoteReadBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nydus_snapshotter_image_remote_read_bytes_total",
+			Help: "Data of image fetched from storage backend, including prefetch, in Byte.",
+		},
+		[]string{imageRefLabel},
+	)
+
+	ImageCacheReadBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nydus_snapshotter_image_cache_read_bytes_total",
+			Help: "Data read by containers served from blob cache without fetching from storage backend, in Byte.",
+		},
+		[]string{imageRefLabel},
+	)
+
+	ImageCacheHitRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "nydus_snapshotter_image_cache_hit_ratio",
+			Help: "Ratio of data read by containers served from blob cache.",
+		},
+		[]string{imageRefLabel},
+	)
+
+	ImageIntegrityFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nydus_snapshotter_image_integrity_failures_total",
+			Help: "Reads of images with digest validation failed by chunks mismatching their digests.",
+		},
+		[]string{imageRefLabel},
+	)
+
+	DaemonProbeFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nydus_snapshotter_daemon_probe_failures_total",
+			Help: "Failed liveness probes of nydusd, the probe is \"api\" or \"fuse\".",
+		},
+		[]string{daemonIDLabel, probeLabel},
+	)
+
+	DaemonRecoveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nydus_snapshotter_daemon_recoveries_total",
+			Help: "Recovery actions taken on nydusd failing liveness probes, the result is \"success\" or \"failure\".",
+		},
+		[]string{daemonIDLabel, resultLabel},
+	)
 )
 
 // Fs metric histograms
@@ -20,6 +20,15 @@ func init() {
 		OpenFdCount,
 		OpenFdMaxCount,
 		LastFopTimestamp,
+		ImagePinned,
+		ImageDegraded,
+		ImageReadBytes,
+		ImageRemoteReadBytes,
+		ImageCacheReadBytes,
+		ImageCacheHitRatio,
+		ImageIntegrityFailures,
+		DaemonProbeFailures,
+		DaemonRecoveries,
 	)
 
 	for _, m := range FsMetricHists {
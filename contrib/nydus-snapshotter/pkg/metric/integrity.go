@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/metric/exporter"
+)
+
+// IntegrityEventType is the type of integrity event.
+type IntegrityEventType string
+
+const (
+	// IntegrityEventValidationFailed is raised when nydusd fails reads of
+	// an image with digest validation, while the storage backend doesn't
+	// fail, i.e. the chunks in blob cache or fetched from backend mismatch
+	// their digests in bootstrap.
+	IntegrityEventValidationFailed IntegrityEventType = "validation_failed"
+)
+
+// maxIntegrityEvents is the number of the latest events kept in memory.
+const maxIntegrityEvents = 100
+
+// IntegrityEvent describes the integrity failures of an image found in a
+// metrics collection, it's returned by the management API.
+type IntegrityEvent struct {
+	Type     IntegrityEventType `json:"type"`
+	Image    string             `json:"image"`
+	DaemonID string             `json:"daemon_id"`
+	// Failures is the number of failed reads since last collection.
+	Failures uint64    `json:"failures"`
+	Time     time.Time `json:"time"`
+}
+
+// integritySample is the error counters of a nydusd instance validating
+// the chunks of image.
+type integritySample struct {
+	daemonID      string
+	image         string
+	readErrors    uint64
+	backendErrors uint64
+}
+
+type errorCounters struct {
+	readErrors    uint64
+	backendErrors uint64
+}
+
+// integrityMonitor finds the integrity failures of images by the read
+// errors of nydusd instances. nydusd returns EIO for the chunks mismatching
+// their digests without a dedicated counter, so the read errors not caused
+// by backend errors in the same interval are regarded as integrity failures.
+type integrityMonitor struct {
+	mu     sync.Mutex
+	last   map[string]errorCounters
+	events []IntegrityEvent
+}
+
+func newIntegrityMonitor() *integrityMonitor {
+	return &integrityMonitor{
+		last:   map[string]errorCounters{},
+		events: []IntegrityEvent{},
+	}
+}
+
+// update checks the samples collected at now, live are the images of all the
+// running instances by id, the counters of the instances gone are dropped.
+func (m *integrityMonitor) update(samples []integritySample, live map[string]string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sample := range samples {
+		last := m.last[sample.daemonID]
+		m.last[sample.daemonID] = errorCounters{readErrors: sample.readErrors, backendErrors: sample.backendErrors}
+		readErrors := delta(sample.readErrors, last.readErrors)
+		backendErrors := delta(sample.backendErrors, last.backendErrors)
+		if readErrors <= backendErrors {
+			continue
+		}
+
+		event := IntegrityEvent{
+			Type:     IntegrityEventValidationFailed,
+			Image:    sample.image,
+			DaemonID: sample.daemonID,
+			Failures: readErrors - backendErrors,
+			Time:     now,
+		}
+		log.L.Warnf("%d reads of image %s failed digest validation in daemon %s", event.Failures, event.Image, event.DaemonID)
+		exporter.ImageIntegrityFailures.WithLabelValues(sample.image).Add(float64(event.Failures))
+		m.events = append(m.events, event)
+		if len(m.events) > maxIntegrityEvents {
+			m.events = m.events[len(m.events)-maxIntegrityEvents:]
+		}
+	}
+
+	for id := range m.last {
+		if _, ok := live[id]; !ok {
+			delete(m.last, id)
+		}
+	}
+}
+
+// list returns the latest events in time order.
+func (m *integrityMonitor) list() []IntegrityEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]IntegrityEvent{}, m.events...)
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/metric/exporter"
+)
+
+func TestIntegrityMonitor(t *testing.T) {
+	image := "docker.io/library/busybox:integrity"
+	m := newIntegrityMonitor()
+	live := map[string]string{"d1": image, "d2": image}
+	now := time.Now()
+
+	m.update([]integritySample{
+		{daemonID: "d1", image: image, readErrors: 0},
+		{daemonID: "d2", image: image, readErrors: 2, backendErrors: 2},
+	}, live, now)
+	assert.Empty(t, m.list())
+
+	// The read errors caused by backend aren't integrity failures
+	m.update([]integritySample{
+		{daemonID: "d1", image: image, readErrors: 3, backendErrors: 1},
+		{daemonID: "d2", image: image, readErrors: 4, backendErrors: 4},
+	}, live, now.Add(time.Minute))
+	events := m.list()
+	require.Len(t, events, 1)
+	assert.Equal(t, IntegrityEvent{
+		Type:     IntegrityEventValidationFailed,
+		Image:    image,
+		DaemonID: "d1",
+		Failures: 2,
+		Time:     now.Add(time.Minute),
+	}, events[0])
+
+	// d1 is restarted, so its counters are reset
+	m.update([]integritySample{{daemonID: "d1", image: image, readErrors: 1}}, map[string]string{"d1": image}, now.Add(2*time.Minute))
+	events = m.list()
+	require.Len(t, events, 2)
+	assert.Equal(t, uint64(1), events[1].Failures)
+	assert.Len(t, m.last, 1)
+
+	var metric dto.Metric
+	require.Nil(t, exporter.ImageIntegrityFailures.WithLabelValues(image).Write(&metric))
+	assert.Equal(t, float64(3), metric.GetCounter().GetValue())
+
+	// Only the latest events are kept
+	for i := 0; i < maxIntegrityEvents; i++ {
+		m.update([]integritySample{{daemonID: "d1", image: image, readErrors: uint64(i + 2)}}, live, now)
+	}
+	events = m.list()
+	assert.Len(t, events, maxIntegrityEvents)
+	assert.Equal(t, "d1", events[0].DaemonID)
+	assert.True(t, events[0].Time.Equal(now))
+}
@@ -9,21 +9,74 @@ package metrics
 import (
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	unixScheme = "unix://"
+	tcpScheme  = "tcp://"
 )
 
 // DefaultBindAddress sets the default bind address for the metrics
 // listener.
 var DefaultBindAddress = ":8080"
 
-// NewListener creates a new TCP listener bound to the given address.
-func NewListener(addr string) (net.Listener, error) {
+// DefaultSocketMode is the file permission of the unix socket, only
+// the owner is allowed to access metrics and management API by default.
+var DefaultSocketMode os.FileMode = 0600
+
+// ParseAddress parses the address into network and address, the address
+// could be "unix:///path/to/sock", "tcp://host:port", an absolute path of
+// unix socket or a TCP address.
+func ParseAddress(addr string) (string, string) {
+	switch {
+	case strings.HasPrefix(addr, unixScheme):
+		return "unix", strings.TrimPrefix(addr, unixScheme)
+	case strings.HasPrefix(addr, tcpScheme):
+		return "tcp", strings.TrimPrefix(addr, tcpScheme)
+	case filepath.IsAbs(addr):
+		return "unix", addr
+	default:
+		return "tcp", addr
+	}
+}
+
+// NewListener creates a new listener bound to the given address, the
+// unix socket file will be created with the given file permission.
+func NewListener(addr string, mode os.FileMode) (net.Listener, error) {
 	if addr == "" {
 		// If the metrics bind address is empty, default to ":8080"
 		addr = DefaultBindAddress
 	}
-	ln, err := net.Listen("unix", addr)
+	network, addr := ParseAddress(addr)
+
+	if network == "unix" {
+		if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+			return nil, fmt.Errorf("error creating directory of %s: %v", addr, err)
+		}
+		if _, err := os.Stat(addr); err == nil {
+			if err := os.Remove(addr); err != nil {
+				return nil, fmt.Errorf("error removing stale socket %s: %v", addr, err)
+			}
+		}
+	}
+
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("error listening on %s: %v", addr, err)
 	}
+
+	if network == "unix" {
+		if mode == 0 {
+			mode = DefaultSocketMode
+		}
+		if err := os.Chmod(addr, mode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("error changing mode of %s: %v", addr, err)
+		}
+	}
+
 	return ln, nil
 }
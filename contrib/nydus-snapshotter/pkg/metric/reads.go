@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package metrics
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/metric/exporter"
+)
+
+// ImageReads describes the data read of an image since it's served on the
+// node, it's returned by the management API.
+type ImageReads struct {
+	Image string `json:"image"`
+	// ReadBytes is the data read by containers from the filesystem.
+	ReadBytes uint64 `json:"read_bytes"`
+	// RemoteBytes is the data fetched from storage backend, including the
+	// data prefetched.
+	RemoteBytes uint64 `json:"remote_bytes"`
+	// CacheBytes is the data read by containers served from blob cache
+	// without fetching from storage backend.
+	CacheBytes    uint64  `json:"cache_bytes"`
+	CacheHitRatio float64 `json:"cache_hit_ratio"`
+}
+
+// ReadSummary describes the data read of images on node, the totals show
+// how much data lazy loading saves from being fetched.
+type ReadSummary struct {
+	Images        []ImageReads `json:"images"`
+	ReadBytes     uint64       `json:"read_bytes"`
+	RemoteBytes   uint64       `json:"remote_bytes"`
+	CacheBytes    uint64       `json:"cache_bytes"`
+	CacheHitRatio float64      `json:"cache_hit_ratio"`
+}
+
+// readSample is the counters of a nydusd instance collected from its fs
+// and backend metrics.
+type readSample struct {
+	daemonID string
+	image    string
+	read     uint64
+	remote   uint64
+}
+
+type readCounters struct {
+	read   uint64
+	remote uint64
+	cache  uint64
+}
+
+type imageReads struct {
+	readCounters
+	// daemons are the last counters of the instances serving image.
+	daemons map[string]readCounters
+}
+
+// readAggregator aggregates the counters of nydusd instances into the
+// counters of images. The counters of nydusd are reset by restart and
+// remount, which are detected by the decrease of counters, so the counters
+// of images are monotonic. The data read in an interval is regarded as
+// served from blob cache except the data fetched in the same interval.
+type readAggregator struct {
+	mu     sync.Mutex
+	images map[string]*imageReads
+}
+
+func newReadAggregator() *readAggregator {
+	return &readAggregator{images: map[string]*imageReads{}}
+}
+
+func delta(current, last uint64) uint64 {
+	if current < last {
+		// The counter is reset
+		return current
+	}
+	return current - last
+}
+
+func hitRatio(cache, read uint64) float64 {
+	if read == 0 {
+		return 0
+	}
+	return float64(cache) / float64(read)
+}
+
+// update accumulates the samples, live are the images of all the running
+// instances by id, including the ones failing to report metrics. The images
+// without running instance are dropped.
+func (a *readAggregator) update(samples []readSample, live map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, sample := range samples {
+		image, ok := a.images[sample.image]
+		if !ok {
+			image = &imageReads{daemons: map[string]readCounters{}}
+			a.images[sample.image] = image
+		}
+		last := image.daemons[sample.daemonID]
+		read := delta(sample.read, last.read)
+		remote := delta(sample.remote, last.remote)
+		var cache uint64
+		if read > remote {
+			cache = read - remote
+		}
+		image.read += read
+		image.remote += remote
+		image.cache += cache
+		image.daemons[sample.daemonID] = readCounters{read: sample.read, remote: sample.remote}
+
+		exporter.ImageReadBytes.WithLabelValues(sample.image).Add(float64(read))
+		exporter.ImageRemoteReadBytes.WithLabelValues(sample.image).Add(float64(remote))
+		exporter.ImageCacheReadBytes.WithLabelValues(sample.image).Add(float64(cache))
+		exporter.ImageCacheHitRatio.WithLabelValues(sample.image).Set(hitRatio(image.cache, image.read))
+	}
+
+	liveImages := map[string]bool{}
+	for _, image := range live {
+		liveImages[image] = true
+	}
+	for ref, image := range a.images {
+		if !liveImages[ref] {
+			delete(a.images, ref)
+			exporter.ImageReadBytes.DeleteLabelValues(ref)
+			exporter.ImageRemoteReadBytes.DeleteLabelValues(ref)
+			exporter.ImageCacheReadBytes.DeleteLabelValues(ref)
+			exporter.ImageCacheHitRatio.DeleteLabelValues(ref)
+			continue
+		}
+		for id := range image.daemons {
+			if _, ok := live[id]; !ok {
+				delete(image.daemons, id)
+			}
+		}
+	}
+}
+
+// summary returns the data read of images ordered by image.
+func (a *readAggregator) summary() ReadSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	summary := ReadSummary{Images: []ImageReads{}}
+	for ref, image := range a.images {
+		summary.Images = append(summary.Images, ImageReads{
+			Image:         ref,
+			ReadBytes:     image.read,
+			RemoteBytes:   image.remote,
+			CacheBytes:    image.cache,
+			CacheHitRatio: hitRatio(image.cache, image.read),
+		})
+		summary.ReadBytes += image.read
+		summary.RemoteBytes += image.remote
+		summary.CacheBytes += image.cache
+	}
+	sort.Slice(summary.Images, func(i, j int) bool {
+		return summary.Images[i].Image < summary.Images[j].Image
+	})
+	summary.CacheHitRatio = hitRatio(summary.CacheBytes, summary.ReadBytes)
+	return summary
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/metric/exporter"
+)
+
+func counterValue(t *testing.T, image string) float64 {
+	var m dto.Metric
+	require.Nil(t, exporter.ImageCacheReadBytes.WithLabelValues(image).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestReadAggregator(t *testing.T) {
+	busybox := "docker.io/library/busybox:reads"
+	nginx := "docker.io/library/nginx:reads"
+	a := newReadAggregator()
+	live := map[string]string{"d1": busybox, "d2": busybox, "d3": nginx}
+
+	// The prefetched data is fetched before being read
+	a.update([]readSample{
+		{daemonID: "d1", image: busybox, read: 100, remote: 300},
+		{daemonID: "d3", image: nginx, read: 50, remote: 50},
+	}, live)
+	a.update([]readSample{
+		{daemonID: "d1", image: busybox, read: 400, remote: 300},
+		{daemonID: "d2", image: busybox, read: 100, remote: 0},
+		{daemonID: "d3", image: nginx, read: 50, remote: 50},
+	}, live)
+	// d1 is remounted, so its counters are reset
+	a.update([]readSample{
+		{daemonID: "d1", image: busybox, read: 100, remote: 20},
+	}, live)
+
+	summary := a.summary()
+	require.Len(t, summary.Images, 2)
+	assert.Equal(t, ImageReads{
+		Image:         busybox,
+		ReadBytes:     600,
+		RemoteBytes:   320,
+		CacheBytes:    480,
+		CacheHitRatio: 0.8,
+	}, summary.Images[0])
+	assert.Equal(t, ImageReads{Image: nginx, ReadBytes: 50, RemoteBytes: 50}, summary.Images[1])
+	assert.Equal(t, uint64(650), summary.ReadBytes)
+	assert.Equal(t, uint64(480), summary.CacheBytes)
+	assert.Equal(t, 480.0/650, summary.CacheHitRatio)
+	assert.Equal(t, float64(480), counterValue(t, busybox))
+
+	// The image without running instance is dropped, and so are the
+	// instances gone, the running ones failing to report metrics are kept
+	a.update(nil, map[string]string{"d2": busybox})
+	summary = a.summary()
+	require.Len(t, summary.Images, 1)
+	assert.Equal(t, busybox, summary.Images[0].Image)
+	assert.Len(t, a.images[busybox].daemons, 1)
+	a.update([]readSample{{daemonID: "d2", image: busybox, read: 150}}, map[string]string{"d2": busybox})
+	assert.Equal(t, uint64(530), a.summary().CacheBytes)
+}
+
+func TestClientImageReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-metrics-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &Server{reads: newReadAggregator()}
+	s.reads.update([]readSample{{daemonID: "d1", image: "busybox", read: 100, remote: 40}}, map[string]string{"d1": "busybox"})
+
+	sock := filepath.Join(dir, "metrics.sock")
+	ln, err := NewListener(sock, 0600)
+	require.Nil(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc(readsEndpoint, s.imageReads)
+	server := http.Server{Handler: mux}
+	go server.Serve(ln)
+	defer server.Close()
+
+	client, err := NewClient(sock, "")
+	require.Nil(t, err)
+	summary, err := client.ImageReads()
+	require.Nil(t, err)
+	require.Len(t, summary.Images, 1)
+	assert.Equal(t, uint64(60), summary.Images[0].CacheBytes)
+	assert.Equal(t, 0.6, summary.CacheHitRatio)
+}
@@ -8,31 +8,121 @@ package metrics
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/containerd/containerd/log"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/artifact"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/cache"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/latency"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/metric/exporter"
-	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/nydussdk"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/preheat"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/process"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/store"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 type ServerOpt func(*Server) error
 
-const sockFileName = "metrics.sock"
+const (
+	sockFileName = "metrics.sock"
+
+	metricsEndpoint   = "/metrics"
+	daemonsEndpoint   = "/api/v1/daemons"
+	pinsEndpoint      = "/api/v1/pins"
+	latencyEndpoint   = "/api/v1/latency"
+	logLevelEndpoint  = "/api/v1/log-level"
+	preheatEndpoint   = "/api/v1/preheat"
+	cacheEndpoint     = "/api/v1/cache"
+	cacheGCEndpoint   = "/api/v1/cache/gc"
+	drainEndpoint     = "/api/v1/drain"
+	flushEndpoint     = "/api/v1/metrics/flush"
+	readsEndpoint     = "/api/v1/metrics/images"
+	integrityEndpoint = "/api/v1/integrity/events"
+	configEndpoint    = "/api/v1/config"
+	artifactEndpoint  = "/api/v1/artifacts"
+)
 
 type Server struct {
 	listener    net.Listener
 	rootDir     string
+	address     string
+	socketMode  os.FileMode
+	authToken   string
 	metricsFile string
 	pm          *process.Manager
+	cm          *cache.Manager
+	recorder    *latency.Recorder
+	preheater   *preheat.Preheater
+	artifacts   *artifact.Manager
+	cfg         *config.Config
 	exp         *exporter.Exporter
+	reads       *readAggregator
+	integrity   *integrityMonitor
+}
+
+// DaemonInfo describes a nydusd instance managed by snapshotter, it's
+// returned by the management API.
+type DaemonInfo struct {
+	ID         string `json:"id"`
+	SnapshotID string `json:"snapshot_id"`
+	ImageID    string `json:"image_id"`
+	Pid        int    `json:"pid"`
+	APISock    string `json:"api_sock"`
+	MountPoint string `json:"mountpoint"`
+	Pinned     bool   `json:"pinned"`
+	// Degraded is true if the image is served in degraded mode, where
+	// only the chunks in blob cache are readable.
+	Degraded      bool       `json:"degraded"`
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+}
+
+// PinInfo describes a pinned image whose blob caches are protected
+// from GC, it's returned by the management API.
+type PinInfo struct {
+	Image     string    `json:"image"`
+	Blobs     []string  `json:"blobs"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ImageCacheInfo describes the blob cache usage of an image, it's returned
+// by the management API.
+type ImageCacheInfo struct {
+	Image  string   `json:"image"`
+	Blobs  []string `json:"blobs"`
+	Size   int64    `json:"size"`
+	Pinned bool     `json:"pinned"`
+}
+
+// CacheUsage describes the blob cache usage of images on node, the blobs
+// shared by images are counted once in TotalSize.
+type CacheUsage struct {
+	Images    []ImageCacheInfo `json:"images"`
+	TotalSize int64            `json:"total_size"`
+}
+
+// GCResult is the result of blob cache GC triggered by management API.
+type GCResult struct {
+	RemovedBlobs []string `json:"removed_blobs"`
+}
+
+// DrainStatus describes whether snapshotter is draining, and the count
+// of nydusd instances still serving images.
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+	Daemons  int  `json:"daemons"`
 }
 
 func WithRootDir(rootDir string) ServerOpt {
@@ -42,6 +132,43 @@ func WithRootDir(rootDir string) ServerOpt {
 	}
 }
 
+// WithAddress sets the address of metrics and management API server, it
+// could be a unix socket path or a TCP address, see ParseAddress. The server
+// listens on the unix socket "metrics.sock" in root dir by default.
+func WithAddress(address string) ServerOpt {
+	return func(s *Server) error {
+		s.address = address
+		return nil
+	}
+}
+
+// WithSocketMode sets the file permission of the unix socket.
+func WithSocketMode(mode os.FileMode) ServerOpt {
+	return func(s *Server) error {
+		s.socketMode = mode
+		return nil
+	}
+}
+
+// WithAuthTokenFile enables the bearer token authentication, the token
+// is read from the file, request without the token will be rejected.
+func WithAuthTokenFile(tokenFile string) ServerOpt {
+	return func(s *Server) error {
+		if tokenFile == "" {
+			return nil
+		}
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read auth token file %s", tokenFile)
+		}
+		s.authToken = strings.TrimSpace(string(token))
+		if s.authToken == "" {
+			return errors.Errorf("auth token file %s is empty", tokenFile)
+		}
+		return nil
+	}
+}
+
 func WithMetricsFile(metricsFile string) ServerOpt {
 	return func(s *Server) error {
 		if s.rootDir == "" {
@@ -64,6 +191,64 @@ func WithProcessManager(pm *process.Manager) ServerOpt {
 	}
 }
 
+// WithCacheManager enables the pin API, which protects the blob caches
+// of images from GC.
+func WithCacheManager(cm *cache.Manager) ServerOpt {
+	return func(s *Server) error {
+		s.cm = cm
+		return nil
+	}
+}
+
+// WithLatencyRecorder enables the latency API, which reports the pod
+// start latencies of nydus and non-nydus images on the node.
+func WithLatencyRecorder(recorder *latency.Recorder) ServerOpt {
+	return func(s *Server) error {
+		s.recorder = recorder
+		return nil
+	}
+}
+
+// PreheatRequest is the body of request creating a preheat task.
+type PreheatRequest struct {
+	Images []string `json:"images"`
+}
+
+// WithPreheater enables the preheat API, which fetches the blob data of
+// images into blob cache before they are pulled.
+func WithPreheater(preheater *preheat.Preheater) ServerOpt {
+	return func(s *Server) error {
+		s.preheater = preheater
+		return nil
+	}
+}
+
+// ArtifactRequest is the body of request mounting an artifact.
+type ArtifactRequest struct {
+	Ref        string `json:"ref"`
+	Mountpoint string `json:"mountpoint"`
+}
+
+// WithArtifactManager enables the artifact API, which mounts RAFS data
+// artifacts at host paths.
+func WithArtifactManager(artifacts *artifact.Manager) ServerOpt {
+	return func(s *Server) error {
+		s.artifacts = artifacts
+		return nil
+	}
+}
+
+// WithConfig enables the config API, which dumps the effective config of
+// snapshotter, the credentials in nydusd config are redacted.
+func WithConfig(cfg config.Config) ServerOpt {
+	return func(s *Server) error {
+		backend := &cfg.DaemonCfg.Device.Backend.Config
+		backend.Auth, backend.RegistryToken, backend.AccessKeySecret = "", "", ""
+		s.cfg = &cfg
+		return nil
+	}
+}
+
 func NewServer(ctx context.Context, opts ...ServerOpt) (*Server, error) {
 	var s Server
 	for _, o := range opts {
@@ -79,22 +264,20 @@ func NewServer(ctx context.Context, opts ...ServerOpt) (*Server, error) {
 		return nil, errors.Wrap(err, "failed to new metric exporter")
 	}
 	s.exp = exp
+	s.reads = newReadAggregator()
+	s.integrity = newIntegrityMonitor()
 
-	sockPath := filepath.Join(s.rootDir, sockFileName)
-
-	if _, err := os.Stat(sockPath); err == nil {
-		err = os.Remove(sockPath)
-		if err != nil {
-			return nil, err
-		}
+	if s.address == "" {
+		s.address = filepath.Join(s.rootDir, sockFileName)
 	}
-	ln, err := NewListener(sockPath)
+
+	ln, err := NewListener(s.address, s.socketMode)
 	if err != nil {
 		return nil, err
 	}
 	s.listener = ln
 
-	log.G(ctx).Infof("Starting metrics server on %s", sockPath)
+	log.G(ctx).Infof("Starting metrics server on %s", s.address)
 
 	return &s, nil
 }
@@ -107,29 +290,7 @@ outer:
 	for {
 		select {
 		case <-timer.C:
-			daemons := s.pm.ListDaemons()
-			for _, d := range daemons {
-				if d.ID == daemon.SharedNydusDaemonID {
-					continue
-				}
-
-				client, err := nydussdk.NewNydusClient(d.APISock())
-				if err != nil {
-					log.G(ctx).Errorf("failed to connect nydusd: %v", err)
-					continue
-				}
-
-				fsMetrics, err := client.GetFsMetric(s.pm.IsSharedDaemon(), d.SnapshotID)
-				if err != nil {
-					log.G(ctx).Errorf("failed to get fs metric: %v", err)
-					continue
-				}
-
-				if err := s.exp.ExportFsMetrics(fsMetrics, d.ImageID); err != nil {
-					log.G(ctx).Errorf("failed to export fs metrics for %s: %v", d.ImageID, err)
-					continue
-				}
-			}
+			s.flushDaemonMetrics(ctx)
 		case <-ctx.Done():
 			log.G(ctx).Infof("cancel daemon metrics collecting")
 			break outer
@@ -139,14 +300,471 @@ outer:
 	return nil
 }
 
+// flushDaemonMetrics collects the fs metrics of all daemons and exports
+// them right now, the data read of images is aggregated with the backend
+// metrics as well, and so are the read errors of images with digest
+// validation to find integrity failures.
+func (s *Server) flushDaemonMetrics(ctx context.Context) int {
+	flushed := 0
+	samples := []readSample{}
+	errorSamples := []integritySample{}
+	live := map[string]string{}
+	defer func() {
+		s.reads.update(samples, live)
+		s.integrity.update(errorSamples, live, time.Now())
+	}()
+	for _, d := range s.pm.ListDaemons() {
+		if d.ID == daemon.SharedNydusDaemonID {
+			continue
+		}
+		live[d.ID] = d.ImageID
+
+		client, err := d.Client()
+		if err != nil {
+			log.G(ctx).Errorf("failed to connect nydusd: %v", err)
+			continue
+		}
+
+		fsMetrics, err := client.GetFsMetric(s.pm.IsSharedDaemon(), d.SnapshotID)
+		if err != nil {
+			log.G(ctx).Errorf("failed to get fs metric: %v", err)
+			continue
+		}
+		if fsMetrics == nil {
+			continue
+		}
+
+		if backendMetrics, err := client.GetBackendMetric(s.pm.IsSharedDaemon(), d.SnapshotID); err != nil {
+			log.G(ctx).Errorf("failed to get backend metric of %s: %v", d.ImageID, err)
+		} else {
+			samples = append(samples, readSample{
+				daemonID: d.ID,
+				image:    d.ImageID,
+				read:     fsMetrics.DataRead,
+				remote:   backendMetrics.ReadAmountTotal,
+			})
+			if d.DigestValidate && len(fsMetrics.FopErrors) > exporter.Read {
+				errorSamples = append(errorSamples, integritySample{
+					daemonID:      d.ID,
+					image:         d.ImageID,
+					readErrors:    fsMetrics.FopErrors[exporter.Read],
+					backendErrors: backendMetrics.ReadErrors,
+				})
+			}
+		}
+
+		if err := s.exp.ExportFsMetrics(fsMetrics, d.ImageID); err != nil {
+			log.G(ctx).Errorf("failed to export fs metrics for %s: %v", d.ImageID, err)
+			continue
+		}
+		flushed++
+	}
+	return flushed
+}
+
+func (s *Server) listDaemons(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	infos := []DaemonInfo{}
+	for _, d := range s.pm.ListDaemons() {
+		info := DaemonInfo{
+			ID:         d.ID,
+			SnapshotID: d.SnapshotID,
+			ImageID:    d.ImageID,
+			Pid:        d.Pid,
+			APISock:    d.APISock(),
+			MountPoint: d.MountPoint(),
+			Pinned:     s.cm != nil && s.cm.IsPinned(d.ImageID),
+		}
+		if status := s.pm.DegradedStatus(d.ID); status.Degraded {
+			info.Degraded = true
+			info.DegradedSince = &status.Since
+		}
+		infos = append(infos, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		log.L.Errorf("failed to encode daemon list, err: %v", err)
+	}
+}
+
+// syncPinMetrics exports the pinned images to metrics.
+func (s *Server) syncPinMetrics() error {
+	pins, err := s.cm.ListPins()
+	if err != nil {
+		return err
+	}
+	exporter.ImagePinned.Reset()
+	for _, pin := range pins {
+		exporter.ImagePinned.WithLabelValues(pin.Image).Set(1)
+	}
+	return nil
+}
+
+func (s *Server) pins(w http.ResponseWriter, r *http.Request) {
+	if s.cm == nil {
+		http.Error(w, "cache manager is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		pins, err := s.cm.ListPins()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		infos := []PinInfo{}
+		for _, pin := range pins {
+			infos = append(infos, PinInfo{
+				Image:     pin.Image,
+				Blobs:     pin.Blobs,
+				CreatedAt: pin.CreateAt,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(infos); err != nil {
+			log.L.Errorf("failed to encode pin list, err: %v", err)
+		}
+		return
+	case http.MethodPut, http.MethodDelete:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	image := r.URL.Query().Get("image")
+	if image == "" {
+		http.Error(w, "image is required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if r.Method == http.MethodPut {
+		err = s.cm.Pin(image)
+	} else {
+		err = s.cm.Unpin(image)
+	}
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("image %s is not pinned", image), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.L.Infof("%s pin of image %s", r.Method, image)
+
+	if err := s.syncPinMetrics(); err != nil {
+		log.L.Errorf("failed to export pin metrics, err: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) latencyReport(w http.ResponseWriter, r *http.Request) {
+	if s.recorder == nil {
+		http.Error(w, "latency measurement is not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := s.recorder.Report(r.URL.Query().Get("records") == "true")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.L.Errorf("failed to encode latency report, err: %v", err)
+	}
+}
+
+// logLevel gets the log levels, or sets the global level or the level of
+// a module, the module follows the global level again after DELETE.
+func (s *Server) logLevel(w http.ResponseWriter, r *http.Request) {
+	module := r.URL.Query().Get("module")
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(logging.GetLevels()); err != nil {
+			log.L.Errorf("failed to encode log levels, err: %v", err)
+		}
+		return
+	case http.MethodPut:
+		var level logrus.Level
+		level, err = logrus.ParseLevel(r.URL.Query().Get("level"))
+		if err == nil {
+			err = logging.SetLevel(module, level)
+		}
+	case http.MethodDelete:
+		if module == "" {
+			http.Error(w, "module is required", http.StatusBadRequest)
+			return
+		}
+		err = logging.ResetLevel(module)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.L.Infof("log levels are changed by %s request: %+v", r.Method, logging.GetLevels())
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// preheat creates a preheat task by POST, and returns the task of id or all
+// the tasks by GET.
+func (s *Server) preheat(w http.ResponseWriter, r *http.Request) {
+	if s.preheater == nil {
+		http.Error(w, "preheat is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	var (
+		result interface{}
+		status = http.StatusOK
+	)
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			result = s.preheater.List()
+			break
+		}
+		task, err := s.preheater.Get(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		result = task
+	case http.MethodPost:
+		var req PreheatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid preheat request: %v", err), http.StatusBadRequest)
+			return
+		}
+		task, err := s.preheater.Submit(req.Images)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, status = task, http.StatusAccepted
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.L.Errorf("failed to encode preheat task, err: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.L.Errorf("failed to encode response, err: %v", err)
+	}
+}
+
+// cacheUsage returns the blob cache usage of images.
+func (s *Server) cacheUsage(w http.ResponseWriter, r *http.Request) {
+	if s.cm == nil {
+		http.Error(w, "cache manager is not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	usages, total, err := s.cm.Usage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := CacheUsage{Images: []ImageCacheInfo{}, TotalSize: total}
+	for _, usage := range usages {
+		result.Images = append(result.Images, ImageCacheInfo{
+			Image:  usage.Image,
+			Blobs:  usage.Blobs,
+			Size:   usage.Size,
+			Pinned: usage.Pinned,
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// cacheGC removes the unused blob caches right now.
+func (s *Server) cacheGC(w http.ResponseWriter, r *http.Request) {
+	if s.cm == nil {
+		http.Error(w, "cache manager is not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	removed, err := s.cm.GC()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.L.Infof("blob cache gc is triggered by management API, %d blobs removed", len(removed))
+	if removed == nil {
+		removed = []string{}
+	}
+	writeJSON(w, http.StatusOK, GCResult{RemovedBlobs: removed})
+}
+
+// drain gets the drain status, or starts draining by PUT and stops it by
+// DELETE.
+func (s *Server) drain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodDelete:
+		s.pm.SetDraining(r.Method == http.MethodPut)
+		log.L.Infof("draining is changed by %s request: %t", r.Method, s.pm.IsDraining())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := DrainStatus{Draining: s.pm.IsDraining()}
+	for _, d := range s.pm.ListDaemons() {
+		if d.ID != daemon.SharedNydusDaemonID {
+			status.Daemons++
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// flushMetrics collects and exports the metrics of daemons right now,
+// instead of waiting for the next collection.
+func (s *Server) flushMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flushed := s.flushDaemonMetrics(r.Context())
+	log.L.Infof("metrics of %d daemons are flushed by management API", flushed)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// imageReads returns the data read of images, the counters are updated on
+// metrics collection.
+func (s *Server) imageReads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.reads.summary())
+}
+
+// integrityEvents returns the latest integrity events of images with digest
+// validation, the events are found on metrics collection.
+func (s *Server) integrityEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.integrity.list())
+}
+
+// dumpConfig returns the effective config of snapshotter.
+func (s *Server) dumpConfig(w http.ResponseWriter, r *http.Request) {
+	if s.cfg == nil {
+		http.Error(w, "config is not available", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.cfg)
+}
+
+// artifactMounts mounts an artifact by POST, umounts the artifact mounted at
+// mountpoint by DELETE, and lists the mounted artifacts by GET.
+func (s *Server) artifactMounts(w http.ResponseWriter, r *http.Request) {
+	if s.artifacts == nil {
+		http.Error(w, "artifact mount is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.artifacts.List())
+	case http.MethodPost:
+		var req ArtifactRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid artifact request: %v", err), http.StatusBadRequest)
+			return
+		}
+		mnt, err := s.artifacts.Mount(r.Context(), req.Ref, req.Mountpoint)
+		switch {
+		case err == nil:
+			writeJSON(w, http.StatusCreated, mnt)
+		case errors.Is(err, artifact.ErrInvalidArgument):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, artifact.ErrAlreadyMounted):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case http.MethodDelete:
+		err := s.artifacts.Umount(r.URL.Query().Get("mountpoint"))
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, artifact.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
 func (s *Server) Serve(ctx context.Context) error {
 	handler := promhttp.HandlerFor(exporter.Registry, promhttp.HandlerOpts{
 		ErrorHandling: promhttp.HTTPErrorOnError,
 	})
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", handler)
+	mux.Handle(metricsEndpoint, handler)
+	mux.HandleFunc(daemonsEndpoint, s.listDaemons)
+	mux.HandleFunc(pinsEndpoint, s.pins)
+	mux.HandleFunc(latencyEndpoint, s.latencyReport)
+	mux.HandleFunc(logLevelEndpoint, s.logLevel)
+	mux.HandleFunc(preheatEndpoint, s.preheat)
+	mux.HandleFunc(cacheEndpoint, s.cacheUsage)
+	mux.HandleFunc(cacheGCEndpoint, s.cacheGC)
+	mux.HandleFunc(drainEndpoint, s.drain)
+	mux.HandleFunc(flushEndpoint, s.flushMetrics)
+	mux.HandleFunc(readsEndpoint, s.imageReads)
+	mux.HandleFunc(integrityEndpoint, s.integrityEvents)
+	mux.HandleFunc(configEndpoint, s.dumpConfig)
+	mux.HandleFunc(artifactEndpoint, s.artifactMounts)
 	server := http.Server{
-		Handler: mux,
+		Handler: withAuth(s.authToken, mux),
+	}
+
+	if s.cm != nil {
+		if err := s.syncPinMetrics(); err != nil {
+			log.G(ctx).Errorf("failed to export pin metrics, err: %v", err)
+		}
 	}
 
 	// Process manager starts to collect metrics from daemons periodically.
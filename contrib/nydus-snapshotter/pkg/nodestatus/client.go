@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package nodestatus
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/kubeclient"
+)
+
+// Taint is the taint of node.
+type Taint struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value,omitempty"`
+	Effect    string     `json:"effect"`
+	TimeAdded *time.Time `json:"timeAdded,omitempty"`
+}
+
+// Condition is the condition of node status.
+type Condition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	LastHeartbeatTime  time.Time `json:"lastHeartbeatTime"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+	Reason             string    `json:"reason"`
+	Message            string    `json:"message"`
+}
+
+// node is the subset of node object used by reporter.
+type node struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec struct {
+		Taints []Taint `json:"taints,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []Condition `json:"conditions,omitempty"`
+	} `json:"status"`
+}
+
+// client reads and patches the node.
+type client struct {
+	*kubeclient.Client
+}
+
+func (c *client) getNode(ctx context.Context, name string) (*node, error) {
+	var n node
+	if err := c.Do(ctx, http.MethodGet, "/api/v1/nodes/"+name, "", nil, &n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// patchCondition sets the condition of node status, the conditions are
+// merged by type, so that the conditions of others are kept.
+func (c *client) patchCondition(ctx context.Context, name string, condition Condition) error {
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []Condition{condition},
+		},
+	}
+	return c.Do(ctx, http.MethodPatch, "/api/v1/nodes/"+name+"/status", kubeclient.StrategicMergePatchType, patch, nil)
+}
+
+// patchTaints replaces the taints of node, the resource version makes the
+// patch fail with kubeclient.ErrConflict if the taints are modified by others.
+func (c *client) patchTaints(ctx context.Context, name, resourceVersion string, taints []Taint) error {
+	if taints == nil {
+		taints = []Taint{}
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": resourceVersion,
+		},
+		"spec": map[string]interface{}{
+			"taints": taints,
+		},
+	}
+	return c.Do(ctx, http.MethodPatch, "/api/v1/nodes/"+name, kubeclient.MergePatchType, patch, nil)
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package nodestatus reports the health of snapshotter to the node object
+// in Kubernetes, so that the scheduler stops placing the lazy-loaded
+// workloads on the node while the snapshotter is unhealthy or draining.
+package nodestatus
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/kubeclient"
+)
+
+const (
+	// ConditionType is the type of node condition reported by snapshotter,
+	// the status is "True" if the snapshotter is unavailable.
+	ConditionType = "NydusSnapshotterUnavailable"
+	// TaintKey is the key of NoSchedule taint added to node while the
+	// snapshotter is unavailable, if tainting is enabled.
+	TaintKey = "nydus.remote/snapshotter-unavailable"
+
+	ReasonHealthy   = "SnapshotterHealthy"
+	ReasonUnhealthy = "SnapshotterUnhealthy"
+	ReasonDraining  = "SnapshotterDraining"
+
+	taintEffect             = "NoSchedule"
+	defaultInterval         = 30 * time.Second
+	defaultFailureThreshold = 2
+	maxConflicts            = 3
+)
+
+// CheckFunc checks the health of snapshotter, it returns the reason if
+// the snapshotter is unhealthy.
+type CheckFunc func(ctx context.Context) error
+
+type Opt struct {
+	// NodeName is the name of node object the snapshotter runs on.
+	NodeName string
+	// Interval is the period of checking and reporting, defaults to 30s.
+	Interval time.Duration
+	// FailureThreshold is the number of consecutive failed checks before
+	// reporting unhealthy, so that a nydusd being started isn't regarded
+	// as unhealthy, defaults to 2.
+	FailureThreshold int
+	// Taint adds a NoSchedule taint to node besides the condition while
+	// the snapshotter is unavailable.
+	Taint bool
+	Check CheckFunc
+}
+
+// Reporter checks the health of snapshotter periodically, and updates the
+// node condition and taint through Kubernetes API.
+type Reporter struct {
+	client   *client
+	nodeName string
+	interval time.Duration
+	taint    bool
+	check    CheckFunc
+
+	mu        sync.Mutex
+	draining  bool
+	threshold int
+	failures  int
+}
+
+// New creates a reporter with the service account mounted in pod.
+func New(opt Opt) (*Reporter, error) {
+	c, err := kubeclient.NewInCluster()
+	if err != nil {
+		return nil, err
+	}
+	return newReporter(&client{c}, opt)
+}
+
+func newReporter(c *client, opt Opt) (*Reporter, error) {
+	if opt.NodeName == "" {
+		return nil, errors.New("node name is required")
+	}
+	if opt.Check == nil {
+		return nil, errors.New("health check is required")
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = defaultInterval
+	}
+	if opt.FailureThreshold <= 0 {
+		opt.FailureThreshold = defaultFailureThreshold
+	}
+	return &Reporter{
+		client:   c,
+		nodeName: opt.NodeName,
+		interval: opt.Interval,
+		taint:    opt.Taint,
+		check:    opt.Check,
+
+		threshold: opt.FailureThreshold,
+	}, nil
+}
+
+// Run reports the health of snapshotter every interval until ctx is done.
+func (r *Reporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.report(ctx); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to report node status of %s", r.nodeName)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Drain marks the snapshotter unavailable before shutting down, the node
+// is reported available again by the next run after the snapshotter
+// recovers. It's no-op if the reporter is nil.
+func (r *Reporter) Drain(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	r.draining = true
+	r.mu.Unlock()
+	return r.report(ctx)
+}
+
+func (r *Reporter) report(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, reason, message := "False", ReasonHealthy, "nydus snapshotter is healthy"
+	if r.draining {
+		status, reason, message = "True", ReasonDraining, "nydus snapshotter is shutting down"
+	} else if err := r.check(ctx); err != nil {
+		if r.failures++; r.failures < r.threshold {
+			log.G(ctx).WithError(err).Warnf("nydus snapshotter health check failed %d times", r.failures)
+			return nil
+		}
+		status, reason, message = "True", ReasonUnhealthy, err.Error()
+	} else {
+		r.failures = 0
+	}
+
+	for conflicts := 0; ; conflicts++ {
+		n, err := r.client.getNode(ctx, r.nodeName)
+		if err != nil {
+			return errors.Wrap(err, "failed to get node")
+		}
+		if err := r.updateCondition(ctx, n, status, reason, message); err != nil {
+			return errors.Wrap(err, "failed to update node condition")
+		}
+		err = r.updateTaint(ctx, n, status == "True" && r.taint)
+		if err == kubeclient.ErrConflict && conflicts < maxConflicts {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to update node taint")
+		}
+		return nil
+	}
+}
+
+func (r *Reporter) updateCondition(ctx context.Context, n *node, status, reason, message string) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	condition := Condition{
+		Type:               ConditionType,
+		Status:             status,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             reason,
+		Message:            message,
+	}
+	for _, c := range n.Status.Conditions {
+		if c.Type == ConditionType && c.Status == status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+	}
+	if status == "True" {
+		log.G(ctx).Warnf("reporting nydus snapshotter unavailable on node %s: %s", r.nodeName, message)
+	}
+	return r.client.patchCondition(ctx, r.nodeName, condition)
+}
+
+// updateTaint adds or removes the taint of snapshotter, the stale taint is
+// removed even if tainting is disabled.
+func (r *Reporter) updateTaint(ctx context.Context, n *node, tainted bool) error {
+	taints := []Taint{}
+	found := false
+	for _, t := range n.Spec.Taints {
+		if t.Key == TaintKey {
+			found = true
+			if !tainted {
+				continue
+			}
+		}
+		taints = append(taints, t)
+	}
+	if found == tainted {
+		return nil
+	}
+	if tainted {
+		now := time.Now().UTC().Truncate(time.Second)
+		taints = append(taints, Taint{Key: TaintKey, Effect: taintEffect, TimeAdded: &now})
+		log.G(ctx).Infof("tainting node %s with %s", r.nodeName, TaintKey)
+	} else {
+		log.G(ctx).Infof("removing taint %s from node %s", TaintKey, r.nodeName)
+	}
+	return r.client.patchTaints(ctx, r.nodeName, n.Metadata.ResourceVersion, taints)
+}
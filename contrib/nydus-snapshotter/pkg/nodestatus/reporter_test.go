@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package nodestatus
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/kubeclient"
+)
+
+// fakeAPIServer serves the node object, the conditions are merged by type
+// and the taints are replaced with resource version checked.
+type fakeAPIServer struct {
+	mu        sync.Mutex
+	node      node
+	version   int
+	conflicts int
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/nodes/node1":
+		s.node.Metadata.ResourceVersion = string(rune('0' + s.version))
+		json.NewEncoder(w).Encode(s.node)
+	case r.Method == http.MethodPatch && r.URL.Path == "/api/v1/nodes/node1/status":
+		var patch node
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &patch)
+		for _, condition := range patch.Status.Conditions {
+			merged := false
+			for idx := range s.node.Status.Conditions {
+				if s.node.Status.Conditions[idx].Type == condition.Type {
+					s.node.Status.Conditions[idx] = condition
+					merged = true
+				}
+			}
+			if !merged {
+				s.node.Status.Conditions = append(s.node.Status.Conditions, condition)
+			}
+		}
+	case r.Method == http.MethodPatch && r.URL.Path == "/api/v1/nodes/node1":
+		var patch node
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &patch)
+		if s.conflicts > 0 {
+			s.conflicts--
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if patch.Metadata.ResourceVersion != string(rune('0'+s.version)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.node.Spec.Taints = patch.Spec.Taints
+		s.version++
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeAPIServer) condition() Condition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, condition := range s.node.Status.Conditions {
+		if condition.Type == ConditionType {
+			return condition
+		}
+	}
+	return Condition{}
+}
+
+func (s *fakeAPIServer) tainted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, taint := range s.node.Spec.Taints {
+		if taint.Key == TaintKey {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReporter(t *testing.T) {
+	apiServer := &fakeAPIServer{}
+	apiServer.node.Spec.Taints = []Taint{{Key: "other", Effect: "NoExecute"}}
+	apiServer.node.Status.Conditions = []Condition{{Type: "Ready", Status: "True"}}
+	server := httptest.NewServer(apiServer)
+	defer server.Close()
+
+	var checkErr error
+	reporter, err := newReporter(&client{kubeclient.New(server.URL, server.Client())}, Opt{
+		NodeName: "node1",
+		Taint:    true,
+		Check: func(ctx context.Context) error {
+			return checkErr
+		},
+	})
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	require.Nil(t, reporter.report(ctx))
+	assert.Equal(t, "False", apiServer.condition().Status)
+	assert.Equal(t, ReasonHealthy, apiServer.condition().Reason)
+	assert.False(t, apiServer.tainted())
+	assert.Len(t, apiServer.node.Status.Conditions, 2)
+
+	// The single failure is tolerated
+	checkErr = errors.New("nydusd is not responding")
+	require.Nil(t, reporter.report(ctx))
+	assert.Equal(t, "False", apiServer.condition().Status)
+
+	require.Nil(t, reporter.report(ctx))
+	assert.Equal(t, "True", apiServer.condition().Status)
+	assert.Equal(t, ReasonUnhealthy, apiServer.condition().Reason)
+	assert.Equal(t, "nydusd is not responding", apiServer.condition().Message)
+	assert.True(t, apiServer.tainted())
+	assert.Len(t, apiServer.node.Spec.Taints, 2)
+
+	// Recovered
+	checkErr = nil
+	require.Nil(t, reporter.report(ctx))
+	assert.Equal(t, "False", apiServer.condition().Status)
+	assert.False(t, apiServer.tainted())
+	assert.Equal(t, []Taint{{Key: "other", Effect: "NoExecute"}}, apiServer.node.Spec.Taints)
+
+	// The conflicted taint update is retried
+	apiServer.conflicts = 2
+	require.Nil(t, reporter.Drain(ctx))
+	assert.Equal(t, "True", apiServer.condition().Status)
+	assert.Equal(t, ReasonDraining, apiServer.condition().Reason)
+	assert.True(t, apiServer.tainted())
+
+	// Draining isn't overridden by the healthy check
+	require.Nil(t, reporter.report(ctx))
+	assert.Equal(t, ReasonDraining, apiServer.condition().Reason)
+}
+
+func TestStaleTaint(t *testing.T) {
+	apiServer := &fakeAPIServer{}
+	apiServer.node.Spec.Taints = []Taint{{Key: TaintKey, Effect: taintEffect}}
+	server := httptest.NewServer(apiServer)
+	defer server.Close()
+
+	// The taint left by previous run is removed even if tainting is disabled
+	reporter, err := newReporter(&client{kubeclient.New(server.URL, server.Client())}, Opt{
+		NodeName: "node1",
+		Check: func(ctx context.Context) error {
+			return nil
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, reporter.report(context.Background()))
+	assert.False(t, apiServer.tainted())
+
+	_, err = newReporter(&client{}, Opt{Check: reporter.check})
+	assert.NotNil(t, err)
+
+	var nilReporter *Reporter
+	assert.Nil(t, nilReporter.Drain(context.Background()))
+}
@@ -36,16 +36,23 @@ const (
 type Interface interface {
 	CheckStatus() (model.DaemonInfo, error)
 	SharedMount(sharedMountPoint, bootstrap, daemonConfig string) error
+	Remount(mountPoint, bootstrap, daemonConfig string) error
 	Umount(sharedMountPoint string) error
 	GetFsMetric(sharedDaemon bool, sid string) (*model.FsMetric, error)
+	GetBlobcacheMetric() (*model.BlobcacheMetric, error)
+	GetBackendMetric(sharedDaemon bool, sid string) (*model.BackendMetric, error)
 }
 
 type NydusClient struct {
 	httpClient *http.Client
 }
 
-func NewNydusClient(sock string) (Interface, error) {
-	transport, err := buildTransport(sock)
+func NewNydusClient(sock string, opts ...ClientOpt) (Interface, error) {
+	var opt clientOpt
+	for _, o := range opts {
+		o(&opt)
+	}
+	transport, err := buildTransport(sock, opt)
 	if err != nil {
 		return nil, err
 	}
@@ -120,8 +127,61 @@ func (c *NydusClient) GetFsMetric(sharedDaemon bool, sid string) (*model.FsMetri
 	return &m, nil
 }
 
+// GetBlobcacheMetric returns the metric of blob cache, it's only available
+// on the dedicated nydusd whose only instance uses blob cache.
+func (c *NydusClient) GetBlobcacheMetric() (*model.BlobcacheMetric, error) {
+	resp, err := c.httpClient.Get(fmt.Sprintf("http://unix%s/blobcache", metricEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, handleMountError(resp.Body)
+	}
+
+	var m model.BlobcacheMetric
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetBackendMetric returns the metric of storage backend, the backend of
+// the instance sid is specified in shared daemon.
+func (c *NydusClient) GetBackendMetric(sharedDaemon bool, sid string) (*model.BackendMetric, error) {
+	getStatURL := fmt.Sprintf("http://unix%s/backend", metricEndpoint)
+	if sharedDaemon {
+		getStatURL = fmt.Sprintf("http://unix%s/backend?id=/%s/fs", metricEndpoint, sid)
+	}
+	resp, err := c.httpClient.Get(getStatURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, handleMountError(resp.Body)
+	}
+
+	var m model.BackendMetric
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
 func (c *NydusClient) SharedMount(sharedMountPoint, bootstrap, daemonConfig string) error {
-	requestURL := fmt.Sprintf("http://unix%s?mountpoint=%s", mountEndpoint, sharedMountPoint)
+	return c.mount(http.MethodPost, sharedMountPoint, bootstrap, daemonConfig)
+}
+
+// Remount replaces the bootstrap and config of the mounted instance, the
+// storage backend and cache of instance are recreated by the new config
+// without interrupting the opened files.
+func (c *NydusClient) Remount(mountPoint, bootstrap, daemonConfig string) error {
+	return c.mount(http.MethodPut, mountPoint, bootstrap, daemonConfig)
+}
+
+func (c *NydusClient) mount(method, mountPoint, bootstrap, daemonConfig string) error {
+	requestURL := fmt.Sprintf("http://unix%s?mountpoint=%s", mountEndpoint, mountPoint)
 	content, err := ioutil.ReadFile(daemonConfig)
 	if err != nil {
 		return errors.Wrapf(err, "failed to get content of daemon config %s", daemonConfig)
@@ -130,7 +190,12 @@ func (c *NydusClient) SharedMount(sharedMountPoint, bootstrap, daemonConfig stri
 	if err != nil {
 		return errors.Wrap(err, "failed to create mount request")
 	}
-	resp, err := c.httpClient.Post(requestURL, contentType, bytes.NewBuffer(body))
+	req, err := http.NewRequest(method, requestURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -153,7 +218,7 @@ func waitUntilSocketReady(sock string) error {
 		retry.Delay(100*time.Millisecond))
 }
 
-func buildTransport(sock string) (http.RoundTripper, error) {
+func buildTransport(sock string, opt clientOpt) (http.RoundTripper, error) {
 	err := waitUntilSocketReady(sock)
 	if err != nil {
 		return nil, err
@@ -168,7 +233,15 @@ func buildTransport(sock string) (http.RoundTripper, error) {
 				Timeout:   5 * time.Second,
 				KeepAlive: 5 * time.Second,
 			}
-			return dialer.DialContext(ctx, "unix", sock)
+			conn, err := dialer.DialContext(ctx, "unix", sock)
+			if err != nil {
+				return nil, err
+			}
+			if err := verifyPeer(conn, sock, opt); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
 		},
 	}, nil
 }
@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -65,3 +66,32 @@ func TestNydusClient_CheckStatus(t *testing.T) {
 	assert.Equal(t, "testid", info.ID)
 	assert.Equal(t, BTI, info.Version)
 }
+
+func TestNydusClient_PeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only verified on linux")
+	}
+	sock, dispose := prepareNydusServer(t)
+	defer dispose()
+
+	// The mock server is served by the test process
+	client, err := NewNydusClient(sock, WithPeerPid(os.Getpid()))
+	require.Nil(t, err)
+	_, err = client.CheckStatus()
+	require.Nil(t, err)
+
+	client, err = NewNydusClient(sock, WithPeerPid(os.Getpid()+1))
+	require.Nil(t, err)
+	_, err = client.CheckStatus()
+	assert.NotNil(t, err)
+
+	client, err = NewNydusClient(sock, WithServerUIDs([]uint32{uint32(os.Geteuid()) + 1}))
+	require.Nil(t, err)
+	_, err = client.CheckStatus()
+	assert.NotNil(t, err)
+
+	client, err = NewNydusClient(sock, WithServerUIDs([]uint32{uint32(os.Geteuid()) + 1, uint32(os.Geteuid())}))
+	require.Nil(t, err)
+	_, err = client.CheckStatus()
+	assert.Nil(t, err)
+}
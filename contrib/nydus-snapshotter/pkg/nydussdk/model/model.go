@@ -54,3 +54,26 @@ type FsMetric struct {
 	NrMaxOpens                uint64   `json:"nr_max_opens"`
 	LastFopTp                 uint64   `json:"last_fop_tp"`
 }
+
+// BlobcacheMetric is the metric of blob cache, the prefetch workers exit
+// once the prefetch of nydusd is done.
+type BlobcacheMetric struct {
+	StorePath          string `json:"store_path"`
+	PartialHits        uint64 `json:"partial_hits"`
+	WholeHits          uint64 `json:"whole_hits"`
+	Total              uint64 `json:"total"`
+	EntriesCount       uint64 `json:"entries_count"`
+	PrefetchDataAmount uint64 `json:"prefetch_data_amount"`
+	PrefetchWorkers    uint64 `json:"prefetch_workers"`
+	PrefetchTotalSize  uint64 `json:"prefetch_total_size"`
+	PrefetchMrCount    uint64 `json:"prefetch_mr_count"`
+}
+
+// BackendMetric is the metric of storage backend, the counters are reset
+// when the backend is recreated by remount.
+type BackendMetric struct {
+	BackendType     string `json:"backend_type"`
+	ReadCount       uint64 `json:"read_count"`
+	ReadErrors      uint64 `json:"read_errors"`
+	ReadAmountTotal uint64 `json:"read_amount_total"`
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package nydussdk
+
+import (
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// errPeerCredUnsupported is returned if the peer credentials of unix socket
+// can't be read on the platform, the peer isn't verified then.
+var errPeerCredUnsupported = errors.New("peer credentials are not supported")
+
+// ClientOpt is the option of nydusd client.
+type ClientOpt func(*clientOpt)
+
+type clientOpt struct {
+	pid        int
+	serverUIDs []uint32
+}
+
+// WithPeerPid requires the API socket to be served by the nydusd of pid,
+// it's ignored if pid isn't positive, e.g. the pid of daemon is unknown.
+func WithPeerPid(pid int) ClientOpt {
+	return func(o *clientOpt) {
+		o.pid = pid
+	}
+}
+
+// WithServerUIDs requires the API socket to be served by a process of one
+// of uids, so that a process replacing the socket can't receive the
+// requests of snapshotter, e.g. the daemon configs carrying registry
+// credentials. The UID of snapshotter is required if uids is empty.
+//
+// It verifies the server rather than the clients of the socket. The clients
+// aren't authorized by UID, which is out of scope of the snapshotter, since
+// nydusd doesn't check the peer credentials of its clients.
+func WithServerUIDs(uids []uint32) ClientOpt {
+	return func(o *clientOpt) {
+		o.serverUIDs = append([]uint32(nil), uids...)
+	}
+}
+
+// verifyPeer checks the credentials of the process serving the socket by
+// SO_PEERCRED.
+func verifyPeer(conn net.Conn, sock string, opt clientOpt) error {
+	uid, peerPid, err := peerCred(conn)
+	if err == errPeerCredUnsupported {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get peer credentials of %s", sock)
+	}
+	if opt.pid > 0 && peerPid != opt.pid {
+		return errors.Errorf("api socket %s is served by pid %d rather than nydusd %d", sock, peerPid, opt.pid)
+	}
+
+	serverUIDs := opt.serverUIDs
+	if len(serverUIDs) == 0 {
+		serverUIDs = []uint32{uint32(os.Geteuid())}
+	}
+	for _, allowed := range serverUIDs {
+		if uid == allowed {
+			return nil
+		}
+	}
+	return errors.Errorf("api socket %s is served by uid %d, which is not allowed", sock, uid)
+}
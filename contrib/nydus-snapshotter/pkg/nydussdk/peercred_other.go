@@ -0,0 +1,15 @@
+// +build !linux
+
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package nydussdk
+
+import "net"
+
+func peerCred(conn net.Conn) (uint32, int, error) {
+	return 0, 0, errPeerCredUnsupported
+}
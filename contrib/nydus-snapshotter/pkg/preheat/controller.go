@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package preheat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/kubeclient"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+)
+
+const (
+	// ImagePrePullPath is the API path of the cluster scoped ImagePrePull
+	// custom resources, whose status subresource is reported by each node.
+	ImagePrePullPath = "/apis/nydus.remote/v1alpha1/imageprepulls"
+
+	defaultControllerSync = 30 * time.Second
+)
+
+// ImagePrePull asks the nodes selected by node selector to preheat the
+// images, each node reports its progress to status by node name.
+type ImagePrePull struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Images []string `json:"images"`
+		// NodeSelector selects the nodes by labels, all nodes are selected
+		// if it's empty.
+		NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Nodes map[string]NodeStatus `json:"nodes,omitempty"`
+	} `json:"status"`
+}
+
+// NodeStatus is the preheat status of ImagePrePull on a node.
+type NodeStatus struct {
+	Phase              string    `json:"phase"`
+	ObservedGeneration int64     `json:"observedGeneration"`
+	TaskID             string    `json:"taskID,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastUpdateTime     time.Time `json:"lastUpdateTime"`
+}
+
+type imagePrePullList struct {
+	Items []ImagePrePull `json:"items"`
+}
+
+type nodeObject struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+}
+
+// Controller watches the ImagePrePull resources by polling, and preheats
+// the images of the ones selecting the node.
+type Controller struct {
+	client    *kubeclient.Client
+	preheater *Preheater
+	nodeName  string
+	interval  time.Duration
+	// tasks are the preheat tasks of ImagePrePull by name, the task of
+	// an older generation is replaced.
+	tasks map[string]trackedTask
+}
+
+type trackedTask struct {
+	generation int64
+	id         string
+}
+
+// NewController creates a controller with the service account mounted in
+// pod, the resources are synced every interval, defaults to 30s.
+func NewController(preheater *Preheater, nodeName string, interval time.Duration) (*Controller, error) {
+	c, err := kubeclient.NewInCluster()
+	if err != nil {
+		return nil, err
+	}
+	return newController(c, preheater, nodeName, interval)
+}
+
+func newController(c *kubeclient.Client, preheater *Preheater, nodeName string, interval time.Duration) (*Controller, error) {
+	if nodeName == "" {
+		return nil, errors.New("node name is required")
+	}
+	if interval <= 0 {
+		interval = defaultControllerSync
+	}
+	return &Controller{
+		client:    c,
+		preheater: preheater,
+		nodeName:  nodeName,
+		interval:  interval,
+		tasks:     make(map[string]trackedTask),
+	}, nil
+}
+
+// Run syncs the ImagePrePull resources every interval until ctx is done.
+func (c *Controller) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		if err := c.sync(ctx); err != nil {
+			logging.Preheat.L().WithError(err).Warn("failed to sync ImagePrePull resources")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func selected(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Controller) sync(ctx context.Context) error {
+	var n nodeObject
+	if err := c.client.Do(ctx, http.MethodGet, "/api/v1/nodes/"+c.nodeName, "", nil, &n); err != nil {
+		return errors.Wrap(err, "failed to get node")
+	}
+	var list imagePrePullList
+	if err := c.client.Do(ctx, http.MethodGet, ImagePrePullPath, "", nil, &list); err != nil {
+		return errors.Wrap(err, "failed to list ImagePrePull")
+	}
+
+	present := map[string]struct{}{}
+	for _, item := range list.Items {
+		if !selected(item.Spec.NodeSelector, n.Metadata.Labels) {
+			continue
+		}
+		present[item.Metadata.Name] = struct{}{}
+		if err := c.syncOne(ctx, &item); err != nil {
+			logging.Preheat.L().WithError(err).Warnf("failed to sync ImagePrePull %s", item.Metadata.Name)
+		}
+	}
+	for name := range c.tasks {
+		if _, ok := present[name]; !ok {
+			delete(c.tasks, name)
+		}
+	}
+	return nil
+}
+
+func (c *Controller) syncOne(ctx context.Context, item *ImagePrePull) error {
+	name, generation := item.Metadata.Name, item.Metadata.Generation
+	reported := item.Status.Nodes[c.nodeName]
+	finished := reported.Phase == PhaseSucceeded || reported.Phase == PhaseFailed
+	if reported.ObservedGeneration == generation && finished {
+		return nil
+	}
+
+	status := NodeStatus{ObservedGeneration: generation}
+	var task *Task
+	if tracked, ok := c.tasks[name]; ok && tracked.generation == generation {
+		// The task is nil if it's pruned, then the images are preheated again
+		task, _ = c.preheater.Get(tracked.id)
+	}
+	if task == nil {
+		var err error
+		if task, err = c.preheater.Submit(item.Spec.Images); err != nil {
+			status.Phase = PhaseFailed
+			status.Message = err.Error()
+			return c.patchStatus(ctx, name, status)
+		}
+		c.tasks[name] = trackedTask{generation: generation, id: task.ID}
+	}
+
+	status.Phase = task.Phase
+	status.TaskID = task.ID
+	status.Message = taskMessage(task)
+	if status.Phase == reported.Phase && status.TaskID == reported.TaskID &&
+		status.Message == reported.Message && reported.ObservedGeneration == generation {
+		return nil
+	}
+	return c.patchStatus(ctx, name, status)
+}
+
+// taskMessage summarizes the images of task.
+func taskMessage(task *Task) string {
+	var done int
+	var failures []string
+	for _, image := range task.Images {
+		switch image.Phase {
+		case PhaseSucceeded:
+			done++
+		case PhaseFailed:
+			failures = append(failures, fmt.Sprintf("%s: %s", image.Image, image.Message))
+		}
+	}
+	message := fmt.Sprintf("%d/%d images preheated", done, len(task.Images))
+	if len(failures) > 0 {
+		message += ", failed: " + strings.Join(failures, "; ")
+	}
+	return message
+}
+
+func (c *Controller) patchStatus(ctx context.Context, name string, status NodeStatus) error {
+	status.LastUpdateTime = time.Now().UTC().Truncate(time.Second)
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"nodes": map[string]NodeStatus{c.nodeName: status},
+		},
+	}
+	logging.Preheat.L().Infof("reporting ImagePrePull %s on node %s: %s", name, c.nodeName, status.Phase)
+	return c.client.Do(ctx, http.MethodPatch, ImagePrePullPath+"/"+name+"/status", kubeclient.MergePatchType, patch, nil)
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package preheat
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/kubeclient"
+)
+
+// fakeAPIServer serves the node and ImagePrePull resources, the node
+// statuses of resources are merged by node name.
+type fakeAPIServer struct {
+	mu     sync.Mutex
+	labels map[string]string
+	items  []ImagePrePull
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/nodes/node1":
+		var n nodeObject
+		n.Metadata.Labels = s.labels
+		json.NewEncoder(w).Encode(n)
+	case r.Method == http.MethodGet && r.URL.Path == ImagePrePullPath:
+		json.NewEncoder(w).Encode(imagePrePullList{Items: s.items})
+	case r.Method == http.MethodPatch && strings.HasSuffix(r.URL.Path, "/status"):
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, ImagePrePullPath+"/"), "/status")
+		var patch ImagePrePull
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &patch)
+		for idx := range s.items {
+			if s.items[idx].Metadata.Name != name {
+				continue
+			}
+			if s.items[idx].Status.Nodes == nil {
+				s.items[idx].Status.Nodes = map[string]NodeStatus{}
+			}
+			for node, status := range patch.Status.Nodes {
+				s.items[idx].Status.Nodes[node] = status
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeAPIServer) add(name string, generation int64, images []string, selector map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var item ImagePrePull
+	item.Metadata.Name = name
+	item.Metadata.Generation = generation
+	item.Spec.Images = images
+	item.Spec.NodeSelector = selector
+	for idx := range s.items {
+		if s.items[idx].Metadata.Name == name {
+			item.Status = s.items[idx].Status
+			s.items[idx] = item
+			return
+		}
+	}
+	s.items = append(s.items, item)
+}
+
+func (s *fakeAPIServer) status(name string) (NodeStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range s.items {
+		if item.Metadata.Name == name {
+			status, ok := item.Status.Nodes["node1"]
+			return status, ok
+		}
+	}
+	return NodeStatus{}, false
+}
+
+func TestController(t *testing.T) {
+	server := &fakeAPIServer{labels: map[string]string{"pool": "web"}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	p := newFakePreheater(t)
+	c, err := newController(kubeclient.New(ts.URL, ts.Client()), p, "node1", time.Second)
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	server.add("web", 1, []string{"nginx"}, map[string]string{"pool": "web"})
+	server.add("db", 1, []string{"mysql"}, map[string]string{"pool": "db"})
+	require.Nil(t, c.sync(ctx))
+	status, ok := server.status("web")
+	require.True(t, ok)
+	assert.Equal(t, int64(1), status.ObservedGeneration)
+	assert.NotEmpty(t, status.TaskID)
+	// Not selected
+	_, ok = server.status("db")
+	assert.False(t, ok)
+
+	waitTask(t, p, status.TaskID)
+	require.Nil(t, c.sync(ctx))
+	status, _ = server.status("web")
+	assert.Equal(t, PhaseSucceeded, status.Phase)
+	assert.Equal(t, "1/1 images preheated", status.Message)
+
+	// The finished generation isn't preheated again
+	require.Nil(t, c.sync(ctx))
+	assert.Len(t, p.List(), 1)
+
+	// The new generation is preheated
+	server.add("web", 2, []string{"nginx", "broken"}, map[string]string{"pool": "web"})
+	require.Nil(t, c.sync(ctx))
+	status, _ = server.status("web")
+	assert.Equal(t, int64(2), status.ObservedGeneration)
+	waitTask(t, p, status.TaskID)
+	require.Nil(t, c.sync(ctx))
+	status, _ = server.status("web")
+	assert.Equal(t, PhaseFailed, status.Phase)
+	assert.Contains(t, status.Message, "docker.io/library/broken:latest: not a nydus image")
+}
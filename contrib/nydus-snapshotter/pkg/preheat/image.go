@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package preheat
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/nydussdk"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/utils/mount"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	daemonStateRunning = "RUNNING"
+	pollInterval       = time.Second
+)
+
+// preheatImage pulls the bootstrap of image, and starts a nydusd prefetching
+// all the files of image into blob cache, i.e. with the root directory as
+// prefetch file. The prefetch workers of nydusd exit once all the files are
+// prefetched, then nydusd is stopped.
+func (p *Preheater) preheatImage(ctx context.Context, image string, progress func(uint64)) error {
+	if err := os.MkdirAll(p.RootDir, 0700); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(p.RootDir, "image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	blobs, err := p.pullBootstrap(ctx, image, filepath.Join(dir, "image.boot"))
+	if err != nil {
+		return err
+	}
+	if p.CacheManager != nil {
+		if err := p.CacheManager.AddSnapshot(image, blobs); err != nil {
+			return errors.Wrapf(err, "failed to add blob caches of image %s", image)
+		}
+	}
+
+	cfg, err := p.DaemonConfig(image)
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate nydusd config of image %s", image)
+	}
+	if cfg.Device.Cache.CacheType == "" {
+		return errors.New("blob cache is disabled in nydusd config")
+	}
+	cfg.FSPrefetch.Enable = true
+	if err := config.SaveConfig(cfg, filepath.Join(dir, "config.json")); err != nil {
+		return errors.Wrap(err, "failed to save nydusd config")
+	}
+
+	return p.prefetch(ctx, dir, progress)
+}
+
+// pullBootstrap pulls the bootstrap of image to target, and returns the
+// blob IDs of image.
+func (p *Preheater) pullBootstrap(ctx context.Context, image, target string) ([]string, error) {
+	remote, err := provider.DefaultRemote(image, p.Insecure)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create remote of image %s", image)
+	}
+	imageParser := parser.New(remote)
+	parsed, err := imageParser.Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse image %s", image)
+	}
+	if parsed.NydusImage == nil {
+		return nil, fmt.Errorf("image %s is not a nydus image", image)
+	}
+
+	reader, err := imageParser.PullNydusBootstrap(ctx, parsed.NydusImage)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to pull bootstrap of image %s", image)
+	}
+	defer reader.Close()
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, target); err != nil {
+		return nil, errors.Wrapf(err, "failed to unpack bootstrap of image %s", image)
+	}
+
+	var blobs []string
+	for _, layer := range parsed.NydusImage.Manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBlob] == "true" {
+			blobs = append(blobs, layer.Digest.Hex())
+		}
+	}
+	return blobs, nil
+}
+
+// prefetch runs nydusd with the bootstrap and config in dir until all the
+// files are prefetched.
+func (p *Preheater) prefetch(ctx context.Context, dir string, progress func(uint64)) (retErr error) {
+	mountPoint := filepath.Join(dir, "mnt")
+	if err := os.MkdirAll(mountPoint, 0700); err != nil {
+		return err
+	}
+	apiSock := filepath.Join(dir, "api.sock")
+	logFile := filepath.Join(p.RootDir, filepath.Base(dir)+".log")
+
+	cmd := exec.Command(p.NydusdPath,
+		"--config", filepath.Join(dir, "config.json"),
+		"--bootstrap", filepath.Join(dir, "image.boot"),
+		"--mountpoint", mountPoint,
+		"--apisock", apiSock,
+		"--log-level", "info",
+		"--log-file", logFile,
+		"--prefetch-files", "/",
+	)
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed to start nydusd")
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+		close(exited)
+	}()
+	defer func() {
+		select {
+		case <-exited:
+		default:
+			if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+				logging.Preheat.L().WithError(err).Warnf("failed to stop nydusd %d", cmd.Process.Pid)
+			}
+			<-exited
+		}
+		mounter := mount.Mounter{}
+		if err := mounter.Umount(mountPoint); err != nil && err != syscall.EINVAL {
+			logging.Preheat.L().WithError(err).Warnf("failed to umount %s", mountPoint)
+		}
+		// The log is kept for troubleshooting if prefetch failed
+		if retErr == nil {
+			os.Remove(logFile)
+		}
+	}()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	var client nydussdk.Interface
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "prefetch is not finished")
+		case err := <-exited:
+			return errors.Errorf("nydusd exited unexpectedly: %v, see log %s", err, logFile)
+		case <-ticker.C:
+		}
+
+		if client == nil {
+			c, err := nydussdk.NewNydusClient(apiSock, nydussdk.WithPeerPid(cmd.Process.Pid))
+			if err != nil {
+				continue
+			}
+			client = c
+		}
+		// The prefetch workers are started before nydusd is running
+		info, err := client.CheckStatus()
+		if err != nil || info.State != daemonStateRunning {
+			continue
+		}
+		m, err := client.GetBlobcacheMetric()
+		if err != nil {
+			return errors.Wrap(err, "failed to get blob cache metric")
+		}
+		progress(m.PrefetchDataAmount)
+		if m.PrefetchWorkers == 0 {
+			return nil
+		}
+	}
+}
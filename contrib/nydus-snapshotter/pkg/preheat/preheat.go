@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package preheat fetches the blob data of nydus images into the blob cache
+// of node before the images are pulled, so that the containers started on
+// the node later don't fetch the data from registry lazily. Each image is
+// preheated by a transient nydusd which prefetches all the files of image.
+package preheat
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/cache"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+)
+
+// The phases of task and image.
+const (
+	PhasePending   = "Pending"
+	PhaseRunning   = "Running"
+	PhaseSucceeded = "Succeeded"
+	PhaseFailed    = "Failed"
+)
+
+const (
+	defaultTimeout     = 30 * time.Minute
+	defaultConcurrency = 1
+	// maxFinishedTasks is the number of finished tasks kept in memory.
+	maxFinishedTasks = 100
+)
+
+// ErrNotFound is returned if the task doesn't exist.
+var ErrNotFound = errors.New("preheat task not found")
+
+// ImageStatus is the preheat status of an image.
+type ImageStatus struct {
+	Image   string `json:"image"`
+	Phase   string `json:"phase"`
+	Message string `json:"message,omitempty"`
+	// PrefetchedSize is the size of blob data fetched into blob cache.
+	PrefetchedSize uint64     `json:"prefetched_size"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+// Task preheats a list of images, it's succeeded if all the images are
+// preheated.
+type Task struct {
+	ID         string        `json:"id"`
+	Phase      string        `json:"phase"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	Images     []ImageStatus `json:"images"`
+}
+
+type Opt struct {
+	// RootDir holds the bootstraps, configs and mountpoints of the nydusd
+	// preheating images, they are removed once the image is preheated.
+	RootDir    string
+	NydusdPath string
+	Insecure   bool
+	// DaemonConfig generates the nydusd config of image, the blob cache
+	// of it should be the one used by snapshotter.
+	DaemonConfig func(image string) (config.DaemonConfig, error)
+	// CacheManager tracks the blob caches of preheated images for GC,
+	// it's optional.
+	CacheManager *cache.Manager
+	// Timeout is the timeout of preheating an image, defaults to 30m.
+	Timeout time.Duration
+	// Concurrency is the number of images preheated at the same time,
+	// defaults to 1 to bound the resource usage on node.
+	Concurrency int
+}
+
+// Preheater runs the preheat tasks in background.
+type Preheater struct {
+	Opt
+	ctx context.Context
+	// preheat preheats an image and reports the prefetched size,
+	// replaced in tests.
+	preheat func(ctx context.Context, image string, progress func(uint64)) error
+	sem     chan struct{}
+
+	mu    sync.Mutex
+	tasks map[string]*Task
+}
+
+// New creates a preheater, the running tasks are cancelled when ctx is done.
+func New(ctx context.Context, opt Opt) (*Preheater, error) {
+	if opt.RootDir == "" {
+		return nil, errors.New("root dir is required")
+	}
+	if opt.NydusdPath == "" {
+		return nil, errors.New("nydusd binary path is required")
+	}
+	if opt.DaemonConfig == nil {
+		return nil, errors.New("daemon config generator is required")
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultTimeout
+	}
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = defaultConcurrency
+	}
+	p := &Preheater{
+		Opt:   opt,
+		ctx:   ctx,
+		sem:   make(chan struct{}, opt.Concurrency),
+		tasks: make(map[string]*Task),
+	}
+	p.preheat = p.preheatImage
+	return p, nil
+}
+
+func newTaskID() string {
+	id := uuid.New()
+	b := [16]byte(id)
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// Submit creates a task preheating the images in background, the images
+// are normalized and deduplicated.
+func (p *Preheater) Submit(images []string) (*Task, error) {
+	if len(images) == 0 {
+		return nil, errors.New("no image to preheat")
+	}
+	task := &Task{
+		ID:        newTaskID(),
+		Phase:     PhasePending,
+		CreatedAt: time.Now().UTC(),
+	}
+	seen := map[string]struct{}{}
+	for _, image := range images {
+		named, err := docker.ParseDockerRef(image)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid image reference %s", image)
+		}
+		ref := named.String()
+		if _, ok := seen[ref]; ok {
+			continue
+		}
+		seen[ref] = struct{}{}
+		task.Images = append(task.Images, ImageStatus{Image: ref, Phase: PhasePending})
+	}
+
+	p.mu.Lock()
+	p.tasks[task.ID] = task
+	p.pruneTasks()
+	copied := copyTask(task)
+	p.mu.Unlock()
+
+	logging.Preheat.L().Infof("submitted preheat task %s of images %v", task.ID, images)
+	go p.run(task)
+
+	return copied, nil
+}
+
+// Get returns the snapshot of task.
+func (p *Preheater) Get(id string) (*Task, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	task, ok := p.tasks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyTask(task), nil
+}
+
+// List returns the snapshots of tasks ordered by creation time.
+func (p *Preheater) List() []Task {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tasks := make([]Task, 0, len(p.tasks))
+	for _, task := range p.tasks {
+		tasks = append(tasks, *copyTask(task))
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].CreatedAt.Before(tasks[j].CreatedAt)
+	})
+	return tasks
+}
+
+// pruneTasks removes the oldest finished tasks beyond maxFinishedTasks,
+// it's called with lock held.
+func (p *Preheater) pruneTasks() {
+	var finished []*Task
+	for _, task := range p.tasks {
+		if task.FinishedAt != nil {
+			finished = append(finished, task)
+		}
+	}
+	if len(finished) <= maxFinishedTasks {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.Before(*finished[j].FinishedAt)
+	})
+	for _, task := range finished[:len(finished)-maxFinishedTasks] {
+		delete(p.tasks, task.ID)
+	}
+}
+
+func copyTask(task *Task) *Task {
+	copied := *task
+	copied.Images = append([]ImageStatus(nil), task.Images...)
+	return &copied
+}
+
+func (p *Preheater) update(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn()
+}
+
+func (p *Preheater) run(task *Task) {
+	p.update(func() { task.Phase = PhaseRunning })
+
+	phase := PhaseSucceeded
+	for idx := range task.Images {
+		if err := p.runImage(task, idx); err != nil {
+			phase = PhaseFailed
+		}
+	}
+
+	now := time.Now().UTC()
+	p.update(func() {
+		task.Phase = phase
+		task.FinishedAt = &now
+	})
+	logging.Preheat.L().Infof("preheat task %s finished: %s", task.ID, phase)
+}
+
+func (p *Preheater) runImage(task *Task, idx int) error {
+	status := &task.Images[idx]
+
+	select {
+	case p.sem <- struct{}{}:
+		defer func() { <-p.sem }()
+	case <-p.ctx.Done():
+		err := p.ctx.Err()
+		p.update(func() {
+			status.Phase = PhaseFailed
+			status.Message = err.Error()
+		})
+		return err
+	}
+
+	start := time.Now().UTC()
+	p.update(func() {
+		status.Phase = PhaseRunning
+		status.StartedAt = &start
+	})
+
+	ctx, cancel := context.WithTimeout(p.ctx, p.Timeout)
+	defer cancel()
+	err := p.preheat(ctx, status.Image, func(size uint64) {
+		p.update(func() { status.PrefetchedSize = size })
+	})
+
+	end := time.Now().UTC()
+	p.update(func() {
+		status.FinishedAt = &end
+		if err != nil {
+			status.Phase = PhaseFailed
+			status.Message = err.Error()
+		} else {
+			status.Phase = PhaseSucceeded
+		}
+	})
+	if err != nil {
+		logging.Preheat.L().WithError(err).Errorf("failed to preheat image %s", status.Image)
+		return err
+	}
+	logging.Preheat.L().Infof("preheated image %s in %s", status.Image, end.Sub(start))
+	return nil
+}
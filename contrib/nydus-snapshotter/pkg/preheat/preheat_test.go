@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package preheat
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+)
+
+// newFakePreheater creates a preheater preheating the images containing
+// "broken" with failure.
+func newFakePreheater(t *testing.T) *Preheater {
+	p, err := New(context.Background(), Opt{
+		RootDir:    t.Name(),
+		NydusdPath: "/bin/nydusd",
+		DaemonConfig: func(image string) (config.DaemonConfig, error) {
+			return config.DaemonConfig{}, nil
+		},
+	})
+	require.Nil(t, err)
+	p.preheat = func(ctx context.Context, image string, progress func(uint64)) error {
+		progress(1024)
+		if strings.Contains(image, "broken") {
+			return errors.New("not a nydus image")
+		}
+		return nil
+	}
+	return p
+}
+
+func waitTask(t *testing.T, p *Preheater, id string) *Task {
+	for i := 0; i < 100; i++ {
+		task, err := p.Get(id)
+		require.Nil(t, err)
+		if task.FinishedAt != nil {
+			return task
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("preheat task %s is not finished", id)
+	return nil
+}
+
+func TestPreheater(t *testing.T) {
+	p := newFakePreheater(t)
+
+	_, err := p.Submit(nil)
+	assert.NotNil(t, err)
+	_, err = p.Submit([]string{"INVALID"})
+	assert.NotNil(t, err)
+
+	task, err := p.Submit([]string{"busybox:latest", "docker.io/library/busybox:latest", "nginx"})
+	require.Nil(t, err)
+	require.Len(t, task.Images, 2)
+	assert.Equal(t, "docker.io/library/busybox:latest", task.Images[0].Image)
+	assert.Equal(t, "docker.io/library/nginx:latest", task.Images[1].Image)
+
+	task = waitTask(t, p, task.ID)
+	assert.Equal(t, PhaseSucceeded, task.Phase)
+	for _, image := range task.Images {
+		assert.Equal(t, PhaseSucceeded, image.Phase)
+		assert.Equal(t, uint64(1024), image.PrefetchedSize)
+		assert.NotNil(t, image.FinishedAt)
+	}
+
+	// The task fails if any image fails
+	failed, err := p.Submit([]string{"nginx", "broken"})
+	require.Nil(t, err)
+	failed = waitTask(t, p, failed.ID)
+	assert.Equal(t, PhaseFailed, failed.Phase)
+	assert.Equal(t, PhaseSucceeded, failed.Images[0].Phase)
+	assert.Equal(t, PhaseFailed, failed.Images[1].Phase)
+	assert.Equal(t, "not a nydus image", failed.Images[1].Message)
+
+	tasks := p.List()
+	require.Len(t, tasks, 2)
+	assert.Equal(t, task.ID, tasks[0].ID)
+	assert.Equal(t, failed.ID, tasks[1].ID)
+
+	_, err = p.Get("unknown")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestPruneTasks(t *testing.T) {
+	p := newFakePreheater(t)
+	for i := 0; i < maxFinishedTasks+2; i++ {
+		task, err := p.Submit([]string{"nginx"})
+		require.Nil(t, err)
+		waitTask(t, p, task.ID)
+	}
+	// The finished tasks are pruned when submitting
+	assert.Len(t, p.List(), maxFinishedTasks+1)
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package process
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/metric/exporter"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/nydussdk/model"
+)
+
+// The config of instance in degraded mode, saved beside the normal config.
+const degradedConfigFileName = "degraded.json"
+
+const (
+	defaultDegradedInterval       = 10 * time.Second
+	defaultDegradedErrorThreshold = 3
+	defaultDegradedBackendTimeout = 2 * time.Second
+)
+
+type DegradedOpt struct {
+	// Interval is the period of checking the backend metrics, defaults
+	// to 10s.
+	Interval time.Duration
+	// ErrorThreshold is the number of backend read errors within an
+	// interval to switch the instance to degraded mode, defaults to 3.
+	ErrorThreshold uint64
+	// RetryLimit is the retry limit of backend reads in degraded mode.
+	RetryLimit int
+	// BackendTimeout is the timeout of backend reads in degraded mode,
+	// defaults to 2s, rounded up to seconds.
+	BackendTimeout time.Duration
+}
+
+func (opt *DegradedOpt) validate() error {
+	if opt.Interval == 0 {
+		opt.Interval = defaultDegradedInterval
+	}
+	if opt.ErrorThreshold == 0 {
+		opt.ErrorThreshold = defaultDegradedErrorThreshold
+	}
+	if opt.BackendTimeout == 0 {
+		opt.BackendTimeout = defaultDegradedBackendTimeout
+	}
+	if opt.RetryLimit < 0 {
+		return errors.Errorf("invalid retry limit %d", opt.RetryLimit)
+	}
+	return nil
+}
+
+// DegradedStatus is the degraded status of the instance serving an image.
+type DegradedStatus struct {
+	Degraded bool
+	// Since is the time of switching to degraded mode.
+	Since time.Time
+}
+
+// backendState is the last seen backend metric of an instance.
+type backendState struct {
+	imageID    string
+	readCount  uint64
+	readErrors uint64
+	degraded   bool
+	since      time.Time
+}
+
+// degradation tracks the backend states of instances by daemon ID.
+type degradation struct {
+	opt    DegradedOpt
+	mu     sync.Mutex
+	states map[string]*backendState
+}
+
+// WatchBackend checks the backend metrics of instances periodically until
+// ctx is done. The instance whose backend keeps failing, e.g. registry is
+// unreachable, is switched to degraded mode, where the chunks in blob cache
+// are still served while the reads of uncached ranges fail fast with EIO
+// after RetryLimit retries, instead of blocking the whole mount on backend
+// timeouts. The instance is switched back once the backend reads succeed
+// again.
+func (m *Manager) WatchBackend(ctx context.Context, opt DegradedOpt) error {
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	m.degradation = &degradation{
+		opt:    opt,
+		states: make(map[string]*backendState),
+	}
+
+	go func() {
+		ticker := time.NewTicker(opt.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.checkBackends()
+			}
+		}
+	}()
+	return nil
+}
+
+// DegradedStatus returns the degraded status of daemon, it's never degraded
+// if degraded mode isn't enabled.
+func (m *Manager) DegradedStatus(id string) DegradedStatus {
+	dg := m.degradation
+	if dg == nil {
+		return DegradedStatus{}
+	}
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+	if state, ok := dg.states[id]; ok && state.degraded {
+		return DegradedStatus{Degraded: true, Since: state.since}
+	}
+	return DegradedStatus{}
+}
+
+func (m *Manager) checkBackends() {
+	alive := make(map[string]bool)
+	for _, d := range m.ListDaemons() {
+		// The shared daemon serves no image itself
+		if d.ID == daemon.SharedNydusDaemonID {
+			continue
+		}
+		alive[d.ID] = true
+		metric, err := d.GetBackendMetric()
+		if err != nil {
+			logging.Manager.L().WithField("daemon", d.ID).WithError(err).Debug("failed to get backend metric")
+			continue
+		}
+		switch m.degradation.update(d, metric) {
+		case transitionDegrade:
+			m.degrade(d)
+		case transitionRecover:
+			m.recover(d)
+		}
+	}
+
+	dg := m.degradation
+	dg.mu.Lock()
+	for id, state := range dg.states {
+		if !alive[id] {
+			if state.degraded {
+				exporter.ImageDegraded.DeleteLabelValues(state.imageID)
+			}
+			delete(dg.states, id)
+		}
+	}
+	dg.mu.Unlock()
+}
+
+type transition int
+
+const (
+	transitionNone transition = iota
+	transitionDegrade
+	transitionRecover
+)
+
+// update records the backend metric of daemon, and returns the transition
+// to take by the read errors and successes since the last check.
+func (dg *degradation) update(d *daemon.Daemon, metric *model.BackendMetric) transition {
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+	state, ok := dg.states[d.ID]
+	if !ok {
+		state = &backendState{
+			imageID:    d.ImageID,
+			readCount:  metric.ReadCount,
+			readErrors: metric.ReadErrors,
+		}
+		// The instance is left in degraded mode if snapshotter restarted
+		// before switching it back
+		if info, err := os.Stat(filepath.Join(d.ConfigDir, degradedConfigFileName)); err == nil {
+			state.degraded = true
+			state.since = info.ModTime()
+			exporter.ImageDegraded.WithLabelValues(d.ImageID).Set(1)
+		}
+		dg.states[d.ID] = state
+		return transitionNone
+	}
+
+	// The counters are reset when the backend is recreated by remount
+	if metric.ReadCount < state.readCount || metric.ReadErrors < state.readErrors {
+		state.readCount, state.readErrors = 0, 0
+	}
+	reads := metric.ReadCount - state.readCount
+	readErrors := metric.ReadErrors - state.readErrors
+	state.readCount, state.readErrors = metric.ReadCount, metric.ReadErrors
+
+	if !state.degraded && readErrors >= dg.opt.ErrorThreshold {
+		return transitionDegrade
+	}
+	if state.degraded && reads > 0 && readErrors == 0 {
+		return transitionRecover
+	}
+	return transitionNone
+}
+
+func (dg *degradation) setDegraded(id string, degraded bool) {
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+	if state, ok := dg.states[id]; ok {
+		state.degraded = degraded
+		state.since = time.Now()
+		// The counters of the recreated backend start from zero
+		state.readCount, state.readErrors = 0, 0
+	}
+}
+
+// degradedConfig generates the config of degraded mode from the config of
+// daemon, the backend reads fail fast and prefetch is disabled, since it
+// only adds failing reads to the unreachable backend.
+func (dg *degradation) degradedConfig(d *daemon.Daemon) (string, error) {
+	var cfg config.DaemonConfig
+	if err := config.LoadConfig(d.ConfigFile(), &cfg); err != nil {
+		return "", err
+	}
+	if cfg.Device.Cache.CacheType == "" {
+		return "", errors.New("blob cache is disabled, nothing could be served in degraded mode")
+	}
+	timeout := int((dg.opt.BackendTimeout + time.Second - 1) / time.Second)
+	cfg.Device.Backend.Config.RetryLimit = dg.opt.RetryLimit
+	cfg.Device.Backend.Config.Timeout = timeout
+	cfg.Device.Backend.Config.ConnectTimeout = timeout
+	cfg.FSPrefetch.Enable = false
+
+	configFile := filepath.Join(d.ConfigDir, degradedConfigFileName)
+	if err := config.SaveConfig(cfg, configFile); err != nil {
+		return "", err
+	}
+	return configFile, nil
+}
+
+func (m *Manager) degrade(d *daemon.Daemon) {
+	dg := m.degradation
+	configFile, err := dg.degradedConfig(d)
+	if err == nil {
+		err = d.Remount(configFile)
+	}
+	if err != nil {
+		logging.Manager.L().WithField("daemon", d.ID).WithError(err).Errorf("failed to switch image %s to degraded mode", d.ImageID)
+		return
+	}
+	dg.setDegraded(d.ID, true)
+	exporter.ImageDegraded.WithLabelValues(d.ImageID).Set(1)
+	logging.Manager.L().WithField("daemon", d.ID).Warnf("backend of image %s is failing, switched to degraded mode", d.ImageID)
+}
+
+func (m *Manager) recover(d *daemon.Daemon) {
+	dg := m.degradation
+	if err := d.Remount(d.ConfigFile()); err != nil {
+		logging.Manager.L().WithField("daemon", d.ID).WithError(err).Errorf("failed to switch image %s back from degraded mode", d.ImageID)
+		return
+	}
+	dg.setDegraded(d.ID, false)
+	exporter.ImageDegraded.DeleteLabelValues(d.ImageID)
+	if err := os.Remove(filepath.Join(d.ConfigDir, degradedConfigFileName)); err != nil && !os.IsNotExist(err) {
+		logging.Manager.L().WithField("daemon", d.ID).WithError(err).Warn("failed to remove degraded config")
+	}
+	logging.Manager.L().WithField("daemon", d.ID).Infof("backend of image %s is recovered, switched back from degraded mode", d.ImageID)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package process
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/nydussdk/model"
+)
+
+// fakeBackend serves the backend metric of nydusd, and records the config
+// of remount, the counters are reset on remount like nydusd.
+type fakeBackend struct {
+	mu     sync.Mutex
+	metric model.BackendMetric
+	config config.DaemonConfig
+	mounts int
+}
+
+func (b *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/metrics/backend":
+		json.NewEncoder(w).Encode(b.metric)
+	case r.Method == http.MethodPut && r.URL.Path == "/api/v1/mount":
+		var req model.MountRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.Unmarshal([]byte(req.Config), &b.config)
+		b.metric = model.BackendMetric{}
+		b.mounts++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (b *fakeBackend) read(count, errors uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.metric.ReadCount += count
+	b.metric.ReadErrors += errors
+}
+
+func TestDegradedMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-degraded-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", sock)
+	require.Nil(t, err)
+	defer listener.Close()
+	backend := &fakeBackend{}
+	go http.Serve(listener, backend)
+
+	d, err := daemon.NewDaemon(
+		daemon.WithSnapshotID("1"),
+		daemon.WithSnapshotDir(dir),
+		daemon.WithConfigDir(filepath.Join(dir, "config")),
+		daemon.WithAPISock(sock),
+		daemon.WithImageID("docker.io/library/busybox:latest"),
+	)
+	require.Nil(t, err)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "1", "fs", "image"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "1", "fs", "image", "image.boot"), nil, 0644))
+	var cfg config.DaemonConfig
+	cfg.Device.Backend.BackendType = "registry"
+	cfg.Device.Backend.Config.RetryLimit = 5
+	cfg.Device.Cache.CacheType = "blobcache"
+	cfg.FSPrefetch.Enable = true
+	require.Nil(t, config.SaveConfig(cfg, d.ConfigFile()))
+
+	opt := DegradedOpt{ErrorThreshold: 2, RetryLimit: 1, BackendTimeout: 1500 * time.Millisecond}
+	require.Nil(t, opt.validate())
+	m := &Manager{degradation: &degradation{opt: opt, states: make(map[string]*backendState)}}
+	check := func() {
+		metric, err := d.GetBackendMetric()
+		require.Nil(t, err)
+		switch m.degradation.update(d, metric) {
+		case transitionDegrade:
+			m.degrade(d)
+		case transitionRecover:
+			m.recover(d)
+		}
+	}
+
+	// The errors below threshold are tolerated
+	check()
+	backend.read(10, 1)
+	check()
+	assert.False(t, m.DegradedStatus(d.ID).Degraded)
+
+	backend.read(3, 3)
+	check()
+	assert.True(t, m.DegradedStatus(d.ID).Degraded)
+	assert.Equal(t, 1, backend.mounts)
+	assert.Equal(t, 1, backend.config.Device.Backend.Config.RetryLimit)
+	assert.Equal(t, 2, backend.config.Device.Backend.Config.Timeout)
+	assert.False(t, backend.config.FSPrefetch.Enable)
+	assert.Equal(t, "blobcache", backend.config.Device.Cache.CacheType)
+
+	// Still failing in degraded mode
+	backend.read(2, 2)
+	check()
+	assert.True(t, m.DegradedStatus(d.ID).Degraded)
+
+	// The state is restored from the degraded config
+	m.degradation.states = make(map[string]*backendState)
+	check()
+	assert.True(t, m.DegradedStatus(d.ID).Degraded)
+
+	// Switched back once the backend reads succeed
+	backend.read(4, 0)
+	check()
+	assert.False(t, m.DegradedStatus(d.ID).Degraded)
+	assert.Equal(t, 2, backend.mounts)
+	assert.Equal(t, 5, backend.config.Device.Backend.Config.RetryLimit)
+	assert.True(t, backend.config.FSPrefetch.Enable)
+	_, err = os.Stat(filepath.Join(d.ConfigDir, degradedConfigFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NotNil(t, (&DegradedOpt{RetryLimit: -1}).validate())
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package process
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/metric/exporter"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/utils/retry"
+)
+
+// The actions taken on nydusd failing the liveness probes
+const (
+	// LivenessActionNone only reports the failures by log and metrics.
+	LivenessActionNone = "none"
+	// LivenessActionRestart kills nydusd, detaches its mountpoint and starts
+	// it again, so that the subsequent containers can be mounted. The
+	// running containers on the detached mountpoint aren't recovered.
+	LivenessActionRestart = "restart"
+)
+
+// The probes of nydusd, used as the label of failure metrics
+const (
+	probeAPI  = "api"
+	probeFUSE = "fuse"
+)
+
+const (
+	defaultProbeInterval    = 10 * time.Second
+	defaultProbeTimeout     = 5 * time.Second
+	defaultFailureThreshold = 3
+)
+
+type LivenessOpt struct {
+	// Interval is the period of probing, defaults to 10s.
+	Interval time.Duration
+	// Timeout is the timeout of each probe, defaults to 5s.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failed probes before
+	// taking the action, defaults to 3.
+	FailureThreshold int
+	// Action is LivenessActionNone or LivenessActionRestart.
+	Action string
+}
+
+func (opt *LivenessOpt) validate() error {
+	if opt.Interval == 0 {
+		opt.Interval = defaultProbeInterval
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = defaultProbeTimeout
+	}
+	if opt.FailureThreshold == 0 {
+		opt.FailureThreshold = defaultFailureThreshold
+	}
+	if opt.Action == "" {
+		opt.Action = LivenessActionNone
+	}
+	if opt.Action != LivenessActionNone && opt.Action != LivenessActionRestart {
+		return errors.Errorf("unknown liveness action %s", opt.Action)
+	}
+	return nil
+}
+
+// prober tracks the consecutive failures and the hanging probes of
+// daemons, a probe blocked on a wedged daemon is never started again until
+// it returns, so that the goroutines don't pile up.
+type prober struct {
+	opt      LivenessOpt
+	mu       sync.Mutex
+	failures map[string]int
+	hanging  map[string]bool
+}
+
+// Probe checks the liveness of nydusd daemons periodically until ctx is
+// done. A daemon is alive if its API responds in time with running state,
+// and its FUSE mountpoint can be stat-ed in time, which detects the daemons
+// wedged but not exited. The action is taken on the daemon failing the
+// probes FailureThreshold times consecutively.
+func (m *Manager) Probe(ctx context.Context, opt LivenessOpt) error {
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	p := &prober{
+		opt:      opt,
+		failures: make(map[string]int),
+		hanging:  make(map[string]bool),
+	}
+
+	go func() {
+		ticker := time.NewTicker(opt.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.probeDaemons(p)
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *Manager) probeDaemons(p *prober) {
+	alive := make(map[string]bool)
+	for _, d := range m.ListDaemons() {
+		// The virtual daemons in shared mode are served by the shared daemon
+		if m.IsSharedDaemon() && d.ID != daemon.SharedNydusDaemonID {
+			continue
+		}
+		alive[d.ID] = true
+		if !p.check(d) {
+			continue
+		}
+		logging.Manager.L().WithField("daemon", d.ID).Warnf("nydusd failed %d liveness probes, action %s", p.opt.FailureThreshold, p.opt.Action)
+		if p.opt.Action != LivenessActionRestart {
+			continue
+		}
+		result := "success"
+		if err := m.restartDaemon(d); err != nil {
+			logging.Manager.L().WithField("daemon", d.ID).WithError(err).Errorf("failed to restart nydusd")
+			result = "failure"
+		} else {
+			logging.Manager.L().WithField("daemon", d.ID).Infof("restarted nydusd")
+		}
+		exporter.DaemonRecoveries.WithLabelValues(d.ID, result).Inc()
+	}
+
+	// Forget the destroyed daemons
+	p.mu.Lock()
+	for id := range p.failures {
+		if !alive[id] {
+			delete(p.failures, id)
+		}
+	}
+	p.mu.Unlock()
+}
+
+// check probes the daemon, it returns true if the daemon reaches the
+// failure threshold, the failures are reset then.
+func (p *prober) check(d *daemon.Daemon) bool {
+	probe, err := p.probe(d)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		delete(p.failures, d.ID)
+		return false
+	}
+
+	exporter.DaemonProbeFailures.WithLabelValues(d.ID, probe).Inc()
+	p.failures[d.ID]++
+	logging.Manager.L().WithField("daemon", d.ID).WithError(err).Warnf("liveness probe %s failed (%d/%d)", probe, p.failures[d.ID], p.opt.FailureThreshold)
+	if p.failures[d.ID] < p.opt.FailureThreshold {
+		return false
+	}
+	delete(p.failures, d.ID)
+	return true
+}
+
+func (p *prober) probe(d *daemon.Daemon) (string, error) {
+	if err := p.run(d.ID+"/"+probeAPI, func() error {
+		info, err := d.CheckStatus()
+		if err != nil {
+			return err
+		}
+		if info.State != daemonStateRunning {
+			return errors.Errorf("nydusd is in state %s", info.State)
+		}
+		return nil
+	}); err != nil {
+		return probeAPI, err
+	}
+
+	if err := p.run(d.ID+"/"+probeFUSE, func() error {
+		_, err := os.Stat(daemonMountPoint(d))
+		return err
+	}); err != nil {
+		return probeFUSE, err
+	}
+	return "", nil
+}
+
+// run runs the probe with timeout, the probe still hanging from previous
+// round fails immediately.
+func (p *prober) run(key string, probe func() error) error {
+	p.mu.Lock()
+	if p.hanging[key] {
+		p.mu.Unlock()
+		return errors.New("previous probe is still hanging")
+	}
+	p.hanging[key] = true
+	p.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := probe()
+		p.mu.Lock()
+		delete(p.hanging, key)
+		p.mu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(p.opt.Timeout):
+		return errors.Errorf("probe timed out after %s", p.opt.Timeout)
+	}
+}
+
+// daemonMountPoint returns the FUSE mountpoint of daemon on host, all the
+// virtual daemons are mounted under the root mountpoint of shared daemon.
+func daemonMountPoint(d *daemon.Daemon) string {
+	if d.RootMountPoint != nil {
+		return *d.RootMountPoint
+	}
+	return d.MountPoint()
+}
+
+// restartDaemon kills the daemon, detaches its mountpoint without
+// accessing it, and starts the daemon again with the same config. The
+// virtual daemons are mounted again if it's the shared daemon.
+func (m *Manager) restartDaemon(d *daemon.Daemon) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.store.Get(d.ID); err != nil {
+		// The daemon has been destroyed meanwhile
+		return nil
+	}
+	// The pid of daemon reconnected after snapshotter restarts is unknown
+	if d.Pid <= 0 {
+		return errors.New("unknown pid of nydusd")
+	}
+
+	p, err := os.FindProcess(d.Pid)
+	if err != nil {
+		return err
+	}
+	// The daemon may have exited already
+	if err := p.Signal(syscall.SIGKILL); err != nil {
+		logging.Manager.L().WithField("daemon", d.ID).WithError(err).Warnf("failed to kill nydusd %d", d.Pid)
+	}
+	// Reap the process without waiting, it may stay in kernel for a while
+	// until the FUSE connection is aborted
+	go func() {
+		_, _ = p.Wait()
+	}()
+
+	mountPoint := daemonMountPoint(d)
+	if err := m.mounter.LazyUmount(mountPoint); err != nil {
+		return errors.Wrapf(err, "failed to detach mountpoint %s", mountPoint)
+	}
+	if err := os.Remove(d.APISock()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove api socket %s", d.APISock())
+	}
+	if err := m.StartDaemon(d); err != nil {
+		return errors.Wrap(err, "failed to start nydusd")
+	}
+	if err := retry.Do(func() error {
+		info, err := d.CheckStatus()
+		if err != nil {
+			return err
+		}
+		if info.State != daemonStateRunning {
+			return errors.Errorf("nydusd is in state %s", info.State)
+		}
+		return nil
+	},
+		retry.Attempts(20),
+		retry.LastErrorOnly(true),
+		retry.Delay(100*time.Millisecond),
+	); err != nil {
+		return errors.Wrap(err, "failed to wait nydusd")
+	}
+
+	if d.ID != daemon.SharedNydusDaemonID {
+		return nil
+	}
+	for _, vd := range m.store.List() {
+		if vd.ID == daemon.SharedNydusDaemonID {
+			continue
+		}
+		if err := vd.SharedMount(); err != nil {
+			logging.Manager.L().WithField("daemon", vd.ID).WithError(err).Errorf("failed to mount again on restarted shared daemon")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2021. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package process
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+)
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-liveness-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", sock)
+	require.Nil(t, err)
+	defer listener.Close()
+
+	// 0: running, 1: initializing, 2: hanging
+	var mode int32
+	release := make(chan struct{})
+	defer close(release)
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.LoadInt32(&mode) {
+		case 0:
+			w.Write([]byte(`{"id":"test","state":"RUNNING"}`))
+		case 1:
+			w.Write([]byte(`{"id":"test","state":"INIT"}`))
+		default:
+			<-release
+		}
+	}))
+
+	d, err := daemon.NewDaemon(
+		daemon.WithSnapshotID("1"),
+		daemon.WithSnapshotDir(dir),
+		daemon.WithAPISock(sock),
+	)
+	require.Nil(t, err)
+	require.Nil(t, os.MkdirAll(d.MountPoint(), 0755))
+
+	opt := LivenessOpt{Timeout: 200 * time.Millisecond, FailureThreshold: 2}
+	require.Nil(t, opt.validate())
+	p := &prober{
+		opt:      opt,
+		failures: make(map[string]int),
+		hanging:  make(map[string]bool),
+	}
+
+	assert.False(t, p.check(d))
+	assert.Empty(t, p.failures)
+
+	// The action is taken on consecutive failures only
+	atomic.StoreInt32(&mode, 1)
+	assert.False(t, p.check(d))
+	atomic.StoreInt32(&mode, 0)
+	assert.False(t, p.check(d))
+	atomic.StoreInt32(&mode, 1)
+	assert.False(t, p.check(d))
+	assert.True(t, p.check(d))
+	assert.Empty(t, p.failures)
+
+	// The wedged daemon times out, and the hanging probe isn't started again
+	atomic.StoreInt32(&mode, 2)
+	probe, err := p.probe(d)
+	assert.Equal(t, probeAPI, probe)
+	assert.Contains(t, err.Error(), "timed out")
+	start := time.Now()
+	_, err = p.probe(d)
+	assert.Contains(t, err.Error(), "still hanging")
+	assert.True(t, time.Since(start) < opt.Timeout)
+
+	// The FUSE mountpoint is probed after the API
+	atomic.StoreInt32(&mode, 0)
+	release <- struct{}{}
+	require.Nil(t, os.RemoveAll(d.MountPoint()))
+	assert.Eventually(t, func() bool {
+		probe, err = p.probe(d)
+		return probe == probeFUSE
+	}, time.Second, 50*time.Millisecond)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NotNil(t, (&LivenessOpt{Action: "reboot"}).validate())
+}
@@ -11,33 +11,47 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"sync"
 	"syscall"
 
-	"github.com/containerd/containerd/log"
 	"github.com/pkg/errors"
 
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/errdefs"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/store"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/utils/mount"
 )
 
 type configGenerator = func(*daemon.Daemon) error
 
+// The state of nydusd serving requests, reported by its API
+const daemonStateRunning = "RUNNING"
+
+const defaultFuseThreads = 10
+
 type Manager struct {
 	store            Store
 	nydusdBinaryPath string
 	DaemonMode       string
 	mounter          mount.Interface
+	serverUIDs       []uint32
 	mu               sync.Mutex
+	// degradation is set if degraded mode is enabled, see WatchBackend
+	degradation *degradation
+	// draining rejects new daemons, see SetDraining
+	draining bool
 }
 
 type Opt struct {
 	NydusdBinaryPath string
 	Database         *store.Database
 	DaemonMode       string
+	// ServerUIDs are the UIDs nydusd is allowed to run as, the API socket
+	// of daemon is verified by peer credentials, see Daemon.ServerUIDs.
+	ServerUIDs []uint32
 }
 
 func NewManager(opt Opt) (*Manager, error) {
@@ -45,8 +59,8 @@ func NewManager(opt Opt) (*Manager, error) {
 	if err != nil {
 		return nil, err
 	}
-
 	return &Manager{
+		serverUIDs:       opt.ServerUIDs,
 		store:            s,
 		mounter:          &mount.Mounter{},
 		nydusdBinaryPath: opt.NydusdBinaryPath,
@@ -57,13 +71,33 @@ func NewManager(opt Opt) (*Manager, error) {
 func (m *Manager) NewDaemon(daemon *daemon.Daemon) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.draining {
+		return errdefs.ErrDraining
+	}
 	d, err := m.store.GetBySnapshot(daemon.SnapshotID)
 	if err == nil && d != nil {
 		return errdefs.ErrAlreadyExists
 	}
+	daemon.ServerUIDs = m.serverUIDs
 	return m.store.Add(daemon)
 }
 
+// SetDraining starts or stops draining, no nydusd instance is created for
+// new images while draining, so that the node could be maintained once the
+// running containers are moved away, the running instances keep serving.
+func (m *Manager) SetDraining(draining bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draining = draining
+}
+
+// IsDraining returns true if snapshotter is draining.
+func (m *Manager) IsDraining() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.draining
+}
+
 func (m *Manager) DeleteBySnapshotID(id string) (*daemon.Daemon, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -101,7 +135,7 @@ func (m *Manager) CleanUpDaemonResource(d *daemon.Daemon) {
 	}
 	for _, dir := range resource {
 		if err := os.RemoveAll(dir); err != nil {
-			log.L.Errorf("failed to remove dir %s err %v", dir, err)
+			logging.Manager.L().Errorf("failed to remove dir %s err %v", dir, err)
 		}
 	}
 }
@@ -127,11 +161,15 @@ func (m *Manager) StartDaemon(d *daemon.Daemon) error {
 }
 
 func (m *Manager) buildStartCommand(d *daemon.Daemon) (*exec.Cmd, error) {
+	threads := defaultFuseThreads
+	if d.FuseThreads > 0 {
+		threads = d.FuseThreads
+	}
 	args := []string{
 		"--apisock", d.APISock(),
 		"--log-level", "info",
 		"--log-file", d.LogFile(),
-		"--thread-num", "10",
+		"--thread-num", strconv.Itoa(threads),
 	}
 	if d.IsMultipleDaemon() {
 		bootstrap, err := d.BootstrapFile()
@@ -168,7 +206,7 @@ func (m *Manager) DestroyBySnapshotID(id string) error {
 func (m *Manager) DestroyDaemon(d *daemon.Daemon) error {
 	m.store.Delete(d)
 	m.CleanUpDaemonResource(d)
-	log.L.Infof("umount remote snapshot, mountpoint %s", d.MountPoint())
+	logging.Manager.L().Infof("umount remote snapshot, mountpoint %s", d.MountPoint())
 	// if daemon is shared mount, we should only umount the daemon with api instead of
 	// umount entire mountpoint
 	if d.IsSharedDaemon() {
@@ -200,6 +238,25 @@ func (m *Manager) IsSharedDaemon() bool {
 	return m.DaemonMode == config.DaemonModeShared || m.DaemonMode == config.DaemonModeSingle
 }
 
+// CheckHealth checks that all the nydusd daemons managed by snapshotter are
+// running, the virtual daemons in shared mode are served by the shared
+// daemon and aren't checked.
+func (m *Manager) CheckHealth() error {
+	for _, d := range m.ListDaemons() {
+		if m.IsSharedDaemon() && d.ID != daemon.SharedNydusDaemonID {
+			continue
+		}
+		info, err := d.CheckStatus()
+		if err != nil {
+			return errors.Wrapf(err, "nydusd %s is not responding", d.ID)
+		}
+		if info.State != daemonStateRunning {
+			return errors.Errorf("nydusd %s is in state %s", d.ID, info.State)
+		}
+	}
+	return nil
+}
+
 // Reconnect already running daemons，and rebuild daemons management structs.
 func (m *Manager) Reconnect(ctx context.Context) error {
 	var (
@@ -208,23 +265,24 @@ func (m *Manager) Reconnect(ctx context.Context) error {
 	)
 
 	if err := m.store.WalkDaemons(ctx, func(d *daemon.Daemon) error {
-		log.L.WithField("daemon", d.ID).
+		d.ServerUIDs = m.serverUIDs
+		logging.Manager.L().WithField("daemon", d.ID).
 			WithField("shared", d.IsSharedDaemon()).
 			Info("found daemon in database")
 
 		// Do not check status on virtual daemons
 		if m.IsSharedDaemon() && d.ID != daemon.SharedNydusDaemonID {
 			daemons = append(daemons, d)
-			log.L.WithField("daemon", d.ID).Infof("found virtual daemon")
+			logging.Manager.L().WithField("daemon", d.ID).Infof("found virtual daemon")
 			return nil
 		}
 
 		_, err := d.CheckStatus()
 		if err != nil {
-			log.L.WithField("daemon", d.ID).Warnf("failed to check daemon status")
+			logging.Manager.L().WithField("daemon", d.ID).Warnf("failed to check daemon status")
 			return nil
 		}
-		log.L.WithField("daemon", d.ID).Infof("found alive daemon")
+		logging.Manager.L().WithField("daemon", d.ID).Infof("found alive daemon")
 		daemons = append(daemons, d)
 
 		// Get the global shared daemon here after CheckStatus() by attention
@@ -243,18 +301,26 @@ func (m *Manager) Reconnect(ctx context.Context) error {
 	}
 
 	if m.IsSharedDaemon() && sharedDaemon == nil && len(daemons) > 0 {
-		log.L.Warnf("SharedDaemon enabled, but cannot find alive shared daemon")
+		logging.Manager.L().Warnf("SharedDaemon enabled, but cannot find alive shared daemon")
 		// Clear daemon list to skip adding them into daemon store
 		daemons = nil
 	}
 
 	// cleanup database so that we'll have a clean database for this snapshotter process lifetime
-	log.L.Infof("found %d daemons running", len(daemons))
+	logging.Manager.L().Infof("found %d daemons running", len(daemons))
 	if err := m.store.CleanupDaemons(ctx); err != nil {
 		return errors.Wrapf(err, "failed to cleanup database")
 	}
 
 	for _, d := range daemons {
+		// The configs written by older releases are rewritten to the current
+		// version, so that they keep working when the daemon remounts
+		migrated, err := config.MigrateConfig(d.ConfigFile())
+		if err != nil {
+			logging.Manager.L().WithField("daemon", d.ID).WithError(err).Warnf("failed to migrate config")
+		} else if migrated {
+			logging.Manager.L().WithField("daemon", d.ID).Infof("migrated config to version %d", config.ConfigVersion)
+		}
 		if err := m.NewDaemon(d); err != nil {
 			return errors.Wrapf(err, "failed to add daemon(%s) to daemon store", d.ID)
 		}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,6 +20,25 @@ type Snapshot struct {
 	CreateAt time.Time
 	UpdateAt time.Time
 }
+
+// Pin protects the blob caches of an image from GC, the image is
+// identified by the digest or reference of image.
+type Pin struct {
+	Image string
+	Blobs []string
+	// Static is true if the pin comes from configuration rather than
+	// the management API, it's removed once dropped from configuration.
+	Static   bool
+	CreateAt time.Time
+	UpdateAt time.Time
+}
+
+// Match returns true if the image reference is pinned, the reference
+// matches the pin by itself or by the digest in it.
+func (pin *Pin) Match(imageRef string) bool {
+	return imageRef == pin.Image || strings.HasSuffix(imageRef, "@"+pin.Image)
+}
+
 type CacheStore struct {
 	sync.Mutex
 	*Database
@@ -41,6 +61,17 @@ func (cs *CacheStore) AddSnapshot(imageID string, blobs []string) error {
 	if err := cs.Database.addSnapshot(imageID, ss); err != nil {
 		return err
 	}
+	// Record blobs of pinned image to keep them even after the
+	// snapshot is removed
+	if pin, err := cs.getPin(imageID); err != nil {
+		return err
+	} else if pin != nil {
+		pin.Blobs = mergeBlobs(pin.Blobs, blobs)
+		pin.UpdateAt = time.Now()
+		if err := cs.Database.putPin(pin); err != nil {
+			return err
+		}
+	}
 	for _, id := range blobs {
 		blob := &Blob{
 			CreateAt: time.Now(),
@@ -90,3 +121,162 @@ func (cs *CacheStore) GC(delFunc func(blob string) error) ([]string, error) {
 	}
 	return delBlobs, nil
 }
+
+func mergeBlobs(blobs, added []string) []string {
+	seen := make(map[string]struct{}, len(blobs))
+	for _, blob := range blobs {
+		seen[blob] = struct{}{}
+	}
+	for _, blob := range added {
+		if _, ok := seen[blob]; !ok {
+			seen[blob] = struct{}{}
+			blobs = append(blobs, blob)
+		}
+	}
+	return blobs
+}
+
+func (cs *CacheStore) getPin(imageRef string) (*Pin, error) {
+	var found *Pin
+	if err := cs.Database.walkPins(func(pin *Pin) error {
+		if pin.Match(imageRef) {
+			found = pin
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Pin protects blob caches of the image from GC, the blobs of image are
+// recorded when the image is mounted.
+func (cs *CacheStore) Pin(image string) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	pins, err := cs.listPins()
+	if err != nil {
+		return err
+	}
+	for _, pin := range pins {
+		if pin.Image == image {
+			return nil
+		}
+	}
+
+	return cs.addPin(image, false)
+}
+
+// ReconcilePins makes the static pins consistent with images from
+// configuration, the images not pinned yet are pinned, and the static
+// pins of the images no longer in configuration are removed. The pins
+// added by the management API are kept.
+func (cs *CacheStore) ReconcilePins(images []string) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	pins, err := cs.listPins()
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]struct{}, len(images))
+	for _, image := range images {
+		wanted[image] = struct{}{}
+	}
+	pinned := make(map[string]struct{}, len(pins))
+	for _, pin := range pins {
+		pinned[pin.Image] = struct{}{}
+		if _, ok := wanted[pin.Image]; !ok && pin.Static {
+			if err := cs.Database.delPin(pin.Image); err != nil {
+				return errors.Wrapf(err, "failed to unpin image %s", pin.Image)
+			}
+		}
+	}
+	for image := range wanted {
+		if _, ok := pinned[image]; ok {
+			continue
+		}
+		if err := cs.addPin(image, true); err != nil {
+			return errors.Wrapf(err, "failed to pin image %s", image)
+		}
+	}
+
+	return nil
+}
+
+func (cs *CacheStore) addPin(image string, static bool) error {
+	pin := &Pin{
+		Image:    image,
+		Static:   static,
+		CreateAt: time.Now(),
+		UpdateAt: time.Now(),
+	}
+	// The image may be in use already
+	if err := cs.Database.walkSnapshots(func(imageID string, snapshot *Snapshot) error {
+		if pin.Match(imageID) {
+			pin.Blobs = mergeBlobs(pin.Blobs, snapshot.Blobs)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return cs.Database.putPin(pin)
+}
+
+// Unpin removes the pin of image, its blob caches will be removed by
+// next GC if no snapshot uses them.
+func (cs *CacheStore) Unpin(image string) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	return cs.Database.delPin(image)
+}
+
+// IsPinned returns true if the image reference matches any pin.
+func (cs *CacheStore) IsPinned(imageRef string) (bool, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	pin, err := cs.getPin(imageRef)
+	if err != nil {
+		return false, err
+	}
+	return pin != nil, nil
+}
+
+// ListPins returns all pinned images.
+func (cs *CacheStore) ListPins() ([]Pin, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	return cs.listPins()
+}
+
+func (cs *CacheStore) listPins() ([]Pin, error) {
+	pins := []Pin{}
+	if err := cs.Database.walkPins(func(pin *Pin) error {
+		pins = append(pins, *pin)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+// ListSnapshots returns the images whose blobs are used by snapshots.
+func (cs *CacheStore) ListSnapshots() ([]Snapshot, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	snapshots := []Snapshot{}
+	if err := cs.Database.walkSnapshots(func(imageID string, snapshot *Snapshot) error {
+		snapshot.ImageID = imageID
+		snapshots = append(snapshots, *snapshot)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
@@ -31,6 +31,7 @@ var (
 	snapshotBucketName = []byte("snapshots")
 
 	blobBucketName = []byte("blobs")
+	pinBucketName  = []byte("pins")
 )
 
 var (
@@ -257,6 +258,67 @@ func (d *Database) delBlob(blobID string) error {
 	})
 }
 
+func (d *Database) walkSnapshots(cb func(imageID string, snapshot *Snapshot) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		cbkt := tx.Bucket(cachesBucketName)
+		sbkt := cbkt.Bucket(snapshotBucketName)
+		if sbkt == nil {
+			return nil
+		}
+
+		return sbkt.ForEach(func(k, v []byte) error {
+			snapshot := &Snapshot{}
+			if err := json.Unmarshal(v, snapshot); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal %s", k)
+			}
+			return cb(string(k), snapshot)
+		})
+	})
+}
+
+func (d *Database) putPin(pin *Pin) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		cbkt := tx.Bucket(cachesBucketName)
+		pbkt, err := cbkt.CreateBucketIfNotExists(pinBucketName)
+		if err != nil {
+			return err
+		}
+		return updateObject(pbkt, pin.Image, pin)
+	})
+}
+
+func (d *Database) delPin(image string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		cbkt := tx.Bucket(cachesBucketName)
+		pbkt, err := cbkt.CreateBucketIfNotExists(pinBucketName)
+		if err != nil {
+			return err
+		}
+		if pbkt.Get([]byte(image)) == nil {
+			return ErrNotFound
+		}
+		return pbkt.Delete([]byte(image))
+	})
+}
+
+func (d *Database) walkPins(cb func(pin *Pin) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		cbkt := tx.Bucket(cachesBucketName)
+		pbkt := cbkt.Bucket(pinBucketName)
+		if pbkt == nil {
+			return nil
+		}
+
+		return pbkt.ForEach(func(k, v []byte) error {
+			pin := &Pin{}
+			if err := json.Unmarshal(v, pin); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal %s", k)
+			}
+			return cb(pin)
+		})
+	})
+}
+
 func (d *Database) getMarked() (map[string]struct{}, error) {
 	var results = make(map[string]struct{})
 	if err := d.db.View(func(tx *bolt.Tx) error {
@@ -276,6 +338,15 @@ func (d *Database) getMarked() (map[string]struct{}, error) {
 	}); err != nil {
 		return nil, err
 	}
+	// Blobs of pinned images are always in use
+	if err := d.walkPins(func(pin *Pin) error {
+		for _, blobID := range pin.Blobs {
+			results[blobID] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 	return results, nil
 }
 
@@ -8,6 +8,9 @@ package mount
 
 type Interface interface {
 	Umount(target string) error
+	// LazyUmount detaches the mount without accessing it, so that it
+	// doesn't block on a hung FUSE mount.
+	LazyUmount(target string) error
 	IsLikelyNotMountPoint(file string) (bool, error)
 }
 
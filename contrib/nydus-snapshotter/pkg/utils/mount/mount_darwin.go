@@ -9,6 +9,10 @@ func (m *Mounter) Umount(target string) error {
 	return nil
 }
 
+func (m *Mounter) LazyUmount(target string) error {
+	return nil
+}
+
 func (m *Mounter) IsLikelyNotMountPoint(file string) (bool, error) {
 	return true, nil
 }
@@ -20,6 +20,13 @@ func (m *Mounter) Umount(target string) error {
 	return syscall.Unmount(target, syscall.MNT_FORCE)
 }
 
+func (m *Mounter) LazyUmount(target string) error {
+	if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		return err
+	}
+	return nil
+}
+
 func (m *Mounter) IsLikelyNotMountPoint(file string) (bool, error) {
 	stat, err := os.Stat(file)
 	if err != nil {
@@ -13,25 +13,39 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/containerd/containerd/errdefs"
-	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/continuity/fs"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/artifact"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/blobproxy"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/cache"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/compat"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/contentstore"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/converter"
 	metrics "github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/metric"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/store"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/config"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/auth"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/converted"
 	fspkg "github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/fs"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/nydus"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/stargz"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/latency"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/lock"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/logging"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/nodestatus"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/preheat"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/process"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/signature"
 	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/snapshot"
@@ -39,6 +53,20 @@ import (
 
 var _ snapshots.Snapshotter = &snapshotter{}
 
+// Drainer is implemented by the snapshotter to mark the node unavailable
+// before shutting down.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+const (
+	migrateRetryInterval = 5 * time.Second
+	// instanceLockFileName is locked by the instance managing root dir,
+	// the other instances on the same root dir wait until it exits.
+	instanceLockFileName    = "snapshotter.lock"
+	instanceLockRetryPeriod = time.Second
+)
+
 type snapshotter struct {
 	context     context.Context
 	root        string
@@ -47,8 +75,19 @@ type snapshotter struct {
 	asyncRemove bool
 	fs          fspkg.FileSystem
 	stargzFs    fspkg.FileSystem
+	convertedFs fspkg.FileSystem
+	converter   *converter.Converter
 	manager     *process.Manager
 	hasDaemon   bool
+	mergedView  bool
+	compat      *compat.Shim
+	cacheMgr    *cache.Manager
+	recorder    *latency.Recorder
+	contents    *contentstore.Store
+	reporter    *nodestatus.Reporter
+	// instanceLock is held as long as the snapshotter is running, it's
+	// released by kernel once the process exits.
+	instanceLock *lock.Lock
 }
 
 func (o *snapshotter) Cleanup(ctx context.Context) error {
@@ -57,10 +96,10 @@ func (o *snapshotter) Cleanup(ctx context.Context) error {
 		return err
 	}
 
-	log.G(ctx).Infof("cleanup: dirs=%v", cleanup)
+	logging.Snapshots.G(ctx).Infof("cleanup: dirs=%v", cleanup)
 	for _, dir := range cleanup {
 		if err := o.cleanupSnapshotDirectory(ctx, dir); err != nil {
-			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+			logging.Snapshots.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
 		}
 	}
 	return nil
@@ -74,6 +113,21 @@ func NewSnapshotter(ctx context.Context, cfg *config.Config) (snapshots.Snapshot
 
 	cfg.DaemonMode = strings.ToLower(cfg.DaemonMode)
 
+	compatShim, err := compat.NewShim(cfg.ContainerdVersion)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize containerd compatibility shim")
+	}
+	if cfg.ContainerdAddress != "" {
+		go compatShim.Negotiate(ctx, cfg.ContainerdAddress)
+	}
+
+	// Only one instance manages the metastores and daemons in root dir
+	instanceLock, err := lockInstance(ctx, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lock root dir")
+	}
+	logging.Snapshots.G(ctx).Infof("locked root dir %s", cfg.RootDir)
+
 	db, err := store.NewDatabase(cfg.RootDir)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to new database")
@@ -83,6 +137,7 @@ func NewSnapshotter(ctx context.Context, cfg *config.Config) (snapshots.Snapshot
 		NydusdBinaryPath: cfg.NydusdBinaryPath,
 		Database:         db,
 		DaemonMode:       cfg.DaemonMode,
+		ServerUIDs:       cfg.DaemonServerUIDs,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to new process manager")
@@ -91,13 +146,55 @@ func NewSnapshotter(ctx context.Context, cfg *config.Config) (snapshots.Snapshot
 		Database: db,
 		Period:   cfg.GCPeriod,
 		CacheDir: cfg.CacheDir,
+		// The instances on different root dirs may share the cache dir
+		Instance: digest.FromString(filepath.Clean(cfg.RootDir)).Hex()[:12],
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to new cache manager")
 	}
+	if err := cacheMgr.ReconcilePins(cfg.PinnedImages); err != nil {
+		return nil, errors.Wrap(err, "failed to reconcile pinned images")
+	}
 
 	hasDaemon := cfg.DaemonMode != config.DaemonModeNone
 
+	if cfg.DaemonLivenessProbe && hasDaemon {
+		if err := pm.Probe(ctx, process.LivenessOpt{
+			Interval:         cfg.DaemonProbeInterval,
+			Timeout:          cfg.DaemonProbeTimeout,
+			FailureThreshold: cfg.DaemonProbeFailureThreshold,
+			Action:           cfg.DaemonLivenessAction,
+		}); err != nil {
+			return nil, errors.Wrap(err, "failed to probe daemon liveness")
+		}
+	}
+
+	if cfg.DaemonDegradedMode && hasDaemon {
+		if err := pm.WatchBackend(ctx, process.DegradedOpt{
+			Interval:       cfg.DaemonDegradedInterval,
+			ErrorThreshold: uint64(cfg.DaemonDegradedErrorThreshold),
+			RetryLimit:     cfg.DaemonDegradedRetryLimit,
+			BackendTimeout: cfg.DaemonDegradedTimeout,
+		}); err != nil {
+			return nil, errors.Wrap(err, "failed to watch daemon backend")
+		}
+	}
+
+	var blobProxy *blobproxy.Proxy
+	if cfg.BlobProxyAddress != "" && hasDaemon {
+		blobProxy, err = blobproxy.New(blobproxy.Opt{
+			RootDir:   filepath.Join(cfg.RootDir, "blobproxy"),
+			Address:   cfg.BlobProxyAddress,
+			CacheSize: cfg.BlobProxyCacheSize,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize blob proxy")
+		}
+		if err := blobProxy.Serve(ctx); err != nil {
+			return nil, errors.Wrap(err, "failed to serve blob proxy")
+		}
+	}
+
 	nydusFs, err := nydus.NewFileSystem(
 		ctx,
 		nydus.WithProcessManager(pm),
@@ -106,6 +203,10 @@ func NewSnapshotter(ctx context.Context, cfg *config.Config) (snapshots.Snapshot
 		nydus.WithMeta(cfg.RootDir),
 		nydus.WithDaemonConfig(cfg.DaemonCfg),
 		nydus.WithVPCRegistry(cfg.ConvertVpcRegistry),
+		nydus.WithHostConfigDir(cfg.HostConfigDir),
+		nydus.WithSizeClasses(cfg.SizeClasses),
+		nydus.WithDigestValidate(cfg.DigestValidate),
+		nydus.WithBlobProxy(blobProxy),
 		nydus.WithVerifier(verifier),
 		nydus.WithDaemonMode(cfg.DaemonMode),
 	)
@@ -123,13 +224,99 @@ func NewSnapshotter(ctx context.Context, cfg *config.Config) (snapshots.Snapshot
 				stargz.WithNydusdBinaryPath(cfg.NydusdBinaryPath),
 				stargz.WithNydusImageBinaryPath(cfg.NydusImageBinaryPath),
 				stargz.WithDaemonConfig(cfg.DaemonCfg),
+				stargz.WithHostConfigDir(cfg.HostConfigDir),
 			)
 			if err != nil {
 				return nil, errors.Wrap(err, "failed to initialize stargz filesystem")
 			}
 		} else {
 			// stargz support requires nydusd to run
-			log.G(ctx).Info("DaemonMode is none, disable stargz support")
+			logging.Snapshots.G(ctx).Info("DaemonMode is none, disable stargz support")
+		}
+	}
+
+	var nodeConverter *converter.Converter
+	var convertedFs fspkg.FileSystem = nil
+	if cfg.ConvertOnNode {
+		if hasDaemon {
+			nodeConverter, err = converter.New(converter.Opt{
+				RootDir:        filepath.Join(cfg.RootDir, "converted"),
+				NydusImagePath: cfg.NydusImageBinaryPath,
+				TargetRepo:     cfg.ConvertTargetRepo,
+				Insecure:       cfg.ConvertInsecure,
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to initialize converter")
+			}
+			convertedFs, err = converted.NewFileSystem(
+				ctx,
+				converted.WithConverter(nodeConverter),
+				converted.WithProcessManager(pm),
+				converted.WithDaemonConfig(cfg.DaemonCfg),
+			)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to initialize converted filesystem")
+			}
+		} else {
+			// The converted images are mounted by nydusd
+			logging.Snapshots.G(ctx).Info("DaemonMode is none, disable conversion on node")
+		}
+	}
+
+	var recorder *latency.Recorder
+	if cfg.MeasureLatency {
+		recorder = latency.NewRecorder(0)
+		go recorder.Watch(ctx, cfg.ContainerdAddress)
+	}
+
+	var preheater *preheat.Preheater
+	if cfg.EnablePreheat {
+		if hasDaemon {
+			preheater, err = preheat.New(ctx, preheat.Opt{
+				RootDir:    filepath.Join(cfg.RootDir, "preheat"),
+				NydusdPath: cfg.NydusdBinaryPath,
+				Insecure:   cfg.PreheatInsecure,
+				DaemonConfig: func(image string) (config.DaemonConfig, error) {
+					return nydusFs.NewDaemonConfig(map[string]string{label.ImageRef: image})
+				},
+				CacheManager: cacheMgr,
+				Timeout:      cfg.PreheatTimeout,
+				Concurrency:  cfg.PreheatConcurrency,
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to initialize preheater")
+			}
+		} else {
+			// The blob caches are fetched by nydusd
+			logging.Snapshots.G(ctx).Info("DaemonMode is none, disable preheat")
+		}
+	}
+	if preheater != nil && cfg.WatchImagePrePull {
+		controller, err := preheat.NewController(preheater, cfg.NodeName, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize ImagePrePull controller")
+		}
+		go controller.Run(ctx)
+	}
+
+	var artifacts *artifact.Manager
+	if cfg.EnableArtifactMount {
+		if hasDaemon {
+			artifacts, err = artifact.New(ctx, artifact.Opt{
+				RootDir:    filepath.Join(cfg.RootDir, "artifacts"),
+				NydusdPath: cfg.NydusdBinaryPath,
+				Insecure:   cfg.ArtifactInsecure,
+				DaemonConfig: func(ref string) (config.DaemonConfig, error) {
+					return nydusFs.NewDaemonConfig(map[string]string{label.ImageRef: ref})
+				},
+				CacheManager: cacheMgr,
+				AllowedPaths: cfg.ArtifactMountPaths,
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to initialize artifact manager")
+			}
+		} else {
+			logging.Snapshots.G(ctx).Info("DaemonMode is none, disable artifact mount")
 		}
 	}
 
@@ -137,8 +324,16 @@ func NewSnapshotter(ctx context.Context, cfg *config.Config) (snapshots.Snapshot
 		metricServer, err := metrics.NewServer(
 			ctx,
 			metrics.WithRootDir(cfg.RootDir),
+			metrics.WithAddress(cfg.MetricsAddress),
+			metrics.WithSocketMode(cfg.MetricsSocketMode),
+			metrics.WithAuthTokenFile(cfg.MetricsTokenFile),
 			metrics.WithMetricsFile(cfg.MetricsFile),
 			metrics.WithProcessManager(pm),
+			metrics.WithCacheManager(cacheMgr),
+			metrics.WithLatencyRecorder(recorder),
+			metrics.WithPreheater(preheater),
+			metrics.WithArtifactManager(artifacts),
+			metrics.WithConfig(*cfg),
 		)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to new metric server")
@@ -146,11 +341,27 @@ func NewSnapshotter(ctx context.Context, cfg *config.Config) (snapshots.Snapshot
 		// Start metrics http server.
 		go func() {
 			if err := metricServer.Serve(ctx); err != nil {
-				log.G(ctx).Error(err)
+				logging.Snapshots.G(ctx).Error(err)
 			}
 		}()
 	}
 
+	var reporter *nodestatus.Reporter
+	if cfg.ReportNodeStatus {
+		reporter, err = nodestatus.New(nodestatus.Opt{
+			NodeName: cfg.NodeName,
+			Interval: cfg.NodeStatusInterval,
+			Taint:    cfg.NodeTaint,
+			Check: func(ctx context.Context) error {
+				return pm.CheckHealth()
+			},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize node status reporter")
+		}
+		go reporter.Run(ctx)
+	}
+
 	if err := os.MkdirAll(cfg.RootDir, 0700); err != nil {
 		return nil, err
 	}
@@ -171,7 +382,12 @@ func NewSnapshotter(ctx context.Context, cfg *config.Config) (snapshots.Snapshot
 		return nil, err
 	}
 
-	return &snapshotter{
+	var contents *contentstore.Store
+	if cfg.BootstrapContentStore {
+		contents = contentstore.New(cfg.ContainerdAddress, cfg.ContentNamespace, cfg.ContainerdRoot)
+	}
+
+	o := &snapshotter{
 		context:     ctx,
 		root:        cfg.RootDir,
 		nydusdPath:  cfg.NydusdBinaryPath,
@@ -179,8 +395,34 @@ func NewSnapshotter(ctx context.Context, cfg *config.Config) (snapshots.Snapshot
 		asyncRemove: cfg.AsyncRemove,
 		fs:          nydusFs,
 		stargzFs:    stargzFs,
+		convertedFs: convertedFs,
+		converter:   nodeConverter,
 		hasDaemon:   hasDaemon,
-	}, nil
+		mergedView:  cfg.MergedView,
+		compat:      compatShim,
+		cacheMgr:    cacheMgr,
+		recorder:    recorder,
+		contents:    contents,
+		reporter:    reporter,
+
+		instanceLock: instanceLock,
+	}
+	if contents != nil {
+		go o.migrateBootstraps(ctx)
+	}
+
+	return o, nil
+}
+
+// lockInstance waits for the instance running on the same root dir to exit,
+// and locks root dir.
+func lockInstance(ctx context.Context, cfg *config.Config) (*lock.Lock, error) {
+	if cfg.InstanceLockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.InstanceLockTimeout)
+		defer cancel()
+	}
+	return lock.Wait(ctx, filepath.Join(cfg.RootDir, instanceLockFileName), instanceLockRetryPeriod)
 }
 
 func (o *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
@@ -213,14 +455,26 @@ func (o *snapshotter) getSnapShot(ctx context.Context, key string) (*storage.Sna
 }
 
 func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	start := time.Now()
+	mounts, err := o.getMounts(ctx, key)
+	if err == nil {
+		o.recorder.Mounted(key, start)
+	}
+	return mounts, err
+}
+
+func (o *snapshotter) getMounts(ctx context.Context, key string) ([]mount.Mount, error) {
 	s, err := o.getSnapShot(ctx, key)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get active mount")
 	}
+	if _, info, _, rErr := snapshot.GetSnapshotInfo(ctx, o.ms, key); rErr == nil && forceOCI(info.Labels) {
+		return o.mounts(ctx, *s)
+	}
 	if id, info, rErr := o.findNydusMetaLayer(ctx, key); rErr == nil {
 		err = o.fs.WaitUntilReady(ctx, id)
 		if err != nil {
-			log.G(ctx).Errorf("snapshot %s is not ready, err: %v", id, err)
+			logging.Snapshots.G(ctx).Errorf("snapshot %s is not ready, err: %v", id, err)
 			return nil, err
 		}
 		return o.remoteMounts(ctx, *s, id, info.Labels)
@@ -228,34 +482,108 @@ func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, er
 		if id, _, rErr := o.findStargzMetaLayer(ctx, key); rErr == nil {
 			err = o.stargzFs.WaitUntilReady(ctx, id)
 			if err != nil {
-				log.G(ctx).Errorf("snapshot %s is not ready, err: %v", id, err)
+				logging.Snapshots.G(ctx).Errorf("snapshot %s is not ready, err: %v", id, err)
 				return nil, err
 			}
 			return o.remoteMounts(ctx, *s, id, info.Labels)
 		}
 	}
+	if o.convertedFs != nil {
+		if _, info, _, rErr := snapshot.GetSnapshotInfo(ctx, o.ms, key); rErr == nil {
+			if convertedKey, ok := info.Labels[label.NydusConvertedLayer]; ok {
+				err = o.convertedFs.WaitUntilReady(ctx, convertedKey)
+				if err != nil {
+					logging.Snapshots.G(ctx).Errorf("converted layer chain %s is not ready, err: %v", convertedKey, err)
+					return nil, err
+				}
+				return o.convertedMounts(ctx, *s, convertedKey)
+			}
+		}
+	}
 	return o.mounts(ctx, *s)
 }
 
 func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, id string, labels map[string]string) error {
-	log.G(ctx).Infof("prepare remote snapshot mountpoint %s", o.upperPath(id))
+	logging.Snapshots.G(ctx).Infof("prepare remote snapshot mountpoint %s", o.upperPath(id))
 	return o.fs.Mount(o.context, id, labels)
 }
 
 func (o *snapshotter) prepareStargzRemoteSnapshot(ctx context.Context, id string, labels map[string]string) error {
-	log.G(ctx).Infof("prepare stargz remote snapshot mountpoint %s", o.upperPath(id))
+	logging.Snapshots.G(ctx).Infof("prepare stargz remote snapshot mountpoint %s", o.upperPath(id))
 	return o.stargzFs.Mount(o.context, id, labels)
 }
 
 func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
-	logCtx := log.G(ctx).WithField("key", key).WithField("parent", parent)
+	if o.recorder == nil {
+		return o.prepare(ctx, key, parent, opts...)
+	}
+
+	start := time.Now()
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
+	isImageLayer := o.compat.IsImageLayer(base.Labels)
+	if isImageLayer {
+		_, isMeta := base.Labels[label.NydusMetaLayer]
+		isNydus := isMeta || o.fs.Support(ctx, base.Labels)
+		o.recorder.StartPull(base.Labels[label.ImageRef], isNydus && !forceOCI(base.Labels))
+	}
+
+	mounts, err := o.prepare(ctx, key, parent, opts...)
+	if err == nil && !isImageLayer {
+		o.recordPrepared(ctx, key, parent, start)
+	}
+	return mounts, err
+}
+
+// recordPrepared records the prepare segment of container rootfs, the
+// image is found by the labels of nydus meta layer or parent snapshot.
+func (o *snapshotter) recordPrepared(ctx context.Context, key, parent string, start time.Time) {
+	if _, info, err := o.findNydusMetaLayer(ctx, key); err == nil {
+		o.recorder.Prepared(key, info.Labels[label.ImageRef], true, start)
+		return
+	}
+	var image string
+	if parent != "" {
+		if _, info, _, err := snapshot.GetSnapshotInfo(ctx, o.ms, parent); err == nil {
+			image = info.Labels[label.ImageRef]
+		}
+	}
+	o.recorder.Prepared(key, image, false, start)
+}
+
+func (o *snapshotter) prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	logCtx := logging.Snapshots.G(ctx).WithField("key", key).WithField("parent", parent)
+
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
+	if forceOCI(base.Labels) {
+		return o.prepareOCI(ctx, key, parent, base.Labels, opts)
+	}
+
+	if o.converter != nil {
+		if convertedKey, parentLabels := o.checkConversion(ctx, parent, opts); convertedKey != "" {
+			logCtx.Infof("found converted layer chain %s, prepare remote snapshot", convertedKey)
+			if err := o.convertedFs.Mount(o.context, convertedKey, parentLabels); err != nil {
+				return nil, err
+			}
+			opts = append(opts, withLabel(label.NydusConvertedLayer, convertedKey))
+		}
+	}
 
 	s, err := o.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
 	if err != nil {
 		return nil, err
 	}
-
-	var base snapshots.Info
+	// The label of converted layer chain may be appended
+	base = snapshots.Info{}
 	for _, opt := range opts {
 		if err := opt(&base); err != nil {
 			return nil, err
@@ -266,8 +594,14 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 	if target, ok := base.Labels[label.TargetSnapshotLabel]; ok {
 		// check if image layer is nydus layer
 		if o.fs.Support(ctx, base.Labels) {
+			// The data layer can't be lazily loaded without image reference,
+			// and it's not an unpackable tar either
+			if _, ok := base.Labels[label.ImageRef]; !ok {
+				return nil, errors.Errorf("image ref of nydus data layer %s is missing, "+
+					"enable_remote_snapshot_annotations must be exported by snapshotter to pull through transfer service", target)
+			}
 			logCtx.Infof("nydus data layer, skip download and unpack %s", key)
-			err := o.Commit(ctx, target, key, append(opts, snapshots.WithLabels(base.Labels))...)
+			err := o.Commit(ctx, target, key, append(opts, snapshots.WithLabels(base.Labels), o.withReadiness(ctx, base.Labels, ""))...)
 			if err == nil || errdefs.IsAlreadyExists(err) {
 				return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "target snapshot %q", target)
 			}
@@ -281,14 +615,14 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 			if err != nil {
 				logCtx.Errorf("failed to prepare stargz layer of snapshot ID %s, err: %v", s.ID, err)
 			} else {
-				err := o.Commit(ctx, target, key, append(opts, snapshots.WithLabels(base.Labels))...)
+				err := o.Commit(ctx, target, key, append(opts, snapshots.WithLabels(base.Labels), o.withReadiness(ctx, base.Labels, "registry"))...)
 				if err == nil || errdefs.IsAlreadyExists(err) {
 					return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "target snapshot %q", target)
 				}
 			}
 		}
 	}
-	if prepareForContainer(base) {
+	if !o.compat.IsImageLayer(base.Labels) {
 		logCtx.Infof("prepare for container layer %s", key)
 		if id, info, err := o.findNydusMetaLayer(ctx, key); err == nil {
 			logCtx.Infof("found nydus meta layer id %s, parpare remote snapshot", id)
@@ -305,10 +639,164 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 				return o.remoteMounts(ctx, s, id, info.Labels)
 			}
 		}
+		if convertedKey, ok := base.Labels[label.NydusConvertedLayer]; ok {
+			return o.convertedMounts(ctx, s, convertedKey)
+		}
 	}
 	return o.mounts(ctx, s)
 }
 
+// forceOCI returns true if the snapshot is labeled to use the OCI path,
+// e.g. for emergencies or comparing the performance with nydus, without
+// changing the config of snapshotter.
+func forceOCI(labels map[string]string) bool {
+	force, err := strconv.ParseBool(labels[label.ForceOCI])
+	return err == nil && force
+}
+
+// prepareOCI prepares the snapshot in the normal overlayfs path, the image
+// layers are downloaded and unpacked by containerd rather than lazily
+// pulled, and the container snapshot is mounted on the unpacked layers. The
+// images without OCI layers, i.e. nydus images and the stargz images whose
+// layers have been lazily pulled, are rejected as they can't run without
+// nydusd.
+func (o *snapshotter) prepareOCI(ctx context.Context, key, parent string, labels map[string]string, opts []snapshots.Opt) ([]mount.Mount, error) {
+	logCtx := logging.Snapshots.G(ctx).WithField("key", key).WithField("parent", parent)
+
+	if o.fs.Support(ctx, labels) {
+		return nil, errors.Errorf("can't force OCI path for nydus image %s without OCI layers", labels[label.ImageRef])
+	}
+	if parent != "" {
+		if _, info, err := o.findNydusMetaLayer(ctx, parent); err == nil {
+			return nil, errors.Errorf("can't force OCI path for nydus image %s without OCI layers", info.Labels[label.ImageRef])
+		}
+		if _, info, err := o.findStargzMetaLayer(ctx, parent); err == nil {
+			return nil, errors.Errorf("can't force OCI path for stargz image %s lazily pulled, pull it again with label %s", info.Labels[label.ImageRef], label.ForceOCI)
+		}
+	}
+
+	s, err := o.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
+	if err != nil {
+		return nil, err
+	}
+	logCtx.Infof("prepare snapshot %s in OCI path", key)
+	return o.mounts(ctx, s)
+}
+
+func withLabel(key, value string) snapshots.Opt {
+	return func(info *snapshots.Info) error {
+		if info.Labels == nil {
+			info.Labels = make(map[string]string)
+		}
+		info.Labels[key] = value
+		return nil
+	}
+}
+
+// withReadiness labels the snapshot of layer which is lazily loaded from
+// backend rather than downloaded, the labels are merged into the snapshot
+// info of containerd metadata, so that the lazily loaded images can be
+// reported by fleet tools. The backend is found by the nydusd config of
+// image if it's not given.
+func (o *snapshotter) withReadiness(ctx context.Context, labels map[string]string, backend string) snapshots.Opt {
+	if backend == "" {
+		if cfg, err := o.fs.NewDaemonConfig(labels); err == nil {
+			backend = cfg.Device.Backend.BackendType
+		} else {
+			logging.Snapshots.G(ctx).WithError(err).Debug("unknown backend of lazily loaded layer")
+		}
+	}
+	return func(info *snapshots.Info) error {
+		if info.Labels == nil {
+			info.Labels = make(map[string]string)
+		}
+		info.Labels[label.NydusLazy] = "true"
+		if backend != "" {
+			info.Labels[label.NydusBackend] = backend
+		}
+		// The blobs of image aren't downloaded when pulling
+		if size, ok := labels[label.NydusImageSize]; ok {
+			info.Labels[label.NydusEstimatedSavedBytes] = size
+		}
+		return nil
+	}
+}
+
+// checkConversion returns the key of converted layer chain and the labels
+// of parent snapshot if the container is prepared on the layers of an image
+// which has been converted on node, otherwise it schedules the conversion
+// in background if the image has no nydus companion.
+func (o *snapshotter) checkConversion(ctx context.Context, parent string, opts []snapshots.Opt) (string, map[string]string) {
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return "", nil
+		}
+	}
+	if parent == "" || o.compat.IsImageLayer(base.Labels) {
+		return "", nil
+	}
+	if _, _, err := o.findNydusMetaLayer(ctx, parent); err == nil {
+		return "", nil
+	}
+	if o.stargzFs != nil {
+		if _, _, err := o.findStargzMetaLayer(ctx, parent); err == nil {
+			return "", nil
+		}
+	}
+
+	_, info, _, err := snapshot.GetSnapshotInfo(ctx, o.ms, parent)
+	if err != nil || info.Kind != snapshots.KindCommitted {
+		return "", nil
+	}
+	image, ok := info.Labels[label.ImageRef]
+	if !ok {
+		return "", nil
+	}
+	key, ok := converter.Key(parent)
+	if !ok {
+		return "", nil
+	}
+	if o.converter.IsConverted(key) {
+		return key, info.Labels
+	}
+
+	layers := []converter.Layer{}
+	for name := parent; name != ""; {
+		id, info, _, err := snapshot.GetSnapshotInfo(ctx, o.ms, name)
+		if err != nil {
+			logging.Snapshots.G(ctx).WithError(err).Warnf("failed to get layer %s for conversion", name)
+			return "", nil
+		}
+		layerKey, ok := converter.Key(name)
+		if !ok {
+			return "", nil
+		}
+		layers = append([]converter.Layer{{Key: layerKey, Path: o.upperPath(id)}}, layers...)
+		name = info.Parent
+	}
+	if o.converter.Schedule(o.context, image, auth.FromLabels(info.Labels).ToBase64(), layers) {
+		logging.Snapshots.G(ctx).Infof("scheduled conversion of image %s on node", image)
+	}
+	return "", nil
+}
+
+// convertedMounts mounts the container snapshot on the nydusd mountpoint
+// of converted layer chain.
+func (o *snapshotter) convertedMounts(ctx context.Context, s storage.Snapshot, convertedKey string) ([]mount.Mount, error) {
+	lowerDir, err := o.convertedFs.MountPoint(convertedKey)
+	if err != nil {
+		return nil, err
+	}
+	options := []string{
+		fmt.Sprintf("workdir=%s", o.workPath(s.ID)),
+		fmt.Sprintf("upperdir=%s", o.upperPath(s.ID)),
+		fmt.Sprintf("lowerdir=%s", lowerDir),
+	}
+	logging.Snapshots.G(ctx).Infof("mount options %v", options)
+	return overlayMount(options), nil
+}
+
 func (o *snapshotter) findStargzMetaLayer(ctx context.Context, key string) (string, snapshots.Info, error) {
 	return snapshot.FindSnapshot(ctx, o.ms, key, func(info snapshots.Info) bool {
 		_, ok := info.Labels[label.RemoteLabel]
@@ -323,11 +811,6 @@ func (o *snapshotter) findNydusMetaLayer(ctx context.Context, key string) (strin
 	})
 }
 
-func prepareForContainer(info snapshots.Info) bool {
-	_, ok := info.Labels[label.CRIImageLayer]
-	return !ok
-}
-
 func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
 	s, err := o.createSnapshot(ctx, snapshots.KindView, key, parent, opts)
 	if err != nil {
@@ -337,6 +820,100 @@ func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snap
 }
 
 func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return err
+		}
+	}
+	// The meta layer is unpacked by containerd, but the image is lazily
+	// loaded on it
+	if _, ok := base.Labels[label.NydusMetaLayer]; ok {
+		opts = append(opts, o.withReadiness(ctx, base.Labels, ""))
+	}
+
+	if err := o.commit(ctx, name, key, opts...); err != nil {
+		return err
+	}
+
+	if o.recorder != nil {
+		o.recorder.EndPull(base.Labels[label.ImageRef])
+	}
+
+	if o.contents != nil {
+		id, info, _, err := snapshot.GetSnapshotInfo(ctx, o.ms, name)
+		if err != nil {
+			return err
+		}
+		if _, ok := info.Labels[label.NydusMetaLayer]; ok {
+			// The private bootstrap file is still usable on failure
+			if err := o.importBootstrap(ctx, id); err != nil {
+				logging.Snapshots.G(ctx).WithError(err).Warnf("failed to import bootstrap of snapshot %s to content store", id)
+			}
+		}
+	}
+	return nil
+}
+
+func (o *snapshotter) importBootstrap(ctx context.Context, id string) error {
+	bootstrap, err := o.fs.BootstrapFile(id)
+	if err != nil {
+		return err
+	}
+	dgst, err := o.contents.Import(ctx, id, bootstrap)
+	if err != nil {
+		return err
+	}
+	logging.Snapshots.G(ctx).Infof("imported bootstrap of snapshot %s to content store as %s", id, dgst)
+	return nil
+}
+
+// migrateBootstraps imports the private bootstrap files of the snapshots
+// committed before enabling content store, it waits for containerd to be
+// ready because snapshotter usually starts before containerd.
+func (o *snapshotter) migrateBootstraps(ctx context.Context) {
+	ids := []string{}
+	if err := o.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if _, ok := info.Labels[label.NydusMetaLayer]; !ok || info.Kind != snapshots.KindCommitted {
+			return nil
+		}
+		id, _, _, err := snapshot.GetSnapshotInfo(ctx, o.ms, info.Name)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		logging.Snapshots.G(ctx).WithError(err).Error("failed to walk snapshots for bootstrap migration")
+		return
+	}
+
+	bootstraps := make(map[string]string)
+	for _, id := range ids {
+		bootstrap, err := o.fs.BootstrapFile(id)
+		if err != nil {
+			logging.Snapshots.G(ctx).WithError(err).Warnf("skip bootstrap migration of snapshot %s", id)
+			continue
+		}
+		bootstraps[id] = bootstrap
+	}
+
+	for {
+		migrated, err := o.contents.Migrate(ctx, bootstraps)
+		if err == nil {
+			logging.Snapshots.G(ctx).Infof("migrated %d bootstraps to content store", migrated)
+			return
+		}
+		logging.Snapshots.G(ctx).WithError(err).Debug("retry bootstrap migration")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(migrateRetryInterval):
+		}
+	}
+}
+
+func (o *snapshotter) commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
 	ctx, t, err := o.ms.TransactionContext(ctx, true)
 	if err != nil {
 		return err
@@ -345,7 +922,7 @@ func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snap
 	defer func() {
 		if err != nil {
 			if rerr := t.Rollback(); rerr != nil {
-				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+				logging.Snapshots.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
 			}
 		}
 	}()
@@ -376,11 +953,27 @@ func (o *snapshotter) Remove(ctx context.Context, key string) error {
 	defer func() {
 		if err != nil {
 			if rerr := t.Rollback(); rerr != nil {
-				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+				logging.Snapshots.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
 			}
 		}
 	}()
 
+	// Keep the image layer snapshots of pinned image, containerd will
+	// retry to remove them in next GC until the image is unpinned
+	var info snapshots.Info
+	_, info, _, err = storage.GetInfo(ctx, key)
+	if err != nil {
+		return err
+	}
+	if imageRef, ok := info.Labels[label.ImageRef]; ok && info.Kind == snapshots.KindCommitted && o.cacheMgr.IsPinned(imageRef) {
+		err = errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %s of pinned image %s", key, imageRef)
+		return err
+	}
+	var convertedKey string
+	if o.converter != nil && info.Kind == snapshots.KindCommitted {
+		convertedKey, _ = converter.Key(key)
+	}
+
 	_, _, err = storage.Remove(ctx, key)
 	if err != nil {
 		return errors.Wrap(err, "failed to remove")
@@ -400,7 +993,7 @@ func (o *snapshotter) Remove(ctx context.Context, key string) error {
 			if err == nil {
 				for _, dir := range removals {
 					if err := o.cleanupSnapshotDirectory(ctx, dir); err != nil {
-						log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+						logging.Snapshots.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
 					}
 				}
 			}
@@ -408,7 +1001,26 @@ func (o *snapshotter) Remove(ctx context.Context, key string) error {
 
 	}
 
-	return t.Commit()
+	if err = t.Commit(); err != nil {
+		return err
+	}
+	if convertedKey != "" {
+		o.removeConverted(ctx, convertedKey)
+	}
+	return nil
+}
+
+// removeConverted stops nydusd and removes the bootstrap of converted layer
+// chain, the committed layer snapshot of the chain has been removed.
+func (o *snapshotter) removeConverted(ctx context.Context, convertedKey string) {
+	if mnt, err := o.convertedFs.MountPoint(convertedKey); err == nil {
+		if err := o.convertedFs.Umount(ctx, filepath.Dir(mnt)); err != nil {
+			logging.Snapshots.G(ctx).WithError(err).Warnf("failed to umount converted layer chain %s", convertedKey)
+		}
+	}
+	if err := o.converter.Remove(convertedKey); err != nil {
+		logging.Snapshots.G(ctx).WithError(err).Warnf("failed to remove converted layer chain %s", convertedKey)
+	}
 }
 
 func (o *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...string) error {
@@ -423,9 +1035,18 @@ func (o *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...str
 func (o *snapshotter) Close() error {
 	err := o.fs.Cleanup(context.Background())
 	if err != nil {
-		log.L.Errorf("failed to clean up remote snapshot, err %v", err)
+		logging.Snapshots.L().Errorf("failed to clean up remote snapshot, err %v", err)
+	}
+	if err := o.ms.Close(); err != nil {
+		return err
 	}
-	return o.ms.Close()
+	return o.instanceLock.Unlock()
+}
+
+// Drain reports the snapshotter unavailable to the node before shutting
+// down, it's no-op if node status reporting is disabled.
+func (o *snapshotter) Drain(ctx context.Context) error {
+	return o.reporter.Drain(ctx)
 }
 
 func (o *snapshotter) upperPath(id string) string {
@@ -457,12 +1078,12 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		if err != nil {
 			if td != "" {
 				if err1 := o.cleanupSnapshotDirectory(ctx, td); err1 != nil {
-					log.G(ctx).WithError(err1).Warn("failed to cleanup temp snapshot directory")
+					logging.Snapshots.G(ctx).WithError(err1).Warn("failed to cleanup temp snapshot directory")
 				}
 			}
 			if path != "" {
 				if err1 := o.cleanupSnapshotDirectory(ctx, path); err1 != nil {
-					log.G(ctx).WithError(err1).WithField("path", path).Error("failed to reclaim snapshot directory, directory may need removal")
+					logging.Snapshots.G(ctx).WithError(err1).WithField("path", path).Error("failed to reclaim snapshot directory, directory may need removal")
 					err = errors.Wrapf(err, "failed to remove path: %v", err1)
 				}
 			}
@@ -472,7 +1093,7 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 	td, err = o.prepareDirectory(ctx, o.snapshotRoot(), kind)
 	if err != nil {
 		if rerr := t.Rollback(); rerr != nil {
-			log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+			logging.Snapshots.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
 		}
 		return storage.Snapshot{}, errors.Wrap(err, "failed to create prepare snapshot dir")
 	}
@@ -480,7 +1101,7 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 	defer func() {
 		if rollback {
 			if rerr := t.Rollback(); rerr != nil {
-				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+				logging.Snapshots.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
 			}
 		}
 	}()
@@ -500,7 +1121,7 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 
 		if err := os.Lchown(filepath.Join(td, "fs"), int(stat.Uid), int(stat.Gid)); err != nil {
 			if rerr := t.Rollback(); rerr != nil {
-				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+				logging.Snapshots.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
 			}
 			return storage.Snapshot{}, errors.Wrap(err, "failed to chown")
 		}
@@ -543,6 +1164,22 @@ func overlayMount(options []string) []mount.Mount {
 	}
 }
 
+// isMergedView returns whether the views of image are bind mounts of the
+// nydusd mount rather than overlayfs with it as the only lower layer, the
+// label of meta layer takes precedence over the config.
+func (o *snapshotter) isMergedView(ctx context.Context, labels map[string]string) bool {
+	value, ok := labels[label.NydusMergedView]
+	if !ok {
+		return o.mergedView
+	}
+	merged, err := strconv.ParseBool(value)
+	if err != nil {
+		logging.Snapshots.G(ctx).Warnf("ignore invalid merged view %q in label %s", value, label.NydusMergedView)
+		return o.mergedView
+	}
+	return merged
+}
+
 func (o *snapshotter) remoteMounts(ctx context.Context, s storage.Snapshot, id string, labels map[string]string) ([]mount.Mount, error) {
 	var options []string
 	if o.hasDaemon {
@@ -553,10 +1190,15 @@ func (o *snapshotter) remoteMounts(ctx context.Context, s storage.Snapshot, id s
 			)
 		} else if len(s.ParentIDs) == 1 {
 			return bindMount(o.upperPath(s.ParentIDs[0])), nil
+		} else if s.ParentIDs[0] == id && o.isMergedView(ctx, labels) {
+			// The bootstrap of meta layer is merged from all the layers
+			// of image, so nydusd presents the whole image in one mount
+			logging.Snapshots.G(ctx).Infof("bind merged view of snapshot %s", id)
+			return bindMount(o.upperPath(id)), nil
 		}
 		lowerDirOption := fmt.Sprintf("lowerdir=%s", o.upperPath(id))
 		options = append(options, lowerDirOption)
-		log.G(ctx).Infof("mount options %v", options)
+		logging.Snapshots.G(ctx).Infof("mount options %v", options)
 		return overlayMount(options), nil
 	} else {
 		// Only nydus can work without daemon
@@ -587,7 +1229,7 @@ func (o *snapshotter) remoteMounts(ctx context.Context, s storage.Snapshot, id s
 		if err != nil {
 			return nil, errors.Wrapf(err, "remoteMounts: failed to marshal config")
 		}
-		log.G(ctx).Infof("Bootstrap file for snapshotID %s: %s, config %s", id, source, string(b))
+		logging.Snapshots.G(ctx).Infof("Bootstrap file for snapshotID %s: %s, config %s", id, source, string(b))
 
 		return []mount.Mount{
 			{
@@ -645,7 +1287,7 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot) ([]mount.M
 	}
 
 	options = append(options, fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":")))
-	log.G(ctx).Infof("mount options %s", options)
+	logging.Snapshots.G(ctx).Infof("mount options %s", options)
 	return []mount.Mount{
 		{
 			Type:    "overlay",
@@ -718,18 +1360,22 @@ func (o *snapshotter) cleanupSnapshotDirectory(ctx context.Context, dir string)
 	// On a remote snapshot, the layer is mounted on the "fs" directory.
 	// We use Filesystem's Unmount API so that it can do necessary finalization
 	// before/after the unmount.
-	log.G(ctx).WithField("dir", dir).Infof("cleanupSnapshotDirectory %s", dir)
+	logging.Snapshots.G(ctx).WithField("dir", dir).Infof("cleanupSnapshotDirectory %s", dir)
 	if err := o.fs.Umount(ctx, dir); err != nil && !os.IsNotExist(err) {
-		log.G(ctx).WithError(err).WithField("dir", dir).Error("failed to unmount")
+		logging.Snapshots.G(ctx).WithError(err).WithField("dir", dir).Error("failed to unmount")
 	} else if o.stargzFs != nil {
 		if err := o.stargzFs.Umount(ctx, dir); err != nil && !os.IsNotExist(err) {
-			log.G(ctx).WithError(err).WithField("dir", dir).Error("failed to unmount")
+			logging.Snapshots.G(ctx).WithError(err).WithField("dir", dir).Error("failed to unmount")
 		}
 	}
 
 	if err := os.RemoveAll(dir); err != nil {
 		return errors.Wrapf(err, "failed to remove directory %q", dir)
 	}
+	// The bootstrap content is left to containerd GC
+	if err := o.contents.Release(ctx, filepath.Base(dir)); err != nil {
+		logging.Snapshots.G(ctx).WithError(err).WithField("dir", dir).Warn("failed to release bootstrap content")
+	}
 	return nil
 }
 
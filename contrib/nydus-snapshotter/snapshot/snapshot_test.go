@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2020. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	fspkg "github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/filesystem/fs"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+// fakeFs mounts the meta layer of image only.
+type fakeFs struct {
+	fspkg.FileSystem
+	metaID string
+}
+
+func (fs *fakeFs) MountPoint(snapshotID string) (string, error) {
+	if snapshotID == fs.metaID {
+		return "/mnt/" + snapshotID, nil
+	}
+	return "", errdefs.ErrNotFound
+}
+
+func TestMergedView(t *testing.T) {
+	const metaID = "2"
+	o := &snapshotter{
+		root:      "/root",
+		fs:        &fakeFs{metaID: metaID},
+		hasDaemon: true,
+	}
+	ctx := context.Background()
+	// The view of fully lazy image, whose topmost parent is the meta layer
+	view := storage.Snapshot{Kind: snapshots.KindView, ID: "3", ParentIDs: []string{metaID, "1"}}
+	bind := bindMount("/mnt/" + metaID)
+	overlay := overlayMount([]string{"lowerdir=/mnt/" + metaID})
+
+	for _, tc := range []struct {
+		mergedView bool
+		labels     map[string]string
+		expected   []mount.Mount
+	}{
+		{false, nil, overlay},
+		{true, nil, bind},
+		// The label of meta layer overrides the config
+		{true, map[string]string{label.NydusMergedView: "false"}, overlay},
+		{false, map[string]string{label.NydusMergedView: "true"}, bind},
+		// The invalid label falls back to the config
+		{false, map[string]string{label.NydusMergedView: "yes please"}, overlay},
+		{true, map[string]string{label.NydusMergedView: "yes please"}, bind},
+	} {
+		o.mergedView = tc.mergedView
+		mounts, err := o.remoteMounts(ctx, view, metaID, tc.labels)
+		require.Nil(t, err)
+		assert.Equal(t, tc.expected, mounts, fmt.Sprintf("merged view %t, labels %v", tc.mergedView, tc.labels))
+	}
+
+	o.mergedView = true
+	labels := map[string]string{label.NydusMergedView: "true"}
+
+	// The view with committed layers on top of the image
+	committed := storage.Snapshot{Kind: snapshots.KindView, ID: "4", ParentIDs: []string{"3", metaID, "1"}}
+	mounts, err := o.remoteMounts(ctx, committed, metaID, labels)
+	require.Nil(t, err)
+	assert.Equal(t, overlay, mounts)
+
+	// The container snapshot needs the writable upper layer
+	active := storage.Snapshot{Kind: snapshots.KindActive, ID: "5", ParentIDs: []string{metaID, "1"}}
+	mounts, err = o.remoteMounts(ctx, active, metaID, labels)
+	require.Nil(t, err)
+	assert.Equal(t, overlayMount([]string{
+		"workdir=/root/snapshots/5/work",
+		"upperdir=/root/snapshots/5/fs",
+		"lowerdir=/mnt/" + metaID,
+	}), mounts)
+}
@@ -9,27 +9,65 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containerd/containerd/reference/docker"
+	"github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/admission"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/alias"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/batch"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/chunkdict"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cloner"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/comparer"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/copier"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/encryption"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/gc"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/inspector"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/mirror"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/mounter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/optimizer"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/packer"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remotebuild"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/reverter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/scanner"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/server"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/signer"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
 
 var versionGitCommit string
 var versionBuildTime string
-var maxCacheMaxRecords uint = 50
+var defaultCacheMaxRecords = converter.DefaultCacheMaxRecords
+var maxCacheMaxRecords uint = 10000
+
+// remoteBuilder is the pool of remote builder agents shared across
+// conversions, the layers are built by local nydus-image if it's nil.
+var remoteBuilder *remotebuild.Pool
 
 func isPossibleValue(excepted []string, value string) bool {
 	for _, v := range excepted {
@@ -40,6 +78,18 @@ func isPossibleValue(excepted []string, value string) bool {
 	return false
 }
 
+// warnNydusdBackend warns that the blobs stored in S3 or GCS backend can't
+// be fetched by the nydusd in this repository, which only supports localfs,
+// oss and registry backends.
+func warnNydusdBackend(backendType string) {
+	if backendType == "s3" || backendType == "gcs" {
+		logrus.Warnf(
+			"The Nydus image with %s backend requires a nydusd supporting it, the nydusd in this repository only supports localfs, oss and registry backends",
+			backendType,
+		)
+	}
+}
+
 func parseBackendConfig(backendConfigJSON, backendConfigFile string) (string, error) {
 	if backendConfigJSON != "" && backendConfigFile != "" {
 		return "", fmt.Errorf("--backend-config conflicts with --backend-config-file")
@@ -73,18 +123,35 @@ func addReferenceSuffix(source, suffix string) (string, error) {
 	return target, nil
 }
 
-func getTargetReference(c *cli.Context) (string, error) {
+func getTargetReference(c *cli.Context, source string) (string, error) {
 	target := c.String("target")
 	targetSuffix := c.String("target-suffix")
 	if target != "" && targetSuffix != "" {
 		return "", fmt.Errorf("--target conflicts with --target-suffix")
 	}
+	if c.Bool("referrer") {
+		if provider.IsLocalSource(source) || provider.IsLocalTarget(target) {
+			return "", fmt.Errorf("--referrer requires the source and target image in registry")
+		}
+		if targetSuffix != "" {
+			return "", fmt.Errorf("--referrer conflicts with --target-suffix")
+		}
+		return getReferrerTarget(source, target)
+	}
 	if target == "" && targetSuffix == "" {
 		return "", fmt.Errorf("--target or --target-suffix is required")
 	}
 	var err error
 	if targetSuffix != "" {
-		target, err = addReferenceSuffix(c.String("source"), targetSuffix)
+		if strings.HasPrefix(source, provider.OCILayoutScheme) {
+			// Tag the target image in the same image layout
+			dir, tag := provider.ParseLocalPath(source)
+			if tag == "" {
+				tag = "latest"
+			}
+			return fmt.Sprintf("%s%s:%s%s", provider.OCILayoutScheme, dir, tag, targetSuffix), nil
+		}
+		target, err = addReferenceSuffix(provider.LocalReference(source), targetSuffix)
 		if err != nil {
 			return "", err
 		}
@@ -92,6 +159,86 @@ func getTargetReference(c *cli.Context) (string, error) {
 	return target, nil
 }
 
+// The Nydus manifest pushed as referrer must be in the same repository
+// with source image, use the source repository as target by default.
+func getReferrerTarget(source, target string) (string, error) {
+	sourceNamed, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid source image reference: %s", err)
+	}
+	if target == "" {
+		return sourceNamed.Name(), nil
+	}
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid target image reference: %s", err)
+	}
+	if targetNamed.Name() != sourceNamed.Name() {
+		return "", fmt.Errorf("--target should be in the same repository with --source for --referrer")
+	}
+	return target, nil
+}
+
+// The Nydus layers of previous image are reused without copying, so
+// it must be in the same repository with target image.
+func checkSameRepository(previous, target string) error {
+	previousNamed, err := docker.ParseDockerRef(previous)
+	if err != nil {
+		return fmt.Errorf("invalid image reference: %s", err)
+	}
+	targetNamed, err := docker.ParseDockerRef(target)
+	if err != nil {
+		return fmt.Errorf("invalid target image reference: %s", err)
+	}
+	if previousNamed.Name() != targetNamed.Name() {
+		return fmt.Errorf("%s isn't in repository %s", previous, targetNamed.Name())
+	}
+	return nil
+}
+
+// getHTTPCache returns the option caching manifest and config responses
+// from registry in the directory of --http-cache-dir.
+func getHTTPCache(c *cli.Context) provider.RemoteOpt {
+	return provider.WithHTTPCache(c.String("http-cache-dir"))
+}
+
+// getTLSOpt returns the TLS options of source or target registry from
+// the --<prefix>-ca, --<prefix>-cert and --<prefix>-key options.
+func getTLSOpt(c *cli.Context, prefix string) provider.TLSOpt {
+	opt := provider.TLSOpt{
+		CertFile: c.String(prefix + "-cert"),
+		KeyFile:  c.String(prefix + "-key"),
+	}
+	if ca := c.String(prefix + "-ca"); ca != "" {
+		opt.CAFiles = []string{ca}
+	}
+	return opt
+}
+
+// addRegistryTLS adds the TLS options of source and target registries,
+// they're applied to all images in the same registry host, e.g. the
+// build cache image in target registry.
+func addRegistryTLS(c *cli.Context, source, target string) error {
+	add := func(ref, prefix string) error {
+		named, err := docker.ParseDockerRef(ref)
+		if err != nil {
+			return fmt.Errorf("invalid image reference: %s", err)
+		}
+		return provider.AddHostTLS(docker.Domain(named), getTLSOpt(c, prefix))
+	}
+	if !provider.IsLocalSource(source) {
+		if err := add(source, "source"); err != nil {
+			return err
+		}
+	}
+	if !provider.IsLocalTarget(target) {
+		if err := add(target, "target"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func getCacheReference(c *cli.Context, target string) (string, error) {
 	cache := c.String("build-cache")
 	cacheTag := c.String("build-cache-tag")
@@ -108,203 +255,2125 @@ func getCacheReference(c *cli.Context, target string) (string, error) {
 	return cache, nil
 }
 
-func main() {
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
+// Create signer for --sign option, returns nil if it isn't specified.
+func getSigner(c *cli.Context, insecure bool) (*signer.Signer, error) {
+	tool := c.String("sign")
+	if tool == "" {
+		return nil, nil
+	}
+	possibleTools := []string{signer.ToolCosign, signer.ToolNotation}
+	if !isPossibleValue(possibleTools, tool) {
+		return nil, fmt.Errorf("--sign should be one of %v", possibleTools)
+	}
+	return signer.New(signer.Opt{
+		Tool:     tool,
+		ToolPath: c.String("sign-tool-path"),
+		Key:      c.String("sign-key"),
+		Insecure: insecure,
 	})
+}
 
-	version := fmt.Sprintf("%s.%s", versionGitCommit, versionBuildTime)
+// Create vulnerability scanner for --vuln-scanner option, returns nil if it
+// isn't specified.
+func getScanner(c *cli.Context) (*scanner.Scanner, error) {
+	tool := c.String("vuln-scanner")
+	if tool == "" {
+		if c.String("fail-on") != "" || c.String("vuln-report") != "" {
+			return nil, fmt.Errorf("--fail-on and --vuln-report require --vuln-scanner")
+		}
+		return nil, nil
+	}
+	possibleTools := []string{scanner.ToolTrivy, scanner.ToolGrype}
+	if !isPossibleValue(possibleTools, tool) {
+		return nil, fmt.Errorf("--vuln-scanner should be one of %v", possibleTools)
+	}
+	return scanner.New(scanner.Opt{
+		Tool:     tool,
+		ToolPath: c.String("vuln-scanner-path"),
+		FailOn:   c.String("fail-on"),
+	})
+}
 
-	app := &cli.App{
-		Name:    "Nydusify",
-		Usage:   "Nydus image converter tool",
-		Version: version,
+// parseBytes parses the human readable bytes of flag, e.g. 10MiB, it
+// returns 0 if the flag is not specified.
+func parseBytes(c *cli.Context, name string) (uint64, error) {
+	value := c.String(name)
+	if value == "" {
+		return 0, nil
 	}
+	bytes, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Parse --%s", name)
+	}
+	return bytes, nil
+}
 
-	logrus.Infof("Version: %s\n", version)
+// setupContentStore enables the content store shared across conversions in
+// work directory for source layers if --content-store is specified.
+func setupContentStore(c *cli.Context) error {
+	if !c.Bool("content-store") {
+		return nil
+	}
+	size, err := parseBytes(c, "content-store-size")
+	if err != nil {
+		return err
+	}
+	store, err := remote.NewContentStore(filepath.Join(c.String("work-dir"), "content"), int64(size))
+	if err != nil {
+		return err
+	}
+	provider.SourceContentStore = store
+	return nil
+}
 
-	app.Commands = []*cli.Command{
-		{
-			Name:  "convert",
-			Usage: "Convert source image to nydus image",
-			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
-				&cli.StringFlag{Name: "source", Required: true, Usage: "Source image reference", EnvVars: []string{"SOURCE"}},
-				&cli.StringFlag{Name: "target", Required: false, Usage: "Target (Nydus) image reference", EnvVars: []string{"TARGET"}},
-				&cli.StringFlag{Name: "target-suffix", Required: false, Usage: "Add suffix to source image reference as target image reference, conflict with --target", EnvVars: []string{"TARGET_SUFFIX"}},
+// setupRemoteBuilder connects the remote builder agents for building
+// layers if --remote-builder is specified.
+func setupRemoteBuilder(c *cli.Context) error {
+	addresses := c.StringSlice("remote-builder")
+	if len(addresses) == 0 {
+		return nil
+	}
+	pool, err := remotebuild.NewPool(remotebuild.PoolOpt{
+		Addresses:   addresses,
+		TLS:         c.Bool("remote-builder-tls"),
+		TLSCAFile:   c.String("remote-builder-ca"),
+		TLSCertFile: c.String("remote-builder-cert"),
+		TLSKeyFile:  c.String("remote-builder-key"),
+		Token:       c.String("remote-builder-token"),
+	})
+	if err != nil {
+		return err
+	}
+	remoteBuilder = pool
+	return nil
+}
 
-				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
-				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+// parseChunkSize parses the chunk size of flag in hex, e.g. 0x100000, or
+// in human readable bytes, e.g. 1MiB.
+func parseChunkSize(c *cli.Context, name string) (uint64, error) {
+	value := c.String(name)
+	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+		size, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Parse --%s", name)
+		}
+		return size, nil
+	}
+	return parseBytes(c, name)
+}
 
-				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for image conversion", EnvVars: []string{"WORK_DIR"}},
-				&cli.StringFlag{Name: "prefetch-dir", Value: "/", Usage: "Prefetch directory for nydus image, use absolute path of rootfs", EnvVars: []string{"PREFETCH_DIR"}},
-				&cli.StringFlag{Name: "nydus-image", Value: "./nydus-image", Usage: "The nydus-image binary path", EnvVars: []string{"NYDUS_IMAGE"}},
-				&cli.BoolFlag{Name: "multi-platform", Value: false, Usage: "Merge OCI & Nydus manifest to manifest index for target image, please ensure that OCI manifest already exists in target image", EnvVars: []string{"MULTI_PLATFORM"}},
-				&cli.BoolFlag{Name: "docker-v2-format", Value: false, Usage: "Use docker image manifest v2, schema 2 format", EnvVars: []string{"DOCKER_V2_FORMAT"}},
-				&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type", EnvVars: []string{"BACKEND_TYPE"}},
-				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
-				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
-				&cli.StringFlag{Name: "build-cache", Value: "", Usage: "An remote image reference for accelerating nydus image build", EnvVars: []string{"BUILD_CACHE"}},
-				&cli.StringFlag{Name: "build-cache-tag", Value: "", Usage: "Use $target:$build-cache-tag as cache image reference, conflict with --build-cache", EnvVars: []string{"BUILD_CACHE_TAG"}},
-				&cli.StringFlag{Name: "build-cache-version", Value: "v1", Usage: "Specify the version of cache image, if the existed remote cache image does not match the version, cache records will be dropped", EnvVars: []string{"BUILD_CACHE_VERSION"}},
-				&cli.BoolFlag{Name: "build-cache-insecure", Required: false, Usage: "Allow http/insecure registry communication of cache image", EnvVars: []string{"BUILD_CACHE_INSECURE"}},
-				// The --build-cache-max-records flag represents the maximum number
-				// of layers in cache image. 50 (bootstrap + blob in one record) was
-				// chosen to make it compatible with the 127 max in graph driver of
-				// docker so that we can pull cache image using docker.
-				&cli.UintFlag{Name: "build-cache-max-records", Value: maxCacheMaxRecords, Usage: "Maximum cache records in cache image", EnvVars: []string{"BUILD_CACHE_MAX_RECORDS"}},
-			},
-			Action: func(c *cli.Context) error {
-				logLevel, err := logrus.ParseLevel(c.String("log-level"))
-				if err != nil {
-					return err
-				}
-				logrus.SetLevel(logLevel)
+// parseKeyValues parses the values of slice flag in format key=value.
+func parseKeyValues(c *cli.Context, name string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, value := range c.StringSlice(name) {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid --%s %s, should be in format key=value", name, value)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
 
-				target, err := getTargetReference(c)
-				if err != nil {
-					return err
-				}
+// getConfigMutation returns the mutation of target image config, or nil
+// if no mutation is specified.
+func getConfigMutation(c *cli.Context) (*converter.ConfigMutation, error) {
+	if len(c.StringSlice("label")) == 0 && len(c.StringSlice("annotation")) == 0 &&
+		len(c.StringSlice("env")) == 0 && c.String("user") == "" {
+		return nil, nil
+	}
+	labels, err := parseKeyValues(c, "label")
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := parseKeyValues(c, "annotation")
+	if err != nil {
+		return nil, err
+	}
+	return &converter.ConfigMutation{
+		Labels:      labels,
+		Annotations: annotations,
+		Env:         c.StringSlice("env"),
+		User:        c.String("user"),
+	}, nil
+}
 
-				backendType := c.String("backend-type")
-				possibleBackendTypes := []string{"registry", "oss"}
-				if !isPossibleValue(possibleBackendTypes, backendType) {
-					return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
-				}
+func getMetricsRecorder(c *cli.Context) (*metrics.Recorder, error) {
+	pushGateway := c.String("metrics-push-gateway")
+	otlpEndpoint := c.String("metrics-otlp-endpoint")
+	statsd := c.String("metrics-statsd")
+	if pushGateway == "" && otlpEndpoint == "" && statsd == "" {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	for _, label := range c.StringSlice("metrics-label") {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid metrics label %s, should be in format key=value", label)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return metrics.New(metrics.Opt{
+		PushGateway:  pushGateway,
+		OTLPEndpoint: otlpEndpoint,
+		StatsD:       statsd,
+		Job:          c.String("metrics-job"),
+		Labels:       labels,
+	})
+}
 
-				// This only works for OSS backend rightnow
-				backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
-				if err != nil {
-					return err
-				}
-				if backendType != "registry" && strings.TrimSpace(backendConfig) == "" {
-					return fmt.Errorf("--backend-config or --backend-config-file required")
-				}
+// convertImage converts the source image to target image in work directory
+// by the options of convert command.
+func convertImage(ctx context.Context, c *cli.Context, source, target, workDir string) error {
+	backendType := c.String("backend-type")
+	possibleBackendTypes := []string{"registry", "oss", "s3", "gcs"}
+	if !isPossibleValue(possibleBackendTypes, backendType) {
+		return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
+	}
 
-				var cacheRemote *remote.Remote
-				cache, err := getCacheReference(c, target)
-				if err != nil {
-					return err
-				}
-				if cache != "" {
-					cacheRemote, err = provider.DefaultRemote(cache, c.Bool("build-cache-insecure"))
-					if err != nil {
-						return err
-					}
-				}
+	targetFormat := c.String("target-format")
+	possibleTargetFormats := []string{converter.TargetFormatNydus, converter.TargetFormatEstargz}
+	if !isPossibleValue(possibleTargetFormats, targetFormat) {
+		return fmt.Errorf("--target-format should be one of %v", possibleTargetFormats)
+	}
 
-				cacheMaxRecords := c.Uint("build-cache-max-records")
-				if cacheMaxRecords < 1 {
-					return fmt.Errorf("--build-cache-max-records should be greater than 0")
-				}
-				if cacheMaxRecords > maxCacheMaxRecords {
-					return fmt.Errorf("--build-cache-max-records should not be greater than %d", maxCacheMaxRecords)
-				}
-				cacheVersion := c.String("build-cache-version")
+	compressor := c.String("compressor")
+	possibleCompressors := []string{converter.CompressorNone, converter.CompressorLZ4Block, converter.CompressorZstd}
+	if compressor != "" && !isPossibleValue(possibleCompressors, compressor) {
+		return fmt.Errorf("--compressor should be one of %v", possibleCompressors)
+	}
 
-				logger, err := provider.DefaultLogger()
-				if err != nil {
-					return err
-				}
+	fsVersion := c.String("fs-version")
+	possibleFsVersions := []string{converter.FsVersionV5, converter.FsVersionV6}
+	if fsVersion != "" && !isPossibleValue(possibleFsVersions, fsVersion) {
+		return fmt.Errorf("--fs-version should be one of %v", possibleFsVersions)
+	}
+	sbomFormat := c.String("sbom")
+	possibleSBOMFormats := []string{converter.SBOMFormatSPDX, converter.SBOMFormatCycloneDX}
+	if sbomFormat != "" && !isPossibleValue(possibleSBOMFormats, sbomFormat) {
+		return fmt.Errorf("--sbom should be one of %v", possibleSBOMFormats)
+	}
+	chunkSize, err := parseChunkSize(c, "chunk-size")
+	if err != nil {
+		return err
+	}
+	batchSize, err := parseChunkSize(c, "batch-size")
+	if err != nil {
+		return err
+	}
 
-				sourceDir := filepath.Join(c.String("work-dir"), "source")
-				if err := os.RemoveAll(sourceDir); err != nil {
-					return err
-				}
-				if err := os.MkdirAll(sourceDir, 0755); err != nil {
-					return err
-				}
-				sourceRemote, err := provider.DefaultRemote(c.String("source"), c.Bool("source-insecure"))
-				if err != nil {
-					return errors.Wrap(err, "Parse source reference")
-				}
-				sourceProviders, err := provider.DefaultSource(context.Background(), sourceRemote, sourceDir)
-				if err != nil {
-					return errors.Wrap(err, "Parse source image")
-				}
+	if err := addRegistryTLS(c, source, target); err != nil {
+		return err
+	}
 
-				targetRemote, err := provider.DefaultRemote(target, c.Bool("target-insecure"))
-				if err != nil {
-					return err
-				}
+	// This only works for object storage backends rightnow
+	backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+	if err != nil {
+		return err
+	}
+	if backendType != "registry" && strings.TrimSpace(backendConfig) == "" {
+		return fmt.Errorf("--backend-config or --backend-config-file required")
+	}
+	warnNydusdBackend(backendType)
 
-				opt := converter.Opt{
-					Logger:          logger,
-					SourceProviders: sourceProviders,
+	if c.Bool("reverse") {
+		if provider.IsLocalSource(source) {
+			return fmt.Errorf("--reverse requires the source Nydus image in registry")
+		}
+		targetRemote, err := converter.NewTargetRemote(target, c.Bool("target-insecure"), workDir, getHTTPCache(c))
+		if err != nil {
+			return err
+		}
+		// The blobs are pulled from source registry by default
+		if backendType == "registry" && strings.TrimSpace(backendConfig) == "" {
+			backendType = ""
+		}
+		reverter, err := reverter.New(reverter.Opt{
+			WorkDir:        filepath.Join(workDir, "reverse"),
+			Source:         source,
+			SourceInsecure: c.Bool("source-insecure"),
+			TargetRemote:   targetRemote,
+			NydusdPath:     c.String("nydusd"),
+			BackendType:    backendType,
+			BackendConfig:  backendConfig,
+			DockerV2Format: c.Bool("docker-v2-format"),
+		})
+		if err != nil {
+			return err
+		}
+		desc, err := reverter.Revert(ctx)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Converted to OCI image %s@%s", target, desc.Digest)
+		return nil
+	}
 
-					TargetRemote: targetRemote,
+	var cacheBackend cache.CacheBackend
+	cacheRef, err := getCacheReference(c, target)
+	if err != nil {
+		return err
+	}
+	if cacheRef != "" {
+		cacheBackend, err = converter.NewCacheBackend(cacheRef, c.Bool("build-cache-insecure"), getHTTPCache(c))
+		if err != nil {
+			return err
+		}
+	}
+	if cacheRef == "" && (c.Bool("build-cache-dry-run") || c.String("cache-stats") != "") {
+		return fmt.Errorf("--build-cache-dry-run and --cache-stats require --build-cache or --build-cache-tag")
+	}
 
-					CacheRemote:     cacheRemote,
-					CacheMaxRecords: cacheMaxRecords,
-					CacheVersion:    cacheVersion,
+	var dedupRemote *remote.Remote
+	if dedup := c.String("dedup-from"); dedup != "" {
+		if cacheRef != "" {
+			return fmt.Errorf("--dedup-from conflicts with --build-cache")
+		}
+		dedupRemote, err = provider.DefaultRemote(dedup, c.Bool("dedup-from-insecure"), getHTTPCache(c))
+		if err != nil {
+			return errors.Wrap(err, "Parse dedup reference")
+		}
+	}
+	// The chunk dictionary image is a Nydus image as well, its
+	// chunks are deduplicated in the same way as dedup image.
+	if chunkDict := c.String("chunk-dict"); chunkDict != "" {
+		if cacheRef != "" {
+			return fmt.Errorf("--chunk-dict conflicts with --build-cache")
+		}
+		if dedupRemote != nil {
+			return fmt.Errorf("--chunk-dict conflicts with --dedup-from")
+		}
+		dedupRemote, err = provider.DefaultRemote(chunkDict, c.Bool("chunk-dict-insecure"), getHTTPCache(c))
+		if err != nil {
+			return errors.Wrap(err, "Parse chunk dictionary reference")
+		}
+	}
 
-					WorkDir:        c.String("work-dir"),
-					PrefetchDir:    c.String("prefetch-dir"),
-					NydusImagePath: c.String("nydus-image"),
-					MultiPlatform:  c.Bool("multi-platform"),
-					DockerV2Format: c.Bool("docker-v2-format"),
+	var incrementalRemote *remote.Remote
+	if previous := c.String("incremental-from"); previous != "" {
+		if dedupRemote != nil {
+			return fmt.Errorf("--incremental-from conflicts with --dedup-from and --chunk-dict")
+		}
+		if err := checkSameRepository(previous, target); err != nil {
+			return errors.Wrap(err, "--incremental-from should be in the same repository with target")
+		}
+		incrementalRemote, err = provider.DefaultRemote(previous, c.Bool("target-insecure"), getHTTPCache(c))
+		if err != nil {
+			return errors.Wrap(err, "Parse incremental reference")
+		}
+	}
 
-					BackendType:   backendType,
-					BackendConfig: backendConfig,
-				}
+	cacheMaxRecords := c.Uint("build-cache-max-records")
+	if cacheMaxRecords < 1 {
+		return fmt.Errorf("--build-cache-max-records should be greater than 0")
+	}
+	if cacheMaxRecords > maxCacheMaxRecords {
+		return fmt.Errorf("--build-cache-max-records should not be greater than %d", maxCacheMaxRecords)
+	}
+	cacheVersion := c.String("build-cache-version")
 
-				cvt, err := converter.New(opt)
-				if err != nil {
-					return err
-				}
+	var criticalPathBudget uint64
+	if budget := c.String("critical-path-budget"); budget != "" {
+		criticalPathBudget, err = humanize.ParseBytes(budget)
+		if err != nil {
+			return errors.Wrap(err, "Parse --critical-path-budget")
+		}
+	}
 
-				return cvt.Convert(context.Background())
-			},
-		},
-		{
-			Name:  "check",
-			Usage: "Check nydus image",
-			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "source", Required: false, Usage: "Source image reference", EnvVars: []string{"SOURCE"}},
-				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"TARGET"}},
+	pullRateLimit, err := parseBytes(c, "pull-rate-limit")
+	if err != nil {
+		return err
+	}
+	pushRateLimit, err := parseBytes(c, "push-rate-limit")
+	if err != nil {
+		return err
+	}
 
-				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
-				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+	maxBlobSize, err := parseBytes(c, "max-blob-size")
+	if err != nil {
+		return err
+	}
+	maxFileSize, err := parseBytes(c, "max-file-size")
+	if err != nil {
+		return err
+	}
+	scratchSize, err := parseBytes(c, "scratch-size")
+	if err != nil {
+		return err
+	}
 
-				&cli.BoolFlag{Name: "multi-platform", Value: false, Usage: "Ensure the target image represents a manifest list, and it should consist of OCI and Nydus manifest", EnvVars: []string{"MULTI_PLATFORM"}},
+	logger, err := provider.DefaultLogger()
+	if err != nil {
+		return err
+	}
 
-				&cli.StringFlag{Name: "work-dir", Value: "./output", Usage: "Work directory path for image check, will be cleaned before checking", EnvVars: []string{"WORK_DIR"}},
-				&cli.StringFlag{Name: "nydus-image", Value: "./nydus-image", Usage: "The nydus-image binary path", EnvVars: []string{"NYDUS_IMAGE"}},
-				&cli.StringFlag{Name: "nydusd", Value: "./nydusd", Usage: "The nydusd binary path", EnvVars: []string{"NYDUSD"}},
-				&cli.StringFlag{Name: "backend-type", Value: "", Usage: "Specify Nydus blob storage backend type, will check file data in Nydus image if specified", EnvVars: []string{"BACKEND_TYPE"}},
-				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
-				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
-			},
-			Action: func(c *cli.Context) error {
-				backendType := c.String("backend-type")
-				backendConfig := ""
-				if backendType != "" {
-					_backendConfig, err := parseBackendConfig(
-						c.String("backend-config"), c.String("backend-config-file"),
-					)
-					if err != nil {
-						return err
-					}
-					backendConfig = _backendConfig
-				}
+	sourceDir := filepath.Join(workDir, "source")
+	if err := os.RemoveAll(sourceDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		return err
+	}
+	sourceProviders, err := converter.NewSourceProviders(
+		ctx, source, c.Bool("source-insecure"), sourceDir, c.String("containerd-address"), getHTTPCache(c),
+	)
+	if err != nil {
+		return err
+	}
 
-				checker, err := checker.New(checker.Opt{
+	var encrypter *encryption.Encrypter
+	if recipients := c.StringSlice("encrypt-recipient"); len(recipients) > 0 {
+		encrypter, err = encryption.New(recipients)
+		if err != nil {
+			return errors.Wrap(err, "Parse encryption recipients")
+		}
+		// The blob id in bootstrap is the digest of unencrypted blob, which
+		// isn't found in registry when nydusd loads the blob lazily
+		if !provider.IsLocalTarget(target) {
+			return fmt.Errorf("--encrypt-recipient requires the target image in OCI layout or docker archive")
+		}
+	}
+
+	imageSigner, err := getSigner(c, c.Bool("target-insecure"))
+	if err != nil {
+		return err
+	}
+	if imageSigner != nil && provider.IsLocalTarget(target) {
+		return fmt.Errorf("--sign requires the target image in registry")
+	}
+	if (sbomFormat != "" || c.Bool("provenance")) && provider.IsLocalTarget(target) {
+		return fmt.Errorf("--sbom and --provenance require the target image in registry")
+	}
+	vulnScanner, err := getScanner(c)
+	if err != nil {
+		return err
+	}
+	if vulnScanner != nil && provider.IsLocalTarget(target) {
+		return fmt.Errorf("--vuln-scanner requires the target image in registry")
+	}
+
+	metricsRecorder, err := getMetricsRecorder(c)
+	if err != nil {
+		return err
+	}
+
+	targetRemote, err := converter.NewTargetRemote(target, c.Bool("target-insecure"), workDir, getHTTPCache(c))
+	if err != nil {
+		return err
+	}
+
+	configMutation, err := getConfigMutation(c)
+	if err != nil {
+		return err
+	}
+
+	hooks := []converter.Hook{}
+	for _, hookPath := range c.StringSlice("hook") {
+		hooks = append(hooks, &converter.ExecHook{Path: hookPath})
+	}
+
+	opt := converter.Opt{
+		Logger:          logger,
+		SourceProviders: sourceProviders,
+
+		TargetRemote: targetRemote,
+
+		CacheBackend:    cacheBackend,
+		CacheMaxRecords: cacheMaxRecords,
+		CacheVersion:    cacheVersion,
+		CacheTTL:        c.Duration("build-cache-ttl"),
+		CacheDryRun:     c.Bool("build-cache-dry-run"),
+
+		DedupRemote:       dedupRemote,
+		IncrementalRemote: incrementalRemote,
+		ChunkBloom:        c.Bool("chunk-bloom"),
+
+		WhiteoutSpec: c.String("whiteout-spec"),
+		TargetFormat: targetFormat,
+		Compressor:   compressor,
+		FsVersion:    fsVersion,
+		ChunkSize:    chunkSize,
+		BatchSize:    batchSize,
+		CheckConfig:  c.Bool("check-config"),
+		SBOMFormat:   sbomFormat,
+		Provenance:   c.Bool("provenance"),
+		AliasLabel:   c.Bool("alias-label"),
+		SourceRef:    source,
+
+		ConfigMutation: configMutation,
+
+		CriticalPathBudget:       int64(criticalPathBudget),
+		CriticalPathBudgetStrict: c.Bool("critical-path-budget-strict"),
+
+		MaxBlobSize: int64(maxBlobSize),
+		MaxLayers:   c.Uint("max-layers"),
+		MaxFileSize: int64(maxFileSize),
+
+		WorkDir:        workDir,
+		PrefetchDir:    c.String("prefetch-dir"),
+		NydusImagePath: c.String("nydus-image"),
+		MultiPlatform:  c.Bool("multi-platform"),
+		DockerV2Format: c.Bool("docker-v2-format"),
+		Referrer:       c.Bool("referrer"),
+		Encrypter:      encrypter,
+		Signer:         imageSigner,
+		Metrics:        metricsRecorder,
+		PullRateLimit:  int64(pullRateLimit),
+		PushRateLimit:  int64(pushRateLimit),
+		Hooks:          hooks,
+		IncludePaths:   c.StringSlice("include-path"),
+		ExcludePaths:   c.StringSlice("exclude-path"),
+		Squash:         c.Uint("squash"),
+		Flatten:        c.Bool("flatten"),
+		Scratch: build.ScratchOption{
+			Type: c.String("scratch-type"),
+			Dir:  c.String("scratch-dir"),
+			Size: int64(scratchSize),
+		},
+		Scanner:    vulnScanner,
+		VulnReport: c.String("vuln-report"),
+
+		BackendType:   backendType,
+		BackendConfig: backendConfig,
+	}
+	if remoteBuilder != nil {
+		opt.Runner = remoteBuilder
+	}
+
+	if c.Bool("progress") || c.String("progress-json") != "" {
+		progressOpt := progress.Opt{}
+		if c.Bool("progress") {
+			progressOpt.Terminal = os.Stderr
+		}
+		if progressTarget := c.String("progress-json"); progressTarget != "" {
+			w, err := progress.Open(progressTarget)
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+			progressOpt.JSON = w
+		}
+		opt.Progress = progress.New(progressOpt)
+	}
+
+	var auditor *metrics.Auditor
+	if c.String("audit-log") != "" {
+		auditor = metrics.NewAuditor(c.String("audit-user"), source, target)
+		opt.Progress = opt.Progress.WithHook(auditor.Observe)
+	}
+
+	cvt, err := converter.New(opt)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("dry-run") {
+		plan, err := cvt.Plan(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Plan conversion")
+		}
+		output, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+		return nil
+	}
+
+	err = cvt.Convert(ctx)
+	// The metrics are pushed and the audit record is written for the
+	// failed run as well, and the failures of them don't fail the
+	// conversion
+	if err := metricsRecorder.Push(context.Background()); err != nil {
+		logrus.Warnf("Failed to push metrics: %s", err)
+	}
+	if auditor != nil {
+		if auditErr := writeAudit(c.String("audit-log"), auditor, cvt, err); auditErr != nil {
+			logrus.Warnf("Failed to write audit log: %s", auditErr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if statsPath := c.String("cache-stats"); statsPath != "" {
+		if err := writeCacheStats(statsPath, cvt.CacheStats()); err != nil {
+			return errors.Wrap(err, "Write cache statistics")
+		}
+	}
+
+	return provider.ExportLocalTarget(ctx, target, workDir)
+}
+
+// writeAudit finishes the audit record of conversion and appends it to
+// audit log.
+func writeAudit(path string, auditor *metrics.Auditor, cvt *converter.Converter, convertErr error) error {
+	var sourceDigest, targetDigest string
+	if desc := cvt.SourceManifest(); desc != nil {
+		sourceDigest = desc.Digest.String()
+	}
+	if desc := cvt.TargetManifest(); desc != nil {
+		targetDigest = desc.Digest.String()
+	}
+	var hits, misses int
+	var bytesSaved int64
+	if stats := cvt.CacheStats(); stats != nil {
+		hits, misses, bytesSaved = stats.Hits, stats.Misses, stats.BytesSaved
+	}
+	record := auditor.Finish(sourceDigest, targetDigest, hits, misses, bytesSaved, convertErr)
+	return metrics.WriteAudit(path, record)
+}
+
+// writeCacheStats writes the statistics of build cache as JSON to the
+// file, or to stdout if path is `-`.
+func writeCacheStats(path string, stats *converter.CacheStats) error {
+	output, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	output = append(output, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(output)
+		return err
+	}
+	return ioutil.WriteFile(path, output, 0644)
+}
+
+// convertImages converts the images in source list concurrently, the target
+// is resolved by --target-suffix or --referrer if it isn't in the list.
+func convertImages(c *cli.Context) error {
+	if c.String("source") != "" || c.String("target") != "" {
+		return fmt.Errorf("--source-list conflicts with --source and --target")
+	}
+
+	listPath := c.String("source-list")
+	list := os.Stdin
+	if listPath != "-" {
+		file, err := os.Open(listPath)
+		if err != nil {
+			return errors.Wrap(err, "Open source list")
+		}
+		defer file.Close()
+		list = file
+	}
+	images, err := batch.ParseList(list)
+	if err != nil {
+		return errors.Wrap(err, "Parse source list")
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("no image found in source list")
+	}
+	for idx := range images {
+		if images[idx].Target != "" {
+			continue
+		}
+		images[idx].Target, err = getTargetReference(c, images[idx].Source)
+		if err != nil {
+			return errors.Wrapf(err, "Resolve target of %s", images[idx].Source)
+		}
+	}
+
+	// Each image is converted in its own work directory
+	results := batch.Run(context.Background(), images, c.Uint("batch-workers"), func(ctx context.Context, index int, image batch.Image) error {
+		workDir := filepath.Join(c.String("work-dir"), strconv.Itoa(index))
+		defer os.RemoveAll(workDir)
+		return convertImage(ctx, c, image.Source, image.Target, workDir)
+	})
+	if err := batch.PrintSummary(os.Stdout, results); err != nil {
+		return err
+	}
+
+	return batch.Failures(results)
+}
+
+// mirrorImages converts the images in source registry to target registry.
+func mirrorImages(c *cli.Context) error {
+	if c.String("source") != "" || c.String("target") != "" || c.String("source-list") != "" {
+		return fmt.Errorf("--source-registry conflicts with --source, --target and --source-list")
+	}
+	if c.String("target-registry") == "" {
+		return fmt.Errorf("--target-registry is required for --source-registry")
+	}
+	if c.Bool("referrer") {
+		return fmt.Errorf("--source-registry conflicts with --referrer")
+	}
+
+	parsePatterns := func(name string) ([]*regexp.Regexp, error) {
+		patterns := []*regexp.Regexp{}
+		for _, expr := range c.StringSlice(name) {
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Parse --%s", name)
+			}
+			patterns = append(patterns, pattern)
+		}
+		return patterns, nil
+	}
+	include, err := parsePatterns("mirror-include")
+	if err != nil {
+		return err
+	}
+	exclude, err := parsePatterns("mirror-exclude")
+	if err != nil {
+		return err
+	}
+
+	if err := provider.AddHostTLS(c.String("source-registry"), getTLSOpt(c, "source")); err != nil {
+		return err
+	}
+
+	m, err := mirror.New(mirror.Opt{
+		SourceRegistry: c.String("source-registry"),
+		SourceInsecure: c.Bool("source-insecure"),
+		TargetRegistry: c.String("target-registry"),
+		TargetSuffix:   c.String("target-suffix"),
+		Include:        include,
+		Exclude:        exclude,
+		StatePath:      c.String("mirror-state"),
+		Workers:        c.Uint("batch-workers"),
+		HTTPCacheDir:   c.String("http-cache-dir"),
+	})
+	if err != nil {
+		return err
+	}
+
+	results, err := m.Run(context.Background(), func(ctx context.Context, index int, image batch.Image) error {
+		workDir := filepath.Join(c.String("work-dir"), strconv.Itoa(index))
+		defer os.RemoveAll(workDir)
+		return convertImage(ctx, c, image.Source, image.Target, workDir)
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.PrintSummary(os.Stdout, results); err != nil {
+		return err
+	}
+
+	return batch.Failures(results)
+}
+
+// getWebhookOpt parses the webhook options of serve command, the images
+// pushed by conversion are excluded to avoid converting them again.
+func getWebhookOpt(c *cli.Context) (*server.WebhookOpt, error) {
+	parsePatterns := func(exprs []string) ([]*regexp.Regexp, error) {
+		patterns := []*regexp.Regexp{}
+		for _, expr := range exprs {
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Parse webhook pattern %s", expr)
+			}
+			patterns = append(patterns, pattern)
+		}
+		return patterns, nil
+	}
+
+	include, err := parsePatterns(c.StringSlice("webhook-include"))
+	if err != nil {
+		return nil, err
+	}
+	excludeExprs := c.StringSlice("webhook-exclude")
+	if suffix := c.String("target-suffix"); suffix != "" {
+		excludeExprs = append(excludeExprs, fmt.Sprintf(":.*%s$", regexp.QuoteMeta(suffix)))
+	}
+	if cacheTag := c.String("build-cache-tag"); cacheTag != "" {
+		excludeExprs = append(excludeExprs, fmt.Sprintf(":%s$", regexp.QuoteMeta(cacheTag)))
+	}
+	exclude, err := parsePatterns(excludeExprs)
+	if err != nil {
+		return nil, err
+	}
+
+	registries := c.StringSlice("webhook-registry")
+	if len(registries) == 0 {
+		return nil, fmt.Errorf("--webhook-registry is required by --webhook")
+	}
+
+	return &server.WebhookOpt{
+		Token:      c.String("webhook-token"),
+		Registries: registries,
+		Include:    include,
+		Exclude:    exclude,
+	}, nil
+}
+
+func main() {
+	logrus.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp: true,
+	})
+
+	version := fmt.Sprintf("%s.%s", versionGitCommit, versionBuildTime)
+
+	app := &cli.App{
+		Name:    "Nydusify",
+		Usage:   "Nydus image converter tool",
+		Version: version,
+	}
+
+	logrus.Infof("Version: %s\n", version)
+
+	// The options of convert command are shared by serve command as the
+	// defaults of conversion jobs
+	convertFlags := []cli.Flag{
+		&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+		&cli.StringFlag{Name: "source", Required: false, Usage: "Source image reference, use docker-daemon://<image> or containerd://<namespace>/<image> for the image in local image store, oci://<dir>[:<tag>] or docker-archive://<file>[:<image>] for the image in local file system", EnvVars: []string{"SOURCE"}},
+		&cli.StringFlag{Name: "target", Required: false, Usage: "Target (Nydus) image reference, use oci://<dir>[:<tag>] or docker-archive://<file>[:<image>] to write the image to local file system", EnvVars: []string{"TARGET"}},
+		&cli.StringFlag{Name: "source-list", Value: "", TakesFile: true, Usage: "Path of source list to convert many images concurrently, with one image per line in format <source> [<target>], the target defaults to the one resolved by --target-suffix or --referrer, - for stdin, conflicts with --source and --target", EnvVars: []string{"SOURCE_LIST"}},
+		&cli.UintFlag{Name: "batch-workers", Value: 4, Usage: "Maximum count of images converted at the same time for --source-list", EnvVars: []string{"BATCH_WORKERS"}},
+		&cli.StringFlag{Name: "source-registry", Value: "", Usage: "Convert all images enumerated by catalog API in the source registry host to --target-registry, conflicts with --source, --target and --source-list", EnvVars: []string{"SOURCE_REGISTRY"}},
+		&cli.StringFlag{Name: "target-registry", Value: "", Usage: "Target registry host with an optional namespace for --source-registry, e.g. myregistry/nydus, <repository>:<tag> is converted to <target registry>/<repository>:<tag><target suffix>", EnvVars: []string{"TARGET_REGISTRY"}},
+		&cli.StringSliceFlag{Name: "mirror-include", Usage: "Only convert the images whose <repository>:<tag> matches the regular expression for --source-registry, can be specified multiple times", EnvVars: []string{"MIRROR_INCLUDE"}},
+		&cli.StringSliceFlag{Name: "mirror-exclude", Usage: "Skip the images whose <repository>:<tag> matches the regular expression for --source-registry, can be specified multiple times", EnvVars: []string{"MIRROR_EXCLUDE"}},
+		&cli.StringFlag{Name: "mirror-state", Value: "", TakesFile: true, Usage: "Path of state file recording the converted images for --source-registry, the images converted from the same digest are skipped on re-runs", EnvVars: []string{"MIRROR_STATE"}},
+		&cli.StringFlag{Name: "target-suffix", Required: false, Usage: "Add suffix to source image reference as target image reference, conflict with --target", EnvVars: []string{"TARGET_SUFFIX"}},
+
+		&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
+		&cli.StringFlag{Name: "source-ca", Value: "", TakesFile: true, Usage: "Path of PEM encoded CA certificate trusted for source registry in addition to system ones", EnvVars: []string{"SOURCE_CA"}},
+		&cli.StringFlag{Name: "source-cert", Value: "", TakesFile: true, Usage: "Path of PEM encoded client certificate for source registry requiring mutual TLS, requires --source-key", EnvVars: []string{"SOURCE_CERT"}},
+		&cli.StringFlag{Name: "source-key", Value: "", TakesFile: true, Usage: "Path of PEM encoded client key for --source-cert", EnvVars: []string{"SOURCE_KEY"}},
+		&cli.StringFlag{Name: "containerd-address", Value: provider.DefaultContainerdAddress, Usage: "Containerd address for the source image in containerd:// scheme", EnvVars: []string{"CONTAINERD_ADDRESS"}},
+		&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+
+		&cli.StringFlag{Name: "target-ca", Value: "", TakesFile: true, Usage: "Path of PEM encoded CA certificate trusted for target registry in addition to system ones", EnvVars: []string{"TARGET_CA"}},
+		&cli.StringFlag{Name: "target-cert", Value: "", TakesFile: true, Usage: "Path of PEM encoded client certificate for target registry requiring mutual TLS, requires --target-key", EnvVars: []string{"TARGET_CERT"}},
+		&cli.StringFlag{Name: "target-key", Value: "", TakesFile: true, Usage: "Path of PEM encoded client key for --target-cert", EnvVars: []string{"TARGET_KEY"}},
+		&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for image conversion", EnvVars: []string{"WORK_DIR"}},
+		&cli.StringFlag{Name: "prefetch-dir", Value: "/", Usage: "Prefetch directory for nydus image, use absolute path of rootfs", EnvVars: []string{"PREFETCH_DIR"}},
+		&cli.StringFlag{Name: "nydus-image", Value: "./nydus-image", Usage: "The nydus-image binary path", EnvVars: []string{"NYDUS_IMAGE"}},
+		&cli.StringSliceFlag{Name: "remote-builder", Usage: "Address of builder agent started by nydusify builder-agent in format host:port, the layers are built on the least busy agent instead of by local nydus-image, can be specified multiple times", EnvVars: []string{"REMOTE_BUILDER"}},
+		&cli.BoolFlag{Name: "remote-builder-tls", Value: false, Usage: "Connect the builder agents over TLS", EnvVars: []string{"REMOTE_BUILDER_TLS"}},
+		&cli.StringFlag{Name: "remote-builder-ca", Value: "", TakesFile: true, Usage: "Path of PEM encoded CA certificate trusted for builder agents in addition to system ones, requires --remote-builder-tls", EnvVars: []string{"REMOTE_BUILDER_CA"}},
+		&cli.StringFlag{Name: "remote-builder-cert", Value: "", TakesFile: true, Usage: "Path of PEM encoded client certificate for builder agents requiring mutual TLS, requires --remote-builder-tls and --remote-builder-key", EnvVars: []string{"REMOTE_BUILDER_CERT"}},
+		&cli.StringFlag{Name: "remote-builder-key", Value: "", TakesFile: true, Usage: "Path of PEM encoded client key for --remote-builder-cert", EnvVars: []string{"REMOTE_BUILDER_KEY"}},
+		&cli.StringFlag{Name: "remote-builder-token", Value: "", Usage: "Bearer token for builder agents started with --token, requires --remote-builder-tls", EnvVars: []string{"REMOTE_BUILDER_TOKEN"}},
+		&cli.BoolFlag{Name: "multi-platform", Value: false, Usage: "Merge OCI & Nydus manifest to manifest index for target image, please ensure that OCI manifest already exists in target image", EnvVars: []string{"MULTI_PLATFORM"}},
+		&cli.BoolFlag{Name: "docker-v2-format", Value: false, Usage: "Use docker image manifest v2, schema 2 format", EnvVars: []string{"DOCKER_V2_FORMAT"}},
+		&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type, possible values: registry, oss, s3, gcs", EnvVars: []string{"BACKEND_TYPE"}},
+		&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+		&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+		&cli.StringFlag{Name: "build-cache", Value: "", Usage: "An remote image reference, a local directory in format dir:///path or an object storage location in format <oss|s3|gcs>://bucket/prefix for accelerating nydus image build", EnvVars: []string{"BUILD_CACHE"}},
+		&cli.StringFlag{Name: "build-cache-tag", Value: "", Usage: "Use $target:$build-cache-tag as cache image reference, conflict with --build-cache", EnvVars: []string{"BUILD_CACHE_TAG"}},
+		&cli.StringFlag{Name: "build-cache-version", Value: "v1", Usage: "Specify the version of cache image, if the existed remote cache image does not match the version, cache records will be dropped", EnvVars: []string{"BUILD_CACHE_VERSION"}},
+		&cli.BoolFlag{Name: "build-cache-insecure", Required: false, Usage: "Allow http/insecure registry communication of cache image", EnvVars: []string{"BUILD_CACHE_INSECURE"}},
+		&cli.DurationFlag{Name: "build-cache-ttl", Value: 0, Usage: "Ignore the cache records not hit or recorded within the duration, e.g. 720h, the records never expire if it's 0", EnvVars: []string{"BUILD_CACHE_TTL"}},
+		&cli.BoolFlag{Name: "build-cache-dry-run", Required: false, Usage: "Use the records in cache image without pushing layers and records to it", EnvVars: []string{"BUILD_CACHE_DRY_RUN"}},
+		&cli.BoolFlag{Name: "dry-run", Required: false, Usage: "Resolve source image, plan layers against cache and incremental image and push a tiny probe blob to check target permission, print the plan as JSON without building or pushing target image", EnvVars: []string{"DRY_RUN"}},
+		&cli.StringFlag{Name: "cache-stats", Value: "", TakesFile: true, Usage: "Write the cache hits, misses, bytes saved and the records added to cache image as JSON to the file, or to stdout if it's -", EnvVars: []string{"CACHE_STATS"}},
+		// The --build-cache-max-records flag represents the maximum number
+		// of records in cache image. 50 (bootstrap + blob in one record) was
+		// chosen to make it compatible with the 127 max in graph driver of
+		// docker so that we can pull cache image using docker, the records
+		// exceeding it are split into multiple pages.
+		&cli.UintFlag{Name: "build-cache-max-records", Value: defaultCacheMaxRecords, Usage: "Maximum cache records in cache image", EnvVars: []string{"BUILD_CACHE_MAX_RECORDS"}},
+		&cli.StringFlag{Name: "http-cache-dir", Value: "", Usage: "Cache manifest and config responses from registry in the directory, will be shared across conversions", EnvVars: []string{"HTTP_CACHE_DIR"}},
+		&cli.BoolFlag{Name: "content-store", Required: false, Usage: "Store the pulled source layers in $work-dir/content shared across conversions, so that the layers shared by images are pulled only once", EnvVars: []string{"CONTENT_STORE"}},
+		&cli.StringFlag{Name: "content-store-size", Value: "10GiB", Usage: "Remove the least recently used layers from content store once its size exceeds the limit, unlimited if it's 0", EnvVars: []string{"CONTENT_STORE_SIZE"}},
+		&cli.StringFlag{Name: "dedup-from", Value: "", Usage: "An existing Nydus image reference, only the chunks not existed in its blobs will be dumped to target blobs, conflict with --build-cache, requires nydus-image supporting --chunk-dict", EnvVars: []string{"DEDUP_FROM"}},
+		&cli.BoolFlag{Name: "dedup-from-insecure", Required: false, Usage: "Allow http/insecure registry communication of dedup image", EnvVars: []string{"DEDUP_FROM_INSECURE"}},
+		&cli.StringFlag{Name: "chunk-dict", Value: "", Usage: "A chunk dictionary image generated by nydusify chunkdict generate, the chunks existed in it will be referenced instead of being dumped to target blobs, conflict with --build-cache and --dedup-from", EnvVars: []string{"CHUNK_DICT"}},
+		&cli.BoolFlag{Name: "chunk-dict-insecure", Required: false, Usage: "Allow http/insecure registry communication of chunk dictionary image", EnvVars: []string{"CHUNK_DICT_INSECURE"}},
+		&cli.StringFlag{Name: "incremental-from", Value: "", Usage: "A Nydus image previously converted in target repository, the Nydus layers built from the source layers shared with it will be reused, conflict with --dedup-from", EnvVars: []string{"INCREMENTAL_FROM"}},
+		&cli.BoolFlag{Name: "chunk-bloom", Required: false, Usage: "Publish a bloom filter of chunk digests to target repository for estimating chunk overlap between images", EnvVars: []string{"CHUNK_BLOOM"}},
+		&cli.StringFlag{Name: "whiteout-spec", Value: "auto", Usage: "Whiteout spec used to build source layers, auto selects overlayfs for RAFS v6, otherwise by the type of source layer, possible values: auto, oci, overlayfs", EnvVars: []string{"WHITEOUT_SPEC"}},
+		&cli.BoolFlag{Name: "reverse", Required: false, Usage: "Convert the source Nydus image back to OCI image with a single gzip layer packed from its rootfs, the backend options specify the storage backend of source blobs", EnvVars: []string{"REVERSE"}},
+		&cli.StringFlag{Name: "nydusd", Value: "./nydusd", Usage: "The nydusd binary path to mount source Nydus image for --reverse", EnvVars: []string{"NYDUSD"}},
+		&cli.StringFlag{Name: "target-format", Value: "nydus", Usage: "Image format of target image, estargz converts source layers to eStargz layers for stargz snapshotter instead of Nydus, possible values: nydus, estargz", EnvVars: []string{"TARGET_FORMAT"}},
+		&cli.StringFlag{Name: "compressor", Value: "", Usage: "Compression algorithm of Nydus blobs, defaults to lz4_block, zstd requires nydus-image supporting it and also compresses the bootstrap layer with zstd in OCI format if zstd binary is found, possible values: none, lz4_block, zstd", EnvVars: []string{"COMPRESSOR"}},
+		&cli.StringFlag{Name: "fs-version", Value: "", Usage: "RAFS version of Nydus image, 6 is compatible with EROFS, defaults to the one of nydus-image, possible values: 5, 6", EnvVars: []string{"FS_VERSION"}},
+		&cli.StringFlag{Name: "chunk-size", Value: "", Usage: "Size of data chunk in Nydus blobs, power of two between 0x1000 and 0x1000000, e.g. 0x100000 or 1MiB, defaults to the one of nydus-image", EnvVars: []string{"CHUNK_SIZE"}},
+		&cli.StringFlag{Name: "batch-size", Value: "", Usage: "Size to merge small chunks into, power of two between 0x1000 and 0x1000000, ignored if unsupported by nydus-image", EnvVars: []string{"BATCH_SIZE"}},
+		&cli.BoolFlag{Name: "referrer", Required: false, Usage: "Push Nydus manifest as a referrer of source manifest by OCI referrers API instead of tagging it, target defaults to the source repository", EnvVars: []string{"REFERRER"}},
+		&cli.BoolFlag{Name: "check-config", Required: false, Usage: "Check the user and entrypoint of image config against the rootfs of target image, fail the conversion if problem found", EnvVars: []string{"CHECK_CONFIG"}},
+		&cli.StringFlag{Name: "sbom", Value: "", Usage: "Generate the SBOM of the packages installed in target image and attach it to Nydus manifest by OCI referrers API, possible values: spdx, cyclonedx", EnvVars: []string{"SBOM"}},
+		&cli.BoolFlag{Name: "provenance", Required: false, Usage: "Attach a SLSA provenance recording the source image digest and conversion options to Nydus manifest by OCI referrers API", EnvVars: []string{"PROVENANCE"}},
+		&cli.BoolFlag{Name: "alias-label", Required: false, Usage: "Annotate Nydus manifest with the repository, tag and digest of source image, and record it in the conversion index of target repository listed by nydusify ls", EnvVars: []string{"ALIAS_LABEL"}},
+		&cli.StringFlag{Name: "critical-path-budget", Value: "", Usage: "Warn if the size of files needed before entrypoint starts (files in prefetch dir, entrypoint and its dependencies) exceeds the budget, e.g. 100MiB", EnvVars: []string{"CRITICAL_PATH_BUDGET"}},
+		&cli.BoolFlag{Name: "critical-path-budget-strict", Required: false, Usage: "Fail the conversion instead of warning if --critical-path-budget is exceeded", EnvVars: []string{"CRITICAL_PATH_BUDGET_STRICT"}},
+		&cli.StringFlag{Name: "max-blob-size", Value: "", Usage: "Abort the conversion if the total size of blobs referenced by target image exceeds the limit, e.g. 10GiB", EnvVars: []string{"MAX_BLOB_SIZE"}},
+		&cli.UintFlag{Name: "max-layers", Value: 0, Usage: "Abort the conversion if the source image has more layers than the limit, 0 means no limit", EnvVars: []string{"MAX_LAYERS"}},
+		&cli.StringFlag{Name: "max-file-size", Value: "", Usage: "Abort the conversion if a file in source layers is larger than the limit, e.g. 2GiB", EnvVars: []string{"MAX_FILE_SIZE"}},
+		&cli.StringSliceFlag{Name: "encrypt-recipient", Usage: "Encrypt Nydus blob layers in ocicrypt format for the recipient, in format jwe:<path of RSA public key>, can be specified multiple times, requires the target image in OCI layout or docker archive, which must be decrypted before lazy loading", EnvVars: []string{"ENCRYPT_RECIPIENT"}},
+		&cli.StringFlag{Name: "sign", Value: "", Usage: "Sign Nydus manifest after conversion by the signing tool, the signature is pushed to target repository, possible values: cosign, notation", EnvVars: []string{"SIGN"}},
+		&cli.StringFlag{Name: "sign-key", Value: "", Usage: "The key for --sign, a private key path or KMS URI for cosign, a key name for notation", EnvVars: []string{"SIGN_KEY"}},
+		&cli.StringFlag{Name: "sign-tool-path", Value: "", Usage: "The binary path of signing tool, looked up in PATH by default", EnvVars: []string{"SIGN_TOOL_PATH"}},
+		&cli.StringSliceFlag{Name: "label", Usage: "Set label of target image config in format key=value, remove it if value is empty, can be specified multiple times", EnvVars: []string{"LABEL"}},
+		&cli.StringSliceFlag{Name: "annotation", Usage: "Set annotation of target manifest in format key=value, can be specified multiple times", EnvVars: []string{"ANNOTATION"}},
+		&cli.StringSliceFlag{Name: "env", Usage: "Set environment variable of target image config in format KEY=value, e.g. NYDUS_PREFETCH=true, can be specified multiple times", EnvVars: []string{"IMAGE_ENV"}},
+		&cli.StringFlag{Name: "user", Value: "", Usage: "Override the user of target image config, e.g. 1000:1000", EnvVars: []string{"IMAGE_USER"}},
+		&cli.StringSliceFlag{Name: "hook", Usage: "Path of hook program executed before and after building each layer and before pushing manifest, with the event name as argument and the event in JSON as stdin, non-zero exit aborts the conversion, can be specified multiple times", EnvVars: []string{"HOOK"}},
+		&cli.StringSliceFlag{Name: "include-path", Usage: "Keep only the paths matched by the absolute glob pattern in target image, ** matches any levels of directories, e.g. /usr/**/*.so, can be specified multiple times", EnvVars: []string{"INCLUDE_PATH"}},
+		&cli.StringSliceFlag{Name: "exclude-path", Usage: "Drop the paths matched by the absolute glob pattern from target image, ** matches any levels of directories, e.g. /usr/share/doc, can be specified multiple times", EnvVars: []string{"EXCLUDE_PATH"}},
+		&cli.UintFlag{Name: "squash", Value: 0, Usage: "Merge the lowest N source layers into one Nydus layer to reduce the layer count of target image, conflicts with cache and incremental image", EnvVars: []string{"SQUASH"}},
+		&cli.BoolFlag{Name: "flatten", Value: false, Usage: "Merge all the source layers into one Nydus layer, conflicts with cache and incremental image", EnvVars: []string{"FLATTEN"}},
+		&cli.StringFlag{Name: "scratch-type", Value: "disk", Usage: "Where the source layers are unpacked for building, possible values: disk, tmpfs (requires root), stream (pipe the layers into nydus-image without unpacking)", EnvVars: []string{"SCRATCH_TYPE"}},
+		&cli.StringFlag{Name: "scratch-dir", Value: "", Usage: "The directory of disk or tmpfs scratch, e.g. the mountpoint of a dedicated disk, defaults to `scratch` in work directory", EnvVars: []string{"SCRATCH_DIR"}},
+		&cli.StringFlag{Name: "scratch-size", Value: "", Usage: "Cap the total size of the source layers unpacked in disk or tmpfs scratch, e.g. 20GiB", EnvVars: []string{"SCRATCH_SIZE"}},
+		&cli.StringFlag{Name: "vuln-scanner", Value: "", Usage: "Scan the vulnerabilities of source layers by the scanning tool and attach the report to Nydus manifest, possible values: trivy, grype", EnvVars: []string{"VULN_SCANNER"}},
+		&cli.StringFlag{Name: "vuln-scanner-path", Value: "", Usage: "The binary path of vulnerability scanning tool, looked up in PATH by default", EnvVars: []string{"VULN_SCANNER_PATH"}},
+		&cli.StringFlag{Name: "fail-on", Value: "", Usage: "Abort the conversion without pushing manifest if a vulnerability at or above the severity is found, possible values: low, medium, high, critical", EnvVars: []string{"FAIL_ON"}},
+		&cli.StringFlag{Name: "vuln-report", Value: "", Usage: "Write the vulnerability report in JSON to the file", EnvVars: []string{"VULN_REPORT"}},
+		&cli.BoolFlag{Name: "progress", Required: false, Usage: "Print the progress of pulling, building and pushing each layer to stderr", EnvVars: []string{"PROGRESS"}},
+		&cli.StringFlag{Name: "progress-json", Value: "", Usage: "Write the progress as JSON event stream with one event per line, to fd://<number>, unix://<socket path> or a file path", EnvVars: []string{"PROGRESS_JSON"}},
+		&cli.StringFlag{Name: "pull-rate-limit", Value: "", Usage: "Cap the bandwidth of pulling in bytes per second shared by all concurrent pulls, e.g. 10MiB", EnvVars: []string{"PULL_RATE_LIMIT"}},
+		&cli.StringFlag{Name: "push-rate-limit", Value: "", Usage: "Cap the bandwidth of pushing in bytes per second shared by all concurrent pushes, e.g. 10MiB", EnvVars: []string{"PUSH_RATE_LIMIT"}},
+		&cli.StringFlag{Name: "metrics-push-gateway", Value: "", Usage: "Push the conversion metrics to Prometheus Pushgateway at the end of run, e.g. http://pushgateway:9091", EnvVars: []string{"METRICS_PUSH_GATEWAY"}},
+		&cli.StringFlag{Name: "metrics-otlp-endpoint", Value: "", Usage: "Push the conversion metrics to OTLP/HTTP metrics endpoint at the end of run, e.g. http://collector:4318", EnvVars: []string{"METRICS_OTLP_ENDPOINT"}},
+		&cli.StringFlag{Name: "metrics-statsd", Value: "", Usage: "Push the conversion metrics to StatsD server by UDP at the end of run, the labels are sent as DogStatsD tags, e.g. statsd:8125", EnvVars: []string{"METRICS_STATSD"}},
+		&cli.StringFlag{Name: "metrics-job", Value: "nydusify", Usage: "The job name of Pushgateway grouping key and the service name of OTLP resource", EnvVars: []string{"METRICS_JOB"}},
+		&cli.StringSliceFlag{Name: "metrics-label", Usage: "Extra label of pushed metrics in format key=value, e.g. pipeline=build, can be specified multiple times", EnvVars: []string{"METRICS_LABEL"}},
+		&cli.StringFlag{Name: "audit-log", Value: "", Usage: "Append an audit record of each conversion as a JSON line to the file, or write it to stdout if it's -", EnvVars: []string{"AUDIT_LOG"}},
+		&cli.StringFlag{Name: "audit-user", Value: "", Usage: "The user triggering the conversion recorded in audit log, defaults to the user running nydusify", EnvVars: []string{"AUDIT_USER"}},
+	}
+
+	app.Commands = []*cli.Command{
+		{
+			Name:  "convert",
+			Usage: "Convert source image to nydus image",
+			Flags: convertFlags,
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				if err := setupContentStore(c); err != nil {
+					return err
+				}
+				if err := setupRemoteBuilder(c); err != nil {
+					return err
+				}
+
+				if c.String("cache-stats") != "" && (c.String("source-registry") != "" || c.String("source-list") != "") {
+					return fmt.Errorf("--cache-stats conflicts with --source-list and --source-registry")
+				}
+				if c.Bool("dry-run") && (c.String("source-registry") != "" || c.String("source-list") != "") {
+					return fmt.Errorf("--dry-run conflicts with --source-list and --source-registry")
+				}
+				if c.String("source-registry") != "" {
+					return mirrorImages(c)
+				}
+				if c.String("source-list") != "" {
+					return convertImages(c)
+				}
+				if c.String("source") == "" {
+					return fmt.Errorf("--source, --source-list or --source-registry is required")
+				}
+
+				target, err := getTargetReference(c, c.String("source"))
+				if err != nil {
+					return err
+				}
+
+				return convertImage(context.Background(), c, c.String("source"), target, c.String("work-dir"))
+			},
+		},
+		{
+			Name:  "serve",
+			Usage: "Run conversion service accepting conversion jobs by REST API",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{Name: "addr", Value: "127.0.0.1:8080", Usage: "The address to listen on for REST API, --api-token is required if it isn't a loopback address", EnvVars: []string{"ADDR"}},
+				&cli.StringFlag{Name: "api-token", Value: "", Usage: "Reject the job API requests whose Authorization header isn't the token", EnvVars: []string{"API_TOKEN"}},
+				&cli.UintFlag{Name: "workers", Value: 4, Usage: "Maximum count of jobs running at the same time", EnvVars: []string{"WORKERS"}},
+				&cli.UintFlag{Name: "queue-size", Value: 100, Usage: "Maximum count of queued jobs, the jobs submitted when the queue is full are rejected", EnvVars: []string{"QUEUE_SIZE"}},
+				&cli.BoolFlag{Name: "webhook", Required: false, Usage: "Receive push events by Harbor webhook and docker distribution notification, and convert the pushed images automatically", EnvVars: []string{"WEBHOOK"}},
+				&cli.StringFlag{Name: "webhook-token", Value: "", Usage: "Reject the webhook requests whose Authorization header isn't the token", EnvVars: []string{"WEBHOOK_TOKEN"}},
+				&cli.StringSliceFlag{Name: "webhook-registry", Usage: "Only convert the images pushed to the registry host, required by --webhook, can be specified multiple times", EnvVars: []string{"WEBHOOK_REGISTRY"}},
+				&cli.StringSliceFlag{Name: "webhook-include", Usage: "Only convert the pushed images whose <repository>:<tag> matches the regular expression, can be specified multiple times", EnvVars: []string{"WEBHOOK_INCLUDE"}},
+				&cli.StringSliceFlag{Name: "webhook-exclude", Usage: "Skip the pushed images whose <repository>:<tag> matches the regular expression, can be specified multiple times", EnvVars: []string{"WEBHOOK_EXCLUDE"}},
+			}, convertFlags...),
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				if err := setupContentStore(c); err != nil {
+					return err
+				}
+				if err := setupRemoteBuilder(c); err != nil {
+					return err
+				}
+
+				if c.String("cache-stats") != "" || c.Bool("dry-run") {
+					return fmt.Errorf("--cache-stats and --dry-run aren't supported by serve command")
+				}
+				if err := server.CheckAddress(c.String("addr"), c.String("api-token")); err != nil {
+					return err
+				}
+
+				var webhook *server.WebhookOpt
+				if c.Bool("webhook") {
+					webhook, err = getWebhookOpt(c)
+					if err != nil {
+						return err
+					}
+				}
+
+				// The options of convert command are applied to all jobs,
+				// except the source and target specified by job
+				srv := server.New(server.Opt{
+					Convert: func(ctx context.Context, source, target string) error {
+						if err := os.MkdirAll(c.String("work-dir"), 0755); err != nil {
+							return err
+						}
+						workDir, err := ioutil.TempDir(c.String("work-dir"), "job-")
+						if err != nil {
+							return err
+						}
+						defer os.RemoveAll(workDir)
+						return convertImage(ctx, c, source, target, workDir)
+					},
+					Resolve: func(source, target string) (string, error) {
+						if provider.IsLocalSource(source) || provider.IsLocalTarget(target) {
+							return "", fmt.Errorf("the source and target image should be in registry")
+						}
+						if target != "" {
+							return target, nil
+						}
+						return getTargetReference(c, source)
+					},
+					Workers:   c.Uint("workers"),
+					QueueSize: c.Uint("queue-size"),
+					Token:     c.String("api-token"),
+					Webhook:   webhook,
+				})
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				srv.Start(ctx)
+
+				httpServer := &http.Server{
+					Addr:    c.String("addr"),
+					Handler: srv.Handler(),
+				}
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				defer signal.Stop(signals)
+				go func() {
+					<-signals
+					logrus.Infof("Shutting down, the running jobs are canceled")
+					cancel()
+					httpServer.Shutdown(context.Background())
+				}()
+
+				logrus.Infof("Serving conversion API on %s", c.String("addr"))
+				if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					return err
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "webhook",
+			Usage: "Run admission webhook rejecting or flagging malformed Nydus images, as Kubernetes validating webhook or Harbor scanner adapter",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "addr", Value: ":8443", Usage: "The address to listen on", EnvVars: []string{"ADDR"}},
+				&cli.StringFlag{Name: "tls-cert", Value: "", TakesFile: true, Usage: "The certificate file to serve HTTPS, required by Kubernetes, HTTP is served if it's not specified", EnvVars: []string{"TLS_CERT"}},
+				&cli.StringFlag{Name: "tls-key", Value: "", TakesFile: true, Usage: "The private key file of --tls-cert", EnvVars: []string{"TLS_KEY"}},
+				&cli.StringFlag{Name: "mode", Value: admission.ModeEnforce, Usage: "Reject the workloads with malformed Nydus images (enforce), or admit them with warnings (warn), possible values: enforce, warn", EnvVars: []string{"MODE"}},
+				&cli.BoolFlag{Name: "insecure", Required: false, Usage: "Allow http/insecure registry communication for the images in Kubernetes workloads", EnvVars: []string{"INSECURE"}},
+				&cli.StringFlag{Name: "http-cache-dir", Value: "", Usage: "Cache manifest and config responses from registry in the directory, will be shared across checks", EnvVars: []string{"HTTP_CACHE_DIR"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				if (c.String("tls-cert") == "") != (c.String("tls-key") == "") {
+					return fmt.Errorf("--tls-cert and --tls-key should be specified together")
+				}
+
+				srv, err := admission.New(admission.Opt{
+					Check: func(ctx context.Context, image admission.Image) error {
+						checker, err := checker.New(checker.Opt{
+							Target:         image.Ref,
+							TargetInsecure: image.Insecure,
+							TargetAuth:     image.Auth,
+							Fast:           true,
+							HTTPCacheDir:   c.String("http-cache-dir"),
+						})
+						if err != nil {
+							return err
+						}
+						return checker.Check(ctx)
+					},
+					Mode:     c.String("mode"),
+					Insecure: c.Bool("insecure"),
+					Scanner: admission.Scanner{
+						Name:    "Nydusify",
+						Vendor:  "Nydus",
+						Version: version,
+					},
+				})
+				if err != nil {
+					return err
+				}
+
+				httpServer := &http.Server{
+					Addr:    c.String("addr"),
+					Handler: srv.Handler(),
+				}
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				defer signal.Stop(signals)
+				go func() {
+					<-signals
+					httpServer.Shutdown(context.Background())
+				}()
+
+				logrus.Infof("Serving admission webhook on %s", c.String("addr"))
+				if c.String("tls-cert") != "" {
+					err = httpServer.ListenAndServeTLS(c.String("tls-cert"), c.String("tls-key"))
+				} else {
+					err = httpServer.ListenAndServe()
+				}
+				if err != nil && err != http.ErrServerClosed {
+					return err
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "check",
+			Usage: "Check nydus image",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "source", Required: false, Usage: "Source image reference", EnvVars: []string{"SOURCE"}},
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"TARGET"}},
+
+				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+
+				&cli.BoolFlag{Name: "multi-platform", Value: false, Usage: "Ensure the target image represents a manifest list, and it should consist of OCI and Nydus manifest", EnvVars: []string{"MULTI_PLATFORM"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./output", Usage: "Work directory path for image check, will be cleaned before checking", EnvVars: []string{"WORK_DIR"}},
+				&cli.StringFlag{Name: "nydus-image", Value: "./nydus-image", Usage: "The nydus-image binary path", EnvVars: []string{"NYDUS_IMAGE"}},
+				&cli.StringFlag{Name: "nydusd", Value: "./nydusd", Usage: "The nydusd binary path", EnvVars: []string{"NYDUSD"}},
+				&cli.StringSliceFlag{Name: "nydus-image-path", Usage: "The nydus-image binary path to validate bootstrap, can be specified multiple times to produce a compatibility report of the binaries, overrides --nydus-image", EnvVars: []string{"NYDUS_IMAGE_PATH"}},
+				&cli.StringSliceFlag{Name: "nydusd-path", Usage: "The nydusd binary path to validate filesystem, can be specified multiple times to produce a compatibility report of the binaries, overrides --nydusd", EnvVars: []string{"NYDUSD_PATH"}},
+				&cli.StringFlag{Name: "backend-type", Value: "", Usage: "Specify Nydus blob storage backend type, will check file data in Nydus image if specified", EnvVars: []string{"BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+				&cli.StringFlag{Name: "http-cache-dir", Value: "", Usage: "Cache manifest and config responses from registry in the directory, will be shared across checks", EnvVars: []string{"HTTP_CACHE_DIR"}},
+				&cli.Int64Flag{Name: "hash-sample-size", Value: 0, Usage: "Only compare the head, middle and tail blocks in the size of file data when checking file data, compare the whole file if it's 0", EnvVars: []string{"HASH_SAMPLE_SIZE"}},
+				&cli.StringFlag{Name: "sign", Value: "", Usage: "Verify the signature of Nydus manifest by the signing tool, possible values: cosign, notation", EnvVars: []string{"SIGN"}},
+				&cli.StringFlag{Name: "sign-key", Value: "", Usage: "The key for --sign, a public key path or KMS URI for cosign, ignored by notation which verifies by trust policy", EnvVars: []string{"SIGN_KEY"}},
+				&cli.StringFlag{Name: "sign-tool-path", Value: "", Usage: "The binary path of signing tool, looked up in PATH by default", EnvVars: []string{"SIGN_TOOL_PATH"}},
+				&cli.BoolFlag{Name: "fast", Value: false, Usage: "Only check the consistency of manifest and annotations and the existence of referenced blobs in registry, without nydus-image and nydusd", EnvVars: []string{"FAST"}},
+			},
+			Action: func(c *cli.Context) error {
+				backendType := c.String("backend-type")
+				backendConfig := ""
+				if backendType != "" {
+					_backendConfig, err := parseBackendConfig(
+						c.String("backend-config"), c.String("backend-config-file"),
+					)
+					if err != nil {
+						return err
+					}
+					backendConfig = _backendConfig
+					if !c.Bool("fast") {
+						warnNydusdBackend(backendType)
+					}
+				}
+
+				imageSigner, err := getSigner(c, c.Bool("target-insecure"))
+				if err != nil {
+					return err
+				}
+
+				checker, err := checker.New(checker.Opt{
+					WorkDir:         c.String("work-dir"),
+					Source:          c.String("source"),
+					Target:          c.String("target"),
+					MultiPlatform:   c.Bool("multi-platform"),
+					SourceInsecure:  c.Bool("source-insecure"),
+					TargetInsecure:  c.Bool("target-insecure"),
+					NydusImagePath:  c.String("nydus-image"),
+					NydusdPath:      c.String("nydusd"),
+					NydusImagePaths: c.StringSlice("nydus-image-path"),
+					NydusdPaths:     c.StringSlice("nydusd-path"),
+					BackendType:     backendType,
+					BackendConfig:   backendConfig,
+					HashSampleSize:  c.Int64("hash-sample-size"),
+					Signer:          imageSigner,
+					Fast:            c.Bool("fast"),
+					HTTPCacheDir:    c.String("http-cache-dir"),
+				})
+				if err != nil {
+					return err
+				}
+
+				return checker.Check(context.Background())
+			},
+		},
+		{
+			Name:  "optimize",
+			Usage: "Rebuild Nydus image from source image with the files in access trace prefetched",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "source", Required: true, Usage: "Source (OCI) image reference which the Nydus image is converted from", EnvVars: []string{"SOURCE"}},
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference to push the optimized image", EnvVars: []string{"TARGET"}},
+				&cli.StringFlag{Name: "trace", Required: true, TakesFile: true, Usage: "Path of access trace, either the access patterns in JSON exported by nydusd API /api/v1/metrics/pattern or a file list with one absolute path per line, - for stdin", EnvVars: []string{"TRACE"}},
+				&cli.IntFlag{Name: "max-prefetch-files", Value: 0, Usage: "Only prefetch the first files in access trace, 0 means no limit", EnvVars: []string{"MAX_PREFETCH_FILES"}},
+
+				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for image optimization", EnvVars: []string{"WORK_DIR"}},
+				&cli.StringFlag{Name: "nydus-image", Value: "./nydus-image", Usage: "The nydus-image binary path", EnvVars: []string{"NYDUS_IMAGE"}},
+				&cli.BoolFlag{Name: "docker-v2-format", Value: false, Usage: "Use docker image manifest v2, schema 2 format", EnvVars: []string{"DOCKER_V2_FORMAT"}},
+				&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type, possible values: registry, oss, s3, gcs", EnvVars: []string{"BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+				&cli.StringFlag{Name: "compressor", Value: "", Usage: "Compression algorithm of Nydus blobs, possible values: none, lz4_block, zstd", EnvVars: []string{"COMPRESSOR"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				backendType := c.String("backend-type")
+				possibleBackendTypes := []string{"registry", "oss", "s3", "gcs"}
+				if !isPossibleValue(possibleBackendTypes, backendType) {
+					return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
+				}
+				backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+				if err != nil {
+					return err
+				}
+				if backendType != "registry" && strings.TrimSpace(backendConfig) == "" {
+					return fmt.Errorf("--backend-config or --backend-config-file required")
+				}
+
+				trace := os.Stdin
+				if tracePath := c.String("trace"); tracePath != "-" {
+					trace, err = os.Open(tracePath)
+					if err != nil {
+						return errors.Wrap(err, "Open access trace")
+					}
+					defer trace.Close()
+				}
+				paths, err := optimizer.ParseTrace(trace)
+				if err != nil {
+					return errors.Wrap(err, "Parse access trace")
+				}
+				if len(paths) == 0 {
+					return fmt.Errorf("no accessed file found in access trace")
+				}
+				prefetchHint := optimizer.PrefetchHint(paths, c.Int("max-prefetch-files"))
+				logrus.Infof("Found %d accessed files in access trace", len(paths))
+
+				if provider.IsLocalSource(c.String("source")) || provider.IsLocalTarget(c.String("target")) {
+					return fmt.Errorf("optimize requires the source and target image in registry")
+				}
+				sourceRemote, err := provider.DefaultRemote(c.String("source"), c.Bool("source-insecure"))
+				if err != nil {
+					return errors.Wrap(err, "Parse source reference")
+				}
+				targetRemote, err := provider.DefaultRemote(c.String("target"), c.Bool("target-insecure"))
+				if err != nil {
+					return errors.Wrap(err, "Parse target reference")
+				}
+
+				sourceDir := filepath.Join(c.String("work-dir"), "source")
+				if err := os.RemoveAll(sourceDir); err != nil {
+					return err
+				}
+				if err := os.MkdirAll(sourceDir, 0755); err != nil {
+					return err
+				}
+				sourceProviders, err := provider.DefaultSource(context.Background(), sourceRemote, sourceDir)
+				if err != nil {
+					return errors.Wrap(err, "Parse source image")
+				}
+
+				logger, err := provider.DefaultLogger()
+				if err != nil {
+					return err
+				}
+
+				// The layers are rebuilt instead of being reused from build
+				// cache, since the prefetch files are placed in front of blobs
+				cvt, err := converter.New(converter.Opt{
+					Logger:          logger,
+					SourceProviders: sourceProviders,
+					TargetRemote:    targetRemote,
+					NydusImagePath:  c.String("nydus-image"),
+					WorkDir:         c.String("work-dir"),
+					PrefetchDir:     prefetchHint,
+					DockerV2Format:  c.Bool("docker-v2-format"),
+					Compressor:      c.String("compressor"),
+					BackendType:     backendType,
+					BackendConfig:   backendConfig,
+				})
+				if err != nil {
+					return err
+				}
+
+				return cvt.Convert(context.Background())
+			},
+		},
+		{
+			Name:  "mount",
+			Usage: "Mount nydus image to local mountpoint for inspection",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "mountpoint", Required: true, Usage: "The path to mount Nydus image, the image is umounted on interrupt", EnvVars: []string{"MOUNTPOINT"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for bootstrap, nydusd config and blob cache, will be cleaned before mounting", EnvVars: []string{"WORK_DIR"}},
+				&cli.StringFlag{Name: "nydusd", Value: "./nydusd", Usage: "The nydusd binary path", EnvVars: []string{"NYDUSD"}},
+				&cli.StringFlag{Name: "backend-type", Value: "", Usage: "Specify Nydus blob storage backend type, the blobs are pulled from target registry if not specified, possible values: registry, oss, s3", EnvVars: []string{"BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+			},
+			Action: func(c *cli.Context) error {
+				backendType := c.String("backend-type")
+				backendConfig := ""
+				if backendType != "" {
+					_backendConfig, err := parseBackendConfig(
+						c.String("backend-config"), c.String("backend-config-file"),
+					)
+					if err != nil {
+						return err
+					}
+					backendConfig = _backendConfig
+				}
+
+				mounter, err := mounter.New(mounter.Opt{
 					WorkDir:        c.String("work-dir"),
-					Source:         c.String("source"),
 					Target:         c.String("target"),
-					MultiPlatform:  c.Bool("multi-platform"),
+					TargetInsecure: c.Bool("target-insecure"),
+					Mountpoint:     c.String("mountpoint"),
+					NydusdPath:     c.String("nydusd"),
+					BackendType:    backendType,
+					BackendConfig:  backendConfig,
+				})
+				if err != nil {
+					return err
+				}
+
+				// Register the signal handler before mounting, so that the
+				// interrupt during mounting isn't missed
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				defer signal.Stop(signals)
+
+				if err := mounter.Mount(context.Background()); err != nil {
+					return err
+				}
+
+				logrus.Infof("Mounted Nydus image to %s, press Ctrl-C to umount", c.String("mountpoint"))
+				<-signals
+
+				return mounter.Umount()
+			},
+		},
+		{
+			Name:  "pack",
+			Usage: "Pack a directory (not a container image) into RAFS filesystem and push it as an OCI artifact, e.g. for dataset or model distribution",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "source-dir", Required: true, TakesFile: true, Usage: "The directory to pack", EnvVars: []string{"SOURCE_DIR"}},
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target artifact reference, use oci://<dir>[:<tag>] to write the artifact to local OCI image layout", EnvVars: []string{"TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for the built bootstrap and blob, will be cleaned before packing", EnvVars: []string{"WORK_DIR"}},
+				&cli.StringFlag{Name: "nydus-image", Value: "./nydus-image", Usage: "The nydus-image binary path", EnvVars: []string{"NYDUS_IMAGE"}},
+				&cli.StringFlag{Name: "compressor", Value: "", Usage: "Compression algorithm of RAFS blob, defaults to lz4_block, possible values: none, lz4_block, zstd", EnvVars: []string{"COMPRESSOR"}},
+				&cli.StringFlag{Name: "fs-version", Value: "", Usage: "RAFS version, 6 is compatible with EROFS, defaults to the one of nydus-image, possible values: 5, 6", EnvVars: []string{"FS_VERSION"}},
+				&cli.StringFlag{Name: "chunk-size", Value: "", Usage: "Size of data chunk in RAFS blob, power of two between 0x1000 and 0x1000000, e.g. 0x100000 or 1MiB, defaults to the one of nydus-image", EnvVars: []string{"CHUNK_SIZE"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				target := c.String("target")
+				if strings.HasPrefix(target, provider.DockerArchiveScheme) {
+					return fmt.Errorf("--target in %s scheme isn't supported for artifact", provider.DockerArchiveScheme)
+				}
+				compressor := c.String("compressor")
+				possibleCompressors := []string{converter.CompressorNone, converter.CompressorLZ4Block, converter.CompressorZstd}
+				if compressor != "" && !isPossibleValue(possibleCompressors, compressor) {
+					return fmt.Errorf("--compressor should be one of %v", possibleCompressors)
+				}
+				fsVersion := c.String("fs-version")
+				possibleFsVersions := []string{converter.FsVersionV5, converter.FsVersionV6}
+				if fsVersion != "" && !isPossibleValue(possibleFsVersions, fsVersion) {
+					return fmt.Errorf("--fs-version should be one of %v", possibleFsVersions)
+				}
+				chunkSize, err := parseChunkSize(c, "chunk-size")
+				if err != nil {
+					return err
+				}
+
+				workDir := c.String("work-dir")
+				targetRemote, err := converter.NewTargetRemote(target, c.Bool("target-insecure"), workDir, getHTTPCache(c))
+				if err != nil {
+					return err
+				}
+				desc, err := packer.Pack(context.Background(), packer.PackOpt{
+					WorkDir:        filepath.Join(workDir, "pack"),
+					NydusImagePath: c.String("nydus-image"),
+					SourceDir:      c.String("source-dir"),
+					TargetRemote:   targetRemote,
+					Compressor:     compressor,
+					FsVersion:      fsVersion,
+					ChunkSize:      chunkSize,
+				})
+				if err != nil {
+					return err
+				}
+				logrus.Infof("Packed %s to %s@%s", c.String("source-dir"), target, desc.Digest)
+				return nil
+			},
+		},
+		{
+			Name:  "unpack",
+			Usage: "Unpack the RAFS artifact packed by `nydusify pack` to a directory",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "source", Required: true, Usage: "Source artifact reference", EnvVars: []string{"SOURCE"}},
+				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
+				&cli.StringFlag{Name: "target-dir", Required: true, TakesFile: true, Usage: "The directory to unpack files to, will be created if it doesn't exist", EnvVars: []string{"TARGET_DIR"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for bootstrap, nydusd config and blob cache, will be cleaned before unpacking", EnvVars: []string{"WORK_DIR"}},
+				&cli.StringFlag{Name: "nydusd", Value: "./nydusd", Usage: "The nydusd binary path", EnvVars: []string{"NYDUSD"}},
+				&cli.StringFlag{Name: "backend-type", Value: "", Usage: "Specify Nydus blob storage backend type, the blob is pulled from source registry if not specified, possible values: registry, oss, s3", EnvVars: []string{"BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				backendType := c.String("backend-type")
+				backendConfig := ""
+				if backendType != "" {
+					_backendConfig, err := parseBackendConfig(
+						c.String("backend-config"), c.String("backend-config-file"),
+					)
+					if err != nil {
+						return err
+					}
+					backendConfig = _backendConfig
+				}
+
+				if err := packer.Unpack(context.Background(), packer.UnpackOpt{
+					WorkDir:        filepath.Join(c.String("work-dir"), "unpack"),
+					Source:         c.String("source"),
 					SourceInsecure: c.Bool("source-insecure"),
+					TargetDir:      c.String("target-dir"),
+					NydusdPath:     c.String("nydusd"),
+					BackendType:    backendType,
+					BackendConfig:  backendConfig,
+				}); err != nil {
+					return err
+				}
+				logrus.Infof("Unpacked %s to %s", c.String("source"), c.String("target-dir"))
+				return nil
+			},
+		},
+		{
+			Name:  "inspect",
+			Usage: "Inspect the bootstrap metadata of nydus image and print as JSON",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: false, Usage: "Target (Nydus) image reference, only the bootstrap layer is pulled", EnvVars: []string{"TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "bootstrap", Value: "", TakesFile: true, Usage: "Inspect the local Nydus bootstrap file instead of target image", EnvVars: []string{"BOOTSTRAP"}},
+				&cli.StringFlag{Name: "output", Value: "", TakesFile: true, Usage: "Write the JSON to the file instead of stdout", EnvVars: []string{"OUTPUT"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for the pulled bootstrap", EnvVars: []string{"WORK_DIR"}},
+			},
+			Action: func(c *cli.Context) error {
+				var bootstrap *inspector.Bootstrap
+				if bootstrapPath := c.String("bootstrap"); bootstrapPath != "" {
+					_bootstrap, err := inspector.ParseBootstrap(bootstrapPath)
+					if err != nil {
+						return err
+					}
+					bootstrap = _bootstrap
+				} else {
+					if c.String("target") == "" {
+						return fmt.Errorf("--target or --bootstrap required")
+					}
+					inspector, err := inspector.New(inspector.Opt{
+						WorkDir:        c.String("work-dir"),
+						Target:         c.String("target"),
+						TargetInsecure: c.Bool("target-insecure"),
+					})
+					if err != nil {
+						return err
+					}
+					if bootstrap, err = inspector.Inspect(context.Background()); err != nil {
+						return err
+					}
+				}
+
+				output, err := json.MarshalIndent(bootstrap, "", "  ")
+				if err != nil {
+					return err
+				}
+				output = append(output, '\n')
+				if outputPath := c.String("output"); outputPath != "" {
+					return ioutil.WriteFile(outputPath, output, 0644)
+				}
+				_, err = os.Stdout.Write(output)
+				return err
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "List the Nydus images converted into repository with --alias-label and their source images",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target repository of conversion, e.g. myregistry/repo, the tag is ignored", EnvVars: []string{"TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "source", Value: "", Usage: "Only list the Nydus images converted from the source repository, tagged reference or manifest digest, e.g. nginx, nginx:1.21 or sha256:<hex>", EnvVars: []string{"SOURCE"}},
+				&cli.BoolFlag{Name: "json", Required: false, Usage: "Print the entries of conversion index in JSON", EnvVars: []string{"JSON"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				target, err := provider.DefaultRemote(c.String("target"), c.Bool("target-insecure"))
+				if err != nil {
+					return errors.Wrap(err, "Init target image parser")
+				}
+				index, err := alias.Pull(context.Background(), target)
+				if err != nil {
+					return err
+				}
+				entries := index.Lookup(c.String("source"))
+
+				if c.Bool("json") {
+					output, err := json.MarshalIndent(entries, "", "  ")
+					if err != nil {
+						return err
+					}
+					fmt.Println(string(output))
+					return nil
+				}
+				return alias.PrintEntries(os.Stdout, entries)
+			},
+		},
+		{
+			Name:  "compare",
+			Usage: "Compare nydus image with its OCI image, report size overhead, chunk deduplication and estimated cold start read amplification",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "oci", Required: true, Usage: "OCI image reference, only the manifest is pulled", EnvVars: []string{"OCI"}},
+				&cli.StringFlag{Name: "nydus", Required: true, Usage: "Nydus image reference, only the manifest and bootstrap layer are pulled", EnvVars: []string{"NYDUS"}},
+				&cli.BoolFlag{Name: "oci-insecure", Required: false, Usage: "Allow http/insecure registry communication of OCI image", EnvVars: []string{"OCI_INSECURE"}},
+				&cli.BoolFlag{Name: "nydus-insecure", Required: false, Usage: "Allow http/insecure registry communication of Nydus image", EnvVars: []string{"NYDUS_INSECURE"}},
+				&cli.StringFlag{Name: "chunk-dict", Value: "", Usage: "A chunk dictionary image generated by nydusify chunkdict generate, report the chunks of Nydus image found in it", EnvVars: []string{"CHUNK_DICT"}},
+				&cli.BoolFlag{Name: "chunk-dict-insecure", Required: false, Usage: "Allow http/insecure registry communication of chunk dictionary image", EnvVars: []string{"CHUNK_DICT_INSECURE"}},
+				&cli.StringFlag{Name: "trace", Value: "", TakesFile: true, Usage: "Access trace of container startup for estimating cold start, in the format of nydusify optimize --trace, the prefetch table of Nydus image is used if it's not specified", EnvVars: []string{"TRACE"}},
+				&cli.StringFlag{Name: "format", Value: "json", Usage: "Format of report, possible values: json, markdown", EnvVars: []string{"FORMAT"}},
+				&cli.StringFlag{Name: "output", Value: "", TakesFile: true, Usage: "Write the report to the file instead of stdout", EnvVars: []string{"OUTPUT"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for the pulled bootstraps", EnvVars: []string{"WORK_DIR"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				format := c.String("format")
+				if format != "json" && format != "markdown" {
+					return fmt.Errorf("invalid --format %s, possible values: json, markdown", format)
+				}
+
+				var paths []string
+				if tracePath := c.String("trace"); tracePath != "" {
+					trace, err := os.Open(tracePath)
+					if err != nil {
+						return errors.Wrap(err, "Open access trace")
+					}
+					defer trace.Close()
+					if paths, err = optimizer.ParseTrace(trace); err != nil {
+						return errors.Wrap(err, "Parse access trace")
+					}
+				}
+
+				comparer, err := comparer.New(comparer.Opt{
+					WorkDir:           c.String("work-dir"),
+					OCI:               c.String("oci"),
+					OCIInsecure:       c.Bool("oci-insecure"),
+					Nydus:             c.String("nydus"),
+					NydusInsecure:     c.Bool("nydus-insecure"),
+					ChunkDict:         c.String("chunk-dict"),
+					ChunkDictInsecure: c.Bool("chunk-dict-insecure"),
+					Trace:             paths,
+				})
+				if err != nil {
+					return err
+				}
+				report, err := comparer.Compare(context.Background())
+				if err != nil {
+					return err
+				}
+
+				var output []byte
+				if format == "markdown" {
+					output = []byte(report.Markdown())
+				} else {
+					if output, err = json.MarshalIndent(report, "", "  "); err != nil {
+						return err
+					}
+					output = append(output, '\n')
+				}
+				if outputPath := c.String("output"); outputPath != "" {
+					return ioutil.WriteFile(outputPath, output, 0644)
+				}
+				_, err = os.Stdout.Write(output)
+				return err
+			},
+		},
+		{
+			Name:  "copy",
+			Usage: "Copy nydus image between registries",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "source", Required: true, Usage: "Source (Nydus) image reference", EnvVars: []string{"SOURCE"}},
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"TARGET"}},
+
+				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+
+				&cli.StringFlag{Name: "source-backend-type", Value: "", Usage: "Specify Nydus blob storage backend type of source image, required if the blobs aren't stored in source registry, possible values: oss, s3, gcs", EnvVars: []string{"SOURCE_BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "source-backend-config", Value: "", Usage: "Specify Nydus blob storage backend of source image in JSON config string", EnvVars: []string{"SOURCE_BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "source-backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config of source image from path", EnvVars: []string{"SOURCE_BACKEND_CONFIG_FILE"}},
+				&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type of target image, possible values: registry, oss, s3, gcs", EnvVars: []string{"BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend of target image in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config of target image from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for relocating blobs between storage backends", EnvVars: []string{"WORK_DIR"}},
+				&cli.UintFlag{Name: "concurrency", Value: 5, Usage: "Count of blobs transferred concurrently", EnvVars: []string{"CONCURRENCY"}},
+				&cli.StringFlag{Name: "http-cache-dir", Value: "", Usage: "Cache manifest and config responses from registry in the directory, will be shared across copies", EnvVars: []string{"HTTP_CACHE_DIR"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				sourceBackendType := c.String("source-backend-type")
+				sourceBackendConfig := ""
+				if sourceBackendType != "" {
+					possibleBackendTypes := []string{"registry", "oss", "s3", "gcs"}
+					if !isPossibleValue(possibleBackendTypes, sourceBackendType) {
+						return fmt.Errorf("--source-backend-type should be one of %v", possibleBackendTypes)
+					}
+					sourceBackendConfig, err = parseBackendConfig(
+						c.String("source-backend-config"), c.String("source-backend-config-file"),
+					)
+					if err != nil {
+						return err
+					}
+					if sourceBackendType != "registry" && strings.TrimSpace(sourceBackendConfig) == "" {
+						return fmt.Errorf("--source-backend-config or --source-backend-config-file required")
+					}
+				}
+
+				backendType := c.String("backend-type")
+				possibleBackendTypes := []string{"registry", "oss", "s3", "gcs"}
+				if !isPossibleValue(possibleBackendTypes, backendType) {
+					return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
+				}
+				backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+				if err != nil {
+					return err
+				}
+				if backendType != "registry" && strings.TrimSpace(backendConfig) == "" {
+					return fmt.Errorf("--backend-config or --backend-config-file required")
+				}
+
+				cp, err := copier.New(copier.Opt{
+					WorkDir:             c.String("work-dir"),
+					Source:              c.String("source"),
+					Target:              c.String("target"),
+					SourceInsecure:      c.Bool("source-insecure"),
+					TargetInsecure:      c.Bool("target-insecure"),
+					SourceBackendType:   sourceBackendType,
+					SourceBackendConfig: sourceBackendConfig,
+					BackendType:         backendType,
+					BackendConfig:       backendConfig,
+					Concurrency:         c.Uint("concurrency"),
+					HTTPCacheDir:        c.String("http-cache-dir"),
+				})
+				if err != nil {
+					return err
+				}
+
+				return cp.Copy(context.Background())
+			},
+		},
+		{
+			Name:  "rewrite",
+			Usage: "Rewrite the manifest of Nydus image without re-converting layers",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "source", Required: true, Usage: "Source Nydus image reference", EnvVars: []string{"SOURCE"}},
+				&cli.StringFlag{Name: "target", Value: "", Usage: "Target Nydus image reference in the same repository, defaults to source image", EnvVars: []string{"TARGET"}},
+				&cli.BoolFlag{Name: "insecure", Required: false, Usage: "Allow http/insecure registry communication", EnvVars: []string{"INSECURE"}},
+
+				&cli.StringSliceFlag{Name: "annotation", Usage: "Set annotation of Nydus manifest in format key=value, remove it if value is empty, can be specified multiple times", EnvVars: []string{"ANNOTATION"}},
+				&cli.StringFlag{Name: "format", Value: "", Usage: "Convert media types of manifest, config and layers to the format, possible values: oci, docker", EnvVars: []string{"FORMAT"}},
+
+				&cli.StringFlag{Name: "source-backend-type", Value: "", Usage: "Specify Nydus blob storage backend type of source image, required if the blobs are relocated from object storage, possible values: oss, s3, gcs", EnvVars: []string{"SOURCE_BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "source-backend-config", Value: "", Usage: "Specify Nydus blob storage backend of source image in JSON config string", EnvVars: []string{"SOURCE_BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "source-backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config of source image from path", EnvVars: []string{"SOURCE_BACKEND_CONFIG_FILE"}},
+				&cli.StringFlag{Name: "backend-type", Value: "", Usage: "Relocate Nydus blobs to the storage backend, keep blobs in place if not specified, possible values: registry, oss, s3, gcs", EnvVars: []string{"BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend to relocate blobs in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config to relocate blobs from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for relocating blobs between storage backends", EnvVars: []string{"WORK_DIR"}},
+				&cli.UintFlag{Name: "concurrency", Value: 5, Usage: "Count of blobs relocated concurrently", EnvVars: []string{"CONCURRENCY"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				source := c.String("source")
+				target := c.String("target")
+				if target == "" {
+					target = source
+				}
+				if err := checkSameRepository(target, source); err != nil {
+					return err
+				}
+
+				annotations := map[string]string{}
+				for _, annotation := range c.StringSlice("annotation") {
+					parts := strings.SplitN(annotation, "=", 2)
+					if len(parts) != 2 || parts[0] == "" {
+						return fmt.Errorf("Invalid annotation %s, should be in format key=value", annotation)
+					}
+					annotations[parts[0]] = parts[1]
+				}
+
+				format := c.String("format")
+				if format != "" {
+					possibleFormats := []string{copier.FormatOCI, copier.FormatDocker}
+					if !isPossibleValue(possibleFormats, format) {
+						return fmt.Errorf("--format should be one of %v", possibleFormats)
+					}
+				}
+
+				sourceBackendType := c.String("source-backend-type")
+				sourceBackendConfig := ""
+				if sourceBackendType != "" {
+					possibleBackendTypes := []string{"registry", "oss", "s3", "gcs"}
+					if !isPossibleValue(possibleBackendTypes, sourceBackendType) {
+						return fmt.Errorf("--source-backend-type should be one of %v", possibleBackendTypes)
+					}
+					sourceBackendConfig, err = parseBackendConfig(
+						c.String("source-backend-config"), c.String("source-backend-config-file"),
+					)
+					if err != nil {
+						return err
+					}
+					if sourceBackendType != "registry" && strings.TrimSpace(sourceBackendConfig) == "" {
+						return fmt.Errorf("--source-backend-config or --source-backend-config-file required")
+					}
+				}
+
+				backendType := c.String("backend-type")
+				backendConfig := ""
+				if backendType != "" {
+					possibleBackendTypes := []string{"registry", "oss", "s3", "gcs"}
+					if !isPossibleValue(possibleBackendTypes, backendType) {
+						return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
+					}
+					backendConfig, err = parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+					if err != nil {
+						return err
+					}
+					if backendType != "registry" && strings.TrimSpace(backendConfig) == "" {
+						return fmt.Errorf("--backend-config or --backend-config-file required")
+					}
+				}
+
+				cp, err := copier.New(copier.Opt{
+					WorkDir:             c.String("work-dir"),
+					Source:              source,
+					Target:              target,
+					SourceInsecure:      c.Bool("insecure"),
+					TargetInsecure:      c.Bool("insecure"),
+					SourceBackendType:   sourceBackendType,
+					SourceBackendConfig: sourceBackendConfig,
+					BackendType:         backendType,
+					BackendConfig:       backendConfig,
+					Concurrency:         c.Uint("concurrency"),
+					ManifestOnly:        true,
+					Annotations:         annotations,
+					Format:              format,
+				})
+				if err != nil {
+					return err
+				}
+
+				return cp.Copy(context.Background())
+			},
+		},
+		{
+			Name:  "clone",
+			Usage: "Clone Nydus image into a new tag with different config or prefetch table, sharing all the blobs",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "source", Required: true, Usage: "Source Nydus image reference", EnvVars: []string{"SOURCE"}},
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target Nydus image reference in the same repository with source image", EnvVars: []string{"TARGET"}},
+				&cli.BoolFlag{Name: "insecure", Required: false, Usage: "Allow http/insecure registry communication", EnvVars: []string{"INSECURE"}},
+
+				&cli.StringSliceFlag{Name: "label", Usage: "Set label of target image config in format key=value, remove it if value is empty, can be specified multiple times", EnvVars: []string{"LABEL"}},
+				&cli.StringSliceFlag{Name: "annotation", Usage: "Set annotation of target manifest in format key=value, can be specified multiple times", EnvVars: []string{"ANNOTATION"}},
+				&cli.StringSliceFlag{Name: "env", Usage: "Set environment variable of target image config in format KEY=value, can be specified multiple times", EnvVars: []string{"IMAGE_ENV"}},
+				&cli.StringFlag{Name: "user", Value: "", Usage: "Override the user of target image config, e.g. 1000:1000", EnvVars: []string{"IMAGE_USER"}},
+				&cli.StringFlag{Name: "trace", Value: "", TakesFile: true, Usage: "Rebuild the prefetch table with the files in access trace, in the format of nydusify optimize --trace, - for stdin", EnvVars: []string{"TRACE"}},
+				&cli.IntFlag{Name: "max-prefetch-files", Value: 0, Usage: "Only prefetch the first files in access trace, 0 means no limit", EnvVars: []string{"MAX_PREFETCH_FILES"}},
+
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for rebuilding bootstrap", EnvVars: []string{"WORK_DIR"}},
+				&cli.StringFlag{Name: "nydus-image", Value: "./nydus-image", Usage: "The nydus-image binary path, required if --trace is specified", EnvVars: []string{"NYDUS_IMAGE"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				if err := checkSameRepository(c.String("target"), c.String("source")); err != nil {
+					return err
+				}
+
+				mutation, err := getConfigMutation(c)
+				if err != nil {
+					return err
+				}
+
+				prefetchHint := ""
+				if tracePath := c.String("trace"); tracePath != "" {
+					trace := os.Stdin
+					if tracePath != "-" {
+						trace, err = os.Open(tracePath)
+						if err != nil {
+							return errors.Wrap(err, "Open access trace")
+						}
+						defer trace.Close()
+					}
+					paths, err := optimizer.ParseTrace(trace)
+					if err != nil {
+						return errors.Wrap(err, "Parse access trace")
+					}
+					if len(paths) == 0 {
+						return fmt.Errorf("no accessed file found in access trace")
+					}
+					prefetchHint = optimizer.PrefetchHint(paths, c.Int("max-prefetch-files"))
+				}
+
+				if mutation == nil && prefetchHint == "" {
+					return fmt.Errorf("at least one of --label, --annotation, --env, --user and --trace is required")
+				}
+
+				cl, err := cloner.New(cloner.Opt{
+					WorkDir:          c.String("work-dir"),
+					NydusImagePath:   c.String("nydus-image"),
+					Source:           c.String("source"),
+					Target:           c.String("target"),
+					Insecure:         c.Bool("insecure"),
+					Mutation:         mutation,
+					PrefetchPatterns: prefetchHint,
+				})
+				if err != nil {
+					return err
+				}
+
+				_, err = cl.Clone(context.Background())
+				return err
+			},
+		},
+		{
+			Name:  "gc",
+			Usage: "Delete the Nydus blobs in object storage backend not referenced by any image in registry",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "target-registry", Required: true, Usage: "Registry host storing all Nydus images whose blobs are in the backend, the images are enumerated by catalog API", EnvVars: []string{"TARGET_REGISTRY"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "target-ca", Value: "", TakesFile: true, Usage: "Path of PEM encoded CA certificate trusted for target registry in addition to system ones", EnvVars: []string{"TARGET_CA"}},
+
+				&cli.StringFlag{Name: "backend-type", Required: true, Usage: "Specify Nydus blob storage backend type, possible values: oss, s3, gcs", EnvVars: []string{"BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+
+				&cli.DurationFlag{Name: "grace-period", Value: 24 * time.Hour, Usage: "Only delete the orphan blobs not modified within the period, which protects the blobs uploaded by running conversions", EnvVars: []string{"GRACE_PERIOD"}},
+				&cli.BoolFlag{Name: "dry-run", Required: false, Usage: "Only print the orphan blobs without deleting them", EnvVars: []string{"DRY_RUN"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				backendType := c.String("backend-type")
+				possibleBackendTypes := []string{"oss", "s3", "gcs"}
+				if !isPossibleValue(possibleBackendTypes, backendType) {
+					return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
+				}
+				backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+				if err != nil {
+					return err
+				}
+				if strings.TrimSpace(backendConfig) == "" {
+					return fmt.Errorf("--backend-config or --backend-config-file required")
+				}
+				blobBackend, err := backend.NewBackend(backendType, []byte(backendConfig), nil)
+				if err != nil {
+					return err
+				}
+				collector, ok := blobBackend.(backend.Collector)
+				if !ok {
+					return fmt.Errorf("backend type %s doesn't support gc", backendType)
+				}
+
+				if err := provider.AddHostTLS(c.String("target-registry"), getTLSOpt(c, "target")); err != nil {
+					return err
+				}
+
+				collection, err := gc.New(gc.Opt{
+					TargetRegistry: c.String("target-registry"),
 					TargetInsecure: c.Bool("target-insecure"),
-					NydusImagePath: c.String("nydus-image"),
-					NydusdPath:     c.String("nydusd"),
-					BackendType:    backendType,
-					BackendConfig:  backendConfig,
+					Backend:        collector,
+					GracePeriod:    c.Duration("grace-period"),
+					DryRun:         c.Bool("dry-run"),
 				})
 				if err != nil {
 					return err
 				}
+				result, err := collection.Run(context.Background())
+				if err != nil {
+					return err
+				}
 
-				return checker.Check(context.Background())
+				var size int64
+				for _, orphan := range result.Orphans {
+					size += orphan.Size
+				}
+				logrus.Infof(
+					"Found %d orphan blobs (%s) in %d blobs, deleted %d blobs",
+					len(result.Orphans), humanize.IBytes(uint64(size)), result.Blobs, result.Deleted,
+				)
+				return nil
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "Manage build cache image",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "prune",
+					Usage: "Rewrite build cache image dropping the expired records and the records whose layers are gone",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+						&cli.StringFlag{Name: "build-cache", Required: true, Usage: "An remote image reference, a local directory in format dir:///path or an object storage location in format <oss|s3|gcs>://bucket/prefix of cache image", EnvVars: []string{"BUILD_CACHE"}},
+						&cli.StringFlag{Name: "build-cache-version", Value: "v1", Usage: "Specify the version of cache image, should be the same with the one used by conversions", EnvVars: []string{"BUILD_CACHE_VERSION"}},
+						&cli.BoolFlag{Name: "build-cache-insecure", Required: false, Usage: "Allow http/insecure registry communication of cache image", EnvVars: []string{"BUILD_CACHE_INSECURE"}},
+						&cli.UintFlag{Name: "build-cache-max-records", Value: defaultCacheMaxRecords, Usage: "Maximum cache records kept in cache image", EnvVars: []string{"BUILD_CACHE_MAX_RECORDS"}},
+						&cli.DurationFlag{Name: "build-cache-ttl", Value: 0, Usage: "Drop the cache records not hit or recorded within the duration, e.g. 720h, the records never expire if it's 0", EnvVars: []string{"BUILD_CACHE_TTL"}},
+						&cli.BoolFlag{Name: "docker-v2-format", Value: false, Usage: "Use docker image manifest v2, schema 2 format, should be the same with the one used by conversions", EnvVars: []string{"DOCKER_V2_FORMAT"}},
+
+						&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type used by conversions to check the blobs of cache records, possible values: registry, oss, s3, gcs", EnvVars: []string{"BACKEND_TYPE"}},
+						&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+						&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+
+						&cli.BoolFlag{Name: "dry-run", Required: false, Usage: "Only print the count of records to be dropped without rewriting cache image", EnvVars: []string{"DRY_RUN"}},
+					},
+					Action: func(c *cli.Context) error {
+						logLevel, err := logrus.ParseLevel(c.String("log-level"))
+						if err != nil {
+							return err
+						}
+						logrus.SetLevel(logLevel)
+
+						cacheMaxRecords := c.Uint("build-cache-max-records")
+						if cacheMaxRecords < 1 || cacheMaxRecords > maxCacheMaxRecords {
+							return fmt.Errorf("--build-cache-max-records should be between 1 and %d", maxCacheMaxRecords)
+						}
+
+						backendType := c.String("backend-type")
+						possibleBackendTypes := []string{"registry", "oss", "s3", "gcs"}
+						if !isPossibleValue(possibleBackendTypes, backendType) {
+							return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
+						}
+						backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+						if err != nil {
+							return err
+						}
+						if backendType != "registry" && strings.TrimSpace(backendConfig) == "" {
+							return fmt.Errorf("--backend-config or --backend-config-file required")
+						}
+						blobBackend, err := backend.NewBackend(backendType, []byte(backendConfig), nil)
+						if err != nil {
+							return err
+						}
+
+						cacheBackend, err := converter.NewCacheBackend(c.String("build-cache"), c.Bool("build-cache-insecure"))
+						if err != nil {
+							return err
+						}
+
+						result, err := cache.Prune(context.Background(), cacheBackend, cache.Opt{
+							MaxRecords:     cacheMaxRecords,
+							Version:        c.String("build-cache-version"),
+							DockerV2Format: c.Bool("docker-v2-format"),
+							Backend:        blobBackend,
+							TTL:            c.Duration("build-cache-ttl"),
+						}, c.Bool("dry-run"))
+						if err != nil {
+							return err
+						}
+
+						logrus.Infof(
+							"Kept %d records in cache image %s, dropped %d expired and %d unreachable records",
+							result.Records, cacheBackend.Reference(), result.Expired, result.Unreachable,
+						)
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "chunkdict",
+			Usage: "Manage chunk dictionary for deduplicating chunks across images",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "generate",
+					Usage: "Generate chunk dictionary image from a set of base images",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+						&cli.StringSliceFlag{Name: "sources", Required: true, Usage: "Comma separated base image references, in the same forms as --source of convert", EnvVars: []string{"SOURCES"}},
+						&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) chunk dictionary image reference", EnvVars: []string{"TARGET"}},
+
+						&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
+						&cli.StringFlag{Name: "containerd-address", Value: provider.DefaultContainerdAddress, Usage: "Containerd address for the source image in containerd:// scheme", EnvVars: []string{"CONTAINERD_ADDRESS"}},
+						&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+
+						&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for chunk dictionary generation", EnvVars: []string{"WORK_DIR"}},
+						&cli.StringFlag{Name: "nydus-image", Value: "./nydus-image", Usage: "The nydus-image binary path", EnvVars: []string{"NYDUS_IMAGE"}},
+						&cli.StringFlag{Name: "compressor", Value: "", Usage: "Compression algorithm of chunk dictionary blob, possible values: none, lz4_block, zstd", EnvVars: []string{"COMPRESSOR"}},
+						&cli.BoolFlag{Name: "docker-v2-format", Value: false, Usage: "Use docker image manifest v2, schema 2 format", EnvVars: []string{"DOCKER_V2_FORMAT"}},
+						&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type, should be the same with the images converted with the dictionary, possible values: registry, oss, s3, gcs", EnvVars: []string{"BACKEND_TYPE"}},
+						&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
+						&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+					},
+					Action: func(c *cli.Context) error {
+						logLevel, err := logrus.ParseLevel(c.String("log-level"))
+						if err != nil {
+							return err
+						}
+						logrus.SetLevel(logLevel)
+
+						backendType := c.String("backend-type")
+						possibleBackendTypes := []string{"registry", "oss", "s3", "gcs"}
+						if !isPossibleValue(possibleBackendTypes, backendType) {
+							return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
+						}
+						backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+						if err != nil {
+							return err
+						}
+						if backendType != "registry" && strings.TrimSpace(backendConfig) == "" {
+							return fmt.Errorf("--backend-config or --backend-config-file required")
+						}
+
+						logger, err := provider.DefaultLogger()
+						if err != nil {
+							return err
+						}
+
+						gen, err := chunkdict.New(chunkdict.Opt{
+							Logger:            logger,
+							WorkDir:           c.String("work-dir"),
+							Sources:           c.StringSlice("sources"),
+							Target:            c.String("target"),
+							SourceInsecure:    c.Bool("source-insecure"),
+							TargetInsecure:    c.Bool("target-insecure"),
+							ContainerdAddress: c.String("containerd-address"),
+							NydusImagePath:    c.String("nydus-image"),
+							Compressor:        c.String("compressor"),
+							DockerV2Format:    c.Bool("docker-v2-format"),
+							BackendType:       backendType,
+							BackendConfig:     backendConfig,
+						})
+						if err != nil {
+							return err
+						}
+
+						return gen.Generate(context.Background())
+					},
+				},
+			},
+		},
+		{
+			Name:  "builder-agent",
+			Usage: "Run builder agent building the layers dispatched by convert --remote-builder",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "addr", Value: "127.0.0.1:8090", Usage: "The address to listen on for gRPC builder service, listen on a public address only with TLS and client authentication", EnvVars: []string{"ADDR"}},
+				&cli.StringFlag{Name: "tls-cert", Value: "", TakesFile: true, Usage: "Path of PEM encoded certificate to serve builder service over TLS, requires --tls-key", EnvVars: []string{"TLS_CERT"}},
+				&cli.StringFlag{Name: "tls-key", Value: "", TakesFile: true, Usage: "Path of PEM encoded key for --tls-cert", EnvVars: []string{"TLS_KEY"}},
+				&cli.StringFlag{Name: "tls-client-ca", Value: "", TakesFile: true, Usage: "Path of PEM encoded CA certificate to require and verify the client certificates, requires --tls-cert", EnvVars: []string{"TLS_CLIENT_CA"}},
+				&cli.StringFlag{Name: "token", Value: "", Usage: "Bearer token required from the clients, requires --tls-cert", EnvVars: []string{"TOKEN"}},
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for the layers being built", EnvVars: []string{"WORK_DIR"}},
+				&cli.StringFlag{Name: "nydus-image", Value: "./nydus-image", Usage: "The nydus-image binary path", EnvVars: []string{"NYDUS_IMAGE"}},
+				&cli.IntFlag{Name: "concurrency", Value: 1, Usage: "Maximum count of layers built at the same time, the other requests wait", EnvVars: []string{"CONCURRENCY"}},
+			},
+			Action: func(c *cli.Context) error {
+				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+				if err != nil {
+					return err
+				}
+				logrus.SetLevel(logLevel)
+
+				agent, err := remotebuild.NewAgent(remotebuild.AgentOpt{
+					NydusImagePath:  c.String("nydus-image"),
+					WorkDir:         c.String("work-dir"),
+					Concurrency:     c.Int("concurrency"),
+					TLSCertFile:     c.String("tls-cert"),
+					TLSKeyFile:      c.String("tls-key"),
+					TLSClientCAFile: c.String("tls-client-ca"),
+					Token:           c.String("token"),
+				})
+				if err != nil {
+					return err
+				}
+				listener, err := net.Listen("tcp", c.String("addr"))
+				if err != nil {
+					return errors.Wrap(err, "Listen builder service")
+				}
+
+				return agent.Serve(listener)
 			},
 		},
 	}
@@ -55,6 +55,9 @@ func main() {
 		NydusImagePath: nydusImagePath,
 		MultiPlatform:  false,
 		DockerV2Format: true,
+		// Or implement converter.ManifestAssembler to push Nydus manifest
+		// in custom layout, conflicts with MultiPlatform
+		// ManifestAssembler: &converter.AnnotationAssembler{},
 	}
 
 	cvt, err := converter.New(opt)
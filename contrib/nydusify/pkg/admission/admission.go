@@ -0,0 +1,148 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package admission validates Nydus images before they are deployed, as a
+// Kubernetes validating admission webhook, or as a scanner adapter of
+// Harbor which prevents the malformed images from being pulled.
+package admission
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker"
+)
+
+const (
+	// ModeEnforce rejects the workloads with malformed Nydus images.
+	ModeEnforce = "enforce"
+	// ModeWarn admits the workloads with warnings of malformed Nydus images.
+	ModeWarn = "warn"
+)
+
+// defaultConcurrency is the count of images checked at the same time in
+// an admission request.
+const defaultConcurrency = 4
+
+// Image is the image to check.
+type Image struct {
+	Ref string
+	// Auth is the base64 encoded `username:password` of registry, the
+	// default credential is used if it's empty.
+	Auth     string
+	Insecure bool
+}
+
+// CheckFunc checks the structure of Nydus image, it returns
+// checker.ErrNotNydusImage if the image isn't a Nydus image, and
+// *checker.RuleError if the Nydus image is malformed.
+type CheckFunc func(ctx context.Context, image Image) error
+
+// Opt defines Server options.
+type Opt struct {
+	Check CheckFunc
+	// Mode is ModeEnforce or ModeWarn.
+	Mode string
+	// Insecure allows http/insecure registries of the images in workloads.
+	Insecure bool
+	// Scanner is the name and version reported to Harbor.
+	Scanner Scanner
+}
+
+// Server handles the admission reviews of Kubernetes and the scan requests
+// of Harbor.
+type Server struct {
+	Opt
+	mu      sync.Mutex
+	reports map[string]*scanReport
+	scans   []string
+}
+
+// New creates Server instance.
+func New(opt Opt) (*Server, error) {
+	if opt.Mode == "" {
+		opt.Mode = ModeEnforce
+	}
+	if opt.Mode != ModeEnforce && opt.Mode != ModeWarn {
+		return nil, fmt.Errorf("invalid mode %s, should be %s or %s", opt.Mode, ModeEnforce, ModeWarn)
+	}
+	if opt.Check == nil {
+		return nil, errors.New("check function is required")
+	}
+	return &Server{
+		Opt:     opt,
+		reports: map[string]*scanReport{},
+	}, nil
+}
+
+// problem is the failure of an image.
+type problem struct {
+	Image string
+	Err   error
+	// Malformed is true if the Nydus image fails to validate the rules,
+	// otherwise the image can't be checked, e.g. it's in a private
+	// repository or the registry is down, which isn't enforced.
+	Malformed bool
+}
+
+// checkImages checks the images concurrently, and returns the problems of
+// Nydus images and the images failed to check in order of images.
+func (server *Server) checkImages(ctx context.Context, images []Image) []problem {
+	errs := make([]error, len(images))
+	sem := make(chan struct{}, defaultConcurrency)
+	var wg sync.WaitGroup
+	for idx := range images {
+		idx := idx
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[idx] = server.Check(ctx, images[idx])
+		}()
+	}
+	wg.Wait()
+
+	problems := []problem{}
+	for idx, err := range errs {
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, checker.ErrNotNydusImage) {
+			logrus.Debugf("Skip non-nydus image %s", images[idx].Ref)
+			continue
+		}
+		var ruleErr *checker.RuleError
+		if errors.As(err, &ruleErr) {
+			logrus.Warnf("Malformed nydus image %s: %s", images[idx].Ref, err)
+			problems = append(problems, problem{Image: images[idx].Ref, Err: err, Malformed: true})
+			continue
+		}
+		logrus.Warnf("Failed to check image %s: %s", images[idx].Ref, err)
+		problems = append(problems, problem{Image: images[idx].Ref, Err: err})
+	}
+	return problems
+}
+
+// Handler returns the handler of:
+//
+//	POST /validate                  Kubernetes AdmissionReview
+//	GET  /api/v1/metadata           Harbor scanner adapter metadata
+//	POST /api/v1/scan               Harbor scan request
+//	GET  /api/v1/scan/<id>/report   Harbor scan report
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", server.validateHandler)
+	mux.HandleFunc("/api/v1/metadata", server.metadataHandler)
+	mux.HandleFunc("/api/v1/scan", server.scanHandler)
+	mux.HandleFunc("/api/v1/scan/", server.reportHandler)
+	return mux
+}
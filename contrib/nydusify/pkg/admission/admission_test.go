@@ -0,0 +1,162 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package admission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker"
+)
+
+func fakeCheck(ctx context.Context, image Image) error {
+	if strings.HasPrefix(image.Ref, "oci") {
+		return checker.ErrNotNydusImage
+	}
+	if strings.Contains(image.Ref, "broken") {
+		return &checker.RuleError{Rule: "structure", Err: fmt.Errorf("blobs not found")}
+	}
+	if strings.Contains(image.Ref, "private") {
+		return fmt.Errorf("resolve %s: unexpected status 401 Unauthorized", image.Ref)
+	}
+	return nil
+}
+
+func review(t *testing.T, handler http.Handler, images ...string) *admissionResponse {
+	containers := []container{}
+	for _, image := range images {
+		containers = append(containers, container{Image: image})
+	}
+	object, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{"containers": containers},
+			},
+		},
+	})
+	require.Nil(t, err)
+	body, err := json.Marshal(admissionReview{
+		APIVersion: "admission.k8s.io/v1",
+		Kind:       "AdmissionReview",
+		Request:    &admissionRequest{UID: "uid", Operation: "CREATE", Object: object},
+	})
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp admissionReview
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "admission.k8s.io/v1", resp.APIVersion)
+	require.NotNil(t, resp.Response)
+	assert.Equal(t, "uid", resp.Response.UID)
+	return resp.Response
+}
+
+func TestValidate(t *testing.T) {
+	server, err := New(Opt{Check: fakeCheck})
+	require.Nil(t, err)
+	handler := server.Handler()
+
+	resp := review(t, handler, "oci:latest", "good:nydus")
+	assert.True(t, resp.Allowed)
+	assert.Empty(t, resp.Warnings)
+
+	resp = review(t, handler, "good:nydus", "broken:nydus")
+	assert.False(t, resp.Allowed)
+	require.NotNil(t, resp.Status)
+	assert.Equal(t, http.StatusForbidden, resp.Status.Code)
+	assert.Contains(t, resp.Status.Message, "broken:nydus")
+
+	// The image failed to check isn't rejected
+	resp = review(t, handler, "good:nydus", "private:nydus")
+	assert.True(t, resp.Allowed)
+	require.Len(t, resp.Warnings, 1)
+	assert.Contains(t, resp.Warnings[0], "unchecked image private:nydus")
+
+	resp = review(t, handler, "private:nydus", "broken:nydus")
+	assert.False(t, resp.Allowed)
+	require.NotNil(t, resp.Status)
+	assert.NotContains(t, resp.Status.Message, "private:nydus")
+
+	server.Mode = ModeWarn
+	resp = review(t, handler, "broken:nydus")
+	assert.True(t, resp.Allowed)
+	require.Len(t, resp.Warnings, 1)
+	assert.Contains(t, resp.Warnings[0], "blobs not found")
+
+	_, err = New(Opt{Check: fakeCheck, Mode: "audit"})
+	assert.NotNil(t, err)
+}
+
+func TestScan(t *testing.T) {
+	var checked Image
+	server, err := New(Opt{
+		Check: func(ctx context.Context, image Image) error {
+			checked = image
+			return fakeCheck(ctx, image)
+		},
+		Scanner: Scanner{Name: "Nydusify"},
+	})
+	require.Nil(t, err)
+	handler := server.Handler()
+
+	scan := func(repo string) string {
+		body := fmt.Sprintf(`{
+			"registry": {"url": "http://harbor.local", "authorization": "Basic dXNlcjpwYXNz"},
+			"artifact": {"repository": "%s", "digest": "sha256:abc"}
+		}`, repo)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/scan", bytes.NewReader([]byte(body))))
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		var resp map[string]string
+		require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp["id"]
+	}
+	report := func(id string) *scanReport {
+		for i := 0; i < 100; i++ {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/scan/"+id+"/report", nil))
+			if rec.Code == http.StatusFound {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			require.Equal(t, http.StatusOK, rec.Code)
+			var report scanReport
+			require.Nil(t, json.NewDecoder(rec.Body).Decode(&report))
+			return &report
+		}
+		t.Fatalf("scan %s not completed", id)
+		return nil
+	}
+
+	r := report(scan("library/broken"))
+	assert.Equal(t, severityCritical, r.Severity)
+	require.Len(t, r.Vulnerabilities, 1)
+	assert.Equal(t, malformedID, r.Vulnerabilities[0].ID)
+	assert.Equal(t, Image{Ref: "harbor.local/library/broken@sha256:abc", Auth: "dXNlcjpwYXNz", Insecure: true}, checked)
+
+	r = report(scan("library/good"))
+	assert.Equal(t, severityNone, r.Severity)
+	assert.Empty(t, r.Vulnerabilities)
+
+	r = report(scan("library/private"))
+	assert.Equal(t, severityUnknown, r.Severity)
+	assert.Empty(t, r.Vulnerabilities)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/scan/unknown/report", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
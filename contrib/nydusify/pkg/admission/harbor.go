@@ -0,0 +1,228 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// The media types of pluggable scanner API of Harbor:
+// https://github.com/goharbor/pluggable-scanner-spec
+const (
+	mediaTypeMetadata     = "application/vnd.scanner.adapter.metadata+json; version=1.0"
+	mediaTypeScanResponse = "application/vnd.scanner.adapter.scan.response+json; version=1.0"
+	mediaTypeReport       = "application/vnd.scanner.adapter.vuln.report.harbor+json; version=1.0"
+	mediaTypeDockerV2     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// maxScanReports is the count of scan reports kept for querying, the oldest
+// reports are dropped beyond it.
+const maxScanReports = 1000
+
+// Severities of Harbor report, the malformed Nydus image is reported as a
+// critical vulnerability, so that it's prevented from being pulled by the
+// vulnerability policy of project.
+const (
+	severityNone     = "None"
+	severityUnknown  = "Unknown"
+	severityCritical = "Critical"
+)
+
+// malformedID is the vulnerability id of malformed Nydus image.
+const malformedID = "NYDUS-MALFORMED-IMAGE"
+
+// Scanner is the scanner reported to Harbor.
+type Scanner struct {
+	Name    string `json:"name"`
+	Vendor  string `json:"vendor"`
+	Version string `json:"version"`
+}
+
+type artifact struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	Tag        string `json:"tag,omitempty"`
+	MimeType   string `json:"mime_type,omitempty"`
+}
+
+type scanRequest struct {
+	Registry struct {
+		URL           string `json:"url"`
+		Authorization string `json:"authorization"`
+	} `json:"registry"`
+	Artifact artifact `json:"artifact"`
+}
+
+type vulnerability struct {
+	ID          string `json:"id"`
+	Package     string `json:"package"`
+	Version     string `json:"version"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+}
+
+type scanReport struct {
+	GeneratedAt     time.Time       `json:"generated_at"`
+	Artifact        artifact        `json:"artifact"`
+	Scanner         Scanner         `json:"scanner"`
+	Severity        string          `json:"severity"`
+	Vulnerabilities []vulnerability `json:"vulnerabilities"`
+
+	done bool
+}
+
+type scanError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func writeScanError(w http.ResponseWriter, status int, message string) {
+	var resp scanError
+	resp.Error.Message = message
+	w.Header().Set("Content-Type", "application/vnd.scanner.adapter.error+json; version=1.0")
+	utils.WriteJSON(w, status, resp)
+}
+
+// metadataHandler reports the scanner and its capabilities.
+func (server *Server) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", mediaTypeMetadata)
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"scanner": server.Scanner,
+		"capabilities": []map[string][]string{{
+			"consumes_mime_types": {ocispec.MediaTypeImageManifest, mediaTypeDockerV2},
+			"produces_mime_types": {mediaTypeReport},
+		}},
+		"properties": map[string]string{
+			"harbor.scanner-adapter/scanner-type": "os-package-vulnerability",
+		},
+	})
+}
+
+// imageFromScanRequest returns the image of scanned artifact by digest,
+// only the basic authorization of Harbor robot account is used.
+func imageFromScanRequest(req *scanRequest) (Image, error) {
+	u, err := url.Parse(req.Registry.URL)
+	if err != nil || u.Host == "" {
+		return Image{}, fmt.Errorf("invalid registry url %q", req.Registry.URL)
+	}
+	if req.Artifact.Repository == "" || req.Artifact.Digest == "" {
+		return Image{}, fmt.Errorf("repository and digest of artifact are required")
+	}
+	image := Image{
+		Ref:      fmt.Sprintf("%s/%s@%s", u.Host, req.Artifact.Repository, req.Artifact.Digest),
+		Insecure: u.Scheme == "http",
+	}
+	if strings.HasPrefix(req.Registry.Authorization, "Basic ") {
+		image.Auth = strings.TrimPrefix(req.Registry.Authorization, "Basic ")
+	}
+	return image, nil
+}
+
+// scanHandler accepts the scan request of Harbor, and checks the artifact
+// in background.
+func (server *Server) scanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req scanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeScanError(w, http.StatusBadRequest, fmt.Sprintf("invalid scan request: %s", err))
+		return
+	}
+	image, err := imageFromScanRequest(&req)
+	if err != nil {
+		writeScanError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	id := uuid.New().String()
+	report := &scanReport{Artifact: req.Artifact, Scanner: server.Scanner}
+	server.mu.Lock()
+	server.reports[id] = report
+	server.scans = append(server.scans, id)
+	for len(server.scans) > maxScanReports {
+		delete(server.reports, server.scans[0])
+		server.scans = server.scans[1:]
+	}
+	server.mu.Unlock()
+
+	go func() {
+		problems := server.checkImages(context.Background(), []Image{image})
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		report.GeneratedAt = time.Now()
+		report.Severity = severityNone
+		report.Vulnerabilities = []vulnerability{}
+		for _, p := range problems {
+			// The image failed to check isn't reported as malformed
+			if !p.Malformed {
+				if report.Severity == severityNone {
+					report.Severity = severityUnknown
+				}
+				continue
+			}
+			report.Severity = severityCritical
+			report.Vulnerabilities = append(report.Vulnerabilities, vulnerability{
+				ID:          malformedID,
+				Package:     req.Artifact.Repository,
+				Version:     req.Artifact.Digest,
+				Severity:    severityCritical,
+				Description: p.Err.Error(),
+			})
+		}
+		report.done = true
+	}()
+
+	w.Header().Set("Content-Type", mediaTypeScanResponse)
+	utils.WriteJSON(w, http.StatusAccepted, map[string]string{"id": id})
+}
+
+// reportHandler returns the report of scan, Harbor is told to retry later
+// if the scan is in progress.
+func (server *Server) reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/scan/")
+	if !strings.HasSuffix(path, "/report") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := strings.TrimSuffix(path, "/report")
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	report, ok := server.reports[id]
+	if !ok {
+		writeScanError(w, http.StatusNotFound, fmt.Sprintf("scan %s not found", id))
+		return
+	}
+	if !report.done {
+		w.Header().Set("Refresh-After", "5")
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", mediaTypeReport)
+	utils.WriteJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// admissionReview is the subset of AdmissionReview in admission.k8s.io/v1
+// and v1beta1 used by webhook, the response echoes the apiVersion.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string          `json:"uid"`
+	Operation string          `json:"operation"`
+	Object    json.RawMessage `json:"object"`
+}
+
+type admissionResponse struct {
+	UID      string   `json:"uid"`
+	Allowed  bool     `json:"allowed"`
+	Status   *status  `json:"status,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type container struct {
+	Image string `json:"image"`
+}
+
+type podSpec struct {
+	Containers          []container `json:"containers"`
+	InitContainers      []container `json:"initContainers"`
+	EphemeralContainers []container `json:"ephemeralContainers"`
+}
+
+type podTemplate struct {
+	Spec podSpec `json:"spec"`
+}
+
+// workload is the object of Pod, the workloads with pod template, e.g.
+// Deployment, StatefulSet, DaemonSet, ReplicaSet and Job, or CronJob.
+type workload struct {
+	Spec struct {
+		podSpec
+		Template    podTemplate `json:"template"`
+		JobTemplate struct {
+			Spec struct {
+				Template podTemplate `json:"template"`
+			} `json:"spec"`
+		} `json:"jobTemplate"`
+	} `json:"spec"`
+}
+
+// workloadImages returns the distinct images of containers in object.
+func workloadImages(object []byte) ([]string, error) {
+	var w workload
+	if err := json.Unmarshal(object, &w); err != nil {
+		return nil, err
+	}
+	images := []string{}
+	seen := map[string]bool{}
+	for _, spec := range []podSpec{w.Spec.podSpec, w.Spec.Template.Spec, w.Spec.JobTemplate.Spec.Template.Spec} {
+		for _, containers := range [][]container{spec.InitContainers, spec.Containers, spec.EphemeralContainers} {
+			for _, c := range containers {
+				if c.Image != "" && !seen[c.Image] {
+					seen[c.Image] = true
+					images = append(images, c.Image)
+				}
+			}
+		}
+	}
+	return images, nil
+}
+
+// validateHandler checks the Nydus images of workload in AdmissionReview,
+// the workload is rejected in enforce mode or admitted with warnings in
+// warn mode if any of them is malformed.
+func (server *Server) validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var review admissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionResponse{UID: review.Request.UID, Allowed: true}
+	refs, err := workloadImages(review.Request.Object)
+	if err != nil {
+		response.Allowed = false
+		response.Status = &status{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid object: %s", err)}
+		utils.WriteJSON(w, http.StatusOK, admissionReview{APIVersion: review.APIVersion, Kind: review.Kind, Response: response})
+		return
+	}
+
+	images := []Image{}
+	for _, ref := range refs {
+		images = append(images, Image{Ref: ref, Insecure: server.Insecure})
+	}
+	// The images failed to check are admitted with warnings, so that the
+	// workloads aren't rejected by the registry unreachable by webhook
+	messages := []string{}
+	for _, p := range server.checkImages(r.Context(), images) {
+		if !p.Malformed {
+			response.Warnings = append(response.Warnings, fmt.Sprintf("unchecked image %s: %s", p.Image, p.Err))
+			continue
+		}
+		messages = append(messages, fmt.Sprintf("malformed nydus image %s: %s", p.Image, p.Err))
+	}
+	if len(messages) > 0 {
+		if server.Mode == ModeEnforce {
+			response.Allowed = false
+			response.Status = &status{Code: http.StatusForbidden, Message: strings.Join(messages, "; ")}
+		} else {
+			response.Warnings = append(response.Warnings, messages...)
+		}
+	}
+	utils.WriteJSON(w, http.StatusOK, admissionReview{APIVersion: review.APIVersion, Kind: review.Kind, Response: response})
+}
@@ -0,0 +1,355 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package alias maps the converted Nydus images to their source images.
+// The Nydus manifest is annotated with the repository, tag and digest of
+// source image, and a conversion index artifact tagged in the target
+// repository lists all the Nydus manifests converted into it, so that the
+// converted image of a source image can be looked up by `nydusify ls`
+// without pulling every manifest in the repository.
+package alias
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	// IndexTag is the tag of conversion index in target repository.
+	IndexTag = "nydus-conversion-index"
+	// ConfigMediaType is the config media type of conversion index
+	// manifest, which identifies the artifact.
+	ConfigMediaType = "application/vnd.nydus.conversion-index.config.v1+json"
+	// MediaType is the media type of the layer holding Index in JSON.
+	MediaType = "application/vnd.nydus.conversion-index.v1+json"
+
+	// The source image of Nydus manifest
+	AnnotationSourceRepository = "containerd.io/snapshot/nydus-source-repository"
+	AnnotationSourceTag        = "containerd.io/snapshot/nydus-source-tag"
+	AnnotationSourceManifest   = "containerd.io/snapshot/nydus-source-manifest"
+)
+
+// UpdateRetries specifies the maximum retries of updating conversion index
+// on conflict with another converter.
+var UpdateRetries uint = 5
+
+// MaxEntries specifies the maximum entries in conversion index, the oldest
+// entries are dropped once exceeded.
+var MaxEntries = 10000
+
+var errConflict = errors.New("Conversion index was updated concurrently")
+
+// Source is the source image of a Nydus image.
+type Source struct {
+	// Repository is the normalized repository name, or the reference as
+	// is for the source not in registry, e.g. docker-daemon://<image>.
+	Repository string `json:"repository"`
+	// Tag is empty if the source is referenced by digest.
+	Tag string `json:"tag,omitempty"`
+	// Digest is the digest of source manifest.
+	Digest digest.Digest `json:"digest"`
+}
+
+// Entry records a Nydus manifest converted into the repository.
+type Entry struct {
+	// Tag is the tag of Nydus manifest, it's empty if the manifest is
+	// pushed by digest, e.g. as a referrer of source manifest.
+	Tag     string        `json:"tag,omitempty"`
+	Digest  digest.Digest `json:"digest"`
+	Source  Source        `json:"source"`
+	Created time.Time     `json:"created"`
+}
+
+// Index is the conversion index of a repository, the entries are ordered
+// by creation time.
+type Index struct {
+	Entries []Entry `json:"entries"`
+}
+
+// NewSource makes the source of the image referenced by ref.
+func NewSource(ref string, dgst digest.Digest) Source {
+	source := Source{Repository: ref, Digest: dgst}
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return source
+	}
+	source.Repository = named.Name()
+	if tagged, ok := named.(docker.Tagged); ok {
+		source.Tag = tagged.Tag()
+	}
+	return source
+}
+
+// Annotate sets the annotations of source in Nydus manifest.
+func (source Source) Annotate(manifest *ocispec.Manifest) {
+	if manifest.Annotations == nil {
+		manifest.Annotations = map[string]string{}
+	}
+	manifest.Annotations[AnnotationSourceRepository] = source.Repository
+	if source.Tag != "" {
+		manifest.Annotations[AnnotationSourceTag] = source.Tag
+	}
+	manifest.Annotations[AnnotationSourceManifest] = source.Digest.String()
+}
+
+// Matches returns true if the source is the image referenced by ref, which
+// is a repository, a tagged reference or a manifest digest.
+func (source Source) Matches(ref string) bool {
+	if dgst, err := digest.Parse(ref); err == nil {
+		return source.Digest == dgst
+	}
+	if source.Repository == ref {
+		return true
+	}
+	named, err := docker.ParseNormalizedNamed(ref)
+	if err != nil || named.Name() != source.Repository {
+		return false
+	}
+	if canonical, ok := named.(docker.Canonical); ok {
+		return canonical.Digest() == source.Digest
+	}
+	if tagged, ok := named.(docker.Tagged); ok {
+		return tagged.Tag() == source.Tag
+	}
+	return true
+}
+
+// add adds the entry, the entry of the same tag and digest is replaced,
+// and the oldest entries beyond MaxEntries are dropped.
+func (index *Index) add(entry Entry) {
+	entries := []Entry{}
+	for _, existing := range index.Entries {
+		if existing.Tag != entry.Tag || existing.Digest != entry.Digest {
+			entries = append(entries, existing)
+		}
+	}
+	entries = append(entries, entry)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	if MaxEntries > 0 && len(entries) > MaxEntries {
+		entries = entries[len(entries)-MaxEntries:]
+	}
+	index.Entries = entries
+}
+
+// Lookup returns the entries whose source matches ref, or all the entries
+// if ref is empty, the latest entry comes first.
+func (index *Index) Lookup(ref string) []Entry {
+	entries := []Entry{}
+	for idx := len(index.Entries) - 1; idx >= 0; idx-- {
+		if ref == "" || index.Entries[idx].Source.Matches(ref) {
+			entries = append(entries, index.Entries[idx])
+		}
+	}
+	return entries
+}
+
+// PrintEntries prints the entries as a table.
+func PrintEntries(w io.Writer, entries []Entry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TAG\tDIGEST\tSOURCE\tSOURCE DIGEST\tCREATED")
+	for _, entry := range entries {
+		tag := entry.Tag
+		if tag == "" {
+			tag = "<none>"
+		}
+		source := entry.Source.Repository
+		if entry.Source.Tag != "" {
+			source += ":" + entry.Source.Tag
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", tag, entry.Digest, source, entry.Source.Digest, entry.Created.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+// locks serializes the updates of conversion index in the same repository
+// by the conversions running in this process.
+var locks sync.Map
+
+func lock(repository string) *sync.Mutex {
+	mu, _ := locks.LoadOrStore(repository, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// Pull pulls the conversion index of the repository of target, returns an
+// empty index if it doesn't exist.
+func Pull(ctx context.Context, target *remote.Remote) (*Index, error) {
+	indexRemote, err := target.WithTag(IndexTag)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse conversion index reference")
+	}
+	index, _, err := pull(ctx, indexRemote)
+	return index, err
+}
+
+func pullJSON(ctx context.Context, r *remote.Remote, desc ocispec.Descriptor, v interface{}) error {
+	reader, err := r.Pull(ctx, desc, true)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// pull returns the conversion index and the digest of its manifest, the
+// digest is empty if it doesn't exist.
+func pull(ctx context.Context, indexRemote *remote.Remote) (*Index, digest.Digest, error) {
+	desc, err := indexRemote.Resolve(ctx)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return &Index{Entries: []Entry{}}, "", nil
+		}
+		return nil, "", errors.Wrap(err, "Resolve conversion index")
+	}
+
+	var manifest ocispec.Manifest
+	if err := pullJSON(ctx, indexRemote, *desc, &manifest); err != nil {
+		return nil, "", errors.Wrap(err, "Pull conversion index manifest")
+	}
+	if manifest.Config.MediaType != ConfigMediaType || len(manifest.Layers) != 1 {
+		return nil, "", fmt.Errorf("Tag %s isn't a conversion index", IndexTag)
+	}
+	var index Index
+	if err := pullJSON(ctx, indexRemote, manifest.Layers[0], &index); err != nil {
+		return nil, "", errors.Wrap(err, "Pull conversion index")
+	}
+	if index.Entries == nil {
+		index.Entries = []Entry{}
+	}
+
+	return &index, desc.Digest, nil
+}
+
+// push pushes the conversion index as an artifact manifest tagged with
+// IndexTag, returns the digest of manifest.
+func push(ctx context.Context, indexRemote *remote.Remote, index *Index) (digest.Digest, error) {
+	layerDesc, layerBytes, err := utils.MarshalToDesc(index, MediaType)
+	if err != nil {
+		return "", errors.Wrap(err, "Marshal conversion index")
+	}
+	if err := indexRemote.Push(ctx, *layerDesc, true, bytes.NewReader(layerBytes)); err != nil {
+		return "", errors.Wrap(err, "Push conversion index")
+	}
+	configDesc, configBytes, err := utils.MarshalToDesc(struct{}{}, ConfigMediaType)
+	if err != nil {
+		return "", errors.Wrap(err, "Marshal conversion index config")
+	}
+	if err := indexRemote.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return "", errors.Wrap(err, "Push conversion index config")
+	}
+
+	manifest := struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Manifest: ocispec.Manifest{
+			Versioned: specs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: *configDesc,
+			Layers: []ocispec.Descriptor{*layerDesc},
+		},
+	}
+	manifestDesc, manifestBytes, err := utils.MarshalToDesc(manifest, ocispec.MediaTypeImageManifest)
+	if err != nil {
+		return "", errors.Wrap(err, "Marshal conversion index manifest")
+	}
+	if err := indexRemote.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
+		return "", errors.Wrap(err, "Push conversion index manifest")
+	}
+
+	return manifestDesc.Digest, nil
+}
+
+// currentDigest returns the digest of conversion index manifest, returns
+// empty digest if it doesn't exist.
+func currentDigest(ctx context.Context, indexRemote *remote.Remote) (digest.Digest, error) {
+	desc, err := indexRemote.Resolve(ctx)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.Wrap(err, "Resolve conversion index")
+	}
+	return desc.Digest, nil
+}
+
+func record(ctx context.Context, indexRemote *remote.Remote, entry Entry) error {
+	index, pulled, err := pull(ctx, indexRemote)
+	if err != nil {
+		return err
+	}
+	index.add(entry)
+
+	// The registry doesn't support conditional push, so the conflict is
+	// detected by checking the index before and after pushing.
+	current, err := currentDigest(ctx, indexRemote)
+	if err != nil {
+		return err
+	}
+	if current != pulled {
+		return errConflict
+	}
+	pushed, err := push(ctx, indexRemote, index)
+	if err != nil {
+		return err
+	}
+	current, err = currentDigest(ctx, indexRemote)
+	if err != nil {
+		return err
+	}
+	if current != pushed {
+		return errConflict
+	}
+
+	return nil
+}
+
+// Record adds the entry to the conversion index of the repository of
+// target. The concurrent updates from other processes are detected by the
+// digest of index and retried with the entries merged, but the update
+// racing between the checks of another converter may still be lost.
+func Record(ctx context.Context, target *remote.Remote, entry Entry) error {
+	indexRemote, err := target.WithTag(IndexTag)
+	if err != nil {
+		return errors.Wrap(err, "Parse conversion index reference")
+	}
+	mu := lock(indexRemote.Ref)
+	mu.Lock()
+	defer mu.Unlock()
+
+	for attempt := uint(0); attempt <= UpdateRetries; attempt++ {
+		err := record(ctx, indexRemote, entry)
+		if !errors.Is(err, errConflict) {
+			return err
+		}
+		logrus.Warnf("Conversion index %s was updated concurrently, merge entries and retry", indexRemote.Ref)
+	}
+	return errors.Wrapf(errConflict, "Update conversion index after %d retries", UpdateRetries)
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package alias
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestSource(t *testing.T) {
+	source := NewSource("nginx:1.21", digest.FromString("nginx"))
+	assert.Equal(t, Source{Repository: "docker.io/library/nginx", Tag: "1.21", Digest: digest.FromString("nginx")}, source)
+	assert.True(t, source.Matches("nginx"))
+	assert.True(t, source.Matches("docker.io/library/nginx:1.21"))
+	assert.True(t, source.Matches(digest.FromString("nginx").String()))
+	assert.True(t, source.Matches("nginx@"+digest.FromString("nginx").String()))
+	assert.False(t, source.Matches("nginx:latest"))
+	assert.False(t, source.Matches("redis"))
+	assert.False(t, source.Matches(digest.FromString("redis").String()))
+
+	source = NewSource("docker-daemon://app:v1", digest.FromString("app"))
+	assert.Equal(t, "docker-daemon://app:v1", source.Repository)
+	assert.Empty(t, source.Tag)
+	assert.True(t, source.Matches("docker-daemon://app:v1"))
+
+	var manifest ocispec.Manifest
+	source.Annotate(&manifest)
+	assert.Equal(t, map[string]string{
+		AnnotationSourceRepository: "docker-daemon://app:v1",
+		AnnotationSourceManifest:   digest.FromString("app").String(),
+	}, manifest.Annotations)
+}
+
+func TestIndex(t *testing.T) {
+	maxEntries := MaxEntries
+	defer func() {
+		MaxEntries = maxEntries
+	}()
+	MaxEntries = 3
+
+	now := time.Now()
+	nginx := NewSource("nginx:1.21", digest.FromString("nginx"))
+	redis := NewSource("redis:6", digest.FromString("redis"))
+	index := Index{}
+	index.add(Entry{Tag: "1.21", Digest: digest.FromString("v1"), Source: nginx, Created: now})
+	index.add(Entry{Tag: "6", Digest: digest.FromString("v2"), Source: redis, Created: now.Add(time.Second)})
+	// The same tag and digest is replaced
+	index.add(Entry{Tag: "1.21", Digest: digest.FromString("v1"), Source: nginx, Created: now.Add(2 * time.Second)})
+	require.Len(t, index.Entries, 2)
+	assert.Equal(t, "6", index.Entries[0].Tag)
+
+	index.add(Entry{Tag: "1.21", Digest: digest.FromString("v3"), Source: nginx, Created: now.Add(3 * time.Second)})
+	index.add(Entry{Digest: digest.FromString("v4"), Source: nginx, Created: now.Add(4 * time.Second)})
+	// The oldest entry is dropped
+	require.Len(t, index.Entries, 3)
+	assert.Empty(t, index.Lookup("redis"))
+
+	entries := index.Lookup("nginx:1.21")
+	require.Len(t, entries, 3)
+	assert.Equal(t, digest.FromString("v4"), entries[0].Digest)
+	assert.Equal(t, digest.FromString("v1"), entries[2].Digest)
+	assert.Len(t, index.Lookup(""), 3)
+
+	var buf bytes.Buffer
+	require.Nil(t, PrintEntries(&buf, entries[:1]))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[1], "<none>  "+digest.FromString("v4").String()+"  docker.io/library/nginx:1.21  "))
+}
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-alias-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	target, err := remote.NewLayout(dir, "v1")
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	index, err := Pull(ctx, target)
+	require.Nil(t, err)
+	assert.Empty(t, index.Entries)
+
+	nginx := NewSource("nginx:1.21", digest.FromString("nginx"))
+	require.Nil(t, Record(ctx, target, Entry{Tag: "v1", Digest: digest.FromString("v1"), Source: nginx, Created: time.Now().UTC()}))
+	other, err := remote.NewLayout(dir, "v2")
+	require.Nil(t, err)
+	require.Nil(t, Record(ctx, other, Entry{Tag: "v2", Digest: digest.FromString("v2"), Source: nginx, Created: time.Now().UTC()}))
+
+	index, err = Pull(ctx, target)
+	require.Nil(t, err)
+	entries := index.Lookup("nginx")
+	require.Len(t, entries, 2)
+	assert.Equal(t, "v2", entries[0].Tag)
+	assert.Equal(t, nginx, entries[1].Source)
+
+	// The tag of conversion index is taken by other image
+	desc, data, err := utils.MarshalToDesc(ocispec.Manifest{}, ocispec.MediaTypeImageManifest)
+	require.Nil(t, err)
+	taken, err := remote.NewLayout(dir, IndexTag)
+	require.Nil(t, err)
+	require.Nil(t, taken.Push(ctx, *desc, false, bytes.NewReader(data)))
+	_, err = Pull(ctx, target)
+	assert.NotNil(t, err)
+}
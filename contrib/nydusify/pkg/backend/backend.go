@@ -7,17 +7,21 @@ package backend
 import (
 	"context"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
 // Backend transers artifacts generated during image conversion to a backend storage such as:
 //		1. registry: complying to OCI distribution specification, push blob file
 //		   to registry and use the registry as a storage.
 //		2. oss: A object storage backend, which uses its SDK to transer blob file.
+//		3. s3/gcs: The object storage backends compatible with AWS S3 API.
 type Backend interface {
 	// TODO: Hopefully, we can pass `Layer` struct in, thus to be able to cook both
 	// file handle and file path.
@@ -33,8 +37,95 @@ type BackendType = int
 const (
 	OssBackend BackendType = iota
 	RegistryBackend
+	S3Backend
+	GCSBackend
 )
 
+// ConfigHinter is implemented by the object storage backends, the hint is
+// the backend config without credentials, it's recorded in the annotation
+// of bootstrap layer, so that the runtime knows where to fetch the blobs
+// which aren't stored in registry.
+type ConfigHinter interface {
+	ConfigHint() map[string]string
+}
+
+// Reader is implemented by the object storage backends, it's used to
+// read the blobs from storage backend, e.g. when relocating blobs.
+type Reader interface {
+	Reader(ctx context.Context, blobID string) (io.ReadCloser, error)
+}
+
+// BlobObject is a blob stored in object storage backend.
+type BlobObject struct {
+	BlobID       string
+	Size         int64
+	LastModified time.Time
+}
+
+// Collector is implemented by the object storage backends, it's used to
+// enumerate and delete the blobs, e.g. when collecting orphan blobs.
+type Collector interface {
+	// List returns the blobs under the object prefix, the objects whose
+	// name isn't a blob ID are skipped.
+	List(ctx context.Context) ([]BlobObject, error)
+	Delete(ctx context.Context, blobID string) error
+}
+
+// ErrPreconditionFailed is returned by conditional put when the object
+// was modified by others since read.
+var ErrPreconditionFailed = errors.New("Precondition failed")
+
+// ObjectStore is implemented by the object storage backends, it's used to
+// store the objects other than Nydus blobs, e.g. build cache image, the
+// keys are relative to the object prefix.
+type ObjectStore interface {
+	// GetObject returns the content and ETag of object, returns
+	// errdefs.ErrNotFound if the object doesn't exist.
+	GetObject(ctx context.Context, key string) (io.ReadCloser, string, error)
+	// PutObject stores the content of object with digest dgst, the object
+	// is stored only if its current ETag matches ifMatch (empty means the
+	// object doesn't exist) if ifMatch isn't nil, otherwise returns
+	// ErrPreconditionFailed.
+	PutObject(ctx context.Context, key string, reader io.Reader, size int64, dgst digest.Digest, ifMatch *string) error
+}
+
+// NewObjectStore creates the object store of object storage backend, the
+// config is the same with NewBackend.
+func NewObjectStore(bt string, config []byte) (ObjectStore, error) {
+	switch bt {
+	case "oss":
+		return newOSSBackend(config)
+	case "s3":
+		return newS3Backend(config)
+	case "gcs":
+		return newGCSBackend(config)
+	default:
+		return nil, fmt.Errorf("unsupported object storage backend type %s", bt)
+	}
+}
+
+// isBlobID returns true if name is a blob ID, which is the hex encoded
+// sha256 digest of blob.
+func isBlobID(name string) bool {
+	return digest.NewDigestFromEncoded(digest.SHA256, name).Validate() == nil
+}
+
+// TypeName returns the backend type name used by `--backend-type` option.
+func TypeName(bt BackendType) string {
+	switch bt {
+	case OssBackend:
+		return "oss"
+	case RegistryBackend:
+		return "registry"
+	case S3Backend:
+		return "s3"
+	case GCSBackend:
+		return "gcs"
+	default:
+		return "unknown"
+	}
+}
+
 func blobDesc(size int64, blobId string) ocispec.Descriptor {
 	blobDigest := digest.NewDigestFromEncoded(digest.SHA256, blobId)
 	desc := ocispec.Descriptor{
@@ -55,7 +146,7 @@ func blobDesc(size int64, blobId string) ocispec.Descriptor {
 // Nydusify majorly works for registry backend, which means blob is stored in
 // registry as per OCI distribution specification. But nydus can also make OSS
 // as rafs backend storage. Therefore, nydusify better have the ability to upload
-// blob into OSS. OSS is configured via a json string input. Currently, it has
+// blob into OSS (or S3/GCS). Object storage is configured via a json string input. Currently, it has
 // no effect to registry backend now.
 // Save byte slice here because I don't find a way to represent
 // all the backend types at the same time
@@ -65,6 +156,10 @@ func NewBackend(bt string, config []byte, remote *remote.Remote) (Backend, error
 		return newOSSBackend(config)
 	case "registry":
 		return newRegistryBackend(config, remote)
+	case "s3":
+		return newS3Backend(config)
+	case "gcs":
+		return newGCSBackend(config)
 	default:
 		return nil, fmt.Errorf("unsupported backend type %s", bt)
 	}
@@ -8,14 +8,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/ratelimit"
 )
 
 const (
@@ -28,6 +35,7 @@ type OSSBackend struct {
 	// OSS storage does not support directory. Therefore add a prefix to each object
 	// to make it a path-like object.
 	objectPrefix string
+	endpoint     string
 	bucket       *oss.Bucket
 }
 
@@ -61,6 +69,7 @@ func newOSSBackend(rawConfig []byte) (*OSSBackend, error) {
 
 	return &OSSBackend{
 		objectPrefix: objectPrefix,
+		endpoint:     endpoint,
 		bucket:       bucket,
 	}, nil
 }
@@ -105,13 +114,21 @@ func (b *OSSBackend) Upload(ctx context.Context, blobID, blobPath string, size i
 			return nil, err
 		}
 
+		file, err := os.Open(blobPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
 		var parts []oss.UploadPart
 
+		limiter := ratelimit.PushLimiter(ctx)
 		g := new(errgroup.Group)
 		for _, chunk := range chunks {
 			ck := chunk
 			g.Go(func() error {
-				p, err := b.bucket.UploadPartFromFile(imur, blobPath, ck.Offset, ck.Size, ck.Number)
+				reader := limiter.Reader(ctx, io.NewSectionReader(file, ck.Offset, ck.Size))
+				p, err := b.bucket.UploadPart(imur, reader, ck.Size, ck.Number)
 				if err != nil {
 					return err
 				}
@@ -136,7 +153,10 @@ func (b *OSSBackend) Upload(ctx context.Context, blobID, blobPath string, size i
 			return nil, err
 		}
 		defer reader.Close()
-		err = b.bucket.PutObject(blobObjectKey, reader)
+		// The content length is unknown to SDK if the reader is limited
+		err = b.bucket.PutObject(
+			blobObjectKey, ratelimit.PushLimiter(ctx).Reader(ctx, reader), oss.ContentLength(blobSize),
+		)
 		if err != nil {
 			return nil, err
 		}
@@ -156,6 +176,87 @@ func (b *OSSBackend) Check(blobID string) (bool, error) {
 	return b.bucket.IsObjectExist(blobID)
 }
 
+// Reader returns the reader of blob object.
+func (b *OSSBackend) Reader(ctx context.Context, blobID string) (io.ReadCloser, error) {
+	return b.bucket.GetObject(b.objectPrefix + blobID)
+}
+
+// List returns the blobs under the object prefix.
+func (b *OSSBackend) List(ctx context.Context) ([]BlobObject, error) {
+	blobs := []BlobObject{}
+	marker := ""
+	for {
+		result, err := b.bucket.ListObjects(oss.Prefix(b.objectPrefix), oss.Marker(marker), oss.MaxKeys(1000))
+		if err != nil {
+			return nil, errors.Wrap(err, "List objects")
+		}
+		for _, object := range result.Objects {
+			blobID := strings.TrimPrefix(object.Key, b.objectPrefix)
+			if !isBlobID(blobID) {
+				continue
+			}
+			blobs = append(blobs, BlobObject{
+				BlobID:       blobID,
+				Size:         object.Size,
+				LastModified: object.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			return blobs, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// Delete deletes the blob object.
+func (b *OSSBackend) Delete(ctx context.Context, blobID string) error {
+	return b.bucket.DeleteObject(b.objectPrefix + blobID)
+}
+
+// GetObject returns the content and ETag of object.
+func (b *OSSBackend) GetObject(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	result, err := b.bucket.DoGetObject(&oss.GetObjectRequest{ObjectKey: b.objectPrefix + key}, nil)
+	if err != nil {
+		if serviceErr, ok := err.(oss.ServiceError); ok && serviceErr.StatusCode == http.StatusNotFound {
+			return nil, "", errors.Wrapf(errdefs.ErrNotFound, "object %s", key)
+		}
+		return nil, "", err
+	}
+	return result.Response.Body, result.Response.Headers.Get(oss.HTTPHeaderEtag), nil
+}
+
+// PutObject stores the object, the conditional put relies on `If-Match`
+// and `x-oss-forbid-overwrite` headers.
+func (b *OSSBackend) PutObject(
+	ctx context.Context, key string, reader io.Reader, size int64, dgst digest.Digest, ifMatch *string,
+) error {
+	options := []oss.Option{oss.ContentLength(size)}
+	if ifMatch != nil {
+		if *ifMatch == "" {
+			options = append(options, oss.ForbidOverWrite(true))
+		} else {
+			options = append(options, oss.IfMatch(*ifMatch))
+		}
+	}
+	if err := b.bucket.PutObject(b.objectPrefix+key, reader, options...); err != nil {
+		if serviceErr, ok := err.(oss.ServiceError); ok &&
+			(serviceErr.StatusCode == http.StatusPreconditionFailed || serviceErr.Code == "FileAlreadyExists") {
+			return errors.Wrapf(ErrPreconditionFailed, "object %s", key)
+		}
+		return err
+	}
+	return nil
+}
+
 func (r *OSSBackend) Type() BackendType {
 	return OssBackend
 }
+
+// ConfigHint returns the backend config without credentials.
+func (r *OSSBackend) ConfigHint() map[string]string {
+	return map[string]string{
+		"endpoint":      r.endpoint,
+		"bucket_name":   r.bucket.BucketName,
+		"object_prefix": r.objectPrefix,
+	}
+}
@@ -24,7 +24,7 @@ func (r *Registry) Upload(ctx context.Context, blobID, blobPath string,
 	}
 	defer blobFile.Close()
 
-	if err := r.remote.Push(ctx, desc, true, blobFile); err != nil {
+	if err := r.remote.PushBlob(ctx, desc, blobFile); err != nil {
 		return nil, errors.Wrap(err, "Push blob layer")
 	}
 
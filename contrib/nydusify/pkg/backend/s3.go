@@ -0,0 +1,478 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/ratelimit"
+)
+
+const (
+	s3Service         = "s3"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DefaultRegion   = "us-east-1"
+	s3DefaultPartSize = 64 * 1024 * 1024
+	// The parts of multipart upload are uploaded concurrently.
+	s3UploadConcurrency = 4
+
+	gcsDefaultEndpoint = "storage.googleapis.com"
+	gcsDefaultRegion   = "auto"
+)
+
+// S3 uploads blobs to the object storage compatible with AWS S3 API, the
+// requests are signed by AWS signature version 4 with the signer of AWS SDK.
+// Google Cloud Storage is supported by its S3 compatible XML API with HMAC
+// keys.
+type S3 struct {
+	backendType     BackendType
+	scheme          string
+	endpoint        string
+	region          string
+	bucketName      string
+	objectPrefix    string
+	accessKeyID     string
+	accessKeySecret string
+	partSize        int64
+	client          *http.Client
+	signer          *v4.Signer
+}
+
+type s3Config struct {
+	Scheme          string `json:"scheme"`
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	BucketName      string `json:"bucket_name"`
+	ObjectPrefix    string `json:"object_prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	AccessKeySecret string `json:"access_key_secret"`
+}
+
+func newS3Backend(rawConfig []byte) (*S3, error) {
+	return newS3CompatibleBackend(rawConfig, S3Backend, "", s3DefaultRegion)
+}
+
+func newGCSBackend(rawConfig []byte) (*S3, error) {
+	return newS3CompatibleBackend(rawConfig, GCSBackend, gcsDefaultEndpoint, gcsDefaultRegion)
+}
+
+func newS3CompatibleBackend(
+	rawConfig []byte, backendType BackendType, defaultEndpoint, defaultRegion string,
+) (*S3, error) {
+	var config s3Config
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return nil, errors.Wrap(err, "Parse object storage backend configuration")
+	}
+
+	if config.Endpoint == "" {
+		config.Endpoint = defaultEndpoint
+	}
+	if config.Endpoint == "" || config.BucketName == "" {
+		return nil, fmt.Errorf("no endpoint or bucket is specified")
+	}
+	if config.Region == "" {
+		config.Region = defaultRegion
+	}
+	if config.Scheme == "" {
+		config.Scheme = "https"
+	}
+
+	return &S3{
+		backendType:     backendType,
+		scheme:          config.Scheme,
+		endpoint:        config.Endpoint,
+		region:          config.Region,
+		bucketName:      config.BucketName,
+		objectPrefix:    config.ObjectPrefix,
+		accessKeyID:     config.AccessKeyID,
+		accessKeySecret: config.AccessKeySecret,
+		partSize:        s3DefaultPartSize,
+		client:          http.DefaultClient,
+		signer: v4.NewSigner(func(opt *v4.SignerOptions) {
+			opt.DisableURIPathEscaping = true
+		}),
+	}, nil
+}
+
+// s3Escape encodes the object key as required by AWS signature version 4,
+// only the unreserved characters and slash are kept.
+func s3Escape(path string) string {
+	var buf strings.Builder
+	for _, c := range []byte(path) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *S3) objectURL(key string, query url.Values) *url.URL {
+	path := "/" + b.bucketName + "/" + key
+	return &url.URL{
+		Scheme:   b.scheme,
+		Host:     b.endpoint,
+		Path:     path,
+		RawPath:  s3Escape(path),
+		RawQuery: query.Encode(),
+	}
+}
+
+// sign signs the request by AWS signature version 4, the request is sent
+// anonymously if no access key is specified.
+func (b *S3) sign(req *http.Request, payloadHash string, now time.Time) error {
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if b.accessKeyID == "" {
+		req.Header.Set("x-amz-date", now.UTC().Format(s3TimeFormat))
+		return nil
+	}
+
+	credentials := aws.Credentials{AccessKeyID: b.accessKeyID, SecretAccessKey: b.accessKeySecret}
+	// The object key in path has been escaped by s3Escape, S3 requires the
+	// path to be escaped only once in canonical request.
+	return b.signer.SignHTTP(req.Context(), credentials, req, payloadHash, s3Service, b.region, now)
+}
+
+func (b *S3) do(
+	ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, payloadHash string,
+) (*http.Response, error) {
+	return b.doWithHeader(ctx, method, key, query, nil, body, size, payloadHash)
+}
+
+func (b *S3) doWithHeader(
+	ctx context.Context, method, key string, query url.Values, header http.Header,
+	body io.Reader, size int64, payloadHash string,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, "", body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.URL = b.objectURL(key, query)
+	req.Host = req.URL.Host
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := b.sign(req, payloadHash, time.Now()); err != nil {
+		return nil, errors.Wrapf(err, "Sign request %s %s", method, key)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Request %s %s", method, key)
+	}
+	if resp.StatusCode >= 300 && !(method == http.MethodHead && resp.StatusCode == http.StatusNotFound) {
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, errors.Wrapf(errdefs.ErrNotFound, "Request %s %s", method, key)
+		case http.StatusPreconditionFailed:
+			return nil, errors.Wrapf(ErrPreconditionFailed, "Request %s %s", method, key)
+		}
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Request %s %s: unexpected status %d: %s", method, key, resp.StatusCode, message)
+	}
+
+	return resp, nil
+}
+
+func (b *S3) exist(ctx context.Context, key string) (bool, error) {
+	resp, err := b.do(ctx, http.MethodHead, key, nil, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+func (b *S3) uploadMultiparts(ctx context.Context, key, blobPath string, size int64) error {
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return errors.Wrap(err, "Initiate multipart upload")
+	}
+	defer resp.Body.Close()
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&initiated); err != nil {
+		return errors.Wrap(err, "Decode multipart upload")
+	}
+
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count := int((size + b.partSize - 1) / b.partSize)
+	parts := make([]s3CompletePart, count)
+	sem := make(chan struct{}, s3UploadConcurrency)
+	limiter := ratelimit.PushLimiter(ctx)
+	g, gctx := errgroup.WithContext(ctx)
+	for idx := 0; idx < count; idx++ {
+		number := idx + 1
+		offset := int64(idx) * b.partSize
+		partSize := b.partSize
+		if offset+partSize > size {
+			partSize = size - offset
+		}
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+
+			// The payload hash of each part needs to be calculated for signing
+			hasher := sha256.New()
+			if _, err := io.Copy(hasher, io.NewSectionReader(file, offset, partSize)); err != nil {
+				return err
+			}
+			query := url.Values{
+				"partNumber": {fmt.Sprintf("%d", number)},
+				"uploadId":   {initiated.UploadID},
+			}
+			resp, err := b.do(
+				gctx, http.MethodPut, key, query, limiter.Reader(gctx, io.NewSectionReader(file, offset, partSize)),
+				partSize, hex.EncodeToString(hasher.Sum(nil)),
+			)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			parts[number-1] = s3CompletePart{PartNumber: number, ETag: resp.Header.Get("ETag")}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		if resp, err := b.do(
+			ctx, http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, 0, sha256Hex(nil),
+		); err == nil {
+			resp.Body.Close()
+		}
+		return errors.Wrap(err, "Uploading parts failed")
+	}
+
+	complete, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err = b.do(
+		ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}},
+		bytes.NewReader(complete), int64(len(complete)), sha256Hex(complete),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Complete multipart upload")
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Upload blob as image layer to object storage. Depending on blob's size,
+// upload it by multiparts method or the normal method
+func (b *S3) Upload(ctx context.Context, blobID, blobPath string, size int64) (*ocispec.Descriptor, error) {
+	blobObjectKey := b.objectPrefix + blobID
+
+	desc := blobDesc(size, blobID)
+
+	if exist, err := b.exist(ctx, blobObjectKey); err != nil {
+		return nil, err
+	} else if exist {
+		return &desc, nil
+	}
+
+	stat, err := os.Stat(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	blobSize := stat.Size()
+
+	start := time.Now()
+
+	if blobSize >= multipartsUploadThreshold {
+		logrus.Debugf("Upload %s using multiparts method", blobObjectKey)
+		if err := b.uploadMultiparts(ctx, blobObjectKey, blobPath, blobSize); err != nil {
+			return nil, err
+		}
+	} else {
+		reader, err := os.Open(blobPath)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		// Blob ID is the sha256 digest of blob data, use it as payload hash
+		body := ratelimit.PushLimiter(ctx).Reader(ctx, reader)
+		resp, err := b.do(ctx, http.MethodPut, blobObjectKey, nil, body, blobSize, blobID)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+	}
+
+	logrus.Debugf("Uploading blob %s costs %s", blobObjectKey, time.Since(start))
+
+	return &desc, nil
+}
+
+func (b *S3) Check(blobID string) (bool, error) {
+	return b.exist(context.Background(), b.objectPrefix+blobID)
+}
+
+// Reader returns the reader of blob object.
+func (b *S3) Reader(ctx context.Context, blobID string) (io.ReadCloser, error) {
+	resp, err := b.do(ctx, http.MethodGet, b.objectPrefix+blobID, nil, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// List returns the blobs under the object prefix by ListObjectsV2 API.
+func (b *S3) List(ctx context.Context) ([]BlobObject, error) {
+	blobs := []BlobObject{}
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {b.objectPrefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := b.do(ctx, http.MethodGet, "", query, nil, 0, sha256Hex(nil))
+		if err != nil {
+			return nil, errors.Wrap(err, "List objects")
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "Decode object list")
+		}
+		for _, object := range result.Contents {
+			blobID := strings.TrimPrefix(object.Key, b.objectPrefix)
+			if !isBlobID(blobID) {
+				continue
+			}
+			blobs = append(blobs, BlobObject{
+				BlobID:       blobID,
+				Size:         object.Size,
+				LastModified: object.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Delete deletes the blob object.
+func (b *S3) Delete(ctx context.Context, blobID string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.objectPrefix+blobID, nil, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetObject returns the content and ETag of object.
+func (b *S3) GetObject(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	resp, err := b.do(ctx, http.MethodGet, b.objectPrefix+key, nil, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("ETag"), nil
+}
+
+// PutObject stores the object, the conditional put relies on `If-Match`
+// and `If-None-Match` headers.
+func (b *S3) PutObject(
+	ctx context.Context, key string, reader io.Reader, size int64, dgst digest.Digest, ifMatch *string,
+) error {
+	header := http.Header{}
+	if ifMatch != nil {
+		if *ifMatch == "" {
+			header.Set("If-None-Match", "*")
+		} else {
+			header.Set("If-Match", *ifMatch)
+		}
+	}
+	payloadHash := "UNSIGNED-PAYLOAD"
+	if dgst.Algorithm() == digest.SHA256 {
+		payloadHash = dgst.Hex()
+	}
+	resp, err := b.doWithHeader(ctx, http.MethodPut, b.objectPrefix+key, nil, header, reader, size, payloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3) Type() BackendType {
+	return b.backendType
+}
+
+// ConfigHint returns the backend config without credentials.
+func (b *S3) ConfigHint() map[string]string {
+	return map[string]string{
+		"scheme":        b.scheme,
+		"endpoint":      b.endpoint,
+		"region":        b.region,
+		"bucket_name":   b.bucketName,
+		"object_prefix": b.objectPrefix,
+	}
+}
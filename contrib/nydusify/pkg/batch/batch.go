@@ -0,0 +1,143 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package batch converts many images concurrently with a bounded worker
+// pool, e.g. for migrating a whole registry, the failure of an image
+// doesn't stop the conversions of others.
+package batch
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Image is an image to be converted in source list, the target is empty
+// if it isn't specified in the list.
+type Image struct {
+	Source string
+	Target string
+}
+
+// Result is the conversion result of an image.
+type Result struct {
+	Image
+	Duration time.Duration
+	Err      error
+}
+
+// ConvertFunc converts an image, index is the position of image in list.
+type ConvertFunc func(ctx context.Context, index int, image Image) error
+
+// ParseList parses the source list with one image per line in format
+// `<source> [<target>]`, the empty lines and `#` comments are ignored.
+func ParseList(r io.Reader) ([]Image, error) {
+	images := []Image{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid source list line %d: %s", line, text)
+		}
+		image := Image{Source: fields[0]}
+		if len(fields) == 2 {
+			image.Target = fields[1]
+		}
+		images = append(images, image)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read source list")
+	}
+	return images, nil
+}
+
+// Run converts the images by at most workers conversions at the same
+// time, and returns the results in the order of images.
+func Run(ctx context.Context, images []Image, workers uint, convert ConvertFunc) []Result {
+	if workers == 0 {
+		workers = 1
+	}
+	results := make([]Result, len(images))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for idx, image := range images {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int, image Image) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			logrus.Infof("[%d/%d] Converting %s", idx+1, len(images), image.Source)
+			start := time.Now()
+			err := convert(ctx, idx, image)
+			results[idx] = Result{
+				Image:    image,
+				Duration: time.Since(start),
+				Err:      err,
+			}
+			if err != nil {
+				logrus.Errorf("[%d/%d] Failed to convert %s: %s", idx+1, len(images), image.Source, err)
+			} else {
+				logrus.Infof("[%d/%d] Converted %s", idx+1, len(images), image.Source)
+			}
+		}(idx, image)
+	}
+	wg.Wait()
+	return results
+}
+
+// reasoner is implemented by the errors classified by their reason,
+// e.g. build.BuildError.
+type reasoner interface {
+	Reason() string
+}
+
+// PrintSummary prints the status of each image in a table, the reason
+// of failure is printed if it's classified.
+func PrintSummary(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tTARGET\tSTATUS\tDURATION")
+	for _, result := range results {
+		status := "OK"
+		if result.Err != nil {
+			status = "FAILED"
+			var r reasoner
+			if errors.As(result.Err, &r) {
+				status = fmt.Sprintf("FAILED (%s)", r.Reason())
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", result.Source, result.Target, status, result.Duration.Round(time.Second))
+	}
+	return tw.Flush()
+}
+
+// Failures returns an error listing the failed images, or nil if all
+// images are converted.
+func Failures(results []Result) error {
+	failures := []string{}
+	for _, result := range results {
+		if result.Err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", result.Source, result.Err))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"failed to convert %d of %d images:\n%s", len(failures), len(results), strings.Join(failures, "\n"),
+	)
+}
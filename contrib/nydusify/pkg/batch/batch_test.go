@@ -0,0 +1,95 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package batch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseList(t *testing.T) {
+	images, err := ParseList(strings.NewReader(`
+# base images
+library/busybox:latest
+  library/nginx:1.19   myregistry/nginx:1.19-nydus
+`))
+	require.Nil(t, err)
+	assert.Equal(t, []Image{
+		{Source: "library/busybox:latest"},
+		{Source: "library/nginx:1.19", Target: "myregistry/nginx:1.19-nydus"},
+	}, images)
+
+	_, err = ParseList(strings.NewReader("a b c\n"))
+	assert.Contains(t, err.Error(), "invalid source list line 1")
+}
+
+type reasonError struct {
+	reason string
+}
+
+func (e *reasonError) Error() string {
+	return e.reason
+}
+
+func (e *reasonError) Reason() string {
+	return e.reason
+}
+
+func TestRun(t *testing.T) {
+	images := []Image{}
+	for _, source := range []string{"a", "b", "c", "d", "e"} {
+		images = append(images, Image{Source: source, Target: source + "-nydus"})
+	}
+
+	var running, maxRunning int32
+	results := Run(context.Background(), images, 2, func(ctx context.Context, index int, image Image) error {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if image.Source == "b" {
+			return errors.New("unauthorized")
+		}
+		if image.Source == "d" {
+			return fmt.Errorf("Build source layer: %w", &reasonError{"path_too_long"})
+		}
+		return nil
+	})
+
+	assert.LessOrEqual(t, maxRunning, int32(2))
+	require.Len(t, results, 5)
+	for idx, result := range results {
+		assert.Equal(t, images[idx], result.Image)
+	}
+	assert.Nil(t, results[0].Err)
+	assert.NotNil(t, results[1].Err)
+
+	var buf bytes.Buffer
+	require.Nil(t, PrintSummary(&buf, results))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 6)
+	assert.Contains(t, lines[1], "a-nydus")
+	assert.Contains(t, lines[1], "OK")
+	assert.Contains(t, lines[2], "FAILED")
+	assert.Contains(t, lines[4], "FAILED (path_too_long)")
+
+	err := Failures(results)
+	assert.Equal(t, "failed to convert 2 of 5 images:\nb: unauthorized\nd: Build source layer: path_too_long", err.Error())
+	assert.Nil(t, Failures(results[:1]))
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package bloom implements a compact bloom filter used to index the chunk
+// digests of Nydus image, it helps to quickly estimate the chunk overlap
+// between images without pulling and parsing the whole bootstrap.
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+)
+
+const (
+	// MediaType is the media type of bloom filter blob in registry.
+	MediaType = "application/vnd.nydus.chunk-bloom.v1"
+	// ConfigMediaType is the media type of the config in bloom filter artifact manifest.
+	ConfigMediaType = "application/vnd.nydus.chunk-bloom.config.v1+json"
+
+	// MaxBits is the max number of bits of bloom filter decoded by
+	// ReadFrom, it's about 100 million keys at 1% false positive rate.
+	MaxBits = uint64(1) << 30
+	// MaxHashes is the max number of hash functions of bloom filter.
+	MaxHashes = uint32(64)
+
+	magic   = "NBLM"
+	version = uint32(1)
+)
+
+// DefaultFalsePositiveRate is the expected false positive rate of the bloom
+// filter created by NewWithEstimates.
+var DefaultFalsePositiveRate = 0.01
+
+// Filter is a bloom filter, the location of a key is calculated by double
+// hashing with FNV-1 and FNV-1a.
+//
+// The filter is encoded in big endian as:
+//
+//	magic(4) | version(4) | k(4) | reserved(4) | m(8) | n(8) | bits(m/64*8)
+type Filter struct {
+	// Number of hash functions
+	k uint32
+	// Number of bits
+	m uint64
+	// Number of added keys
+	n    uint64
+	bits []uint64
+}
+
+// New creates a bloom filter with m bits and k hash functions, k is
+// limited to MaxHashes.
+func New(m uint64, k uint32) *Filter {
+	if m == 0 {
+		m = 1
+	}
+	if k == 0 {
+		k = 1
+	}
+	if k > MaxHashes {
+		k = MaxHashes
+	}
+	words := (m + 63) / 64
+	return &Filter{
+		k:    k,
+		m:    words * 64,
+		bits: make([]uint64, words),
+	}
+}
+
+// NewWithEstimates creates a bloom filter for about n keys with the
+// expected false positive rate fp.
+func NewWithEstimates(n uint64, fp float64) *Filter {
+	if n == 0 {
+		n = 1
+	}
+	if fp <= 0 || fp >= 1 {
+		fp = DefaultFalsePositiveRate
+	}
+	m := math.Ceil(-float64(n) * math.Log(fp) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	return New(uint64(m), uint32(math.Max(k, 1)))
+}
+
+func (filter *Filter) locations(key []byte) (uint64, uint64) {
+	h1 := fnv.New64()
+	h1.Write(key)
+	h2 := fnv.New64a()
+	h2.Write(key)
+	// Make sure the second hash is odd to walk through all bits
+	return h1.Sum64(), h2.Sum64() | 1
+}
+
+// Add adds the key to bloom filter.
+func (filter *Filter) Add(key []byte) {
+	h1, h2 := filter.locations(key)
+	for i := uint64(0); i < uint64(filter.k); i++ {
+		loc := (h1 + i*h2) % filter.m
+		filter.bits[loc/64] |= 1 << (loc % 64)
+	}
+	filter.n++
+}
+
+// Test returns false if the key is definitely not in bloom filter.
+func (filter *Filter) Test(key []byte) bool {
+	h1, h2 := filter.locations(key)
+	for i := uint64(0); i < uint64(filter.k); i++ {
+		loc := (h1 + i*h2) % filter.m
+		if filter.bits[loc/64]&(1<<(loc%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns the number of keys added to bloom filter.
+func (filter *Filter) Count() uint64 {
+	return filter.n
+}
+
+// Overlap estimates the ratio of the keys in bloom filter that also
+// exist in the given key list, the result is in range [0, 1].
+func (filter *Filter) Overlap(keys [][]byte) float64 {
+	if len(keys) == 0 {
+		return 0
+	}
+	hit := 0
+	for _, key := range keys {
+		if filter.Test(key) {
+			hit++
+		}
+	}
+	return float64(hit) / float64(len(keys))
+}
+
+// WriteTo writes the encoded bloom filter to writer.
+func (filter *Filter) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	header := []interface{}{version, filter.k, uint32(0), filter.m, filter.n, filter.bits}
+	for _, field := range header {
+		if err := binary.Write(&buf, binary.BigEndian, field); err != nil {
+			return 0, err
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// ReadFrom decodes the bloom filter from reader.
+func ReadFrom(r io.Reader) (*Filter, error) {
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if string(head) != magic {
+		return nil, fmt.Errorf("invalid bloom filter magic %q", head)
+	}
+
+	var ver, k, reserved uint32
+	var m, n uint64
+	for _, field := range []interface{}{&ver, &k, &reserved, &m, &n} {
+		if err := binary.Read(r, binary.BigEndian, field); err != nil {
+			return nil, err
+		}
+	}
+	if ver != version {
+		return nil, fmt.Errorf("unsupported bloom filter version %d", ver)
+	}
+	// The parameters are checked before allocating the bits, since the
+	// filter may be pulled from untrusted registry
+	if k == 0 || k > MaxHashes || m == 0 || m%64 != 0 || m > MaxBits {
+		return nil, fmt.Errorf("invalid bloom filter parameters k=%d m=%d", k, m)
+	}
+
+	filter := New(m, k)
+	filter.n = n
+	if err := binary.Read(r, binary.BigEndian, filter.bits); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
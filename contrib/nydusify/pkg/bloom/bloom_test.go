@@ -0,0 +1,83 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("%064x", i))
+}
+
+func TestFilter(t *testing.T) {
+	filter := NewWithEstimates(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		filter.Add(key(i))
+	}
+	assert.Equal(t, uint64(1000), filter.Count())
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, filter.Test(key(i)))
+	}
+
+	falsePositive := 0
+	for i := 1000; i < 11000; i++ {
+		if filter.Test(key(i)) {
+			falsePositive++
+		}
+	}
+	assert.Less(t, falsePositive, 300)
+
+	keys := [][]byte{}
+	for i := 500; i < 1500; i++ {
+		keys = append(keys, key(i))
+	}
+	overlap := filter.Overlap(keys)
+	assert.True(t, overlap >= 0.5 && overlap < 0.55)
+}
+
+func TestEncoding(t *testing.T) {
+	filter := NewWithEstimates(100, 0.01)
+	for i := 0; i < 100; i++ {
+		filter.Add(key(i))
+	}
+
+	var buf bytes.Buffer
+	_, err := filter.WriteTo(&buf)
+	require.Nil(t, err)
+
+	decoded, err := ReadFrom(&buf)
+	require.Nil(t, err)
+	assert.Equal(t, filter, decoded)
+
+	_, err = ReadFrom(bytes.NewReader([]byte("invalid bloom filter")))
+	assert.NotNil(t, err)
+
+	// The oversized parameters are rejected before allocating bits
+	header := func(k uint32, m uint64) []byte {
+		var buf bytes.Buffer
+		buf.WriteString(magic)
+		for _, field := range []interface{}{version, k, uint32(0), m, uint64(0)} {
+			require.Nil(t, binary.Write(&buf, binary.BigEndian, field))
+		}
+		return buf.Bytes()
+	}
+	_, err = ReadFrom(bytes.NewReader(header(1, MaxBits*2)))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid bloom filter parameters")
+	_, err = ReadFrom(bytes.NewReader(header(MaxHashes+1, 64)))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid bloom filter parameters")
+	// The truncated bits
+	_, err = ReadFrom(bytes.NewReader(header(1, 128)))
+	assert.NotNil(t, err)
+}
@@ -5,16 +5,27 @@
 package build
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// SourceTypeTarRafs builds layer from the tar stream of layer instead
+// of the unpacked layer directory.
+const SourceTypeTarRafs = "tar-rafs"
+
 type BuilderOption struct {
 	ParentBootstrapPath string
+	ChunkDictPath       string
 	BootstrapPath       string
 	RootfsPath          string
 	BackendType         string
@@ -22,14 +33,47 @@ type BuilderOption struct {
 	PrefetchDir         string
 	WhiteoutSpec        string
 	OutputJSONPath      string
+	// Compressor is the compression algorithm of blob, one of `none`,
+	// `lz4_block` and `zstd`, uses the default of nydus-image if empty.
+	Compressor string
+	// FsVersion is the version of RAFS, `5` or `6` (EROFS compatible),
+	// uses the default of nydus-image if empty.
+	FsVersion string
+	// ChunkSize is the size of data chunk, uses the default of nydus-image
+	// if zero.
+	ChunkSize uint64
+	// BatchSize is the size to merge small chunks into, uses the default
+	// of nydus-image if zero.
+	BatchSize uint64
 	// A regular file or fifo into which commands nydus-image to dump contents.
 	BlobPath string
+	// Tar is the uncompressed tar stream of layer, it's streamed into
+	// nydus-image by a fifo with `--source-type tar-rafs` instead of
+	// RootfsPath if it's specified.
+	Tar io.Reader
+}
+
+// Runner runs nydus-image for the build workflow, it's implemented by
+// Builder executing the local nydus-image binary, and by the clients of
+// remote builder agents.
+type Runner interface {
+	// Run builds layer by option.
+	Run(option BuilderOption) error
+	// Check dumps the blob and chunk digest list of bootstrap to output
+	// json file.
+	Check(bootstrapPath, outputJSONPath string) error
+	// Probe returns the features supported by nydus-image.
+	Probe() (*Features, error)
 }
 
 type Builder struct {
 	binaryPath string
 	stdout     io.Writer
 	stderr     io.Writer
+
+	probeOnce sync.Once
+	features  *Features
+	probeErr  error
 }
 
 func NewBuilder(binaryPath string) *Builder {
@@ -54,6 +98,24 @@ func (builder *Builder) Run(option BuilderOption) error {
 			option.ParentBootstrapPath,
 		}
 	}
+	if option.ChunkDictPath != "" {
+		args = append(args, "--chunk-dict", fmt.Sprintf("bootstrap=%s", option.ChunkDictPath))
+	}
+	rootfsPath := option.RootfsPath
+	if option.Tar != nil {
+		// The stdin of nydus-image is occupied by prefetch list, so the
+		// tar stream is fed by a fifo
+		fifoDir, err := ioutil.TempDir("", "nydusify-tar-")
+		if err != nil {
+			return errors.Wrap(err, "create fifo directory")
+		}
+		defer os.RemoveAll(fifoDir)
+		rootfsPath = filepath.Join(fifoDir, "layer.tar")
+		if err := syscall.Mkfifo(rootfsPath, 0600); err != nil {
+			return errors.Wrap(err, "create fifo")
+		}
+		args = append(args, "--source-type", SourceTypeTarRafs)
+	}
 	args = append(
 		args,
 		"--bootstrap",
@@ -66,18 +128,36 @@ func (builder *Builder) Run(option BuilderOption) error {
 		option.OutputJSONPath,
 		"--blob",
 		option.BlobPath,
-		option.RootfsPath,
+		rootfsPath,
 	)
 
+	if option.Compressor != "" {
+		args = append(args, "--compressor", option.Compressor)
+	}
+
+	if option.FsVersion != "" {
+		args = append(args, "--fs-version", option.FsVersion)
+	}
+
+	if option.ChunkSize != 0 {
+		args = append(args, "--chunk-size", fmt.Sprintf("0x%x", option.ChunkSize))
+	}
+
+	if option.BatchSize != 0 {
+		args = append(args, "--batch-size", fmt.Sprintf("0x%x", option.BatchSize))
+	}
+
 	if option.PrefetchDir != "" {
 		args = append(args, "--prefetch-policy", "fs")
 	}
 
 	logrus.Debugf("\tCommand: %s %s", builder.binaryPath, strings.Join(args[:], " "))
 
+	// The output is kept for classifying the failure
+	output := &tailBuffer{}
 	cmd := exec.Command(builder.binaryPath, args...)
-	cmd.Stdout = builder.stdout
-	cmd.Stderr = builder.stderr
+	cmd.Stdout = io.MultiWriter(builder.stdout, output)
+	cmd.Stderr = io.MultiWriter(builder.stderr, output)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -87,9 +167,62 @@ func (builder *Builder) Run(option BuilderOption) error {
 	io.WriteString(stdin, option.PrefetchDir)
 	stdin.Close()
 
-	if err := cmd.Run(); err != nil {
-		return err
+	if option.Tar == nil {
+		if err := cmd.Run(); err != nil {
+			return newBuildError(err, output.String())
+		}
+		return nil
+	}
+
+	// Opening fifo for read and write never blocks, and the blocked write
+	// is interrupted by closing it if nydus-image exits without reading
+	fifo, err := os.OpenFile(rootfsPath, os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrap(err, "open fifo")
+	}
+	defer fifo.Close()
+
+	if err := cmd.Start(); err != nil {
+		return newBuildError(err, output.String())
+	}
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(fifo, option.Tar)
+		// Send EOF to nydus-image
+		fifo.Close()
+		copyErr <- err
+	}()
+
+	err = cmd.Wait()
+	fifo.Close()
+	if err != nil {
+		return newBuildError(err, output.String())
+	}
+	if err := <-copyErr; err != nil {
+		return errors.Wrap(err, "stream layer tar")
 	}
 
 	return nil
 }
+
+// Check exec nydus-image CLI to validate bootstrap, the blob and chunk
+// digest list of bootstrap will be dumped to output json file
+func (builder *Builder) Check(bootstrapPath, outputJSONPath string) error {
+	args := []string{
+		"check",
+		"--bootstrap",
+		bootstrapPath,
+		"--log-level",
+		"warn",
+		"--output-json",
+		outputJSONPath,
+	}
+
+	logrus.Debugf("\tCommand: %s %s", builder.binaryPath, strings.Join(args[:], " "))
+
+	cmd := exec.Command(builder.binaryPath, args...)
+	cmd.Stdout = builder.stdout
+	cmd.Stderr = builder.stderr
+
+	return cmd.Run()
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ErrorKind classifies the failure of nydus-image by its output.
+type ErrorKind string
+
+const (
+	ErrorKindUnknown              ErrorKind = "unknown"
+	ErrorKindUnsupportedXattr     ErrorKind = "unsupported_xattr"
+	ErrorKindHardlinkOutsideLayer ErrorKind = "hardlink_outside_layer"
+	ErrorKindPathTooLong          ErrorKind = "path_too_long"
+	ErrorKindOutOfMemory          ErrorKind = "out_of_memory"
+)
+
+// The patterns of nydus-image output for each kind of failure, matched
+// in order.
+var errorPatterns = []struct {
+	kind    ErrorKind
+	pattern *regexp.Regexp
+}{
+	{ErrorKindOutOfMemory, regexp.MustCompile(`(?i)memory allocation of \d+ bytes failed|cannot allocate memory|out of memory`)},
+	{ErrorKindPathTooLong, regexp.MustCompile(`(?i)name too long|path too long|os error 36\b`)},
+	{ErrorKindHardlinkOutsideLayer, regexp.MustCompile(`(?i)hard ?link.*(outside|not found|invalid|escape)`)},
+	{ErrorKindUnsupportedXattr, regexp.MustCompile(`(?i)xattr.*(not supported|unsupported|invalid)|failed to (get|list|set) xattr`)},
+}
+
+// BuildError is the error of nydus-image execution classified by its
+// output, so that the failure of layer is actionable.
+type BuildError struct {
+	Kind ErrorKind
+	// Message is the error message printed by nydus-image.
+	Message string
+	// Err is the error of executing nydus-image.
+	Err error
+}
+
+func (e *BuildError) Error() string {
+	msg := fmt.Sprintf("nydus-image %s (%s)", e.Err, e.Kind)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// Reason returns the kind of failure.
+func (e *BuildError) Reason() string {
+	return string(e.Kind)
+}
+
+// errorMessage returns the error line and its root cause in the output
+// of nydus-image, which is like:
+//
+//	Error: failed to build layer
+//
+//	Caused by:
+//	    0: failed to create node "/path"
+//	    1: File name too long (os error 36)
+func errorMessage(output string) string {
+	lines := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+
+	message := ""
+	messageIdx := -1
+	for idx, line := range lines {
+		if strings.HasPrefix(line, "Error:") {
+			message = strings.TrimSpace(strings.TrimPrefix(line, "Error:"))
+			messageIdx = idx
+			break
+		}
+	}
+	if messageIdx == len(lines)-1 {
+		return message
+	}
+	cause := lines[len(lines)-1]
+	if idx := strings.Index(cause, ": "); idx > 0 && strings.Trim(cause[:idx], "0123456789") == "" {
+		cause = cause[idx+2:]
+	}
+	if message == "" {
+		return cause
+	}
+	return message + ": " + cause
+}
+
+// newBuildError classifies the error of executing nydus-image by its
+// output and exit status.
+func newBuildError(err error, output string) *BuildError {
+	buildErr := &BuildError{
+		Kind:    ErrorKindUnknown,
+		Message: errorMessage(output),
+		Err:     err,
+	}
+	for _, pattern := range errorPatterns {
+		if pattern.pattern.MatchString(output) {
+			buildErr.Kind = pattern.kind
+			return buildErr
+		}
+	}
+	// nydus-image is likely killed by OOM killer
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGKILL {
+			buildErr.Kind = ErrorKindOutOfMemory
+		}
+	}
+	return buildErr
+}
+
+// maxOutputSize is the size of the tail of nydus-image output kept for
+// classifying its failure.
+const maxOutputSize = 64 * 1024
+
+// tailBuffer keeps the last maxOutputSize bytes written to it.
+type tailBuffer struct {
+	sync.Mutex
+	data []byte
+}
+
+func (buf *tailBuffer) Write(p []byte) (int, error) {
+	buf.Lock()
+	defer buf.Unlock()
+	buf.data = append(buf.data, p...)
+	if len(buf.data) > maxOutputSize {
+		buf.data = buf.data[len(buf.data)-maxOutputSize:]
+	}
+	return len(p), nil
+}
+
+func (buf *tailBuffer) String() string {
+	buf.Lock()
+	defer buf.Unlock()
+	return string(buf.data)
+}
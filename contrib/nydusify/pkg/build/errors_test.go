@@ -0,0 +1,76 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildError(t *testing.T) {
+	for _, c := range []struct {
+		output  string
+		kind    ErrorKind
+		message string
+	}{
+		{
+			output:  "Error: failed to build layer\n\nCaused by:\n    0: failed to create node \"/a\"\n    1: File name too long (os error 36)\n",
+			kind:    ErrorKindPathTooLong,
+			message: "failed to build layer: File name too long (os error 36)",
+		},
+		{
+			output:  "Error: failed to get xattr \"security.foo\" of \"/a\"\n",
+			kind:    ErrorKindUnsupportedXattr,
+			message: "failed to get xattr \"security.foo\" of \"/a\"",
+		},
+		{
+			output:  "[WARN] something\nError: hardlink \"/a\" links to \"/b\" outside layer\n",
+			kind:    ErrorKindHardlinkOutsideLayer,
+			message: "hardlink \"/a\" links to \"/b\" outside layer",
+		},
+		{
+			output:  "memory allocation of 1073741824 bytes failed\n",
+			kind:    ErrorKindOutOfMemory,
+			message: "memory allocation of 1073741824 bytes failed",
+		},
+		{
+			output:  "Error: failed to compress node file \"/a\"\n",
+			kind:    ErrorKindUnknown,
+			message: "failed to compress node file \"/a\"",
+		},
+	} {
+		err := newBuildError(errors.New("exit status 1"), c.output)
+		assert.Equal(t, c.kind, err.Kind)
+		assert.Equal(t, c.message, err.Message)
+	}
+}
+
+func TestBuilderError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-builder-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	binary := filepath.Join(dir, "nydus-image")
+	script := "#!/bin/sh\necho 'Error: failed to build layer' >&2\necho '    0: File name too long (os error 36)' >&2\nexit 1\n"
+	require.Nil(t, ioutil.WriteFile(binary, []byte(script), 0755))
+
+	builder := NewBuilder(binary)
+	builder.stdout = ioutil.Discard
+	builder.stderr = ioutil.Discard
+	err = builder.Run(BuilderOption{RootfsPath: dir})
+	wrapped := fmt.Errorf("build layer: %w", err)
+
+	var buildErr *BuildError
+	require.True(t, errors.As(wrapped, &buildErr))
+	assert.Equal(t, ErrorKindPathTooLong, buildErr.Kind)
+	assert.Equal(t, "nydus-image exit status 1 (path_too_long): failed to build layer: File name too long (os error 36)", buildErr.Error())
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Features are the features supported by nydus-image, detected by the
+// output of `nydus-image --version` and `nydus-image create --help`.
+type Features struct {
+	Version string
+	// FsVersion6 is true if RAFS v6 is supported by `--fs-version 6`.
+	FsVersion6 bool
+	// ChunkSize is true if `--chunk-size` is supported.
+	ChunkSize bool
+	// BatchSize is true if `--batch-size` is supported.
+	BatchSize bool
+	// Encrypt is true if `--encrypt` is supported.
+	Encrypt bool
+	// Compressor is true if `--compressor` is supported.
+	Compressor bool
+	// Zstd is true if `zstd` is a possible value of `--compressor`.
+	Zstd bool
+	// ChunkDict is true if `--chunk-dict` is supported.
+	ChunkDict bool
+	// TarRafs is true if the `tar-rafs` source type is supported.
+	TarRafs bool
+}
+
+var versionPattern = regexp.MustCompile(`Version:\s*(\S+)`)
+
+// parseVersion returns the version in the output of `--version`.
+func parseVersion(output string) string {
+	if matches := versionPattern.FindStringSubmatch(output); len(matches) == 2 {
+		return matches[1]
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return "unknown"
+}
+
+// flagHelp returns the help text of flag in the output of `--help`, it's
+// empty if the flag isn't found.
+func flagHelp(help, flag string) string {
+	idx := strings.Index(help, flag)
+	if idx < 0 {
+		return ""
+	}
+	text := help[idx:]
+	// The help of flag ends at the next flag
+	if end := strings.Index(text[len(flag):], "\n        -"); end >= 0 {
+		return text[:len(flag)+end]
+	}
+	if end := strings.Index(text[len(flag):], "\n    -"); end >= 0 {
+		return text[:len(flag)+end]
+	}
+	return text
+}
+
+// parseFeatures detects the features by the output of `--version` and
+// `create --help`.
+func parseFeatures(version, help string) *Features {
+	return &Features{
+		Version:    parseVersion(version),
+		FsVersion6: strings.Contains(flagHelp(help, "--fs-version"), "6"),
+		ChunkSize:  flagHelp(help, "--chunk-size") != "",
+		BatchSize:  flagHelp(help, "--batch-size") != "",
+		Encrypt:    flagHelp(help, "--encrypt") != "",
+		Compressor: flagHelp(help, "--compressor") != "",
+		Zstd:       strings.Contains(flagHelp(help, "--compressor"), "zstd"),
+		ChunkDict:  flagHelp(help, "--chunk-dict") != "",
+		TarRafs:    strings.Contains(flagHelp(help, "--source-type"), SourceTypeTarRafs),
+	}
+}
+
+// Probe detects the features supported by nydus-image, it runs nydus-image
+// only once, the result is reused by later calls.
+func (builder *Builder) Probe() (*Features, error) {
+	builder.probeOnce.Do(func() {
+		version, err := exec.Command(builder.binaryPath, "--version").CombinedOutput()
+		if err != nil {
+			builder.probeErr = errors.Wrapf(err, "get version of %s", builder.binaryPath)
+			return
+		}
+		help, err := exec.Command(builder.binaryPath, "create", "--help").CombinedOutput()
+		if err != nil {
+			builder.probeErr = errors.Wrapf(err, "get help of %s", builder.binaryPath)
+			return
+		}
+		builder.features = parseFeatures(string(version), string(help))
+		logrus.Debugf("Detected features of nydus-image %s: %+v", builder.features.Version, *builder.features)
+	})
+	return builder.features, builder.probeErr
+}
+
+// adapt drops the options unsupported by nydus-image, the options only
+// for optimization are dropped with warning, and the options changing
+// the format of image are rejected.
+func (features *Features) adapt(option *BuilderOption) error {
+	// The blob is annotated with its compressor, nydusd fails to read it
+	// if it's built by other compressor
+	if option.Compressor == "zstd" && !features.Zstd {
+		return fmt.Errorf("zstd compressor is unsupported by nydus-image %s", features.Version)
+	}
+	if option.Compressor != "" && !features.Compressor {
+		logrus.Warnf("Ignore compressor %s unsupported by nydus-image %s", option.Compressor, features.Version)
+		option.Compressor = ""
+	}
+	// The chunk dictionary is only specified for deduplication explicitly
+	if option.ChunkDictPath != "" && !features.ChunkDict {
+		return fmt.Errorf("chunk dictionary is unsupported by nydus-image %s", features.Version)
+	}
+	if option.BatchSize != 0 && !features.BatchSize {
+		logrus.Warnf("Ignore batch size unsupported by nydus-image %s", features.Version)
+		option.BatchSize = 0
+	}
+	if option.FsVersion != "" && !features.FsVersion6 {
+		// RAFS v5 is the only version of old nydus-image
+		if option.FsVersion != "5" {
+			return fmt.Errorf("RAFS v%s is unsupported by nydus-image %s", option.FsVersion, features.Version)
+		}
+		option.FsVersion = ""
+	}
+	if option.ChunkSize != 0 && !features.ChunkSize {
+		return fmt.Errorf("chunk size is unsupported by nydus-image %s", features.Version)
+	}
+	return nil
+}
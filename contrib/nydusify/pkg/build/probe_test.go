@@ -0,0 +1,107 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const oldHelp = `nydus-image-create
+dump image bootstrap and upload blob to storage backend
+
+USAGE:
+    nydus-image create [FLAGS] [OPTIONS] <SOURCE> --bootstrap <bootstrap>
+
+OPTIONS:
+        --compressor <compressor>
+            how blob will be compressed: none, lz4_block (default) [default: lz4_block]  [possible values: none, lz4_block,
+            gzip]
+        --source-type <source-type>
+            source type [default: directory]  [possible values: directory, stargz_index]
+        --whiteout-spec <whiteout-spec>
+            decide which whiteout spec to follow: "oci" or "overlayfs" [default: oci]  [possible values: oci, overlayfs]
+`
+
+const newHelp = `nydus-image-create
+OPTIONS:
+        --batch-size <batch-size>
+            Set the batch size to merge small chunks [default: 0]
+        --chunk-dict <chunk-dict>
+            specify a chunk dictionary for chunk deduplication
+        --chunk-size <chunk-size>
+            size of nydus image data chunk, must be power of two and between 0x1000-0x1000000: [default: 0x100000]
+        --compressor <compressor>
+            how blob will be compressed: none, lz4_block (default) [default: lz4_block]  [possible values: none, lz4_block,
+            zstd]
+        --encrypt
+            encrypt the generated RAFS metadata and data blobs
+        --fs-version <fs-version>
+            version number of nydus image format [default: 5]  [possible values: 5, 6]
+        --source-type <source-type>
+            source type [default: directory]  [possible values: directory, stargz_index, tar-rafs]
+`
+
+func TestParseFeatures(t *testing.T) {
+	version := "nydus image builder \rVersion: \t0.1.0\nGit Commit: \t1234\n"
+	features := parseFeatures(version, oldHelp)
+	assert.Equal(t, Features{Version: "0.1.0", Compressor: true}, *features)
+
+	features = parseFeatures(version, newHelp)
+	assert.Equal(t, Features{
+		Version:    "0.1.0",
+		FsVersion6: true,
+		ChunkSize:  true,
+		BatchSize:  true,
+		Encrypt:    true,
+		Compressor: true,
+		Zstd:       true,
+		ChunkDict:  true,
+		TarRafs:    true,
+	}, *features)
+
+	option := BuilderOption{Compressor: "lz4_block", FsVersion: "5", BatchSize: 0x100000}
+	require.Nil(t, (&Features{}).adapt(&option))
+	assert.Equal(t, BuilderOption{}, option)
+	option = BuilderOption{FsVersion: "6", ChunkSize: 0x100000, BatchSize: 0x100000}
+	require.Nil(t, features.adapt(&option))
+	assert.Equal(t, BuilderOption{FsVersion: "6", ChunkSize: 0x100000, BatchSize: 0x100000}, option)
+	assert.Contains(t, (&Features{}).adapt(&BuilderOption{FsVersion: "6"}).Error(), "RAFS v6 is unsupported")
+	assert.Contains(t, (&Features{}).adapt(&BuilderOption{ChunkSize: 0x100000}).Error(), "chunk size is unsupported")
+	assert.Contains(t, parseFeatures(version, oldHelp).adapt(&BuilderOption{Compressor: "zstd"}).Error(), "zstd compressor is unsupported")
+	assert.Contains(t, (&Features{}).adapt(&BuilderOption{ChunkDictPath: "/dict"}).Error(), "chunk dictionary is unsupported")
+}
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-builder-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The binary is only executed once
+	binary := filepath.Join(dir, "nydus-image")
+	counter := filepath.Join(dir, "counter")
+	script := "#!/bin/sh\necho >> " + counter + "\nif [ \"$1\" = --version ]; then echo 'Version: 0.2.0'; else echo '--chunk-dict <chunk-dict>'; fi\n"
+	require.Nil(t, ioutil.WriteFile(binary, []byte(script), 0755))
+
+	builder := NewBuilder(binary)
+	for i := 0; i < 2; i++ {
+		features, err := builder.Probe()
+		require.Nil(t, err)
+		assert.Equal(t, "0.2.0", features.Version)
+		assert.True(t, features.ChunkDict)
+		assert.False(t, features.TarRafs)
+	}
+	data, err := ioutil.ReadFile(counter)
+	require.Nil(t, err)
+	assert.Equal(t, "\n\n", string(data))
+
+	_, err = NewBuilder(filepath.Join(dir, "not-found")).Probe()
+	assert.NotNil(t, err)
+}
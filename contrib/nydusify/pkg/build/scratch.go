@@ -0,0 +1,266 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// The types of scratch space where the source layers are unpacked.
+const (
+	// ScratchDisk unpacks the source layers to a directory on disk.
+	ScratchDisk = "disk"
+	// ScratchTmpfs unpacks the source layers to a tmpfs mounted by
+	// Nydusify, requires root privilege.
+	ScratchTmpfs = "tmpfs"
+	// ScratchStream pipes the tar stream of source layers into builder
+	// without unpacking them, requires tar-rafs support of nydus-image.
+	ScratchStream = "stream"
+)
+
+// ErrScratchFull is returned if the unpacked source layers exceed the size
+// cap of scratch space.
+var ErrScratchFull = errors.New("Scratch space is full")
+
+// ScratchOption specifies where the rootfs of source layers lives during
+// building.
+type ScratchOption struct {
+	// Type is one of `disk`, `tmpfs` and `stream`, defaults to `disk`.
+	Type string
+	// Dir is the directory of scratch space, e.g. the mountpoint of a
+	// dedicated disk, defaults to `scratch` in TargetDir.
+	Dir string
+	// Size caps the total size of the unpacked source layers in bytes, the
+	// tmpfs is mounted in the size, the layer exceeding the cap on disk is
+	// removed with ErrScratchFull, it isn't capped if it's 0.
+	Size int64
+}
+
+// Validate checks the type and size of scratch space.
+func (option ScratchOption) Validate() error {
+	switch option.Type {
+	case "", ScratchDisk, ScratchTmpfs, ScratchStream:
+	default:
+		return fmt.Errorf("Invalid scratch type %s", option.Type)
+	}
+	if option.Size < 0 {
+		return fmt.Errorf("Invalid scratch size %d", option.Size)
+	}
+	if option.Type == ScratchStream && (option.Dir != "" || option.Size > 0) {
+		return errors.New("Stream scratch doesn't take directory and size")
+	}
+	return nil
+}
+
+// ScratchStats is the usage of scratch space.
+type ScratchStats struct {
+	// Unpacked and Streamed are the count of source layers unpacked to
+	// and streamed past scratch space.
+	Unpacked int
+	Streamed int
+	// Used is the size of the source layers not released yet, Peak is the
+	// maximum of Used.
+	Used int64
+	Peak int64
+	// Released is the total size of the released source layers.
+	Released int64
+}
+
+// Scratch is the space holding the unpacked source layers, the layers are
+// accounted and removed on release, and the leftovers are removed on close.
+type Scratch struct {
+	ScratchOption
+
+	// created is true if Dir is created by Nydusify, it's removed on close.
+	created bool
+	mounted bool
+
+	mu    sync.Mutex
+	dirs  map[string]int64
+	stats ScratchStats
+}
+
+func newScratch(option ScratchOption, targetDir string) (*Scratch, error) {
+	if err := option.Validate(); err != nil {
+		return nil, err
+	}
+	if option.Type == "" {
+		option.Type = ScratchDisk
+	}
+	scratch := &Scratch{
+		ScratchOption: option,
+		dirs:          make(map[string]int64),
+	}
+	if option.Type == ScratchStream {
+		return scratch, nil
+	}
+
+	if scratch.Dir == "" {
+		scratch.Dir = filepath.Join(targetDir, "scratch")
+		if err := os.RemoveAll(scratch.Dir); err != nil {
+			return nil, errors.Wrap(err, "Remove scratch directory")
+		}
+	}
+	if _, err := os.Stat(scratch.Dir); os.IsNotExist(err) {
+		scratch.created = true
+	}
+	if err := os.MkdirAll(scratch.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Create scratch directory")
+	}
+
+	if option.Type == ScratchTmpfs {
+		data := ""
+		if option.Size > 0 {
+			data = fmt.Sprintf("size=%d", option.Size)
+		}
+		if err := syscall.Mount("tmpfs", scratch.Dir, "tmpfs", 0, data); err != nil {
+			scratch.Close()
+			return nil, errors.Wrapf(err, "Mount tmpfs on %s", scratch.Dir)
+		}
+		scratch.mounted = true
+	}
+
+	return scratch, nil
+}
+
+// Streaming returns true if the source layers are streamed into builder
+// instead of being unpacked.
+func (scratch *Scratch) Streaming() bool {
+	return scratch.Type == ScratchStream
+}
+
+// Unpack unpacks the (compressed) tar stream of source layer to the named
+// directory in scratch space, and returns the directory, the partially
+// unpacked layer is removed on failure.
+func (scratch *Scratch) Unpack(ctx context.Context, name string, tarReader io.Reader) (string, error) {
+	if scratch.Streaming() {
+		return "", errors.New("Stream scratch can't unpack layer")
+	}
+	dir := filepath.Join(scratch.Dir, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", errors.Wrap(err, "Remove layer directory")
+	}
+	if err := utils.UnpackTargz(ctx, dir, tarReader); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", errors.Wrap(err, "Stat layer directory")
+	}
+
+	scratch.mu.Lock()
+	defer scratch.mu.Unlock()
+	if scratch.Size > 0 && scratch.stats.Used+size > scratch.Size {
+		os.RemoveAll(dir)
+		return "", errors.Wrapf(
+			ErrScratchFull, "%d bytes unpacked on top of %d bytes used, cap is %d bytes",
+			size, scratch.stats.Used, scratch.Size,
+		)
+	}
+	scratch.dirs[dir] = size
+	scratch.stats.Unpacked++
+	scratch.stats.Used += size
+	if scratch.stats.Used > scratch.stats.Peak {
+		scratch.stats.Peak = scratch.stats.Used
+	}
+	return dir, nil
+}
+
+// Release removes the unpacked layer directory from scratch space, it's
+// no-op if the directory has been released.
+func (scratch *Scratch) Release(dir string) error {
+	scratch.mu.Lock()
+	size, ok := scratch.dirs[dir]
+	if ok {
+		delete(scratch.dirs, dir)
+		scratch.stats.Used -= size
+		scratch.stats.Released += size
+	}
+	scratch.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
+
+func (scratch *Scratch) streamed() {
+	scratch.mu.Lock()
+	defer scratch.mu.Unlock()
+	scratch.stats.Streamed++
+}
+
+// Stats returns the usage of scratch space.
+func (scratch *Scratch) Stats() ScratchStats {
+	scratch.mu.Lock()
+	defer scratch.mu.Unlock()
+	return scratch.stats
+}
+
+// Close releases the leftover layers, umounts the tmpfs and removes the
+// scratch directory created by Nydusify.
+func (scratch *Scratch) Close() error {
+	scratch.mu.Lock()
+	dirs := make([]string, 0, len(scratch.dirs))
+	for dir := range scratch.dirs {
+		dirs = append(dirs, dir)
+	}
+	scratch.mu.Unlock()
+
+	for _, dir := range dirs {
+		if err := scratch.Release(dir); err != nil {
+			logrus.Warnf("Failed to release scratch layer %s: %s", dir, err)
+		}
+	}
+	if scratch.mounted {
+		// Lazily umount in case of the layers being removed in background
+		if err := syscall.Unmount(scratch.Dir, syscall.MNT_DETACH); err != nil {
+			return errors.Wrapf(err, "Umount tmpfs on %s", scratch.Dir)
+		}
+		scratch.mounted = false
+	}
+	if scratch.created {
+		if err := os.RemoveAll(scratch.Dir); err != nil {
+			return errors.Wrap(err, "Remove scratch directory")
+		}
+		scratch.created = false
+	}
+	return nil
+}
+
+// dirSize returns the disk usage of directory, the hard links are counted
+// once.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	inodes := make(map[uint64]struct{})
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if _, ok := inodes[stat.Ino]; ok {
+				return nil
+			}
+			inodes[stat.Ino] = struct{}{}
+			size += stat.Blocks * 512
+			return nil
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
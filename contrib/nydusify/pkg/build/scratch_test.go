@@ -0,0 +1,107 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTar(t *testing.T, files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, data := range files {
+		require.Nil(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+		}))
+		_, err := tw.Write(data)
+		require.Nil(t, err)
+	}
+	require.Nil(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestScratchOption(t *testing.T) {
+	assert.Nil(t, ScratchOption{}.Validate())
+	assert.Nil(t, ScratchOption{Type: ScratchTmpfs, Size: 1 << 30}.Validate())
+	assert.Nil(t, ScratchOption{Type: ScratchStream}.Validate())
+	assert.NotNil(t, ScratchOption{Type: "overlay"}.Validate())
+	assert.NotNil(t, ScratchOption{Size: -1}.Validate())
+	assert.NotNil(t, ScratchOption{Type: ScratchStream, Size: 1 << 30}.Validate())
+
+	scratch, err := newScratch(ScratchOption{Type: ScratchStream}, "")
+	require.Nil(t, err)
+	assert.True(t, scratch.Streaming())
+	_, err = scratch.Unpack(context.Background(), "layer", bytes.NewReader(nil))
+	assert.NotNil(t, err)
+	assert.Nil(t, scratch.Close())
+}
+
+func TestScratchDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-scratch-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	scratch, err := newScratch(ScratchOption{}, dir)
+	require.Nil(t, err)
+	assert.Equal(t, ScratchDisk, scratch.Type)
+	assert.Equal(t, filepath.Join(dir, "scratch"), scratch.Dir)
+
+	layer := makeTar(t, map[string][]byte{"data": bytes.Repeat([]byte("a"), 1<<20)})
+	lower, err := scratch.Unpack(ctx, "lower", bytes.NewReader(layer))
+	require.Nil(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(lower, "data"))
+	require.Nil(t, err)
+	assert.Len(t, data, 1<<20)
+	upper, err := scratch.Unpack(ctx, "upper", bytes.NewReader(layer))
+	require.Nil(t, err)
+
+	stats := scratch.Stats()
+	assert.Equal(t, 2, stats.Unpacked)
+	assert.True(t, stats.Used >= 2<<20)
+	assert.Equal(t, stats.Used, stats.Peak)
+
+	require.Nil(t, scratch.Release(lower))
+	require.Nil(t, scratch.Release(lower))
+	_, err = os.Stat(lower)
+	assert.True(t, os.IsNotExist(err))
+	released := scratch.Stats()
+	assert.Equal(t, stats.Peak, released.Peak)
+	assert.Equal(t, stats.Used, released.Used+released.Released)
+
+	// The leftovers and scratch directory are removed on close
+	require.Nil(t, scratch.Close())
+	_, err = os.Stat(upper)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(scratch.Dir)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(0), scratch.Stats().Used)
+
+	// The specified directory is kept on close
+	scratchDir := filepath.Join(dir, "disk")
+	require.Nil(t, os.MkdirAll(scratchDir, 0755))
+	scratch, err = newScratch(ScratchOption{Dir: scratchDir, Size: 1 << 20}, dir)
+	require.Nil(t, err)
+	_, err = scratch.Unpack(ctx, "layer", bytes.NewReader(layer))
+	assert.True(t, errors.Is(err, ErrScratchFull))
+	_, err = os.Stat(filepath.Join(scratchDir, "layer"))
+	assert.True(t, os.IsNotExist(err))
+	require.Nil(t, scratch.Close())
+	_, err = os.Stat(scratchDir)
+	assert.Nil(t, err)
+}
@@ -5,70 +5,231 @@
 package build
 
 import (
+	"archive/tar"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/google/uuid"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
 
 type WorkflowOption struct {
 	TargetDir      string
 	NydusImagePath string
-	PrefetchDir    string
+	// Runner runs nydus-image, e.g. on remote builder agents, the local
+	// NydusImagePath is executed if it's nil.
+	Runner      Runner
+	PrefetchDir string
+	// A bootstrap used as chunk dictionary, the chunks existed
+	// in its blobs will not be dumped to new blob again.
+	ChunkDictPath string
+	// The compression algorithm of blobs, see BuilderOption.Compressor.
+	Compressor string
+	// The RAFS version, chunk size and batch size, see BuilderOption.
+	FsVersion string
+	ChunkSize uint64
+	BatchSize uint64
+	// ParentRef is a Nydus image reference, only its bootstrap is pulled
+	// as the parent bootstrap of the first built layer, so the new layers
+	// are built on top of it without building the parent layers again.
+	ParentRef      string
+	ParentInsecure bool
+	// Scratch specifies where the source layers are unpacked, the layers
+	// are unpacked to `scratch` in TargetDir by default.
+	Scratch ScratchOption
 }
 
 type Workflow struct {
 	WorkflowOption
 	bootstrapPath       string
 	blobsDir            string
+	artifactsDir        string
 	backendConfig       string
 	parentBootstrapPath string
-	builder             *Builder
+	builder             Runner
 	lastBlobID          string
+	parentImage         *parser.Image
+	scratch             *Scratch
 }
 
 type debugJSON struct {
-	Blobs []string
+	Blobs  []string
+	Chunks []string
+}
+
+// BuildResult is the result of building a layer.
+type BuildResult struct {
+	// BlobPath is the path of the blob built by the layer, its basename
+	// is sha256 hex string, it's empty if no new blob is built.
+	BlobPath string
+	// BlobSize is the size of the blob built by the layer.
+	BlobSize int64
+	// BlobIDs is the blob list in blob table of built bootstrap, includes
+	// the blobs referenced from parent bootstrap and chunk dictionary.
+	BlobIDs []string
+	// UncompressedSize is the total size of the regular files in layer.
+	UncompressedSize int64
+	// FileCount is the count of files in layer, includes directories.
+	FileCount int
+	// Duration is the time spent on building the layer.
+	Duration time.Duration
+	// OutputJSONPath is the output json file of nydus-image in artifacts
+	// directory.
+	OutputJSONPath string
 }
 
-// Dump output json file of every layer to $workdir/bootstraps directory
+// Dump output json file of every layer to $workdir/artifacts directory
 // for debug or perf analysis purpose
 func (workflow *Workflow) buildOutputJSONPath() string {
-	return workflow.bootstrapPath + "-output.json"
+	return workflow.artifactPath(workflow.bootstrapPath, "output")
 }
 
-// Get latest built blob from blobs directory
-func (workflow *Workflow) getLatestBlobPath() (string, error) {
+// artifactPath returns the path of json file dumped for bootstrap in
+// artifacts directory.
+func (workflow *Workflow) artifactPath(bootstrapPath, kind string) string {
+	return filepath.Join(workflow.artifactsDir, filepath.Base(bootstrapPath)+"-"+kind+".json")
+}
+
+// Features returns the features supported by nydus-image.
+func (workflow *Workflow) Features() (*Features, error) {
+	return workflow.builder.Probe()
+}
+
+// ArtifactsDir returns the directory storing the output json files.
+func (workflow *Workflow) ArtifactsDir() string {
+	return workflow.artifactsDir
+}
+
+// BlobIDs returns the blob list in blob table of latest built bootstrap,
+// includes the blobs referenced from parent bootstrap and chunk dictionary.
+func (workflow *Workflow) BlobIDs() ([]string, error) {
 	var data debugJSON
 	jsonBytes, err := ioutil.ReadFile(workflow.buildOutputJSONPath())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if err := json.Unmarshal(jsonBytes, &data); err != nil {
-		return "", err
+		return nil, err
+	}
+	return data.Blobs, nil
+}
+
+// check validates bootstrap and returns its blob and chunk digest list.
+func (workflow *Workflow) check(bootstrapPath string) (*debugJSON, error) {
+	outputJSONPath := workflow.artifactPath(bootstrapPath, "check")
+	if err := workflow.builder.Check(bootstrapPath, outputJSONPath); err != nil {
+		return nil, errors.Wrapf(err, "check bootstrap %s", bootstrapPath)
 	}
-	blobIDs := data.Blobs
 
+	var data debugJSON
+	jsonBytes, err := ioutil.ReadFile(outputJSONPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(jsonBytes, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// ChunkDigests returns the chunk digest list referenced by bootstrap,
+// includes the chunks from parent bootstrap.
+func (workflow *Workflow) ChunkDigests(bootstrapPath string) ([]string, error) {
+	data, err := workflow.check(bootstrapPath)
+	if err != nil {
+		return nil, err
+	}
+	return data.Chunks, nil
+}
+
+// ParentBlobs returns the Nydus blob layers of parent image, they should
+// be kept in the manifest of the image built on top of parent image.
+func (workflow *Workflow) ParentBlobs() []ocispec.Descriptor {
+	blobs := []ocispec.Descriptor{}
+	if workflow.parentImage == nil {
+		return blobs
+	}
+	for _, layer := range workflow.parentImage.Manifest.Layers {
+		if layer.MediaType == utils.MediaTypeNydusBlob {
+			blobs = append(blobs, layer)
+		}
+	}
+	return blobs
+}
+
+// pullParent pulls the bootstrap of parent image into target directory
+// as the parent bootstrap of the first built layer.
+func (workflow *Workflow) pullParent(ctx context.Context) error {
+	parentRemote, err := provider.DefaultRemote(workflow.ParentRef, workflow.ParentInsecure)
+	if err != nil {
+		return errors.Wrap(err, "Parse parent image reference")
+	}
+	imageParser := parser.New(parentRemote)
+	parsed, err := imageParser.Parse(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Parse parent image")
+	}
+	if parsed.NydusImage == nil {
+		return fmt.Errorf("Not found Nydus manifest in parent image %s", workflow.ParentRef)
+	}
+
+	reader, err := imageParser.PullNydusBootstrap(ctx, parsed.NydusImage)
+	if err != nil {
+		return errors.Wrap(err, "Pull bootstrap of parent image")
+	}
+	defer reader.Close()
+	bootstrapPath := filepath.Join(workflow.TargetDir, "parent-bootstrap")
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, bootstrapPath); err != nil {
+		return errors.Wrap(err, "Unpack bootstrap of parent image")
+	}
+
+	// The blobs of parent image aren't in blobs directory, so they
+	// shouldn't be considered as the blob built by the next layer
+	data, err := workflow.check(bootstrapPath)
+	if err != nil {
+		return err
+	}
+	if len(data.Blobs) > 0 {
+		workflow.lastBlobID = data.Blobs[len(data.Blobs)-1]
+	}
+	workflow.parentBootstrapPath = bootstrapPath
+	workflow.parentImage = parsed.NydusImage
+	logrus.Infof("Pulled bootstrap of parent image %s", workflow.ParentRef)
+
+	return nil
+}
+
+// Get latest built blob from blobs directory
+func (workflow *Workflow) getLatestBlobPath(blobIDs []string) string {
 	if len(blobIDs) == 0 {
-		return "", nil
+		return ""
 	}
 
 	latestBlobID := blobIDs[len(blobIDs)-1]
 	if latestBlobID != workflow.lastBlobID {
 		workflow.lastBlobID = latestBlobID
 		blobPath := filepath.Join(workflow.blobsDir, latestBlobID)
-		return blobPath, nil
+		return blobPath
 	}
 
-	return "", nil
+	return ""
 }
 
-// NewWorkflow prepare bootstrap and blobs path for layered build workflow
+// NewWorkflow prepare bootstrap and blobs path for layered build workflow,
+// the bootstrap of parent image is pulled if ParentRef is specified.
 func NewWorkflow(option WorkflowOption) (*Workflow, error) {
 	blobsDir := filepath.Join(option.TargetDir, "blobs")
 	if err := os.RemoveAll(blobsDir); err != nil {
@@ -77,26 +238,210 @@ func NewWorkflow(option WorkflowOption) (*Workflow, error) {
 	if err := os.MkdirAll(blobsDir, 0755); err != nil {
 		return nil, errors.Wrap(err, "Create blob directory")
 	}
+	artifactsDir := filepath.Join(option.TargetDir, "artifacts")
+	if err := os.RemoveAll(artifactsDir); err != nil {
+		return nil, errors.Wrap(err, "Remove artifacts directory")
+	}
+	if err := os.MkdirAll(artifactsDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Create artifacts directory")
+	}
 
 	backendConfig := fmt.Sprintf(`{"dir": "%s"}`, blobsDir)
-	builder := NewBuilder(option.NydusImagePath)
+	var builder Runner = NewBuilder(option.NydusImagePath)
+	if option.Runner != nil {
+		builder = option.Runner
+	}
 
 	if option.PrefetchDir == "" {
 		option.PrefetchDir = "/"
 	}
 
-	return &Workflow{
+	scratch, err := newScratch(option.Scratch, option.TargetDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Create scratch space")
+	}
+
+	workflow := &Workflow{
 		WorkflowOption: option,
 		blobsDir:       blobsDir,
+		artifactsDir:   artifactsDir,
 		backendConfig:  backendConfig,
 		builder:        builder,
-	}, nil
+		scratch:        scratch,
+	}
+
+	if option.ParentRef != "" {
+		if err := workflow.pullParent(context.Background()); err != nil {
+			scratch.Close()
+			return nil, err
+		}
+	}
+
+	return workflow, nil
+}
+
+// Scratch returns the scratch space where the source layers are unpacked.
+func (workflow *Workflow) Scratch() *Scratch {
+	return workflow.scratch
+}
+
+// Close removes the source layers left in scratch space, and logs the usage
+// of scratch space.
+func (workflow *Workflow) Close() error {
+	stats := workflow.scratch.Stats()
+	logrus.Debugf(
+		"Scratch %s: %d layers unpacked, %d layers streamed, peak %d bytes, released %d bytes",
+		workflow.scratch.Type, stats.Unpacked, stats.Streamed, stats.Peak, stats.Released,
+	)
+	return workflow.scratch.Close()
+}
+
+// layerStat returns the count of files and the total size of regular
+// files in layer directory.
+func layerStat(layerDir string) (int, int64, error) {
+	count := 0
+	var size int64
+	err := filepath.Walk(layerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == layerDir {
+			return nil
+		}
+		count++
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return count, size, err
+}
+
+// tarStat counts the files and the total size of regular files in the
+// tar stream read through it.
+type tarStat struct {
+	reader io.Reader
+	writer *io.PipeWriter
+	done   chan struct{}
+	count  int
+	size   int64
 }
 
-// Build nydus bootstrap and blob, returned blobPath's basename is sha256 hex string
+func newTarStat(tarReader io.Reader) *tarStat {
+	pr, pw := io.Pipe()
+	stat := &tarStat{
+		reader: io.TeeReader(tarReader, pw),
+		writer: pw,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(stat.done)
+		tr := tar.NewReader(pr)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if name := path.Clean("/" + hdr.Name); name == "/" {
+				continue
+			}
+			stat.count++
+			if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+				stat.size += hdr.Size
+			}
+		}
+		// Drain the stream to not block the reader
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return stat
+}
+
+func (stat *tarStat) Read(p []byte) (int, error) {
+	return stat.reader.Read(p)
+}
+
+// wait returns the count of files and the total size of regular files.
+func (stat *tarStat) wait() (int, int64) {
+	stat.writer.Close()
+	<-stat.done
+	return stat.count, stat.size
+}
+
+// Build nydus bootstrap and blob, the basename of returned blob path is
+// sha256 hex string
 func (workflow *Workflow) Build(
 	layerDir, whiteoutSpec, parentBootstrapPath, bootstrapPath string,
-) (string, error) {
+) (*BuildResult, error) {
+	result, err := workflow.build(BuilderOption{
+		RootfsPath:   layerDir,
+		WhiteoutSpec: whiteoutSpec,
+	}, parentBootstrapPath, bootstrapPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "build layer %s", layerDir)
+	}
+
+	result.FileCount, result.UncompressedSize, err = layerStat(layerDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat layer %s", layerDir)
+	}
+
+	return result, nil
+}
+
+// BuildFromTar builds nydus bootstrap and blob from the (compressed) tar
+// stream of layer, the tar stream is piped into nydus-image without being
+// unpacked to a layer directory, it falls back to build from unpacked
+// layer directory if tar-rafs is unsupported by nydus-image.
+func (workflow *Workflow) BuildFromTar(
+	tarReader io.Reader, whiteoutSpec, parentBootstrapPath, bootstrapPath string,
+) (*BuildResult, error) {
+	features, err := workflow.builder.Probe()
+	if err != nil {
+		return nil, err
+	}
+	if !features.TarRafs {
+		// Fall back to build from the layer directory unpacked in scratch
+		// space, the stream scratch has no room to unpack
+		if workflow.scratch.Streaming() {
+			return nil, fmt.Errorf("Stream scratch requires tar-rafs support of nydus-image %s", features.Version)
+		}
+		logrus.Warnf("Unpack layer tar since tar-rafs is unsupported by nydus-image %s", features.Version)
+		layerDir, err := workflow.scratch.Unpack(context.Background(), "layer-"+uuid.NewString(), tarReader)
+		if err != nil {
+			return nil, errors.Wrap(err, "unpack layer tar")
+		}
+		defer workflow.scratch.Release(layerDir)
+		return workflow.Build(layerDir, whiteoutSpec, parentBootstrapPath, bootstrapPath)
+	}
+
+	rdr, err := utils.DecompressStream(tarReader)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress layer tar")
+	}
+	defer rdr.Close()
+
+	stat := newTarStat(rdr)
+	result, err := workflow.build(BuilderOption{
+		Tar:          stat,
+		WhiteoutSpec: whiteoutSpec,
+	}, parentBootstrapPath, bootstrapPath)
+	fileCount, uncompressedSize := stat.wait()
+	if err != nil {
+		return nil, errors.Wrap(err, "build layer from tar")
+	}
+	result.FileCount = fileCount
+	result.UncompressedSize = uncompressedSize
+	workflow.scratch.streamed()
+
+	return result, nil
+}
+
+// build builds the layer by option on top of parent bootstrap, the blob
+// built by the layer is renamed to its sha256 digest.
+func (workflow *Workflow) build(
+	option BuilderOption, parentBootstrapPath, bootstrapPath string,
+) (*BuildResult, error) {
+	start := time.Now()
 	workflow.bootstrapPath = bootstrapPath
 
 	if parentBootstrapPath != "" {
@@ -105,24 +450,59 @@ func (workflow *Workflow) Build(
 
 	blobPath := filepath.Join(workflow.blobsDir, uuid.NewString())
 
-	if err := workflow.builder.Run(BuilderOption{
-		ParentBootstrapPath: workflow.parentBootstrapPath,
-		BootstrapPath:       workflow.bootstrapPath,
-		RootfsPath:          layerDir,
-		PrefetchDir:         workflow.PrefetchDir,
-		WhiteoutSpec:        whiteoutSpec,
-		OutputJSONPath:      workflow.buildOutputJSONPath(),
-		BlobPath:            blobPath,
-	}); err != nil {
-		return "", errors.Wrapf(err, "build layer %s", layerDir)
+	option.ParentBootstrapPath = workflow.parentBootstrapPath
+	option.BootstrapPath = workflow.bootstrapPath
+	option.ChunkDictPath = workflow.ChunkDictPath
+	option.PrefetchDir = workflow.PrefetchDir
+	option.OutputJSONPath = workflow.buildOutputJSONPath()
+	option.BlobPath = blobPath
+	option.Compressor = workflow.Compressor
+	option.FsVersion = workflow.FsVersion
+	option.ChunkSize = workflow.ChunkSize
+	option.BatchSize = workflow.BatchSize
+	features, err := workflow.builder.Probe()
+	if err != nil {
+		return nil, err
+	}
+	if err := features.adapt(&option); err != nil {
+		return nil, err
+	}
+	if err := workflow.builder.Run(option); err != nil {
+		return nil, err
 	}
 
 	workflow.parentBootstrapPath = workflow.bootstrapPath
 
-	digestedBlobPath, err := workflow.getLatestBlobPath()
+	blobIDs, err := workflow.BlobIDs()
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob list")
+	}
+	result := &BuildResult{
+		BlobIDs:        blobIDs,
+		OutputJSONPath: workflow.buildOutputJSONPath(),
+	}
+
+	blobPath, err = workflow.digestBlob(blobIDs, blobPath)
 	if err != nil {
-		return "", errors.Wrap(err, "get latest blob")
+		return nil, err
+	}
+	if blobPath != "" {
+		blobInfo, err := os.Stat(blobPath)
+		if err != nil {
+			return nil, err
+		}
+		result.BlobPath = blobPath
+		result.BlobSize = blobInfo.Size()
 	}
+	result.Duration = time.Since(start)
+
+	return result, nil
+}
+
+// digestBlob renames the blob built by the layer to its sha256 digest,
+// returns empty path if no new blob is built.
+func (workflow *Workflow) digestBlob(blobIDs []string, blobPath string) (string, error) {
+	digestedBlobPath := workflow.getLatestBlobPath(blobIDs)
 
 	logrus.Debugf("original: %s. digested: %s", blobPath, digestedBlobPath)
 
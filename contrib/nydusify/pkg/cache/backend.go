@@ -0,0 +1,229 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// ErrConflict is returned when the cache image was updated by another
+// converter since it was imported.
+var ErrConflict = errors.New("Cache image conflict")
+
+// CacheBackend stores the cache image, the index, manifests and layers
+// of cache image are pulled from and pushed to it.
+type CacheBackend interface {
+	// Reference returns a human readable location of cache image.
+	Reference() string
+	// Resolve returns the descriptor of cache image index.
+	Resolve(ctx context.Context) (*ocispec.Descriptor, error)
+	// Pull returns the content of descriptor, the content is addressed by
+	// reference instead of digest if byDigest is false.
+	Pull(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (io.ReadCloser, error)
+	// Push stores the content of descriptor, the descriptor will be
+	// referenced by cache image if byDigest is false.
+	Push(ctx context.Context, desc ocispec.Descriptor, byDigest bool, reader io.Reader) error
+}
+
+// ConditionalPusher is implemented by the cache backend which supports to
+// update cache image atomically, the registry doesn't support it.
+type ConditionalPusher interface {
+	// PushIfMatch pushes the descriptor as cache image only if the current
+	// cache image digest matches the expected one (empty means that cache
+	// image doesn't exist), otherwise returns ErrConflict.
+	PushIfMatch(ctx context.Context, desc ocispec.Descriptor, expected digest.Digest, reader io.Reader) error
+}
+
+type registryBackend struct {
+	*remote.Remote
+}
+
+// NewRegistryBackend creates a cache backend stores cache image in registry.
+func NewRegistryBackend(remote *remote.Remote) CacheBackend {
+	return &registryBackend{remote}
+}
+
+func (backend *registryBackend) Reference() string {
+	return backend.Ref
+}
+
+// LocalBackend stores cache image in a local directory with OCI image
+// layout, it's useful for the environment without a writable registry,
+// e.g. air-gapped or CI environment.
+type LocalBackend struct {
+	dir string
+}
+
+// NewLocalBackend creates a cache backend stores cache image in directory.
+func NewLocalBackend(dir string) (*LocalBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Create cache directory")
+	}
+
+	layoutPath := filepath.Join(dir, ocispec.ImageLayoutFile)
+	if _, err := os.Stat(layoutPath); os.IsNotExist(err) {
+		layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+		if err != nil {
+			return nil, errors.Wrap(err, "Marshal image layout")
+		}
+		if err := utils.WriteFileAtomic(layoutPath, layout); err != nil {
+			return nil, errors.Wrap(err, "Write image layout")
+		}
+	}
+
+	return &LocalBackend{
+		dir: dir,
+	}, nil
+}
+
+func (backend *LocalBackend) blobPath(dgst digest.Digest) string {
+	return filepath.Join(backend.dir, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+func (backend *LocalBackend) indexPath() string {
+	return filepath.Join(backend.dir, "index.json")
+}
+
+// Reference returns the directory of cache image.
+func (backend *LocalBackend) Reference() string {
+	return "dir://" + backend.dir
+}
+
+// Resolve returns the descriptor referenced by index.json of OCI image layout.
+func (backend *LocalBackend) Resolve(ctx context.Context) (*ocispec.Descriptor, error) {
+	data, err := ioutil.ReadFile(backend.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrapf(errdefs.ErrNotFound, "cache image in %s", backend.dir)
+		}
+		return nil, err
+	}
+
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal index of image layout")
+	}
+	if len(index.Manifests) == 0 {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "cache image in %s", backend.dir)
+	}
+
+	desc := index.Manifests[0]
+	desc.Annotations = nil
+
+	return &desc, nil
+}
+
+// Pull opens the blob file of descriptor.
+func (backend *LocalBackend) Pull(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (io.ReadCloser, error) {
+	file, err := os.Open(backend.blobPath(desc.Digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrapf(errdefs.ErrNotFound, "blob %s", desc.Digest)
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// Push writes the blob file of descriptor, and updates index.json of
+// OCI image layout to reference the descriptor if byDigest is false.
+func (backend *LocalBackend) Push(ctx context.Context, desc ocispec.Descriptor, byDigest bool, reader io.Reader) error {
+	blobPath := backend.blobPath(desc.Digest)
+	if _, err := os.Stat(blobPath); os.IsNotExist(err) {
+		if err := backend.writeBlob(blobPath, desc, reader); err != nil {
+			return errors.Wrapf(err, "Write blob %s", desc.Digest)
+		}
+	}
+
+	if byDigest {
+		return nil
+	}
+
+	desc.Annotations = map[string]string{
+		ocispec.AnnotationRefName: "latest",
+	}
+	index := ocispec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ocispec.Descriptor{desc},
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "Marshal index of image layout")
+	}
+
+	return utils.WriteFileAtomic(backend.indexPath(), data)
+}
+
+// PushIfMatch implements ConditionalPusher, the index.json of OCI image
+// layout is updated under a file lock.
+func (backend *LocalBackend) PushIfMatch(ctx context.Context, desc ocispec.Descriptor, expected digest.Digest, reader io.Reader) error {
+	lock, err := os.OpenFile(backend.indexPath()+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Open cache lock file")
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrap(err, "Lock cache image")
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	var current digest.Digest
+	currentDesc, err := backend.Resolve(ctx)
+	if err == nil {
+		current = currentDesc.Digest
+	} else if !errdefs.IsNotFound(err) {
+		return err
+	}
+	if current != expected {
+		return ErrConflict
+	}
+
+	return backend.Push(ctx, desc, false, reader)
+}
+
+func (backend *LocalBackend) writeBlob(blobPath string, desc ocispec.Descriptor, reader io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(blobPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	digester := desc.Digest.Algorithm().Digester()
+	size, err := io.Copy(io.MultiWriter(file, digester.Hash()), reader)
+	if err != nil {
+		return err
+	}
+	if size != desc.Size || digester.Digest() != desc.Digest {
+		return fmt.Errorf("unexpected blob size %d and digest %s", size, digester.Digest())
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), blobPath)
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+)
+
+func TestLocalBackend(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "nydusify-cache-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheBackend, err := NewLocalBackend(dir)
+	require.Nil(t, err)
+
+	_, err = cacheBackend.Resolve(ctx)
+	assert.True(t, errdefs.IsNotFound(err))
+
+	// Export records to local backend, the bootstrap and blob
+	// layers must be pushed before exporting.
+	cache, err := New(cacheBackend, Opt{
+		MaxRecords: 3,
+		Version:    "v1",
+		Backend:    &backend.Registry{},
+	})
+	require.Nil(t, err)
+	records := []*CacheRecord{makeRecord(1, true), makeRecord(2, false)}
+	for _, record := range records {
+		data := []byte("bootstrap-" + record.NydusBootstrapDesc.Digest.Hex())
+		record.NydusBootstrapDesc.Digest = digest.FromBytes(data)
+		record.NydusBootstrapDesc.Size = int64(len(data))
+		require.Nil(t, cache.Push(ctx, *record.NydusBootstrapDesc, bytes.NewReader(data)))
+		if record.NydusBlobDesc != nil {
+			data := []byte("blob-" + record.NydusBlobDesc.Digest.Hex())
+			record.NydusBlobDesc.Digest = digest.FromBytes(data)
+			record.NydusBlobDesc.Size = int64(len(data))
+			require.Nil(t, cache.Push(ctx, *record.NydusBlobDesc, bytes.NewReader(data)))
+		}
+	}
+	cache.Record(records)
+	require.Nil(t, cache.Export(ctx))
+
+	desc, err := cacheBackend.Resolve(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, ocispec.MediaTypeImageIndex, desc.MediaType)
+
+	// Import records from local backend
+	imported, err := New(cacheBackend, Opt{
+		MaxRecords: 3,
+		Version:    "v1",
+		Backend:    &backend.Registry{},
+	})
+	require.Nil(t, err)
+	require.Nil(t, imported.Import(ctx))
+
+	for _, record := range records {
+		checked, bootstrapReader, blobReader, err := imported.Check(ctx, record.SourceChainID)
+		require.Nil(t, err)
+		require.NotNil(t, checked)
+		assert.Equal(t, record.NydusBootstrapDesc.Digest, checked.NydusBootstrapDesc.Digest)
+		bootstrapReader.Close()
+		if record.NydusBlobDesc != nil {
+			assert.Equal(t, record.NydusBlobDesc.Digest, checked.NydusBlobDesc.Digest)
+			blobReader.Close()
+		} else {
+			assert.Nil(t, blobReader)
+		}
+	}
+
+	// Mismatched content should be rejected
+	err = cacheBackend.Push(ctx, ocispec.Descriptor{
+		Digest: digest.FromString("foo"),
+		Size:   3,
+	}, true, bytes.NewReader([]byte("bar")))
+	assert.NotNil(t, err)
+}
+
+func TestConcurrentExport(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "nydusify-cache-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheBackend, err := NewLocalBackend(dir)
+	require.Nil(t, err)
+
+	newCache := func() *Cache {
+		cache, err := New(cacheBackend, Opt{
+			MaxRecords: 10,
+			Version:    "v1",
+			Backend:    &backend.OSSBackend{},
+		})
+		require.Nil(t, err)
+		cache.Import(ctx)
+		return cache
+	}
+
+	// Both converters import the cache image before anyone exports
+	cache1 := newCache()
+	cache2 := newCache()
+
+	cache1.Record([]*CacheRecord{makeRecord(1, false)})
+	require.Nil(t, cache1.Export(ctx))
+	cache2.Record([]*CacheRecord{makeRecord(2, false)})
+	require.Nil(t, cache2.Export(ctx))
+
+	// The records of both converters should be kept
+	cache := newCache()
+	for _, id := range []string{"1", "2"} {
+		_, ok := cache.pulledRecords[digest.FromString("chain-"+id)]
+		assert.True(t, ok)
+	}
+}
+
+func TestPaginatedExport(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "nydusify-cache-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheBackend, err := NewLocalBackend(dir)
+	require.Nil(t, err)
+
+	newCache := func() *Cache {
+		cache, err := New(cacheBackend, Opt{
+			MaxRecords: 20,
+			Version:    "v1",
+			Backend:    &backend.Registry{},
+			// Fits about 4 records in a page
+			MaxManifestSize: manifestOverhead + 2500,
+		})
+		require.Nil(t, err)
+		cache.Import(ctx)
+		return cache
+	}
+
+	cache := newCache()
+	records := []*CacheRecord{}
+	for id := int64(1); id <= 10; id++ {
+		records = append(records, makeRecord(id, true))
+	}
+	cache.Record(records)
+	require.Nil(t, cache.Export(ctx))
+	pages := len(cache.platformManifests)
+	assert.True(t, pages > 1)
+
+	// Only the first page is pulled on import
+	cache = newCache()
+	assert.Equal(t, pages-1, len(cache.pendingPages))
+	_, ok := cache.pulledRecords[digest.FromString("chain-10")]
+	assert.False(t, ok)
+
+	// The pending pages are pulled on cache miss
+	record, err := cache.findRecord(ctx, digest.FromString("chain-10"))
+	require.Nil(t, err)
+	assert.Equal(t, makeRecord(10, true).NydusBlobDesc.Digest, record.NydusBlobDesc.Digest)
+	assert.Equal(t, 0, len(cache.pendingPages))
+	record, err = cache.findRecord(ctx, digest.FromString("chain-11"))
+	require.Nil(t, err)
+	assert.Nil(t, record)
+
+	// The records of pending pages are kept on export
+	cache = newCache()
+	cache.Record([]*CacheRecord{makeRecord(11, true)})
+	require.Nil(t, cache.Export(ctx))
+	cache = newCache()
+	require.Nil(t, cache.importPendingPages(ctx))
+	assert.Equal(t, 11, len(cache.pushedRecords))
+	assert.Equal(t, digest.FromString("chain-11"), cache.pushedRecords[0].SourceChainID)
+	assert.Equal(t, digest.FromString("chain-10"), cache.pushedRecords[10].SourceChainID)
+}
+
+// memoryStore is an in-memory object store, the ETag of object is its
+// digest, beforePut is called before putting object with condition.
+type memoryStore struct {
+	sync.Mutex
+	objects   map[string][]byte
+	beforePut func()
+}
+
+func (store *memoryStore) GetObject(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	store.Lock()
+	defer store.Unlock()
+	data, ok := store.objects[key]
+	if !ok {
+		return nil, "", errors.Wrapf(errdefs.ErrNotFound, "object %s", key)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), digest.FromBytes(data).String(), nil
+}
+
+func (store *memoryStore) PutObject(
+	ctx context.Context, key string, reader io.Reader, size int64, dgst digest.Digest, ifMatch *string,
+) error {
+	if ifMatch != nil && store.beforePut != nil {
+		store.beforePut()
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	store.Lock()
+	defer store.Unlock()
+	if ifMatch != nil {
+		current, ok := store.objects[key]
+		if (*ifMatch == "" && ok) || (*ifMatch != "" && (!ok || digest.FromBytes(current).String() != *ifMatch)) {
+			return backend.ErrPreconditionFailed
+		}
+	}
+	store.objects[key] = data
+	return nil
+}
+
+func TestObjectBackend(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{objects: map[string][]byte{}}
+	cacheBackend := NewObjectBackend(store, "s3://bucket/cache/")
+	assert.Equal(t, "s3://bucket/cache/", cacheBackend.Reference())
+
+	_, err := cacheBackend.Resolve(ctx)
+	assert.True(t, errdefs.IsNotFound(err))
+
+	newCache := func() *Cache {
+		cache, err := New(cacheBackend, Opt{
+			MaxRecords: 10,
+			Version:    "v1",
+			Backend:    &backend.OSSBackend{},
+		})
+		require.Nil(t, err)
+		cache.Import(ctx)
+		return cache
+	}
+
+	cache1 := newCache()
+	cache2 := newCache()
+	cache1.Record([]*CacheRecord{makeRecord(1, false)})
+	require.Nil(t, cache1.Export(ctx))
+	_, ok := store.objects[objectIndexKey]
+	assert.True(t, ok)
+
+	// The index object is modified by another converter before putting
+	store.beforePut = func() {
+		store.beforePut = nil
+		cache := newCache()
+		cache.Record([]*CacheRecord{makeRecord(3, false)})
+		require.Nil(t, cache.Export(ctx))
+	}
+	cache2.Record([]*CacheRecord{makeRecord(2, false)})
+	require.Nil(t, cache2.Export(ctx))
+
+	// The records of all converters should be kept
+	cache := newCache()
+	for _, id := range []string{"1", "2", "3"} {
+		_, ok := cache.pulledRecords[digest.FromString("chain-"+id)]
+		assert.True(t, ok)
+	}
+}
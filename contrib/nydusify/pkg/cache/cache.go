@@ -11,13 +11,15 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
-	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 	"github.com/sirupsen/logrus"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
@@ -25,6 +27,18 @@ import (
 	"github.com/pkg/errors"
 )
 
+// ExportRetries specifies the maximum retries of exporting on conflict
+var ExportRetries uint = 5
+
+// manifestOverhead is the reserved size for the fields other than layers
+// in cache manifest, e.g. media type, config and annotations.
+const manifestOverhead = 1024
+
+// maxPageLayers is the maximum layers in a page, it keeps the page compatible
+// with the 127 max in graph driver of docker so that we can pull the page
+// using docker.
+const maxPageLayers = 100
+
 // Opt configures Nydus cache
 type Opt struct {
 	// Maximum records(bootstrap layer + blob layer) in cache image.
@@ -37,6 +51,16 @@ type Opt struct {
 	// the backend be specified, because the blob layer will be uploaded
 	// to backend.
 	Backend backend.Backend
+	// The records are scoped by platform in cache image, default
+	// to the platform of runtime.
+	Platform *ocispec.Platform
+	// The size limit in bytes of cache manifest, the records exceeding
+	// it are split into multiple pages, default to DefaultMaxManifestSize.
+	MaxManifestSize int
+	// TTL expires the records not recorded within it, the expired records
+	// are ignored on import and dropped on next export, the records never
+	// expire if it's 0.
+	TTL time.Duration
 }
 
 // Cache creates an image to store cache records in its image manifest,
@@ -46,26 +70,57 @@ type Opt struct {
 // If the converter hits cache record during build source layer, we can
 // skip the layer building, see cache image example: examples/manifest/cache_manifest.json.
 //
+// The cache image is an image index, the records of each platform are stored
+// in the layers of its own image manifest, see examples/manifest/cache_index.json.
+// The cache image in single image manifest (schema v1) will be migrated to image
+// index on next export.
+//
+// The records of a platform are split into multiple image manifests (pages) if
+// they exceed the manifest size limit of registry, only the first page is pulled
+// on import, the others are pulled on demand when the cache misses.
+//
 // Here is the build cache workflow:
-// 1. Import cache records from registry;
+// 1. Import cache records from cache backend;
 // 2. Check cache record using source layer ChainID before layer build,
 //    skip layer build if the cache hit;
-// 3. Export new cache records to registry;
+// 3. Export new cache records to cache backend;
 type Cache struct {
 	opt Opt
-	// Remote is responsible for pulling & pushing cache image
-	remote *remote.Remote
+	// Backend is responsible for pulling & pushing cache image
+	backend CacheBackend
 	// Store the pulled records from registry
 	pulledRecords map[digest.Digest]*CacheRecord
 	// Store the records prepared to push to registry
 	pushedRecords []*CacheRecord
+	// Store the image manifests of all platforms in cache image index
+	platformManifests []ocispec.Descriptor
+	// Store the pages of current platform not pulled yet
+	pendingPages []ocispec.Descriptor
+	// Digest of cache image index imported from backend, be empty if the
+	// cache image doesn't exist, it's used to detect concurrent updates.
+	indexDigest digest.Digest
+	// Store the records put by Record, they will be merged into the records
+	// of cache image updated by another converter on conflict.
+	recorded []*CacheRecord
+	// Count of the expired records ignored on import.
+	expired int
 }
 
 // New creates Nydus cache instance,
-func New(remote *remote.Remote, opt Opt) (*Cache, error) {
+func New(backend CacheBackend, opt Opt) (*Cache, error) {
+	if opt.Platform == nil {
+		opt.Platform = &ocispec.Platform{
+			OS:           utils.SupportedOS,
+			Architecture: utils.SupportedArch,
+		}
+	}
+	if opt.MaxManifestSize <= 0 {
+		opt.MaxManifestSize = DefaultMaxManifestSize
+	}
+
 	cache := &Cache{
-		opt:    opt,
-		remote: remote,
+		opt:     opt,
+		backend: backend,
 		// source_layer_chain_id -> cache_record
 		pulledRecords: make(map[digest.Digest]*CacheRecord),
 		pushedRecords: []*CacheRecord{},
@@ -76,7 +131,9 @@ func New(remote *remote.Remote, opt Opt) (*Cache, error) {
 
 func (cache *Cache) recordToLayer(record *CacheRecord) (*ocispec.Descriptor, *ocispec.Descriptor) {
 	bootstrapCacheMediaType := ocispec.MediaTypeImageLayerGzip
-	if cache.opt.DockerV2Format {
+	if record.NydusBootstrapDesc.MediaType == utils.MediaTypeImageLayerZstd {
+		bootstrapCacheMediaType = utils.MediaTypeImageLayerZstd
+	} else if cache.opt.DockerV2Format {
 		bootstrapCacheMediaType = images.MediaTypeDockerSchema2LayerGzip
 	}
 
@@ -91,6 +148,12 @@ func (cache *Cache) recordToLayer(record *CacheRecord) (*ocispec.Descriptor, *oc
 			utils.LayerAnnotationUncompressed: record.NydusBootstrapDiffID.String(),
 		},
 	}
+	if compressor := record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusCompressor]; compressor != "" {
+		bootstrapCacheDesc.Annotations[utils.LayerAnnotationNydusCompressor] = compressor
+	}
+	if !record.Timestamp.IsZero() {
+		bootstrapCacheDesc.Annotations[utils.LayerAnnotationNydusCacheTimestamp] = record.Timestamp.UTC().Format(time.RFC3339)
+	}
 
 	var blobCacheDesc *ocispec.Descriptor
 	if record.NydusBlobDesc != nil {
@@ -161,6 +224,9 @@ func (cache *Cache) layerToRecord(layer *ocispec.Descriptor) *CacheRecord {
 				utils.LayerAnnotationUncompressed:   uncompressedDigestStr,
 			},
 		}
+		if compressor := layer.Annotations[utils.LayerAnnotationNydusCompressor]; compressor != "" {
+			bootstrapDesc.Annotations[utils.LayerAnnotationNydusCompressor] = compressor
+		}
 		var nydusBlobDesc *ocispec.Descriptor
 		if layer.Annotations[utils.LayerAnnotationNydusBlobDigest] != "" &&
 			layer.Annotations[utils.LayerAnnotationNydusBlobSize] != "" {
@@ -181,11 +247,14 @@ func (cache *Cache) layerToRecord(layer *ocispec.Descriptor) *CacheRecord {
 				},
 			}
 		}
+		// The record without valid timestamp never expires
+		timestamp, _ := time.Parse(time.RFC3339, layer.Annotations[utils.LayerAnnotationNydusCacheTimestamp])
 		return &CacheRecord{
 			SourceChainID:        sourceChainID,
 			NydusBootstrapDesc:   &bootstrapDesc,
 			NydusBlobDesc:        nydusBlobDesc,
 			NydusBootstrapDiffID: bootstrapDiffID,
+			Timestamp:            timestamp,
 		}
 	}
 
@@ -218,6 +287,7 @@ func mergeRecord(old, new *CacheRecord) *CacheRecord {
 	if new.NydusBootstrapDesc != nil {
 		old.NydusBootstrapDesc = new.NydusBootstrapDesc
 		old.NydusBootstrapDiffID = new.NydusBootstrapDiffID
+		old.Timestamp = new.Timestamp
 	}
 
 	if new.NydusBlobDesc != nil {
@@ -228,36 +298,125 @@ func mergeRecord(old, new *CacheRecord) *CacheRecord {
 }
 
 func (cache *Cache) importRecordsFromLayers(layers []ocispec.Descriptor) {
-	pulledRecords := make(map[digest.Digest]*CacheRecord)
-	pushedRecords := []*CacheRecord{}
+	cache.pulledRecords = make(map[digest.Digest]*CacheRecord)
+	cache.pushedRecords = []*CacheRecord{}
+	cache.expired = 0
+	cache.appendRecordsFromLayers(layers)
+}
 
+// expiredRecord returns true if the record isn't recorded within TTL.
+func (cache *Cache) expiredRecord(record *CacheRecord) bool {
+	return cache.opt.TTL > 0 && !record.Timestamp.IsZero() && time.Since(record.Timestamp) > cache.opt.TTL
+}
+
+// appendRecordsFromLayers appends the records of a page after the records
+// of previous pages, the expired records are ignored.
+func (cache *Cache) appendRecordsFromLayers(layers []ocispec.Descriptor) {
+	records := []*CacheRecord{}
 	for _, layer := range layers {
 		record := cache.layerToRecord(&layer)
 		if record != nil {
 			// Merge bootstrap and related blob layer to record
-			newRecord := mergeRecord(
-				pulledRecords[record.SourceChainID],
-				record,
-			)
-			pulledRecords[record.SourceChainID] = newRecord
-			pushedRecords = append(pushedRecords, newRecord)
+			oldRecord := cache.pulledRecords[record.SourceChainID]
+			newRecord := mergeRecord(oldRecord, record)
+			cache.pulledRecords[record.SourceChainID] = newRecord
+			if oldRecord == nil {
+				records = append(records, newRecord)
+			}
 		} else {
 			logrus.Warnf("Strange! Build cache layer can't produce a valid record. %s", layer.Digest)
 		}
 	}
 
-	cache.pulledRecords = pulledRecords
-	cache.pushedRecords = pushedRecords
+	// The timestamp is only annotated in bootstrap layer, so the records
+	// are checked after the layers of a record are merged
+	for _, record := range records {
+		if cache.expiredRecord(record) {
+			delete(cache.pulledRecords, record.SourceChainID)
+			cache.expired++
+			continue
+		}
+		cache.pushedRecords = append(cache.pushedRecords, record)
+	}
 }
 
-// Export pushes cache manifest index to remote registry
-func (cache *Cache) Export(ctx context.Context) error {
-	if len(cache.pushedRecords) == 0 {
-		return nil
+func (cache *Cache) platformMatch(platform *ocispec.Platform) bool {
+	return platform != nil &&
+		platform.OS == cache.opt.Platform.OS &&
+		platform.Architecture == cache.opt.Platform.Architecture &&
+		platform.Variant == cache.opt.Platform.Variant
+}
+
+// paginateRecords splits the layers of pushed records into pages, the
+// layers of a record are kept in the same page, and the size of the layers
+// in a page doesn't exceed the manifest size limit unless the page only
+// has one record, nor does the layer count exceed maxPageLayers.
+func (cache *Cache) paginateRecords() ([][]ocispec.Descriptor, error) {
+	// Reserve the space for the fields other than layers in manifest
+	limit := cache.opt.MaxManifestSize - manifestOverhead
+	pages := [][]ocispec.Descriptor{}
+	page := []ocispec.Descriptor{}
+	pageSize := 0
+
+	for _, record := range cache.pushedRecords {
+		bootstrapCacheDesc, blobCacheDesc := cache.recordToLayer(record)
+		layers := []ocispec.Descriptor{*bootstrapCacheDesc}
+		if blobCacheDesc != nil {
+			layers = append(layers, *blobCacheDesc)
+		}
+
+		size := 0
+		for _, layer := range layers {
+			layerBytes, err := json.Marshal(layer)
+			if err != nil {
+				return nil, errors.Wrap(err, "Marshal cache layer")
+			}
+			// Count the separator between layers
+			size += len(layerBytes) + 1
+		}
+
+		if len(page) > 0 && (pageSize+size > limit || len(page)+len(layers) > maxPageLayers) {
+			pages = append(pages, page)
+			page = []ocispec.Descriptor{}
+			pageSize = 0
+		}
+		page = append(page, layers...)
+		pageSize += size
+	}
+	pages = append(pages, page)
+
+	return pages, nil
+}
+
+// exportManifests pushes the image manifests store the records of current
+// platform to cache backend, the records are stored in a single manifest
+// unless they exceed the manifest size limit.
+func (cache *Cache) exportManifests(ctx context.Context) ([]ocispec.Descriptor, error) {
+	pages, err := cache.paginateRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	descs := []ocispec.Descriptor{}
+	for idx, layers := range pages {
+		desc, err := cache.exportManifest(ctx, layers)
+		if err != nil {
+			return nil, err
+		}
+		if len(pages) > 1 {
+			desc.Annotations = map[string]string{
+				utils.ManifestNydusCachePage: strconv.Itoa(idx),
+			}
+		}
+		descs = append(descs, *desc)
 	}
 
-	layers := cache.exportRecordsToLayers()
+	return descs, nil
+}
 
+// exportManifest pushes the image manifest stores the records in layers
+// to cache backend
+func (cache *Cache) exportManifest(ctx context.Context, layers []ocispec.Descriptor) (*ocispec.Descriptor, error) {
 	// Ensure layers from manifest match with image config,
 	// this will keep compatibility when using docker pull
 	// for the image that only included bootstrap layers.
@@ -280,29 +439,30 @@ func (cache *Cache) Export(ctx context.Context) error {
 		}
 	}
 
-	// Prepare empty image config, just for registry API compatibility,
-	// manifest requires a valid config field.
+	// Prepare image config of the platform, layers from
+	// manifest must be match image config.
 	configMediaType := ocispec.MediaTypeImageConfig
 	if cache.opt.DockerV2Format {
 		configMediaType = images.MediaTypeDockerSchema2Config
 	}
 	config := ocispec.Image{
-		Config: ocispec.ImageConfig{},
+		Architecture: cache.opt.Platform.Architecture,
+		OS:           cache.opt.Platform.OS,
+		Config:       ocispec.ImageConfig{},
 		RootFS: ocispec.RootFS{
-			Type: "layers",
-			// Layers from manifest must be match image config.
+			Type:    "layers",
 			DiffIDs: diffIDs,
 		},
 	}
 	configDesc, configBytes, err := utils.MarshalToDesc(config, configMediaType)
 	if err != nil {
-		return errors.Wrap(err, "Marshal cache config")
+		return nil, errors.Wrap(err, "Marshal cache config")
 	}
-	if err := cache.remote.Push(ctx, *configDesc, false, bytes.NewReader(configBytes)); err != nil {
-		return errors.Wrap(err, "Push cache config")
+	if err := cache.backend.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push cache config")
 	}
 
-	// Push cache manifest to remote registry
+	// Push cache manifest to cache backend
 	mediaType := ocispec.MediaTypeImageManifest
 	if cache.opt.DockerV2Format {
 		mediaType = images.MediaTypeDockerSchema2Manifest
@@ -314,8 +474,6 @@ func (cache *Cache) Export(ctx context.Context) error {
 			Versioned: specs.Versioned{
 				SchemaVersion: 2,
 			},
-			// Just for registry API compatibility, registry required a
-			// valid config field.
 			Config: *configDesc,
 			Layers: layers,
 			Annotations: map[string]string{
@@ -326,62 +484,296 @@ func (cache *Cache) Export(ctx context.Context) error {
 
 	manifestDesc, manifestBytes, err := utils.MarshalToDesc(manifest, manifest.MediaType)
 	if err != nil {
-		return errors.Wrap(err, "Push cache manifest")
+		return nil, errors.Wrap(err, "Marshal cache manifest")
 	}
+	manifestDesc.Platform = cache.opt.Platform
 
-	if err := cache.remote.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
-		return errors.Wrap(err, "Push cache manifest")
+	if err := cache.backend.Push(ctx, *manifestDesc, true, bytes.NewReader(manifestBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push cache manifest")
 	}
 
-	return nil
+	return manifestDesc, nil
 }
 
-// Import pulls cache manifest index from remote registry
-func (cache *Cache) Import(ctx context.Context) error {
-	manifestDesc, err := cache.remote.Resolve(ctx)
+// currentDigest returns the digest of cache image in backend, returns
+// empty digest if the cache image doesn't exist.
+func (cache *Cache) currentDigest(ctx context.Context) (digest.Digest, error) {
+	desc, err := cache.backend.Resolve(ctx)
 	if err != nil {
-		return errors.Wrap(err, "Resolve cache image")
+		if errdefs.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.Wrap(err, "Resolve cache image")
+	}
+	return desc.Digest, nil
+}
+
+// Export pushes cache manifest index to cache backend with optimistic
+// locking, if the cache image was updated by another converter since
+// imported, the records of both sides are merged and pushed again.
+func (cache *Cache) Export(ctx context.Context) error {
+	if len(cache.pushedRecords) == 0 {
+		return nil
 	}
+	for attempt := uint(0); attempt <= ExportRetries; attempt++ {
+		err := cache.export(ctx)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+		logrus.Warnf("Cache image %s was updated concurrently, merge records and retry", cache.backend.Reference())
+		// Ignore the error of importing cache image, the records
+		// put by Record will be pushed anyway.
+		if err := cache.Import(ctx); err != nil {
+			logrus.Warnf("Failed to import cache: %s", err)
+		}
+		cache.record(cache.recorded)
+	}
+	return errors.Wrapf(ErrConflict, "Export cache image after %d retries", ExportRetries)
+}
 
-	// Fetch cache manifest from remote registry
-	manifestReader, err := cache.remote.Pull(ctx, *manifestDesc, true)
+func (cache *Cache) export(ctx context.Context) error {
+	current, err := cache.currentDigest(ctx)
 	if err != nil {
-		return errors.Wrap(err, "Pull cache image")
+		return err
+	}
+	if current != cache.indexDigest {
+		return ErrConflict
 	}
-	defer manifestReader.Close()
 
-	manifestBytes, err := ioutil.ReadAll(manifestReader)
+	// The records of the pages not pulled yet are kept behind the others
+	if err := cache.importPendingPages(ctx); err != nil {
+		return err
+	}
+	cache.record(nil)
+
+	manifestDescs, err := cache.exportManifests(ctx)
 	if err != nil {
-		return errors.Wrap(err, "Read cache manifest")
+		return err
 	}
 
-	var manifest CacheManifest
-	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
-		return errors.Wrap(err, "Unmarshal cache manifest")
+	// Keep the records of other platforms in cache image index
+	manifests := []ocispec.Descriptor{}
+	for _, desc := range cache.platformManifests {
+		if !cache.platformMatch(desc.Platform) {
+			manifests = append(manifests, desc)
+		}
+	}
+	manifests = append(manifests, manifestDescs...)
+
+	mediaType := ocispec.MediaTypeImageIndex
+	if cache.opt.DockerV2Format {
+		mediaType = images.MediaTypeDockerSchema2ManifestList
+	}
+
+	index := CacheIndex{
+		MediaType: mediaType,
+		Index: ocispec.Index{
+			Versioned: specs.Versioned{
+				SchemaVersion: 2,
+			},
+			Manifests: manifests,
+			Annotations: map[string]string{
+				utils.ManifestNydusCache:       cache.opt.Version,
+				utils.ManifestNydusCacheSchema: SchemaVersion,
+			},
+		},
+	}
+
+	indexDesc, indexBytes, err := utils.MarshalToDesc(index, index.MediaType)
+	if err != nil {
+		return errors.Wrap(err, "Marshal cache index")
+	}
+
+	if pusher, ok := cache.backend.(ConditionalPusher); ok {
+		if err := pusher.PushIfMatch(ctx, *indexDesc, cache.indexDigest, bytes.NewReader(indexBytes)); err != nil {
+			if errors.Is(err, ErrConflict) {
+				return err
+			}
+			return errors.Wrap(err, "Push cache index")
+		}
+	} else {
+		if err := cache.backend.Push(ctx, *indexDesc, false, bytes.NewReader(indexBytes)); err != nil {
+			return errors.Wrap(err, "Push cache index")
+		}
+		// The registry doesn't support conditional push, check whether
+		// the cache index is overwritten by another converter during push.
+		current, err := cache.currentDigest(ctx)
+		if err != nil {
+			return err
+		}
+		if current != indexDesc.Digest {
+			return ErrConflict
+		}
+	}
+
+	cache.platformManifests = manifests
+	cache.indexDigest = indexDesc.Digest
+
+	return nil
+}
+
+func (cache *Cache) pull(ctx context.Context, desc *ocispec.Descriptor, res interface{}) error {
+	reader, err := cache.backend.Pull(ctx, *desc, true)
+	if err != nil {
+		return errors.Wrap(err, "Pull cache image")
 	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrap(err, "Read cache image")
+	}
+
+	return json.Unmarshal(data, res)
+}
 
+func (cache *Cache) checkVersion(annotations map[string]string) error {
 	// Discard the cache mismatched version
-	if manifest.Annotations[utils.ManifestNydusCache] != cache.opt.Version {
+	if annotations[utils.ManifestNydusCache] != cache.opt.Version {
 		return fmt.Errorf(
 			"unmatched cache image version %s, required to be %s",
-			manifest.Annotations[utils.ManifestNydusCache], cache.opt.Version,
+			annotations[utils.ManifestNydusCache], cache.opt.Version,
 		)
 	}
+	return nil
+}
+
+// importIndex imports the records of current platform from cache image index
+func (cache *Cache) importIndex(ctx context.Context, desc *ocispec.Descriptor) error {
+	var index CacheIndex
+	if err := cache.pull(ctx, desc, &index); err != nil {
+		return errors.Wrap(err, "Unmarshal cache index")
+	}
+
+	if schema := index.Annotations[utils.ManifestNydusCacheSchema]; schema != SchemaVersion {
+		return fmt.Errorf("unsupported cache image schema %s", schema)
+	}
+	if err := cache.checkVersion(index.Annotations); err != nil {
+		return err
+	}
+	cache.platformManifests = index.Manifests
+
+	pages := []ocispec.Descriptor{}
+	for _, manifestDesc := range index.Manifests {
+		if cache.platformMatch(manifestDesc.Platform) {
+			pages = append(pages, manifestDesc)
+		}
+	}
+	sort.SliceStable(pages, func(i, j int) bool {
+		return pageIndex(&pages[i]) < pageIndex(&pages[j])
+	})
+
+	cache.importRecordsFromLayers([]ocispec.Descriptor{})
+	cache.pendingPages = pages
+
+	// Only pull the first page, the others are pulled on demand
+	return cache.importNextPage(ctx)
+}
+
+func pageIndex(desc *ocispec.Descriptor) int {
+	idx, err := strconv.Atoi(desc.Annotations[utils.ManifestNydusCachePage])
+	if err != nil {
+		return 0
+	}
+	return idx
+}
+
+// importNextPage pulls the next pending page of current platform and
+// appends its records, nothing to do if there isn't any pending page.
+func (cache *Cache) importNextPage(ctx context.Context) error {
+	if len(cache.pendingPages) == 0 {
+		return nil
+	}
+	desc := cache.pendingPages[0]
+
+	var manifest CacheManifest
+	if err := cache.pull(ctx, &desc, &manifest); err != nil {
+		return errors.Wrap(err, "Unmarshal cache manifest")
+	}
+	cache.pendingPages = cache.pendingPages[1:]
+	cache.appendRecordsFromLayers(manifest.Layers)
+
+	return nil
+}
+
+func (cache *Cache) importPendingPages(ctx context.Context) error {
+	for len(cache.pendingPages) > 0 {
+		if err := cache.importNextPage(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findRecord finds the record of layer chain id, pulls the pending pages
+// one by one until the record is found.
+func (cache *Cache) findRecord(ctx context.Context, layerChainID digest.Digest) (*CacheRecord, error) {
+	for {
+		if record, ok := cache.pulledRecords[layerChainID]; ok {
+			return record, nil
+		}
+		if len(cache.pendingPages) == 0 {
+			return nil, nil
+		}
+		if err := cache.importNextPage(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
 
+// importManifest imports the records from the cache image in schema
+// v1, the records will be treated as the records of current platform
+func (cache *Cache) importManifest(ctx context.Context, desc *ocispec.Descriptor) error {
+	var manifest CacheManifest
+	if err := cache.pull(ctx, desc, &manifest); err != nil {
+		return errors.Wrap(err, "Unmarshal cache manifest")
+	}
+
+	if err := cache.checkVersion(manifest.Annotations); err != nil {
+		return err
+	}
+
+	logrus.Infof("Migrate cache image %s from schema v1 to %s", cache.backend.Reference(), SchemaVersion)
+	cache.platformManifests = nil
+	cache.pendingPages = nil
 	cache.importRecordsFromLayers(manifest.Layers)
 
 	return nil
 }
 
+// Import pulls cache manifest index from cache backend
+func (cache *Cache) Import(ctx context.Context) error {
+	desc, err := cache.backend.Resolve(ctx)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			cache.indexDigest = ""
+		}
+		return errors.Wrap(err, "Resolve cache image")
+	}
+	cache.indexDigest = desc.Digest
+
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		return cache.importIndex(ctx, desc)
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		return cache.importManifest(ctx, desc)
+	default:
+		return fmt.Errorf("unsupported cache image media type %s", desc.MediaType)
+	}
+}
+
 // Check checks bootstrap & blob layer exists in registry or storage backend
 func (cache *Cache) Check(ctx context.Context, layerChainID digest.Digest) (*CacheRecord, io.ReadCloser, io.ReadCloser, error) {
-	record, ok := cache.pulledRecords[layerChainID]
-	if !ok {
+	record, err := cache.findRecord(ctx, layerChainID)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "Pull cache page")
+	}
+	if record == nil {
 		return nil, nil, nil, nil
 	}
 
 	// Check bootstrap layer on cache
-	bootstrapReader, err := cache.remote.Pull(ctx, *record.NydusBootstrapDesc, true)
+	bootstrapReader, err := cache.backend.Pull(ctx, *record.NydusBootstrapDesc, true)
 	if err != nil {
 		return nil, nil, nil, errors.Wrap(err, "Check bootstrap layer")
 	}
@@ -389,7 +781,7 @@ func (cache *Cache) Check(ctx context.Context, layerChainID digest.Digest) (*Cac
 	// Check blob layer on cache
 	if record.NydusBlobDesc != nil {
 		if cache.opt.Backend.Type() == backend.RegistryBackend {
-			blobReader, err := cache.remote.Pull(ctx, *record.NydusBlobDesc, true)
+			blobReader, err := cache.backend.Pull(ctx, *record.NydusBlobDesc, true)
 			if err != nil {
 				return nil, nil, nil, errors.Wrap(err, "Check blob layer")
 			}
@@ -410,14 +802,34 @@ func (cache *Cache) Check(ctx context.Context, layerChainID digest.Digest) (*Cac
 
 // Record puts new bootstrap & blob layer to cache record, it's a limited queue.
 func (cache *Cache) Record(records []*CacheRecord) {
-	moveFront := map[digest.Digest]bool{}
+	recorded := records
+	for _, record := range cache.recorded {
+		found := false
+		for _, newRecord := range records {
+			if newRecord.SourceChainID == record.SourceChainID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			recorded = append(recorded, record)
+		}
+	}
+	cache.recorded = recorded
+
+	cache.record(records)
+}
+
+func (cache *Cache) record(records []*CacheRecord) {
+	seen := map[digest.Digest]bool{}
 	for _, record := range records {
-		moveFront[record.SourceChainID] = true
+		seen[record.SourceChainID] = true
 	}
 
 	pushedRecords := records
 	for _, record := range cache.pushedRecords {
-		if !moveFront[record.SourceChainID] {
+		if !seen[record.SourceChainID] {
+			seen[record.SourceChainID] = true
 			pushedRecords = append(pushedRecords, record)
 			if len(pushedRecords) >= int(cache.opt.MaxRecords) {
 				break
@@ -432,10 +844,10 @@ func (cache *Cache) Record(records []*CacheRecord) {
 	}
 }
 
-// PullBootstrap pulls bootstrap layer from registry, and unpack to a specified path,
+// PullBootstrap pulls bootstrap layer from cache backend, and unpack to a specified path,
 // we can use it to prepare parent bootstrap for building.
 func (cache *Cache) PullBootstrap(ctx context.Context, bootstrapDesc *ocispec.Descriptor, target string) error {
-	reader, err := cache.remote.Pull(ctx, *bootstrapDesc, true)
+	reader, err := cache.backend.Pull(ctx, *bootstrapDesc, true)
 	if err != nil {
 		return errors.Wrap(err, "Pull cached bootstrap layer")
 	}
@@ -448,7 +860,7 @@ func (cache *Cache) PullBootstrap(ctx context.Context, bootstrapDesc *ocispec.De
 	return nil
 }
 
-// Push pushes cache image to registry
+// Push pushes cache image to cache backend
 func (cache *Cache) Push(ctx context.Context, desc ocispec.Descriptor, reader io.Reader) error {
-	return cache.remote.Push(ctx, desc, true, reader)
+	return cache.backend.Push(ctx, desc, true, reader)
 }
@@ -0,0 +1,147 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+)
+
+const objectIndexKey = "index.json"
+
+// ObjectBackend stores cache image in object storage with the layout of
+// OCI image layout, the index.json object references the cache image and
+// is updated by conditional put, it's useful for the environment with only
+// object storage, e.g. air-gapped environment without scratch registry.
+type ObjectBackend struct {
+	store     backend.ObjectStore
+	reference string
+}
+
+// NewObjectBackend creates a cache backend stores cache image in object
+// storage, reference is the human readable location of cache image.
+func NewObjectBackend(store backend.ObjectStore, reference string) *ObjectBackend {
+	return &ObjectBackend{
+		store:     store,
+		reference: reference,
+	}
+}
+
+func objectBlobKey(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// Reference returns the location of cache image.
+func (b *ObjectBackend) Reference() string {
+	return b.reference
+}
+
+// resolve returns the descriptor referenced by index.json object and the
+// ETag of object.
+func (b *ObjectBackend) resolve(ctx context.Context) (*ocispec.Descriptor, string, error) {
+	reader, etag, err := b.store.GetObject(ctx, objectIndexKey)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Read index of cache image")
+	}
+
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, "", errors.Wrap(err, "Unmarshal index of cache image")
+	}
+	if len(index.Manifests) == 0 {
+		return nil, etag, errors.Wrapf(errdefs.ErrNotFound, "cache image in %s", b.reference)
+	}
+
+	desc := index.Manifests[0]
+	desc.Annotations = nil
+
+	return &desc, etag, nil
+}
+
+// Resolve returns the descriptor referenced by index.json object.
+func (b *ObjectBackend) Resolve(ctx context.Context) (*ocispec.Descriptor, error) {
+	desc, _, err := b.resolve(ctx)
+	return desc, err
+}
+
+// Pull opens the blob object of descriptor.
+func (b *ObjectBackend) Pull(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (io.ReadCloser, error) {
+	reader, _, err := b.store.GetObject(ctx, objectBlobKey(desc.Digest))
+	return reader, err
+}
+
+// Push stores the blob object of descriptor, and updates index.json object
+// to reference the descriptor if byDigest is false.
+func (b *ObjectBackend) Push(ctx context.Context, desc ocispec.Descriptor, byDigest bool, reader io.Reader) error {
+	if err := b.store.PutObject(ctx, objectBlobKey(desc.Digest), reader, desc.Size, desc.Digest, nil); err != nil {
+		return errors.Wrapf(err, "Put blob %s", desc.Digest)
+	}
+	if byDigest {
+		return nil
+	}
+	return b.putIndex(ctx, desc, nil)
+}
+
+func (b *ObjectBackend) putIndex(ctx context.Context, desc ocispec.Descriptor, ifMatch *string) error {
+	desc.Annotations = map[string]string{
+		ocispec.AnnotationRefName: "latest",
+	}
+	index := ocispec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ocispec.Descriptor{desc},
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "Marshal index of cache image")
+	}
+	return b.store.PutObject(
+		ctx, objectIndexKey, bytes.NewReader(data), int64(len(data)), digest.FromBytes(data), ifMatch,
+	)
+}
+
+// PushIfMatch implements ConditionalPusher, the index.json object is put
+// only if its ETag isn't changed since the current cache image is read.
+func (b *ObjectBackend) PushIfMatch(ctx context.Context, desc ocispec.Descriptor, expected digest.Digest, reader io.Reader) error {
+	var current digest.Digest
+	currentDesc, etag, err := b.resolve(ctx)
+	if err == nil {
+		current = currentDesc.Digest
+	} else if !errdefs.IsNotFound(err) {
+		return err
+	}
+	if current != expected {
+		return ErrConflict
+	}
+
+	if err := b.store.PutObject(ctx, objectBlobKey(desc.Digest), reader, desc.Size, desc.Digest, nil); err != nil {
+		return errors.Wrapf(err, "Put blob %s", desc.Digest)
+	}
+	if err := b.putIndex(ctx, desc, &etag); err != nil {
+		if errors.Is(err, backend.ErrPreconditionFailed) {
+			return ErrConflict
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+)
+
+// PruneResult is the result of pruning cache image.
+type PruneResult struct {
+	// Records is the count of records kept in cache image.
+	Records int
+	// Expired is the count of records not recorded within TTL.
+	Expired int
+	// Unreachable is the count of records whose bootstrap or blob layer
+	// isn't found in cache backend or storage backend.
+	Unreachable int
+}
+
+func (result *PruneResult) add(other *PruneResult) {
+	result.Records += other.Records
+	result.Expired += other.Expired
+	result.Unreachable += other.Unreachable
+}
+
+// reachable checks the bootstrap and blob layer of record exist in cache
+// backend or storage backend.
+func (cache *Cache) reachable(ctx context.Context, record *CacheRecord) (bool, error) {
+	if record.NydusBootstrapDesc == nil {
+		return false, nil
+	}
+	descs := []ocispec.Descriptor{*record.NydusBootstrapDesc}
+	if record.NydusBlobDesc != nil {
+		if cache.opt.Backend.Type() == backend.RegistryBackend {
+			descs = append(descs, *record.NydusBlobDesc)
+		} else {
+			exist, err := cache.opt.Backend.Check(record.NydusBlobDesc.Digest.Hex())
+			if err != nil {
+				return false, errors.Wrapf(err, "Check blob %s on backend", record.NydusBlobDesc.Digest)
+			}
+			if !exist {
+				return false, nil
+			}
+		}
+	}
+
+	for _, desc := range descs {
+		reader, err := cache.backend.Pull(ctx, desc, true)
+		if err != nil {
+			logrus.Debugf("Layer %s of cache record %s isn't found: %s", desc.Digest, record.SourceChainID, err)
+			return false, nil
+		}
+		reader.Close()
+	}
+
+	return true, nil
+}
+
+// prune drops the expired and unreachable records of current platform.
+func (cache *Cache) prune(ctx context.Context, dryRun bool) (*PruneResult, error) {
+	for attempt := uint(0); ; attempt++ {
+		if err := cache.Import(ctx); err != nil {
+			return nil, err
+		}
+		if err := cache.importPendingPages(ctx); err != nil {
+			return nil, err
+		}
+
+		result := &PruneResult{Expired: cache.expired}
+		records := []*CacheRecord{}
+		for _, record := range cache.pushedRecords {
+			ok, err := cache.reachable(ctx, record)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				result.Unreachable++
+				continue
+			}
+			// The records exported by old versions start to expire from now
+			if record.Timestamp.IsZero() {
+				record.Timestamp = time.Now()
+			}
+			records = append(records, record)
+		}
+		result.Records = len(records)
+		if dryRun {
+			return result, nil
+		}
+
+		cache.pushedRecords = records
+		err := cache.export(ctx)
+		if err == nil {
+			// The records exceeding MaxRecords are dropped on export
+			result.Records = len(cache.pushedRecords)
+			return result, nil
+		}
+		if !errors.Is(err, ErrConflict) || attempt >= ExportRetries {
+			return nil, err
+		}
+		logrus.Warnf("Cache image %s was updated concurrently, prune again", cache.backend.Reference())
+	}
+}
+
+// Prune rewrites the cache image in backend, drops the records expired
+// by TTL and the records whose layers are gone from the records of all
+// platforms. The records exported by old versions without timestamp are
+// stamped with current time, so they expire after TTL from now on.
+// The records exceeding opt.MaxRecords are dropped as well.
+func Prune(ctx context.Context, cacheBackend CacheBackend, opt Opt, dryRun bool) (*PruneResult, error) {
+	desc, err := cacheBackend.Resolve(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Resolve cache image")
+	}
+
+	// The cache image in schema v1 only has the records of one platform,
+	// they are treated as the records of the specified platform
+	platforms := []*ocispec.Platform{opt.Platform}
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index CacheIndex
+		cache, err := New(cacheBackend, opt)
+		if err != nil {
+			return nil, err
+		}
+		if err := cache.pull(ctx, desc, &index); err != nil {
+			return nil, errors.Wrap(err, "Unmarshal cache index")
+		}
+		platforms = []*ocispec.Platform{}
+		for idx := range index.Manifests {
+			platform := index.Manifests[idx].Platform
+			if platform == nil || pageIndex(&index.Manifests[idx]) != 0 {
+				continue
+			}
+			platforms = append(platforms, platform)
+		}
+	}
+
+	result := &PruneResult{}
+	for _, platform := range platforms {
+		platformOpt := opt
+		platformOpt.Platform = platform
+		cache, err := New(cacheBackend, platformOpt)
+		if err != nil {
+			return nil, err
+		}
+		platformResult, err := cache.prune(ctx, dryRun)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Prune records of platform %s/%s", cache.opt.Platform.OS, cache.opt.Platform.Architecture)
+		}
+		logrus.Infof(
+			"Pruned records of platform %s/%s: kept %d, expired %d, unreachable %d",
+			cache.opt.Platform.OS, cache.opt.Platform.Architecture,
+			platformResult.Records, platformResult.Expired, platformResult.Unreachable,
+		)
+		result.add(platformResult)
+	}
+
+	return result, nil
+}
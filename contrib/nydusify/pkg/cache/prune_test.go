@@ -0,0 +1,103 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+)
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "nydusify-cache-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheBackend, err := NewLocalBackend(dir)
+	require.Nil(t, err)
+
+	newCache := func(ttl time.Duration) *Cache {
+		cache, err := New(cacheBackend, Opt{
+			MaxRecords: 10,
+			Version:    "v1",
+			Backend:    &backend.Registry{},
+			TTL:        ttl,
+		})
+		require.Nil(t, err)
+		cache.Import(ctx)
+		return cache
+	}
+
+	// Record 1 is fresh, record 2 is expired, the layers of record 3 are
+	// gone, record 4 is exported by old version without timestamp
+	now := time.Now().Truncate(time.Second)
+	records := []*CacheRecord{makeRecord(1, true), makeRecord(2, true), makeRecord(3, true), makeRecord(4, false)}
+	records[0].Timestamp = now
+	records[1].Timestamp = now.Add(-48 * time.Hour)
+	records[2].Timestamp = now
+	cache := newCache(0)
+	for _, record := range records {
+		if record.SourceChainID == digest.FromString("chain-3") {
+			continue
+		}
+		data := []byte("bootstrap-" + record.NydusBootstrapDesc.Digest.Hex())
+		record.NydusBootstrapDesc.Digest = digest.FromBytes(data)
+		record.NydusBootstrapDesc.Size = int64(len(data))
+		require.Nil(t, cache.Push(ctx, *record.NydusBootstrapDesc, bytes.NewReader(data)))
+		if record.NydusBlobDesc != nil {
+			data := []byte("blob-" + record.NydusBlobDesc.Digest.Hex())
+			record.NydusBlobDesc.Digest = digest.FromBytes(data)
+			record.NydusBlobDesc.Size = int64(len(data))
+			require.Nil(t, cache.Push(ctx, *record.NydusBlobDesc, bytes.NewReader(data)))
+		}
+	}
+	cache.Record(records)
+	require.Nil(t, cache.Export(ctx))
+
+	// The timestamp is kept in cache image
+	cache = newCache(0)
+	assert.Equal(t, 4, len(cache.pushedRecords))
+	assert.True(t, cache.pulledRecords[digest.FromString("chain-1")].Timestamp.Equal(now))
+	assert.True(t, cache.pulledRecords[digest.FromString("chain-4")].Timestamp.IsZero())
+
+	// The expired record is ignored on import
+	cache = newCache(24 * time.Hour)
+	assert.Equal(t, 3, len(cache.pushedRecords))
+	assert.Equal(t, 1, cache.expired)
+	_, ok := cache.pulledRecords[digest.FromString("chain-2")]
+	assert.False(t, ok)
+
+	opt := Opt{MaxRecords: 10, Version: "v1", Backend: &backend.Registry{}, TTL: 24 * time.Hour}
+	result, err := Prune(ctx, cacheBackend, opt, true)
+	require.Nil(t, err)
+	assert.Equal(t, &PruneResult{Records: 2, Expired: 1, Unreachable: 1}, result)
+	assert.Equal(t, 4, len(newCache(0).pushedRecords))
+
+	result, err = Prune(ctx, cacheBackend, opt, false)
+	require.Nil(t, err)
+	assert.Equal(t, &PruneResult{Records: 2, Expired: 1, Unreachable: 1}, result)
+	cache = newCache(0)
+	require.Equal(t, 2, len(cache.pushedRecords))
+	assert.Equal(t, digest.FromString("chain-1"), cache.pushedRecords[0].SourceChainID)
+	assert.Equal(t, digest.FromString("chain-4"), cache.pushedRecords[1].SourceChainID)
+	// The record of old version starts to expire from now
+	assert.False(t, cache.pushedRecords[1].Timestamp.IsZero())
+
+	// Version mismatch isn't pruned
+	opt.Version = "v2"
+	_, err = Prune(ctx, cacheBackend, opt, false)
+	assert.Contains(t, err.Error(), "unmatched cache image version")
+}
@@ -5,10 +5,29 @@
 package cache
 
 import (
+	"time"
+
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// SchemaVersion is the version of cache image format:
+// v1: records are stored in the layers of an image manifest;
+// v2: records are stored in the per-platform image manifests of an
+// image index, the records of v1 will be migrated on next export.
+const SchemaVersion = "v2"
+
+// DefaultMaxManifestSize is the default size limit of cache manifest, the
+// records of a platform exceeding it are split into multiple manifests
+// (pages) in cache image index, 4MiB is the manifest size limit of docker
+// distribution.
+const DefaultMaxManifestSize = 4 << 20
+
+type CacheIndex struct {
+	MediaType string `json:"mediaType,omitempty"`
+	ocispec.Index
+}
+
 type CacheManifest struct {
 	MediaType string `json:"mediaType,omitempty"`
 	ocispec.Manifest
@@ -19,4 +38,7 @@ type CacheRecord struct {
 	NydusBlobDesc        *ocispec.Descriptor
 	NydusBootstrapDesc   *ocispec.Descriptor
 	NydusBootstrapDiffID digest.Digest
+	// Timestamp is the time when the record was last recorded, it's zero
+	// for the records exported by old versions, which never expire.
+	Timestamp time.Time
 }
@@ -6,6 +6,7 @@ package checker
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 
@@ -16,8 +17,31 @@ import (
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker/tool"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/signer"
 )
 
+// ErrNotNydusImage is returned by the fast check if the target image isn't
+// a Nydus image, so that the callers validating arbitrary images, e.g. an
+// admission webhook, can skip it.
+var ErrNotNydusImage = errors.New("not a nydus image")
+
+// RuleError is returned if the image fails to validate a rule, the other
+// errors of check are the failures to read the image, e.g. the registry is
+// unreachable or the credential is rejected.
+type RuleError struct {
+	Rule string
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("validate rule %s: %s", e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
 // Opt defines Checker options.
 // Note: target is the Nydus image reference.
 type Opt struct {
@@ -26,11 +50,31 @@ type Opt struct {
 	Target         string
 	SourceInsecure bool
 	TargetInsecure bool
+	// TargetAuth is the base64 encoded `username:password` of target
+	// registry, the default credential is used if it's empty.
+	TargetAuth     string
 	MultiPlatform  bool
 	NydusImagePath string
 	NydusdPath     string
-	BackendType    string
-	BackendConfig  string
+	// NydusImagePaths and NydusdPaths are the binaries to validate the
+	// image against each, NydusImagePath and NydusdPath are used if
+	// they're empty, a compatibility report is produced if more than one
+	// binary is specified.
+	NydusImagePaths []string
+	NydusdPaths     []string
+	BackendType     string
+	BackendConfig   string
+	// HashSampleSize is the size of sampled blocks when comparing file
+	// data, the whole file is compared if it's 0.
+	HashSampleSize int64
+	// Signer verifies the signature of Nydus manifest if it's specified.
+	Signer *signer.Signer
+	// Fast only checks the structure of manifest and annotations, and the
+	// existence of referenced blobs, without nydus-image and nydusd.
+	Fast bool
+	// HTTPCacheDir caches the manifest and config responses from registry
+	// in the directory if it's specified.
+	HTTPCacheDir string
 }
 
 // Checker validates Nydus image manifest, bootstrap and mounts filesystem
@@ -44,7 +88,13 @@ type Checker struct {
 // New creates Checker instance, target is the Nydus image reference.
 func New(opt Opt) (*Checker, error) {
 	// TODO: support source and target resolver
-	targetRemote, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure)
+	var targetRemote *remote.Remote
+	var err error
+	if opt.TargetAuth != "" {
+		targetRemote, err = provider.DefaultRemoteWithAuth(opt.Target, opt.TargetInsecure, opt.TargetAuth, provider.WithHTTPCache(opt.HTTPCacheDir))
+	} else {
+		targetRemote, err = provider.DefaultRemote(opt.Target, opt.TargetInsecure, provider.WithHTTPCache(opt.HTTPCacheDir))
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "Init target image parser")
 	}
@@ -52,7 +102,7 @@ func New(opt Opt) (*Checker, error) {
 
 	var sourceParser *parser.Parser
 	if opt.Source != "" {
-		sourceRemote, err := provider.DefaultRemote(opt.Source, opt.SourceInsecure)
+		sourceRemote, err := provider.DefaultRemote(opt.Source, opt.SourceInsecure, provider.WithHTTPCache(opt.HTTPCacheDir))
 		if err != nil {
 			return nil, errors.Wrap(err, "Init source image parser")
 		}
@@ -86,6 +136,10 @@ func (checker *Checker) Check(ctx context.Context) error {
 		sourceParsed = targetParsed
 	}
 
+	if checker.Fast {
+		return checker.checkFast(targetParsed, sourceParsed)
+	}
+
 	if err := os.RemoveAll(checker.WorkDir); err != nil {
 		return errors.Wrap(err, "clean up work directory")
 	}
@@ -105,31 +159,33 @@ func (checker *Checker) Check(ctx context.Context) error {
 			MultiPlatform: checker.MultiPlatform,
 			BackendType:   checker.BackendType,
 		},
-		&rule.BootstrapRule{
-			Parsed:          targetParsed,
-			NydusImagePath:  checker.NydusImagePath,
-			BootstrapPath:   filepath.Join(checker.WorkDir, "nydus_bootstrap"),
-			DebugOutputPath: filepath.Join(checker.WorkDir, "nydus_bootstrap_debug.json"),
-		},
-		&rule.FilesystemRule{
-			Source:          checker.Source,
-			SourceMountPath: filepath.Join(checker.WorkDir, "fs/source_mounted"),
-			NydusdConfig: tool.NydusdConfig{
-				NydusdPath:    checker.NydusdPath,
-				BackendType:   checker.BackendType,
-				BackendConfig: checker.BackendConfig,
-				BootstrapPath: filepath.Join(checker.WorkDir, "nydus_bootstrap"),
-				ConfigPath:    filepath.Join(checker.WorkDir, "fs/nydusd_config.json"),
-				BlobCacheDir:  filepath.Join(checker.WorkDir, "fs/nydus_blobs"),
-				MountPath:     filepath.Join(checker.WorkDir, "fs/nydus_mounted"),
-				APISockPath:   filepath.Join(checker.WorkDir, "fs/nydus_api.sock"),
-			},
+		&rule.SignatureRule{
+			Parsed: targetParsed,
+			Remote: checker.targetParser.Remote,
+			Signer: checker.Signer,
 		},
 	}
 
+	nydusImagePaths := checker.nydusImagePaths()
+	nydusdPaths := checker.nydusdPaths()
+	if len(nydusImagePaths) > 1 || len(nydusdPaths) > 1 {
+		for _, rule := range rules {
+			if err := rule.Validate(); err != nil {
+				return &RuleError{Rule: rule.Name(), Err: err}
+			}
+		}
+		return checker.checkCompatibility(targetParsed, nydusImagePaths, nydusdPaths)
+	}
+
+	rules = append(
+		rules,
+		checker.bootstrapRule(targetParsed, nydusImagePaths[0], ""),
+		checker.filesystemRule(nydusdPaths[0], ""),
+	)
+
 	for _, rule := range rules {
 		if err := rule.Validate(); err != nil {
-			return errors.Wrapf(err, "validate rule %s", rule.Name())
+			return &RuleError{Rule: rule.Name(), Err: err}
 		}
 	}
 
@@ -137,3 +193,90 @@ func (checker *Checker) Check(ctx context.Context) error {
 
 	return nil
 }
+
+// checkFast validates the structure of Nydus image in seconds, nothing is
+// written to work directory. The blobs are regarded as stored in registry
+// if no backend is specified.
+func (checker *Checker) checkFast(targetParsed, sourceParsed *parser.Parsed) error {
+	if targetParsed.NydusImage == nil {
+		return ErrNotNydusImage
+	}
+	backendType := checker.BackendType
+	if backendType == "" {
+		backendType = "registry"
+	}
+	rules := []rule.Rule{
+		&rule.ManifestRule{
+			SourceParsed:  sourceParsed,
+			TargetParsed:  targetParsed,
+			MultiPlatform: checker.MultiPlatform,
+			BackendType:   backendType,
+		},
+		&rule.StructureRule{
+			Parsed:     targetParsed,
+			Remote:     checker.targetParser.Remote,
+			CheckBlobs: backendType == "registry",
+		},
+		&rule.SignatureRule{
+			Parsed: targetParsed,
+			Remote: checker.targetParser.Remote,
+			Signer: checker.Signer,
+		},
+	}
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return &RuleError{Rule: rule.Name(), Err: err}
+		}
+	}
+
+	logrus.Infof("Verified structure of Nydus image %s", checker.targetParser.Remote.Ref)
+
+	return nil
+}
+
+func (checker *Checker) nydusImagePaths() []string {
+	if len(checker.NydusImagePaths) > 0 {
+		return checker.NydusImagePaths
+	}
+	return []string{checker.NydusImagePath}
+}
+
+func (checker *Checker) nydusdPaths() []string {
+	if len(checker.NydusdPaths) > 0 {
+		return checker.NydusdPaths
+	}
+	return []string{checker.NydusdPath}
+}
+
+// bootstrapRule creates the bootstrap rule validated by nydus-image binary,
+// the output file names have the suffix to distinguish the binaries.
+func (checker *Checker) bootstrapRule(targetParsed *parser.Parsed, nydusImagePath, suffix string) rule.Rule {
+	return &rule.BootstrapRule{
+		Parsed:          targetParsed,
+		NydusImagePath:  nydusImagePath,
+		BootstrapPath:   filepath.Join(checker.WorkDir, "nydus_bootstrap"),
+		DebugOutputPath: filepath.Join(checker.WorkDir, fmt.Sprintf("nydus_bootstrap_debug%s.json", suffix)),
+	}
+}
+
+// filesystemRule creates the filesystem rule validated by nydusd binary,
+// the working files have the suffix to distinguish the binaries.
+func (checker *Checker) filesystemRule(nydusdPath, suffix string) rule.Rule {
+	fsDir := filepath.Join(checker.WorkDir, "fs"+suffix)
+	return &rule.FilesystemRule{
+		Source:          checker.Source,
+		SourceMountPath: filepath.Join(fsDir, "source_mounted"),
+		HashSampleSize:  checker.HashSampleSize,
+		DiffOutputPath:  filepath.Join(checker.WorkDir, fmt.Sprintf("filesystem_diff%s.json", suffix)),
+		NydusdConfig: tool.NydusdConfig{
+			NydusdPath:    nydusdPath,
+			BackendType:   checker.BackendType,
+			BackendConfig: checker.BackendConfig,
+			BootstrapPath: filepath.Join(checker.WorkDir, "nydus_bootstrap"),
+			ConfigPath:    filepath.Join(fsDir, "nydusd_config.json"),
+			BlobCacheDir:  filepath.Join(fsDir, "nydus_blobs"),
+			MountPath:     filepath.Join(fsDir, "nydus_mounted"),
+			APISockPath:   filepath.Join(fsDir, "nydus_api.sock"),
+		},
+	}
+}
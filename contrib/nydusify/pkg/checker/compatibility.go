@@ -0,0 +1,133 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package checker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker/rule"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+)
+
+const (
+	toolNydusImage = "nydus-image"
+	toolNydusd     = "nydusd"
+)
+
+// CompatibilityResult is the result of validating the image by a binary.
+type CompatibilityResult struct {
+	// Tool is the kind of binary, nydus-image or nydusd.
+	Tool    string `json:"tool"`
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Rule    string `json:"rule"`
+	Passed  bool   `json:"passed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// CompatibilityReport is the result of validating the image against the
+// nydus-image and nydusd binaries.
+type CompatibilityReport struct {
+	Target  string                `json:"target"`
+	Results []CompatibilityResult `json:"results"`
+}
+
+// binaryVersion returns the first line of `<binary> --version` output.
+func binaryVersion(path string) string {
+	output, err := exec.Command(path, "--version").CombinedOutput()
+	if err != nil {
+		return "unknown"
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return "unknown"
+}
+
+// Failures returns the count of failed validations.
+func (report *CompatibilityReport) Failures() int {
+	failures := 0
+	for _, result := range report.Results {
+		if !result.Passed {
+			failures++
+		}
+	}
+	return failures
+}
+
+// Print prints the report as table.
+func (report *CompatibilityReport) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOOL\tPATH\tVERSION\tRULE\tRESULT")
+	for _, result := range report.Results {
+		status := "passed"
+		if !result.Passed {
+			status = "failed: " + result.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Tool, result.Path, result.Version, result.Rule, status)
+	}
+	return tw.Flush()
+}
+
+// checkCompatibility validates the bootstrap by each nydus-image binary and
+// the filesystem by each nydusd binary, all binaries are validated even if
+// some of them fail, the report is dumped to work directory.
+func (checker *Checker) checkCompatibility(targetParsed *parser.Parsed, nydusImagePaths, nydusdPaths []string) error {
+	report := CompatibilityReport{
+		Target:  checker.targetParser.Remote.Ref,
+		Results: []CompatibilityResult{},
+	}
+
+	validate := func(tool, path string, rule rule.Rule) {
+		logrus.Infof("Validating rule %s by %s %s", rule.Name(), tool, path)
+		result := CompatibilityResult{
+			Tool:    tool,
+			Path:    path,
+			Version: binaryVersion(path),
+			Rule:    rule.Name(),
+			Passed:  true,
+		}
+		if err := rule.Validate(); err != nil {
+			logrus.Warnf("Failed to validate rule %s by %s %s: %s", rule.Name(), tool, path, err)
+			result.Passed = false
+			result.Error = err.Error()
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	for idx, path := range nydusImagePaths {
+		validate(toolNydusImage, path, checker.bootstrapRule(targetParsed, path, fmt.Sprintf("_%d", idx)))
+	}
+	for idx, path := range nydusdPaths {
+		validate(toolNydusd, path, checker.filesystemRule(path, fmt.Sprintf("_%d", idx)))
+	}
+
+	reportPath := filepath.Join(checker.WorkDir, "compatibility_report.json")
+	if err := prettyDump(report, reportPath); err != nil {
+		return errors.Wrap(err, "output compatibility report")
+	}
+	logrus.Infof("Dumped compatibility report to %s", reportPath)
+
+	if err := report.Print(os.Stdout); err != nil {
+		return errors.Wrap(err, "print compatibility report")
+	}
+
+	if failures := report.Failures(); failures > 0 {
+		return fmt.Errorf("%d of %d validations failed", failures, len(report.Results))
+	}
+
+	return nil
+}
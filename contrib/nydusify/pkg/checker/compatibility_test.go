@@ -0,0 +1,44 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package checker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompatibilityReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-checker-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	nydusd := filepath.Join(dir, "nydusd")
+	script := "#!/bin/sh\necho\necho 'Version: v1.1.0'\necho 'Git Commit: 1234'\n"
+	require.Nil(t, ioutil.WriteFile(nydusd, []byte(script), 0755))
+	assert.Equal(t, "Version: v1.1.0", binaryVersion(nydusd))
+	assert.Equal(t, "unknown", binaryVersion(filepath.Join(dir, "not-found")))
+
+	report := CompatibilityReport{
+		Target: "localhost:5000/nginx:nydus",
+		Results: []CompatibilityResult{
+			{Tool: toolNydusImage, Path: "/v1/nydus-image", Version: "v1", Rule: "Bootstrap", Passed: true},
+			{Tool: toolNydusd, Path: "/v2/nydusd", Version: "v2", Rule: "Filesystem", Error: "found 1 differences"},
+		},
+	}
+	assert.Equal(t, 1, report.Failures())
+
+	var buf bytes.Buffer
+	require.Nil(t, report.Print(&buf))
+	assert.Equal(t, `TOOL         PATH             VERSION  RULE        RESULT
+nydus-image  /v1/nydus-image  v1       Bootstrap   passed
+nydusd       /v2/nydusd       v2       Filesystem  failed: found 1 differences
+`, buf.String())
+}
@@ -5,12 +5,17 @@
 package rule
 
 import (
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"syscall"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker/tool"
 
@@ -27,6 +32,13 @@ type FilesystemRule struct {
 	NydusdConfig    tool.NydusdConfig
 	Source          string
 	SourceMountPath string
+	// HashSampleSize is the size of each sampled block when hashing file
+	// data, only the head, middle and tail blocks of the file are hashed,
+	// the whole file is hashed if it's 0.
+	HashSampleSize int64
+	// DiffOutputPath is the path of the machine-readable diff report
+	// between source and Nydus image, skip the output if it's empty.
+	DiffOutputPath string
 }
 
 // Node records file metadata and file data hash.
@@ -34,22 +46,88 @@ type Node struct {
 	Path   string
 	Size   int64
 	Mode   os.FileMode
+	UID    uint32
+	GID    uint32
+	Link   string
 	Xattrs map[string][]byte
 	Hash   []byte
 }
 
+type jsonNode struct {
+	Path   string            `json:"path"`
+	Size   int64             `json:"size"`
+	Mode   string            `json:"mode"`
+	UID    uint32            `json:"uid"`
+	GID    uint32            `json:"gid"`
+	Link   string            `json:"link,omitempty"`
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	Hash   string            `json:"hash,omitempty"`
+}
+
 func (node *Node) String() string {
 	return fmt.Sprintf(
-		"Path: %s, Size: %d, Mode: %d, Xattrs: %v, Hash: %s",
-		node.Path, node.Size, node.Mode, node.Xattrs, hex.EncodeToString(node.Hash),
+		"Path: %s, Size: %d, Mode: %d, UID: %d, GID: %d, Link: %s, Xattrs: %v, Hash: %s",
+		node.Path, node.Size, node.Mode, node.UID, node.GID, node.Link, node.Xattrs, hex.EncodeToString(node.Hash),
 	)
 }
 
+// MarshalJSON outputs xattrs and hash of node in readable format.
+func (node Node) MarshalJSON() ([]byte, error) {
+	xattrs := map[string]string{}
+	for name, value := range node.Xattrs {
+		xattrs[name] = string(value)
+	}
+	return json.Marshal(jsonNode{
+		Path:   node.Path,
+		Size:   node.Size,
+		Mode:   node.Mode.String(),
+		UID:    node.UID,
+		GID:    node.GID,
+		Link:   node.Link,
+		Xattrs: xattrs,
+		Hash:   hex.EncodeToString(node.Hash),
+	})
+}
+
+// DiffType is the kind of difference of a file between source
+// and Nydus image.
+type DiffType string
+
+const (
+	// DiffMissingInNydus means the file only exists in source image.
+	DiffMissingInNydus DiffType = "missing_in_nydus"
+	// DiffMissingInSource means the file only exists in Nydus image.
+	DiffMissingInSource DiffType = "missing_in_source"
+	// DiffMismatch means the metadata or data of file is different.
+	DiffMismatch DiffType = "mismatch"
+)
+
+// Diff records a difference of file between source and Nydus image.
+type Diff struct {
+	Path string   `json:"path"`
+	Type DiffType `json:"type"`
+	// Fields lists the mismatched fields of file, e.g. size, mode, xattrs.
+	Fields []string `json:"fields,omitempty"`
+	Source *Node    `json:"source,omitempty"`
+	Nydus  *Node    `json:"nydus,omitempty"`
+}
+
+// DiffReport is the machine-readable result of filesystem verification.
+type DiffReport struct {
+	Source      string `json:"source"`
+	SourceFiles int    `json:"source_files"`
+	NydusFiles  int    `json:"nydus_files"`
+	Diffs       []Diff `json:"diffs"`
+}
+
 func (rule *FilesystemRule) Name() string {
 	return "Filesystem"
 }
 
-func hashFile(path string) ([]byte, error) {
+// hashFile calculates the hash of file data, only the head, middle and
+// tail blocks are hashed if sampleSize is specified, it reduces the data
+// read from storage backend by Nydusd for large files.
+func hashFile(path string, sampleSize int64) ([]byte, error) {
 	hasher := blake3.New(32, nil)
 
 	file, err := os.Open(path)
@@ -58,17 +136,21 @@ func hashFile(path string) ([]byte, error) {
 	}
 	defer file.Close()
 
-	buf := make([]byte, 2<<15) // 64KB
-	for {
-		n, err := file.Read(buf)
-		if err == io.EOF || n == 0 {
-			break
-		}
-		if err != nil {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat file before hashing file")
+	}
+
+	if sampleSize <= 0 || info.Size() <= sampleSize*3 {
+		if _, err := io.Copy(hasher, file); err != nil {
 			return nil, errors.Wrap(err, "read file during hashing file")
 		}
-		if _, err := hasher.Write(buf); err != nil {
-			return nil, errors.Wrap(err, "calculate hash of file")
+		return hasher.Sum(nil), nil
+	}
+
+	for _, offset := range []int64{0, (info.Size() - sampleSize) / 2, info.Size() - sampleSize} {
+		if _, err := io.Copy(hasher, io.NewSectionReader(file, offset, sampleSize)); err != nil {
+			return nil, errors.Wrap(err, "read file during hashing file")
 		}
 	}
 
@@ -120,11 +202,24 @@ func (rule *FilesystemRule) walk(rootfs string) (map[string]Node, error) {
 			logrus.Warnf("Failed to get xattr: %s", err)
 		}
 
+		var uid, gid uint32
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = stat.Uid, stat.Gid
+		}
+
+		var link string
+		if mode&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return errors.Wrap(err, "read symlink")
+			}
+		}
+
 		// Calculate file data hash if the `backend-type` option be specified,
 		// this will cause that nydusd read data from backend, it's network load
 		var hash []byte
 		if rule.NydusdConfig.BackendType != "" && info.Mode().IsRegular() {
-			hash, err = hashFile(path)
+			hash, err = hashFile(path, rule.HashSampleSize)
 			if err != nil {
 				return err
 			}
@@ -134,6 +229,9 @@ func (rule *FilesystemRule) walk(rootfs string) (map[string]Node, error) {
 			Path:   rootfsPath,
 			Size:   size,
 			Mode:   mode,
+			UID:    uid,
+			GID:    gid,
+			Link:   link,
 			Xattrs: xattrs,
 			Hash:   hash,
 		}
@@ -147,6 +245,84 @@ func (rule *FilesystemRule) walk(rootfs string) (map[string]Node, error) {
 	return nodes, nil
 }
 
+// mismatchedFields returns the names of different fields between nodes.
+func mismatchedFields(source, nydus *Node) []string {
+	fields := []string{}
+	if source.Size != nydus.Size {
+		fields = append(fields, "size")
+	}
+	if source.Mode != nydus.Mode {
+		fields = append(fields, "mode")
+	}
+	if source.UID != nydus.UID {
+		fields = append(fields, "uid")
+	}
+	if source.GID != nydus.GID {
+		fields = append(fields, "gid")
+	}
+	if source.Link != nydus.Link {
+		fields = append(fields, "link")
+	}
+	if !reflect.DeepEqual(source.Xattrs, nydus.Xattrs) {
+		fields = append(fields, "xattrs")
+	}
+	if !bytes.Equal(source.Hash, nydus.Hash) {
+		fields = append(fields, "hash")
+	}
+	return fields
+}
+
+// diffNodes compares the files of source and Nydus image, the diffs
+// are sorted by path.
+func diffNodes(sourceNodes, nydusNodes map[string]Node) []Diff {
+	diffs := []Diff{}
+
+	for path := range sourceNodes {
+		sourceNode := sourceNodes[path]
+		nydusNode, exist := nydusNodes[path]
+		if !exist {
+			diffs = append(diffs, Diff{
+				Path:   path,
+				Type:   DiffMissingInNydus,
+				Source: &sourceNode,
+			})
+			continue
+		}
+
+		if path == "/" {
+			continue
+		}
+
+		if fields := mismatchedFields(&sourceNode, &nydusNode); len(fields) > 0 {
+			diffs = append(diffs, Diff{
+				Path:   path,
+				Type:   DiffMismatch,
+				Fields: fields,
+				Source: &sourceNode,
+				Nydus:  &nydusNode,
+			})
+		}
+	}
+
+	for path := range nydusNodes {
+		if _, exist := sourceNodes[path]; exist {
+			continue
+		}
+		nydusNode := nydusNodes[path]
+		diffs = append(diffs, Diff{
+			Path:  path,
+			Type:  DiffMissingInSource,
+			Nydus: &nydusNode,
+		})
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+
+	return diffs
+}
+
 func (rule *FilesystemRule) mountSourceImage() (*tool.Image, error) {
 	logrus.Infof("Mounting source image to %s", rule.SourceMountPath)
 
@@ -194,7 +370,6 @@ func (rule *FilesystemRule) mountNydusImage() (*tool.Nydusd, error) {
 func (rule *FilesystemRule) verify() error {
 	logrus.Infof("Verifying filesystem for source and Nydus image")
 
-	validate := true
 	sourceNodes := map[string]Node{}
 
 	// Concurrently walk the rootfs directory of source and Nydus image
@@ -214,28 +389,37 @@ func (rule *FilesystemRule) verify() error {
 		return errors.Wrap(err, "walk rootfs of source image")
 	}
 
-	for path, sourceNode := range sourceNodes {
-		nydusNode, exist := nydusNodes[path]
-		if !exist {
-			logrus.Warnf("File not found in Nydus image: %s", path)
-			validate = false
-			continue
-		}
-		delete(nydusNodes, path)
-
-		if path != "/" && !reflect.DeepEqual(sourceNode, nydusNode) {
-			logrus.Warnf("File not match in Nydus image: %s <=> %s", sourceNode.String(), nydusNode.String())
-			validate = false
+	diffs := diffNodes(sourceNodes, nydusNodes)
+	for _, diff := range diffs {
+		switch diff.Type {
+		case DiffMissingInNydus:
+			logrus.Warnf("File not found in Nydus image: %s", diff.Path)
+		case DiffMissingInSource:
+			logrus.Warnf("File not found in source image: %s", diff.Path)
+		case DiffMismatch:
+			logrus.Warnf("File not match in Nydus image: %s <=> %s", diff.Source.String(), diff.Nydus.String())
 		}
 	}
 
-	for path := range nydusNodes {
-		logrus.Warnf("File not found in source image: %s", path)
-		validate = false
+	if rule.DiffOutputPath != "" {
+		report := DiffReport{
+			Source:      rule.Source,
+			SourceFiles: len(sourceNodes),
+			NydusFiles:  len(nydusNodes),
+			Diffs:       diffs,
+		}
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "marshal filesystem diff")
+		}
+		if err := ioutil.WriteFile(rule.DiffOutputPath, data, 0644); err != nil {
+			return errors.Wrap(err, "output filesystem diff")
+		}
+		logrus.Infof("Dumped filesystem diff to %s", rule.DiffOutputPath)
 	}
 
-	if !validate {
-		return fmt.Errorf("Failed to verify source image and Nydus image")
+	if len(diffs) > 0 {
+		return fmt.Errorf("Failed to verify source image and Nydus image, found %d differences", len(diffs))
 	}
 
 	return nil
@@ -0,0 +1,77 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffNodes(t *testing.T) {
+	sourceNodes := map[string]Node{
+		"/":       {Path: "/", Mode: os.ModeDir | 0755},
+		"/etc":    {Path: "/etc", Mode: os.ModeDir | 0755},
+		"/bin/sh": {Path: "/bin/sh", Size: 10, Mode: 0755, Hash: []byte{1}},
+		"/lib":    {Path: "/lib", Mode: os.ModeDir | 0755},
+	}
+	nydusNodes := map[string]Node{
+		"/":       {Path: "/", Mode: os.ModeDir | 0700},
+		"/etc":    {Path: "/etc", Mode: os.ModeDir | 0755},
+		"/bin/sh": {Path: "/bin/sh", Size: 10, Mode: 0755, UID: 1, Hash: []byte{2}},
+		"/usr":    {Path: "/usr", Mode: os.ModeDir | 0755},
+	}
+
+	diffs := diffNodes(sourceNodes, nydusNodes)
+	require.Len(t, diffs, 3)
+
+	assert.Equal(t, "/bin/sh", diffs[0].Path)
+	assert.Equal(t, DiffMismatch, diffs[0].Type)
+	assert.Equal(t, []string{"uid", "hash"}, diffs[0].Fields)
+	assert.Equal(t, "/lib", diffs[1].Path)
+	assert.Equal(t, DiffMissingInNydus, diffs[1].Type)
+	assert.Nil(t, diffs[1].Nydus)
+	assert.Equal(t, "/usr", diffs[2].Path)
+	assert.Equal(t, DiffMissingInSource, diffs[2].Type)
+	assert.Nil(t, diffs[2].Source)
+
+	data, err := json.Marshal(diffs[0])
+	require.Nil(t, err)
+	assert.Contains(t, string(data), `"hash":"01"`)
+	assert.Contains(t, string(data), `"fields":["uid","hash"]`)
+}
+
+func TestHashFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-checker-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("a"), 1024)
+	path1 := filepath.Join(dir, "file1")
+	require.Nil(t, ioutil.WriteFile(path1, data, 0644))
+
+	// Change the data out of sampled blocks
+	data[100] = 'b'
+	path2 := filepath.Join(dir, "file2")
+	require.Nil(t, ioutil.WriteFile(path2, data, 0644))
+
+	hash1, err := hashFile(path1, 0)
+	require.Nil(t, err)
+	hash2, err := hashFile(path2, 0)
+	require.Nil(t, err)
+	assert.NotEqual(t, hash1, hash2)
+
+	hash1, err = hashFile(path1, 64)
+	require.Nil(t, err)
+	hash2, err = hashFile(path2, 64)
+	require.Nil(t, err)
+	assert.Equal(t, hash1, hash2)
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/encryption"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
@@ -81,6 +82,16 @@ func (rule *ManifestRule) Validate() error {
 				return errors.Wrap(err, "failed to unmarshal blob list in annotation of nydus image manifest")
 			}
 		} else {
+			// The digest of encrypted blob layer is the digest of encrypted
+			// data, the blob id is recorded in annotation instead.
+			if layer.MediaType == utils.MediaTypeNydusBlob+encryption.MediaTypeSuffix {
+				blobID := layer.Annotations[utils.LayerAnnotationNydusBlobID]
+				if blobID == "" || layer.Annotations[encryption.AnnotationKeysJWE] == "" {
+					return errors.New("invalid encrypted blob layer in nydus image manifest")
+				}
+				blobListInLayer = append(blobListInLayer, blobID)
+				continue
+			}
 			if layer.MediaType != utils.MediaTypeNydusBlob ||
 				layer.Annotations[utils.LayerAnnotationNydusBlob] != "true" {
 				return errors.New("invalid blob layer in nydus image manifest")
@@ -0,0 +1,47 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package rule
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/signer"
+)
+
+// SignatureRule verifies the signature of Nydus manifest
+type SignatureRule struct {
+	Parsed *parser.Parsed
+	Remote *remote.Remote
+	Signer *signer.Signer
+}
+
+func (rule *SignatureRule) Name() string {
+	return "Signature"
+}
+
+func (rule *SignatureRule) Validate() error {
+	// Skip signature verification if no signing tool be specified
+	if rule.Signer == nil {
+		return nil
+	}
+
+	logrus.Infof("Checking Nydus manifest signature")
+
+	if rule.Parsed.NydusImage == nil {
+		return errors.New("invalid nydus image manifest")
+	}
+
+	ref := rule.Remote.DigestReference(rule.Parsed.NydusImage.Desc.Digest)
+	if err := rule.Signer.Verify(context.Background(), ref); err != nil {
+		return errors.Wrapf(err, "verify signature of %s", ref)
+	}
+
+	return nil
+}
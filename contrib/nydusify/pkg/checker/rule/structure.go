@@ -0,0 +1,133 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package rule
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const defaultBlobCheckConcurrency = 10
+
+// StructureRule validates the structure of Nydus image without nydus-image
+// and nydusd, i.e. the media types, the annotations of bootstrap layer and
+// the existence of blobs referenced by manifest, so that it completes in
+// seconds, e.g. as the backend of a registry admission webhook.
+type StructureRule struct {
+	Parsed *parser.Parsed
+	Remote *remote.Remote
+	// CheckBlobs checks if the config and layers exist in registry by HEAD
+	// requests, it should be disabled if blobs are stored in other backends.
+	CheckBlobs  bool
+	Concurrency int
+}
+
+func (rule *StructureRule) Name() string {
+	return "Structure"
+}
+
+func (rule *StructureRule) Validate() error {
+	logrus.Infof("Checking Nydus image structure")
+
+	image := rule.Parsed.NydusImage
+	if image == nil {
+		return errors.New("invalid nydus image manifest")
+	}
+
+	if image.Desc.MediaType != ocispec.MediaTypeImageManifest &&
+		image.Desc.MediaType != images.MediaTypeDockerSchema2Manifest {
+		return fmt.Errorf("invalid media type %s of nydus image manifest", image.Desc.MediaType)
+	}
+	if image.Manifest.Config.MediaType != ocispec.MediaTypeImageConfig &&
+		image.Manifest.Config.MediaType != images.MediaTypeDockerSchema2Config {
+		return fmt.Errorf("invalid media type %s of nydus image config", image.Manifest.Config.MediaType)
+	}
+
+	layers := image.Manifest.Layers
+	if len(layers) == 0 {
+		return errors.New("no layer in nydus image manifest")
+	}
+	if len(image.Config.RootFS.DiffIDs) != len(layers) {
+		return fmt.Errorf(
+			"unmatched number of diff ids in config and layers: %d != %d",
+			len(image.Config.RootFS.DiffIDs), len(layers),
+		)
+	}
+
+	bootstrap := layers[len(layers)-1]
+	switch bootstrap.MediaType {
+	case ocispec.MediaTypeImageLayerGzip, images.MediaTypeDockerSchema2LayerGzip, utils.MediaTypeImageLayerZstd:
+	default:
+		return fmt.Errorf("invalid media type %s of bootstrap layer", bootstrap.MediaType)
+	}
+	if fsVersion, ok := bootstrap.Annotations[utils.LayerAnnotationNydusFsVersion]; ok && fsVersion != "5" && fsVersion != "6" {
+		return fmt.Errorf("invalid fs version %s in annotation of bootstrap layer", fsVersion)
+	}
+	for _, layer := range layers[:len(layers)-1] {
+		if layer.Annotations[utils.LayerAnnotationNydusBootstrap] == "true" {
+			return fmt.Errorf("unexpected bootstrap layer %s before the topmost layer", layer.Digest)
+		}
+	}
+
+	if !rule.CheckBlobs {
+		return nil
+	}
+	missing, err := rule.missingBlobs(append([]ocispec.Descriptor{image.Manifest.Config}, layers...))
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("blobs referenced by nydus image manifest not found in registry: %v", missing)
+	}
+
+	return nil
+}
+
+// missingBlobs returns the digests of blobs not found in registry.
+func (rule *StructureRule) missingBlobs(descs []ocispec.Descriptor) ([]string, error) {
+	concurrency := rule.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultBlobCheckConcurrency
+	}
+
+	var mu sync.Mutex
+	missing := []string{}
+	eg, ctx := errgroup.WithContext(context.Background())
+	sem := make(chan struct{}, concurrency)
+	for idx := range descs {
+		desc := descs[idx]
+		sem <- struct{}{}
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			exists, err := rule.Remote.BlobExists(ctx, desc)
+			if err != nil {
+				return errors.Wrapf(err, "check blob %s", desc.Digest)
+			}
+			if !exists {
+				mu.Lock()
+				missing = append(missing, desc.Digest.String())
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package rule
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestStructureRule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-structure-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	layout, err := remote.NewLayout(dir, "latest")
+	require.Nil(t, err)
+	push := func(mediaType string, data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		}
+		require.Nil(t, layout.Push(context.Background(), desc, true, bytes.NewReader(data)))
+		return desc
+	}
+
+	blob := push(utils.MediaTypeNydusBlob, []byte("blob"))
+	blob.Annotations = map[string]string{utils.LayerAnnotationNydusBlob: "true"}
+	bootstrap := push(ocispec.MediaTypeImageLayerGzip, []byte("bootstrap"))
+	bootstrap.Annotations = map[string]string{
+		utils.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationNydusFsVersion: "6",
+	}
+	config := push(ocispec.MediaTypeImageConfig, []byte("{}"))
+
+	parsed := &parser.Parsed{
+		NydusImage: &parser.Image{
+			Desc: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest},
+			Manifest: ocispec.Manifest{
+				Config: config,
+				Layers: []ocispec.Descriptor{blob, bootstrap},
+			},
+			Config: ocispec.Image{
+				RootFS: ocispec.RootFS{DiffIDs: []digest.Digest{blob.Digest, bootstrap.Digest}},
+			},
+		},
+	}
+	rule := &StructureRule{Parsed: parsed, Remote: layout, CheckBlobs: true}
+	require.Nil(t, rule.Validate())
+
+	// The blob referenced by manifest is missing
+	missing := ocispec.Descriptor{MediaType: utils.MediaTypeNydusBlob, Digest: digest.FromString("missing")}
+	parsed.NydusImage.Manifest.Layers = []ocispec.Descriptor{missing, blob, bootstrap}
+	parsed.NydusImage.Config.RootFS.DiffIDs = append(parsed.NydusImage.Config.RootFS.DiffIDs, missing.Digest)
+	err = rule.Validate()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), missing.Digest.String())
+	rule.CheckBlobs = false
+	require.Nil(t, rule.Validate())
+
+	// The diff ids don't match layers
+	parsed.NydusImage.Config.RootFS.DiffIDs = parsed.NydusImage.Config.RootFS.DiffIDs[:2]
+	assert.NotNil(t, rule.Validate())
+	parsed.NydusImage.Config.RootFS.DiffIDs = append(parsed.NydusImage.Config.RootFS.DiffIDs, missing.Digest)
+
+	// Invalid annotation of bootstrap layer
+	bootstrap.Annotations[utils.LayerAnnotationNydusFsVersion] = "7"
+	assert.NotNil(t, rule.Validate())
+	bootstrap.Annotations[utils.LayerAnnotationNydusFsVersion] = "5"
+	require.Nil(t, rule.Validate())
+
+	// Invalid media type of bootstrap layer
+	parsed.NydusImage.Manifest.Layers[2].MediaType = utils.MediaTypeNydusBlob
+	assert.NotNil(t, rule.Validate())
+}
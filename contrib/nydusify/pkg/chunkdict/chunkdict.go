@@ -0,0 +1,310 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package chunkdict generates the chunk dictionary from a set of base
+// images, the dictionary is pushed as a Nydus image whose blob contains
+// the chunks of all files in base images, so that the images converted
+// with it reference these chunks instead of dumping them again.
+package chunkdict
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// LabelChunkDict labels the image config of chunk dictionary image.
+const LabelChunkDict = "containerd.io/snapshot/nydus-chunk-dict"
+
+// Opt defines chunk dictionary generator options.
+type Opt struct {
+	Logger provider.ProgressLogger
+
+	WorkDir string
+	// Sources are the base images, in the same forms as the source
+	// of conversion, e.g. docker-daemon://<image> for local image.
+	Sources           []string
+	Target            string
+	SourceInsecure    bool
+	TargetInsecure    bool
+	ContainerdAddress string
+
+	NydusImagePath string
+	Compressor     string
+	DockerV2Format bool
+
+	// The storage backend of chunk dictionary blob, it should be the
+	// same with the images converted with the dictionary.
+	BackendType   string
+	BackendConfig string
+}
+
+// Generator generates chunk dictionary image from base images.
+type Generator struct {
+	Opt
+	target *remote.Remote
+}
+
+// New creates Generator instance.
+func New(opt Opt) (*Generator, error) {
+	if len(opt.Sources) == 0 {
+		return nil, errors.New("No source image specified")
+	}
+	target, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse target reference")
+	}
+
+	return &Generator{
+		Opt:    opt,
+		target: target,
+	}, nil
+}
+
+// sourceProvider returns the provider of source image, the layers are
+// unpacked to dir.
+func (gen *Generator) sourceProvider(ctx context.Context, source, dir string) (provider.SourceProvider, error) {
+	var sourceProviders []provider.SourceProvider
+	var err error
+	if provider.IsLocalSource(source) {
+		sourceProviders, err = provider.LocalSource(ctx, source, dir, gen.ContainerdAddress)
+	} else {
+		var sourceRemote *remote.Remote
+		sourceRemote, err = provider.DefaultRemote(source, gen.SourceInsecure)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parse source reference")
+		}
+		sourceProviders, err = provider.DefaultSource(ctx, sourceRemote, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, sp := range sourceProviders {
+		config, err := sp.Config(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "Get source image config")
+		}
+		if utils.IsSupportedPlatform(config.OS, config.Architecture) {
+			return sp, nil
+		}
+	}
+	return nil, fmt.Errorf("Not found supported platform in source image")
+}
+
+// Generate stages the regular files in all layers of base images into a
+// directory, each layer in its own sub-directory, then converts it to a
+// single layer Nydus image as the chunk dictionary image.
+func (gen *Generator) Generate(ctx context.Context) error {
+	sourceDir := filepath.Join(gen.WorkDir, "source")
+	dictDir := filepath.Join(gen.WorkDir, "chunkdict")
+	for _, dir := range []string{sourceDir, dictDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Wrap(err, "Remove work directory")
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrap(err, "Create work directory")
+		}
+	}
+	defer os.RemoveAll(dictDir)
+
+	dict := &dictSource{dir: dictDir}
+	chainIDs := []string{}
+	staged := map[digest.Digest]bool{}
+	for idx, source := range gen.Sources {
+		sp, err := gen.sourceProvider(ctx, source, sourceDir)
+		if err != nil {
+			return errors.Wrapf(err, "Parse source image %s", source)
+		}
+		layers, err := sp.Layers(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "Get layers of source image %s", source)
+		}
+		for layerIdx, layer := range layers {
+			// The layers shared by base images are staged only once
+			if staged[layer.ChainID()] {
+				continue
+			}
+			staged[layer.ChainID()] = true
+			stageDone := gen.Logger.Log(ctx, "[DICT] Stage layer", provider.LoggerFields{
+				"Source": source,
+				"Digest": layer.Digest(),
+			})
+			dir := filepath.Join(dictDir, fmt.Sprintf("%d-%d", idx, layerIdx))
+			size, err := stageLayer(ctx, layer, dir)
+			if err != nil {
+				return stageDone(errors.Wrapf(err, "Stage layer %s", layer.Digest()))
+			}
+			stageDone(nil)
+			dict.size += size
+			chainIDs = append(chainIDs, layer.ChainID().String())
+		}
+	}
+	dict.digest = digest.FromString(strings.Join(chainIDs, ","))
+
+	cvt, err := converter.New(converter.Opt{
+		Logger:          gen.Logger,
+		SourceProviders: []provider.SourceProvider{dict},
+		TargetRemote:    gen.target,
+		Compressor:      gen.Compressor,
+		NydusImagePath:  gen.NydusImagePath,
+		WorkDir:         gen.WorkDir,
+		DockerV2Format:  gen.DockerV2Format,
+		BackendType:     gen.BackendType,
+		BackendConfig:   gen.BackendConfig,
+	})
+	if err != nil {
+		return err
+	}
+
+	return cvt.Convert(ctx)
+}
+
+// mountSource returns the directory of mounted layer.
+func mountSource(mounts []mount.Mount) (string, error) {
+	if len(mounts) == 0 {
+		return "", errors.New("Invalid layer mounts")
+	}
+	if mounts[0].Type == "overlay" {
+		for _, option := range mounts[0].Options {
+			if strings.HasPrefix(option, "lowerdir=") {
+				return strings.Split(strings.TrimPrefix(option, "lowerdir="), ":")[0], nil
+			}
+		}
+		return "", fmt.Errorf("Failed to parse mount overlayfs options %v", mounts[0].Options)
+	}
+	return mounts[0].Source, nil
+}
+
+// stageLayer links (or copies if not in the same filesystem) the regular
+// files in layer to dir, the whiteouts and special files are skipped since
+// only the chunks matter, returns the total size of staged files.
+func stageLayer(ctx context.Context, layer provider.SourceLayer, dir string) (int64, error) {
+	mounts, umount, err := layer.Mount(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "Mount layer")
+	}
+	if umount != nil {
+		defer umount()
+	}
+	src, err := mountSource(mounts)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 ||
+			strings.HasPrefix(info.Name(), ".wh.") {
+			return nil
+		}
+		if err := os.Link(path, target); err != nil {
+			if err := copyFile(path, target); err != nil {
+				return errors.Wrapf(err, "Copy file %s", rel)
+			}
+		}
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
+
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	_, err = io.Copy(dstFile, srcFile)
+	return err
+}
+
+// dictSource is the source provider of chunk dictionary image, which has
+// only one layer in the staging directory.
+type dictSource struct {
+	dir    string
+	size   int64
+	digest digest.Digest
+}
+
+func (ds *dictSource) Manifest(ctx context.Context) (*ocispec.Descriptor, error) {
+	return nil, nil
+}
+
+func (ds *dictSource) Config(ctx context.Context) (*ocispec.Image, error) {
+	return &ocispec.Image{
+		OS:           utils.SupportedOS,
+		Architecture: utils.SupportedArch,
+		Config: ocispec.ImageConfig{
+			Labels: map[string]string{
+				LabelChunkDict: "true",
+			},
+		},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{ds.digest},
+		},
+	}, nil
+}
+
+func (ds *dictSource) Layers(ctx context.Context) ([]provider.SourceLayer, error) {
+	return []provider.SourceLayer{ds}, nil
+}
+
+func (ds *dictSource) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	mounts := []mount.Mount{
+		{
+			Type:   "oci-directory",
+			Source: ds.dir,
+		},
+	}
+	return mounts, func() error { return nil }, nil
+}
+
+func (ds *dictSource) Size() int64 {
+	return ds.size
+}
+
+func (ds *dictSource) Digest() digest.Digest {
+	return ds.digest
+}
+
+func (ds *dictSource) ChainID() digest.Digest {
+	return ds.digest
+}
+
+func (ds *dictSource) ParentChainID() *digest.Digest {
+	return nil
+}
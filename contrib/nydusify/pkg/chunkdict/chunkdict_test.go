@@ -0,0 +1,42 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package chunkdict
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStageLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-chunkdict-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	layerDir := filepath.Join(dir, "layer")
+	require.Nil(t, os.MkdirAll(filepath.Join(layerDir, "usr/lib"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(layerDir, "usr/lib/libc.so"), []byte("libc"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(layerDir, "usr/lib/empty"), nil, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(layerDir, "usr/.wh.removed"), []byte("x"), 0644))
+	require.Nil(t, os.Symlink("usr/lib", filepath.Join(layerDir, "lib")))
+
+	target := filepath.Join(dir, "staged")
+	size, err := stageLayer(context.Background(), &dictSource{dir: layerDir}, target)
+	require.Nil(t, err)
+	assert.Equal(t, int64(4), size)
+
+	data, err := ioutil.ReadFile(filepath.Join(target, "usr/lib/libc.so"))
+	require.Nil(t, err)
+	assert.Equal(t, "libc", string(data))
+	for _, skipped := range []string{"usr/lib/empty", "usr/.wh.removed", "lib"} {
+		_, err := os.Lstat(filepath.Join(target, skipped))
+		assert.True(t, os.IsNotExist(err), skipped)
+	}
+}
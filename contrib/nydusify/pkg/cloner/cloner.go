@@ -0,0 +1,276 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package cloner derives a variant of an existing Nydus image, e.g. with
+// different environment variables, labels or prefetch table, by rebuilding
+// only the image config and bootstrap layer, all the Nydus blobs are shared
+// with the source image, so no data blob is pushed.
+package cloner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Opt defines cloner options.
+type Opt struct {
+	WorkDir        string
+	NydusImagePath string
+	// Source is the Nydus image to clone, Target must be in the same
+	// repository with Source, so that the blobs are shared without being
+	// copied.
+	Source   string
+	Target   string
+	Insecure bool
+	// Mutation mutates the config and manifest of target image.
+	Mutation *converter.ConfigMutation
+	// PrefetchPatterns are the absolute paths of rootfs to be prefetched,
+	// one path per line, the prefetch table of source image is kept if
+	// it's empty.
+	PrefetchPatterns string
+}
+
+// Cloner clones Nydus image into a new tag with different config.
+type Cloner struct {
+	Opt
+	source *remote.Remote
+	target *remote.Remote
+}
+
+// New creates Cloner instance.
+func New(opt Opt) (*Cloner, error) {
+	if opt.Mutation == nil && opt.PrefetchPatterns == "" {
+		return nil, fmt.Errorf("Nothing to change for the cloned image")
+	}
+	if opt.Mutation != nil {
+		if err := opt.Mutation.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	sourceNamed, err := docker.ParseDockerRef(opt.Source)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse source reference")
+	}
+	targetNamed, err := docker.ParseDockerRef(opt.Target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse target reference")
+	}
+	if sourceNamed.Name() != targetNamed.Name() {
+		return nil, fmt.Errorf("Target should be in the same repository with source for cloning")
+	}
+
+	source, err := provider.DefaultRemote(opt.Source, opt.Insecure)
+	if err != nil {
+		return nil, errors.Wrap(err, "Init source image parser")
+	}
+	target, err := provider.DefaultRemote(opt.Target, opt.Insecure)
+	if err != nil {
+		return nil, errors.Wrap(err, "Init target image parser")
+	}
+
+	return &Cloner{
+		Opt:    opt,
+		source: source,
+		target: target,
+	}, nil
+}
+
+// Clone pushes the Nydus manifest of target image, only the config and the
+// bootstrap layer (if the prefetch table is changed) are pushed, the target
+// image is a single Nydus manifest even if source is a manifest index.
+func (cl *Cloner) Clone(ctx context.Context) (*ocispec.Descriptor, error) {
+	parsed, err := parser.New(cl.source).Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse source image")
+	}
+	if parsed.NydusImage == nil {
+		return nil, fmt.Errorf("Not found Nydus manifest in source image %s", cl.Source)
+	}
+	image := parsed.NydusImage
+	manifest := image.Manifest
+	manifest.Layers = append([]ocispec.Descriptor{}, image.Manifest.Layers...)
+	config := image.Config
+	config.RootFS.DiffIDs = append([]digest.Digest{}, image.Config.RootFS.DiffIDs...)
+
+	if cl.PrefetchPatterns != "" {
+		bootstrapDesc, diffID, err := cl.rebuildBootstrap(ctx, image)
+		if err != nil {
+			return nil, errors.Wrap(err, "Rebuild bootstrap layer")
+		}
+		if err := replaceBootstrap(&manifest, &config, *bootstrapDesc, diffID); err != nil {
+			return nil, err
+		}
+	}
+
+	cl.Mutation.Apply(&config)
+	cl.Mutation.Annotate(&manifest)
+
+	configMediaType := manifest.Config.MediaType
+	configDesc, configBytes, err := utils.MarshalToDesc(config, configMediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal image config")
+	}
+	if err := cl.target.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push image config")
+	}
+	manifest.Config = *configDesc
+
+	manifestDesc, manifestBytes, err := utils.MarshalToDesc(manifestWithMediaType(manifest, image.Desc.MediaType), image.Desc.MediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal image manifest")
+	}
+	if err := cl.target.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push image manifest")
+	}
+	logrus.Infof("Cloned %s to %s with manifest %s", cl.Source, cl.Target, manifestDesc.Digest)
+
+	return manifestDesc, nil
+}
+
+// manifestWithMediaType adds the media type field required by Docker
+// manifest v2, schema 2.
+func manifestWithMediaType(manifest ocispec.Manifest, mediaType string) interface{} {
+	return struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{
+		MediaType: mediaType,
+		Manifest:  manifest,
+	}
+}
+
+// replaceBootstrap replaces the bootstrap layer, which is the last layer of
+// Nydus manifest, and its diff id in image config.
+func replaceBootstrap(manifest *ocispec.Manifest, config *ocispec.Image, desc ocispec.Descriptor, diffID digest.Digest) error {
+	layers := manifest.Layers
+	if len(layers) == 0 || layers[len(layers)-1].Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+		return fmt.Errorf("Not found Nydus bootstrap layer in manifest")
+	}
+	if len(config.RootFS.DiffIDs) != len(layers) {
+		return fmt.Errorf("Mismatched layers %d and diff ids %d", len(layers), len(config.RootFS.DiffIDs))
+	}
+	layers[len(layers)-1] = desc
+	config.RootFS.DiffIDs[len(config.RootFS.DiffIDs)-1] = diffID
+	return nil
+}
+
+// rebuildBootstrap builds an empty directory on top of source bootstrap
+// with the new prefetch patterns, the prefetch table is regenerated for
+// the merged filesystem without any new blob, then pushes the bootstrap in
+// the same layer format as source bootstrap layer.
+func (cl *Cloner) rebuildBootstrap(ctx context.Context, image *parser.Image) (*ocispec.Descriptor, digest.Digest, error) {
+	if err := os.RemoveAll(cl.WorkDir); err != nil {
+		return nil, "", errors.Wrap(err, "Clean up work directory")
+	}
+	emptyDir := filepath.Join(cl.WorkDir, "empty")
+	// The attributes of root directory are overridden by the upper layer
+	if err := os.MkdirAll(emptyDir, 0755); err != nil {
+		return nil, "", errors.Wrap(err, "Create work directory")
+	}
+	defer os.RemoveAll(cl.WorkDir)
+
+	sourceDesc := image.Manifest.Layers[len(image.Manifest.Layers)-1]
+	reader, err := parser.New(cl.source).PullNydusBootstrap(ctx, image)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+	parentPath := filepath.Join(cl.WorkDir, "parent-bootstrap")
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, parentPath); err != nil {
+		return nil, "", errors.Wrap(err, "Unpack source bootstrap")
+	}
+
+	bootstrapPath := filepath.Join(cl.WorkDir, "bootstrap")
+	blobPath := filepath.Join(cl.WorkDir, "blob")
+	logrus.Infof("Rebuilding bootstrap of %s with new prefetch table", cl.Source)
+	if err := build.NewBuilder(cl.NydusImagePath).Run(build.BuilderOption{
+		ParentBootstrapPath: parentPath,
+		BootstrapPath:       bootstrapPath,
+		RootfsPath:          emptyDir,
+		WhiteoutSpec:        "oci",
+		OutputJSONPath:      filepath.Join(cl.WorkDir, "output.json"),
+		BlobPath:            blobPath,
+		PrefetchDir:         cl.PrefetchPatterns,
+		Compressor:          sourceDesc.Annotations[utils.LayerAnnotationNydusCompressor],
+		FsVersion:           sourceDesc.Annotations[utils.LayerAnnotationNydusFsVersion],
+	}); err != nil {
+		return nil, "", err
+	}
+	if info, err := os.Stat(blobPath); err == nil && info.Size() > 0 {
+		return nil, "", fmt.Errorf("Unexpected blob of %d bytes is built", info.Size())
+	}
+
+	return cl.pushBootstrap(ctx, sourceDesc, bootstrapPath)
+}
+
+// pushBootstrap pushes the bootstrap layer with the media type and the
+// annotations of source bootstrap layer, the blobs referenced by bootstrap
+// aren't changed.
+func (cl *Cloner) pushBootstrap(ctx context.Context, sourceDesc ocispec.Descriptor, bootstrapPath string) (*ocispec.Descriptor, digest.Digest, error) {
+	zstd := sourceDesc.MediaType == utils.MediaTypeImageLayerZstd
+
+	var compressedDigest digest.Digest
+	var compressedSize int64
+	var err error
+	if zstd {
+		compressedDigest, compressedSize, err = utils.PackTarZstdInfo(bootstrapPath, utils.BootstrapFileNameInLayer)
+	} else {
+		compressedDigest, compressedSize, err = utils.PackTargzInfo(bootstrapPath, utils.BootstrapFileNameInLayer, true)
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Calculate compressed bootstrap digest")
+	}
+	uncompressedDigest, _, err := utils.PackTargzInfo(bootstrapPath, utils.BootstrapFileNameInLayer, false)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Calculate uncompressed bootstrap digest")
+	}
+
+	annotations := map[string]string{}
+	for key, value := range sourceDesc.Annotations {
+		annotations[key] = value
+	}
+	annotations[utils.LayerAnnotationUncompressed] = uncompressedDigest.String()
+	desc := ocispec.Descriptor{
+		MediaType:   sourceDesc.MediaType,
+		Digest:      compressedDigest,
+		Size:        compressedSize,
+		Annotations: annotations,
+	}
+
+	if err := utils.WithRetry(func() error {
+		var reader io.ReadCloser
+		if zstd {
+			reader, err = utils.PackTarZstd(bootstrapPath, utils.BootstrapFileNameInLayer)
+		} else {
+			reader, err = utils.PackTargz(bootstrapPath, utils.BootstrapFileNameInLayer, true)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Compress bootstrap layer")
+		}
+		defer reader.Close()
+		return cl.target.Push(ctx, desc, true, reader)
+	}); err != nil {
+		return nil, "", errors.Wrap(err, "Push bootstrap layer")
+	}
+
+	return &desc, uncompressedDigest, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cloner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func pushJSON(t *testing.T, r *remote.Remote, v interface{}, mediaType string, byDigest bool) ocispec.Descriptor {
+	desc, data, err := utils.MarshalToDesc(v, mediaType)
+	require.Nil(t, err)
+	require.Nil(t, r.Push(context.Background(), *desc, byDigest, bytes.NewReader(data)))
+	return *desc
+}
+
+func pull(t *testing.T, r *remote.Remote, desc ocispec.Descriptor, res interface{}) {
+	reader, err := r.Pull(context.Background(), desc, true)
+	require.Nil(t, err)
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(data, res))
+}
+
+func TestClone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-cloner-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	source, err := remote.NewLayout(dir, "v1")
+	require.Nil(t, err)
+	target, err := remote.NewLayout(dir, "v1-tenant")
+	require.Nil(t, err)
+
+	layers := []ocispec.Descriptor{
+		{
+			MediaType:   utils.MediaTypeNydusBlob,
+			Digest:      digest.FromString("blob"),
+			Size:        4,
+			Annotations: map[string]string{utils.LayerAnnotationNydusBlob: "true"},
+		},
+		{
+			MediaType:   ocispec.MediaTypeImageLayerGzip,
+			Digest:      digest.FromString("bootstrap"),
+			Size:        9,
+			Annotations: map[string]string{utils.LayerAnnotationNydusBootstrap: "true"},
+		},
+	}
+	config := ocispec.Image{
+		Config: ocispec.ImageConfig{
+			Env:    []string{"PATH=/bin", "TENANT=default"},
+			Labels: map[string]string{"app": "web"},
+		},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromString("blob"), digest.FromString("bootstrap-tar")},
+		},
+	}
+	configDesc := pushJSON(t, source, config, ocispec.MediaTypeImageConfig, true)
+	pushJSON(t, source, manifestWithMediaType(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    configDesc,
+		Layers:    layers,
+	}, ocispec.MediaTypeImageManifest), ocispec.MediaTypeImageManifest, false)
+
+	cl := &Cloner{
+		Opt: Opt{
+			Source: source.Ref,
+			Target: target.Ref,
+			Mutation: &converter.ConfigMutation{
+				Labels:      map[string]string{"tenant": "acme"},
+				Annotations: map[string]string{"org.example.tenant": "acme"},
+				Env:         []string{"TENANT=acme"},
+			},
+		},
+		source: source,
+		target: target,
+	}
+	desc, err := cl.Clone(context.Background())
+	require.Nil(t, err)
+
+	resolved, err := target.Resolve(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, desc.Digest, resolved.Digest)
+
+	var manifest ocispec.Manifest
+	pull(t, target, *desc, &manifest)
+	// The blob and bootstrap layers are shared with source image
+	assert.Equal(t, layers, manifest.Layers)
+	assert.NotEqual(t, configDesc.Digest, manifest.Config.Digest)
+	assert.Equal(t, "acme", manifest.Annotations["org.example.tenant"])
+
+	var clonedConfig ocispec.Image
+	pull(t, target, manifest.Config, &clonedConfig)
+	assert.Equal(t, []string{"PATH=/bin", "TENANT=acme"}, clonedConfig.Config.Env)
+	assert.Equal(t, map[string]string{"app": "web", "tenant": "acme"}, clonedConfig.Config.Labels)
+	assert.Equal(t, config.RootFS, clonedConfig.RootFS)
+
+	// The source image isn't changed
+	resolved, err = source.Resolve(context.Background())
+	require.Nil(t, err)
+	var sourceManifest ocispec.Manifest
+	pull(t, source, *resolved, &sourceManifest)
+	assert.Equal(t, configDesc.Digest, sourceManifest.Config.Digest)
+}
+
+func TestReplaceBootstrap(t *testing.T) {
+	manifest := ocispec.Manifest{
+		Layers: []ocispec.Descriptor{
+			{Digest: digest.FromString("blob")},
+			{Digest: digest.FromString("bootstrap"), Annotations: map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}},
+		},
+	}
+	config := ocispec.Image{
+		RootFS: ocispec.RootFS{DiffIDs: []digest.Digest{digest.FromString("blob"), digest.FromString("bootstrap-tar")}},
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("new-bootstrap"), Annotations: map[string]string{utils.LayerAnnotationNydusBootstrap: "true"}}
+	require.Nil(t, replaceBootstrap(&manifest, &config, desc, digest.FromString("new-bootstrap-tar")))
+	assert.Equal(t, desc, manifest.Layers[1])
+	assert.Equal(t, digest.FromString("blob"), config.RootFS.DiffIDs[0])
+	assert.Equal(t, digest.FromString("new-bootstrap-tar"), config.RootFS.DiffIDs[1])
+
+	config.RootFS.DiffIDs = config.RootFS.DiffIDs[:1]
+	assert.NotNil(t, replaceBootstrap(&manifest, &config, desc, digest.FromString("new-bootstrap-tar")))
+	manifest.Layers = manifest.Layers[:1]
+	assert.NotNil(t, replaceBootstrap(&manifest, &config, desc, digest.FromString("new-bootstrap-tar")))
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Opt{Source: "localhost:5000/app:v1", Target: "localhost:5000/app:v2"})
+	assert.NotNil(t, err)
+	_, err = New(Opt{Source: "localhost:5000/app:v1", Target: "localhost:5000/app:v2", Mutation: &converter.ConfigMutation{Env: []string{"TENANT"}}})
+	assert.NotNil(t, err)
+	_, err = New(Opt{Source: "localhost:5000/app:v1", Target: "localhost:5000/other:v1", PrefetchPatterns: "/usr/bin"})
+	assert.NotNil(t, err)
+	_, err = New(Opt{Source: "localhost:5000/app:v1", Target: "localhost:5000/app:v2", PrefetchPatterns: "/usr/bin"})
+	assert.Nil(t, err)
+}
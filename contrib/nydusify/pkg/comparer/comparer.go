@@ -0,0 +1,315 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package comparer compares a Nydus image with its OCI image by their
+// metadata, it reports the size overhead, the chunks deduplicated against a
+// chunk dictionary and the estimated read amplification of cold start, so
+// that users can decide whether the image is worth converting.
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/inspector"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// The sources of the files read at container startup.
+const (
+	WorkingSetTrace         = "trace"
+	WorkingSetPrefetchTable = "prefetch_table"
+)
+
+// Opt defines Comparer options.
+type Opt struct {
+	WorkDir string
+
+	OCI           string
+	OCIInsecure   bool
+	Nydus         string
+	NydusInsecure bool
+	// ChunkDict is the chunk dictionary image, the chunks of Nydus image
+	// found in it are reported as deduplicated if it's specified.
+	ChunkDict         string
+	ChunkDictInsecure bool
+	// Trace is the paths of files read at container startup, the files
+	// in prefetch table of Nydus image are used if it's empty.
+	Trace []string
+}
+
+// Comparer compares Nydus image with OCI image.
+type Comparer struct {
+	Opt
+}
+
+// OCIImage is the summary of OCI image.
+type OCIImage struct {
+	Ref            string `json:"ref"`
+	Layers         int    `json:"layers"`
+	CompressedSize int64  `json:"compressed_size"`
+}
+
+// NydusImage is the summary of Nydus image, the blob sizes are summed from
+// the chunks referenced by bootstrap.
+type NydusImage struct {
+	Ref                  string `json:"ref"`
+	FsVersion            uint32 `json:"fs_version"`
+	ChunkSize            uint32 `json:"chunk_size"`
+	Blobs                int    `json:"blobs"`
+	Chunks               int    `json:"chunks"`
+	Files                uint64 `json:"files"`
+	BootstrapSize        int64  `json:"bootstrap_size"`
+	BlobCompressedSize   uint64 `json:"blob_compressed_size"`
+	BlobUncompressedSize uint64 `json:"blob_uncompressed_size"`
+	// CompressedSize is the size of bootstrap layer and blobs.
+	CompressedSize int64 `json:"compressed_size"`
+}
+
+// ChunkDict reports the chunks of Nydus image found in chunk dictionary.
+type ChunkDict struct {
+	Ref    string `json:"ref"`
+	Chunks int    `json:"chunks"`
+	// DedupChunks and DedupSize are the count and uncompressed size of the
+	// chunks of Nydus image found in chunk dictionary.
+	DedupChunks int    `json:"dedup_chunks"`
+	DedupSize   uint64 `json:"dedup_size"`
+	// DedupRatio is DedupSize divided by the uncompressed size of blobs.
+	DedupRatio float64 `json:"dedup_ratio"`
+}
+
+// ColdStart estimates the data read at container startup, the OCI image
+// is pulled entirely, while only the bootstrap and the chunks of files read
+// at startup are fetched for Nydus image.
+type ColdStart struct {
+	// WorkingSet is the source of files read at startup, WorkingSetTrace
+	// or WorkingSetPrefetchTable.
+	WorkingSet string `json:"working_set"`
+	Files      int    `json:"files"`
+	// FileSize is the size of files read at startup.
+	FileSize      uint64  `json:"file_size"`
+	OCIReadSize   int64   `json:"oci_read_size"`
+	NydusReadSize int64   `json:"nydus_read_size"`
+	OCIReadAmp    float64 `json:"oci_read_amplification"`
+	NydusReadAmp  float64 `json:"nydus_read_amplification"`
+}
+
+// Report is the result of comparison.
+type Report struct {
+	OCI   OCIImage   `json:"oci"`
+	Nydus NydusImage `json:"nydus"`
+	// SizeOverhead is the size of Nydus image relative to OCI image,
+	// e.g. 0.1 means Nydus image is 10% larger.
+	SizeOverhead float64    `json:"size_overhead"`
+	ChunkDict    *ChunkDict `json:"chunk_dict,omitempty"`
+	// ColdStart is nil if no file is read at startup, i.e. no trace is
+	// specified and the prefetch table of Nydus image is empty.
+	ColdStart *ColdStart `json:"cold_start,omitempty"`
+}
+
+// New creates Comparer instance.
+func New(opt Opt) (*Comparer, error) {
+	if opt.OCI == "" || opt.Nydus == "" {
+		return nil, fmt.Errorf("both OCI and Nydus image are required")
+	}
+	return &Comparer{Opt: opt}, nil
+}
+
+func (comparer *Comparer) inspect(ctx context.Context, ref string, insecure bool) (*inspector.Bootstrap, error) {
+	inspector, err := inspector.New(inspector.Opt{
+		WorkDir:        comparer.WorkDir,
+		Target:         ref,
+		TargetInsecure: insecure,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inspector.Inspect(ctx)
+}
+
+// Compare parses the manifests of both images and the bootstrap of Nydus
+// image, the blobs aren't pulled.
+func (comparer *Comparer) Compare(ctx context.Context) (*Report, error) {
+	ociRemote, err := provider.DefaultRemote(comparer.OCI, comparer.OCIInsecure)
+	if err != nil {
+		return nil, errors.Wrap(err, "init OCI image parser")
+	}
+	ociParsed, err := parser.New(ociRemote).Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse OCI image")
+	}
+	if ociParsed.OCIImage == nil {
+		return nil, fmt.Errorf("not found OCI image in %s", comparer.OCI)
+	}
+
+	nydusRemote, err := provider.DefaultRemote(comparer.Nydus, comparer.NydusInsecure)
+	if err != nil {
+		return nil, errors.Wrap(err, "init Nydus image parser")
+	}
+	nydusParsed, err := parser.New(nydusRemote).Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse Nydus image")
+	}
+	if nydusParsed.NydusImage == nil {
+		return nil, fmt.Errorf("not found Nydus image in %s", comparer.Nydus)
+	}
+	layers := nydusParsed.NydusImage.Manifest.Layers
+	if len(layers) == 0 || layers[len(layers)-1].Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+		return nil, fmt.Errorf("not found bootstrap layer in %s", comparer.Nydus)
+	}
+	bootstrapSize := layers[len(layers)-1].Size
+
+	bootstrap, err := comparer.inspect(ctx, comparer.Nydus, comparer.NydusInsecure)
+	if err != nil {
+		return nil, errors.Wrap(err, "inspect Nydus image")
+	}
+
+	var dict *inspector.Bootstrap
+	if comparer.ChunkDict != "" {
+		logrus.Infof("Inspecting chunk dictionary %s", comparer.ChunkDict)
+		if dict, err = comparer.inspect(ctx, comparer.ChunkDict, comparer.ChunkDictInsecure); err != nil {
+			return nil, errors.Wrap(err, "inspect chunk dictionary")
+		}
+	}
+
+	workingSet := WorkingSetTrace
+	trace := comparer.Trace
+	if len(trace) == 0 {
+		workingSet = WorkingSetPrefetchTable
+		for _, entry := range bootstrap.PrefetchTable {
+			trace = append(trace, entry.Path)
+		}
+	}
+
+	return compare(ociParsed.OCIImage, bootstrap, bootstrapSize, dict, workingSet, trace, comparer.Opt), nil
+}
+
+func ratio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+// compare makes the report from the parsed images.
+func compare(
+	ociImage *parser.Image, bootstrap *inspector.Bootstrap, bootstrapSize int64,
+	dict *inspector.Bootstrap, workingSet string, trace []string, opt Opt,
+) *Report {
+	report := Report{
+		OCI: OCIImage{
+			Ref:    opt.OCI,
+			Layers: len(ociImage.Manifest.Layers),
+		},
+		Nydus: NydusImage{
+			Ref:           opt.Nydus,
+			FsVersion:     bootstrap.FsVersion,
+			ChunkSize:     bootstrap.ChunkSize,
+			Blobs:         len(bootstrap.Blobs),
+			Chunks:        len(bootstrap.Chunks),
+			Files:         bootstrap.Files,
+			BootstrapSize: bootstrapSize,
+		},
+	}
+	for _, layer := range ociImage.Manifest.Layers {
+		report.OCI.CompressedSize += layer.Size
+	}
+	for _, blob := range bootstrap.Blobs {
+		report.Nydus.BlobCompressedSize += blob.CompressedSize
+		report.Nydus.BlobUncompressedSize += blob.UncompressedSize
+	}
+	report.Nydus.CompressedSize = bootstrapSize + int64(report.Nydus.BlobCompressedSize)
+	report.SizeOverhead = ratio(float64(report.Nydus.CompressedSize-report.OCI.CompressedSize), float64(report.OCI.CompressedSize))
+
+	if dict != nil {
+		report.ChunkDict = compareChunkDict(bootstrap, dict, opt.ChunkDict)
+	}
+	report.ColdStart = estimateColdStart(bootstrap, workingSet, trace)
+	if report.ColdStart != nil {
+		report.ColdStart.OCIReadSize = report.OCI.CompressedSize
+		report.ColdStart.NydusReadSize += bootstrapSize
+		report.ColdStart.OCIReadAmp = ratio(float64(report.ColdStart.OCIReadSize), float64(report.ColdStart.FileSize))
+		report.ColdStart.NydusReadAmp = ratio(float64(report.ColdStart.NydusReadSize), float64(report.ColdStart.FileSize))
+	}
+
+	return &report
+}
+
+// compareChunkDict finds the chunks of Nydus image in chunk dictionary by
+// digest, the digester of both should be the same.
+func compareChunkDict(bootstrap, dict *inspector.Bootstrap, ref string) *ChunkDict {
+	result := ChunkDict{Ref: ref, Chunks: len(bootstrap.Chunks)}
+	if dict.Digester != bootstrap.Digester {
+		logrus.Warnf("Unmatched digester of chunk dictionary and Nydus image: %s != %s", dict.Digester, bootstrap.Digester)
+		return &result
+	}
+	digests := map[string]struct{}{}
+	for _, chunk := range dict.Chunks {
+		digests[chunk.Digest] = struct{}{}
+	}
+	for _, chunk := range bootstrap.Chunks {
+		if _, ok := digests[chunk.Digest]; ok {
+			result.DedupChunks++
+			result.DedupSize += uint64(chunk.UncompressedSize)
+		}
+	}
+	var uncompressedSize uint64
+	for _, blob := range bootstrap.Blobs {
+		uncompressedSize += blob.UncompressedSize
+	}
+	result.DedupRatio = ratio(float64(result.DedupSize), float64(uncompressedSize))
+	return &result
+}
+
+// estimateColdStart sums the size and chunks of the files in trace, the
+// descendants of a directory are included, e.g. in prefetch table. The
+// chunks shared by files are counted once.
+func estimateColdStart(bootstrap *inspector.Bootstrap, workingSet string, trace []string) *ColdStart {
+	if len(trace) == 0 {
+		return nil
+	}
+	paths := map[string]bool{}
+	for _, p := range trace {
+		paths[path.Clean("/"+p)] = true
+	}
+	included := func(p string) bool {
+		for dir := p; ; dir = path.Dir(dir) {
+			if paths[dir] {
+				return true
+			}
+			if dir == "/" {
+				return false
+			}
+		}
+	}
+
+	result := ColdStart{WorkingSet: workingSet}
+	chunks := map[int]struct{}{}
+	for _, file := range bootstrap.RegularFiles {
+		if !included(file.Path) {
+			continue
+		}
+		result.Files++
+		result.FileSize += file.Size
+		for _, idx := range file.Chunks {
+			if _, ok := chunks[idx]; ok {
+				continue
+			}
+			chunks[idx] = struct{}{}
+			result.NydusReadSize += int64(bootstrap.Chunks[idx].CompressedSize)
+		}
+	}
+	if result.Files == 0 {
+		logrus.Warnf("No file of %s found in Nydus image", strings.Replace(workingSet, "_", " ", -1))
+		return nil
+	}
+	return &result
+}
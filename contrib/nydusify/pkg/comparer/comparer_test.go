@@ -0,0 +1,86 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package comparer
+
+import (
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/inspector"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+)
+
+func TestCompare(t *testing.T) {
+	ociImage := &parser.Image{
+		Manifest: ocispec.Manifest{
+			Layers: []ocispec.Descriptor{{Size: 600}, {Size: 400}},
+		},
+	}
+	bootstrap := &inspector.Bootstrap{
+		FsVersion: 5,
+		ChunkSize: 0x100000,
+		Digester:  "blake3",
+		Files:     3,
+		Blobs: []inspector.Blob{
+			{ID: "blob-a", ChunkCount: 2, CompressedSize: 700, UncompressedSize: 1400},
+			{ID: "blob-b", ChunkCount: 1, CompressedSize: 300, UncompressedSize: 600},
+		},
+		Chunks: []inspector.Chunk{
+			{Digest: "a", BlobIndex: 0, CompressedSize: 500, UncompressedSize: 1000},
+			{Digest: "b", BlobIndex: 0, CompressedSize: 200, UncompressedSize: 400},
+			{Digest: "c", BlobIndex: 1, CompressedSize: 300, UncompressedSize: 600},
+		},
+		RegularFiles: []inspector.File{
+			{Path: "/usr/bin/app", Size: 1000, Chunks: []int{0}},
+			{Path: "/usr/lib/libc.so", Size: 400, Chunks: []int{1}},
+			{Path: "/etc/config", Size: 600, Chunks: []int{2}},
+		},
+		PrefetchTable: []inspector.PrefetchEntry{{Inode: 2, Path: "/usr"}},
+	}
+	dict := &inspector.Bootstrap{
+		Digester: "blake3",
+		Chunks:   []inspector.Chunk{{Digest: "b"}, {Digest: "c"}, {Digest: "d"}},
+	}
+	opt := Opt{OCI: "oci:latest", Nydus: "nydus:latest", ChunkDict: "dict:latest"}
+
+	report := compare(ociImage, bootstrap, 100, dict, WorkingSetTrace, []string{"/usr/bin/app"}, opt)
+	assert.Equal(t, OCIImage{Ref: "oci:latest", Layers: 2, CompressedSize: 1000}, report.OCI)
+	assert.Equal(t, int64(1100), report.Nydus.CompressedSize)
+	assert.Equal(t, 3, report.Nydus.Chunks)
+	assert.InDelta(t, 0.1, report.SizeOverhead, 0.0001)
+
+	require.NotNil(t, report.ChunkDict)
+	assert.Equal(t, 2, report.ChunkDict.DedupChunks)
+	assert.Equal(t, uint64(1000), report.ChunkDict.DedupSize)
+	assert.InDelta(t, 0.5, report.ChunkDict.DedupRatio, 0.0001)
+
+	require.NotNil(t, report.ColdStart)
+	assert.Equal(t, ColdStart{
+		WorkingSet:    WorkingSetTrace,
+		Files:         1,
+		FileSize:      1000,
+		OCIReadSize:   1000,
+		NydusReadSize: 600,
+		OCIReadAmp:    1,
+		NydusReadAmp:  0.6,
+	}, *report.ColdStart)
+
+	// The descendants of directory in prefetch table are read
+	report = compare(ociImage, bootstrap, 100, nil, WorkingSetPrefetchTable, []string{"/usr"}, opt)
+	assert.Nil(t, report.ChunkDict)
+	require.NotNil(t, report.ColdStart)
+	assert.Equal(t, 2, report.ColdStart.Files)
+	assert.Equal(t, uint64(1400), report.ColdStart.FileSize)
+	assert.Equal(t, int64(800), report.ColdStart.NydusReadSize)
+	assert.Contains(t, report.Markdown(), "| Read amplification | 0.71x | 0.57x |")
+
+	// No file is read at startup
+	report = compare(ociImage, bootstrap, 100, nil, WorkingSetTrace, []string{"/not-found"}, opt)
+	assert.Nil(t, report.ColdStart)
+	assert.NotContains(t, report.Markdown(), "Cold start")
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package comparer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+func bytes(size int64) string {
+	if size < 0 {
+		return "-" + humanize.IBytes(uint64(-size))
+	}
+	return humanize.IBytes(uint64(size))
+}
+
+func percent(value float64) string {
+	return fmt.Sprintf("%+.1f%%", value*100)
+}
+
+// Markdown renders the report as markdown tables.
+func (report *Report) Markdown() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "## Nydus vs OCI image\n\n")
+	fmt.Fprintf(&b, "| | OCI | Nydus |\n")
+	fmt.Fprintf(&b, "| --- | --- | --- |\n")
+	fmt.Fprintf(&b, "| Image | `%s` | `%s` |\n", report.OCI.Ref, report.Nydus.Ref)
+	fmt.Fprintf(&b, "| Layers | %d | %d blobs + bootstrap |\n", report.OCI.Layers, report.Nydus.Blobs)
+	fmt.Fprintf(&b, "| Compressed size | %s | %s (%s) |\n",
+		bytes(report.OCI.CompressedSize), bytes(report.Nydus.CompressedSize), percent(report.SizeOverhead))
+	fmt.Fprintf(&b, "| Bootstrap size | - | %s |\n", bytes(report.Nydus.BootstrapSize))
+	fmt.Fprintf(&b, "| Uncompressed data | - | %s |\n", bytes(int64(report.Nydus.BlobUncompressedSize)))
+	fmt.Fprintf(&b, "| Files | - | %d |\n", report.Nydus.Files)
+	fmt.Fprintf(&b, "| Chunks | - | %d of %s |\n", report.Nydus.Chunks, bytes(int64(report.Nydus.ChunkSize)))
+
+	if dict := report.ChunkDict; dict != nil {
+		fmt.Fprintf(&b, "\n## Chunk dictionary\n\n")
+		fmt.Fprintf(&b, "| Dictionary | Deduplicated chunks | Deduplicated size | Ratio |\n")
+		fmt.Fprintf(&b, "| --- | --- | --- | --- |\n")
+		fmt.Fprintf(&b, "| `%s` | %d / %d | %s | %.1f%% |\n",
+			dict.Ref, dict.DedupChunks, dict.Chunks, bytes(int64(dict.DedupSize)), dict.DedupRatio*100)
+	}
+
+	if cold := report.ColdStart; cold != nil {
+		fmt.Fprintf(&b, "\n## Cold start (estimated)\n\n")
+		fmt.Fprintf(&b, "%d files of %s are read at startup, from %s.\n\n",
+			cold.Files, bytes(int64(cold.FileSize)), strings.Replace(cold.WorkingSet, "_", " ", -1))
+		fmt.Fprintf(&b, "| | OCI | Nydus |\n")
+		fmt.Fprintf(&b, "| --- | --- | --- |\n")
+		fmt.Fprintf(&b, "| Read size | %s | %s |\n", bytes(cold.OCIReadSize), bytes(cold.NydusReadSize))
+		fmt.Fprintf(&b, "| Read amplification | %.2fx | %.2fx |\n", cold.OCIReadAmp, cold.NydusReadAmp)
+	}
+
+	return b.String()
+}
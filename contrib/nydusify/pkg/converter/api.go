@@ -0,0 +1,231 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+const (
+	// LocalCacheScheme is the scheme of cache image stored in local
+	// directory, e.g. dir:///path/to/cache.
+	LocalCacheScheme = "dir://"
+
+	// ObjectCacheAccessKeyEnv and ObjectCacheSecretKeyEnv are the environment
+	// variables of the credentials of cache image stored in object storage.
+	ObjectCacheAccessKeyEnv = "BUILD_CACHE_ACCESS_KEY_ID"
+	ObjectCacheSecretKeyEnv = "BUILD_CACHE_ACCESS_KEY_SECRET"
+
+	DefaultCacheMaxRecords uint = 50
+	DefaultCacheVersion         = "v1"
+)
+
+// ConvertOpt is the options of Convert, the source providers, target remote
+// and cache backend in Opt are resolved from the references by Convert.
+type ConvertOpt struct {
+	Opt
+
+	SourceInsecure bool
+	TargetInsecure bool
+	// ContainerdAddress is the address of containerd for the source image
+	// in containerd image store, uses the default address if empty.
+	ContainerdAddress string
+
+	// BuildCache is the reference of cache image in registry, or a local
+	// directory in format dir:///path, the build cache is disabled if it's
+	// empty.
+	BuildCache         string
+	BuildCacheInsecure bool
+	// HTTPCacheDir caches the manifest and config responses from registry
+	// in the directory if it's specified.
+	HTTPCacheDir string
+}
+
+// NewSourceProviders creates the source providers of source image in
+// registry, or in local image store (docker daemon, containerd, OCI image
+// layout or docker archive), the layers are unpacked in workDir.
+func NewSourceProviders(ctx context.Context, source string, insecure bool, workDir, containerdAddress string, opts ...provider.RemoteOpt) ([]provider.SourceProvider, error) {
+	if provider.IsLocalSource(source) {
+		// Stream layers from the local image store of docker daemon or containerd
+		sourceProviders, err := provider.LocalSource(ctx, source, workDir, containerdAddress)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parse local source image")
+		}
+		return sourceProviders, nil
+	}
+
+	sourceRemote, err := provider.DefaultRemote(source, insecure, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse source reference")
+	}
+	sourceProviders, err := provider.DefaultSource(ctx, sourceRemote, workDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse source image")
+	}
+	return sourceProviders, nil
+}
+
+// NewTargetRemote creates the remote of target image in registry, or in
+// OCI image layout or docker archive, the docker archive is staged in
+// workDir until it's exported by provider.ExportLocalTarget.
+func NewTargetRemote(target string, insecure bool, workDir string, opts ...provider.RemoteOpt) (*remote.Remote, error) {
+	if provider.IsLocalTarget(target) {
+		return provider.LocalTarget(target, workDir)
+	}
+	return provider.DefaultRemote(target, insecure, opts...)
+}
+
+// NewCacheBackend creates the backend of cache image in registry, or in
+// local directory in format dir:///path, or in object storage in format
+// <oss|s3|gcs>://bucket/prefix?endpoint=host&region=region&scheme=http.
+func NewCacheBackend(ref string, insecure bool, opts ...provider.RemoteOpt) (cache.CacheBackend, error) {
+	for _, scheme := range []string{"oss", "s3", "gcs"} {
+		if strings.HasPrefix(ref, scheme+"://") {
+			return newObjectCacheBackend(scheme, ref)
+		}
+	}
+	if strings.HasPrefix(ref, LocalCacheScheme) {
+		localBackend, err := cache.NewLocalBackend(strings.TrimPrefix(ref, LocalCacheScheme))
+		if err != nil {
+			return nil, err
+		}
+		return localBackend, nil
+	}
+	cacheRemote, err := provider.DefaultRemote(ref, insecure, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse cache reference")
+	}
+	return cache.NewRegistryBackend(cacheRemote), nil
+}
+
+// newObjectCacheBackend creates the backend of cache image in object
+// storage, the credentials are read from environment variables.
+func newObjectCacheBackend(backendType, ref string) (cache.CacheBackend, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse cache reference")
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no bucket is specified in cache reference %s", ref)
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	query := u.Query()
+	configMap := map[string]string{
+		"scheme":            query.Get("scheme"),
+		"endpoint":          query.Get("endpoint"),
+		"region":            query.Get("region"),
+		"bucket_name":       u.Host,
+		"object_prefix":     prefix,
+		"access_key_id":     os.Getenv(ObjectCacheAccessKeyEnv),
+		"access_key_secret": os.Getenv(ObjectCacheSecretKeyEnv),
+	}
+	for key, value := range configMap {
+		if value == "" {
+			delete(configMap, key)
+		}
+	}
+	config, err := json.Marshal(configMap)
+	if err != nil {
+		return nil, err
+	}
+	store, err := backend.NewObjectStore(backendType, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Create object storage of cache image")
+	}
+	// The credentials are never in reference
+	u.User = nil
+	return cache.NewObjectBackend(store, u.String()), nil
+}
+
+// Convert converts source image to target Nydus image, it's the entrypoint
+// for the Go programs embedding Nydus conversion, e.g. buildkit plugins and
+// operators, without executing nydusify binary. The references are in the
+// same forms as the options of `nydusify convert`, a temporary work
+// directory is used if opt.WorkDir is empty.
+func Convert(ctx context.Context, source, target string, opt ConvertOpt) error {
+	if opt.WorkDir == "" {
+		workDir, err := ioutil.TempDir("", "nydusify-")
+		if err != nil {
+			return errors.Wrap(err, "Create work directory")
+		}
+		defer os.RemoveAll(workDir)
+		opt.WorkDir = workDir
+	}
+	if opt.Logger == nil {
+		logger, err := provider.DefaultLogger()
+		if err != nil {
+			return err
+		}
+		opt.Logger = logger
+	}
+	if opt.BackendType == "" {
+		opt.BackendType = "registry"
+	}
+	if opt.SourceRef == "" {
+		opt.SourceRef = source
+	}
+	if opt.Encrypter != nil && !provider.IsLocalTarget(target) {
+		return errors.New("Encryption requires the target image in OCI layout or docker archive")
+	}
+
+	sourceDir := filepath.Join(opt.WorkDir, "source")
+	if err := os.RemoveAll(sourceDir); err != nil {
+		return errors.Wrap(err, "Remove source directory")
+	}
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		return errors.Wrap(err, "Create source directory")
+	}
+	httpCache := provider.WithHTTPCache(opt.HTTPCacheDir)
+	sourceProviders, err := NewSourceProviders(ctx, source, opt.SourceInsecure, sourceDir, opt.ContainerdAddress, httpCache)
+	if err != nil {
+		return err
+	}
+	opt.SourceProviders = sourceProviders
+
+	opt.TargetRemote, err = NewTargetRemote(target, opt.TargetInsecure, opt.WorkDir, httpCache)
+	if err != nil {
+		return errors.Wrap(err, "Parse target reference")
+	}
+
+	if opt.BuildCache != "" {
+		opt.CacheBackend, err = NewCacheBackend(opt.BuildCache, opt.BuildCacheInsecure, httpCache)
+		if err != nil {
+			return err
+		}
+		if opt.CacheMaxRecords == 0 {
+			opt.CacheMaxRecords = DefaultCacheMaxRecords
+		}
+		if opt.CacheVersion == "" {
+			opt.CacheVersion = DefaultCacheVersion
+		}
+	}
+
+	cvt, err := New(opt.Opt)
+	if err != nil {
+		return err
+	}
+	if err := cvt.Convert(ctx); err != nil {
+		return err
+	}
+
+	return provider.ExportLocalTarget(ctx, target, opt.WorkDir)
+}
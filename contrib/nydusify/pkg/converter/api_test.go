@@ -0,0 +1,51 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
+)
+
+func TestConvertAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-api-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheBackend, err := NewCacheBackend(LocalCacheScheme+filepath.Join(dir, "cache"), false)
+	require.Nil(t, err)
+	assert.IsType(t, &cache.LocalBackend{}, cacheBackend)
+
+	cacheBackend, err = NewCacheBackend("localhost:5000/app:cache", false)
+	require.Nil(t, err)
+	assert.Equal(t, "localhost:5000/app:cache", cacheBackend.Reference())
+
+	cacheBackend, err = NewCacheBackend("s3://bucket/nydus/cache?endpoint=localhost:9000&scheme=http", false)
+	require.Nil(t, err)
+	assert.IsType(t, &cache.ObjectBackend{}, cacheBackend)
+	_, err = NewCacheBackend("oss:///nydus/cache", false)
+	assert.NotNil(t, err)
+
+	target, err := NewTargetRemote("oci://"+filepath.Join(dir, "layout")+":nydus", false, dir)
+	require.Nil(t, err)
+	assert.Equal(t, "oci://"+filepath.Join(dir, "layout")+":nydus", target.Ref)
+
+	// The options are validated before converting
+	workDir := filepath.Join(dir, "work")
+	err = Convert(context.Background(), "oci://"+filepath.Join(dir, "source")+":latest", "localhost:5000/app:nydus", ConvertOpt{
+		Opt: Opt{WorkDir: workDir},
+	})
+	assert.NotNil(t, err)
+	err = Convert(context.Background(), "INVALID::REF", "localhost:5000/app:nydus", ConvertOpt{})
+	assert.Contains(t, err.Error(), "Parse source reference")
+}
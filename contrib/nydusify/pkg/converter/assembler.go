@@ -0,0 +1,307 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// AssembleInput is the Nydus manifest to be assembled, the image config
+// and layers referenced by the manifest have been pushed to target.
+type AssembleInput struct {
+	Target *remote.Remote
+	// Manifest is the Nydus image manifest
+	Manifest ocispec.Manifest
+	// MediaType is the media type of Nydus manifest, OCI image manifest
+	// or docker v2 manifest
+	MediaType string
+	// SourceManifest is the descriptor of source image manifest, it's nil
+	// if the source image doesn't have a manifest, e.g. the image exported
+	// from docker daemon.
+	SourceManifest *ocispec.Descriptor
+	DockerV2Format bool
+}
+
+// PushManifest pushes the Nydus manifest to target by tag, or by digest
+// only, returns the descriptor of Nydus manifest with Nydus platform.
+func (input *AssembleInput) PushManifest(ctx context.Context, byDigest bool) (*ocispec.Descriptor, error) {
+	manifest := struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{
+		MediaType: input.MediaType,
+		Manifest:  input.Manifest,
+	}
+	desc, manifestBytes, err := utils.MarshalToDesc(manifest, input.MediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal Nydus image manifest")
+	}
+	desc.Platform = &ocispec.Platform{
+		OS:           utils.SupportedOS,
+		Architecture: utils.SupportedArch,
+		OSFeatures:   []string{utils.ManifestOSFeatureNydus},
+	}
+
+	if err := input.Target.Push(ctx, *desc, byDigest, bytes.NewReader(manifestBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push nydus image manifest")
+	}
+
+	return desc, nil
+}
+
+// ManifestAssembler pushes Nydus manifest to target, and decides how it
+// relates to source image in target registry, so that the registry
+// conventions other than the built-in layouts can be implemented without
+// changing the convert flow. It returns the descriptor of Nydus manifest.
+type ManifestAssembler interface {
+	Assemble(ctx context.Context, input *AssembleInput) (*ocispec.Descriptor, error)
+}
+
+// TagAssembler tags Nydus manifest in target repository, which is usually
+// a separate tag with suffix of source image, it's the default layout.
+type TagAssembler struct{}
+
+func (assembler *TagAssembler) Assemble(ctx context.Context, input *AssembleInput) (*ocispec.Descriptor, error) {
+	return input.PushManifest(ctx, false)
+}
+
+// IndexAssembler merges OCI and Nydus manifest into a manifest index,
+// which is tagged in target repository.
+type IndexAssembler struct{}
+
+// Try to get manifests from exists target image
+func (assembler *IndexAssembler) getExistsManifests(ctx context.Context, target *remote.Remote) ([]ocispec.Descriptor, error) {
+	desc, err := target.Resolve(ctx)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return []ocispec.Descriptor{}, nil
+		}
+		return nil, errors.Wrap(err, "Resolve image manifest index")
+	}
+
+	if desc.MediaType == images.MediaTypeDockerSchema2ManifestList ||
+		desc.MediaType == ocispec.MediaTypeImageIndex {
+
+		reader, err := target.Pull(ctx, *desc, true)
+		if err != nil {
+			return nil, errors.Wrap(err, "Pull image manifest index")
+		}
+		defer reader.Close()
+
+		indexBytes, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "Read image manifest index")
+		}
+
+		var index ocispec.Index
+		if err := json.Unmarshal(indexBytes, &index); err != nil {
+			return nil, errors.Wrap(err, "Unmarshal image manifest index")
+		}
+
+		return index.Manifests, nil
+	}
+
+	if desc.MediaType == images.MediaTypeDockerSchema2Manifest ||
+		desc.MediaType == ocispec.MediaTypeImageManifest {
+		return []ocispec.Descriptor{*desc}, nil
+	}
+
+	return []ocispec.Descriptor{}, nil
+}
+
+// Merge OCI and Nydus manifest into a manifest index, the OCI
+// manifest of source image is not required to be provided
+func (assembler *IndexAssembler) makeManifestIndex(
+	ctx context.Context, existDescs []ocispec.Descriptor, nydusManifest, ociManifest *ocispec.Descriptor,
+) (*ocispec.Index, error) {
+	foundOCI := false
+	descs := make([]ocispec.Descriptor, 0)
+	for _, desc := range existDescs {
+		isNydus := false
+		if desc.Platform != nil {
+			if utils.IsSupportedPlatform(desc.Platform.OS, desc.Platform.Architecture) {
+				if utils.IsNydusPlatform(desc.Platform) {
+					isNydus = true
+				} else {
+					desc.Platform.OS = utils.SupportedOS
+					desc.Platform.Architecture = utils.SupportedArch
+					foundOCI = true
+				}
+			}
+		} else {
+			desc.Platform = &ocispec.Platform{
+				OS:           utils.SupportedOS,
+				Architecture: utils.SupportedArch,
+			}
+			foundOCI = true
+		}
+		if !isNydus {
+			descs = append(descs, desc)
+		}
+	}
+
+	// Append the OCI manifest provided by source to manifest list
+	if !foundOCI && ociManifest != nil {
+		ociManifest.Platform = &ocispec.Platform{
+			OS:           utils.SupportedOS,
+			Architecture: utils.SupportedArch,
+		}
+		descs = append(descs, *ociManifest)
+	}
+
+	// Always put the nydus manifest to the last position of manifest list
+	descs = append(descs, *nydusManifest)
+
+	// Merge exists OCI manifests and Nydus manifest to manifest index
+	index := ocispec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: descs,
+	}
+
+	return &index, nil
+}
+
+func (assembler *IndexAssembler) Assemble(ctx context.Context, input *AssembleInput) (*ocispec.Descriptor, error) {
+	nydusManifestDesc, err := input.PushManifest(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Push manifest index, includes OCI manifest and Nydus manifest
+	var ociManifestDesc *ocispec.Descriptor
+	if input.SourceManifest != nil {
+		desc := *input.SourceManifest
+		desc.Platform = &ocispec.Platform{
+			OS:           utils.SupportedOS,
+			Architecture: utils.SupportedArch,
+		}
+		ociManifestDesc = &desc
+	}
+
+	existManifests, err := assembler.getExistsManifests(ctx, input.Target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get remote existing manifest index")
+	}
+
+	_index, err := assembler.makeManifestIndex(ctx, existManifests, nydusManifestDesc, ociManifestDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "Make manifest index for target")
+	}
+
+	indexMediaType := ocispec.MediaTypeImageIndex
+	if input.DockerV2Format {
+		indexMediaType = images.MediaTypeDockerSchema2ManifestList
+	}
+
+	index := struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Index
+	}{
+		MediaType: indexMediaType,
+		Index:     *_index,
+	}
+
+	indexDesc, indexBytes, err := utils.MarshalToDesc(index, indexMediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal image manifest index")
+	}
+
+	if err := input.Target.Push(ctx, *indexDesc, false, bytes.NewReader(indexBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push image manifest index")
+	}
+
+	return nydusManifestDesc, nil
+}
+
+// ReferrerAssembler pushes Nydus manifest by digest with the source
+// manifest as `subject`, so that it can be discovered by OCI referrers
+// API, the target should be in the same repository with source.
+type ReferrerAssembler struct{}
+
+func (assembler *ReferrerAssembler) Assemble(ctx context.Context, input *AssembleInput) (*ocispec.Descriptor, error) {
+	if input.SourceManifest == nil {
+		return nil, errors.New("Source image manifest is required by referrer")
+	}
+	desc, err := pushReferrer(ctx, input.Target, makeReferrerManifest(input.Manifest, *input.SourceManifest))
+	if err != nil {
+		return nil, errors.Wrap(err, "Push Nydus image manifest as referrer")
+	}
+	logrus.Infof("Pushed Nydus manifest %s as referrer of %s", desc.Digest, input.SourceManifest.Digest)
+	return desc, nil
+}
+
+// AnnotationAssembler pushes Nydus manifest by digest, and tags a copy of
+// source manifest annotated with the digest of Nydus manifest in target
+// repository, so that the target is still a regular OCI image for the
+// runtimes unaware of Nydus, and the Nydus manifest can be found by the
+// annotation. The source manifest and its layers should be in the same
+// repository with target.
+type AnnotationAssembler struct{}
+
+func (assembler *AnnotationAssembler) Assemble(ctx context.Context, input *AssembleInput) (*ocispec.Descriptor, error) {
+	if input.SourceManifest == nil {
+		return nil, errors.New("Source image manifest is required by annotation")
+	}
+
+	nydusManifestDesc, err := input.PushManifest(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := input.Target.Pull(ctx, *input.SourceManifest, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Pull source image manifest from target repository")
+	}
+	defer reader.Close()
+	manifestBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Read source image manifest")
+	}
+
+	annotated, err := annotateManifest(manifestBytes, nydusManifestDesc)
+	if err != nil {
+		return nil, err
+	}
+	desc, annotatedBytes, err := utils.MarshalToDesc(annotated, input.SourceManifest.MediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal annotated source image manifest")
+	}
+	if err := input.Target.Push(ctx, *desc, false, bytes.NewReader(annotatedBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push annotated source image manifest")
+	}
+
+	return nydusManifestDesc, nil
+}
+
+// annotateManifest adds the digest of Nydus manifest to the annotations of
+// manifest, the unknown fields in manifest are kept as they are.
+func annotateManifest(manifestBytes []byte, nydusManifest *ocispec.Descriptor) (map[string]interface{}, error) {
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal source image manifest")
+	}
+	annotations, ok := manifest["annotations"].(map[string]interface{})
+	if !ok {
+		annotations = map[string]interface{}{}
+	}
+	annotations[utils.ManifestAnnotationNydusManifest] = nydusManifest.Digest.String()
+	manifest["annotations"] = annotations
+	return manifest, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestAnnotateManifest(t *testing.T) {
+	nydusDesc := makeDesc("nydus", makePlatform("linux/amd64", true))
+
+	manifestBytes := []byte(`{"schemaVersion":2,"config":{"digest":"sha256:abc"},"layers":[],"subject":{"size":1}}`)
+	annotated, err := annotateManifest(manifestBytes, &nydusDesc)
+	require.Nil(t, err)
+	annotatedBytes, err := json.Marshal(annotated)
+	require.Nil(t, err)
+
+	var manifest struct {
+		ocispec.Manifest
+		Subject *ocispec.Descriptor `json:"subject"`
+	}
+	require.Nil(t, json.Unmarshal(annotatedBytes, &manifest))
+	assert.Equal(t, digest.Digest("sha256:abc"), manifest.Config.Digest)
+	// The unknown fields are kept
+	require.NotNil(t, manifest.Subject)
+	assert.Equal(t, int64(1), manifest.Subject.Size)
+	assert.Equal(t, map[string]string{
+		utils.ManifestAnnotationNydusManifest: nydusDesc.Digest.String(),
+	}, manifest.Annotations)
+
+	// The existing annotations are kept
+	manifestBytes = []byte(`{"schemaVersion":2,"annotations":{"org.opencontainers.image.revision":"v1"}}`)
+	annotated, err = annotateManifest(manifestBytes, &nydusDesc)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"org.opencontainers.image.revision":   "v1",
+		utils.ManifestAnnotationNydusManifest: nydusDesc.Digest.String(),
+	}, annotated["annotations"])
+
+	_, err = annotateManifest([]byte("invalid"), &nydusDesc)
+	assert.NotNil(t, err)
+}
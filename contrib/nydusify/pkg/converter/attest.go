@@ -0,0 +1,248 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	ArtifactTypeProvenance = "application/vnd.in-toto+json"
+
+	// mediaTypeEmptyJSON is the media type of empty config of artifact
+	// manifest, which isn't defined in image-spec v1.0.
+	mediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+	inTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v0.2"
+	nydusifyBuilderID   = "https://github.com/dragonflyoss/image-service/contrib/nydusify"
+	nydusifyBuildType   = "https://github.com/dragonflyoss/image-service/contrib/nydusify/convert@v1"
+)
+
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	PredicateType string          `json:"predicateType"`
+	Subject       []inTotoSubject `json:"subject"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	Builder    slsaBuilder    `json:"builder"`
+	BuildType  string         `json:"buildType"`
+	Invocation slsaInvocation `json:"invocation"`
+	Metadata   slsaMetadata   `json:"metadata"`
+	Materials  []slsaMaterial `json:"materials"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+type slsaInvocation struct {
+	Parameters  map[string]string `json:"parameters,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+}
+
+type slsaMetadata struct {
+	BuildStartedOn  string `json:"buildStartedOn"`
+	BuildFinishedOn string `json:"buildFinishedOn"`
+	Reproducible    bool   `json:"reproducible"`
+}
+
+type slsaMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// provenanceInput is the conversion recorded by provenance.
+type provenanceInput struct {
+	SourceRef string
+	Source    ocispec.Descriptor
+	TargetRef string
+	Target    ocispec.Descriptor
+	// Parameters are the options of conversion, Environment are the
+	// versions of builder binaries.
+	Parameters  map[string]string
+	Environment map[string]string
+	Started     time.Time
+	Finished    time.Time
+}
+
+// repositoryName returns the repository of reference without tag and
+// digest, or the reference itself if it can't be parsed.
+func repositoryName(ref string) string {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return ref
+	}
+	return named.Name()
+}
+
+// makeProvenance makes the SLSA provenance in in-toto statement, which
+// maps source manifest digest to Nydus manifest digest.
+func makeProvenance(input *provenanceInput) *inTotoStatement {
+	return &inTotoStatement{
+		Type:          inTotoStatementType,
+		PredicateType: slsaProvenanceType,
+		Subject: []inTotoSubject{{
+			Name: repositoryName(input.TargetRef),
+			Digest: map[string]string{
+				input.Target.Digest.Algorithm().String(): input.Target.Digest.Hex(),
+			},
+		}},
+		Predicate: slsaProvenance{
+			Builder:   slsaBuilder{ID: nydusifyBuilderID},
+			BuildType: nydusifyBuildType,
+			Invocation: slsaInvocation{
+				Parameters:  input.Parameters,
+				Environment: input.Environment,
+			},
+			Metadata: slsaMetadata{
+				BuildStartedOn:  input.Started.UTC().Format(time.RFC3339),
+				BuildFinishedOn: input.Finished.UTC().Format(time.RFC3339),
+			},
+			Materials: []slsaMaterial{{
+				URI: repositoryName(input.SourceRef),
+				Digest: map[string]string{
+					input.Source.Digest.Algorithm().String(): input.Source.Digest.Hex(),
+				},
+			}},
+		},
+	}
+}
+
+// pushAttestation pushes the document as the only layer of an artifact
+// manifest with artifactType, which refers to subject manifest, so that
+// it can be discovered by OCI referrers API.
+func pushAttestation(
+	ctx context.Context, target *remote.Remote, subject ocispec.Descriptor, artifactType string, document interface{},
+) (*ocispec.Descriptor, error) {
+	layerDesc, layerBytes, err := utils.MarshalToDesc(document, artifactType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal attestation")
+	}
+	if err := target.Push(ctx, *layerDesc, true, bytes.NewReader(layerBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push attestation")
+	}
+
+	configDesc, configBytes, err := utils.MarshalToDesc(struct{}{}, mediaTypeEmptyJSON)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal attestation config")
+	}
+	if err := target.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push attestation config")
+	}
+
+	manifest := makeArtifactManifest(artifactType, ocispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: *configDesc,
+		Layers: []ocispec.Descriptor{*layerDesc},
+	}, subject)
+
+	return pushReferrer(ctx, target, manifest)
+}
+
+// conversionParameters returns the options recorded in provenance.
+func (cvt *Converter) conversionParameters() map[string]string {
+	parameters := map[string]string{
+		"whiteout-spec": cvt.WhiteoutSpec,
+		"compressor":    cvt.Compressor,
+		"fs-version":    cvt.FsVersion,
+	}
+	if cvt.ChunkSize > 0 {
+		parameters["chunk-size"] = fmt.Sprintf("0x%x", cvt.ChunkSize)
+	}
+	if cvt.BatchSize > 0 {
+		parameters["batch-size"] = fmt.Sprintf("0x%x", cvt.BatchSize)
+	}
+	for key, value := range parameters {
+		if value == "" {
+			delete(parameters, key)
+		}
+	}
+	return parameters
+}
+
+// attest generates the SBOM of rootfs and the provenance of conversion
+// started at started, and attaches them to Nydus manifest as referrers,
+// environment is the versions of builder binaries.
+func (cvt *Converter) attest(
+	ctx context.Context, r rootfs, sourceProvider provider.SourceProvider, manifestDesc ocispec.Descriptor,
+	started time.Time, environment map[string]string,
+) error {
+	subject := ocispec.Descriptor{
+		MediaType: manifestDesc.MediaType,
+		Digest:    manifestDesc.Digest,
+		Size:      manifestDesc.Size,
+	}
+
+	if cvt.SBOMFormat != "" {
+		image := &sbomImage{
+			Name:     cvt.TargetRemote.Ref,
+			Digest:   manifestDesc.Digest,
+			Distro:   r.distro(),
+			Packages: r.packages(),
+			Created:  time.Now(),
+		}
+		document, artifactType := makeSBOM(cvt.SBOMFormat, image)
+		sbomDone := logger.Log(ctx, "[SBOM] Push SBOM", provider.LoggerFields{
+			"Format":   cvt.SBOMFormat,
+			"Packages": len(image.Packages),
+		})
+		desc, err := pushAttestation(ctx, cvt.TargetRemote, subject, artifactType, document)
+		if err := sbomDone(err); err != nil {
+			return errors.Wrap(err, "Push SBOM")
+		}
+		logrus.Infof("Pushed SBOM %s as referrer of %s", desc.Digest, subject.Digest)
+	}
+
+	if cvt.Provenance {
+		sourceManifest, err := sourceProvider.Manifest(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Get source image manifest")
+		}
+		if sourceManifest == nil {
+			return errors.New("Source image manifest is required by provenance")
+		}
+		statement := makeProvenance(&provenanceInput{
+			SourceRef:   cvt.SourceRef,
+			Source:      *sourceManifest,
+			TargetRef:   cvt.TargetRemote.Ref,
+			Target:      subject,
+			Parameters:  cvt.conversionParameters(),
+			Environment: environment,
+			Started:     started,
+			Finished:    time.Now(),
+		})
+		provenanceDone := logger.Log(ctx, "[PROV] Push provenance", nil)
+		desc, err := pushAttestation(ctx, cvt.TargetRemote, subject, ArtifactTypeProvenance, statement)
+		if err := provenanceDone(err); err != nil {
+			return errors.Wrap(err, "Push provenance")
+		}
+		logrus.Infof("Pushed provenance %s as referrer of %s", desc.Digest, subject.Digest)
+	}
+
+	return nil
+}
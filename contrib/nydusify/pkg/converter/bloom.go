@@ -0,0 +1,98 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/bloom"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// ChunkBloomFalsePositiveRate specifies the expected false positive
+// rate of chunk bloom filter
+var ChunkBloomFalsePositiveRate = bloom.DefaultFalsePositiveRate
+
+// pushChunkBloom builds a bloom filter for the chunk digests referenced by
+// the final bootstrap, and pushes it to target repo, the snapshotter can
+// consult it to estimate the chunk overlap with the images already present
+// on the node. Returns the descriptor of bloom filter blob, which should be
+// referenced by pushChunkBloomArtifact once the target manifest is pushed.
+func pushChunkBloom(
+	ctx context.Context, workflow *build.Workflow, lastLayer *buildLayer, targetRemote *remote.Remote,
+) (*ocispec.Descriptor, error) {
+	bloomDone := logger.Log(ctx, "[BLOM] Push chunk bloom filter", nil)
+
+	bootstrapPath := lastLayer.bootstrapPath
+	if lastLayer.Cached() {
+		var err error
+		bootstrapPath, err = lastLayer.pullCachedBootstrap(ctx)
+		if err != nil {
+			return nil, bloomDone(errors.Wrap(err, "Pull bootstrap from cache"))
+		}
+	}
+
+	chunkDigests, err := workflow.ChunkDigests(bootstrapPath)
+	if err != nil {
+		return nil, bloomDone(errors.Wrap(err, "Get chunk digests of bootstrap"))
+	}
+
+	filter := bloom.NewWithEstimates(uint64(len(chunkDigests)), ChunkBloomFalsePositiveRate)
+	for _, chunkDigest := range chunkDigests {
+		filter.Add([]byte(chunkDigest))
+	}
+
+	var buf bytes.Buffer
+	if _, err := filter.WriteTo(&buf); err != nil {
+		return nil, bloomDone(errors.Wrap(err, "Encode chunk bloom filter"))
+	}
+	bloomDesc := ocispec.Descriptor{
+		MediaType: bloom.MediaType,
+		Digest:    digest.FromBytes(buf.Bytes()),
+		Size:      int64(buf.Len()),
+	}
+	if err := targetRemote.Push(ctx, bloomDesc, true, bytes.NewReader(buf.Bytes())); err != nil {
+		return nil, bloomDone(errors.Wrap(err, "Push chunk bloom filter"))
+	}
+
+	logrus.Debugf("Chunk bloom filter %s includes %d chunks", bloomDesc.Digest, filter.Count())
+
+	return &bloomDesc, bloomDone(nil)
+}
+
+// pushChunkBloomArtifact wraps the bloom filter blob into an artifact
+// manifest referring to the target manifest by `subject` field, so that the
+// blob isn't garbage collected by registry as an untagged manifest, and can
+// be discovered by OCI referrers API.
+func pushChunkBloomArtifact(
+	ctx context.Context, targetRemote *remote.Remote, bloomDesc, subject ocispec.Descriptor,
+) (*ocispec.Descriptor, error) {
+	configDesc, configBytes, err := utils.MarshalToDesc(struct{}{}, bloom.ConfigMediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal chunk bloom config")
+	}
+	if err := targetRemote.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push chunk bloom config")
+	}
+
+	manifest := makeArtifactManifest(bloom.MediaType, ocispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: *configDesc,
+		Layers: []ocispec.Descriptor{bloomDesc},
+	}, subject)
+
+	return pushReferrer(ctx, targetRemote, manifest)
+}
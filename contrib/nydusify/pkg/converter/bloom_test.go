@@ -0,0 +1,78 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/bloom"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+func pullJSON(t *testing.T, target *remote.Remote, desc ocispec.Descriptor, value interface{}) {
+	reader, err := target.Pull(context.Background(), desc, true)
+	require.Nil(t, err)
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(data, value))
+}
+
+func TestPushChunkBloomArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-bloom-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	target, err := remote.NewLayout(dir, "v1")
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	filter := bloom.NewWithEstimates(1, bloom.DefaultFalsePositiveRate)
+	var buf bytes.Buffer
+	_, err = filter.WriteTo(&buf)
+	require.Nil(t, err)
+	bloomDesc := ocispec.Descriptor{
+		MediaType: bloom.MediaType,
+		Digest:    digest.FromBytes(buf.Bytes()),
+		Size:      int64(buf.Len()),
+	}
+	require.Nil(t, target.Push(ctx, bloomDesc, true, bytes.NewReader(buf.Bytes())))
+	subject := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("nydus"),
+		Size:      100,
+	}
+
+	desc, err := pushChunkBloomArtifact(ctx, target, bloomDesc, subject)
+	require.Nil(t, err)
+
+	// The artifact refers to target manifest, and is listed in the
+	// referrers tag of target manifest
+	var manifest referrerManifest
+	pullJSON(t, target, *desc, &manifest)
+	assert.Equal(t, bloom.MediaType, manifest.ArtifactType)
+	assert.Equal(t, subject.Digest, manifest.Subject.Digest)
+	assert.Equal(t, []ocispec.Descriptor{bloomDesc}, manifest.Layers)
+
+	tagRemote, err := target.WithTag(referrersTag(subject))
+	require.Nil(t, err)
+	indexDesc, err := tagRemote.Resolve(ctx)
+	require.Nil(t, err)
+	var index referrerIndex
+	pullJSON(t, tagRemote, *indexDesc, &index)
+	require.Len(t, index.Manifests, 1)
+	assert.Equal(t, desc.Digest, index.Manifests[0].Digest)
+	assert.Equal(t, bloom.MediaType, index.Manifests[0].ArtifactType)
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+)
+
+// ErrBudgetExceeded is returned when the critical path size of target
+// image exceeds the budget in strict mode.
+var ErrBudgetExceeded = errors.New("Critical path size budget exceeded")
+
+// prefetchPaths splits the prefetch profile passed to builder, one path
+// per line.
+func prefetchPaths(prefetchDir string) []string {
+	paths := []string{}
+	for _, line := range strings.Split(prefetchDir, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths
+}
+
+// criticalPathSize estimates the bytes needed before the entrypoint can
+// start, includes the regular files in prefetch paths, the entrypoint and
+// its interpreter and shared libraries. The file is counted by the
+// uncompressed size only once even if it's matched multiple times.
+func (c *configChecker) criticalPathSize(r rootfs, prefetchDir string) int64 {
+	files := map[string]int64{}
+	add := func(p string) *rootfsEntry {
+		resolved, entry := r.resolve(p)
+		if entry != nil && entry.mode.IsRegular() {
+			files[resolved] = entry.size
+		}
+		return entry
+	}
+
+	for _, p := range prefetchPaths(prefetchDir) {
+		resolved, entry := r.resolve(p)
+		if entry == nil || !entry.mode.IsDir() {
+			add(p)
+			continue
+		}
+		prefix := strings.TrimSuffix(resolved, "/") + "/"
+		for p, entry := range r {
+			if entry.mode.IsRegular() && strings.HasPrefix(p, prefix) {
+				files[p] = entry.size
+			}
+		}
+	}
+
+	if argv0 := c.argv0(); argv0 != "" {
+		execPath, entry := c.lookPath(r, argv0)
+		if entry != nil && entry.mode.IsRegular() {
+			files[execPath] = entry.size
+			if entry.exec != nil {
+				if entry.exec.interp != "" {
+					add(entry.exec.interp)
+				}
+				for _, name := range entry.exec.needed {
+					if p, lib := c.resolveLibrary(r, execPath, entry.exec, name); lib != nil {
+						add(p)
+					}
+				}
+			}
+		}
+	}
+
+	var size int64
+	for _, fileSize := range files {
+		size += fileSize
+	}
+	return size
+}
+
+// CheckBudget compares the critical path size of merged rootfs with the
+// budget, only warns if exceeded unless strict is true.
+func (c *configChecker) CheckBudget(ctx context.Context, r rootfs, prefetchDir string, budget int64, strict bool) error {
+	size := c.criticalPathSize(r, prefetchDir)
+	logger.Log(ctx, "[BUDG] Estimate critical path size", provider.LoggerFields{
+		"Size":   humanize.IBytes(uint64(size)),
+		"Budget": humanize.IBytes(uint64(budget)),
+	})(nil)
+
+	if size <= budget {
+		return nil
+	}
+	msg := fmt.Sprintf(
+		"critical path size %s exceeds budget %s, reduce the files in prefetch paths or the dependencies of entrypoint",
+		humanize.IBytes(uint64(size)), humanize.IBytes(uint64(budget)),
+	)
+	if strict {
+		return errors.Wrap(ErrBudgetExceeded, msg)
+	}
+	logrus.Warn(msg)
+
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+)
+
+func TestCriticalPathBudget(t *testing.T) {
+	layers := [][]testFile{
+		{
+			{path: "bin", link: "usr/bin"},
+			{path: "usr/bin/app", content: "#!/bin/sh\necho hello\n", mode: 0755},
+			{path: "usr/bin/sh", content: strings.Repeat("s", 100), mode: 0755},
+			{path: "app/data/large", content: strings.Repeat("l", 1000), mode: 0644},
+			{path: "app/data/small", content: strings.Repeat("m", 10), mode: 0644},
+			{path: "app/config", content: strings.Repeat("c", 20), mode: 0644},
+		},
+		{
+			// Remove the large file in upper layer
+			{path: "app/data/.wh.large", mode: 0644},
+		},
+	}
+
+	checker := newConfigChecker(ocispec.ImageConfig{Entrypoint: []string{"app"}})
+	buildLayers := []*buildLayer{}
+	for idx, files := range layers {
+		dir := createLayer(t, files)
+		defer os.RemoveAll(dir)
+		require.Nil(t, checker.IndexLayer(idx, &sourceMount{Source: dir, WhiteoutSpec: WhiteoutSpecOCI}))
+		buildLayers = append(buildLayers, &buildLayer{index: idx})
+	}
+	r, err := checker.Merge(context.Background(), buildLayers)
+	require.Nil(t, err)
+
+	// The entrypoint script and its interpreter
+	entrypointSize := int64(len("#!/bin/sh\necho hello\n") + 100)
+	assert.Equal(t, entrypointSize, checker.criticalPathSize(r, ""))
+	assert.Equal(t, entrypointSize+10, checker.criticalPathSize(r, "/app/data"))
+	assert.Equal(t, entrypointSize+30, checker.criticalPathSize(r, "/app/data\n/app/config\n/not-exist"))
+	assert.Equal(t, entrypointSize+30, checker.criticalPathSize(r, "/"))
+
+	logger, err = provider.DefaultLogger()
+	require.Nil(t, err)
+	ctx := context.Background()
+	assert.Nil(t, checker.CheckBudget(ctx, r, "/", entrypointSize+30, true))
+	assert.Nil(t, checker.CheckBudget(ctx, r, "/", entrypointSize, false))
+	err = checker.CheckBudget(ctx, r, "/", entrypointSize, true)
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+}
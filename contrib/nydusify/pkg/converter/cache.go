@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
@@ -20,29 +21,62 @@ import (
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
 
+// CacheStats is the statistics of build cache in a conversion, for
+// tracking the effectiveness of build cache.
+type CacheStats struct {
+	// Reference is the reference of cache image.
+	Reference string `json:"reference"`
+	// Hits is the count of source layers hit in cache image, Misses is the
+	// count of source layers built, the layers reused from incremental
+	// image are counted in neither.
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+	// BytesSaved is the total size of the source layers hit in cache image,
+	// which are neither pulled nor built.
+	BytesSaved int64 `json:"bytes_saved"`
+	// DryRun is true if the records aren't exported to cache image.
+	DryRun bool `json:"dry_run"`
+	// Records are the records added to cache image, or would be added in
+	// dry run, for the source layers built.
+	Records []CacheStatsRecord `json:"records"`
+}
+
+// CacheStatsRecord is a record added to cache image.
+type CacheStatsRecord struct {
+	SourceChainID   digest.Digest `json:"source_chain_id"`
+	BootstrapDigest digest.Digest `json:"bootstrap_digest"`
+	BlobDigest      digest.Digest `json:"blob_digest,omitempty"`
+	BlobSize        int64         `json:"blob_size,omitempty"`
+}
+
 type cacheGlue struct {
 	cache *cache.Cache
-	// Remote object for cache image
-	cacheRemote *remote.Remote
+	// Backend object for cache image
+	cacheBackend cache.CacheBackend
 	// Remote object for target image
 	remote *remote.Remote
+	// dryRun uses the records in cache image, but never pushes layers
+	// and records to it.
+	dryRun bool
 }
 
 func newCacheGlue(
-	ctx context.Context, maxRecords uint, version string, dockerV2Format bool, remote *remote.Remote, cacheRemote *remote.Remote, backend backend.Backend,
+	ctx context.Context, maxRecords uint, version string, ttl time.Duration, dockerV2Format, dryRun bool,
+	remote *remote.Remote, cacheBackend cache.CacheBackend, backend backend.Backend,
 ) (*cacheGlue, error) {
-	if cacheRemote == nil {
+	if cacheBackend == nil {
 		return &cacheGlue{}, nil
 	}
 
-	logrus.Infof("[CACH] Import from %s, required version %s", cacheRemote.Ref, version)
+	logrus.Infof("[CACH] Import from %s, required version %s", cacheBackend.Reference(), version)
 
-	// Pull Nydus cache image from remote registry
-	cache, err := cache.New(cacheRemote, cache.Opt{
+	// Pull Nydus cache image from cache backend
+	cache, err := cache.New(cacheBackend, cache.Opt{
 		MaxRecords:     maxRecords,
 		Version:        version,
 		DockerV2Format: dockerV2Format,
 		Backend:        backend,
+		TTL:            ttl,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "Import cache image")
@@ -55,9 +89,10 @@ func newCacheGlue(
 	}
 
 	return &cacheGlue{
-		cache:       cache,
-		cacheRemote: cacheRemote,
-		remote:      remote,
+		cache:        cache,
+		cacheBackend: cacheBackend,
+		remote:       remote,
+		dryRun:       dryRun,
 	}, nil
 }
 
@@ -97,8 +132,28 @@ func (cg *cacheGlue) Pull(
 	return cacheRecord, nil
 }
 
+// Lookup checks the Nydus layer of source layer exists in cache image,
+// without copying it to target like Pull, it's used by dry run.
+func (cg *cacheGlue) Lookup(ctx context.Context, sourceLayerChainID digest.Digest) (*cache.CacheRecord, error) {
+	if cg == nil || cg.cache == nil {
+		return nil, nil
+	}
+
+	record, bootstrapReader, blobReader, err := cg.cache.Check(ctx, sourceLayerChainID)
+	if err != nil {
+		return nil, err
+	}
+	if bootstrapReader != nil {
+		bootstrapReader.Close()
+	}
+	if blobReader != nil {
+		blobReader.Close()
+	}
+	return record, nil
+}
+
 func (cg *cacheGlue) Push(ctx context.Context, layer *buildLayer) error {
-	if cg.cache == nil {
+	if cg.cache == nil || cg.dryRun {
 		return nil
 	}
 
@@ -163,27 +218,71 @@ func (cg *cacheGlue) PullBootstrap(
 	return fmt.Errorf("not found bootstrap in cache")
 }
 
+// Stats returns the statistics of build cache for buildLayers, or nil
+// if build cache isn't used.
+func (cg *cacheGlue) Stats(buildLayers []*buildLayer) *CacheStats {
+	if cg.cache == nil {
+		return nil
+	}
+
+	stats := &CacheStats{
+		Reference: cg.cacheBackend.Reference(),
+		DryRun:    cg.dryRun,
+		Records:   []CacheStatsRecord{},
+	}
+	for _, layer := range buildLayers {
+		if layer.Cached() {
+			if !layer.incremental {
+				stats.Hits++
+				stats.BytesSaved += layer.source.Size()
+			}
+			continue
+		}
+		stats.Misses++
+		record := layer.GetCacheRecord()
+		statsRecord := CacheStatsRecord{
+			SourceChainID:   record.SourceChainID,
+			BootstrapDigest: record.NydusBootstrapDesc.Digest,
+		}
+		if record.NydusBlobDesc != nil {
+			statsRecord.BlobDigest = record.NydusBlobDesc.Digest
+			statsRecord.BlobSize = record.NydusBlobDesc.Size
+		}
+		stats.Records = append(stats.Records, statsRecord)
+	}
+
+	return stats
+}
+
 func (cg *cacheGlue) Export(
 	ctx context.Context, buildLayers []*buildLayer,
 ) error {
 	if cg.cache == nil {
 		return nil
 	}
+	if cg.dryRun {
+		logrus.Infof("[CACH] Skip exporting to %s in dry run", cg.cacheBackend.Reference())
+		return nil
+	}
 
-	pushDone := logger.Log(ctx, fmt.Sprintf("[CACH] Export to %s", cg.cacheRemote.Ref), nil)
+	pushDone := logger.Log(ctx, fmt.Sprintf("[CACH] Export to %s", cg.cacheBackend.Reference()), nil)
 
-	// Re-import cache from remote registry to avoid conflicts with another
+	// Re-import cache from cache backend to avoid conflicts with another
 	// conversion progress as much as possible
 	cg.cache.Import(ctx)
 
+	// The records hit in cache are stamped again, so the records in use
+	// never expire
+	now := time.Now()
 	cacheRecords := []*cache.CacheRecord{}
 	for _, layer := range buildLayers {
 		record := layer.GetCacheRecord()
+		record.Timestamp = now
 		cacheRecords = append(cacheRecords, &record)
 	}
 	cg.cache.Record(cacheRecords)
 
-	// Push cache image to remote registry
+	// Push cache image to cache backend
 	if err := cg.cache.Export(ctx); err != nil {
 		logrus.Warnf("Failed to export cache: %s", err)
 	}
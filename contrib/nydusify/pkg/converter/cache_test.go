@@ -0,0 +1,93 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
+)
+
+func TestCacheStats(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "nydusify-cache-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cacheBackend, err := cache.NewLocalBackend(dir)
+	require.Nil(t, err)
+
+	// Build cache isn't used
+	cg, err := newCacheGlue(ctx, 10, "v1", 0, false, true, nil, nil, &backend.Registry{})
+	require.Nil(t, err)
+	assert.Nil(t, cg.Stats(nil))
+
+	cg, err = newCacheGlue(ctx, 10, "v1", 0, false, true, nil, cacheBackend, &backend.Registry{})
+	require.Nil(t, err)
+
+	bootstrapDiffID := digest.FromString("bootstrap-uncompressed")
+	hitRecord := &cache.CacheRecord{
+		SourceChainID:      digest.FromString("layer1"),
+		NydusBootstrapDesc: &ocispec.Descriptor{Digest: digest.FromString("bootstrap1")},
+	}
+	buildLayers := []*buildLayer{
+		{
+			source:      &hookSourceLayer{digest: digest.FromString("layer1"), size: 100},
+			cacheRecord: hitRecord,
+		},
+		{
+			// The layer reused from incremental image isn't a cache hit
+			source:      &hookSourceLayer{digest: digest.FromString("layer2"), size: 200},
+			cacheRecord: hitRecord,
+			incremental: true,
+		},
+		{
+			source:          &hookSourceLayer{digest: digest.FromString("layer3"), size: 300},
+			bootstrapDesc:   &ocispec.Descriptor{Digest: digest.FromString("bootstrap3")},
+			bootstrapDiffID: &bootstrapDiffID,
+			blobDesc:        &ocispec.Descriptor{Digest: digest.FromString("blob3"), Size: 30},
+		},
+		{
+			// The layer only includes whiteouts doesn't have blob
+			source:          &hookSourceLayer{digest: digest.FromString("layer4"), size: 400},
+			bootstrapDesc:   &ocispec.Descriptor{Digest: digest.FromString("bootstrap4")},
+			bootstrapDiffID: &bootstrapDiffID,
+		},
+	}
+
+	assert.Equal(t, &CacheStats{
+		Reference:  cacheBackend.Reference(),
+		Hits:       1,
+		Misses:     2,
+		BytesSaved: 100,
+		DryRun:     true,
+		Records: []CacheStatsRecord{
+			{
+				SourceChainID:   digest.FromString("layer3"),
+				BootstrapDigest: digest.FromString("bootstrap3"),
+				BlobDigest:      digest.FromString("blob3"),
+				BlobSize:        30,
+			},
+			{
+				SourceChainID:   digest.FromString("layer4"),
+				BootstrapDigest: digest.FromString("bootstrap4"),
+			},
+		},
+	}, cg.Stats(buildLayers))
+
+	// Nothing is exported to cache image in dry run
+	require.Nil(t, cg.Export(ctx, buildLayers))
+	_, err = cacheBackend.Resolve(ctx)
+	assert.NotNil(t, err)
+}
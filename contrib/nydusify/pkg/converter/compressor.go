@@ -0,0 +1,40 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	CompressorNone     = "none"
+	CompressorLZ4Block = "lz4_block"
+	CompressorZstd     = "zstd"
+)
+
+func validCompressor(compressor string) bool {
+	switch compressor {
+	case "", CompressorNone, CompressorLZ4Block, CompressorZstd:
+		return true
+	}
+	return false
+}
+
+// useZstdBootstrap decides whether to compress the bootstrap layer with
+// zstd, it's only done for zstd compressor in OCI format, since docker v2
+// format doesn't define zstd layer, and requires `zstd` binary in $PATH,
+// otherwise the bootstrap layer falls back to gzip.
+func useZstdBootstrap(compressor string, dockerV2Format bool) bool {
+	if compressor != CompressorZstd || dockerV2Format {
+		return false
+	}
+	if !utils.ZstdAvailable() {
+		logrus.Warn("Compress bootstrap layer with gzip since zstd binary isn't found")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,518 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPathEnv  = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	maxSymlinkHops  = 40
+	maxContentSize  = 1 << 20
+	maxShebangSize  = 256
+	ociOpaqueMarker = ".wh..wh..opq"
+)
+
+// defaultLibDirs are the directories searched by dynamic linker
+// without ld.so.cache, it covers glibc, multiarch and musl layouts.
+var defaultLibDirs = []string{
+	"/lib", "/lib64", "/usr/lib", "/usr/lib64", "/usr/local/lib",
+	"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu",
+	"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu",
+}
+
+// ErrInvalidConfig is returned when the image config doesn't match the
+// rootfs of converted image, the container would fail to start, which is
+// often misattributed to Nydus at runtime.
+var ErrInvalidConfig = errors.New("Invalid image config")
+
+type rootfsEntry struct {
+	mode os.FileMode
+	link string
+	size int64
+	// content is only recorded for the files parsed by checks,
+	// e.g. /etc/passwd, /etc/group and package databases.
+	content []byte
+	// exec is only recorded for the executables may be the entrypoint.
+	exec *execInfo
+}
+
+type execInfo struct {
+	// interp is the ELF interpreter or the shebang interpreter.
+	interp  string
+	needed  []string
+	runpath []string
+}
+
+// layerIndex records the files and whiteouts of a source layer.
+type layerIndex struct {
+	entries   map[string]*rootfsEntry
+	whiteouts []string
+	opaques   []string
+}
+
+type rootfs map[string]*rootfsEntry
+
+// configChecker checks the user and entrypoint of image config against
+// the rootfs merged from source layers, it's best-effort: only the direct
+// library dependencies of entrypoint are checked, and ld.so.cache isn't used.
+type configChecker struct {
+	sync.Mutex
+	config  ocispec.ImageConfig
+	env     map[string]string
+	argv    []string
+	binDirs map[string]bool
+	layers  map[int]*layerIndex
+	// indexPackageDB records the content of package databases for
+	// generating SBOM.
+	indexPackageDB bool
+}
+
+func newConfigChecker(config ocispec.ImageConfig) *configChecker {
+	env := map[string]string{}
+	for _, kv := range config.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	if _, ok := env["PATH"]; !ok {
+		env["PATH"] = defaultPathEnv
+	}
+
+	binDirs := map[string]bool{}
+	for _, dir := range filepath.SplitList(env["PATH"]) {
+		if dir != "" {
+			binDirs[path.Clean(dir)] = true
+		}
+	}
+
+	return &configChecker{
+		config:  config,
+		env:     env,
+		argv:    append(append([]string{}, config.Entrypoint...), config.Cmd...),
+		binDirs: binDirs,
+		layers:  map[int]*layerIndex{},
+	}
+}
+
+func (c *configChecker) argv0() string {
+	if len(c.argv) == 0 {
+		return ""
+	}
+	argv0 := c.argv[0]
+	if strings.Contains(argv0, "/") && !path.IsAbs(argv0) {
+		workDir := c.config.WorkingDir
+		if workDir == "" {
+			workDir = "/"
+		}
+		argv0 = path.Join(workDir, argv0)
+	}
+	return argv0
+}
+
+// mayBeEntrypoint returns true if the file should be parsed for checking
+// entrypoint, the symlink of entrypoint usually points to the executable
+// in the PATH directories.
+func (c *configChecker) mayBeEntrypoint(p string) bool {
+	argv0 := c.argv0()
+	if argv0 == "" {
+		return false
+	}
+	return c.binDirs[path.Dir(p)] || p == argv0 || path.Base(p) == path.Base(argv0)
+}
+
+func parseExec(p string) *execInfo {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	head := make([]byte, maxShebangSize)
+	n, _ := file.ReadAt(head, 0)
+	head = head[:n]
+	if bytes.HasPrefix(head, []byte("#!")) {
+		line := strings.SplitN(string(head[2:]), "\n", 2)[0]
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil
+		}
+		return &execInfo{interp: fields[0]}
+	}
+
+	f, err := elf.NewFile(file)
+	if err != nil {
+		return nil
+	}
+	info := execInfo{}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data, err := ioutil.ReadAll(prog.Open())
+			if err == nil {
+				info.interp = strings.TrimRight(string(data), "\x00")
+			}
+		}
+	}
+	info.needed, _ = f.ImportedLibraries()
+	for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+		values, _ := f.DynString(tag)
+		for _, value := range values {
+			info.runpath = append(info.runpath, strings.Split(value, ":")...)
+		}
+	}
+	return &info
+}
+
+// IndexLayer walks through the mounted source layer and records the
+// files and whiteouts in the layer.
+func (c *configChecker) IndexLayer(index int, mount *sourceMount) error {
+	dir := mount.Source
+	layer := &layerIndex{entries: map[string]*rootfsEntry{}}
+
+	if err := filepath.Walk(dir, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fullPath)
+		if err != nil {
+			return err
+		}
+		p := path.Join("/", filepath.ToSlash(rel))
+		if p == "/" {
+			return nil
+		}
+
+		switch mount.WhiteoutSpec {
+		case WhiteoutSpecOCI:
+			if info.Name() == ociOpaqueMarker {
+				layer.opaques = append(layer.opaques, path.Dir(p))
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), ociWhiteoutPrefix) {
+				layer.whiteouts = append(layer.whiteouts, path.Join(path.Dir(p), info.Name()[len(ociWhiteoutPrefix):]))
+				return nil
+			}
+		case WhiteoutSpecOverlayfs:
+			if isOverlayWhiteout(info) {
+				layer.whiteouts = append(layer.whiteouts, p)
+				return nil
+			}
+			if info.IsDir() && isOverlayOpaque(fullPath) {
+				layer.opaques = append(layer.opaques, p)
+			}
+		}
+
+		entry := &rootfsEntry{mode: info.Mode()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.link, err = os.Readlink(fullPath); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			entry.size = info.Size()
+			if (p == "/etc/passwd" || p == "/etc/group") && info.Size() <= maxContentSize {
+				if entry.content, err = ioutil.ReadFile(fullPath); err != nil {
+					return err
+				}
+			}
+			if c.indexPackageDB && isPackageDB(p) && info.Size() <= maxPackageDBSize {
+				if entry.content, err = ioutil.ReadFile(fullPath); err != nil {
+					return err
+				}
+			}
+			if info.Mode()&0111 != 0 && c.mayBeEntrypoint(p) {
+				entry.exec = parseExec(fullPath)
+			}
+		}
+		layer.entries[p] = entry
+
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "Walk source layer")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.layers[index] = layer
+
+	return nil
+}
+
+func (r rootfs) removeChildren(dir string) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for p := range r {
+		if strings.HasPrefix(p, prefix) {
+			delete(r, p)
+		}
+	}
+}
+
+// apply merges upper layer into rootfs, the whiteouts of layer only
+// hide the files in lower layers.
+func (r rootfs) apply(layer *layerIndex) {
+	for _, dir := range layer.opaques {
+		r.removeChildren(dir)
+	}
+	for _, p := range layer.whiteouts {
+		if old, ok := r[p]; ok && old.mode.IsDir() {
+			r.removeChildren(p)
+		}
+		delete(r, p)
+	}
+	for p, entry := range layer.entries {
+		// A non-directory hides the directory in lower layers
+		if old, ok := r[p]; ok && old.mode.IsDir() && !entry.mode.IsDir() {
+			r.removeChildren(p)
+		}
+		r[p] = entry
+	}
+}
+
+// resolve follows the symlinks in each component of path in rootfs,
+// returns the resolved path and its entry, nil entry if not found.
+func (r rootfs) resolve(p string) (string, *rootfsEntry) {
+	parts := strings.Split(p, "/")
+	cur := "/"
+	hops := 0
+	for len(parts) > 0 {
+		name := parts[0]
+		parts = parts[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			cur = path.Dir(cur)
+			continue
+		}
+		next := path.Join(cur, name)
+		entry, ok := r[next]
+		if !ok {
+			return next, nil
+		}
+		if entry.mode&os.ModeSymlink != 0 {
+			if hops++; hops > maxSymlinkHops {
+				return next, nil
+			}
+			target := entry.link
+			if path.IsAbs(target) {
+				cur = "/"
+			}
+			parts = append(strings.Split(target, "/"), parts...)
+			continue
+		}
+		cur = next
+	}
+	if cur == "/" {
+		return cur, &rootfsEntry{mode: os.ModeDir | 0755}
+	}
+	return cur, r[cur]
+}
+
+// findName returns true if the name exists in the first field of
+// /etc/passwd or /etc/group format content.
+func findName(content []byte, name string) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if fields[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
+
+func (c *configChecker) checkUser(r rootfs) []string {
+	if c.config.User == "" {
+		return nil
+	}
+
+	var problems []string
+	parts := strings.SplitN(c.config.User, ":", 2)
+	check := func(name, file, kind string) {
+		if name == "" || isNumeric(name) {
+			return
+		}
+		_, entry := r.resolve(file)
+		if entry == nil || !entry.mode.IsRegular() {
+			problems = append(problems, fmt.Sprintf(
+				"%s %s is specified in image config but %s doesn't exist in rootfs, use numeric id instead", kind, name, file,
+			))
+			return
+		}
+		if !findName(entry.content, name) {
+			problems = append(problems, fmt.Sprintf(
+				"%s %s is specified in image config but not found in %s, add it in image build or use numeric id instead", kind, name, file,
+			))
+		}
+	}
+	check(parts[0], "/etc/passwd", "user")
+	if len(parts) == 2 {
+		check(parts[1], "/etc/group", "group")
+	}
+
+	return problems
+}
+
+func (c *configChecker) lookPath(r rootfs, argv0 string) (string, *rootfsEntry) {
+	if strings.Contains(argv0, "/") {
+		return r.resolve(argv0)
+	}
+	for _, dir := range filepath.SplitList(c.env["PATH"]) {
+		if dir == "" {
+			continue
+		}
+		p, entry := r.resolve(path.Join(dir, argv0))
+		if entry != nil && entry.mode.IsRegular() && entry.mode&0111 != 0 {
+			return p, entry
+		}
+	}
+	return "", nil
+}
+
+// resolveLibrary finds the shared library needed by executable in the
+// search paths of dynamic linker, returns nil entry if not found.
+func (c *configChecker) resolveLibrary(r rootfs, execPath string, exec *execInfo, name string) (string, *rootfsEntry) {
+	if strings.Contains(name, "/") {
+		return r.resolve(name)
+	}
+	dirs := []string{}
+	for _, dir := range exec.runpath {
+		dirs = append(dirs, strings.Replace(dir, "$ORIGIN", path.Dir(execPath), -1))
+	}
+	dirs = append(dirs, filepath.SplitList(c.env["LD_LIBRARY_PATH"])...)
+	dirs = append(dirs, defaultLibDirs...)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if p, entry := r.resolve(path.Join(dir, name)); entry != nil && !entry.mode.IsDir() {
+			return p, entry
+		}
+	}
+	return "", nil
+}
+
+func (c *configChecker) checkEntrypoint(r rootfs) []string {
+	argv0 := c.argv0()
+	if argv0 == "" {
+		return nil
+	}
+
+	execPath, entry := c.lookPath(r, argv0)
+	if entry == nil {
+		if strings.Contains(argv0, "/") {
+			return []string{fmt.Sprintf("entrypoint %s doesn't exist in rootfs", argv0)}
+		}
+		return []string{fmt.Sprintf("entrypoint %s isn't found in PATH %s of rootfs", argv0, c.env["PATH"])}
+	}
+	if !entry.mode.IsRegular() || entry.mode&0111 == 0 {
+		return []string{fmt.Sprintf("entrypoint %s (%s) isn't an executable file, mode %s", argv0, execPath, entry.mode)}
+	}
+	if entry.exec == nil {
+		logrus.Debugf("Skip checking dependencies of entrypoint %s (%s)", argv0, execPath)
+		return nil
+	}
+
+	var problems []string
+	if entry.exec.interp != "" {
+		if _, interp := r.resolve(entry.exec.interp); interp == nil {
+			problems = append(problems, fmt.Sprintf(
+				"interpreter %s of entrypoint %s (%s) doesn't exist in rootfs", entry.exec.interp, argv0, execPath,
+			))
+		}
+	}
+	for _, name := range entry.exec.needed {
+		if _, lib := c.resolveLibrary(r, execPath, entry.exec, name); lib == nil {
+			problems = append(problems, fmt.Sprintf(
+				"shared library %s needed by entrypoint %s (%s) isn't found in rootfs", name, argv0, execPath,
+			))
+		}
+	}
+
+	return problems
+}
+
+// Merge merges the indexed layers into rootfs, the cached layers are
+// mounted to be indexed first.
+func (c *configChecker) Merge(ctx context.Context, layers []*buildLayer) (rootfs, error) {
+	for _, layer := range layers {
+		if _, ok := c.layers[layer.index]; ok {
+			continue
+		}
+		if err := c.indexSourceLayer(ctx, layer); err != nil {
+			return nil, errors.Wrapf(err, "Index source layer %s", layer.source.Digest())
+		}
+	}
+
+	r := rootfs{}
+	for _, layer := range layers {
+		r.apply(c.layers[layer.index])
+	}
+
+	return r, nil
+}
+
+// Check merges the indexed layers and checks image config against the
+// merged rootfs.
+func (c *configChecker) Check(ctx context.Context, layers []*buildLayer) error {
+	r, err := c.Merge(ctx, layers)
+	if err != nil {
+		return err
+	}
+
+	return c.CheckRootfs(r)
+}
+
+// CheckRootfs checks image config against the merged rootfs.
+func (c *configChecker) CheckRootfs(r rootfs) error {
+	problems := append(c.checkUser(r), c.checkEntrypoint(r)...)
+	if len(problems) > 0 {
+		return errors.Wrap(ErrInvalidConfig, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func (c *configChecker) indexSourceLayer(ctx context.Context, layer *buildLayer) error {
+	mounts, umount, err := layer.source.Mount(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Mount source layer")
+	}
+	defer func() {
+		if err := umount(); err != nil {
+			logrus.Warnf("Failed to umount layer %s: %s", layer.source.Digest(), err)
+		}
+	}()
+
+	mount, err := parseSourceMount(mounts)
+	if err != nil {
+		return errors.Wrap(err, "Parse source layer mount")
+	}
+	mount.WhiteoutSpec = sourceWhiteoutSpec(layer.whiteoutSpec, mount)
+
+	return c.IndexLayer(layer.index, mount)
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testFile struct {
+	path    string
+	content string
+	mode    os.FileMode
+	link    string
+}
+
+func createLayer(t *testing.T, files []testFile) string {
+	dir, err := ioutil.TempDir("", "nydusify-layer-")
+	require.Nil(t, err)
+	for _, file := range files {
+		p := filepath.Join(dir, file.path)
+		require.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+		if file.link != "" {
+			require.Nil(t, os.Symlink(file.link, p))
+			continue
+		}
+		require.Nil(t, ioutil.WriteFile(p, []byte(file.content), file.mode))
+		require.Nil(t, os.Chmod(p, file.mode))
+	}
+	return dir
+}
+
+func checkConfig(t *testing.T, config ocispec.ImageConfig, layers ...[]testFile) error {
+	checker := newConfigChecker(config)
+	buildLayers := []*buildLayer{}
+	for idx, files := range layers {
+		dir := createLayer(t, files)
+		defer os.RemoveAll(dir)
+		require.Nil(t, checker.IndexLayer(idx, &sourceMount{Source: dir, WhiteoutSpec: WhiteoutSpecOCI}))
+		buildLayers = append(buildLayers, &buildLayer{index: idx})
+	}
+	return checker.Check(context.Background(), buildLayers)
+}
+
+func TestConfigCheck(t *testing.T) {
+	base := []testFile{
+		{path: "bin", link: "usr/bin"},
+		{path: "etc/passwd", content: "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n", mode: 0644},
+		{path: "etc/group", content: "root:x:0:\napp:x:1000:\n", mode: 0644},
+		{path: "usr/bin/sh", content: "sh", mode: 0755},
+		{path: "usr/bin/app", content: "#!/bin/sh\necho hello\n", mode: 0755},
+		{path: "usr/share/doc", content: "doc", mode: 0644},
+	}
+
+	// Resolve entrypoint in PATH and shebang interpreter through symlink
+	err := checkConfig(t, ocispec.ImageConfig{User: "app:app", Entrypoint: []string{"app"}}, base)
+	assert.Nil(t, err)
+	err = checkConfig(t, ocispec.ImageConfig{User: "1000:1000", Cmd: []string{"/bin/app"}}, base)
+	assert.Nil(t, err)
+
+	err = checkConfig(t, ocispec.ImageConfig{User: "nobody:app", Entrypoint: []string{"server"}}, base)
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+	assert.Contains(t, err.Error(), "user nobody is specified in image config but not found in /etc/passwd")
+	assert.Contains(t, err.Error(), "entrypoint server isn't found in PATH")
+
+	err = checkConfig(t, ocispec.ImageConfig{Entrypoint: []string{"/usr/share/doc"}}, base)
+	assert.Contains(t, err.Error(), "isn't an executable file")
+
+	// Interpreter is removed by whiteout in upper layer
+	err = checkConfig(t, ocispec.ImageConfig{Entrypoint: []string{"app"}}, base, []testFile{
+		{path: "usr/bin/.wh.sh", mode: 0644},
+	})
+	assert.Contains(t, err.Error(), "interpreter /bin/sh of entrypoint app (/usr/bin/app) doesn't exist in rootfs")
+
+	// Files in lower layer are hidden by opaque directory
+	err = checkConfig(t, ocispec.ImageConfig{User: "app"}, base, []testFile{
+		{path: "etc/.wh..wh..opq", mode: 0644},
+		{path: "etc/hosts", content: "", mode: 0644},
+	})
+	assert.Contains(t, err.Error(), "/etc/passwd doesn't exist in rootfs")
+}
+
+func TestParseExec(t *testing.T) {
+	executable, err := os.Executable()
+	require.Nil(t, err)
+	assert.NotNil(t, parseExec(executable))
+
+	dir := createLayer(t, []testFile{{path: "script", content: "#!/usr/bin/env python3\n", mode: 0755}})
+	defer os.RemoveAll(dir)
+	info := parseExec(filepath.Join(dir, "script"))
+	require.NotNil(t, info)
+	assert.Equal(t, "/usr/bin/env", info.interp)
+}
@@ -10,14 +10,24 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/alias"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/encryption"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/ratelimit"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/scanner"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/signer"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
 
@@ -70,13 +80,163 @@ type Opt struct {
 	CacheRemote     *remote.Remote
 	CacheMaxRecords uint
 	CacheVersion    string
+	// CacheBackend stores cache image in other places instead of
+	// registry, e.g. local directory, conflicts with CacheRemote.
+	CacheBackend cache.CacheBackend
+	// CacheTTL ignores the cache records not hit or recorded within it,
+	// the records never expire if it's 0.
+	CacheTTL time.Duration
+	// CacheDryRun uses the records in cache image without updating it,
+	// see Converter.CacheStats for the records would be added.
+	CacheDryRun bool
+
+	// DedupRemote is an existing Nydus image, the chunks in its blobs
+	// will be deduplicated from the blobs of target image.
+	DedupRemote *remote.Remote
+
+	// IncrementalRemote is the Nydus image previously converted in the
+	// same repository with target, the Nydus layers built from the source
+	// layers shared with it are reused instead of being built again.
+	IncrementalRemote *remote.Remote
+
+	// ChunkBloom publishes a bloom filter of chunk digests as an
+	// auxiliary artifact of target image.
+	ChunkBloom bool
+
+	// WhiteoutSpec is the whiteout spec used to build source layers,
+	// one of `auto`, `oci` and `overlayfs`, defaults to `auto`.
+	WhiteoutSpec string
+
+	// TargetFormat is the format of target image, one of `nydus` and
+	// `estargz`, defaults to `nydus`.
+	TargetFormat string
+
+	// Compressor is the compression algorithm of Nydus blobs, one of
+	// `none`, `lz4_block` and `zstd`, the bootstrap layer is compressed
+	// with zstd as well for zstd in OCI format.
+	Compressor string
+
+	// FsVersion is the RAFS version of Nydus image, `5` or `6` (EROFS
+	// compatible), uses the default of nydus-image if empty.
+	FsVersion string
+	// ChunkSize and BatchSize tune the chunking of Nydus blobs, they should
+	// be power of two between 0x1000 and 0x1000000, uses the default of
+	// nydus-image if zero.
+	ChunkSize uint64
+	BatchSize uint64
+
+	// CheckConfig checks the user and entrypoint of image config against
+	// the rootfs of target image, fails the conversion if problem found.
+	CheckConfig bool
+
+	// SBOMFormat generates the SBOM of the packages installed in the rootfs
+	// of target image, one of `spdx` and `cyclonedx`, and attaches it to
+	// Nydus manifest as a referrer, the SBOM isn't generated if it's empty.
+	SBOMFormat string
+	// Provenance attaches a SLSA provenance to Nydus manifest as a referrer,
+	// which records the source manifest digest, SourceRef and conversion
+	// options.
+	Provenance bool
+	SourceRef  string
+	// AliasLabel annotates Nydus manifest with the repository, tag and
+	// digest of source image, and records Nydus manifest in the conversion
+	// index of target repository, see package alias.
+	AliasLabel bool
+
+	// CriticalPathBudget is the budget in bytes of the files needed before
+	// the entrypoint can start, estimated from the prefetch paths and the
+	// dependencies of entrypoint, the budget isn't checked if it's 0.
+	CriticalPathBudget int64
+	// CriticalPathBudgetStrict fails the conversion instead of warning
+	// if the critical path size exceeds the budget.
+	CriticalPathBudgetStrict bool
+
+	// MaxBlobSize, MaxLayers and MaxFileSize are the hard limits of the
+	// total size of blobs referenced by target image, the layer count of
+	// source image and the size of a single file in source layers, the
+	// conversion is aborted with ErrLimitExceeded if any of them is
+	// exceeded, the limit isn't checked if it's 0.
+	MaxBlobSize int64
+	MaxLayers   uint
+	MaxFileSize int64
 
 	NydusImagePath string
-	WorkDir        string
-	PrefetchDir    string
+	// Runner builds the layers instead of the local NydusImagePath, e.g.
+	// a pool of remote builder agents.
+	Runner      build.Runner
+	WorkDir     string
+	PrefetchDir string
 
 	MultiPlatform  bool
 	DockerV2Format bool
+	// Referrer pushes Nydus manifest by digest with the source manifest
+	// as `subject`, so that it can be discovered by OCI referrers API,
+	// the target should be in the same repository with source.
+	Referrer bool
+	// ManifestAssembler decides how Nydus manifest relates to source image
+	// in target registry, defaults to the layout selected by MultiPlatform
+	// and Referrer, conflicts with them if it's specified.
+	ManifestAssembler ManifestAssembler
+
+	// Encrypter encrypts Nydus blob layers in ocicrypt format before
+	// pushing them, only works for registry backend. The encrypted blobs
+	// are stored by the digest of encrypted data instead of blob id, so
+	// nydusd can't load them lazily until the image is decrypted.
+	Encrypter *encryption.Encrypter
+
+	// Signer signs the Nydus manifest after pushing it, and the signature
+	// is pushed to target repository by the signing tool.
+	Signer *signer.Signer
+
+	// Progress reports the structured progress of pulling, building and
+	// pushing each layer, the progress isn't reported if it's nil.
+	Progress *progress.Reporter
+
+	// Metrics records the durations, sizes, cache hits and result of the
+	// conversion, the metrics aren't recorded if it's nil.
+	Metrics *metrics.Recorder
+
+	// PullRateLimit and PushRateLimit are the bandwidth caps in bytes per
+	// second of pulling and pushing, shared by all concurrent transfers,
+	// the bandwidth isn't limited if it's 0.
+	PullRateLimit int64
+	PushRateLimit int64
+
+	// Hooks are invoked before and after building each layer and before
+	// pushing manifest, only works for Nydus target format.
+	Hooks []Hook
+
+	// ConfigMutation mutates the config and manifest of target image,
+	// e.g. setting labels and environment variables.
+	ConfigMutation *ConfigMutation
+
+	// IncludePaths and ExcludePaths are the absolute glob patterns of the
+	// paths kept in and dropped from target image, `**` matches any levels
+	// of directories, the patterns are applied to each source layer before
+	// building, only works for the source layers unpacked by Nydusify.
+	IncludePaths []string
+	ExcludePaths []string
+
+	// Squash merges the lowest N source layers into one Nydus layer, and
+	// Flatten merges all the source layers, to reduce the bootstrap chain
+	// depth and overlay stacking at runtime, the squashed layers count as
+	// one layer for MaxLayers, the layers aren't squashed if N is 0.
+	Squash  uint
+	Flatten bool
+
+	// Scratch specifies where the source layers pulled by Nydusify are
+	// unpacked, e.g. a tmpfs in capped size or a dedicated disk, or they
+	// are streamed into builder without being unpacked, the streaming
+	// conflicts with the options requiring the rootfs of source layers.
+	Scratch build.ScratchOption
+
+	// Scanner scans the vulnerabilities of each source layer before pushing
+	// manifest, the conversion fails without pushing manifest if any found
+	// vulnerability is at or above the fail severity of scanner, and the
+	// report is attached to Nydus manifest as a referrer and written to
+	// VulnReport file if it's specified.
+	Scanner    *scanner.Scanner
+	VulnReport string
 
 	BackendType   string
 	BackendConfig string
@@ -88,22 +248,199 @@ type Converter struct {
 
 	TargetRemote *remote.Remote
 
-	CacheRemote     *remote.Remote
+	CacheBackend    cache.CacheBackend
 	CacheMaxRecords uint
 	CacheVersion    string
+	CacheTTL        time.Duration
+	CacheDryRun     bool
+
+	DedupRemote *remote.Remote
+
+	IncrementalRemote *remote.Remote
+
+	ChunkBloom bool
+
+	WhiteoutSpec string
+
+	TargetFormat string
+
+	Compressor string
+
+	FsVersion string
+	ChunkSize uint64
+	BatchSize uint64
+
+	CheckConfig bool
+
+	SBOMFormat string
+	Provenance bool
+	SourceRef  string
+	AliasLabel bool
+
+	ConfigMutation *ConfigMutation
+
+	CriticalPathBudget       int64
+	CriticalPathBudgetStrict bool
+
+	MaxBlobSize int64
+	MaxLayers   uint
+	MaxFileSize int64
 
 	NydusImagePath string
+	Runner         build.Runner
 	WorkDir        string
 	PrefetchDir    string
 
 	MultiPlatform  bool
 	DockerV2Format bool
+	Referrer       bool
+
+	ManifestAssembler ManifestAssembler
+
+	Encrypter *encryption.Encrypter
+
+	Signer *signer.Signer
+
+	Progress *progress.Reporter
+
+	Metrics *metrics.Recorder
+
+	Hooks []Hook
+
+	IncludePaths []string
+	ExcludePaths []string
+
+	Squash  uint
+	Flatten bool
+
+	Scratch build.ScratchOption
+
+	Scanner    *scanner.Scanner
+	VulnReport string
+
+	pathFilter  *pathFilter
+	pullLimiter *ratelimit.Limiter
+	pushLimiter *ratelimit.Limiter
 
 	storageBackend backend.Backend
+
+	cacheStats     *CacheStats
+	sourceManifest *ocispec.Descriptor
+	targetManifest *ocispec.Descriptor
 }
 
 func New(opt Opt) (*Converter, error) {
 	// TODO: Add parameters sanity check here
+	if opt.CacheRemote != nil {
+		if opt.CacheBackend != nil {
+			return nil, errors.New("Cache remote conflicts with cache backend")
+		}
+		opt.CacheBackend = cache.NewRegistryBackend(opt.CacheRemote)
+	}
+	if opt.ConfigMutation != nil {
+		if err := opt.ConfigMutation.Validate(); err != nil {
+			return nil, errors.Wrap(err, "Invalid config mutation")
+		}
+	}
+	if opt.CacheDryRun && opt.CacheBackend == nil {
+		return nil, errors.New("Cache dry run requires cache image")
+	}
+	if opt.DedupRemote != nil && opt.CacheBackend != nil {
+		return nil, errors.New("Dedup image conflicts with cache image")
+	}
+	if opt.DedupRemote != nil && opt.IncrementalRemote != nil {
+		return nil, errors.New("Dedup image conflicts with incremental image")
+	}
+	if opt.Referrer && (opt.MultiPlatform || opt.DockerV2Format) {
+		return nil, errors.New("Referrer conflicts with multi-platform and docker v2 format")
+	}
+	if opt.ManifestAssembler != nil && (opt.MultiPlatform || opt.Referrer) {
+		return nil, errors.New("Manifest assembler conflicts with multi-platform and referrer")
+	}
+	if opt.Encrypter != nil {
+		if opt.BackendType != "" && opt.BackendType != "registry" {
+			return nil, fmt.Errorf("Encryption conflicts with backend type %s", opt.BackendType)
+		}
+		// The keys of cached or reused blobs are wrapped for other recipients
+		if opt.CacheBackend != nil || opt.DedupRemote != nil || opt.IncrementalRemote != nil {
+			return nil, errors.New("Encryption conflicts with cache, dedup and incremental image")
+		}
+	}
+	if !validWhiteoutSpec(opt.WhiteoutSpec) {
+		return nil, fmt.Errorf("Invalid whiteout spec %s", opt.WhiteoutSpec)
+	}
+	if !validTargetFormat(opt.TargetFormat) {
+		return nil, fmt.Errorf("Invalid target format %s", opt.TargetFormat)
+	}
+	if !validCompressor(opt.Compressor) {
+		return nil, fmt.Errorf("Invalid compressor %s", opt.Compressor)
+	}
+	if !validFsVersion(opt.FsVersion) {
+		return nil, fmt.Errorf("Invalid fs version %s", opt.FsVersion)
+	}
+	if !validChunkSize(opt.ChunkSize) {
+		return nil, fmt.Errorf("Invalid chunk size 0x%x", opt.ChunkSize)
+	}
+	if !validChunkSize(opt.BatchSize) {
+		return nil, fmt.Errorf("Invalid batch size 0x%x", opt.BatchSize)
+	}
+	// The cached layers built in other format can't be reused
+	cacheVersion := opt.CacheVersion
+	if format := formatVersion(opt.FsVersion, opt.ChunkSize, opt.BatchSize); format != "" {
+		if cacheVersion != "" {
+			cacheVersion += "-"
+		}
+		cacheVersion += format
+	}
+	if opt.TargetFormat == TargetFormatEstargz {
+		if err := checkEstargzOpt(opt); err != nil {
+			return nil, err
+		}
+	}
+	if !validSBOMFormat(opt.SBOMFormat) {
+		return nil, fmt.Errorf("Invalid SBOM format %s", opt.SBOMFormat)
+	}
+	if opt.CriticalPathBudget < 0 {
+		return nil, fmt.Errorf("Invalid critical path budget %d", opt.CriticalPathBudget)
+	}
+	if opt.MaxBlobSize < 0 || opt.MaxFileSize < 0 {
+		return nil, fmt.Errorf("Invalid size limit %d/%d", opt.MaxBlobSize, opt.MaxFileSize)
+	}
+	if opt.PullRateLimit < 0 || opt.PushRateLimit < 0 {
+		return nil, fmt.Errorf("Invalid rate limit %d/%d", opt.PullRateLimit, opt.PushRateLimit)
+	}
+	pathFilter, err := newPathFilter(opt.IncludePaths, opt.ExcludePaths)
+	if err != nil {
+		return nil, err
+	}
+	// The cached and reused Nydus layers may be built with other filters
+	if pathFilter != nil && (opt.CacheBackend != nil || opt.IncrementalRemote != nil) {
+		return nil, errors.New("Path filter conflicts with cache and incremental image")
+	}
+	// The squashed layer is recorded with the chain ID of its top layer
+	if (opt.Squash > 0 || opt.Flatten) && (opt.CacheBackend != nil || opt.IncrementalRemote != nil) {
+		return nil, errors.New("Squash conflicts with cache and incremental image")
+	}
+
+	if err := opt.Scratch.Validate(); err != nil {
+		return nil, err
+	}
+	// The rootfs of source layers isn't available in streaming
+	if opt.Scratch.Type == build.ScratchStream {
+		if opt.CheckConfig || opt.CriticalPathBudget > 0 || opt.SBOMFormat != "" {
+			return nil, errors.New("Stream scratch conflicts with config check, critical path budget and SBOM")
+		}
+		if pathFilter != nil || len(opt.Hooks) > 0 || opt.MaxFileSize > 0 {
+			return nil, errors.New("Stream scratch conflicts with path filter, hooks and max file size")
+		}
+		if opt.Scanner != nil {
+			return nil, errors.New("Stream scratch conflicts with vulnerability scanning")
+		}
+	}
+	if opt.VulnReport != "" && opt.Scanner == nil {
+		return nil, errors.New("Vulnerability report requires scanner")
+	}
+
 	// Built layer has to go somewhere. Storage backend is the media holing layer blob.
 	backend, err := backend.NewBackend(opt.BackendType, []byte(opt.BackendConfig), opt.TargetRemote)
 	if err != nil {
@@ -111,17 +448,60 @@ func New(opt Opt) (*Converter, error) {
 	}
 
 	return &Converter{
-		Logger:          opt.Logger,
-		SourceProviders: opt.SourceProviders,
-		TargetRemote:    opt.TargetRemote,
-		CacheRemote:     opt.CacheRemote,
-		CacheMaxRecords: opt.CacheMaxRecords,
-		CacheVersion:    opt.CacheVersion,
-		NydusImagePath:  opt.NydusImagePath,
-		WorkDir:         opt.WorkDir,
-		PrefetchDir:     opt.PrefetchDir,
-		MultiPlatform:   opt.MultiPlatform,
-		DockerV2Format:  opt.DockerV2Format,
+		Logger:            opt.Logger,
+		SourceProviders:   opt.SourceProviders,
+		TargetRemote:      opt.TargetRemote,
+		CacheBackend:      opt.CacheBackend,
+		CacheMaxRecords:   opt.CacheMaxRecords,
+		CacheVersion:      cacheVersion,
+		CacheTTL:          opt.CacheTTL,
+		CacheDryRun:       opt.CacheDryRun,
+		DedupRemote:       opt.DedupRemote,
+		IncrementalRemote: opt.IncrementalRemote,
+		ChunkBloom:        opt.ChunkBloom,
+		WhiteoutSpec:      opt.WhiteoutSpec,
+		TargetFormat:      opt.TargetFormat,
+		Compressor:        opt.Compressor,
+		FsVersion:         opt.FsVersion,
+		ChunkSize:         opt.ChunkSize,
+		BatchSize:         opt.BatchSize,
+		CheckConfig:       opt.CheckConfig,
+		SBOMFormat:        opt.SBOMFormat,
+		Provenance:        opt.Provenance,
+		SourceRef:         opt.SourceRef,
+		AliasLabel:        opt.AliasLabel,
+		ConfigMutation:    opt.ConfigMutation,
+		NydusImagePath:    opt.NydusImagePath,
+		Runner:            opt.Runner,
+		WorkDir:           opt.WorkDir,
+		PrefetchDir:       opt.PrefetchDir,
+		MultiPlatform:     opt.MultiPlatform,
+		DockerV2Format:    opt.DockerV2Format,
+		Referrer:          opt.Referrer,
+		ManifestAssembler: opt.ManifestAssembler,
+		Encrypter:         opt.Encrypter,
+		Signer:            opt.Signer,
+		Progress:          opt.Progress,
+		Metrics:           opt.Metrics,
+		Hooks:             opt.Hooks,
+		IncludePaths:      opt.IncludePaths,
+		ExcludePaths:      opt.ExcludePaths,
+		Squash:            opt.Squash,
+		Flatten:           opt.Flatten,
+		Scratch:           opt.Scratch,
+		Scanner:           opt.Scanner,
+		VulnReport:        opt.VulnReport,
+
+		CriticalPathBudget:       opt.CriticalPathBudget,
+		CriticalPathBudgetStrict: opt.CriticalPathBudgetStrict,
+
+		MaxBlobSize: opt.MaxBlobSize,
+		MaxLayers:   opt.MaxLayers,
+		MaxFileSize: opt.MaxFileSize,
+
+		pathFilter:  pathFilter,
+		pullLimiter: ratelimit.New(opt.PullRateLimit),
+		pushLimiter: ratelimit.New(opt.PushRateLimit),
 
 		storageBackend: backend,
 	}, nil
@@ -140,14 +520,61 @@ func findSupportedSource(ctx context.Context, sources []provider.SourceProvider)
 	return nil, fmt.Errorf("not found supported platform in source image")
 }
 
+// checkImage checks image config and critical path budget against the
+// rootfs merged from source layers, and returns the merged rootfs, it's
+// no-op if checker is nil.
+func (cvt *Converter) checkImage(ctx context.Context, checker *configChecker, buildLayers []*buildLayer) (rootfs, error) {
+	if checker == nil {
+		return nil, nil
+	}
+	r, err := checker.Merge(ctx, buildLayers)
+	if err != nil {
+		return nil, errors.Wrap(err, "Merge source layers")
+	}
+	if cvt.CheckConfig {
+		checkDone := logger.Log(ctx, "[CONF] Check image config", nil)
+		if err := checkDone(checker.CheckRootfs(r)); err != nil {
+			return nil, errors.Wrap(err, "Check image config")
+		}
+	}
+	if cvt.CriticalPathBudget > 0 {
+		if err := checker.CheckBudget(
+			ctx, r, cvt.PrefetchDir, cvt.CriticalPathBudget, cvt.CriticalPathBudgetStrict,
+		); err != nil {
+			return nil, errors.Wrap(err, "Check critical path budget")
+		}
+	}
+	return r, nil
+}
+
+// manifestAssembler returns the specified manifest assembler, or the
+// built-in one selected by multi-platform and referrer options.
+func (cvt *Converter) manifestAssembler() ManifestAssembler {
+	if cvt.ManifestAssembler != nil {
+		return cvt.ManifestAssembler
+	}
+	if cvt.Referrer {
+		return &ReferrerAssembler{}
+	}
+	if cvt.MultiPlatform {
+		return &IndexAssembler{}
+	}
+	return &TagAssembler{}
+}
+
 func (cvt *Converter) convert(ctx context.Context) error {
 	logger = cvt.Logger
 
 	logrus.Infof("Converting to %s", cvt.TargetRemote.Ref)
+	started := time.Now()
+
+	if cvt.TargetFormat == TargetFormatEstargz {
+		return cvt.convertEstargz(ctx)
+	}
 
 	// Try to pull Nydus cache image from remote registry
 	cg, err := newCacheGlue(
-		ctx, cvt.CacheMaxRecords, cvt.CacheVersion, cvt.DockerV2Format, cvt.TargetRemote, cvt.CacheRemote, cvt.storageBackend,
+		ctx, cvt.CacheMaxRecords, cvt.CacheVersion, cvt.CacheTTL, cvt.DockerV2Format, cvt.CacheDryRun, cvt.TargetRemote, cvt.CacheBackend, cvt.storageBackend,
 	)
 	if err != nil {
 		return errors.Wrap(err, "Pull cache image")
@@ -161,14 +588,55 @@ func (cvt *Converter) convert(ctx context.Context) error {
 	if err := os.MkdirAll(bootstrapsDir, 0755); err != nil {
 		return errors.Wrap(err, "Create bootstrap directory")
 	}
+
+	// Try to pull the bootstrap of dedup image as chunk dictionary
+	dg, err := newDedupGlue(ctx, cvt.DedupRemote, cvt.WorkDir)
+	if err != nil {
+		return errors.Wrap(err, "Pull dedup image")
+	}
+
+	// Try to pull the source layer records of previous image for reusing
+	// the Nydus layers built from the shared source layers
+	ig, err := newIncrementalGlue(ctx, cvt.IncrementalRemote, cvt.FsVersion)
+	if err != nil {
+		return errors.Wrap(err, "Pull incremental image")
+	}
+
 	buildWorkflow, err := build.NewWorkflow(build.WorkflowOption{
 		NydusImagePath: cvt.NydusImagePath,
+		Runner:         cvt.Runner,
 		PrefetchDir:    cvt.PrefetchDir,
 		TargetDir:      cvt.WorkDir,
+		ChunkDictPath:  dg.BootstrapPath(),
+		Compressor:     cvt.Compressor,
+		FsVersion:      cvt.FsVersion,
+		ChunkSize:      cvt.ChunkSize,
+		BatchSize:      cvt.BatchSize,
+		Scratch:        cvt.Scratch,
 	})
 	if err != nil {
 		return errors.Wrap(err, "Create build flow")
 	}
+	defer func() {
+		if err := buildWorkflow.Close(); err != nil {
+			logrus.Warnf("Failed to clean up scratch space: %s", err)
+		}
+	}()
+	// Reject the options unsupported by nydus-image before pulling source
+	// layers, the in-tree nydus-image only supports none, lz4_block and
+	// gzip compressors, and doesn't support chunk dictionary
+	if cvt.Compressor == CompressorZstd || cvt.DedupRemote != nil {
+		features, err := buildWorkflow.Features()
+		if err != nil {
+			return errors.Wrap(err, "Probe nydus-image")
+		}
+		if cvt.Compressor == CompressorZstd && !features.Zstd {
+			return fmt.Errorf("Compressor zstd is unsupported by nydus-image %s", features.Version)
+		}
+		if cvt.DedupRemote != nil && !features.ChunkDict {
+			return fmt.Errorf("Dedup image and chunk dictionary require --chunk-dict option unsupported by nydus-image %s", features.Version)
+		}
+	}
 
 	if cvt.SourceProviders == nil || len(cvt.SourceProviders) == 0 {
 		return errors.New("Invalid source provider")
@@ -177,20 +645,51 @@ func (cvt *Converter) convert(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "Find supported platform")
 	}
+	// The source manifest is only recorded for audit, it's nil for the
+	// source image without manifest, e.g. in docker archive
+	if sourceManifest, err := sourceProvider.Manifest(ctx); err == nil {
+		cvt.sourceManifest = sourceManifest
+	}
+
+	// The source layers are indexed for checking image config, estimating
+	// critical path size, generating SBOM and filtering the vulnerabilities
+	// of packages upgraded in upper layers
+	var checker *configChecker
+	if cvt.CheckConfig || cvt.CriticalPathBudget > 0 || cvt.SBOMFormat != "" || cvt.Scanner != nil {
+		config, err := sourceProvider.Config(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Get source image config")
+		}
+		// The mutated user and entrypoint are checked
+		cvt.ConfigMutation.Apply(config)
+		checker = newConfigChecker(config.Config)
+		checker.indexPackageDB = cvt.SBOMFormat != "" || cvt.Scanner != nil
+	}
+	vs := newVulnScanner(cvt.Scanner)
 
 	sourceLayers, err := sourceProvider.Layers(ctx)
 	if err != nil {
 		return errors.Wrap(err, "Get source layers")
 	}
+	// The squashed layer takes the index of its top source layer, which
+	// relates it to the source history and diff IDs
+	sourceCount := len(sourceLayers)
+	sourceLayers = squashLayers(sourceLayers, cvt.Squash, cvt.Flatten, filepath.Join(cvt.WorkDir, "squash"))
+	squashedCount := sourceCount - len(sourceLayers)
+	limits := newLimitChecker(cvt.MaxBlobSize, cvt.MaxLayers, cvt.MaxFileSize)
+	if err := limits.CheckLayers(len(sourceLayers)); err != nil {
+		return err
+	}
 	pullWorker := utils.NewQueueWorkerPool(PullWorkerCount, uint(len(sourceLayers)))
 	pushWorker := utils.NewWorkerPool(PushWorkerCount, uint(len(sourceLayers)))
 	buildLayers := []*buildLayer{}
+	zstdBootstrap := useZstdBootstrap(cvt.Compressor, cvt.DockerV2Format)
 
 	// Pull and mount source layer in pull worker
 	var parentBuildLayer *buildLayer
 	for idx, sourceLayer := range sourceLayers {
 		buildLayer := &buildLayer{
-			index:          idx,
+			index:          idx + squashedCount,
 			buildWorkflow:  buildWorkflow,
 			bootstrapsDir:  bootstrapsDir,
 			cacheGlue:      cg,
@@ -198,7 +697,15 @@ func (cvt *Converter) convert(ctx context.Context) error {
 			source:         sourceLayer,
 			parent:         parentBuildLayer,
 			dockerV2Format: cvt.DockerV2Format,
+			whiteoutSpec:   cvt.WhiteoutSpec,
 			backend:        cvt.storageBackend,
+			compressor:     cvt.Compressor,
+			fsVersion:      cvt.FsVersion,
+			zstdBootstrap:  zstdBootstrap,
+			encrypter:      cvt.Encrypter,
+			pathFilter:     cvt.pathFilter,
+
+			incrementalGlue: ig,
 		}
 		parentBuildLayer = buildLayer
 		buildLayers = append(buildLayers, buildLayer)
@@ -225,11 +732,45 @@ func (cvt *Converter) convert(ctx context.Context) error {
 
 			// Skip building if we found the cache record in cache image
 			if job.layer.Cached() {
+				if desc := job.layer.cacheRecord.NydusBlobDesc; desc != nil {
+					if err := limits.AddBlob(desc.Size); err != nil {
+						return err
+					}
+				}
+				if job.layer.incremental {
+					cvt.Metrics.ObserveLayer(metrics.LayerReused)
+				} else {
+					cvt.Metrics.ObserveLayer(metrics.LayerCached)
+				}
 				continue
 			}
 
-			// Build source layer to Nydus layer by invoking Nydus image builder
-			err := job.layer.Build(ctx)
+			// Build source layer to Nydus layer by invoking Nydus image builder,
+			// the built blob is checked against the limits before pushing
+			err := hooks(cvt.Hooks).beforeBuild(ctx, hookLayer(job.layer, false))
+			if err == nil {
+				err = limits.CheckFiles(job.layer.sourceMount.Source)
+			}
+			if err == nil {
+				err = job.layer.Build(ctx)
+			}
+			if err == nil {
+				err = hooks(cvt.Hooks).afterBuild(ctx, hookLayer(job.layer, true))
+			}
+			if err == nil {
+				err = limits.AddBlobFile(job.layer.blobPath)
+			}
+			if err == nil && checker != nil {
+				// Index source layer before umounting it for checking image config
+				if err = checker.IndexLayer(job.layer.index, job.layer.sourceMount); err != nil {
+					err = errors.Wrap(err, "Index source layer")
+				}
+			}
+			if err == nil && vs != nil {
+				if err = vs.ScanLayer(ctx, job.layer, job.layer.sourceMount); err != nil {
+					err = errors.Wrap(err, "Scan source layer")
+				}
+			}
 
 			go func() {
 				// Umount source layer after building in order to save the disk
@@ -242,6 +783,7 @@ func (cvt *Converter) convert(ctx context.Context) error {
 			if err != nil {
 				return errors.Wrap(err, "Build source layer")
 			}
+			cvt.Metrics.ObserveLayer(metrics.LayerBuilt)
 
 			// Push Nydus layer (bootstrap & blob) to target registry
 			pushWorker.Put(func() error {
@@ -261,29 +803,134 @@ func (cvt *Converter) convert(ctx context.Context) error {
 		return errors.Wrap(err, "Push Nydus layer in wait")
 	}
 
+	// Check image config and critical path budget before pushing manifest,
+	// the source layers hit in cache will be pulled again for checking
+	r, err := cvt.checkImage(ctx, checker, buildLayers)
+	if err != nil {
+		return err
+	}
+	// Fail the conversion before pushing manifest if the image is vulnerable,
+	// the pushed blobs are left unreferenced
+	vulns, err := cvt.scanImage(ctx, vs, r, buildLayers)
+	if err != nil {
+		return err
+	}
+
+	// Make the blobs of dedup image referenced by target bootstrap
+	// available in target storage backend
+	var blobIDs []string
+	var dedupBlobs []ocispec.Descriptor
+	if dg != nil {
+		blobIDs, err = buildWorkflow.BlobIDs()
+		if err != nil {
+			return errors.Wrap(err, "Get blob list of bootstrap")
+		}
+		dedupBlobs, err = dg.Push(ctx, blobIDs, cvt.storageBackend, cvt.TargetRemote)
+		if err != nil {
+			return errors.Wrap(err, "Push dedup blobs")
+		}
+	}
+
+	var chunkBloom *ocispec.Descriptor
+	if cvt.ChunkBloom {
+		chunkBloom, err = pushChunkBloom(ctx, buildWorkflow, buildLayers[len(buildLayers)-1], cvt.TargetRemote)
+		if err != nil {
+			return errors.Wrap(err, "Push chunk bloom filter")
+		}
+	}
+
+	if err := hooks(cvt.Hooks).beforePushManifest(ctx, hookImage(cvt.TargetRemote.Ref, buildLayers)); err != nil {
+		return err
+	}
+
+	var source *alias.Source
+	if cvt.AliasLabel {
+		sourceManifest, err := sourceProvider.Manifest(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Get source image manifest")
+		}
+		aliasSource := alias.NewSource(cvt.SourceRef, sourceManifest.Digest)
+		source = &aliasSource
+	}
+
 	// Push OCI manifest, Nydus manifest and manifest index
 	mm := &manifestManager{
 		sourceProvider: sourceProvider,
 		remote:         cvt.TargetRemote,
 		backend:        cvt.storageBackend,
-		multiPlatform:  cvt.MultiPlatform,
 		dockerV2Format: cvt.DockerV2Format,
+		assembler:      cvt.manifestAssembler(),
+		blobIDs:        blobIDs,
+		dedupBlobs:     dedupBlobs,
+		chunkBloom:     chunkBloom,
+		mutation:       cvt.ConfigMutation,
+		source:         source,
 	}
 	pushDone := logger.Log(ctx, "[MANI] Push manifest", nil)
-	if err := mm.Push(ctx, buildLayers); err != nil {
+	manifestDesc, err := mm.Push(ctx, buildLayers)
+	if err != nil {
 		// When encounter http 400 error during pushing manifest to remote registry, means the
 		// manifest is invalid, maybe the cache layer is not available in registry with a high
 		// probability caused by registry GC, for example the cache image be overwritten by another
 		// conversion progress, and the registry GC be triggered in the same time
-		if cvt.CacheRemote != nil && strings.Contains(err.Error(), "400") {
+		if (cvt.CacheBackend != nil || cvt.IncrementalRemote != nil) && strings.Contains(err.Error(), "400") {
 			logrus.Warnf("Push manifest: %s", err)
 			return pushDone(errInvalidCache)
 		}
 		return pushDone(errors.Wrap(err, "Push target manifest"))
 	}
 	pushDone(nil)
+	cvt.targetManifest = manifestDesc
+
+	if source != nil {
+		entry := alias.Entry{
+			Digest:  manifestDesc.Digest,
+			Source:  *source,
+			Created: time.Now().UTC(),
+		}
+		// The Nydus manifest pushed as referrer isn't tagged
+		if !cvt.Referrer {
+			entry.Tag = cvt.TargetRemote.Tag()
+		}
+		if err := alias.Record(ctx, cvt.TargetRemote, entry); err != nil {
+			return errors.Wrap(err, "Record conversion index")
+		}
+	}
+
+	if chunkBloom != nil {
+		if _, err := pushChunkBloomArtifact(ctx, cvt.TargetRemote, *chunkBloom, *manifestDesc); err != nil {
+			return errors.Wrap(err, "Push chunk bloom artifact")
+		}
+	}
+
+	if cvt.SBOMFormat != "" || cvt.Provenance {
+		environment := map[string]string{}
+		if features, err := buildWorkflow.Features(); err == nil && features.Version != "" {
+			environment["nydus-image"] = features.Version
+		}
+		if err := cvt.attest(ctx, r, sourceProvider, *manifestDesc, started, environment); err != nil {
+			return errors.Wrap(err, "Attest target manifest")
+		}
+	}
+	if vulns != nil {
+		if err := cvt.pushVulnReport(ctx, vulns, *manifestDesc); err != nil {
+			return errors.Wrap(err, "Push vulnerability report")
+		}
+	}
+
+	if cvt.Signer != nil {
+		ref := cvt.TargetRemote.DigestReference(manifestDesc.Digest)
+		signDone := logger.Log(ctx, "[SIGN] Sign manifest", provider.LoggerFields{
+			"Tool":   cvt.Signer.Tool,
+			"Digest": manifestDesc.Digest,
+		})
+		if err := signDone(cvt.Signer.Sign(ctx, ref)); err != nil {
+			return errors.Wrap(err, "Sign target manifest")
+		}
+	}
 
 	// Push Nydus cache image to remote registry
+	cvt.cacheStats = cg.Stats(buildLayers)
 	if err := cg.Export(ctx, buildLayers); err != nil {
 		return errors.Wrap(err, "Get cache record")
 	}
@@ -295,13 +942,44 @@ func (cvt *Converter) convert(ctx context.Context) error {
 
 // Convert converts source image to target (Nydus) image
 func (cvt *Converter) Convert(ctx context.Context) error {
+	reporter := cvt.Progress
+	if cvt.Metrics != nil {
+		reporter = reporter.WithHook(cvt.Metrics.Observe)
+	}
+	ctx = progress.WithReporter(ctx, reporter)
+	ctx = ratelimit.WithPullLimiter(ctx, cvt.pullLimiter)
+	ctx = ratelimit.WithPushLimiter(ctx, cvt.pushLimiter)
+	task := reporter.Start(progress.StageConvert, cvt.TargetRemote.Ref, 0)
+	return task.Done(cvt.doConvert(ctx))
+}
+
+// TargetManifest returns the descriptor of Nydus manifest pushed in the
+// last successful conversion, it's nil for eStargz target format.
+func (cvt *Converter) TargetManifest() *ocispec.Descriptor {
+	return cvt.targetManifest
+}
+
+// SourceManifest returns the descriptor of source manifest of the platform
+// converted in the last conversion, or nil if it's unknown.
+func (cvt *Converter) SourceManifest() *ocispec.Descriptor {
+	return cvt.sourceManifest
+}
+
+// CacheStats returns the statistics of build cache in the last successful
+// conversion, or nil if build cache isn't used.
+func (cvt *Converter) CacheStats() *CacheStats {
+	return cvt.cacheStats
+}
+
+func (cvt *Converter) doConvert(ctx context.Context) error {
 	if err := cvt.convert(ctx); err != nil {
 		if errors.Is(err, errInvalidCache) {
 			// Retry to convert without cache if the cache is invalid. we can't ensure the
 			// cache is always valid during conversion progress, the registry will refuse
 			// the Nydus manifest included invalid layer (purged by registry GC) pulled from
 			// cache record, so retry without cache is a middle ground at this point
-			cvt.CacheRemote = nil
+			cvt.CacheBackend = nil
+			cvt.IncrementalRemote = nil
 			retryDone := logger.Log(ctx, "Retrying to convert without cache", nil)
 			return retryDone(cvt.convert(ctx))
 		}
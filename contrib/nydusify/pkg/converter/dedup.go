@@ -0,0 +1,158 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// dedupGlue pulls the bootstrap of an existing Nydus image as the chunk
+// dictionary for building, the chunks already existed in the blobs of
+// dedup image will be referenced instead of being dumped to the new blob.
+type dedupGlue struct {
+	remote        *remote.Remote
+	bootstrapPath string
+	// Blob descriptors of dedup image, the value is nil if the
+	// blob isn't recorded in manifest layers, e.g. OSS backend.
+	blobs map[string]*ocispec.Descriptor
+}
+
+func newDedupGlue(ctx context.Context, dedupRemote *remote.Remote, workDir string) (*dedupGlue, error) {
+	if dedupRemote == nil {
+		return nil, nil
+	}
+
+	pullDone := logger.Log(ctx, fmt.Sprintf("[DEDU] Pull chunk dictionary from %s", dedupRemote.Ref), nil)
+
+	parsed, err := parser.New(dedupRemote).Parse(ctx)
+	if err != nil {
+		return nil, pullDone(errors.Wrap(err, "Parse dedup image"))
+	}
+	if parsed.NydusImage == nil {
+		return nil, pullDone(fmt.Errorf("Not found Nydus manifest in dedup image %s", dedupRemote.Ref))
+	}
+
+	dedupDir := filepath.Join(workDir, "dedup")
+	if err := os.RemoveAll(dedupDir); err != nil {
+		return nil, pullDone(errors.Wrap(err, "Remove dedup directory"))
+	}
+	if err := os.MkdirAll(dedupDir, 0755); err != nil {
+		return nil, pullDone(errors.Wrap(err, "Create dedup directory"))
+	}
+	bootstrapPath := filepath.Join(dedupDir, "bootstrap")
+
+	reader, err := parser.New(dedupRemote).PullNydusBootstrap(ctx, parsed.NydusImage)
+	if err != nil {
+		return nil, pullDone(errors.Wrap(err, "Pull dedup bootstrap layer"))
+	}
+	defer reader.Close()
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, bootstrapPath); err != nil {
+		return nil, pullDone(errors.Wrap(err, "Unpack dedup bootstrap layer"))
+	}
+
+	blobs := make(map[string]*ocispec.Descriptor)
+	layers := parsed.NydusImage.Manifest.Layers
+	for idx := range layers {
+		layer := layers[idx]
+		if layer.Annotations[utils.LayerAnnotationNydusBlob] == "true" {
+			blobs[layer.Digest.Hex()] = &layer
+			continue
+		}
+		if blobIDs, ok := layer.Annotations[utils.LayerAnnotationNydusBlobIDs]; ok {
+			var ids []string
+			if err := json.Unmarshal([]byte(blobIDs), &ids); err != nil {
+				return nil, pullDone(errors.Wrap(err, "Unmarshal blob list of dedup image"))
+			}
+			for _, id := range ids {
+				if _, ok := blobs[id]; !ok {
+					blobs[id] = nil
+				}
+			}
+		}
+	}
+
+	return &dedupGlue{
+		remote:        dedupRemote,
+		bootstrapPath: bootstrapPath,
+		blobs:         blobs,
+	}, pullDone(nil)
+}
+
+// BootstrapPath returns the bootstrap path used as chunk dictionary.
+func (dg *dedupGlue) BootstrapPath() string {
+	if dg == nil {
+		return ""
+	}
+	return dg.bootstrapPath
+}
+
+// Push ensures that the blobs of dedup image referenced by the built
+// bootstrap are available in target storage backend, returns the
+// descriptors of these blobs.
+func (dg *dedupGlue) Push(
+	ctx context.Context, blobIDs []string, targetBackend backend.Backend, targetRemote *remote.Remote,
+) ([]ocispec.Descriptor, error) {
+	if dg == nil {
+		return nil, nil
+	}
+
+	descs := []ocispec.Descriptor{}
+	for _, blobID := range blobIDs {
+		desc, ok := dg.blobs[blobID]
+		if !ok {
+			continue
+		}
+
+		if targetBackend.Type() != backend.RegistryBackend {
+			exist, err := targetBackend.Check(blobID)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Check dedup blob %s", blobID)
+			}
+			if !exist {
+				return nil, fmt.Errorf("Dedup blob %s not found in storage backend", blobID)
+			}
+			continue
+		}
+
+		if desc == nil {
+			return nil, fmt.Errorf("Dedup blob %s not found in manifest of %s", blobID, dg.remote.Ref)
+		}
+
+		// The dedup image may be located in different namespace/repo,
+		// copy the blob to target repo to make it available for Nydusd.
+		pushDone := logger.Log(ctx, "[DEDU] Push dedup blob", provider.LoggerFields{
+			"Digest": digest.NewDigestFromEncoded(digest.SHA256, blobID),
+		})
+		if err := utils.WithRetry(func() error {
+			reader, err := dg.remote.Pull(ctx, *desc, true)
+			if err != nil {
+				return errors.Wrap(err, "Pull dedup blob")
+			}
+			defer reader.Close()
+			return targetRemote.Push(ctx, *desc, true, reader)
+		}); err != nil {
+			return nil, pushDone(errors.Wrapf(err, "Push dedup blob %s", blobID))
+		}
+		pushDone(nil)
+
+		descs = append(descs, *desc)
+	}
+
+	return descs, nil
+}
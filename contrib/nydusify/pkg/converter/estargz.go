@@ -0,0 +1,560 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/estargz"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	// TargetFormatNydus converts source image to Nydus image.
+	TargetFormatNydus = "nydus"
+	// TargetFormatEstargz converts source layers to eStargz layers, which
+	// can be lazily pulled by stargz snapshotter.
+	TargetFormatEstargz = "estargz"
+
+	ociOpaqueWhiteout  = ociWhiteoutPrefix + ociWhiteoutPrefix + ".opq"
+	overlayXattrPrefix = "trusted.overlay."
+)
+
+func validTargetFormat(format string) bool {
+	switch format {
+	case "", TargetFormatNydus, TargetFormatEstargz:
+		return true
+	}
+	return false
+}
+
+// estargzEntry is a file of source layer to be written into eStargz
+// layer, the path is empty for the whiteout converted from overlayfs.
+type estargzEntry struct {
+	header *tar.Header
+	path   string
+}
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// walkLayer collects the tar entries of files in source layer in lexical
+// order, the overlayfs whiteouts are converted to OCI whiteouts since the
+// eStargz layer is a regular OCI layer.
+func walkLayer(dir, spec string) ([]*estargzEntry, error) {
+	entries := []*estargzEntry{}
+	hardlinks := map[inode]string{}
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if spec == WhiteoutSpecOverlayfs && isOverlayWhiteout(info) {
+			entries = append(entries, &estargzEntry{header: &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     path.Join(path.Dir(rel), ociWhiteoutPrefix+path.Base(rel)),
+				ModTime:  info.ModTime(),
+			}})
+			return nil
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			logrus.Warnf("Skip socket /%s in source layer", rel)
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return errors.Wrapf(err, "Make tar header of /%s", rel)
+		}
+		header.Name = rel
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		// The user and group names on host are meaningless in image
+		header.Uname = ""
+		header.Gname = ""
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+
+		if names, err := xattr.LList(p); err == nil {
+			for _, name := range names {
+				if strings.HasPrefix(name, overlayXattrPrefix) {
+					continue
+				}
+				value, err := xattr.LGet(p, name)
+				if err != nil {
+					return errors.Wrapf(err, "Get xattr %s of /%s", name, rel)
+				}
+				if header.PAXRecords == nil {
+					header.PAXRecords = make(map[string]string)
+				}
+				header.PAXRecords["SCHILY.xattr."+name] = string(value)
+			}
+		}
+
+		entry := &estargzEntry{header: header}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && header.Typeflag == tar.TypeReg && stat.Nlink > 1 {
+			key := inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+			if target, ok := hardlinks[key]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = target
+				header.Size = 0
+			} else {
+				hardlinks[key] = rel
+			}
+		}
+		if header.Typeflag == tar.TypeReg {
+			entry.path = p
+		}
+		entries = append(entries, entry)
+
+		if spec == WhiteoutSpecOverlayfs && info.IsDir() && isOverlayOpaque(p) {
+			entries = append(entries, &estargzEntry{header: &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     path.Join(rel, ociOpaqueWhiteout),
+				ModTime:  info.ModTime(),
+			}})
+		}
+
+		return nil
+	})
+
+	return entries, err
+}
+
+// prioritizeEntries moves the files in prefetch paths to the front of
+// layer with their parent directories, the hard links stay in place so
+// that they are always behind the target files.
+func prioritizeEntries(entries []*estargzEntry, prefetchDir string) ([]*estargzEntry, []*estargzEntry) {
+	paths := prefetchPaths(prefetchDir)
+	matched := func(name string) bool {
+		p := "/" + strings.TrimSuffix(name, "/")
+		for _, prefix := range paths {
+			prefix = strings.TrimSuffix(prefix, "/")
+			if p == prefix || strings.HasPrefix(p, prefix+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	dirs := map[string]int{}
+	for idx, entry := range entries {
+		if entry.header.Typeflag == tar.TypeDir {
+			dirs[strings.TrimSuffix(entry.header.Name, "/")] = idx
+		}
+	}
+
+	prioritized := []*estargzEntry{}
+	moved := map[int]bool{}
+	for idx, entry := range entries {
+		typ := entry.header.Typeflag
+		if typ == tar.TypeDir || typ == tar.TypeLink || !matched(entry.header.Name) {
+			continue
+		}
+		parts := strings.Split(entry.header.Name, "/")
+		for i := 1; i < len(parts); i++ {
+			if dirIdx, ok := dirs[strings.Join(parts[:i], "/")]; ok && !moved[dirIdx] {
+				prioritized = append(prioritized, entries[dirIdx])
+				moved[dirIdx] = true
+			}
+		}
+		prioritized = append(prioritized, entry)
+		moved[idx] = true
+	}
+
+	rest := []*estargzEntry{}
+	for idx, entry := range entries {
+		if !moved[idx] {
+			rest = append(rest, entry)
+		}
+	}
+
+	return prioritized, rest
+}
+
+// writeEstargz writes the files of source layer into eStargz layer, the
+// files in prefetch paths are put before the prefetch landmark.
+func writeEstargz(w io.Writer, mount *sourceMount, prefetchDir string) (*estargz.Result, error) {
+	entries, err := walkLayer(mount.Source, mount.WhiteoutSpec)
+	if err != nil {
+		return nil, errors.Wrap(err, "Walk source layer")
+	}
+	prioritized, rest := prioritizeEntries(entries, prefetchDir)
+
+	appendEntry := func(sw *estargz.Writer, entry *estargzEntry) error {
+		if entry.path == "" || entry.header.Size == 0 {
+			return sw.Append(entry.header, nil)
+		}
+		file, err := os.Open(entry.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return sw.Append(entry.header, file)
+	}
+
+	sw := estargz.NewWriter(w)
+	if len(prioritized) == 0 {
+		if err := sw.AppendLandmark(false); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range prioritized {
+		if err := appendEntry(sw, entry); err != nil {
+			return nil, err
+		}
+	}
+	if len(prioritized) > 0 {
+		if err := sw.AppendLandmark(true); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range rest {
+		if err := appendEntry(sw, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	return sw.Close()
+}
+
+// estargzLayer is the eStargz layer built from source layer.
+type estargzLayer struct {
+	desc   ocispec.Descriptor
+	diffID digest.Digest
+	path   string
+}
+
+func (cvt *Converter) buildEstargzLayer(ctx context.Context, layer *buildLayer, blobsDir string) (*estargzLayer, error) {
+	buildDone := logger.Log(ctx, "[ESGZ] Build layer", provider.LoggerFields{
+		"Digest": layer.source.Digest(),
+		"Size":   humanize.Bytes(uint64(layer.source.Size())),
+	})
+
+	blobPath := filepath.Join(blobsDir, strconv.Itoa(layer.index+1)+"-"+layer.source.Digest().Hex())
+	file, err := os.Create(blobPath)
+	if err != nil {
+		return nil, buildDone(errors.Wrap(err, "Create eStargz blob file"))
+	}
+	defer file.Close()
+
+	digester := digest.Canonical.Digester()
+	cw := &countWriter{w: io.MultiWriter(file, digester.Hash())}
+	task := progress.FromContext(ctx).Start(progress.StageBuild, layer.source.Digest().String(), layer.source.Size())
+	result, err := writeEstargz(cw, layer.sourceMount, cvt.PrefetchDir)
+	if err := task.Done(err); err != nil {
+		return nil, buildDone(errors.Wrapf(err, "Build source layer %s", layer.source.Digest()))
+	}
+
+	mediaType := ocispec.MediaTypeImageLayerGzip
+	if cvt.DockerV2Format {
+		mediaType = images.MediaTypeDockerSchema2LayerGzip
+	}
+
+	return &estargzLayer{
+		desc: ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    digester.Digest(),
+			Size:      cw.n,
+			Annotations: map[string]string{
+				estargz.TOCDigestAnnotation:        result.TOCDigest.String(),
+				estargz.UncompressedSizeAnnotation: strconv.FormatInt(result.UncompressedSize, 10),
+			},
+		},
+		diffID: result.DiffID,
+		path:   blobPath,
+	}, buildDone(nil)
+}
+
+func (cvt *Converter) pushEstargzLayer(ctx context.Context, layer *estargzLayer) error {
+	pushDone := logger.Log(ctx, "[ESGZ] Push layer", provider.LoggerFields{
+		"Digest": layer.desc.Digest,
+		"Size":   humanize.Bytes(uint64(layer.desc.Size)),
+	})
+	defer os.Remove(layer.path)
+
+	task := progress.FromContext(ctx).Start(progress.StagePush, layer.desc.Digest.String(), layer.desc.Size)
+	return pushDone(task.Done(utils.WithRetry(func() error {
+		file, err := os.Open(layer.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return cvt.TargetRemote.PushBlob(progress.WithTask(ctx, task), layer.desc, file)
+	})))
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// convertEstargz converts the source layers to eStargz layers one by one
+// instead of building Nydus layers, the image config is kept except the
+// diff ids of layers.
+func (cvt *Converter) convertEstargz(ctx context.Context) error {
+	if len(cvt.SourceProviders) == 0 {
+		return errors.New("Invalid source provider")
+	}
+	sourceProvider, err := findSupportedSource(ctx, cvt.SourceProviders)
+	if err != nil {
+		return errors.Wrap(err, "Find supported platform")
+	}
+	if sourceManifest, err := sourceProvider.Manifest(ctx); err == nil {
+		cvt.sourceManifest = sourceManifest
+	}
+
+	blobsDir := filepath.Join(cvt.WorkDir, "estargz")
+	if err := os.RemoveAll(blobsDir); err != nil {
+		return errors.Wrap(err, "Remove eStargz directory")
+	}
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return errors.Wrap(err, "Create eStargz directory")
+	}
+
+	var checker *configChecker
+	if cvt.CheckConfig || cvt.CriticalPathBudget > 0 {
+		config, err := sourceProvider.Config(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Get source image config")
+		}
+		cvt.ConfigMutation.Apply(config)
+		checker = newConfigChecker(config.Config)
+	}
+
+	sourceLayers, err := sourceProvider.Layers(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Get source layers")
+	}
+	limits := newLimitChecker(cvt.MaxBlobSize, cvt.MaxLayers, cvt.MaxFileSize)
+	if err := limits.CheckLayers(len(sourceLayers)); err != nil {
+		return err
+	}
+	pullWorker := utils.NewQueueWorkerPool(PullWorkerCount, uint(len(sourceLayers)))
+	pushWorker := utils.NewWorkerPool(PushWorkerCount, uint(len(sourceLayers)))
+	buildLayers := []*buildLayer{}
+	layers := make([]*estargzLayer, len(sourceLayers))
+
+	for idx, sourceLayer := range sourceLayers {
+		buildLayer := &buildLayer{
+			index:        idx,
+			cacheGlue:    &cacheGlue{},
+			source:       sourceLayer,
+			whiteoutSpec: cvt.WhiteoutSpec,
+		}
+		buildLayers = append(buildLayers, buildLayer)
+		if err := pullWorker.Put(&mountJob{
+			ctx:   ctx,
+			layer: buildLayer,
+		}); err != nil {
+			return errors.Wrap(err, "Put layer pull job to worker")
+		}
+	}
+
+	for _, jobChan := range pullWorker.Waiter() {
+		select {
+		case _job := <-jobChan:
+			if _job.Err() != nil {
+				return errors.Wrap(_job.Err(), "Pull source layer")
+			}
+			job := _job.(*mountJob)
+
+			var layer *estargzLayer
+			err := limits.CheckFiles(job.layer.sourceMount.Source)
+			if err == nil {
+				layer, err = cvt.buildEstargzLayer(ctx, job.layer, blobsDir)
+			}
+			if err == nil {
+				err = limits.AddBlob(layer.desc.Size)
+			}
+			if err == nil && checker != nil {
+				if err = checker.IndexLayer(job.layer.index, job.layer.sourceMount); err != nil {
+					err = errors.Wrap(err, "Index source layer")
+				}
+			}
+
+			go func() {
+				if err := job.Umount(); err != nil {
+					logrus.Warnf("Failed to umount layer %s: %s", job.layer.source.Digest(), err)
+				}
+			}()
+
+			if err != nil {
+				return errors.Wrap(err, "Build eStargz layer")
+			}
+			cvt.Metrics.ObserveLayer(metrics.LayerBuilt)
+
+			layers[job.layer.index] = layer
+			pushWorker.Put(func() error {
+				return cvt.pushEstargzLayer(ctx, layer)
+			})
+		case err := <-pushWorker.Err():
+			if err != nil {
+				return errors.Wrap(err, "Push eStargz layer in worker")
+			}
+		}
+	}
+
+	if err := <-pushWorker.Waiter(); err != nil {
+		return errors.Wrap(err, "Push eStargz layer in wait")
+	}
+
+	if _, err := cvt.checkImage(ctx, checker, buildLayers); err != nil {
+		return err
+	}
+
+	pushDone := logger.Log(ctx, "[MANI] Push manifest", nil)
+	if err := cvt.pushEstargzManifest(ctx, sourceProvider, layers); err != nil {
+		return pushDone(errors.Wrap(err, "Push target manifest"))
+	}
+	pushDone(nil)
+
+	logrus.Infof("Converted to %s", cvt.TargetRemote.Ref)
+
+	return nil
+}
+
+func (cvt *Converter) pushEstargzManifest(ctx context.Context, sourceProvider provider.SourceProvider, layers []*estargzLayer) error {
+	config, err := sourceProvider.Config(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Get source image config")
+	}
+	config.RootFS.DiffIDs = []digest.Digest{}
+	cvt.ConfigMutation.Apply(config)
+	descs := []ocispec.Descriptor{}
+	for _, layer := range layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.diffID)
+		descs = append(descs, layer.desc)
+	}
+
+	configMediaType := ocispec.MediaTypeImageConfig
+	manifestMediaType := ocispec.MediaTypeImageManifest
+	if cvt.DockerV2Format {
+		configMediaType = images.MediaTypeDockerSchema2Config
+		manifestMediaType = images.MediaTypeDockerSchema2Manifest
+	}
+
+	configDesc, configBytes, err := utils.MarshalToDesc(config, configMediaType)
+	if err != nil {
+		return errors.Wrap(err, "Marshal image config")
+	}
+	if err := cvt.TargetRemote.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return errors.Wrap(err, "Push image config")
+	}
+
+	manifest := struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{
+		MediaType: manifestMediaType,
+		Manifest: ocispec.Manifest{
+			Versioned: specs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: *configDesc,
+			Layers: descs,
+		},
+	}
+	cvt.ConfigMutation.Annotate(&manifest.Manifest)
+	manifestDesc, manifestBytes, err := utils.MarshalToDesc(manifest, manifestMediaType)
+	if err != nil {
+		return errors.Wrap(err, "Marshal image manifest")
+	}
+	if err := cvt.TargetRemote.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
+		return errors.Wrap(err, "Push image manifest")
+	}
+
+	return nil
+}
+
+// checkEstargzOpt returns error if the option can't be applied to eStargz
+// target format.
+func checkEstargzOpt(opt Opt) error {
+	if opt.CacheBackend != nil || opt.DedupRemote != nil || opt.IncrementalRemote != nil {
+		return errors.New("eStargz target format conflicts with cache, dedup and incremental image")
+	}
+	if opt.ChunkBloom || opt.MultiPlatform || opt.Referrer || opt.ManifestAssembler != nil {
+		return errors.New("eStargz target format conflicts with chunk bloom, multi-platform, referrer and manifest assembler")
+	}
+	if opt.BackendType != "" && opt.BackendType != "registry" {
+		return fmt.Errorf("eStargz target format conflicts with backend type %s", opt.BackendType)
+	}
+	if opt.Compressor != "" {
+		return errors.New("eStargz target format conflicts with compressor")
+	}
+	if opt.Signer != nil {
+		return errors.New("eStargz target format conflicts with signing")
+	}
+	if opt.Encrypter != nil {
+		return errors.New("eStargz target format conflicts with encryption")
+	}
+	if len(opt.Hooks) > 0 {
+		return errors.New("eStargz target format conflicts with hooks")
+	}
+	if (opt.Scratch.Type != "" && opt.Scratch.Type != build.ScratchDisk) || opt.Scratch.Dir != "" || opt.Scratch.Size > 0 {
+		return errors.New("eStargz target format conflicts with scratch")
+	}
+	if len(opt.IncludePaths) > 0 || len(opt.ExcludePaths) > 0 {
+		return errors.New("eStargz target format conflicts with path filter")
+	}
+	if opt.SBOMFormat != "" || opt.Provenance {
+		return errors.New("eStargz target format conflicts with SBOM and provenance")
+	}
+	if opt.Scanner != nil {
+		return errors.New("eStargz target format conflicts with vulnerability scanning")
+	}
+	if opt.Squash > 0 || opt.Flatten {
+		return errors.New("eStargz target format conflicts with squash")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/estargz"
+)
+
+func TestWriteEstargz(t *testing.T) {
+	dir := createLayer(t, []testFile{
+		{path: "bin", link: "usr/bin"},
+		{path: "usr/bin/app", content: "app", mode: 0755},
+		{path: "usr/lib/libc.so", content: "libc", mode: 0644},
+		{path: "etc/config", content: "config", mode: 0644},
+		{path: "etc/.wh.removed", mode: 0644},
+	})
+	defer os.RemoveAll(dir)
+	require.Nil(t, os.Link(filepath.Join(dir, "usr/lib/libc.so"), filepath.Join(dir, "usr/lib/libc.so.6")))
+	mount := &sourceMount{Source: dir, WhiteoutSpec: WhiteoutSpecOCI}
+
+	entryNames := func(prefetchDir string) []string {
+		buf := bytes.NewBuffer(nil)
+		result, err := writeEstargz(buf, mount, prefetchDir)
+		require.Nil(t, err)
+		toc, tocDigest, err := estargz.ReadTOC(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.Nil(t, err)
+		assert.Equal(t, result.TOCDigest, tocDigest)
+		names := []string{}
+		for _, entry := range toc.Entries {
+			names = append(names, entry.Type+":"+entry.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{
+		"reg:" + estargz.NoPrefetchLandmark,
+		"symlink:bin", "dir:etc", "reg:etc/.wh.removed", "reg:etc/config",
+		"dir:usr", "dir:usr/bin", "reg:usr/bin/app", "dir:usr/lib", "reg:usr/lib/libc.so", "hardlink:usr/lib/libc.so.6",
+	}, entryNames(""))
+
+	// The prioritized files are moved to the front with parent directories
+	assert.Equal(t, []string{
+		"dir:usr", "dir:usr/bin", "reg:usr/bin/app", "dir:usr/lib", "reg:usr/lib/libc.so",
+		"reg:" + estargz.PrefetchLandmark,
+		"symlink:bin", "dir:etc", "reg:etc/.wh.removed", "reg:etc/config", "hardlink:usr/lib/libc.so.6",
+	}, entryNames("/usr/bin\n/usr/lib/libc.so\n/not-exist"))
+}
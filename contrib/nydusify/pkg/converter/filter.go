@@ -0,0 +1,181 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathFilter drops the files from source layers by glob patterns before
+// building, the patterns are absolute paths in rootfs matched segment by
+// segment with path.Match, and `**` matches zero or more segments. A path
+// matches a pattern if itself or one of its parents matches, so that a
+// directory pattern covers all its descendants.
+//
+// The same patterns are applied to all layers, and a whiteout is filtered
+// as the path it removes, so the files dropped from lower layers don't
+// reappear from upper layers and vice versa.
+type pathFilter struct {
+	include [][]string
+	exclude [][]string
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(path.Clean(p), "/"), "/")
+}
+
+func parsePatterns(patterns []string) ([][]string, error) {
+	parsed := [][]string{}
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("Path pattern %s should be absolute", pattern)
+		}
+		segments := splitPath(pattern)
+		for _, segment := range segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("Invalid path pattern %s: %s", pattern, err)
+			}
+		}
+		parsed = append(parsed, segments)
+	}
+	return parsed, nil
+}
+
+// newPathFilter creates the filter keeping the paths matched by include
+// patterns and not matched by exclude patterns, all paths are included if
+// no include pattern is specified. It returns nil if no pattern specified.
+func newPathFilter(include, exclude []string) (*pathFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	includePatterns, err := parsePatterns(include)
+	if err != nil {
+		return nil, err
+	}
+	excludePatterns, err := parsePatterns(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &pathFilter{
+		include: includePatterns,
+		exclude: excludePatterns,
+	}, nil
+}
+
+// matchSegments matches the path segments against the pattern segments,
+// if partial is true, it also returns true if the path may be the parent
+// of a matched path.
+func matchSegments(pattern, segments []string, partial bool) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for idx := 0; idx <= len(segments); idx++ {
+				if matchSegments(pattern[1:], segments[idx:], partial) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return partial
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// covered returns true if the path or one of its parents matches any of
+// the patterns.
+func covered(patterns [][]string, segments []string) bool {
+	for _, pattern := range patterns {
+		for idx := 1; idx <= len(segments); idx++ {
+			if matchSegments(pattern, segments[:idx], false) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mayContain returns true if the descendants of the directory may match
+// any of the patterns.
+func mayContain(patterns [][]string, segments []string) bool {
+	for _, pattern := range patterns {
+		if matchSegments(pattern, segments, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// keep decides whether to keep the path, descend is true if the path
+// is a directory not kept but its descendants may be kept.
+func (filter *pathFilter) keep(p string, dir bool) (keep bool, descend bool) {
+	segments := splitPath(p)
+	if covered(filter.exclude, segments) {
+		return false, false
+	}
+	if len(filter.include) == 0 || covered(filter.include, segments) {
+		return true, false
+	}
+	if dir && mayContain(filter.include, segments) {
+		return false, true
+	}
+	return false, false
+}
+
+// Filter removes the files not kept from the unpacked source layer in
+// dir, and returns the count of removed files.
+func (filter *pathFilter) Filter(dir string) (int, error) {
+	removed := 0
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		p := "/" + filepath.ToSlash(rel)
+
+		// The opaque whiteout belongs to its parent directory, and other
+		// whiteouts are filtered as the path they remove, which may be a
+		// directory
+		name := info.Name()
+		if name == ociWhiteoutOpaque {
+			return nil
+		}
+		isDir := info.IsDir()
+		if strings.HasPrefix(name, ociWhiteoutPrefix) {
+			p = path.Join(path.Dir(p), strings.TrimPrefix(name, ociWhiteoutPrefix))
+			isDir = true
+		} else if isOverlayWhiteout(info) {
+			isDir = true
+		}
+
+		// Keep the whiteout of directory containing included paths too
+		if keep, descend := filter.keep(p, isDir); keep || descend {
+			return nil
+		}
+		if err := os.RemoveAll(file); err != nil {
+			return err
+		}
+		removed++
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
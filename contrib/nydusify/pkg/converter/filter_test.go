@@ -0,0 +1,116 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPathFilter(t *testing.T) {
+	filter, err := newPathFilter(nil, nil)
+	require.Nil(t, err)
+	assert.Nil(t, filter)
+
+	_, err = newPathFilter([]string{"usr/bin"}, nil)
+	assert.Contains(t, err.Error(), "should be absolute")
+
+	_, err = newPathFilter(nil, []string{"/usr/[a-"})
+	assert.Contains(t, err.Error(), "Invalid path pattern")
+
+	filter, err = newPathFilter([]string{"/usr/**/*.so"}, []string{"/usr/share/"})
+	require.Nil(t, err)
+	assert.Equal(t, [][]string{{"usr", "**", "*.so"}}, filter.include)
+	assert.Equal(t, [][]string{{"usr", "share"}}, filter.exclude)
+}
+
+func TestPathFilterKeep(t *testing.T) {
+	filter, err := newPathFilter(
+		[]string{"/usr/**/*.so", "/etc"},
+		[]string{"/etc/*.bak", "/**/test"},
+	)
+	require.Nil(t, err)
+
+	for _, tc := range []struct {
+		path    string
+		dir     bool
+		keep    bool
+		descend bool
+	}{
+		{"/etc", true, true, false},
+		{"/etc/hosts", false, true, false},
+		{"/etc/ssl/certs", true, true, false},
+		{"/etc/hosts.bak", false, false, false},
+		{"/usr/lib/libc.so", false, true, false},
+		{"/usr/libc.so", false, true, false},
+		{"/usr/lib/test/libc.so", false, false, false},
+		{"/usr", true, false, true},
+		{"/usr/lib/x86_64", true, false, true},
+		{"/usr/lib/test", true, false, false},
+		{"/usr/lib/libc.a", false, false, false},
+		{"/var", true, false, false},
+		{"/var/log", false, false, false},
+	} {
+		keep, descend := filter.keep(tc.path, tc.dir)
+		assert.Equal(t, tc.keep, keep, tc.path)
+		assert.Equal(t, tc.descend, descend, tc.path)
+	}
+}
+
+func TestPathFilterFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-filter-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{
+		"etc/hosts",
+		"etc/.wh..wh..opq",
+		"usr/lib/libc.so",
+		"usr/lib/libc.a",
+		"usr/share/doc/README",
+		"usr/.wh.local",
+		"usr/lib/.wh.libz.so",
+		"usr/share/.wh.man",
+		"var/log/messages",
+		".wh.opt",
+	} {
+		path := filepath.Join(dir, file)
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, ioutil.WriteFile(path, []byte(file), 0644))
+	}
+
+	filter, err := newPathFilter([]string{"/usr/**/*.so", "/etc"}, []string{"/usr/share"})
+	require.Nil(t, err)
+	removed, err := filter.Filter(dir)
+	require.Nil(t, err)
+	assert.Equal(t, 4, removed)
+
+	files := []string{}
+	require.Nil(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(dir, path)
+		files = append(files, rel)
+		return err
+	}))
+	sort.Strings(files)
+	assert.Equal(t, strings.Join([]string{
+		".",
+		"etc",
+		"etc/.wh..wh..opq",
+		"etc/hosts",
+		"usr",
+		// The removed path may be a directory containing included paths
+		"usr/.wh.local",
+		"usr/lib",
+		"usr/lib/.wh.libz.so",
+		"usr/lib/libc.so",
+	}, "\n"), strings.Join(files, "\n"))
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	historyCreatedBy        = "nydusify"
+	historyCommentBlob      = "nydus blob"
+	historyCommentDedupBlob = "nydus blob referenced from chunk dict"
+	historyCommentBootstrap = "nydus bootstrap"
+)
+
+// noSource marks the layer of Nydus image not built from a source layer,
+// i.e. the bootstrap layer and the blobs from chunk dict.
+const noSource = -1
+
+// withSourceAnnotations returns a copy of blob layer annotated with the
+// digest and diff id of source layer producing it, so that the tooling
+// like vulnerability scanner can trace the blob back to source layer. The
+// annotations are removed if they are empty, e.g. for the blobs from chunk
+// dict, which are produced by the layers of other images.
+func withSourceAnnotations(desc ocispec.Descriptor, source digest.Digest, diffID digest.Digest) ocispec.Descriptor {
+	annotations := map[string]string{}
+	for key, value := range desc.Annotations {
+		annotations[key] = value
+	}
+	delete(annotations, utils.LayerAnnotationNydusSourceDigest)
+	delete(annotations, utils.LayerAnnotationNydusSourceDiffID)
+	if source != "" {
+		annotations[utils.LayerAnnotationNydusSourceDigest] = source.String()
+	}
+	if diffID != "" {
+		annotations[utils.LayerAnnotationNydusSourceDiffID] = diffID.String()
+	}
+	desc.Annotations = annotations
+	return desc
+}
+
+// convertHistory converts the history of source image to the history of
+// Nydus image, layerSources is the index of source layer producing each
+// layer of Nydus image, or noSource.
+//
+// The history entry of source layer is kept as is if the layer produces a
+// Nydus blob in manifest, otherwise it's kept as an empty layer entry, e.g.
+// the layer without files or the blob stored in storage backend. The entries
+// are added for the layers not built from source layers, so that the count
+// of non-empty entries always matches the layers of Nydus image.
+func convertHistory(history []ocispec.History, sourceLayers int, layerSources []int) []ocispec.History {
+	// The index of history entry of each source layer
+	positions := []int{}
+	for idx, entry := range history {
+		if !entry.EmptyLayer {
+			positions = append(positions, idx)
+		}
+	}
+	if len(positions) != sourceLayers {
+		if len(history) > 0 {
+			logrus.Warnf(
+				"Drop source image history, unmatched number of non-empty history entries and layers: %d != %d",
+				len(positions), sourceLayers,
+			)
+		}
+		history = nil
+		positions = nil
+	}
+
+	converted := []ocispec.History{}
+	next := 0
+	flush := func(end int) {
+		for ; next < end; next++ {
+			entry := history[next]
+			entry.EmptyLayer = true
+			converted = append(converted, entry)
+		}
+	}
+
+	for idx, source := range layerSources {
+		if source != noSource && source < len(positions) && positions[source] >= next {
+			flush(positions[source])
+			converted = append(converted, history[positions[source]])
+			next = positions[source] + 1
+			continue
+		}
+		comment := historyCommentBlob
+		if idx == len(layerSources)-1 {
+			// The bootstrap layer is the topmost layer
+			flush(len(history))
+			comment = historyCommentBootstrap
+		} else if source == noSource {
+			comment = historyCommentDedupBlob
+		}
+		converted = append(converted, ocispec.History{
+			CreatedBy: historyCreatedBy,
+			Comment:   comment,
+		})
+	}
+	flush(len(history))
+
+	return converted
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestConvertHistory(t *testing.T) {
+	history := []ocispec.History{
+		{CreatedBy: "ADD rootfs.tar /"},
+		{CreatedBy: "ENV PATH=/bin", EmptyLayer: true},
+		{CreatedBy: "RUN mkdir /data"},
+		{CreatedBy: "RUN apt-get install"},
+	}
+	bootstrap := ocispec.History{CreatedBy: historyCreatedBy, Comment: historyCommentBootstrap}
+
+	// The second source layer produces no blob
+	assert.Equal(t, []ocispec.History{
+		{CreatedBy: "ADD rootfs.tar /"},
+		{CreatedBy: "ENV PATH=/bin", EmptyLayer: true},
+		{CreatedBy: "RUN mkdir /data", EmptyLayer: true},
+		{CreatedBy: "RUN apt-get install"},
+		bootstrap,
+	}, convertHistory(history, 3, []int{0, 2, noSource}))
+
+	// The blobs are stored in storage backend
+	assert.Equal(t, []ocispec.History{
+		{CreatedBy: "ADD rootfs.tar /", EmptyLayer: true},
+		{CreatedBy: "ENV PATH=/bin", EmptyLayer: true},
+		{CreatedBy: "RUN mkdir /data", EmptyLayer: true},
+		{CreatedBy: "RUN apt-get install", EmptyLayer: true},
+		bootstrap,
+	}, convertHistory(history, 3, []int{noSource}))
+
+	// The blobs from chunk dict are ordered before the built blobs
+	assert.Equal(t, []ocispec.History{
+		{CreatedBy: historyCreatedBy, Comment: historyCommentDedupBlob},
+		{CreatedBy: "ADD rootfs.tar /", EmptyLayer: true},
+		{CreatedBy: "ENV PATH=/bin", EmptyLayer: true},
+		{CreatedBy: "RUN mkdir /data"},
+		{CreatedBy: historyCreatedBy, Comment: historyCommentBlob},
+		{CreatedBy: "RUN apt-get install", EmptyLayer: true},
+		bootstrap,
+	}, convertHistory(history, 3, []int{noSource, 1, 0, noSource}))
+
+	// The source history doesn't match source layers
+	assert.Equal(t, []ocispec.History{
+		{CreatedBy: historyCreatedBy, Comment: historyCommentBlob},
+		bootstrap,
+	}, convertHistory(history, 2, []int{0, noSource}))
+}
+
+func TestWithSourceAnnotations(t *testing.T) {
+	source := digest.FromString("source")
+	diffID := digest.FromString("diff")
+	desc := ocispec.Descriptor{
+		Digest:      digest.FromString("blob"),
+		Annotations: map[string]string{utils.LayerAnnotationNydusBlob: "true"},
+	}
+
+	annotated := withSourceAnnotations(desc, source, diffID)
+	assert.Equal(t, map[string]string{
+		utils.LayerAnnotationNydusBlob:         "true",
+		utils.LayerAnnotationNydusSourceDigest: source.String(),
+		utils.LayerAnnotationNydusSourceDiffID: diffID.String(),
+	}, annotated.Annotations)
+	// The annotations of original descriptor aren't changed
+	assert.Len(t, desc.Annotations, 1)
+
+	assert.Equal(t, desc.Annotations, withSourceAnnotations(annotated, "", "").Annotations)
+}
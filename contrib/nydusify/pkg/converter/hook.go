@@ -0,0 +1,194 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// HookEvent is the stage of conversion at which the hooks are invoked.
+type HookEvent string
+
+const (
+	// HookBeforeBuild is invoked after the source layer is mounted and
+	// before it's built, the files in source directory can be filtered.
+	HookBeforeBuild HookEvent = "before-build"
+	// HookAfterBuild is invoked after the Nydus blob and bootstrap of the
+	// layer are built and before they are pushed.
+	HookAfterBuild HookEvent = "after-build"
+	// HookBeforePushManifest is invoked after all layers are pushed and
+	// before the Nydus manifest is pushed.
+	HookBeforePushManifest HookEvent = "before-push-manifest"
+)
+
+// HookLayer is the layer context passed to hooks.
+type HookLayer struct {
+	Index        int    `json:"index"`
+	SourceDigest string `json:"source_digest"`
+	// SourceDir is the directory of mounted source layer.
+	SourceDir string `json:"source_dir"`
+	// BlobPath and BootstrapPath are the built Nydus blob and bootstrap,
+	// only available after building, the blob path is empty if the
+	// layer has no data.
+	BlobPath      string `json:"blob_path,omitempty"`
+	BootstrapPath string `json:"bootstrap_path,omitempty"`
+}
+
+// HookImageLayer is a layer of target image passed to hooks.
+type HookImageLayer struct {
+	Index        int    `json:"index"`
+	SourceDigest string `json:"source_digest"`
+	// BlobDigest is the digest of Nydus blob, it's empty if the layer has
+	// no data.
+	BlobDigest string `json:"blob_digest,omitempty"`
+	// Cached is true if the layer is from cache or previous image instead
+	// of being built in this conversion.
+	Cached bool `json:"cached"`
+}
+
+// HookImage is the image context passed to hooks.
+type HookImage struct {
+	Target string `json:"target"`
+	// BootstrapPath is the bootstrap of the top layer, it's empty if the
+	// top layer is cached and not pulled.
+	BootstrapPath string           `json:"bootstrap_path,omitempty"`
+	Layers        []HookImageLayer `json:"layers"`
+}
+
+// Hook injects custom steps into conversion, e.g. virus scanning, SBOM
+// generation or file filtering, the conversion is aborted if a hook
+// returns error. The hooks are invoked in the order they are specified,
+// the layer hooks are invoked only for the layers built in this
+// conversion.
+type Hook interface {
+	BeforeBuild(ctx context.Context, layer *HookLayer) error
+	AfterBuild(ctx context.Context, layer *HookLayer) error
+	BeforePushManifest(ctx context.Context, image *HookImage) error
+}
+
+// hookMessage is the JSON message written to the stdin of exec hook.
+type hookMessage struct {
+	Event HookEvent  `json:"event"`
+	Layer *HookLayer `json:"layer,omitempty"`
+	Image *HookImage `json:"image,omitempty"`
+}
+
+// ExecHook is a hook implemented by an external program, it's executed
+// for each event with the event name as the only argument, and the event
+// message in JSON written to stdin, e.g.
+// `{"event":"after-build","layer":{"index":0,...}}`. The conversion is
+// aborted if the program exits with non-zero status.
+type ExecHook struct {
+	Path string
+}
+
+func (hook *ExecHook) run(ctx context.Context, message hookMessage) error {
+	input, err := json.Marshal(message)
+	if err != nil {
+		return errors.Wrap(err, "Marshal hook message")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook.Path, string(message.Event))
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	logrus.Debugf("Running hook %s %s", hook.Path, message.Event)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Run hook %s: %s: %s", hook.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	if output := strings.TrimSpace(stdout.String()); output != "" {
+		logrus.Infof("Hook %s: %s", hook.Path, output)
+	}
+	return nil
+}
+
+func (hook *ExecHook) BeforeBuild(ctx context.Context, layer *HookLayer) error {
+	return hook.run(ctx, hookMessage{Event: HookBeforeBuild, Layer: layer})
+}
+
+func (hook *ExecHook) AfterBuild(ctx context.Context, layer *HookLayer) error {
+	return hook.run(ctx, hookMessage{Event: HookAfterBuild, Layer: layer})
+}
+
+func (hook *ExecHook) BeforePushManifest(ctx context.Context, image *HookImage) error {
+	return hook.run(ctx, hookMessage{Event: HookBeforePushManifest, Image: image})
+}
+
+// hooks invokes the hooks in order and stops at the first error.
+type hooks []Hook
+
+func (hs hooks) beforeBuild(ctx context.Context, layer *HookLayer) error {
+	for _, hook := range hs {
+		if err := hook.BeforeBuild(ctx, layer); err != nil {
+			return errors.Wrapf(err, "Hook %s of layer %d", HookBeforeBuild, layer.Index)
+		}
+	}
+	return nil
+}
+
+func (hs hooks) afterBuild(ctx context.Context, layer *HookLayer) error {
+	for _, hook := range hs {
+		if err := hook.AfterBuild(ctx, layer); err != nil {
+			return errors.Wrapf(err, "Hook %s of layer %d", HookAfterBuild, layer.Index)
+		}
+	}
+	return nil
+}
+
+func (hs hooks) beforePushManifest(ctx context.Context, image *HookImage) error {
+	for _, hook := range hs {
+		if err := hook.BeforePushManifest(ctx, image); err != nil {
+			return errors.Wrapf(err, "Hook %s", HookBeforePushManifest)
+		}
+	}
+	return nil
+}
+
+// hookLayer makes the hook context of mounted layer, the built files are
+// included if built is true.
+func hookLayer(layer *buildLayer, built bool) *HookLayer {
+	hl := &HookLayer{
+		Index:        layer.index,
+		SourceDigest: layer.source.Digest().String(),
+		SourceDir:    layer.sourceMount.Source,
+	}
+	if built {
+		hl.BlobPath = layer.blobPath
+		hl.BootstrapPath = layer.bootstrapPath
+	}
+	return hl
+}
+
+// hookImage makes the hook context of target image from pushed layers.
+func hookImage(target string, layers []*buildLayer) *HookImage {
+	image := &HookImage{
+		Target: target,
+		Layers: []HookImageLayer{},
+	}
+	for _, layer := range layers {
+		record := layer.GetCacheRecord()
+		hl := HookImageLayer{
+			Index:        layer.index,
+			SourceDigest: layer.source.Digest().String(),
+			Cached:       layer.Cached(),
+		}
+		if record.NydusBlobDesc != nil {
+			hl.BlobDigest = record.NydusBlobDesc.Digest.String()
+		}
+		image.Layers = append(image.Layers, hl)
+	}
+	if top := layers[len(layers)-1]; !top.Cached() {
+		image.BootstrapPath = top.bootstrapPath
+	}
+	return image
+}
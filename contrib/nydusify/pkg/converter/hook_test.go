@@ -0,0 +1,162 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
+)
+
+type hookSourceLayer struct {
+	digest digest.Digest
+	size   int64
+}
+
+func (layer *hookSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	return nil, nil, nil
+}
+
+func (layer *hookSourceLayer) Size() int64 {
+	return layer.size
+}
+
+func (layer *hookSourceLayer) Digest() digest.Digest {
+	return layer.digest
+}
+
+func (layer *hookSourceLayer) ChainID() digest.Digest {
+	return layer.digest
+}
+
+func (layer *hookSourceLayer) ParentChainID() *digest.Digest {
+	return nil
+}
+
+type recordHook struct {
+	events []HookEvent
+	err    error
+}
+
+func (hook *recordHook) BeforeBuild(ctx context.Context, layer *HookLayer) error {
+	hook.events = append(hook.events, HookBeforeBuild)
+	return hook.err
+}
+
+func (hook *recordHook) AfterBuild(ctx context.Context, layer *HookLayer) error {
+	hook.events = append(hook.events, HookAfterBuild)
+	return hook.err
+}
+
+func (hook *recordHook) BeforePushManifest(ctx context.Context, image *HookImage) error {
+	hook.events = append(hook.events, HookBeforePushManifest)
+	return hook.err
+}
+
+func TestExecHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-hook-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	outputPath := filepath.Join(dir, "output.json")
+	hookPath := filepath.Join(dir, "hook.sh")
+	require.Nil(t, ioutil.WriteFile(hookPath, []byte(`#!/bin/sh
+if [ "$1" = "before-push-manifest" ]; then
+  echo "manifest is rejected" >&2
+  exit 1
+fi
+cat > `+outputPath+`
+`), 0755))
+
+	hook := &ExecHook{Path: hookPath}
+	layer := &buildLayer{
+		index:         1,
+		source:        &hookSourceLayer{digest: "sha256:aaa"},
+		sourceMount:   &sourceMount{Source: "/source"},
+		blobPath:      "/blob",
+		bootstrapPath: "/bootstrap",
+	}
+
+	require.Nil(t, hook.BeforeBuild(context.Background(), hookLayer(layer, false)))
+	output, err := ioutil.ReadFile(outputPath)
+	require.Nil(t, err)
+	var message hookMessage
+	require.Nil(t, json.Unmarshal(output, &message))
+	assert.Equal(t, hookMessage{
+		Event: HookBeforeBuild,
+		Layer: &HookLayer{Index: 1, SourceDigest: "sha256:aaa", SourceDir: "/source"},
+	}, message)
+
+	require.Nil(t, hook.AfterBuild(context.Background(), hookLayer(layer, true)))
+	output, err = ioutil.ReadFile(outputPath)
+	require.Nil(t, err)
+	message = hookMessage{}
+	require.Nil(t, json.Unmarshal(output, &message))
+	assert.Equal(t, HookAfterBuild, message.Event)
+	assert.Equal(t, "/blob", message.Layer.BlobPath)
+	assert.Equal(t, "/bootstrap", message.Layer.BootstrapPath)
+
+	err = hook.BeforePushManifest(context.Background(), &HookImage{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "manifest is rejected")
+}
+
+func TestHooks(t *testing.T) {
+	first := &recordHook{err: errors.New("rejected")}
+	second := &recordHook{}
+	hs := hooks{first, second}
+
+	err := hs.beforeBuild(context.Background(), &HookLayer{Index: 2})
+	assert.Contains(t, err.Error(), "Hook before-build of layer 2: rejected")
+	assert.Equal(t, []HookEvent{HookBeforeBuild}, first.events)
+	assert.Empty(t, second.events)
+
+	first.err = nil
+	require.Nil(t, hs.afterBuild(context.Background(), &HookLayer{}))
+	require.Nil(t, hs.beforePushManifest(context.Background(), &HookImage{}))
+	assert.Equal(t, []HookEvent{HookAfterBuild, HookBeforePushManifest}, second.events)
+
+	// No hook
+	require.Nil(t, hooks(nil).beforeBuild(context.Background(), &HookLayer{}))
+}
+
+func TestHookImage(t *testing.T) {
+	diffID := digest.Digest("sha256:ddd")
+	layers := []*buildLayer{
+		{
+			index:  0,
+			source: &hookSourceLayer{digest: "sha256:aaa"},
+			cacheRecord: &cache.CacheRecord{
+				NydusBlobDesc: &ocispec.Descriptor{Digest: "sha256:bbb"},
+			},
+		},
+		{
+			index:           1,
+			source:          &hookSourceLayer{digest: "sha256:ccc"},
+			bootstrapPath:   "/bootstrap",
+			bootstrapDiffID: &diffID,
+		},
+	}
+	assert.Equal(t, &HookImage{
+		Target:        "target",
+		BootstrapPath: "/bootstrap",
+		Layers: []HookImageLayer{
+			{Index: 0, SourceDigest: "sha256:aaa", BlobDigest: "sha256:bbb", Cached: true},
+			{Index: 1, SourceDigest: "sha256:ccc"},
+		},
+	}, hookImage("target", layers))
+}
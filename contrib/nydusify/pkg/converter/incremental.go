@@ -0,0 +1,201 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// sourceLayer records the Nydus layer built from a source layer, the
+// records of all layers are written to the bootstrap layer annotation
+// of Nydus manifest, so that the next conversion of the repository can
+// reuse the layers built from the shared source layers.
+type sourceLayer struct {
+	ChainID   digest.Digest       `json:"chain_id"`
+	Bootstrap ocispec.Descriptor  `json:"bootstrap"`
+	Blob      *ocispec.Descriptor `json:"blob,omitempty"`
+}
+
+// makeSourceLayers converts the build records to the source layer
+// records, only the fields required for reusing the layer are kept.
+func makeSourceLayers(records []cache.CacheRecord) []sourceLayer {
+	layers := []sourceLayer{}
+	for _, record := range records {
+		layer := sourceLayer{
+			ChainID: record.SourceChainID,
+			Bootstrap: ocispec.Descriptor{
+				MediaType: record.NydusBootstrapDesc.MediaType,
+				Digest:    record.NydusBootstrapDesc.Digest,
+				Size:      record.NydusBootstrapDesc.Size,
+				Annotations: map[string]string{
+					utils.LayerAnnotationUncompressed: record.NydusBootstrapDiffID.String(),
+				},
+			},
+		}
+		if record.NydusBlobDesc != nil {
+			layer.Blob = &ocispec.Descriptor{
+				MediaType: record.NydusBlobDesc.MediaType,
+				Digest:    record.NydusBlobDesc.Digest,
+				Size:      record.NydusBlobDesc.Size,
+			}
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// toCacheRecord converts the source layer record to the cache record
+// used by build layer, as if it's hit in the cache image.
+func (layer *sourceLayer) toCacheRecord() (*cache.CacheRecord, error) {
+	diffID := digest.Digest(layer.Bootstrap.Annotations[utils.LayerAnnotationUncompressed])
+	if err := diffID.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid bootstrap diff id of layer %s", layer.ChainID)
+	}
+	bootstrapDesc := layer.Bootstrap
+	bootstrapDesc.Annotations = map[string]string{
+		utils.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationUncompressed:   diffID.String(),
+	}
+	var blobDesc *ocispec.Descriptor
+	if layer.Blob != nil {
+		blobDesc = &ocispec.Descriptor{
+			MediaType: utils.MediaTypeNydusBlob,
+			Digest:    layer.Blob.Digest,
+			Size:      layer.Blob.Size,
+			Annotations: map[string]string{
+				// Use `utils.LayerAnnotationUncompressed` to generate
+				// DiffID of layer defined in OCI spec
+				utils.LayerAnnotationUncompressed: layer.Blob.Digest.String(),
+				utils.LayerAnnotationNydusBlob:    "true",
+			},
+		}
+	}
+	return &cache.CacheRecord{
+		SourceChainID:        layer.ChainID,
+		NydusBlobDesc:        blobDesc,
+		NydusBootstrapDesc:   &bootstrapDesc,
+		NydusBootstrapDiffID: diffID,
+	}, nil
+}
+
+// incrementalGlue reuses the Nydus layers of the image previously
+// converted in the same repository, the source layers shared with
+// previous image (having the same ChainID) are not built again, the
+// bootstrap and blob layers already existed in the repository.
+type incrementalGlue struct {
+	remote  *remote.Remote
+	records map[digest.Digest]*cache.CacheRecord
+}
+
+func newIncrementalGlue(ctx context.Context, previousRemote *remote.Remote, fsVersion string) (*incrementalGlue, error) {
+	if previousRemote == nil {
+		return nil, nil
+	}
+
+	pullDone := logger.Log(ctx, fmt.Sprintf("[INCR] Pull previous image %s", previousRemote.Ref), nil)
+
+	parsed, err := parser.New(previousRemote).Parse(ctx)
+	if err != nil {
+		return nil, pullDone(errors.Wrap(err, "Parse previous image"))
+	}
+	if parsed.NydusImage == nil {
+		return nil, pullDone(fmt.Errorf("Not found Nydus manifest in previous image %s", previousRemote.Ref))
+	}
+
+	glue := &incrementalGlue{
+		remote:  previousRemote,
+		records: make(map[digest.Digest]*cache.CacheRecord),
+	}
+
+	layers := parsed.NydusImage.Manifest.Layers
+	if len(layers) == 0 {
+		return nil, pullDone(fmt.Errorf("Not found Nydus bootstrap layer in previous image %s", previousRemote.Ref))
+	}
+	// The layers of other RAFS version can't be reused
+	previousFsVersion := layers[len(layers)-1].Annotations[utils.LayerAnnotationNydusFsVersion]
+	if previousFsVersion == "" {
+		previousFsVersion = FsVersionV5
+	}
+	if fsVersion == "" {
+		fsVersion = FsVersionV5
+	}
+	if previousFsVersion != fsVersion {
+		logrus.Warnf("Not reuse layers of previous image %s in RAFS v%s", previousRemote.Ref, previousFsVersion)
+		return glue, pullDone(nil)
+	}
+	recordsJSON, ok := layers[len(layers)-1].Annotations[utils.LayerAnnotationNydusSourceLayers]
+	if !ok {
+		// The previous image may be converted by an old version, all
+		// layers will be built as usual.
+		logrus.Warnf("Not found source layer records in previous image %s", previousRemote.Ref)
+		return glue, pullDone(nil)
+	}
+	var sourceLayers []sourceLayer
+	if err := json.Unmarshal([]byte(recordsJSON), &sourceLayers); err != nil {
+		return nil, pullDone(errors.Wrap(err, "Unmarshal source layer records of previous image"))
+	}
+	for idx := range sourceLayers {
+		record, err := sourceLayers[idx].toCacheRecord()
+		if err != nil {
+			return nil, pullDone(err)
+		}
+		glue.records[record.SourceChainID] = record
+	}
+
+	return glue, pullDone(nil)
+}
+
+// Check returns the record of Nydus layer built from the source layer
+// in previous image, returns nil if the source layer isn't shared.
+func (ig *incrementalGlue) Check(ctx context.Context, sourceLayerChainID digest.Digest) *cache.CacheRecord {
+	if ig == nil {
+		return nil
+	}
+
+	record, ok := ig.records[sourceLayerChainID]
+	if !ok {
+		return nil
+	}
+	logger.Log(ctx, "[INCR] Reuse layer", provider.LoggerFields{
+		"ChainID": sourceLayerChainID,
+	})(nil)
+
+	return record
+}
+
+// PullBootstrap pulls the bootstrap of Nydus layer in previous image
+// as the parent bootstrap for building the next layer.
+func (ig *incrementalGlue) PullBootstrap(
+	ctx context.Context, record *cache.CacheRecord, pulledBootstrapPath string,
+) error {
+	pullDone := logger.Log(ctx, "[INCR] Pull bootstrap", provider.LoggerFields{
+		"ChainID": record.SourceChainID,
+	})
+
+	reader, err := ig.remote.Pull(ctx, *record.NydusBootstrapDesc, true)
+	if err != nil {
+		return pullDone(errors.Wrap(err, "Pull bootstrap layer from previous image"))
+	}
+	defer reader.Close()
+
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, pulledBootstrapPath); err != nil {
+		return pullDone(errors.Wrap(err, "Unpack bootstrap layer of previous image"))
+	}
+
+	return pullDone(nil)
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestSourceLayers(t *testing.T) {
+	bootstrapDiffID := digest.FromString("bootstrap-uncompressed")
+	blobDigest := digest.FromString("blob")
+	records := []cache.CacheRecord{
+		{
+			SourceChainID: digest.FromString("layer1"),
+			NydusBootstrapDesc: &ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromString("bootstrap"),
+				Size:      100,
+				Annotations: map[string]string{
+					utils.LayerAnnotationNydusBootstrap: "true",
+					utils.LayerAnnotationUncompressed:   bootstrapDiffID.String(),
+					utils.LayerAnnotationNydusBlobIDs:   "[]",
+				},
+			},
+			NydusBootstrapDiffID: bootstrapDiffID,
+			NydusBlobDesc: &ocispec.Descriptor{
+				MediaType: utils.MediaTypeNydusBlob,
+				Digest:    blobDigest,
+				Size:      200,
+				Annotations: map[string]string{
+					utils.LayerAnnotationUncompressed: blobDigest.String(),
+					utils.LayerAnnotationNydusBlob:    "true",
+				},
+			},
+		},
+		{
+			// The layer doesn't have blob, e.g. only includes whiteouts
+			SourceChainID: digest.FromString("layer2"),
+			NydusBootstrapDesc: &ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromString("bootstrap2"),
+				Size:      100,
+			},
+			NydusBootstrapDiffID: digest.FromString("bootstrap2-uncompressed"),
+		},
+	}
+
+	data, err := json.Marshal(makeSourceLayers(records))
+	require.Nil(t, err)
+	var layers []sourceLayer
+	require.Nil(t, json.Unmarshal(data, &layers))
+	require.Equal(t, 2, len(layers))
+
+	// The records are restored except for the annotations of last bootstrap
+	// layer written by manifest manager
+	for idx := range layers {
+		record, err := layers[idx].toCacheRecord()
+		require.Nil(t, err)
+		expected := records[idx]
+		bootstrapDesc := *expected.NydusBootstrapDesc
+		bootstrapDesc.Annotations = map[string]string{
+			utils.LayerAnnotationNydusBootstrap: "true",
+			utils.LayerAnnotationUncompressed:   expected.NydusBootstrapDiffID.String(),
+		}
+		expected.NydusBootstrapDesc = &bootstrapDesc
+		assert.Equal(t, expected, *record)
+	}
+
+	layers[0].Bootstrap.Annotations = nil
+	_, err = layers[0].toCacheRecord()
+	assert.NotNil(t, err)
+}
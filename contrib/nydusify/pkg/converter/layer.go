@@ -7,6 +7,7 @@ package converter
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -24,6 +25,8 @@ import (
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/encryption"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
@@ -31,6 +34,10 @@ import (
 type sourceMount struct {
 	Source       string
 	WhiteoutSpec string
+	// Unpacked is true if the source is unpacked by Nydusify in work
+	// directory instead of mounted from other places, it can be modified
+	// before building.
+	Unpacked bool
 }
 
 // Layer should have nothing to do with storage backend.
@@ -43,6 +50,15 @@ type buildLayer struct {
 	cacheGlue      *cacheGlue
 	bootstrapsDir  string
 	dockerV2Format bool
+	whiteoutSpec   string
+	compressor     string
+	fsVersion      string
+	// Compress the bootstrap layer with zstd instead of gzip
+	zstdBootstrap bool
+	// Encrypt the blob layer before pushing if it's not nil
+	encrypter *encryption.Encrypter
+	// Drop the files from source layer before building if it's not nil
+	pathFilter *pathFilter
 
 	cacheRecord     *cache.CacheRecord
 	blobDesc        *ocispec.Descriptor
@@ -53,6 +69,15 @@ type buildLayer struct {
 	blobPath        string
 	bootstrapPath   string
 	backend         backend.Backend
+
+	// tarSource is the source layer streamed into builder without being
+	// unpacked, it's nil if the source layer is mounted.
+	tarSource provider.TarSourceLayer
+
+	// Reuse the Nydus layers of previous image in the same repository,
+	// incremental is true if the cache record is from previous image.
+	incrementalGlue *incrementalGlue
+	incremental     bool
 }
 
 // parseSourceMount parses mounts object returned by the Mount method in
@@ -97,6 +122,7 @@ func parseSourceMount(mounts []mount.Mount) (*sourceMount, error) {
 		return &sourceMount{
 			Source:       mounts[0].Source,
 			WhiteoutSpec: "oci",
+			Unpacked:     true,
 		}, nil
 
 	default:
@@ -116,12 +142,19 @@ func (layer *buildLayer) pushBlob(ctx context.Context) error {
 
 	defer os.Remove(blobPath)
 
+	if layer.encrypter != nil {
+		return layer.pushEncryptedBlob(ctx, blobID, info.Size())
+	}
+
 	if err := utils.WithRetry(func() error {
 		size := info.Size()
 		desc, err := layer.backend.Upload(ctx, blobID, blobPath, size)
 		if err != nil {
 			return err
 		}
+		if layer.compressor != "" {
+			desc.Annotations[utils.LayerAnnotationNydusCompressor] = layer.compressor
+		}
 		layer.blobDesc = desc
 
 		return nil
@@ -132,11 +165,61 @@ func (layer *buildLayer) pushBlob(ctx context.Context) error {
 	return nil
 }
 
+// pushEncryptedBlob encrypts blob and pushes it to target, the blob id is
+// recorded in annotation since the layer digest is changed, nydusd can't
+// find the blob by its id until the layer is decrypted.
+func (layer *buildLayer) pushEncryptedBlob(ctx context.Context, blobID string, size int64) error {
+	encryptedPath := layer.blobPath + ".encrypted"
+	defer os.Remove(encryptedPath)
+
+	desc := ocispec.Descriptor{
+		MediaType: utils.MediaTypeNydusBlob,
+		Digest:    digest.NewDigestFromEncoded(digest.SHA256, blobID),
+		Size:      size,
+		Annotations: map[string]string{
+			utils.LayerAnnotationNydusBlob:   "true",
+			utils.LayerAnnotationNydusBlobID: blobID,
+		},
+	}
+	if layer.compressor != "" {
+		desc.Annotations[utils.LayerAnnotationNydusCompressor] = layer.compressor
+	}
+	encryptedDesc, err := layer.encrypter.EncryptFile(layer.blobPath, encryptedPath, desc)
+	if err != nil {
+		return errors.Wrap(err, "Encrypt blob layer")
+	}
+	// Keep the DiffID of layer same with the unencrypted blob
+	encryptedDesc.Annotations[utils.LayerAnnotationUncompressed] = desc.Digest.String()
+
+	if err := utils.WithRetry(func() error {
+		blobFile, err := os.Open(encryptedPath)
+		if err != nil {
+			return errors.Wrap(err, "Open encrypted blob file")
+		}
+		defer blobFile.Close()
+		return layer.remote.PushBlob(ctx, *encryptedDesc, blobFile)
+	}); err != nil {
+		return errors.Wrap(err, "Push encrypted blob layer")
+	}
+	layer.blobDesc = encryptedDesc
+
+	return nil
+}
+
 func (layer *buildLayer) pushBootstrap(ctx context.Context) (*ocispec.Descriptor, *digest.Digest, error) {
 	// TODO: make these PackTargzInfo calls concurrently
-	compressedDigest, compressedSize, err := utils.PackTargzInfo(
-		layer.bootstrapPath, utils.BootstrapFileNameInLayer, true,
-	)
+	var compressedDigest digest.Digest
+	var compressedSize int64
+	var err error
+	if layer.zstdBootstrap {
+		compressedDigest, compressedSize, err = utils.PackTarZstdInfo(
+			layer.bootstrapPath, utils.BootstrapFileNameInLayer,
+		)
+	} else {
+		compressedDigest, compressedSize, err = utils.PackTargzInfo(
+			layer.bootstrapPath, utils.BootstrapFileNameInLayer, true,
+		)
+	}
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "Calculate compressed boostrap digest")
 	}
@@ -149,7 +232,9 @@ func (layer *buildLayer) pushBootstrap(ctx context.Context) (*ocispec.Descriptor
 	}
 
 	bootstrapMediaType := ocispec.MediaTypeImageLayerGzip
-	if layer.dockerV2Format {
+	if layer.zstdBootstrap {
+		bootstrapMediaType = utils.MediaTypeImageLayerZstd
+	} else if layer.dockerV2Format {
 		bootstrapMediaType = images.MediaTypeDockerSchema2LayerGzip
 	}
 
@@ -164,11 +249,27 @@ func (layer *buildLayer) pushBootstrap(ctx context.Context) (*ocispec.Descriptor
 			utils.LayerAnnotationNydusBootstrap: "true",
 		},
 	}
+	if layer.compressor != "" {
+		// Let nydusd pick the decompressor of blobs from the annotation
+		desc.Annotations[utils.LayerAnnotationNydusCompressor] = layer.compressor
+	}
+	if layer.fsVersion != "" {
+		// Let snapshotter pick the way to mount RAFS v6 from the annotation
+		desc.Annotations[utils.LayerAnnotationNydusFsVersion] = layer.fsVersion
+	}
 
 	if err := utils.WithRetry(func() error {
-		compressedReader, err := utils.PackTargz(
-			layer.bootstrapPath, utils.BootstrapFileNameInLayer, true,
-		)
+		var compressedReader io.ReadCloser
+		var err error
+		if layer.zstdBootstrap {
+			compressedReader, err = utils.PackTarZstd(
+				layer.bootstrapPath, utils.BootstrapFileNameInLayer,
+			)
+		} else {
+			compressedReader, err = utils.PackTargz(
+				layer.bootstrapPath, utils.BootstrapFileNameInLayer, true,
+			)
+		}
 		if err != nil {
 			return errors.Wrap(err, "Compress boostrap layer")
 		}
@@ -212,7 +313,7 @@ func (layer *buildLayer) Push(ctx context.Context) error {
 		}
 		blobSize := humanize.Bytes(uint64(info.Size()))
 		var op string
-		if layer.backend.Type() == backend.OssBackend {
+		if layer.backend.Type() != backend.RegistryBackend {
 			op = "Upload"
 		} else {
 			op = "Push"
@@ -221,7 +322,8 @@ func (layer *buildLayer) Push(ctx context.Context) error {
 			"Digest": blobDigest,
 			"Size":   blobSize,
 		})
-		if err := layer.pushBlob(ctx); err != nil {
+		task := progress.FromContext(ctx).Start(progress.StagePush, blobDigest.String(), info.Size())
+		if err := task.Done(layer.pushBlob(progress.WithTask(ctx, task))); err != nil {
 			return pushDone(errors.Wrapf(err, "Push Nydus blob layer"))
 		}
 
@@ -250,6 +352,13 @@ func (layer *buildLayer) Mount(ctx context.Context) (func() error, error) {
 		return nil, nil
 	}
 
+	// Reuse the Nydus layer if the source layer is shared with previous image
+	if record := layer.incrementalGlue.Check(ctx, layer.source.ChainID()); record != nil {
+		layer.cacheRecord = record
+		layer.incremental = true
+		return nil, nil
+	}
+
 	bootstrapName := strconv.Itoa(layer.index+1) + "-" + layer.source.Digest().String()
 	layer.bootstrapPath = filepath.Join(layer.bootstrapsDir, bootstrapName)
 
@@ -258,7 +367,25 @@ func (layer *buildLayer) Mount(ctx context.Context) (func() error, error) {
 		"Digest": layer.source.Digest(),
 		"Size":   sourceLayerSize,
 	})
-	mounts, umount, err := layer.source.Mount(ctx)
+	var mounts []mount.Mount
+	var umount func() error
+	if tarLayer, ok := layer.source.(provider.TarSourceLayer); ok && layer.buildWorkflow != nil {
+		if layer.buildWorkflow.Scratch().Streaming() {
+			// The tar stream is pulled on building, the whiteouts in it
+			// are validated on building and can't be converted
+			layer.tarSource = tarLayer
+			layer.sourceMount = &sourceMount{
+				WhiteoutSpec: selectWhiteoutSpec(
+					layer.whiteoutSpec, &sourceMount{WhiteoutSpec: WhiteoutSpecOCI}, layer.fsVersion,
+				),
+				Unpacked: true,
+			}
+			return func() error { return nil }, mountDone(nil)
+		}
+		mounts, umount, err = layer.unpackSource(ctx, tarLayer)
+	} else {
+		mounts, umount, err = layer.source.Mount(ctx)
+	}
 	if err != nil {
 		return nil, mountDone(errors.Wrapf(err, "Mount source layer %s", layer.source.Digest()))
 	}
@@ -268,9 +395,109 @@ func (layer *buildLayer) Mount(ctx context.Context) (func() error, error) {
 		return nil, mountDone(errors.Wrapf(err, "Parse source layer mount %s", layer.source.Digest()))
 	}
 
+	// Convert the whiteouts of unpacked OCI layer for the consumer requires
+	// overlayfs whiteouts
+	spec := selectWhiteoutSpec(layer.whiteoutSpec, layer.sourceMount, layer.fsVersion)
+	if spec == WhiteoutSpecOverlayfs && layer.sourceMount.WhiteoutSpec == WhiteoutSpecOCI && layer.sourceMount.Unpacked {
+		if err := convertOCIWhiteouts(layer.sourceMount.Source); err != nil {
+			umount()
+			return nil, mountDone(errors.Wrapf(err, "Convert whiteouts of source layer %s", layer.source.Digest()))
+		}
+	}
+
+	// Refuse to build the layer with whiteouts can't be recognized by
+	// the whiteout spec, instead of producing a broken Nydus layer
+	layer.sourceMount.WhiteoutSpec = spec
+	if err := validateWhiteouts(layer.sourceMount.Source, layer.sourceMount.WhiteoutSpec); err != nil {
+		umount()
+		return nil, mountDone(errors.Wrapf(err, "Validate source layer %s", layer.source.Digest()))
+	}
+
+	if layer.pathFilter != nil {
+		if err := layer.filterSource(); err != nil {
+			umount()
+			return nil, mountDone(errors.Wrapf(err, "Filter source layer %s", layer.source.Digest()))
+		}
+	}
+
 	return umount, mountDone(nil)
 }
 
+// unpackSource pulls and unpacks the source layer to the scratch space of
+// build workflow, the layer is removed from scratch space on umount.
+func (layer *buildLayer) unpackSource(
+	ctx context.Context, tarLayer provider.TarSourceLayer,
+) ([]mount.Mount, func() error, error) {
+	scratch := layer.buildWorkflow.Scratch()
+	digestStr := layer.source.Digest().String()
+
+	var layerDir string
+	task := progress.FromContext(ctx).Start(progress.StagePull, digestStr, layer.source.Size())
+	if err := task.Done(utils.WithRetry(func() error {
+		task.Reset()
+
+		reader, err := tarLayer.Tar(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "Pull source layer %s", digestStr)
+		}
+		defer reader.Close()
+
+		// Use layer ChainID as the directory name, in case of the layers
+		// in the same Digest are removed by umount.
+		layerDir, err = scratch.Unpack(ctx, layer.source.ChainID().Hex(), task.Reader(reader))
+		return errors.Wrapf(err, "Unpack source layer %s", digestStr)
+	})); err != nil {
+		return nil, nil, err
+	}
+
+	umount := func() error {
+		return scratch.Release(layerDir)
+	}
+	mounts := []mount.Mount{
+		{
+			Type:   "oci-directory",
+			Source: layerDir,
+		},
+	}
+	return mounts, umount, nil
+}
+
+// buildTar builds the source layer from its tar stream.
+func (layer *buildLayer) buildTar(ctx context.Context, parentBootstrapPath string) (*build.BuildResult, error) {
+	digestStr := layer.source.Digest().String()
+	reader, err := layer.tarSource.Tar(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Pull source layer %s", digestStr)
+	}
+	defer reader.Close()
+
+	// The whiteouts can't be checked before building, the stream is
+	// validated while building instead
+	task := progress.FromContext(ctx).Start(progress.StagePull, digestStr, layer.source.Size())
+	validator := newTarWhiteoutValidator(task.Reader(reader), layer.sourceMount.WhiteoutSpec)
+	result, err := layer.buildWorkflow.BuildFromTar(
+		validator, layer.sourceMount.WhiteoutSpec, parentBootstrapPath, layer.bootstrapPath,
+	)
+	if verr := validator.Close(); verr != nil {
+		err = errors.Wrapf(verr, "Validate source layer %s", digestStr)
+	}
+	return result, task.Done(err)
+}
+
+// filterSource drops the files not kept by path filter from source layer,
+// the files mounted from other places can't be modified.
+func (layer *buildLayer) filterSource() error {
+	if !layer.sourceMount.Unpacked {
+		return errors.New("Path filter only works for unpacked source layer")
+	}
+	removed, err := layer.pathFilter.Filter(layer.sourceMount.Source)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Filtered %d files from source layer %s", removed, layer.source.Digest())
+	return nil
+}
+
 func (layer *buildLayer) Build(ctx context.Context) error {
 	sourceSize := humanize.Bytes(uint64(layer.source.Size()))
 
@@ -284,29 +511,59 @@ func (layer *buildLayer) Build(ctx context.Context) error {
 	if parentLayer != nil {
 		// Try to reuse the bootstrap of parent layer in cache record
 		if parentLayer.Cached() {
-			bootstrapName := strconv.Itoa(parentLayer.index+1) + "-" + parentLayer.source.Digest().String()
-			parentLayer.bootstrapPath = filepath.Join(parentLayer.bootstrapsDir, bootstrapName+"-cached")
-			if err := parentLayer.cacheGlue.PullBootstrap(ctx, parentLayer.source.ChainID(), parentLayer.bootstrapPath); err != nil {
+			bootstrapPath, err := parentLayer.pullCachedBootstrap(ctx)
+			if err != nil {
 				logrus.Warnf("Pull bootstrap from cache: %s", err)
 				// Error occurs, the cache is invalid
 				return buildDone(errInvalidCache)
 			}
+			parentLayer.bootstrapPath = bootstrapPath
 		}
 		parentBootstrapPath = parentLayer.bootstrapPath
 	}
-	blobPath, err := layer.buildWorkflow.Build(
-		layer.sourceMount.Source, layer.sourceMount.WhiteoutSpec, parentBootstrapPath, layer.bootstrapPath,
-	)
-	if err != nil {
+	// The progress of building is unknown until it's done
+	task := progress.FromContext(ctx).Start(progress.StageBuild, layer.source.Digest().String(), layer.source.Size())
+	var result *build.BuildResult
+	var err error
+	if layer.tarSource != nil {
+		result, err = layer.buildTar(ctx, parentBootstrapPath)
+	} else {
+		result, err = layer.buildWorkflow.Build(
+			layer.sourceMount.Source, layer.sourceMount.WhiteoutSpec, parentBootstrapPath, layer.bootstrapPath,
+		)
+	}
+	if err := task.Done(err); err != nil {
 		return buildDone(errors.Wrapf(err, "Build source layer %s", layer.source.Digest()))
 	}
+	logrus.Debugf(
+		"Built source layer %s: %d files, %s uncompressed, %s blob in %s",
+		layer.source.Digest(), result.FileCount, humanize.Bytes(uint64(result.UncompressedSize)),
+		humanize.Bytes(uint64(result.BlobSize)), result.Duration,
+	)
 
 	// The built blob will be removed after `upload` phrase.
-	layer.blobPath = blobPath
+	layer.blobPath = result.BlobPath
 
 	return buildDone(nil)
 }
 
+// pullCachedBootstrap pulls the bootstrap of cached layer from cache
+// image or previous image, returns the path of pulled bootstrap.
+func (layer *buildLayer) pullCachedBootstrap(ctx context.Context) (string, error) {
+	bootstrapName := strconv.Itoa(layer.index+1) + "-" + layer.source.Digest().String()
+	bootstrapPath := filepath.Join(layer.bootstrapsDir, bootstrapName+"-cached")
+	if layer.incremental {
+		if err := layer.incrementalGlue.PullBootstrap(ctx, layer.cacheRecord, bootstrapPath); err != nil {
+			return "", err
+		}
+		return bootstrapPath, nil
+	}
+	if err := layer.cacheGlue.PullBootstrap(ctx, layer.source.ChainID(), bootstrapPath); err != nil {
+		return "", err
+	}
+	return bootstrapPath, nil
+}
+
 func (layer *buildLayer) GetCacheRecord() cache.CacheRecord {
 	if layer.cacheRecord != nil {
 		return *layer.cacheRecord
@@ -0,0 +1,95 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// ErrLimitExceeded is returned when the conversion exceeds one of the hard
+// limits, the conversion is aborted before pushing the target manifest.
+var ErrLimitExceeded = errors.New("Conversion limit exceeded")
+
+// limitChecker enforces the hard limits of conversion, so that the runaway
+// conversions of pathological images don't fill the disk of build hosts or
+// push huge artifacts to registry, the limit isn't checked if it's 0.
+type limitChecker struct {
+	maxBlobSize int64
+	maxLayers   uint
+	maxFileSize int64
+
+	blobSize int64
+}
+
+func newLimitChecker(maxBlobSize int64, maxLayers uint, maxFileSize int64) *limitChecker {
+	return &limitChecker{
+		maxBlobSize: maxBlobSize,
+		maxLayers:   maxLayers,
+		maxFileSize: maxFileSize,
+	}
+}
+
+// CheckLayers checks the layer count of source image before pulling any
+// layer.
+func (l *limitChecker) CheckLayers(count int) error {
+	if l.maxLayers > 0 && uint(count) > l.maxLayers {
+		return errors.Wrapf(ErrLimitExceeded, "source image has %d layers, exceeds limit %d", count, l.maxLayers)
+	}
+	return nil
+}
+
+// CheckFiles checks the size of regular files in the mounted source layer
+// before building it.
+func (l *limitChecker) CheckFiles(dir string) error {
+	if l.maxFileSize <= 0 {
+		return nil
+	}
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() <= l.maxFileSize {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(
+			ErrLimitExceeded, "file /%s of size %s exceeds limit %s", filepath.ToSlash(rel),
+			humanize.IBytes(uint64(info.Size())), humanize.IBytes(uint64(l.maxFileSize)),
+		)
+	})
+}
+
+// AddBlob accumulates the size of blob referenced by target image, either
+// built or reused from cache, and checks the total size before pushing it.
+func (l *limitChecker) AddBlob(size int64) error {
+	l.blobSize += size
+	if l.maxBlobSize > 0 && l.blobSize > l.maxBlobSize {
+		return errors.Wrapf(
+			ErrLimitExceeded, "total blob size %s exceeds limit %s",
+			humanize.IBytes(uint64(l.blobSize)), humanize.IBytes(uint64(l.maxBlobSize)),
+		)
+	}
+	return nil
+}
+
+// AddBlobFile accumulates the size of blob file built from source layer,
+// the layer without blob is ignored.
+func (l *limitChecker) AddBlobFile(blobPath string) error {
+	if blobPath == "" {
+		return nil
+	}
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		return errors.Wrap(err, "Stat blob file")
+	}
+	return l.AddBlob(info.Size())
+}
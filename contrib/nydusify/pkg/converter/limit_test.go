@@ -0,0 +1,50 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitChecker(t *testing.T) {
+	dir := createLayer(t, []testFile{
+		{path: "bin", link: "usr/bin"},
+		{path: "usr/bin/app", content: strings.Repeat("a", 100), mode: 0755},
+		{path: "data/large", content: strings.Repeat("l", 1000), mode: 0644},
+	})
+	defer os.RemoveAll(dir)
+
+	// No limit is checked by default
+	limits := newLimitChecker(0, 0, 0)
+	assert.Nil(t, limits.CheckLayers(1000))
+	assert.Nil(t, limits.CheckFiles(dir))
+	assert.Nil(t, limits.AddBlob(1<<40))
+
+	limits = newLimitChecker(1000, 2, 1000)
+	assert.Nil(t, limits.CheckLayers(2))
+	err := limits.CheckLayers(3)
+	assert.True(t, errors.Is(err, ErrLimitExceeded))
+
+	assert.Nil(t, limits.CheckFiles(dir))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "data/large"), []byte(strings.Repeat("l", 1001)), 0644))
+	err = limits.CheckFiles(dir)
+	assert.True(t, errors.Is(err, ErrLimitExceeded))
+	assert.Contains(t, err.Error(), "/data/large")
+
+	// The blobs without file are ignored, and the total size is accumulated
+	assert.Nil(t, limits.AddBlobFile(""))
+	assert.Nil(t, limits.AddBlobFile(filepath.Join(dir, "usr/bin/app")))
+	assert.Nil(t, limits.AddBlob(900))
+	err = limits.AddBlob(1)
+	assert.True(t, errors.Is(err, ErrLimitExceeded))
+}
@@ -8,17 +8,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"strconv"
 
-	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/alias"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/encryption"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
@@ -29,144 +32,159 @@ type manifestManager struct {
 	sourceProvider provider.SourceProvider
 	backend        backend.Backend
 	remote         *remote.Remote
-	multiPlatform  bool
 	dockerV2Format bool
+	assembler      ManifestAssembler
+	// Blob list in blob table of the final bootstrap, only be set when
+	// building with chunk dictionary, the blobs of dedup image may be
+	// referenced in bootstrap.
+	blobIDs    []string
+	dedupBlobs []ocispec.Descriptor
+	// The bloom filter of chunk digests in the final bootstrap,
+	// the digest is recorded in bootstrap layer annotation.
+	chunkBloom *ocispec.Descriptor
+	// Mutates the config and manifest of Nydus image
+	mutation *ConfigMutation
+	// The source image annotated in Nydus manifest if it's not nil
+	source *alias.Source
 }
 
-// Try to get manifests from exists target image
-func (mm *manifestManager) getExistsManifests(ctx context.Context) ([]ocispec.Descriptor, error) {
-	desc, err := mm.remote.Resolve(ctx)
-	if err != nil {
-		if errdefs.IsNotFound(err) {
-			return []ocispec.Descriptor{}, nil
-		}
-		return nil, errors.Wrap(err, "Resolve image manifest index")
+// blobIDOf returns the blob id of blob layer, which is the digest of
+// blob unless the blob is encrypted.
+func blobIDOf(desc *ocispec.Descriptor) string {
+	if blobID := desc.Annotations[utils.LayerAnnotationNydusBlobID]; blobID != "" {
+		return blobID
 	}
+	return desc.Digest.Hex()
+}
 
-	if desc.MediaType == images.MediaTypeDockerSchema2ManifestList ||
-		desc.MediaType == ocispec.MediaTypeImageIndex {
-
-		reader, err := mm.remote.Pull(ctx, *desc, true)
-		if err != nil {
-			return nil, errors.Wrap(err, "Pull image manifest index")
-		}
-		defer reader.Close()
-
-		indexBytes, err := ioutil.ReadAll(reader)
-		if err != nil {
-			return nil, errors.Wrap(err, "Read image manifest index")
-		}
-
-		var index ocispec.Index
-		if err := json.Unmarshal(indexBytes, &index); err != nil {
-			return nil, errors.Wrap(err, "Unmarshal image manifest index")
-		}
+// Push pushes Nydus image config, then pushes Nydus manifest by assembler,
+// returns the descriptor of Nydus manifest.
+func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer) (*ocispec.Descriptor, error) {
+	layers := []ocispec.Descriptor{}
+	// The index of source layer producing each layer in manifest
+	layerSources := []int{}
+	blobListInAnnotation := []string{}
 
-		return index.Manifests, nil
+	ociConfig, err := mm.sourceProvider.Config(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get source image config")
 	}
+	sourceDiffIDs := ociConfig.RootFS.DiffIDs
+	sourceHistory := ociConfig.History
 
-	if desc.MediaType == images.MediaTypeDockerSchema2Manifest ||
-		desc.MediaType == ocispec.MediaTypeImageManifest {
-		return []ocispec.Descriptor{*desc}, nil
+	records := []cache.CacheRecord{}
+	for _, layer := range buildLayers {
+		records = append(records, layer.GetCacheRecord())
 	}
-
-	return []ocispec.Descriptor{}, nil
-}
-
-// Merge OCI and Nydus manifest into a manifest index, the OCI
-// manifest of source image is not required to be provided
-func (mm *manifestManager) makeManifestIndex(
-	ctx context.Context, existDescs []ocispec.Descriptor, nydusManifest, ociManifest *ocispec.Descriptor,
-) (*ocispec.Index, error) {
-	foundOCI := false
-	descs := make([]ocispec.Descriptor, 0)
-	for _, desc := range existDescs {
-		isNydus := false
-		if desc.Platform != nil {
-			if utils.IsSupportedPlatform(desc.Platform.OS, desc.Platform.Architecture) {
-				if utils.IsNydusPlatform(desc.Platform) {
-					isNydus = true
-				} else {
-					desc.Platform.OS = utils.SupportedOS
-					desc.Platform.Architecture = utils.SupportedArch
-					foundOCI = true
-				}
-			}
-		} else {
-			desc.Platform = &ocispec.Platform{
-				OS:           utils.SupportedOS,
-				Architecture: utils.SupportedArch,
-			}
-			foundOCI = true
-		}
-		if !isNydus {
-			descs = append(descs, desc)
-		}
-	}
-
-	// Append the OCI manifest provided by source to manifest list
-	if !foundOCI && ociManifest != nil {
-		ociManifest.Platform = &ocispec.Platform{
-			OS:           utils.SupportedOS,
-			Architecture: utils.SupportedArch,
-		}
-		descs = append(descs, *ociManifest)
+	// Record the Nydus layer built from each source layer in manifest,
+	// for the incremental conversion of next image in the repository.
+	sourceLayersBytes, err := json.Marshal(makeSourceLayers(records))
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal source layer records")
 	}
 
-	// Always put the nydus manifest to the last position of manifest list
-	descs = append(descs, *nydusManifest)
-
-	// Merge exists OCI manifests and Nydus manifest to manifest index
-	index := ocispec.Index{
-		Versioned: specs.Versioned{
-			SchemaVersion: 2,
-		},
-		Manifests: descs,
+	blobDescs := map[string]ocispec.Descriptor{}
+	blobSources := map[string]int{}
+	for _, desc := range mm.dedupBlobs {
+		blobDescs[desc.Digest.Hex()] = withSourceAnnotations(desc, "", "")
 	}
 
-	return &index, nil
-}
-
-func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer) error {
-	layers := []ocispec.Descriptor{}
-	blobListInAnnotation := []string{}
-
 	for idx, _layer := range buildLayers {
 		record := _layer.GetCacheRecord()
 
 		if record.NydusBlobDesc != nil {
+			var sourceDiffID digest.Digest
+			if _layer.index < len(sourceDiffIDs) {
+				sourceDiffID = sourceDiffIDs[_layer.index]
+			}
+			blobID := blobIDOf(record.NydusBlobDesc)
+			blobDescs[blobID] = withSourceAnnotations(*record.NydusBlobDesc, _layer.source.Digest(), sourceDiffID)
+			blobSources[blobID] = _layer.index
+		}
+		if record.NydusBlobDesc != nil && mm.blobIDs == nil {
+			blobID := blobIDOf(record.NydusBlobDesc)
 			// Write blob digest list in JSON format to layer annotation of bootstrap.
-			blobListInAnnotation = append(blobListInAnnotation, record.NydusBlobDesc.Digest.Hex())
+			blobListInAnnotation = append(blobListInAnnotation, blobID)
 			// For registry backend, we need to write the blob layer to
 			// manifest to prevent them from being deleted by registry GC.
 			if mm.backend.Type() == backend.RegistryBackend {
-				layers = append(layers, *record.NydusBlobDesc)
+				layers = append(layers, blobDescs[blobID])
+				layerSources = append(layerSources, _layer.index)
 			}
 		}
 
 		// Only need to write lastest bootstrap layer in nydus manifest
 		if idx == len(buildLayers)-1 {
+			// Keep the order of blob layers same with the blob table
+			// of bootstrap, includes the blobs from dedup image.
+			if mm.blobIDs != nil {
+				blobListInAnnotation = mm.blobIDs
+				if mm.backend.Type() == backend.RegistryBackend {
+					for _, blobID := range mm.blobIDs {
+						desc, ok := blobDescs[blobID]
+						if !ok {
+							return nil, fmt.Errorf("Not found blob %s in built layers", blobID)
+						}
+						layers = append(layers, desc)
+						if source, ok := blobSources[blobID]; ok {
+							layerSources = append(layerSources, source)
+						} else {
+							layerSources = append(layerSources, noSource)
+						}
+					}
+				}
+			}
 			blobListBytes, err := json.Marshal(blobListInAnnotation)
 			if err != nil {
-				return errors.Wrap(err, "Marshal blob list")
+				return nil, errors.Wrap(err, "Marshal blob list")
 			}
 			record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusBlobIDs] = string(blobListBytes)
+			var imageSize int64
+			for _, blobID := range blobListInAnnotation {
+				imageSize += blobDescs[blobID].Size
+			}
+			record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusImageSize] = strconv.FormatInt(imageSize, 10)
+			record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusSourceLayers] = string(sourceLayersBytes)
+			if mm.chunkBloom != nil {
+				record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusChunkBloom] = mm.chunkBloom.Digest.String()
+			}
+			// Tell runtime where to fetch the blobs stored in object storage
+			if hinter, ok := mm.backend.(backend.ConfigHinter); ok {
+				hintBytes, err := json.Marshal(hinter.ConfigHint())
+				if err != nil {
+					return nil, errors.Wrap(err, "Marshal backend config hint")
+				}
+				record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusBackendType] = backend.TypeName(mm.backend.Type())
+				record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusBackendConfig] = string(hintBytes)
+			}
 			layers = append(layers, *record.NydusBootstrapDesc)
+			layerSources = append(layerSources, noSource)
 		}
 	}
 
-	ociConfig, err := mm.sourceProvider.Config(ctx)
-	if err != nil {
-		return errors.Wrap(err, "Get source image config")
-	}
 	ociConfig.RootFS.DiffIDs = []digest.Digest{}
-	ociConfig.History = []ocispec.History{}
+	// Keep the history of source image, so that the tooling can trace
+	// which source layer produces the Nydus blob.
+	ociConfig.History = convertHistory(sourceHistory, len(sourceDiffIDs), layerSources)
+	mm.mutation.Apply(ociConfig)
 
 	// Remove useless annotations from layer
 	validAnnotationKeys := map[string]bool{
-		utils.LayerAnnotationNydusBlob:      true,
-		utils.LayerAnnotationNydusBlobIDs:   true,
-		utils.LayerAnnotationNydusBootstrap: true,
+		utils.LayerAnnotationNydusBlob:          true,
+		utils.LayerAnnotationNydusBlobIDs:       true,
+		utils.LayerAnnotationNydusBootstrap:     true,
+		utils.LayerAnnotationNydusChunkBloom:    true,
+		utils.LayerAnnotationNydusBackendType:   true,
+		utils.LayerAnnotationNydusBackendConfig: true,
+		utils.LayerAnnotationNydusSourceLayers:  true,
+		utils.LayerAnnotationNydusCompressor:    true,
+		utils.LayerAnnotationNydusFsVersion:     true,
+		utils.LayerAnnotationNydusBlobID:        true,
+		utils.LayerAnnotationNydusImageSize:     true,
+		utils.LayerAnnotationNydusSourceDigest:  true,
+		utils.LayerAnnotationNydusSourceDiffID:  true,
+		encryption.AnnotationKeysJWE:            true,
+		encryption.AnnotationPubOpts:            true,
 	}
 	for idx, desc := range layers {
 		layerDiffID := digest.Digest(desc.Annotations[utils.LayerAnnotationUncompressed])
@@ -192,11 +210,11 @@ func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer)
 	}
 	configDesc, configBytes, err := utils.MarshalToDesc(ociConfig, configMediaType)
 	if err != nil {
-		return errors.Wrap(err, "Marshal source image config")
+		return nil, errors.Wrap(err, "Marshal source image config")
 	}
 
 	if err := mm.remote.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
-		return errors.Wrap(err, "Push Nydus image config")
+		return nil, errors.Wrap(err, "Push Nydus image config")
 	}
 
 	manifestMediaType := ocispec.MediaTypeImageManifest
@@ -204,85 +222,30 @@ func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer)
 		manifestMediaType = images.MediaTypeDockerSchema2Manifest
 	}
 
-	// Push Nydus image manifest
-	nydusManifest := struct {
-		MediaType string `json:"mediaType,omitempty"`
-		ocispec.Manifest
-	}{
-		MediaType: manifestMediaType,
-		Manifest: ocispec.Manifest{
-			Versioned: specs.Versioned{
-				SchemaVersion: 2,
-			},
-			Config: *configDesc,
-			Layers: layers,
-		},
-	}
-
-	nydusManifestDesc, manifestBytes, err := utils.MarshalToDesc(nydusManifest, manifestMediaType)
-	if err != nil {
-		return errors.Wrap(err, "Marshal Nydus image manifest")
-	}
-	nydusManifestDesc.Platform = &ocispec.Platform{
-		OS:           utils.SupportedOS,
-		Architecture: utils.SupportedArch,
-		OSFeatures:   []string{utils.ManifestOSFeatureNydus},
-	}
-
-	if !mm.multiPlatform {
-		if err := mm.remote.Push(ctx, *nydusManifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
-			return errors.Wrap(err, "Push nydus image manifest")
-		}
-		return nil
-	}
-
-	if err := mm.remote.Push(ctx, *nydusManifestDesc, true, bytes.NewReader(manifestBytes)); err != nil {
-		return errors.Wrap(err, "Push nydus image manifest")
-	}
-
-	// Push manifest index, includes OCI manifest and Nydus manifest
-	ociManifestDesc, err := mm.sourceProvider.Manifest(ctx)
+	sourceManifest, err := mm.sourceProvider.Manifest(ctx)
 	if err != nil {
-		return errors.Wrap(err, "Get source image manifest")
-	}
-	if ociManifestDesc != nil {
-		ociManifestDesc.Platform = &ocispec.Platform{
-			OS:           utils.SupportedOS,
-			Architecture: utils.SupportedArch,
-		}
+		return nil, errors.Wrap(err, "Get source image manifest")
 	}
 
-	existManifests, err := mm.getExistsManifests(ctx)
-	if err != nil {
-		return errors.Wrap(err, "Get remote existing manifest index")
-	}
-
-	_index, err := mm.makeManifestIndex(ctx, existManifests, nydusManifestDesc, ociManifestDesc)
-	if err != nil {
-		return errors.Wrap(err, "Make manifest index for target")
-	}
-
-	indexMediaType := ocispec.MediaTypeImageIndex
-	if mm.dockerV2Format {
-		indexMediaType = images.MediaTypeDockerSchema2ManifestList
-	}
-
-	index := struct {
-		MediaType string `json:"mediaType,omitempty"`
-		ocispec.Index
-	}{
-		MediaType: indexMediaType,
-		Index:     *_index,
-	}
-
-	indexDesc, indexBytes, err := utils.MarshalToDesc(index, indexMediaType)
-	if err != nil {
-		return errors.Wrap(err, "Marshal image manifest index")
-	}
-
-	if err := mm.remote.Push(ctx, *indexDesc, false, bytes.NewReader(indexBytes)); err != nil {
-		return errors.Wrap(err, "Push image manifest index")
-	}
-
-	return nil
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: *configDesc,
+		Layers: layers,
+	}
+	mm.mutation.Annotate(&manifest)
+	if mm.source != nil {
+		mm.source.Annotate(&manifest)
+	}
+
+	// Push Nydus image manifest, and relate it to source image in the
+	// layout decided by assembler
+	return mm.assembler.Assemble(ctx, &AssembleInput{
+		Target:         mm.remote,
+		Manifest:       manifest,
+		MediaType:      manifestMediaType,
+		SourceManifest: sourceManifest,
+		DockerV2Format: mm.dockerV2Format,
+	})
 }
@@ -44,10 +44,7 @@ func makeDesc(id string, platform *ocispec.Platform) ocispec.Descriptor {
 }
 
 func TestManifest(t *testing.T) {
-	mm := manifestManager{
-		multiPlatform:  true,
-		dockerV2Format: false,
-	}
+	mm := IndexAssembler{}
 
 	nydusDesc := makeDesc("nydus", makePlatform("linux/amd64", true))
 
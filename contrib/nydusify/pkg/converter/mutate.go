@@ -0,0 +1,92 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ConfigMutation mutates the config and manifest of target image during
+// conversion, e.g. adding the hints for Nydus runtime.
+type ConfigMutation struct {
+	// Labels are set in image config, the label with empty value is
+	// removed.
+	Labels map[string]string
+	// Annotations are set in target manifest, the annotation with empty
+	// value is ignored.
+	Annotations map[string]string
+	// Env are the environment variables in format `KEY=value`, they
+	// replace the variables with the same key in image config, or are
+	// appended to image config.
+	Env []string
+	// User overrides the user of image config if it's not empty.
+	User string
+}
+
+// Validate returns error if the environment variables aren't in format
+// `KEY=value`.
+func (mutation *ConfigMutation) Validate() error {
+	for _, env := range mutation.Env {
+		if idx := strings.Index(env, "="); idx <= 0 {
+			return fmt.Errorf("invalid env %s, should be in format KEY=value", env)
+		}
+	}
+	return nil
+}
+
+// Apply mutates image config, it's idempotent.
+func (mutation *ConfigMutation) Apply(config *ocispec.Image) {
+	if mutation == nil {
+		return
+	}
+
+	for key, value := range mutation.Labels {
+		if value == "" {
+			delete(config.Config.Labels, key)
+			continue
+		}
+		if config.Config.Labels == nil {
+			config.Config.Labels = map[string]string{}
+		}
+		config.Config.Labels[key] = value
+	}
+
+	for _, env := range mutation.Env {
+		key := env[:strings.Index(env, "=")+1]
+		replaced := false
+		for idx, existing := range config.Config.Env {
+			if strings.HasPrefix(existing, key) {
+				config.Config.Env[idx] = env
+				replaced = true
+			}
+		}
+		if !replaced {
+			config.Config.Env = append(config.Config.Env, env)
+		}
+	}
+
+	if mutation.User != "" {
+		config.Config.User = mutation.User
+	}
+}
+
+// Annotate sets the annotations of target manifest.
+func (mutation *ConfigMutation) Annotate(manifest *ocispec.Manifest) {
+	if mutation == nil {
+		return
+	}
+	for key, value := range mutation.Annotations {
+		if value == "" {
+			continue
+		}
+		if manifest.Annotations == nil {
+			manifest.Annotations = map[string]string{}
+		}
+		manifest.Annotations[key] = value
+	}
+}
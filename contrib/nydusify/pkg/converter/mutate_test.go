@@ -0,0 +1,57 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigMutation(t *testing.T) {
+	mutation := &ConfigMutation{
+		Labels:      map[string]string{"version": "2", "deprecated": ""},
+		Annotations: map[string]string{"org.opencontainers.image.source": "https://example.com", "empty": ""},
+		Env:         []string{"PATH=/opt/bin:/usr/bin", "NYDUS_PREFETCH=true"},
+		User:        "1000:1000",
+	}
+	assert.Nil(t, mutation.Validate())
+
+	config := &ocispec.Image{Config: ocispec.ImageConfig{
+		User:   "root",
+		Env:    []string{"PATH=/usr/bin", "PATHEXT=.sh"},
+		Labels: map[string]string{"version": "1", "deprecated": "true"},
+	}}
+	mutation.Apply(config)
+	// Applying again changes nothing
+	mutation.Apply(config)
+	assert.Equal(t, ocispec.ImageConfig{
+		User:   "1000:1000",
+		Env:    []string{"PATH=/opt/bin:/usr/bin", "PATHEXT=.sh", "NYDUS_PREFETCH=true"},
+		Labels: map[string]string{"version": "2"},
+	}, config.Config)
+
+	// The labels are created if image config has no label
+	config = &ocispec.Image{}
+	mutation.Apply(config)
+	assert.Equal(t, map[string]string{"version": "2"}, config.Config.Labels)
+
+	manifest := &ocispec.Manifest{}
+	mutation.Annotate(manifest)
+	assert.Equal(t, map[string]string{"org.opencontainers.image.source": "https://example.com"}, manifest.Annotations)
+
+	// Nil mutation changes nothing
+	var empty *ConfigMutation
+	config = &ocispec.Image{}
+	empty.Apply(config)
+	empty.Annotate(manifest)
+	assert.Equal(t, &ocispec.Image{}, config)
+	assert.Len(t, manifest.Annotations, 1)
+
+	for _, env := range []string{"NYDUS_PREFETCH", "=true"} {
+		assert.NotNil(t, (&ConfigMutation{Env: []string{env}}).Validate())
+	}
+}
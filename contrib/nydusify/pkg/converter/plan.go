@@ -0,0 +1,306 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+// The actions planned for source layers.
+const (
+	// PlanActionBuild pulls and builds the source layer.
+	PlanActionBuild = "build"
+	// PlanActionCached copies the Nydus layer recorded in cache image.
+	PlanActionCached = "cached"
+	// PlanActionReused reuses the Nydus layer of incremental image.
+	PlanActionReused = "reused"
+)
+
+// probeContent is the content of the blob pushed to target for checking
+// the push permission, it's never referenced by any manifest.
+var probeContent = []byte("nydusify dry run probe\n")
+
+// Plan is the execution plan of a conversion resolved by dry run, where
+// the source image, cache image and target permission are checked without
+// building or pushing target image.
+type Plan struct {
+	Source         string              `json:"source"`
+	SourceManifest *ocispec.Descriptor `json:"source_manifest,omitempty"`
+	Platform       string              `json:"platform"`
+	Target         string              `json:"target"`
+	TargetFormat   string              `json:"target_format"`
+	// Layout is how Nydus manifest relates to source image in target
+	// registry, one of `tag`, `index`, `referrer` and `custom`.
+	Layout      string `json:"layout"`
+	Backend     string `json:"backend"`
+	Cache       string `json:"cache,omitempty"`
+	Incremental string `json:"incremental,omitempty"`
+	Dedup       string `json:"dedup,omitempty"`
+	// Layers are the source layers after squashing, in the order from
+	// bottom to top.
+	Layers []PlanLayer `json:"layers"`
+	// BuildSize is the total size of the source layers to be pulled and
+	// built, the cached and reused layers are excluded.
+	BuildSize int64 `json:"build_size"`
+	// Attachments are the artifacts attached to Nydus manifest, e.g. SBOM
+	// and signature.
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// PlanLayer is a source layer planned in dry run.
+type PlanLayer struct {
+	Index   int           `json:"index"`
+	Digest  digest.Digest `json:"digest"`
+	ChainID digest.Digest `json:"chain_id"`
+	Size    int64         `json:"size"`
+	// Squashed is the count of source layers merged into the layer.
+	Squashed int    `json:"squashed,omitempty"`
+	Action   string `json:"action"`
+}
+
+func backendName(typ backend.BackendType) string {
+	switch typ {
+	case backend.RegistryBackend:
+		return "registry"
+	case backend.OssBackend:
+		return "oss"
+	case backend.S3Backend:
+		return "s3"
+	case backend.GCSBackend:
+		return "gcs"
+	default:
+		return "unknown"
+	}
+}
+
+func (cvt *Converter) layoutName() string {
+	switch cvt.manifestAssembler().(type) {
+	case *TagAssembler:
+		return "tag"
+	case *IndexAssembler:
+		return "index"
+	case *ReferrerAssembler:
+		return "referrer"
+	default:
+		return "custom"
+	}
+}
+
+func (cvt *Converter) attachments() []string {
+	var attachments []string
+	if cvt.SBOMFormat != "" {
+		attachments = append(attachments, "sbom-"+cvt.SBOMFormat)
+	}
+	if cvt.Provenance {
+		attachments = append(attachments, "provenance")
+	}
+	if cvt.ChunkBloom {
+		attachments = append(attachments, "chunk-bloom")
+	}
+	if cvt.Signer != nil {
+		attachments = append(attachments, "signature-"+cvt.Signer.Tool)
+	}
+	if cvt.Scanner != nil {
+		attachments = append(attachments, "vulnerability-report-"+cvt.Scanner.Tool)
+	}
+	return attachments
+}
+
+// Plan resolves the source image, plans the source layers against cache
+// and incremental image, and checks the push permission of target by a
+// tiny probe blob, without building or pushing target image.
+func (cvt *Converter) Plan(ctx context.Context) (*Plan, error) {
+	logger = cvt.Logger
+
+	if len(cvt.SourceProviders) == 0 {
+		return nil, errors.New("Invalid source provider")
+	}
+	sourceProvider, err := findSupportedSource(ctx, cvt.SourceProviders)
+	if err != nil {
+		return nil, errors.Wrap(err, "Find supported platform")
+	}
+	config, err := sourceProvider.Config(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get source image config")
+	}
+
+	plan := &Plan{
+		Source:       cvt.SourceRef,
+		Platform:     config.OS + "/" + config.Architecture,
+		Target:       cvt.TargetRemote.Ref,
+		TargetFormat: cvt.TargetFormat,
+		Layout:       cvt.layoutName(),
+		Backend:      backendName(cvt.storageBackend.Type()),
+		Attachments:  cvt.attachments(),
+	}
+	if plan.TargetFormat == "" {
+		plan.TargetFormat = TargetFormatNydus
+	}
+	if sourceManifest, err := sourceProvider.Manifest(ctx); err == nil {
+		plan.SourceManifest = sourceManifest
+	}
+
+	sourceLayers, err := sourceProvider.Layers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Get source layers")
+	}
+	sourceCount := len(sourceLayers)
+	sourceLayers = squashLayers(sourceLayers, cvt.Squash, cvt.Flatten, filepath.Join(cvt.WorkDir, "squash"))
+	if err := newLimitChecker(0, cvt.MaxLayers, 0).CheckLayers(len(sourceLayers)); err != nil {
+		return nil, err
+	}
+
+	// The cache and incremental image are only used by Nydus format
+	var cg *cacheGlue
+	var ig *incrementalGlue
+	if plan.TargetFormat == TargetFormatNydus {
+		cg, err = newCacheGlue(
+			ctx, cvt.CacheMaxRecords, cvt.CacheVersion, cvt.CacheTTL, cvt.DockerV2Format, true, cvt.TargetRemote, cvt.CacheBackend, cvt.storageBackend,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "Pull cache image")
+		}
+		if cvt.CacheBackend != nil {
+			plan.Cache = cvt.CacheBackend.Reference()
+		}
+		ig, err = newIncrementalGlue(ctx, cvt.IncrementalRemote, cvt.FsVersion)
+		if err != nil {
+			return nil, errors.Wrap(err, "Pull incremental image")
+		}
+		if cvt.IncrementalRemote != nil {
+			plan.Incremental = cvt.IncrementalRemote.Ref
+		}
+		if cvt.DedupRemote != nil {
+			if err := checkNydusImage(ctx, cvt.DedupRemote); err != nil {
+				return nil, errors.Wrap(err, "Check dedup image")
+			}
+			plan.Dedup = cvt.DedupRemote.Ref
+		}
+	}
+
+	plan.Layers = planLayers(ctx, sourceLayers, sourceCount-len(sourceLayers), cg, ig)
+	for _, layer := range plan.Layers {
+		if layer.Action == PlanActionBuild {
+			plan.BuildSize += layer.Size
+		}
+	}
+
+	if err := cvt.probeTarget(ctx); err != nil {
+		return nil, errors.Wrap(err, "Check target permission")
+	}
+
+	return plan, nil
+}
+
+// planLayers decides the action of each source layer, the squashed layer
+// takes the index of its top source layer.
+func planLayers(
+	ctx context.Context, sourceLayers []provider.SourceLayer, squashedCount int, cg *cacheGlue, ig *incrementalGlue,
+) []PlanLayer {
+	layers := []PlanLayer{}
+	for idx, sourceLayer := range sourceLayers {
+		layer := PlanLayer{
+			Index:   idx + squashedCount,
+			Digest:  sourceLayer.Digest(),
+			ChainID: sourceLayer.ChainID(),
+			Size:    sourceLayer.Size(),
+			Action:  PlanActionBuild,
+		}
+		if squashed, ok := sourceLayer.(*squashedLayer); ok {
+			layer.Squashed = len(squashed.layers)
+		}
+		if record, err := cg.Lookup(ctx, layer.ChainID); err != nil {
+			logrus.Warnf("Failed to get cache record: %s", err)
+		} else if record != nil {
+			layer.Action = PlanActionCached
+		}
+		if layer.Action == PlanActionBuild && ig.Check(ctx, layer.ChainID) != nil {
+			layer.Action = PlanActionReused
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// checkNydusImage checks the image is a Nydus image without pulling its
+// bootstrap.
+func checkNydusImage(ctx context.Context, imageRemote *remote.Remote) error {
+	parsed, err := parser.New(imageRemote).Parse(ctx)
+	if err != nil {
+		return err
+	}
+	if parsed.NydusImage == nil {
+		return fmt.Errorf("Not found Nydus manifest in image %s", imageRemote.Ref)
+	}
+	return nil
+}
+
+// probeTarget pushes a tiny blob to target registry, and uploads it to
+// the storage backend of blobs if it isn't registry, the probe object is
+// deleted from object storage if possible.
+func (cvt *Converter) probeTarget(ctx context.Context) error {
+	desc := ocispec.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(probeContent),
+		Size:      int64(len(probeContent)),
+	}
+	probeDone := logger.Log(ctx, "[PROB] Push probe blob", provider.LoggerFields{
+		"Target": cvt.TargetRemote.Ref,
+	})
+	if err := cvt.TargetRemote.Push(ctx, desc, true, bytes.NewReader(probeContent)); err != nil {
+		return probeDone(errors.Wrap(err, "Push probe blob to target"))
+	}
+	probeDone(nil)
+
+	if cvt.storageBackend.Type() == backend.RegistryBackend {
+		return nil
+	}
+
+	if err := os.MkdirAll(cvt.WorkDir, 0755); err != nil {
+		return errors.Wrap(err, "Create work directory")
+	}
+	probeFile, err := ioutil.TempFile(cvt.WorkDir, "probe-")
+	if err != nil {
+		return errors.Wrap(err, "Create probe file")
+	}
+	defer os.Remove(probeFile.Name())
+	if _, err := probeFile.Write(probeContent); err != nil {
+		probeFile.Close()
+		return errors.Wrap(err, "Write probe file")
+	}
+	if err := probeFile.Close(); err != nil {
+		return errors.Wrap(err, "Write probe file")
+	}
+
+	blobID := desc.Digest.Hex()
+	uploadDone := logger.Log(ctx, "[PROB] Upload probe blob", provider.LoggerFields{
+		"Backend": backendName(cvt.storageBackend.Type()),
+	})
+	if _, err := cvt.storageBackend.Upload(ctx, blobID, probeFile.Name(), desc.Size); err != nil {
+		return uploadDone(errors.Wrap(err, "Upload probe blob to storage backend"))
+	}
+	uploadDone(nil)
+	if collector, ok := cvt.storageBackend.(backend.Collector); ok {
+		if err := collector.Delete(ctx, blobID); err != nil {
+			return errors.Wrap(err, "Delete probe blob from storage backend")
+		}
+	}
+	return nil
+}
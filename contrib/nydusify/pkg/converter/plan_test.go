@@ -0,0 +1,118 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+type planSourceProvider struct {
+	layers []provider.SourceLayer
+}
+
+func (sp *planSourceProvider) Manifest(ctx context.Context) (*ocispec.Descriptor, error) {
+	return &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("manifest")}, nil
+}
+
+func (sp *planSourceProvider) Config(ctx context.Context) (*ocispec.Image, error) {
+	return &ocispec.Image{OS: "linux", Architecture: "amd64"}, nil
+}
+
+func (sp *planSourceProvider) Layers(ctx context.Context) ([]provider.SourceLayer, error) {
+	return sp.layers, nil
+}
+
+func TestPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-plan-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var layers []provider.SourceLayer
+	for _, content := range []string{"base", "lib", "app"} {
+		layers = append(layers, &hookSourceLayer{digest: digest.FromString(content), size: 100})
+	}
+	target, err := remote.NewLayout(filepath.Join(dir, "target"), "nydus")
+	require.Nil(t, err)
+	logger, err := provider.DefaultLogger()
+	require.Nil(t, err)
+
+	cvt, err := New(Opt{
+		Logger:          logger,
+		SourceProviders: []provider.SourceProvider{&planSourceProvider{layers: layers}},
+		TargetRemote:    target,
+		SourceRef:       "busybox:latest",
+		WorkDir:         filepath.Join(dir, "work"),
+		Squash:          2,
+		Provenance:      true,
+		BackendType:     "registry",
+	})
+	require.Nil(t, err)
+
+	plan, err := cvt.Plan(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "busybox:latest", plan.Source)
+	assert.Equal(t, digest.FromString("manifest"), plan.SourceManifest.Digest)
+	assert.Equal(t, "linux/amd64", plan.Platform)
+	assert.Equal(t, TargetFormatNydus, plan.TargetFormat)
+	assert.Equal(t, "tag", plan.Layout)
+	assert.Equal(t, "registry", plan.Backend)
+	assert.Equal(t, []string{"provenance"}, plan.Attachments)
+	require.Len(t, plan.Layers, 2)
+	assert.Equal(t, PlanLayer{
+		Index:    1,
+		Digest:   layers[1].Digest(),
+		ChainID:  layers[1].ChainID(),
+		Size:     200,
+		Squashed: 2,
+		Action:   PlanActionBuild,
+	}, plan.Layers[0])
+	assert.Equal(t, 2, plan.Layers[1].Index)
+	assert.Equal(t, int64(300), plan.BuildSize)
+
+	// The probe blob is pushed to target without any manifest
+	reader, err := target.Pull(context.Background(), ocispec.Descriptor{
+		Digest: digest.FromBytes(probeContent),
+		Size:   int64(len(probeContent)),
+	}, true)
+	require.Nil(t, err)
+	reader.Close()
+	_, err = target.Resolve(context.Background())
+	assert.NotNil(t, err)
+
+	// Exceeds the layer limit after squashing
+	cvt.MaxLayers = 1
+	_, err = cvt.Plan(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestPlanLayers(t *testing.T) {
+	layers := []provider.SourceLayer{
+		&hookSourceLayer{digest: digest.FromString("base"), size: 100},
+		&hookSourceLayer{digest: digest.FromString("app"), size: 200},
+	}
+	ig := &incrementalGlue{records: map[digest.Digest]*cache.CacheRecord{
+		layers[0].ChainID(): {SourceChainID: layers[0].ChainID()},
+	}}
+	logger, _ = provider.DefaultLogger()
+
+	planned := planLayers(context.Background(), layers, 0, nil, ig)
+	require.Len(t, planned, 2)
+	assert.Equal(t, PlanActionReused, planned[0].Action)
+	assert.Equal(t, PlanActionBuild, planned[1].Action)
+	assert.Equal(t, 1, planned[1].Index)
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CredentialFunc returns the username and secret of registry host, the
+// secret is used as identity token to fetch access token by OAuth if the
+// username is empty, both are empty if no credential is found.
+type CredentialFunc = func(host string) (string, string, error)
+
+const (
+	// envAuthPrefix specifies `username:password` of registry host by
+	// environment variable NYDUSIFY_AUTH_<HOST>.
+	envAuthPrefix = "NYDUSIFY_AUTH_"
+	// envTokenPrefix specifies the identity token of registry host by
+	// environment variable NYDUSIFY_TOKEN_<HOST>.
+	envTokenPrefix = "NYDUSIFY_TOKEN_"
+	// envHelperPrefix specifies the credential helper of registry host by
+	// environment variable NYDUSIFY_CREDENTIAL_HELPER_<HOST>, it overrides
+	// the one configured in docker config.
+	envHelperPrefix = "NYDUSIFY_CREDENTIAL_HELPER_"
+
+	// tokenUsername is the username returned by credential helper for
+	// identity token.
+	tokenUsername = "<token>"
+)
+
+// cloudHelpers are the credential helpers of cloud registries, they're
+// used if the helper binary is found in PATH and no other credential is
+// configured.
+var cloudHelpers = []struct {
+	pattern *regexp.Regexp
+	helper  string
+}{
+	// Amazon ECR
+	{regexp.MustCompile(`^[0-9]+\.dkr\.ecr(-fips)?\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`), "ecr-login"},
+	// Google Container Registry and Artifact Registry
+	{regexp.MustCompile(`^([a-z0-9-]+\.)?gcr\.io$|^[a-z0-9-]+-docker\.pkg\.dev$`), "gcr"},
+	// Azure Container Registry
+	{regexp.MustCompile(`^[a-z0-9-]+\.azurecr\.(io|cn|us)$`), "acr-env"},
+}
+
+var nonAlnum = regexp.MustCompile(`[^A-Z0-9]`)
+
+// normalizeHost converts the docker hub host resolved by containerd
+// back to the name used by users.
+func normalizeHost(host string) string {
+	if host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
+
+// envKey returns the environment variable name of host with prefix, the
+// host is upper-cased with non-alphanumeric characters replaced by `_`,
+// e.g. NYDUSIFY_AUTH_MYREGISTRY_COM_5000 for myregistry.com:5000.
+func envKey(prefix, host string) string {
+	return prefix + nonAlnum.ReplaceAllString(strings.ToUpper(normalizeHost(host)), "_")
+}
+
+// ChainCredential returns a CredentialFunc trying funcs in order, the
+// first found credential is used, and anonymous access is used if none
+// is found. The error of a func is logged and the next one is tried.
+func ChainCredential(funcs ...CredentialFunc) CredentialFunc {
+	return func(host string) (string, string, error) {
+		for _, fn := range funcs {
+			username, secret, err := fn(host)
+			if err != nil {
+				logrus.Warnf("Failed to get credential of %s: %s", host, err)
+				continue
+			}
+			if username != "" || secret != "" {
+				return username, secret, nil
+			}
+		}
+		logrus.Debugf("No credential found for %s, use anonymous access", host)
+		return "", "", nil
+	}
+}
+
+// EnvCredential reads the credential of registry host from environment
+// variables NYDUSIFY_AUTH_<HOST> in format `username:password`, or
+// NYDUSIFY_TOKEN_<HOST> for identity token.
+func EnvCredential(host string) (string, string, error) {
+	if auth := os.Getenv(envKey(envAuthPrefix, host)); auth != "" {
+		parts := strings.SplitN(auth, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return "", "", fmt.Errorf("invalid %s, should be in format username:password", envKey(envAuthPrefix, host))
+		}
+		return parts[0], parts[1], nil
+	}
+	if token := os.Getenv(envKey(envTokenPrefix, host)); token != "" {
+		return "", token, nil
+	}
+	return "", "", nil
+}
+
+// HelperCredential returns a CredentialFunc getting the credential by
+// docker credential helper binary `docker-credential-<helper>`.
+func HelperCredential(helper string) CredentialFunc {
+	return func(host string) (string, string, error) {
+		serverURL := normalizeHost(host)
+		if serverURL == "docker.io" {
+			serverURL = "https://index.docker.io/v1/"
+		}
+		program := client.NewShellProgramFunc("docker-credential-" + helper)
+		creds, err := client.Get(program, serverURL)
+		if err != nil {
+			if credentials.IsErrCredentialsNotFound(err) {
+				return "", "", nil
+			}
+			return "", "", errors.Wrapf(err, "get credential by helper %s", helper)
+		}
+		if creds.Username == tokenUsername {
+			return "", creds.Secret, nil
+		}
+		return creds.Username, creds.Secret, nil
+	}
+}
+
+// EnvHelperCredential gets the credential of registry host by the helper
+// specified in environment variable NYDUSIFY_CREDENTIAL_HELPER_<HOST>.
+func EnvHelperCredential(host string) (string, string, error) {
+	helper := os.Getenv(envKey(envHelperPrefix, host))
+	if helper == "" {
+		return "", "", nil
+	}
+	return HelperCredential(helper)(host)
+}
+
+// CloudHelperCredential gets the credential of cloud registry (ECR, GCR
+// and ACR) by its credential helper if the helper is installed.
+func CloudHelperCredential(host string) (string, string, error) {
+	for _, cloud := range cloudHelpers {
+		if !cloud.pattern.MatchString(host) {
+			continue
+		}
+		if _, err := exec.LookPath("docker-credential-" + cloud.helper); err != nil {
+			logrus.Debugf("Credential helper %s isn't found for %s", cloud.helper, host)
+			return "", "", nil
+		}
+		return HelperCredential(cloud.helper)(host)
+	}
+	return "", "", nil
+}
+
+// DockerConfigAuth reads the credential of registry host from docker auth
+// config file `$DOCKER_CONFIG/config.json`, including the credentials
+// stored by `credsStore` and `credHelpers` in it.
+func DockerConfigAuth(host string) (string, string, error) {
+	// The host of docker hub image will be converted to `registry-1.docker.io` in:
+	// github.com/containerd/containerd/remotes/docker/registry.go
+	// But we need use the key `https://index.docker.io/v1/` to find auth from docker config.
+	if host == "registry-1.docker.io" {
+		host = "https://index.docker.io/v1/"
+	}
+
+	config := dockerconfig.LoadDefaultConfigFile(os.Stderr)
+	authConfig, err := config.GetAuthConfig(host)
+	if err != nil {
+		return "", "", err
+	}
+
+	if authConfig.IdentityToken != "" {
+		return "", authConfig.IdentityToken, nil
+	}
+	return authConfig.Username, authConfig.Password, nil
+}
+
+// DefaultCredential gets the credential of registry host by the chain:
+//
+//  1. environment variables NYDUSIFY_AUTH_<HOST> and NYDUSIFY_TOKEN_<HOST>;
+//  2. credential helper in NYDUSIFY_CREDENTIAL_HELPER_<HOST>;
+//  3. docker config, including its credsStore and credHelpers;
+//  4. installed credential helper of cloud registry (ECR, GCR and ACR);
+//  5. anonymous access.
+var DefaultCredential = ChainCredential(
+	EnvCredential,
+	EnvHelperCredential,
+	DockerConfigAuth,
+	CloudHelperCredential,
+)
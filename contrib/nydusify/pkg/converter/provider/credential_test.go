@@ -0,0 +1,121 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setEnv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	require.Nil(t, os.Setenv(key, value))
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// writeHelper writes a fake credential helper to dir, which returns the
+// token for identity.example.com, the username and secret for other
+// hosts, and not found for unknown.example.com.
+func writeHelper(t *testing.T, dir, name string) {
+	script := `#!/bin/sh
+read host
+case "$host" in
+identity.example.com) echo '{"Username":"<token>","Secret":"identity"}' ;;
+unknown.example.com) echo "credentials not found in native keychain"; exit 1 ;;
+*) echo "{\"Username\":\"helper\",\"Secret\":\"$host\"}" ;;
+esac
+`
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte(script), 0755))
+}
+
+func TestCredentialChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-credential-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeHelper(t, dir, "test")
+	writeHelper(t, dir, "ecr-login")
+	setEnv(t, "PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	auth := base64.StdEncoding.EncodeToString([]byte("config:pass"))
+	config := fmt.Sprintf(`{"auths":{"config.example.com":{"auth":%q},"https://index.docker.io/v1/":{"auth":%q}}}`, auth, auth)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644))
+	setEnv(t, "DOCKER_CONFIG", dir)
+
+	setEnv(t, "NYDUSIFY_AUTH_CONFIG_EXAMPLE_COM", "env:pass")
+	setEnv(t, "NYDUSIFY_TOKEN_TOKEN_EXAMPLE_COM_5000", "token")
+	setEnv(t, "NYDUSIFY_AUTH_INVALID_EXAMPLE_COM", "invalid")
+	setEnv(t, "NYDUSIFY_CREDENTIAL_HELPER_DOCKER_IO", "test")
+	setEnv(t, "NYDUSIFY_CREDENTIAL_HELPER_IDENTITY_EXAMPLE_COM", "test")
+	setEnv(t, "NYDUSIFY_CREDENTIAL_HELPER_UNKNOWN_EXAMPLE_COM", "test")
+
+	for _, tc := range []struct {
+		host     string
+		username string
+		secret   string
+	}{
+		// Environment variable overrides docker config
+		{"config.example.com", "env", "pass"},
+		{"token.example.com:5000", "", "token"},
+		// Helper in environment variable overrides docker config
+		{"registry-1.docker.io", "helper", "https://index.docker.io/v1/"},
+		{"identity.example.com", "", "identity"},
+		// Helper of cloud registry
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com", "helper", "123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		// Anonymous access
+		{"unknown.example.com", "", ""},
+		{"invalid.example.com", "", ""},
+		{"myregistry.azurecr.io", "", ""},
+	} {
+		username, secret, err := DefaultCredential(tc.host)
+		require.Nil(t, err, tc.host)
+		assert.Equal(t, tc.username, username, tc.host)
+		assert.Equal(t, tc.secret, secret, tc.host)
+	}
+
+	os.Unsetenv("NYDUSIFY_AUTH_CONFIG_EXAMPLE_COM")
+	username, secret, err := DefaultCredential("config.example.com")
+	require.Nil(t, err)
+	assert.Equal(t, "config", username)
+	assert.Equal(t, "pass", secret)
+
+	_, _, err = EnvCredential("invalid.example.com")
+	assert.Contains(t, err.Error(), "NYDUSIFY_AUTH_INVALID_EXAMPLE_COM")
+}
+
+func TestChainCredential(t *testing.T) {
+	called := false
+	chain := ChainCredential(
+		func(string) (string, string, error) {
+			return "", "", errors.New("broken")
+		},
+		func(string) (string, string, error) {
+			return "user", "pass", nil
+		},
+		func(string) (string, string, error) {
+			called = true
+			return "", "", nil
+		},
+	)
+	username, secret, err := chain("example.com")
+	require.Nil(t, err)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "pass", secret)
+	assert.False(t, called)
+}
@@ -0,0 +1,691 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/proxy"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/pkg/dialer"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	// DockerDaemonScheme is the scheme of source image in the image store
+	// of docker daemon, e.g. `docker-daemon://nginx:latest`.
+	DockerDaemonScheme = "docker-daemon://"
+	// ContainerdScheme is the scheme of source image in the image store of
+	// containerd, e.g. `containerd://k8s.io/docker.io/library/nginx:latest`.
+	ContainerdScheme = "containerd://"
+	// OCILayoutScheme is the scheme of image in a directory of OCI image
+	// layout, e.g. `oci:///path/to/dir:latest`, the tag defaults to latest.
+	OCILayoutScheme = "oci://"
+	// DockerArchiveScheme is the scheme of image in a tarball exported by
+	// `docker save`, e.g. `docker-archive:///path/to/file.tar:nginx:latest`,
+	// the reference is optional if the tarball includes only one image.
+	DockerArchiveScheme = "docker-archive://"
+	// DefaultContainerdAddress is the default grpc address of containerd.
+	DefaultContainerdAddress = "/run/containerd/containerd.sock"
+
+	defaultDockerHost = "unix:///var/run/docker.sock"
+	dialTimeout       = 10 * time.Second
+)
+
+// IsLocalSource returns true if the source image is in local image store
+// or local file system.
+func IsLocalSource(source string) bool {
+	return strings.HasPrefix(source, DockerDaemonScheme) || strings.HasPrefix(source, ContainerdScheme) ||
+		IsLocalTarget(source)
+}
+
+// IsLocalTarget returns true if the target image is written to local
+// file system instead of registry.
+func IsLocalTarget(target string) bool {
+	return strings.HasPrefix(target, OCILayoutScheme) || strings.HasPrefix(target, DockerArchiveScheme)
+}
+
+// ParseLocalPath splits the image in `oci://` or `docker-archive://`
+// scheme into the file path and the tag or reference after the first
+// colon in path.
+func ParseLocalPath(ref string) (string, string) {
+	for _, scheme := range []string{OCILayoutScheme, DockerArchiveScheme} {
+		if strings.HasPrefix(ref, scheme) {
+			ref = strings.TrimPrefix(ref, scheme)
+			break
+		}
+	}
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func layoutTag(tag string) string {
+	if tag == "" {
+		return "latest"
+	}
+	return tag
+}
+
+// LocalReference returns the image reference of local source image
+// without the scheme and containerd namespace.
+func LocalReference(source string) string {
+	if strings.HasPrefix(source, DockerArchiveScheme) {
+		_, ref := ParseLocalPath(source)
+		return ref
+	}
+	if strings.HasPrefix(source, DockerDaemonScheme) {
+		return strings.TrimPrefix(source, DockerDaemonScheme)
+	}
+	if strings.HasPrefix(source, ContainerdScheme) {
+		ref := strings.TrimPrefix(source, ContainerdScheme)
+		if idx := strings.Index(ref, "/"); idx >= 0 {
+			return ref[idx+1:]
+		}
+		return ref
+	}
+	return source
+}
+
+// LocalSource streams image layers from the image store of docker daemon
+// or containerd, or from the OCI image layout and tarball in local file
+// system, the source should be in `docker-daemon://`, `containerd://<namespace>/`,
+// `oci://` or `docker-archive://` scheme.
+func LocalSource(ctx context.Context, source, workDir, containerdAddress string) ([]SourceProvider, error) {
+	var image *parser.Image
+	var puller contentPuller
+	var err error
+
+	switch {
+	case strings.HasPrefix(source, OCILayoutScheme):
+		dir, tag := ParseLocalPath(source)
+		if _, err := os.Stat(filepath.Join(dir, ocispec.ImageLayoutFile)); err != nil {
+			return nil, errors.Wrapf(err, "Invalid OCI image layout %s", dir)
+		}
+		layout, err := remote.NewLayout(dir, layoutTag(tag))
+		if err != nil {
+			return nil, err
+		}
+		return DefaultSource(ctx, layout, workDir)
+	case strings.HasPrefix(source, DockerArchiveScheme):
+		path, ref := ParseLocalPath(source)
+		image, puller, err = loadFromArchive(ctx, path, ref, workDir)
+	case strings.HasPrefix(source, DockerDaemonScheme):
+		image, puller, err = exportFromDocker(ctx, LocalReference(source), workDir)
+	case strings.HasPrefix(source, ContainerdScheme):
+		ref := strings.TrimPrefix(source, ContainerdScheme)
+		parts := strings.SplitN(ref, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid containerd source %s, should be %s<namespace>/<image>", source, ContainerdScheme)
+		}
+		image, puller, err = resolveFromContainerd(ctx, containerdAddress, parts[0], parts[1])
+	default:
+		return nil, fmt.Errorf("Unsupported local source %s", source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return []SourceProvider{
+		&defaultSourceProvider{
+			workDir: workDir,
+			image:   *image,
+			remote:  puller,
+		},
+	}, nil
+}
+
+// fileStore pulls the layers exported from docker daemon in work directory.
+type fileStore struct {
+	paths map[digest.Digest]string
+}
+
+func (store *fileStore) Pull(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (io.ReadCloser, error) {
+	path, ok := store.paths[desc.Digest]
+	if !ok {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "layer %s", desc.Digest)
+	}
+	return os.Open(path)
+}
+
+// dockerSaveManifest is the manifest.json in the tarball exported by
+// `docker save`, the layers are uncompressed tar files.
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+func newDockerClient() (*http.Client, string, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "Parse docker host %s", host)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", u.Path)
+			},
+		}
+		return &http.Client{Transport: transport}, "http://docker", nil
+	case "tcp":
+		return &http.Client{}, "http://" + u.Host, nil
+	default:
+		return nil, "", fmt.Errorf("Unsupported docker host %s", host)
+	}
+}
+
+// untar extracts the regular files and symlinks (`docker save` links
+// the duplicated layers) in tar stream to dir.
+func untar(reader io.Reader, dir string) error {
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Invalid file path %s in tarball", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			linked := filepath.Join(filepath.Dir(target), hdr.Linkname)
+			if !strings.HasPrefix(linked, filepath.Clean(dir)+string(filepath.Separator)) {
+				return fmt.Errorf("Invalid symlink %s -> %s in tarball", hdr.Name, hdr.Linkname)
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exportFromDocker exports the image from docker daemon to work directory,
+// the image doesn't have a manifest in docker daemon, so the manifest is
+// made up of the uncompressed layers.
+func exportFromDocker(ctx context.Context, ref, workDir string) (*parser.Image, contentPuller, error) {
+	client, endpoint, err := newDockerClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/images/get?names="+url.QueryEscape(ref), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Export image %s from docker daemon", ref)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, nil, fmt.Errorf("Export image %s from docker daemon: %s %s", ref, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	exportDir := filepath.Join(workDir, "docker-daemon")
+	if err := os.RemoveAll(exportDir); err != nil {
+		return nil, nil, errors.Wrap(err, "Remove export directory")
+	}
+	if err := untar(resp.Body, exportDir); err != nil {
+		return nil, nil, errors.Wrapf(err, "Extract image %s exported from docker daemon", ref)
+	}
+
+	return loadDockerArchive(exportDir, "")
+}
+
+// loadFromArchive extracts the tarball exported by `docker save` to work
+// directory, the tarball in OCI image layout is also accepted.
+func loadFromArchive(ctx context.Context, path, ref, workDir string) (*parser.Image, contentPuller, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Open image tarball")
+	}
+	defer file.Close()
+
+	exportDir := filepath.Join(workDir, "docker-archive")
+	if err := os.RemoveAll(exportDir); err != nil {
+		return nil, nil, errors.Wrap(err, "Remove export directory")
+	}
+	if err := untar(file, exportDir); err != nil {
+		return nil, nil, errors.Wrapf(err, "Extract image tarball %s", path)
+	}
+
+	if _, err := os.Stat(filepath.Join(exportDir, "manifest.json")); os.IsNotExist(err) {
+		layout, err := remote.NewLayout(exportDir, layoutTag(ref))
+		if err != nil {
+			return nil, nil, err
+		}
+		parsed, err := parser.New(layout).Parse(ctx)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Parse image layout in tarball %s", path)
+		}
+		if parsed.OCIImage == nil {
+			return nil, nil, fmt.Errorf("Not found OCI %s manifest in image tarball %s", utils.SupportedOS+"/"+utils.SupportedArch, path)
+		}
+		return parsed.OCIImage, layout, nil
+	}
+
+	return loadDockerArchive(exportDir, ref)
+}
+
+// loadDockerArchive loads the image extracted from tarball in `docker save`
+// format, the image doesn't have a manifest, so the manifest is made up of
+// the uncompressed layers. The image is selected by reference if the
+// tarball includes multiple images.
+func loadDockerArchive(exportDir, ref string) (*parser.Image, contentPuller, error) {
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(exportDir, "manifest.json"))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Read manifest of exported image")
+	}
+	var manifests []dockerSaveManifest
+	if err := json.Unmarshal(manifestBytes, &manifests); err != nil {
+		return nil, nil, errors.Wrap(err, "Unmarshal manifest of exported image")
+	}
+	saved, err := selectSavedImage(manifests, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configBytes, err := ioutil.ReadFile(filepath.Join(exportDir, filepath.Clean(saved.Config)))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Read config of exported image")
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return nil, nil, errors.Wrap(err, "Unmarshal config of exported image")
+	}
+	if !utils.IsSupportedPlatform(config.OS, config.Architecture) {
+		return nil, nil, fmt.Errorf("Unsupported platform %s/%s of exported image", config.OS, config.Architecture)
+	}
+	diffIDs := config.RootFS.DiffIDs
+	if len(saved.Layers) != len(diffIDs) {
+		return nil, nil, fmt.Errorf("Mismatched fs layers (%d) and diff ids (%d)", len(saved.Layers), len(diffIDs))
+	}
+
+	store := &fileStore{paths: make(map[digest.Digest]string)}
+	layers := []ocispec.Descriptor{}
+	for idx, layer := range saved.Layers {
+		path := filepath.Join(exportDir, filepath.Clean(layer))
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Stat layer %s", layer)
+		}
+		store.paths[diffIDs[idx]] = path
+		layers = append(layers, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    diffIDs[idx],
+			Size:      info.Size(),
+		})
+	}
+
+	return &parser.Image{
+		Manifest: ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config: ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageConfig,
+				Digest:    digest.FromBytes(configBytes),
+				Size:      int64(len(configBytes)),
+			},
+			Layers: layers,
+		},
+		Config: config,
+	}, store, nil
+}
+
+func selectSavedImage(manifests []dockerSaveManifest, ref string) (*dockerSaveManifest, error) {
+	if ref == "" {
+		if len(manifests) != 1 {
+			return nil, fmt.Errorf("Expected 1 image in exported tarball, got %d, please specify the image reference", len(manifests))
+		}
+		return &manifests[0], nil
+	}
+
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid image reference %s", ref)
+	}
+	for idx := range manifests {
+		for _, tag := range manifests[idx].RepoTags {
+			if tagNamed, err := docker.ParseDockerRef(tag); err == nil && tagNamed.String() == named.String() {
+				return &manifests[idx], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("Not found image %s in exported tarball", ref)
+}
+
+// containerdStore pulls the image content from containerd content store.
+type containerdStore struct {
+	store     content.Store
+	namespace string
+}
+
+func (store *containerdStore) Pull(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (io.ReadCloser, error) {
+	ctx = namespaces.WithNamespace(ctx, store.namespace)
+	ra, err := store.store.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Read %s from containerd content store", desc.Digest)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: content.NewReader(ra),
+		Closer: ra,
+	}, nil
+}
+
+func (store *containerdStore) pull(ctx context.Context, desc ocispec.Descriptor, res interface{}) error {
+	reader, err := store.Pull(ctx, desc, true)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	bytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrapf(err, "Read %s", desc.Digest)
+	}
+
+	return json.Unmarshal(bytes, res)
+}
+
+// resolve finds the OCI manifest of supported platform from the
+// target of image in containerd.
+func (store *containerdStore) resolve(ctx context.Context, desc ocispec.Descriptor) (*parser.Image, error) {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index ocispec.Index
+		if err := store.pull(ctx, desc, &index); err != nil {
+			return nil, errors.Wrap(err, "Pull image index")
+		}
+		for _, manifest := range index.Manifests {
+			platform := manifest.Platform
+			if platform != nil && utils.IsSupportedPlatform(platform.OS, platform.Architecture) && !utils.IsNydusPlatform(platform) {
+				return store.resolve(ctx, manifest)
+			}
+		}
+		return nil, fmt.Errorf("Not found OCI %s manifest in source image", utils.SupportedOS+"/"+utils.SupportedArch)
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		var manifest ocispec.Manifest
+		if err := store.pull(ctx, desc, &manifest); err != nil {
+			return nil, errors.Wrap(err, "Pull image manifest")
+		}
+		var config ocispec.Image
+		if err := store.pull(ctx, manifest.Config, &config); err != nil {
+			return nil, errors.Wrap(err, "Pull image config")
+		}
+		if !utils.IsSupportedPlatform(config.OS, config.Architecture) {
+			return nil, fmt.Errorf("Unsupported platform %s/%s of source image", config.OS, config.Architecture)
+		}
+		return &parser.Image{
+			Desc:     desc,
+			Manifest: manifest,
+			Config:   config,
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported media type %s of source image", desc.MediaType)
+	}
+}
+
+// resolveFromContainerd resolves the image in the namespace of containerd,
+// the grpc connection is kept open for pulling layers during conversion.
+func resolveFromContainerd(ctx context.Context, address, namespace, ref string) (*parser.Image, contentPuller, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, dialer.DialAddress(address),
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(dialer.ContextDialer),
+	)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Dial containerd %s", address)
+	}
+
+	nsCtx := namespaces.WithNamespace(ctx, namespace)
+	client := imagesapi.NewImagesClient(conn)
+	resp, err := client.Get(nsCtx, &imagesapi.GetImageRequest{Name: ref})
+	if err != nil && errdefs.IsNotFound(errdefs.FromGRPC(err)) {
+		// The images pulled by CRI are stored in normalized name
+		if named, parseErr := docker.ParseDockerRef(ref); parseErr == nil && named.String() != ref {
+			resp, err = client.Get(nsCtx, &imagesapi.GetImageRequest{Name: named.String()})
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrapf(errdefs.FromGRPC(err), "Get image %s in containerd namespace %s", ref, namespace)
+	}
+
+	store := &containerdStore{
+		store:     proxy.NewContentStore(contentapi.NewContentClient(conn)),
+		namespace: namespace,
+	}
+	target := resp.Image.Target
+	image, err := store.resolve(ctx, ocispec.Descriptor{
+		MediaType: target.MediaType,
+		Digest:    target.Digest,
+		Size:      target.Size_,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrapf(err, "Resolve image %s in containerd", ref)
+	}
+
+	return image, store, nil
+}
+
+func archiveLayoutDir(workDir string) string {
+	return filepath.Join(workDir, "docker-archive-target")
+}
+
+// LocalTarget creates a remote instance writing the target image to the
+// OCI image layout directory in `oci://` scheme, or to an intermediate
+// layout in work directory for the tarball in `docker-archive://` scheme,
+// which is written by ExportLocalTarget after conversion.
+func LocalTarget(target, workDir string) (*remote.Remote, error) {
+	path, ref := ParseLocalPath(target)
+	if path == "" {
+		return nil, fmt.Errorf("Invalid local target %s", target)
+	}
+
+	if strings.HasPrefix(target, OCILayoutScheme) {
+		return remote.NewLayout(path, layoutTag(ref))
+	}
+
+	dir := archiveLayoutDir(workDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, errors.Wrap(err, "Remove intermediate image layout")
+	}
+	layout, err := remote.NewLayout(dir, archiveTag(ref))
+	if err != nil {
+		return nil, err
+	}
+	layout.Ref = target
+
+	return layout, nil
+}
+
+// archiveTag returns the tag of the reference in `docker-archive://`
+// scheme, which is used in the intermediate image layout.
+func archiveTag(ref string) string {
+	if ref == "" {
+		return "latest"
+	}
+	if named, err := docker.ParseDockerRef(ref); err == nil {
+		if tagged, ok := named.(docker.Tagged); ok {
+			return tagged.Tag()
+		}
+	}
+	return "latest"
+}
+
+// ExportLocalTarget packs the intermediate image layout to the tarball of
+// target in `docker-archive://` scheme, it's no-op for other targets. The
+// tarball includes the OCI image layout and a `manifest.json` in the
+// format of `docker save` if the target is a single manifest.
+func ExportLocalTarget(ctx context.Context, target, workDir string) error {
+	if !strings.HasPrefix(target, DockerArchiveScheme) {
+		return nil
+	}
+	path, ref := ParseLocalPath(target)
+	dir := archiveLayoutDir(workDir)
+
+	layout, err := remote.NewLayout(dir, archiveTag(ref))
+	if err != nil {
+		return err
+	}
+	desc, err := layout.Resolve(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Resolve target image in intermediate image layout")
+	}
+	if desc.MediaType == ocispec.MediaTypeImageManifest || desc.MediaType == images.MediaTypeDockerSchema2Manifest {
+		reader, err := layout.Pull(ctx, *desc, true)
+		if err != nil {
+			return errors.Wrap(err, "Pull target manifest")
+		}
+		manifestBytes, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return errors.Wrap(err, "Read target manifest")
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			return errors.Wrap(err, "Unmarshal target manifest")
+		}
+		saved := dockerSaveManifest{
+			Config:   blobPathInLayout(manifest.Config.Digest),
+			RepoTags: []string{},
+		}
+		if ref != "" {
+			saved.RepoTags = append(saved.RepoTags, ref)
+		}
+		for _, layer := range manifest.Layers {
+			saved.Layers = append(saved.Layers, blobPathInLayout(layer.Digest))
+		}
+		savedBytes, err := json.Marshal([]dockerSaveManifest{saved})
+		if err != nil {
+			return errors.Wrap(err, "Marshal manifest of docker archive")
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), savedBytes, 0644); err != nil {
+			return errors.Wrap(err, "Write manifest of docker archive")
+		}
+	}
+
+	if err := writeTar(dir, path); err != nil {
+		return errors.Wrapf(err, "Write image tarball %s", path)
+	}
+
+	return nil
+}
+
+func blobPathInLayout(dgst digest.Digest) string {
+	return filepath.Join("blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// writeTar packs the regular files in dir to the tarball at path.
+func writeTar(dir, path string) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	tw := tar.NewWriter(file)
+	if err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     rel,
+			Mode:     0644,
+			Size:     info.Size(),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return err
+		}
+		src, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestLocalReference(t *testing.T) {
+	assert.True(t, IsLocalSource("docker-daemon://nginx:latest"))
+	assert.True(t, IsLocalSource("containerd://k8s.io/nginx:latest"))
+	assert.False(t, IsLocalSource("localhost:5000/nginx:latest"))
+
+	assert.Equal(t, "nginx:latest", LocalReference("docker-daemon://nginx:latest"))
+	assert.Equal(t, "docker.io/library/nginx:latest", LocalReference("containerd://k8s.io/docker.io/library/nginx:latest"))
+	assert.Equal(t, "localhost:5000/nginx:latest", LocalReference("localhost:5000/nginx:latest"))
+}
+
+func makeTar(t *testing.T, files map[string][]byte, links map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range files {
+		require.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(data)
+		require.Nil(t, err)
+	}
+	for name, link := range links {
+		require.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Linkname: link, Typeflag: tar.TypeSymlink}))
+	}
+	require.Nil(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestDockerDaemonSource(t *testing.T) {
+	layer := makeTar(t, map[string][]byte{"etc/hosts": []byte("127.0.0.1 localhost")}, nil)
+	diffID := digest.FromBytes(layer)
+	config, err := json.Marshal(ocispec.Image{
+		OS:           utils.SupportedOS,
+		Architecture: utils.SupportedArch,
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{diffID, diffID},
+		},
+	})
+	require.Nil(t, err)
+	manifest, err := json.Marshal([]dockerSaveManifest{{
+		Config:   "config.json",
+		RepoTags: []string{"nginx:latest"},
+		Layers:   []string{"layer1/layer.tar", "layer2/layer.tar"},
+	}})
+	require.Nil(t, err)
+	saved := makeTar(t, map[string][]byte{
+		"manifest.json":    manifest,
+		"config.json":      config,
+		"layer1/layer.tar": layer,
+	}, map[string]string{
+		// The duplicated layer is a symlink in tarball
+		"layer2/layer.tar": "../layer1/layer.tar",
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/get" || r.URL.Query().Get("names") != "nginx:latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(saved)
+	}))
+	defer server.Close()
+	os.Setenv("DOCKER_HOST", strings.Replace(server.URL, "http://", "tcp://", 1))
+	defer os.Unsetenv("DOCKER_HOST")
+
+	workDir, err := ioutil.TempDir("", "nydusify-local-")
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	ctx := context.Background()
+	_, err = LocalSource(ctx, "docker-daemon://busybox:latest", workDir, "")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "404")
+
+	sources, err := LocalSource(ctx, "docker-daemon://nginx:latest", workDir, "")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sources))
+	manifestDesc, err := sources[0].Manifest(ctx)
+	require.Nil(t, err)
+	assert.Nil(t, manifestDesc)
+
+	layers, err := sources[0].Layers(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(layers))
+	assert.Equal(t, diffID, layers[0].Digest())
+	assert.Equal(t, int64(len(layer)), layers[1].Size())
+
+	mounts, umount, err := layers[1].Mount(ctx)
+	require.Nil(t, err)
+	defer umount()
+	hosts, err := ioutil.ReadFile(mounts[0].Source + "/etc/hosts")
+	require.Nil(t, err)
+	assert.Equal(t, "127.0.0.1 localhost", string(hosts))
+
+	// Refuse the file out of export directory
+	evil := makeTar(t, map[string][]byte{"../evil": []byte("evil")}, nil)
+	assert.NotNil(t, untar(bytes.NewReader(evil), workDir))
+}
+
+func TestLocalFileSystem(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-local-")
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	path, ref := ParseLocalPath("docker-archive:///tmp/image.tar:nginx:latest")
+	assert.Equal(t, "/tmp/image.tar", path)
+	assert.Equal(t, "nginx:latest", ref)
+	assert.Equal(t, "nginx:latest", LocalReference("docker-archive:///tmp/image.tar:nginx:latest"))
+	path, ref = ParseLocalPath("oci:///tmp/layout")
+	assert.Equal(t, "/tmp/layout", path)
+	assert.Equal(t, "", ref)
+	assert.True(t, IsLocalSource("oci:///tmp/layout"))
+	assert.True(t, IsLocalTarget("docker-archive:///tmp/image.tar"))
+	assert.False(t, IsLocalTarget("docker-daemon://nginx:latest"))
+
+	// Write an image to tarball through the intermediate image layout
+	ctx := context.Background()
+	layer := makeTar(t, map[string][]byte{"etc/hosts": []byte("127.0.0.1 localhost")}, nil)
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+	config, err := json.Marshal(ocispec.Image{
+		OS:           utils.SupportedOS,
+		Architecture: utils.SupportedArch,
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layerDesc.Digest},
+		},
+	})
+	require.Nil(t, err)
+	configDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(config),
+		Size:      int64(len(config)),
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	})
+	require.Nil(t, err)
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+
+	archive := filepath.Join(workDir, "image.tar")
+	target := "docker-archive://" + archive + ":nginx:v1"
+	targetRemote, err := LocalTarget(target, filepath.Join(workDir, "target"))
+	require.Nil(t, err)
+	require.Nil(t, targetRemote.Push(ctx, layerDesc, true, bytes.NewReader(layer)))
+	require.Nil(t, targetRemote.Push(ctx, configDesc, true, bytes.NewReader(config)))
+	require.Nil(t, targetRemote.Push(ctx, manifestDesc, false, bytes.NewReader(manifest)))
+	require.Nil(t, ExportLocalTarget(ctx, target, filepath.Join(workDir, "target")))
+
+	// Load the tarball in `docker save` format
+	_, err = LocalSource(ctx, "docker-archive://"+archive+":busybox:latest", filepath.Join(workDir, "source"), "")
+	assert.NotNil(t, err)
+	sources, err := LocalSource(ctx, target, filepath.Join(workDir, "source"), "")
+	require.Nil(t, err)
+	layers, err := sources[0].Layers(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(layers))
+	assert.Equal(t, layerDesc.Digest, layers[0].Digest())
+
+	// Load the OCI image layout extracted from tarball
+	layoutDir := filepath.Join(workDir, "layout")
+	file, err := os.Open(archive)
+	require.Nil(t, err)
+	defer file.Close()
+	require.Nil(t, untar(file, layoutDir))
+	require.Nil(t, os.Remove(filepath.Join(layoutDir, "manifest.json")))
+	sources, err = LocalSource(ctx, "oci://"+layoutDir+":v1", filepath.Join(workDir, "source"), "")
+	require.Nil(t, err)
+	desc, err := sources[0].Manifest(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, manifestDesc.Digest, desc.Digest)
+	_, err = LocalSource(ctx, "oci://"+layoutDir+":v2", filepath.Join(workDir, "source"), "")
+	assert.NotNil(t, err)
+}
@@ -9,96 +9,182 @@ import (
 	"encoding/base64"
 	"net"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
-	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/distribution/reference"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
 )
 
-func newDefaultClient() *http.Client {
+// RemoteOpt configures the remote created by DefaultRemote.
+type RemoteOpt func(*remoteOpt)
+
+type remoteOpt struct {
+	httpCacheDir string
+}
+
+// WithHTTPCache caches the manifest and config responses from registry in
+// dir, the cache is disabled if dir is empty, it's only used by the remotes
+// of RegistryProvider.
+func WithHTTPCache(dir string) RemoteOpt {
+	return func(opt *remoteOpt) {
+		opt.httpCacheDir = dir
+	}
+}
+
+// newDefaultTransport creates the transport to registry host, it uses the
+// proxy in environment variables HTTP_PROXY, HTTPS_PROXY and NO_PROXY, and
+// the TLS options added by AddHostTLS for host.
+func newDefaultTransport(host string) http.RoundTripper {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 5 * time.Second,
+		DisableKeepAlives:     true,
+		TLSClientConfig:       getHostTLS(host),
+		TLSNextProto:          make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
+	}
+}
+
+// NewRegistryClient creates a http client to registry host, with the proxy
+// and TLS options used by the remotes.
+func NewRegistryClient(host string) *http.Client {
+	return &http.Client{
+		Transport: newDefaultTransport(host),
+	}
+}
+
+// newCachedClient creates a http client which serves the immutable
+// manifest and config requests from the cache in cacheDir.
+func newCachedClient(host, cacheDir string) *http.Client {
+	if cacheDir == "" {
+		return NewRegistryClient(host)
+	}
+	transport, err := remote.NewCachedTransport(cacheDir, newDefaultTransport(host))
+	if err != nil {
+		logrus.Warnf("Disable http cache: %s", err)
+		return NewRegistryClient(host)
+	}
 	return &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:          10,
-			IdleConnTimeout:       30 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 5 * time.Second,
-			DisableKeepAlives:     true,
-			TLSNextProto:          make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
-		},
+		Transport: transport,
 	}
 }
 
-// withCredentialFunc accepts host url parameter and returns with
-// username, password and error.
-type withCredentialFunc = func(string) (string, string, error)
-
-// withRemote creates an remote instance, it uses the implemention of containerd
-// docker remote to access image from remote registry.
-func withRemote(ref string, insecure bool, credFunc withCredentialFunc) (*remote.Remote, error) {
-	resolverFunc := func() remotes.Resolver {
-		registryHosts := docker.ConfigureDefaultRegistries(
-			docker.WithAuthorizer(docker.NewAuthorizer(
-				newDefaultClient(),
-				credFunc,
-			)),
-			docker.WithClient(newDefaultClient()),
-			docker.WithPlainHTTP(func(host string) (bool, error) {
-				_insecure, err := docker.MatchLocalhost(host)
-				if err != nil {
-					return false, err
-				}
-				if _insecure {
-					return true, nil
-				}
-				return insecure, nil
-			}),
-		)
-
-		return docker.NewResolver(docker.ResolverOptions{
-			Hosts: registryHosts,
-		})
+// RemoteProviderFactory creates the provider of registry clients for the
+// remote of image in registry host, credFunc is the credential chain used
+// by default, which can be ignored by the custom provider.
+type RemoteProviderFactory func(host string, insecure bool, credFunc CredentialFunc) (remote.RemoteProvider, error)
+
+// AnyHost registers the remote provider factory for the hosts without
+// their own factories.
+const AnyHost = "*"
+
+var (
+	remoteProvidersLock sync.Mutex
+	remoteProviders     = map[string]RemoteProviderFactory{}
+)
+
+// RegisterRemoteProvider registers the remote provider factory of registry
+// host, or AnyHost, which is used by the remotes created afterwards instead
+// of RegistryProvider, e.g. to get token from an internal token service, the
+// factory registered for the same host is replaced, and it's unregistered
+// if factory is nil.
+func RegisterRemoteProvider(host string, factory RemoteProviderFactory) {
+	remoteProvidersLock.Lock()
+	defer remoteProvidersLock.Unlock()
+	if factory == nil {
+		delete(remoteProviders, host)
+		return
 	}
+	remoteProviders[host] = factory
+}
 
-	return remote.New(ref, resolverFunc)
+func getRemoteProvider(host string) RemoteProviderFactory {
+	remoteProvidersLock.Lock()
+	defer remoteProvidersLock.Unlock()
+	if factory := remoteProviders[host]; factory != nil {
+		return factory
+	}
+	return remoteProviders[AnyHost]
 }
 
-// DefaultRemote creates an remote instance, it attempts to read docker auth config
-// file `$DOCKER_CONFIG/config.json` to communicate with remote registry, `$DOCKER_CONFIG`
-// defaults to `~/.docker`.
-func DefaultRemote(ref string, insecure bool) (*remote.Remote, error) {
-	return withRemote(ref, insecure, func(host string) (string, string, error) {
-		// The host of docker hub image will be converted to `registry-1.docker.io` in:
-		// github.com/containerd/containerd/remotes/docker/registry.go
-		// But we need use the key `https://index.docker.io/v1/` to find auth from docker config.
-		if host == "registry-1.docker.io" {
-			host = "https://index.docker.io/v1/"
+// RegistryProvider creates the provider of containerd docker remote clients,
+// with the proxy and TLS options of registry host and the credential by
+// credFunc, the custom provider can wrap it to modify part of the requests.
+func RegistryProvider(insecure bool, credFunc CredentialFunc, opts ...RemoteOpt) remote.RemoteProvider {
+	opt := remoteOpt{}
+	for _, o := range opts {
+		o(&opt)
+	}
+	return remote.HostsFunc(func() docker.RegistryHosts {
+		return func(host string) ([]docker.RegistryHost, error) {
+			// The clients are created for each host to apply its TLS options,
+			// the token server is accessed with the options of registry host
+			return docker.ConfigureDefaultRegistries(
+				docker.WithAuthorizer(docker.NewAuthorizer(
+					NewRegistryClient(host),
+					credFunc,
+				)),
+				docker.WithClient(newCachedClient(host, opt.httpCacheDir)),
+				docker.WithPlainHTTP(func(host string) (bool, error) {
+					_insecure, err := docker.MatchLocalhost(host)
+					if err != nil {
+						return false, err
+					}
+					if _insecure {
+						return true, nil
+					}
+					return insecure, nil
+				}),
+			)(host)
 		}
+	})
+}
+
+// withRemote creates an remote instance, it uses the provider registered for
+// the registry host of ref, or the implemention of containerd docker remote
+// to access image from remote registry.
+func withRemote(ref string, insecure bool, credFunc CredentialFunc, opts []RemoteOpt) (*remote.Remote, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, err
+	}
+	host := reference.Domain(named)
 
-		config := dockerconfig.LoadDefaultConfigFile(os.Stderr)
-		authConfig, err := config.GetAuthConfig(host)
+	remoteProvider := RegistryProvider(insecure, credFunc, opts...)
+	if factory := getRemoteProvider(host); factory != nil {
+		remoteProvider, err = factory(host, insecure, credFunc)
 		if err != nil {
-			return "", "", err
+			return nil, errors.Wrapf(err, "Create remote provider of %s", host)
 		}
+	}
 
-		return authConfig.Username, authConfig.Password, nil
-	})
+	return remote.NewWithProvider(ref, remoteProvider)
+}
+
+// DefaultRemote creates an remote instance, it gets the registry credential
+// by DefaultCredential chain, which reads docker auth config file
+// `$DOCKER_CONFIG/config.json` (`$DOCKER_CONFIG` defaults to `~/.docker`)
+// with environment variable and credential helper overrides.
+func DefaultRemote(ref string, insecure bool, opts ...RemoteOpt) (*remote.Remote, error) {
+	return withRemote(ref, insecure, DefaultCredential, opts)
 }
 
 // DefaultRemoteWithAuth creates an remote instance, it parses base64 encoded auth string
 // to communicate with remote registry.
-func DefaultRemoteWithAuth(ref string, insecure bool, auth string) (*remote.Remote, error) {
+func DefaultRemoteWithAuth(ref string, insecure bool, auth string, opts ...RemoteOpt) (*remote.Remote, error) {
 	return withRemote(ref, insecure, func(host string) (string, string, error) {
 		// Leave auth empty if no authorization be required
 		if strings.TrimSpace(auth) == "" {
@@ -113,5 +199,5 @@ func DefaultRemoteWithAuth(ref string, insecure bool, auth string) (*remote.Remo
 			return "", "", errors.New("Invalid base64 encoded auth string")
 		}
 		return ary[0], ary[1], nil
-	})
+	}, opts)
 }
@@ -0,0 +1,73 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+func TestRegisterRemoteProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-provider-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Redirect the requests to the registry host to a local image layout
+	layout, err := remote.NewLayout(dir, "latest")
+	require.Nil(t, err)
+	hosts := []string{}
+	RegisterRemoteProvider("registry.internal", func(host string, insecure bool, credFunc CredentialFunc) (remote.RemoteProvider, error) {
+		hosts = append(hosts, host)
+		return layout.Provider(), nil
+	})
+	defer RegisterRemoteProvider("registry.internal", nil)
+
+	imageRemote, err := DefaultRemote("registry.internal/app:v1", false)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"registry.internal"}, hosts)
+
+	data := []byte("blob")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	require.Nil(t, imageRemote.Push(context.Background(), desc, true, bytes.NewReader(data)))
+	exists, err := layout.BlobExists(context.Background(), desc)
+	require.Nil(t, err)
+	assert.True(t, exists)
+	// The remote of another tag keeps the provider
+	tagRemote, err := imageRemote.WithTag("v2")
+	require.Nil(t, err)
+	exists, err = tagRemote.BlobExists(context.Background(), desc)
+	require.Nil(t, err)
+	assert.True(t, exists)
+
+	// The other hosts use the default registry provider
+	otherRemote, err := DefaultRemote("docker.io/library/busybox:latest", false)
+	require.Nil(t, err)
+	_, ok := otherRemote.Provider().(remote.HostsFunc)
+	assert.True(t, ok)
+
+	RegisterRemoteProvider(AnyHost, func(host string, insecure bool, credFunc CredentialFunc) (remote.RemoteProvider, error) {
+		return nil, errors.New("token service unavailable")
+	})
+	defer RegisterRemoteProvider(AnyHost, nil)
+	_, err = DefaultRemote("docker.io/library/busybox:latest", false)
+	assert.NotNil(t, err)
+	_, err = DefaultRemote("registry.internal/app:v1", false)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// MountFunc mounts the diff of layer, returns the mounts and the function
+// to umount them.
+type MountFunc func(ctx context.Context) ([]mount.Mount, func() error, error)
+
+// SnapshotLayer is a layer mounted from snapshotter instead of being pulled
+// from registry, e.g. the immutable ref of BuildKit, the mounts should be
+// `bind` mount of the layer diff, or `overlay` mount with the layer diff as
+// the first lowerdir.
+type SnapshotLayer struct {
+	DiffID digest.Digest
+	// Size is the size of layer blob or diff, only for progress and
+	// statistics.
+	Size  int64
+	Mount MountFunc
+}
+
+type snapshotSourceProvider struct {
+	manifest *ocispec.Descriptor
+	config   ocispec.Image
+	layers   []SnapshotLayer
+}
+
+type snapshotSourceLayer struct {
+	layer         SnapshotLayer
+	chainID       digest.Digest
+	parentChainID *digest.Digest
+}
+
+// SnapshotSource provides the image built in snapshotter as source image,
+// the diff ids in config should match the layers, manifest is nil if the
+// image isn't committed to a manifest yet.
+func SnapshotSource(manifest *ocispec.Descriptor, config ocispec.Image, layers []SnapshotLayer) (SourceProvider, error) {
+	if len(layers) != len(config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("Mismatched snapshot layers (%d) and diff ids (%d)", len(layers), len(config.RootFS.DiffIDs))
+	}
+	for idx, layer := range layers {
+		if layer.DiffID != config.RootFS.DiffIDs[idx] {
+			return nil, fmt.Errorf("Mismatched diff id of snapshot layer %d: %s", idx, layer.DiffID)
+		}
+		if layer.Mount == nil {
+			return nil, fmt.Errorf("Snapshot layer %d isn't mountable", idx)
+		}
+	}
+	return &snapshotSourceProvider{
+		manifest: manifest,
+		config:   config,
+		layers:   layers,
+	}, nil
+}
+
+func (sp *snapshotSourceProvider) Manifest(ctx context.Context) (*ocispec.Descriptor, error) {
+	return sp.manifest, nil
+}
+
+func (sp *snapshotSourceProvider) Config(ctx context.Context) (*ocispec.Image, error) {
+	return &sp.config, nil
+}
+
+func (sp *snapshotSourceProvider) Layers(ctx context.Context) ([]SourceLayer, error) {
+	var parentChainID *digest.Digest
+	sourceLayers := []SourceLayer{}
+	for idx, layer := range sp.layers {
+		chainID := identity.ChainID(sp.config.RootFS.DiffIDs[:idx+1])
+		sourceLayers = append(sourceLayers, &snapshotSourceLayer{
+			layer:         layer,
+			chainID:       chainID,
+			parentChainID: parentChainID,
+		})
+		parentChainID = &chainID
+	}
+	return sourceLayers, nil
+}
+
+func (sl *snapshotSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	return sl.layer.Mount(ctx)
+}
+
+func (sl *snapshotSourceLayer) Size() int64 {
+	return sl.layer.Size
+}
+
+// Digest returns the diff id, the layer blob may not exist in snapshotter.
+func (sl *snapshotSourceLayer) Digest() digest.Digest {
+	return sl.layer.DiffID
+}
+
+func (sl *snapshotSourceLayer) ChainID() digest.Digest {
+	return sl.chainID
+}
+
+func (sl *snapshotSourceLayer) ParentChainID() *digest.Digest {
+	return sl.parentChainID
+}
@@ -15,6 +15,7 @@ package provider
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -23,8 +24,10 @@ import (
 	"github.com/opencontainers/image-spec/identity"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
@@ -38,6 +41,14 @@ type SourceLayer interface {
 	ParentChainID() *digest.Digest
 }
 
+// TarSourceLayer is a source layer which can be pulled as (compressed) tar
+// stream, the converter unpacks it to the scratch space of build workflow,
+// or streams it into builder, instead of mounting it.
+type TarSourceLayer interface {
+	SourceLayer
+	Tar(ctx context.Context) (io.ReadCloser, error)
+}
+
 // SourceProvider provides resource of source image
 type SourceProvider interface {
 	Manifest(ctx context.Context) (*ocispec.Descriptor, error)
@@ -45,14 +56,44 @@ type SourceProvider interface {
 	Layers(ctx context.Context) ([]SourceLayer, error)
 }
 
+// contentPuller pulls the content of image from remote registry or local
+// image store, it's implemented by remote.Remote.
+type contentPuller interface {
+	Pull(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (io.ReadCloser, error)
+}
+
+// SourceContentStore stores the source layers pulled by default source
+// provider, it's shared across conversions so that the layers shared by
+// images are pulled only once, the store is disabled if it's nil.
+var SourceContentStore *remote.ContentStore
+
+// storePuller pulls the layers from content store, the layers missing in
+// content store are pulled from remote and stored on reading.
+type storePuller struct {
+	store  *remote.ContentStore
+	remote contentPuller
+}
+
+func (puller *storePuller) Pull(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (io.ReadCloser, error) {
+	if reader, err := puller.store.Reader(desc); err == nil {
+		logrus.Debugf("Hit content store for layer %s", desc.Digest)
+		return reader, nil
+	}
+	reader, err := puller.remote.Pull(ctx, desc, byDigest)
+	if err != nil {
+		return nil, err
+	}
+	return puller.store.Tee(desc, reader), nil
+}
+
 type defaultSourceProvider struct {
 	workDir string
 	image   parser.Image
-	remote  *remote.Remote
+	remote  contentPuller
 }
 
 type defaultSourceLayer struct {
-	remote        *remote.Remote
+	remote        contentPuller
 	mountDir      string
 	desc          ocispec.Descriptor
 	chainID       digest.Digest
@@ -60,6 +101,10 @@ type defaultSourceLayer struct {
 }
 
 func (sp *defaultSourceProvider) Manifest(ctx context.Context) (*ocispec.Descriptor, error) {
+	// The image exported from docker daemon doesn't have a manifest
+	if sp.image.Desc.Digest == "" {
+		return nil, nil
+	}
 	return &sp.image.Desc, nil
 }
 
@@ -98,7 +143,10 @@ func (sp *defaultSourceProvider) Layers(ctx context.Context) ([]SourceLayer, err
 func (sl *defaultSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
 	digestStr := sl.desc.Digest.String()
 
-	if err := utils.WithRetry(func() error {
+	task := progress.FromContext(ctx).Start(progress.StagePull, digestStr, sl.desc.Size)
+	if err := task.Done(utils.WithRetry(func() error {
+		task.Reset()
+
 		// Pull the layer from source
 		reader, err := sl.remote.Pull(ctx, sl.desc, true)
 		if err != nil {
@@ -107,12 +155,12 @@ func (sl *defaultSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func()
 		defer reader.Close()
 
 		// Decompress layer from source stream
-		if err := utils.UnpackTargz(ctx, sl.mountDir, reader); err != nil {
+		if err := utils.UnpackTargz(ctx, sl.mountDir, task.Reader(reader)); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("Decompress source layer %s", digestStr))
 		}
 
 		return nil
-	}); err != nil {
+	})); err != nil {
 		return nil, nil, err
 	}
 
@@ -130,6 +178,10 @@ func (sl *defaultSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func()
 	return mounts, umount, nil
 }
 
+func (sl *defaultSourceLayer) Tar(ctx context.Context) (io.ReadCloser, error) {
+	return sl.remote.Pull(ctx, sl.desc, true)
+}
+
 func (sl *defaultSourceLayer) Digest() digest.Digest {
 	return sl.desc.Digest
 }
@@ -161,11 +213,16 @@ func DefaultSource(ctx context.Context, remote *remote.Remote, workDir string) (
 		return nil, fmt.Errorf("Not found OCI %s manifest in source image", utils.SupportedOS+"/"+utils.SupportedArch)
 	}
 
+	var puller contentPuller = remote
+	if SourceContentStore != nil {
+		puller = &storePuller{store: SourceContentStore, remote: remote}
+	}
+
 	sp := []SourceProvider{
 		&defaultSourceProvider{
 			workDir: workDir,
 			image:   *parsed.OCIImage,
-			remote:  remote,
+			remote:  puller,
 		},
 	}
 
@@ -0,0 +1,126 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// TLSOpt defines the TLS options of registry connections.
+type TLSOpt struct {
+	// CAFiles are the PEM encoded CA certificates trusted in addition to
+	// the system ones, for the registry with private CA.
+	CAFiles []string
+	// CertFile and KeyFile are the PEM encoded client certificate and key
+	// for the registry requiring mutual TLS.
+	CertFile string
+	KeyFile  string
+}
+
+var (
+	hostTLSLock sync.Mutex
+	hostTLSOpts = map[string]*TLSOpt{}
+	hostTLS     = map[string]*tls.Config{}
+)
+
+func (opt *TLSOpt) merge(other TLSOpt) error {
+	for _, caFile := range other.CAFiles {
+		found := false
+		for _, existed := range opt.CAFiles {
+			if existed == caFile {
+				found = true
+				break
+			}
+		}
+		if !found {
+			opt.CAFiles = append(opt.CAFiles, caFile)
+		}
+	}
+	if other.CertFile == "" && other.KeyFile == "" {
+		return nil
+	}
+	if opt.CertFile != "" && (opt.CertFile != other.CertFile || opt.KeyFile != other.KeyFile) {
+		return errors.New("conflict client certificate")
+	}
+	opt.CertFile = other.CertFile
+	opt.KeyFile = other.KeyFile
+	return nil
+}
+
+func (opt *TLSOpt) config() (*tls.Config, error) {
+	config := &tls.Config{}
+	if len(opt.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range opt.CAFiles {
+			data, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "read CA certificate")
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, errors.Errorf("no valid certificate found in %s", caFile)
+			}
+		}
+		config.RootCAs = pool
+	}
+	if opt.CertFile != "" || opt.KeyFile != "" {
+		if opt.CertFile == "" || opt.KeyFile == "" {
+			return nil, errors.New("client certificate and key should be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// AddHostTLS adds the TLS options of registry host, which are used by the
+// remotes and clients of the host created afterwards. The options added
+// for the same host multiple times are merged, the CA certificates are
+// all trusted, but the client certificate can't be changed.
+func AddHostTLS(host string, opt TLSOpt) error {
+	if len(opt.CAFiles) == 0 && opt.CertFile == "" && opt.KeyFile == "" {
+		return nil
+	}
+
+	hostTLSLock.Lock()
+	defer hostTLSLock.Unlock()
+
+	merged := TLSOpt{}
+	if existed := hostTLSOpts[host]; existed != nil {
+		merged = *existed
+		merged.CAFiles = append([]string{}, existed.CAFiles...)
+	}
+	if err := merged.merge(opt); err != nil {
+		return errors.Wrapf(err, "add TLS options of %s", host)
+	}
+	config, err := merged.config()
+	if err != nil {
+		return errors.Wrapf(err, "add TLS options of %s", host)
+	}
+	hostTLSOpts[host] = &merged
+	hostTLS[host] = config
+	return nil
+}
+
+// getHostTLS returns the TLS config of registry host, nil for the default
+// config.
+func getHostTLS(host string) *tls.Config {
+	hostTLSLock.Lock()
+	defer hostTLSLock.Unlock()
+	if config := hostTLS[host]; config != nil {
+		return config.Clone()
+	}
+	return nil
+}
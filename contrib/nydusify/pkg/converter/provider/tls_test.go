@@ -0,0 +1,100 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, path, typ string, data []byte) {
+	require.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: data}), 0600))
+}
+
+// writeClientCert writes a self-signed client certificate and its key.
+func writeClientCert(t *testing.T, certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nydusify"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyData, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	writePEM(t, certPath, "CERTIFICATE", cert)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyData)
+}
+
+func TestHostTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-tls-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	caPath := filepath.Join(dir, "ca.crt")
+	writePEM(t, caPath, "CERTIFICATE", server.Certificate().Raw)
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	writeClientCert(t, certPath, keyPath)
+
+	get := func() error {
+		resp, err := NewRegistryClient(host).Get(server.URL + "/v2/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// Unknown CA
+	assert.NotNil(t, get())
+
+	// Client certificate is required
+	require.Nil(t, AddHostTLS(host, TLSOpt{CAFiles: []string{caPath}}))
+	assert.NotNil(t, get())
+
+	require.Nil(t, AddHostTLS(host, TLSOpt{CertFile: certPath, KeyFile: keyPath}))
+	assert.Nil(t, get())
+	// The same options are merged
+	require.Nil(t, AddHostTLS(host, TLSOpt{CAFiles: []string{caPath}, CertFile: certPath, KeyFile: keyPath}))
+	assert.Equal(t, []string{caPath}, hostTLSOpts[host].CAFiles)
+	assert.Nil(t, get())
+
+	err = AddHostTLS(host, TLSOpt{CertFile: caPath, KeyFile: keyPath})
+	assert.Contains(t, err.Error(), "conflict client certificate")
+	err = AddHostTLS("other.example.com", TLSOpt{CertFile: certPath})
+	assert.Contains(t, err.Error(), "should be specified together")
+	err = AddHostTLS("other.example.com", TLSOpt{CAFiles: []string{keyPath}})
+	assert.Contains(t, err.Error(), "no valid certificate")
+	assert.Nil(t, getHostTLS("other.example.com"))
+}
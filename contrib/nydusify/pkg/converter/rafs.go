@@ -0,0 +1,54 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	FsVersionV5 = "5"
+	// FsVersionV6 is compatible with the EROFS in Linux kernel.
+	FsVersionV6 = "6"
+
+	minChunkSize = 0x1000
+	maxChunkSize = 0x1000000
+)
+
+func validFsVersion(fsVersion string) bool {
+	switch fsVersion {
+	case "", FsVersionV5, FsVersionV6:
+		return true
+	}
+	return false
+}
+
+func isPowerOfTwo(size uint64) bool {
+	return size != 0 && size&(size-1) == 0
+}
+
+// validChunkSize checks that the chunk or batch size is power of two
+// between 0x1000 and 0x1000000, zero means the default of nydus-image.
+func validChunkSize(size uint64) bool {
+	return size == 0 || (isPowerOfTwo(size) && size >= minChunkSize && size <= maxChunkSize)
+}
+
+// formatVersion returns the identity of the RAFS format options, the
+// Nydus layers built with different options can't be mixed in an image,
+// it's empty for the default options.
+func formatVersion(fsVersion string, chunkSize, batchSize uint64) string {
+	parts := []string{}
+	if fsVersion != "" && fsVersion != FsVersionV5 {
+		parts = append(parts, "rafs"+fsVersion)
+	}
+	if chunkSize != 0 {
+		parts = append(parts, fmt.Sprintf("chunk0x%x", chunkSize))
+	}
+	if batchSize != 0 {
+		parts = append(parts, fmt.Sprintf("batch0x%x", batchSize))
+	}
+	return strings.Join(parts, "-")
+}
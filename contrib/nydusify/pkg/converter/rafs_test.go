@@ -0,0 +1,28 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRafsOptions(t *testing.T) {
+	assert.True(t, validFsVersion(""))
+	assert.True(t, validFsVersion(FsVersionV6))
+	assert.False(t, validFsVersion("4"))
+
+	assert.True(t, validChunkSize(0))
+	assert.True(t, validChunkSize(0x1000))
+	assert.True(t, validChunkSize(0x1000000))
+	assert.False(t, validChunkSize(0x800))
+	assert.False(t, validChunkSize(0x2000000))
+	assert.False(t, validChunkSize(0x101000))
+
+	assert.Equal(t, "", formatVersion("", 0, 0))
+	assert.Equal(t, "", formatVersion(FsVersionV5, 0, 0))
+	assert.Equal(t, "rafs6-chunk0x100000-batch0x80000", formatVersion(FsVersionV6, 0x100000, 0x80000))
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// referrerManifest is the OCI 1.1 image manifest with `subject` and
+// `artifactType` fields, which are not in image-spec v1.0.
+type referrerManifest struct {
+	MediaType    string `json:"mediaType,omitempty"`
+	ArtifactType string `json:"artifactType,omitempty"`
+	ocispec.Manifest
+	Subject *ocispec.Descriptor `json:"subject,omitempty"`
+}
+
+// referrerDescriptor is the descriptor in the referrers list.
+type referrerDescriptor struct {
+	ocispec.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+type referrerIndex struct {
+	specs.Versioned
+	MediaType string               `json:"mediaType,omitempty"`
+	Manifests []referrerDescriptor `json:"manifests"`
+}
+
+// referrersTag returns the tag of referrers tag schema, which is used
+// to discover referrers on the registry without referrers API.
+func referrersTag(desc ocispec.Descriptor) string {
+	return desc.Digest.Algorithm().String() + "-" + desc.Digest.Hex()
+}
+
+// makeReferrerManifest makes the Nydus manifest refers to source
+// manifest by `subject` field.
+func makeReferrerManifest(manifest ocispec.Manifest, subject ocispec.Descriptor) referrerManifest {
+	return makeArtifactManifest(utils.ArtifactTypeNydusImage, manifest, subject)
+}
+
+// makeArtifactManifest makes the manifest of artifact refers to subject
+// manifest by `subject` field.
+func makeArtifactManifest(artifactType string, manifest ocispec.Manifest, subject ocispec.Descriptor) referrerManifest {
+	return referrerManifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Manifest:     manifest,
+		Subject: &ocispec.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+	}
+}
+
+// addReferrer adds the descriptor to the referrers list, the existing
+// descriptor with the same digest is replaced.
+func addReferrer(index *referrerIndex, desc referrerDescriptor) {
+	manifests := []referrerDescriptor{}
+	for _, manifest := range index.Manifests {
+		if manifest.Digest != desc.Digest {
+			manifests = append(manifests, manifest)
+		}
+	}
+	index.Manifests = append(manifests, desc)
+}
+
+// referrersRetries is the maximum number of retries to update the
+// referrers tag when it's updated by others concurrently.
+const referrersRetries = 3
+
+// referrersLocks serializes the updates of the same referrers tag in
+// process, keyed by the reference of referrers tag.
+var referrersLocks sync.Map
+
+// pullReferrersIndex pulls the referrers index of referrers tag, returns
+// an empty index if the tag doesn't exist.
+func pullReferrersIndex(ctx context.Context, tagRemote *remote.Remote) (*referrerIndex, error) {
+	index := referrerIndex{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	indexDesc, err := tagRemote.Resolve(ctx)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return &index, nil
+		}
+		return nil, errors.Wrap(err, "Resolve referrers tag")
+	}
+	reader, err := tagRemote.Pull(ctx, *indexDesc, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Pull referrers index")
+	}
+	defer reader.Close()
+	indexBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Read referrers index")
+	}
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal referrers index")
+	}
+	return &index, nil
+}
+
+// pushReferrer pushes the referrer manifest by digest. The registry
+// supporting referrers API indexes it by `subject` field and confirms by
+// `OCI-Subject` header, otherwise the referrers tag is updated as the
+// fallback. The referrers tag is read, modified and written without
+// atomicity guarantee of registry, so the update is verified and retried
+// if the referrer is lost by concurrent updates of other processes.
+func pushReferrer(ctx context.Context, target *remote.Remote, manifest referrerManifest) (*ocispec.Descriptor, error) {
+	desc, manifestBytes, err := utils.MarshalToDesc(manifest, manifest.MediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal referrer manifest")
+	}
+	subject, err := target.PushManifest(ctx, *desc, manifestBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Push referrer manifest")
+	}
+	if subject == manifest.Subject.Digest {
+		return desc, nil
+	}
+
+	tagRemote, err := target.WithTag(referrersTag(*manifest.Subject))
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse referrers tag")
+	}
+	lock, _ := referrersLocks.LoadOrStore(tagRemote.Ref, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	referrer := referrerDescriptor{
+		Descriptor: ocispec.Descriptor{
+			MediaType:   desc.MediaType,
+			Digest:      desc.Digest,
+			Size:        desc.Size,
+			Annotations: manifest.Annotations,
+		},
+		ArtifactType: manifest.ArtifactType,
+	}
+	for attempt := 0; ; attempt++ {
+		index, err := pullReferrersIndex(ctx, tagRemote)
+		if err != nil {
+			return nil, err
+		}
+		addReferrer(index, referrer)
+		newIndexDesc, indexBytes, err := utils.MarshalToDesc(index, ocispec.MediaTypeImageIndex)
+		if err != nil {
+			return nil, errors.Wrap(err, "Marshal referrers index")
+		}
+		if err := tagRemote.Push(ctx, *newIndexDesc, false, bytes.NewReader(indexBytes)); err != nil {
+			return nil, errors.Wrap(err, "Push referrers index")
+		}
+
+		// The referrer is lost if others overwrite the tag with the index
+		// read before our update
+		index, err = pullReferrersIndex(ctx, tagRemote)
+		if err != nil {
+			return nil, err
+		}
+		for _, manifest := range index.Manifests {
+			if manifest.Digest == desc.Digest {
+				return desc, nil
+			}
+		}
+		if attempt >= referrersRetries {
+			return nil, fmt.Errorf("Referrers tag %s is updated concurrently", tagRemote.Ref)
+		}
+		logrus.Warnf("Retry to update referrers tag %s updated concurrently", tagRemote.Ref)
+	}
+}
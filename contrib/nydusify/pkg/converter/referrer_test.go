@@ -0,0 +1,202 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestReferrerManifest(t *testing.T) {
+	subject := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Digest:      digest.FromString("source"),
+		Size:        100,
+		Annotations: map[string]string{"key": "value"},
+	}
+	assert.Equal(t, "sha256-"+subject.Digest.Hex(), referrersTag(subject))
+
+	manifest := makeReferrerManifest(ocispec.Manifest{}, subject)
+	data, err := json.Marshal(manifest)
+	require.Nil(t, err)
+
+	var parsed map[string]interface{}
+	require.Nil(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, utils.ArtifactTypeNydusImage, parsed["artifactType"])
+	assert.Equal(t, ocispec.MediaTypeImageManifest, parsed["mediaType"])
+	assert.Equal(t, map[string]interface{}{
+		"mediaType": ocispec.MediaTypeImageManifest,
+		"digest":    subject.Digest.String(),
+		"size":      float64(100),
+	}, parsed["subject"])
+}
+
+func TestAddReferrer(t *testing.T) {
+	index := referrerIndex{}
+	other := referrerDescriptor{
+		Descriptor:   ocispec.Descriptor{Digest: digest.FromString("signature")},
+		ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+	}
+	nydus := referrerDescriptor{
+		Descriptor:   ocispec.Descriptor{Digest: digest.FromString("nydus"), Size: 1},
+		ArtifactType: utils.ArtifactTypeNydusImage,
+	}
+	addReferrer(&index, other)
+	addReferrer(&index, nydus)
+	nydus.Size = 2
+	addReferrer(&index, nydus)
+
+	require.Equal(t, 2, len(index.Manifests))
+	assert.Equal(t, other, index.Manifests[0])
+	assert.Equal(t, int64(2), index.Manifests[1].Size)
+
+	// The artifact type of existing referrers is kept
+	data, err := json.Marshal(index)
+	require.Nil(t, err)
+	var parsed referrerIndex
+	require.Nil(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, other.ArtifactType, parsed.Manifests[0].ArtifactType)
+}
+
+// fakeManifestRegistry serves the manifests of repository library/foo,
+// the `OCI-Subject` header is returned if referrers API is supported.
+type fakeManifestRegistry struct {
+	sync.Mutex
+	referrersAPI bool
+	manifests    map[digest.Digest][]byte
+	mediaTypes   map[digest.Digest]string
+	tags         map[string]digest.Digest
+}
+
+func (reg *fakeManifestRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	ref := strings.TrimPrefix(r.URL.Path, "/v2/library/foo/manifests/")
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		dgst = reg.tags[ref]
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		data, ok := reg.manifests[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", reg.mediaTypes[dgst])
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		dgst := digest.FromBytes(data)
+		reg.manifests[dgst] = data
+		reg.mediaTypes[dgst] = r.Header.Get("Content-Type")
+		if _, err := digest.Parse(ref); err != nil {
+			reg.tags[ref] = dgst
+		}
+		var manifest referrerManifest
+		if err := json.Unmarshal(data, &manifest); err == nil && manifest.Subject != nil && reg.referrersAPI {
+			w.Header().Set("OCI-Subject", manifest.Subject.Digest.String())
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newManifestRemote(t *testing.T, reg *fakeManifestRegistry) (*remote.Remote, func()) {
+	server := httptest.NewServer(reg)
+	host := strings.TrimPrefix(server.URL, "http://")
+	target, err := remote.NewWithHosts(host+"/library/foo:nydus", func() docker.RegistryHosts {
+		return func(string) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client:       server.Client(),
+				Host:         host,
+				Scheme:       "http",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve | docker.HostCapabilityPush,
+			}}, nil
+		}
+	})
+	require.Nil(t, err)
+	return target, server.Close
+}
+
+func TestPushReferrer(t *testing.T) {
+	subject := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("source"),
+		Size:      100,
+	}
+	tag := referrersTag(subject)
+	artifact := func(i int) referrerManifest {
+		return makeArtifactManifest(utils.ArtifactTypeNydusImage, ocispec.Manifest{
+			Config: ocispec.Descriptor{Digest: digest.FromString(fmt.Sprintf("config-%d", i))},
+		}, subject)
+	}
+
+	// The referrers tag isn't needed if the registry indexes the subject
+	reg := &fakeManifestRegistry{
+		referrersAPI: true,
+		manifests:    map[digest.Digest][]byte{},
+		mediaTypes:   map[digest.Digest]string{},
+		tags:         map[string]digest.Digest{},
+	}
+	target, done := newManifestRemote(t, reg)
+	desc, err := pushReferrer(context.Background(), target, artifact(0))
+	require.Nil(t, err)
+	done()
+	assert.Contains(t, reg.manifests, desc.Digest)
+	assert.NotContains(t, reg.tags, tag)
+
+	// The referrers pushed concurrently are all kept in referrers tag
+	reg = &fakeManifestRegistry{
+		manifests:  map[digest.Digest][]byte{},
+		mediaTypes: map[digest.Digest]string{},
+		tags:       map[string]digest.Digest{},
+	}
+	target, done = newManifestRemote(t, reg)
+	defer done()
+	const count = 8
+	var wg sync.WaitGroup
+	errs := make([]error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = pushReferrer(context.Background(), target, artifact(i))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.Nil(t, err)
+	}
+	require.Contains(t, reg.tags, tag)
+	var index referrerIndex
+	require.Nil(t, json.Unmarshal(reg.manifests[reg.tags[tag]], &index))
+	assert.Equal(t, count, len(index.Manifests))
+	assert.Equal(t, ocispec.MediaTypeImageIndex, reg.mediaTypes[reg.tags[tag]])
+}
@@ -0,0 +1,359 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	SBOMFormatSPDX      = "spdx"
+	SBOMFormatCycloneDX = "cyclonedx"
+
+	ArtifactTypeSPDX      = "application/spdx+json"
+	ArtifactTypeCycloneDX = "application/vnd.cyclonedx+json"
+
+	maxPackageDBSize = 64 << 20
+
+	dpkgStatusPath   = "/var/lib/dpkg/status"
+	dpkgStatusDir    = "/var/lib/dpkg/status.d"
+	apkInstalledPath = "/lib/apk/db/installed"
+)
+
+var osReleasePaths = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+func validSBOMFormat(format string) bool {
+	return format == "" || format == SBOMFormatSPDX || format == SBOMFormatCycloneDX
+}
+
+// isPackageDB returns true if the file is parsed for generating SBOM,
+// including the package databases of dpkg and apk and os-release.
+func isPackageDB(p string) bool {
+	if p == dpkgStatusPath || p == apkInstalledPath || path.Dir(p) == dpkgStatusDir {
+		return true
+	}
+	for _, osRelease := range osReleasePaths {
+		if p == osRelease {
+			return true
+		}
+	}
+	return false
+}
+
+type sbomPackage struct {
+	// Type is the purl type of package, `deb` or `apk`.
+	Type    string
+	Name    string
+	Version string
+	Arch    string
+}
+
+// purl returns the package URL of package installed in distro.
+func (pkg *sbomPackage) purl(distro string) string {
+	namespace := ""
+	if distro != "" {
+		namespace = url.PathEscape(distro) + "/"
+	}
+	purl := fmt.Sprintf("pkg:%s/%s%s@%s", pkg.Type, namespace, url.PathEscape(pkg.Name), url.PathEscape(pkg.Version))
+	if pkg.Arch != "" {
+		purl += "?arch=" + url.QueryEscape(pkg.Arch)
+	}
+	return purl
+}
+
+// parseStanzas parses the `Key: value` stanzas separated by blank lines,
+// the continuation lines of multi-line fields are ignored.
+func parseStanzas(content []byte) []map[string]string {
+	stanzas := []map[string]string{}
+	stanza := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), maxPackageDBSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(stanza) > 0 {
+				stanzas = append(stanzas, stanza)
+				stanza = map[string]string{}
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			stanza[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+	if len(stanza) > 0 {
+		stanzas = append(stanzas, stanza)
+	}
+	return stanzas
+}
+
+// parseDpkgStatus parses the installed packages in dpkg status file, the
+// files in status.d of distroless images don't have `Status` field.
+func parseDpkgStatus(content []byte) []sbomPackage {
+	packages := []sbomPackage{}
+	for _, stanza := range parseStanzas(content) {
+		if stanza["Package"] == "" {
+			continue
+		}
+		if status, ok := stanza["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+		packages = append(packages, sbomPackage{
+			Type:    "deb",
+			Name:    stanza["Package"],
+			Version: stanza["Version"],
+			Arch:    stanza["Architecture"],
+		})
+	}
+	return packages
+}
+
+// parseApkInstalled parses the installed packages in apk database, which
+// consists of `X:value` lines.
+func parseApkInstalled(content []byte) []sbomPackage {
+	packages := []sbomPackage{}
+	for _, stanza := range parseStanzas(content) {
+		if stanza["P"] == "" {
+			continue
+		}
+		packages = append(packages, sbomPackage{
+			Type:    "apk",
+			Name:    stanza["P"],
+			Version: stanza["V"],
+			Arch:    stanza["A"],
+		})
+	}
+	return packages
+}
+
+// distro returns the ID in os-release of rootfs.
+func (r rootfs) distro() string {
+	for _, p := range osReleasePaths {
+		_, entry := r.resolve(p)
+		if entry == nil || entry.content == nil {
+			continue
+		}
+		fields := map[string]string{}
+		for _, line := range strings.Split(string(entry.content), "\n") {
+			parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+			if len(parts) == 2 {
+				fields[parts[0]] = strings.Trim(parts[1], `"'`)
+			}
+		}
+		return fields["ID"]
+	}
+	return ""
+}
+
+// packages returns the packages installed in rootfs, sorted by type,
+// name and version.
+func (r rootfs) packages() []sbomPackage {
+	packages := []sbomPackage{}
+	for p, entry := range r {
+		if entry.content == nil {
+			continue
+		}
+		switch {
+		case p == dpkgStatusPath || path.Dir(p) == dpkgStatusDir:
+			packages = append(packages, parseDpkgStatus(entry.content)...)
+		case p == apkInstalledPath:
+			packages = append(packages, parseApkInstalled(entry.content)...)
+		}
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Type != packages[j].Type {
+			return packages[i].Type < packages[j].Type
+		}
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Version < packages[j].Version
+	})
+	deduped := []sbomPackage{}
+	for idx, pkg := range packages {
+		if idx == 0 || pkg != packages[idx-1] {
+			deduped = append(deduped, pkg)
+		}
+	}
+
+	return deduped
+}
+
+// sbomImage is the image described by SBOM.
+type sbomImage struct {
+	// Name is the reference of Nydus image.
+	Name   string
+	Digest digest.Digest
+	// Distro is the ID in os-release of rootfs.
+	Distro   string
+	Packages []sbomPackage
+	Created  time.Time
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// makeSPDX makes the SPDX 2.3 document of image, the image is described
+// as a package containing the installed packages.
+func makeSPDX(image *sbomImage) *spdxDocument {
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              image.Name,
+		DocumentNamespace: fmt.Sprintf("https://nydus.dev/spdx/%s", image.Digest.Hex()),
+		CreationInfo: spdxCreationInfo{
+			Created:  image.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: nydusify"},
+		},
+		Packages: []spdxPackage{{
+			Name:             image.Name,
+			SPDXID:           "SPDXRef-Image",
+			VersionInfo:      image.Digest.String(),
+			DownloadLocation: "NOASSERTION",
+		}},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: "SPDXRef-Image",
+		}},
+	}
+	for idx, pkg := range image.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", idx)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           id,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  pkg.purl(image.Distro),
+			}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      "SPDXRef-Image",
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+	return doc
+}
+
+type cycloneDXDocument struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    cycloneDXMetadata    `json:"metadata"`
+	Components  []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     []cycloneDXTool    `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTool struct {
+	Vendor string `json:"vendor"`
+	Name   string `json:"name"`
+}
+
+type cycloneDXComponent struct {
+	BOMRef  string `json:"bom-ref,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Purl    string `json:"purl,omitempty"`
+}
+
+// makeCycloneDX makes the CycloneDX 1.4 document of image, the image is
+// described as a container component.
+func makeCycloneDX(image *sbomImage) *cycloneDXDocument {
+	doc := &cycloneDXDocument{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: image.Created.UTC().Format(time.RFC3339),
+			Tools:     []cycloneDXTool{{Vendor: "dragonflyoss", Name: "nydusify"}},
+			Component: cycloneDXComponent{
+				BOMRef:  image.Digest.String(),
+				Type:    "container",
+				Name:    image.Name,
+				Version: image.Digest.String(),
+			},
+		},
+		Components: []cycloneDXComponent{},
+	}
+	for _, pkg := range image.Packages {
+		purl := pkg.purl(image.Distro)
+		doc.Components = append(doc.Components, cycloneDXComponent{
+			BOMRef:  purl,
+			Type:    "library",
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			Purl:    purl,
+		})
+	}
+	return doc
+}
+
+// makeSBOM makes the SBOM document of image in format, returns the
+// document and its artifact type.
+func makeSBOM(format string, image *sbomImage) (interface{}, string) {
+	if format == SBOMFormatCycloneDX {
+		return makeCycloneDX(image), ArtifactTypeCycloneDX
+	}
+	return makeSPDX(image), ArtifactTypeSPDX
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dpkgStatus = `Package: base-files
+Status: install ok installed
+Architecture: amd64
+Version: 12.4
+Description: Debian base system miscellaneous files
+ This package contains the basic filesystem hierarchy.
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+
+Package: libc6
+Status: install ok installed
+Architecture: amd64
+Version: 2.36-9+deb12u1
+`
+
+func mergeLayers(t *testing.T, layers ...[]testFile) rootfs {
+	checker := newConfigChecker(ocispec.ImageConfig{})
+	checker.indexPackageDB = true
+	buildLayers := []*buildLayer{}
+	for idx, files := range layers {
+		dir := createLayer(t, files)
+		defer os.RemoveAll(dir)
+		require.Nil(t, checker.IndexLayer(idx, &sourceMount{Source: dir, WhiteoutSpec: WhiteoutSpecOCI}))
+		buildLayers = append(buildLayers, &buildLayer{index: idx})
+	}
+	r, err := checker.Merge(context.Background(), buildLayers)
+	require.Nil(t, err)
+	return r
+}
+
+func TestSBOMPackages(t *testing.T) {
+	r := mergeLayers(t, []testFile{
+		{path: "etc/os-release", link: "../usr/lib/os-release"},
+		{path: "usr/lib/os-release", content: "NAME=\"Debian GNU/Linux\"\nID=debian\nVERSION_ID=\"12\"\n", mode: 0644},
+		{path: "var/lib/dpkg/status", content: dpkgStatus, mode: 0644},
+		{path: "var/lib/dpkg/status.d/tzdata", content: "Package: tzdata\nVersion: 2024a-0+deb12u1\nArchitecture: all\n", mode: 0644},
+	}, []testFile{
+		{path: "lib/apk/db/installed", content: "P:musl\nV:1.2.4-r2\nA:x86_64\n\nP:busybox\nV:1:1.36.1-r5\nA:x86_64\n", mode: 0644},
+		// The package in status.d is removed by whiteout in upper layer
+		{path: "var/lib/dpkg/status.d/.wh.tzdata", mode: 0644},
+	})
+
+	assert.Equal(t, "debian", r.distro())
+	packages := r.packages()
+	assert.Equal(t, []sbomPackage{
+		{Type: "apk", Name: "busybox", Version: "1:1.36.1-r5", Arch: "x86_64"},
+		{Type: "apk", Name: "musl", Version: "1.2.4-r2", Arch: "x86_64"},
+		{Type: "deb", Name: "base-files", Version: "12.4", Arch: "amd64"},
+		{Type: "deb", Name: "libc6", Version: "2.36-9+deb12u1", Arch: "amd64"},
+	}, packages)
+	assert.Equal(t, "pkg:deb/debian/libc6@2.36-9+deb12u1?arch=amd64", packages[3].purl("debian"))
+	assert.Equal(t, "pkg:apk/busybox@1:1.36.1-r5?arch=x86_64", packages[0].purl(""))
+
+	// Package databases aren't recorded unless SBOM is generated
+	checker := newConfigChecker(ocispec.ImageConfig{})
+	dir := createLayer(t, []testFile{{path: "var/lib/dpkg/status", content: dpkgStatus, mode: 0644}})
+	defer os.RemoveAll(dir)
+	require.Nil(t, checker.IndexLayer(0, &sourceMount{Source: dir, WhiteoutSpec: WhiteoutSpecOCI}))
+	r, err := checker.Merge(context.Background(), []*buildLayer{{index: 0}})
+	require.Nil(t, err)
+	assert.Empty(t, r.packages())
+}
+
+func TestMakeSBOM(t *testing.T) {
+	image := &sbomImage{
+		Name:     "localhost:5000/app:nydus",
+		Digest:   digest.FromString("nydus"),
+		Distro:   "alpine",
+		Packages: []sbomPackage{{Type: "apk", Name: "musl", Version: "1.2.4-r2", Arch: "x86_64"}},
+		Created:  time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	document, artifactType := makeSBOM(SBOMFormatSPDX, image)
+	assert.Equal(t, ArtifactTypeSPDX, artifactType)
+	spdx := document.(*spdxDocument)
+	assert.Equal(t, "SPDX-2.3", spdx.SPDXVersion)
+	assert.Equal(t, "2022-01-02T03:04:05Z", spdx.CreationInfo.Created)
+	require.Len(t, spdx.Packages, 2)
+	assert.Equal(t, image.Digest.String(), spdx.Packages[0].VersionInfo)
+	assert.Equal(t, "pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64", spdx.Packages[1].ExternalRefs[0].ReferenceLocator)
+	assert.Equal(t, []spdxRelationship{
+		{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-Image"},
+		{SPDXElementID: "SPDXRef-Image", RelationshipType: "CONTAINS", RelatedSPDXElement: "SPDXRef-Package-0"},
+	}, spdx.Relationships)
+
+	document, artifactType = makeSBOM(SBOMFormatCycloneDX, image)
+	assert.Equal(t, ArtifactTypeCycloneDX, artifactType)
+	data, err := json.Marshal(document)
+	require.Nil(t, err)
+	var parsed map[string]interface{}
+	require.Nil(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, "CycloneDX", parsed["bomFormat"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"bom-ref": "pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64",
+		"type":    "library",
+		"name":    "musl",
+		"version": "1.2.4-r2",
+		"purl":    "pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64",
+	}}, parsed["components"])
+}
+
+func TestMakeProvenance(t *testing.T) {
+	source := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("source")}
+	target := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("nydus")}
+	statement := makeProvenance(&provenanceInput{
+		SourceRef:   "localhost:5000/app:latest",
+		Source:      source,
+		TargetRef:   "localhost:5000/app:latest-nydus",
+		Target:      target,
+		Parameters:  map[string]string{"fs-version": "6"},
+		Environment: map[string]string{"nydus-image": "v2.1.0"},
+		Started:     time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		Finished:    time.Date(2022, 1, 2, 3, 5, 5, 0, time.UTC),
+	})
+
+	data, err := json.Marshal(statement)
+	require.Nil(t, err)
+	var parsed map[string]interface{}
+	require.Nil(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, inTotoStatementType, parsed["_type"])
+	assert.Equal(t, slsaProvenanceType, parsed["predicateType"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"name":   "localhost:5000/app",
+		"digest": map[string]interface{}{"sha256": target.Digest.Hex()},
+	}}, parsed["subject"])
+	predicate := parsed["predicate"].(map[string]interface{})
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"uri":    "localhost:5000/app",
+		"digest": map[string]interface{}{"sha256": source.Digest.Hex()},
+	}}, predicate["materials"])
+	assert.Equal(t, "2022-01-02T03:05:05Z", predicate["metadata"].(map[string]interface{})["buildFinishedOn"])
+
+	manifest := makeArtifactManifest(ArtifactTypeProvenance, ocispec.Manifest{}, target)
+	assert.Equal(t, ArtifactTypeProvenance, manifest.ArtifactType)
+	assert.Equal(t, target.Digest, manifest.Subject.Digest)
+}
@@ -0,0 +1,300 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+)
+
+// squashedLayer merges the lowest source layers into one source layer,
+// it's presented as an unpacked OCI layer containing the rootfs of its top
+// layer, so there is no whiteout in it.
+type squashedLayer struct {
+	layers  []provider.SourceLayer
+	workDir string
+}
+
+// squashLayers merges the lowest count source layers into one, all the
+// layers are merged if flatten is true, the layers are returned as is if
+// no more than one layer would be merged.
+func squashLayers(layers []provider.SourceLayer, count uint, flatten bool, workDir string) []provider.SourceLayer {
+	if flatten || count > uint(len(layers)) {
+		count = uint(len(layers))
+	}
+	if count <= 1 {
+		return layers
+	}
+	squashed := &squashedLayer{
+		layers:  layers[:count],
+		workDir: workDir,
+	}
+	return append([]provider.SourceLayer{squashed}, layers[count:]...)
+}
+
+func (sl *squashedLayer) top() provider.SourceLayer {
+	return sl.layers[len(sl.layers)-1]
+}
+
+// Mount mounts the source layers one by one from bottom, and applies them
+// to a directory in work directory, each layer is unmounted once applied.
+func (sl *squashedLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	if err := os.MkdirAll(sl.workDir, 0755); err != nil {
+		return nil, nil, errors.Wrap(err, "Create work directory")
+	}
+	dir, err := ioutil.TempDir(sl.workDir, "squash-")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Create squash directory")
+	}
+	umount := func() error {
+		return os.RemoveAll(dir)
+	}
+
+	for _, layer := range sl.layers {
+		if err := applySourceLayer(ctx, layer, dir); err != nil {
+			umount()
+			return nil, nil, errors.Wrapf(err, "Squash source layer %s", layer.Digest())
+		}
+	}
+
+	mounts := []mount.Mount{
+		{
+			Type:   "oci-directory",
+			Source: dir,
+		},
+	}
+	return mounts, umount, nil
+}
+
+func applySourceLayer(ctx context.Context, layer provider.SourceLayer, target string) error {
+	mounts, umount, err := layer.Mount(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Mount source layer")
+	}
+	defer umount()
+
+	sourceMount, err := parseSourceMount(mounts)
+	if err != nil {
+		return errors.Wrap(err, "Parse source layer mount")
+	}
+	return applyLayerDir(sourceMount.Source, target)
+}
+
+// applyLayerDir applies the layer directory to target directory as an
+// upper layer, both OCI and overlayfs whiteouts are handled, the files
+// hidden by whiteouts are removed from target.
+func applyLayerDir(source, target string) error {
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+	// The hardlinks in layer are kept by linking to the first copied file
+	links := make(map[uint64]string)
+
+	if err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(source, path)
+		dest := filepath.Join(target, rel)
+		name := info.Name()
+
+		if path != source {
+			if name == ociWhiteoutOpaque {
+				return nil
+			}
+			if strings.HasPrefix(name, ociWhiteoutPrefix) {
+				return os.RemoveAll(filepath.Join(filepath.Dir(dest), strings.TrimPrefix(name, ociWhiteoutPrefix)))
+			}
+			if isOverlayWhiteout(info) {
+				return os.RemoveAll(dest)
+			}
+		}
+
+		if info.IsDir() {
+			if err := applyDir(path, dest, info); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTimes{path: dest, mtime: info.ModTime()})
+			return nil
+		}
+
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 && info.Mode().IsRegular() {
+			if first, ok := links[stat.Ino]; ok {
+				return os.Link(first, dest)
+			}
+			links[stat.Ino] = dest
+		}
+		return copyEntry(path, dest, info)
+	}); err != nil {
+		return err
+	}
+
+	// The modification times of directories are changed by their entries
+	for idx := len(dirs) - 1; idx >= 0; idx-- {
+		if err := os.Chtimes(dirs[idx].path, dirs[idx].mtime, dirs[idx].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyDir creates or updates the directory in target, the entries of
+// existing directory are removed if the directory in layer is opaque.
+func applyDir(path, dest string, info os.FileInfo) error {
+	existing, err := os.Lstat(dest)
+	switch {
+	case err == nil && existing.IsDir():
+		opaque := isOverlayOpaque(path)
+		if _, err := os.Lstat(filepath.Join(path, ociWhiteoutOpaque)); err == nil {
+			opaque = true
+		}
+		if opaque {
+			entries, err := ioutil.ReadDir(dest)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := os.RemoveAll(filepath.Join(dest, entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	case err == nil:
+		if err := os.Remove(dest); err != nil {
+			return err
+		}
+		fallthrough
+	case os.IsNotExist(err):
+		if err := os.Mkdir(dest, info.Mode().Perm()); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	return copyMetadata(path, dest, info)
+}
+
+func copyEntry(path, dest string, info os.FileInfo) error {
+	mode := info.Mode()
+	switch {
+	case mode.IsRegular():
+		if err := copyRegular(path, dest, mode.Perm()); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(link, dest); err != nil {
+			return err
+		}
+		return copyOwner(dest, info)
+	case mode&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0:
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("Unsupported file %s", path)
+		}
+		if err := syscall.Mknod(dest, uint32(stat.Mode), int(stat.Rdev)); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("Unsupported file %s", path)
+	}
+	return copyMetadata(path, dest, info)
+}
+
+func copyRegular(path, dest string, perm os.FileMode) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func copyOwner(dest string, info os.FileInfo) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return os.Lchown(dest, int(stat.Uid), int(stat.Gid))
+	}
+	return nil
+}
+
+// copyMetadata copies the owner, mode, xattrs and modification time of
+// file, the overlayfs opaque xattr is dropped since it's handled already.
+func copyMetadata(path, dest string, info os.FileInfo) error {
+	if err := copyOwner(dest, info); err != nil {
+		return err
+	}
+	// The setuid and setgid bits are cleared by chown
+	if err := os.Chmod(dest, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	names, err := xattr.LList(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == overlayOpaqueXattr {
+			continue
+		}
+		value, err := xattr.LGet(path, name)
+		if err != nil {
+			return err
+		}
+		if err := xattr.LSet(dest, name, value); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+func (sl *squashedLayer) Size() int64 {
+	var size int64
+	for _, layer := range sl.layers {
+		size += layer.Size()
+	}
+	return size
+}
+
+func (sl *squashedLayer) Digest() digest.Digest {
+	return sl.top().Digest()
+}
+
+func (sl *squashedLayer) ChainID() digest.Digest {
+	return sl.top().ChainID()
+}
+
+// ParentChainID is nil since the lowest layers are squashed.
+func (sl *squashedLayer) ParentChainID() *digest.Digest {
+	return nil
+}
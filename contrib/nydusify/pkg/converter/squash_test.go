@@ -0,0 +1,133 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+)
+
+// dirSourceLayer is an unpacked OCI layer in directory.
+type dirSourceLayer struct {
+	hookSourceLayer
+	dir string
+}
+
+func (layer *dirSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	return []mount.Mount{{Type: "oci-directory", Source: layer.dir}}, func() error { return nil }, nil
+}
+
+func writeLayer(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		if content == "/" {
+			require.Nil(t, os.MkdirAll(path, 0755))
+			continue
+		}
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestSquashLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-squash-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	layerFiles := []map[string]string{
+		{
+			"etc/passwd":       "root",
+			"etc/hosts":        "localhost",
+			"usr/lib/a.so":     "a",
+			"usr/lib/b.so":     "b",
+			"var/cache/x":      "x",
+			"opt/app/bin/main": "v1",
+		},
+		{
+			"etc/.wh.hosts":         "",
+			"usr/lib/.wh..wh..opq":  "",
+			"usr/lib/c.so":          "c",
+			"var/cache":             "file",
+			"opt/app/bin/main":      "v2",
+			"opt/app/conf/app.yaml": "conf",
+		},
+		{
+			"etc/hosts": "example",
+			".wh.opt":   "",
+		},
+	}
+	var layers []provider.SourceLayer
+	for idx, files := range layerFiles {
+		layerDir := filepath.Join(dir, "layers", string(rune('0'+idx)))
+		require.Nil(t, os.MkdirAll(layerDir, 0755))
+		writeLayer(t, layerDir, files)
+		layers = append(layers, &dirSourceLayer{
+			hookSourceLayer: hookSourceLayer{digest: digest.FromString(layerDir), size: 100},
+			dir:             layerDir,
+		})
+	}
+
+	// Nothing to squash
+	assert.Equal(t, layers, squashLayers(layers, 0, false, dir))
+	assert.Equal(t, layers, squashLayers(layers, 1, false, dir))
+
+	squashed := squashLayers(layers, 2, false, dir)
+	require.Len(t, squashed, 2)
+	assert.Equal(t, layers[1].Digest(), squashed[0].Digest())
+	assert.Equal(t, layers[1].ChainID(), squashed[0].ChainID())
+	assert.Equal(t, int64(200), squashed[0].Size())
+	assert.Equal(t, layers[2], squashed[1])
+
+	mounts, umount, err := squashed[0].Mount(context.Background())
+	require.Nil(t, err)
+	sourceMount, err := parseSourceMount(mounts)
+	require.Nil(t, err)
+	assert.True(t, sourceMount.Unpacked)
+	assert.Nil(t, validateWhiteouts(sourceMount.Source, WhiteoutSpecOverlayfs))
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(sourceMount.Source, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	assert.Equal(t, "root", read("etc/passwd"))
+	// Removed by whiteout
+	assert.Equal(t, "", read("etc/hosts"))
+	// Opaque directory
+	assert.Equal(t, "", read("usr/lib/a.so"))
+	assert.Equal(t, "c", read("usr/lib/c.so"))
+	// Directory replaced by file
+	assert.Equal(t, "file", read("var/cache"))
+	assert.Equal(t, "v2", read("opt/app/bin/main"))
+	assert.Equal(t, "conf", read("opt/app/conf/app.yaml"))
+
+	require.Nil(t, umount())
+	_, err = os.Stat(sourceMount.Source)
+	assert.True(t, os.IsNotExist(err))
+
+	// All layers are merged
+	squashed = squashLayers(layers, 0, true, dir)
+	require.Len(t, squashed, 1)
+	mounts, umount, err = squashed[0].Mount(context.Background())
+	require.Nil(t, err)
+	defer umount()
+	sourceMount, err = parseSourceMount(mounts)
+	require.Nil(t, err)
+	assert.Equal(t, "example", read("etc/hosts"))
+	_, err = os.Stat(filepath.Join(sourceMount.Source, "opt"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/scanner"
+)
+
+const ArtifactTypeVulnReport = "application/vnd.nydus.vulnerability.report.v1+json"
+
+// layerVulnerability is a vulnerability found in source layer.
+type layerVulnerability struct {
+	scanner.Vulnerability
+	Layer  int           `json:"layer"`
+	Digest digest.Digest `json:"digest"`
+}
+
+// vulnReport is the vulnerabilities found in the source layers of target
+// image, which is attached to Nydus manifest as a referrer.
+type vulnReport struct {
+	Image   string `json:"image"`
+	Tool    string `json:"tool"`
+	FailOn  string `json:"fail_on,omitempty"`
+	Created string `json:"created"`
+	// Summary is the count of vulnerabilities by severity.
+	Summary         map[string]int       `json:"summary"`
+	Vulnerabilities []layerVulnerability `json:"vulnerabilities"`
+}
+
+// vulnScanner scans the source layers one by one, the layers hit in cache
+// are mounted again for scanning before pushing manifest.
+type vulnScanner struct {
+	sync.Mutex
+	scanner *scanner.Scanner
+	layers  map[int][]layerVulnerability
+}
+
+func newVulnScanner(s *scanner.Scanner) *vulnScanner {
+	if s == nil {
+		return nil
+	}
+	return &vulnScanner{
+		scanner: s,
+		layers:  map[int][]layerVulnerability{},
+	}
+}
+
+// ScanLayer scans the mounted source layer.
+func (vs *vulnScanner) ScanLayer(ctx context.Context, layer *buildLayer, mount *sourceMount) error {
+	vulns, err := vs.scanner.Scan(ctx, mount.Source)
+	if err != nil {
+		return err
+	}
+	found := make([]layerVulnerability, 0, len(vulns))
+	for _, vuln := range vulns {
+		found = append(found, layerVulnerability{
+			Vulnerability: vuln,
+			Layer:         layer.index,
+			Digest:        layer.source.Digest(),
+		})
+	}
+
+	vs.Lock()
+	defer vs.Unlock()
+	vs.layers[layer.index] = found
+	return nil
+}
+
+func (vs *vulnScanner) scanSourceLayer(ctx context.Context, layer *buildLayer) error {
+	mounts, umount, err := layer.source.Mount(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Mount source layer")
+	}
+	defer func() {
+		if err := umount(); err != nil {
+			logrus.Warnf("Failed to umount layer %s: %s", layer.source.Digest(), err)
+		}
+	}()
+
+	mount, err := parseSourceMount(mounts)
+	if err != nil {
+		return errors.Wrap(err, "Parse source layer mount")
+	}
+
+	return vs.ScanLayer(ctx, layer, mount)
+}
+
+// Report scans the layers not scanned yet, and collects the vulnerabilities
+// of all layers. The package databases are overwritten by upper layers, so
+// a vulnerability of distro package is dropped if the package isn't installed
+// in the same version in merged rootfs, which is known only if the package
+// database is indexed in rootfs.
+func (vs *vulnScanner) Report(ctx context.Context, image string, r rootfs, layers []*buildLayer) (*vulnReport, error) {
+	for _, layer := range layers {
+		vs.Lock()
+		_, ok := vs.layers[layer.index]
+		vs.Unlock()
+		if ok {
+			continue
+		}
+		if err := vs.scanSourceLayer(ctx, layer); err != nil {
+			return nil, errors.Wrapf(err, "Scan source layer %s", layer.source.Digest())
+		}
+	}
+
+	installed := map[string]string{}
+	for _, pkg := range r.packages() {
+		installed[pkg.Name] = pkg.Version
+	}
+
+	found := []layerVulnerability{}
+	for _, layer := range layers {
+		for _, vuln := range vs.layers[layer.index] {
+			if vuln.Class == scanner.ClassOS && len(installed) > 0 && installed[vuln.Package] != vuln.Version {
+				continue
+			}
+			found = append(found, vuln)
+		}
+	}
+	// The vulnerabilities in upper layers go first for the same package
+	sort.SliceStable(found, func(i, j int) bool {
+		if scanner.Less(&found[i].Vulnerability, &found[j].Vulnerability) {
+			return true
+		}
+		if scanner.Less(&found[j].Vulnerability, &found[i].Vulnerability) {
+			return false
+		}
+		return found[i].Layer > found[j].Layer
+	})
+	vulns := make([]scanner.Vulnerability, 0, len(found))
+	for _, vuln := range found {
+		vulns = append(vulns, vuln.Vulnerability)
+	}
+
+	return &vulnReport{
+		Image:           image,
+		Tool:            vs.scanner.Tool,
+		FailOn:          vs.scanner.FailOn,
+		Created:         time.Now().UTC().Format(time.RFC3339),
+		Summary:         scanner.Summarize(vulns),
+		Vulnerabilities: found,
+	}, nil
+}
+
+// Check fails if any vulnerability in report is at or above the fail
+// severity.
+func (vs *vulnScanner) Check(report *vulnReport) error {
+	vulns := make([]scanner.Vulnerability, 0, len(report.Vulnerabilities))
+	for _, vuln := range report.Vulnerabilities {
+		vulns = append(vulns, vuln.Vulnerability)
+	}
+	return vs.scanner.Check(vulns)
+}
+
+// scanImage collects the vulnerabilities of source layers, writes the
+// report to the specified file, and fails the conversion if vulnerabilities
+// at or above the fail severity are found, it's no-op if vs is nil.
+func (cvt *Converter) scanImage(ctx context.Context, vs *vulnScanner, r rootfs, buildLayers []*buildLayer) (*vulnReport, error) {
+	if vs == nil {
+		return nil, nil
+	}
+	scanDone := logger.Log(ctx, "[VULN] Scan source layers", provider.LoggerFields{
+		"Tool": vs.scanner.Tool,
+	})
+	report, err := vs.Report(ctx, cvt.TargetRemote.Ref, r, buildLayers)
+	if err := scanDone(err); err != nil {
+		return nil, errors.Wrap(err, "Scan vulnerabilities")
+	}
+	logrus.Infof("Found vulnerabilities %v", report.Summary)
+
+	if cvt.VulnReport != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return nil, errors.Wrap(err, "Marshal vulnerability report")
+		}
+		if err := ioutil.WriteFile(cvt.VulnReport, data, 0644); err != nil {
+			return nil, errors.Wrap(err, "Write vulnerability report")
+		}
+	}
+
+	if err := vs.Check(report); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// pushVulnReport attaches the vulnerability report to Nydus manifest as a
+// referrer.
+func (cvt *Converter) pushVulnReport(ctx context.Context, report *vulnReport, manifestDesc ocispec.Descriptor) error {
+	subject := ocispec.Descriptor{
+		MediaType: manifestDesc.MediaType,
+		Digest:    manifestDesc.Digest,
+		Size:      manifestDesc.Size,
+	}
+	pushDone := logger.Log(ctx, "[VULN] Push vulnerability report", provider.LoggerFields{
+		"Vulnerabilities": len(report.Vulnerabilities),
+	})
+	desc, err := pushAttestation(ctx, cvt.TargetRemote, subject, ArtifactTypeVulnReport, report)
+	if err := pushDone(err); err != nil {
+		return err
+	}
+	logrus.Infof("Pushed vulnerability report %s as referrer of %s", desc.Digest, subject.Digest)
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/scanner"
+)
+
+func TestVulnReport(t *testing.T) {
+	// libc6 is upgraded from 2.31-13 in upper layer
+	r := mergeLayers(t, []testFile{
+		{path: "var/lib/dpkg/status", content: "Package: libc6\nVersion: 2.31-13\n\nPackage: zlib1g\nVersion: 1.2.11\n", mode: 0644},
+	}, []testFile{
+		{path: "var/lib/dpkg/status", content: dpkgStatus, mode: 0644},
+	})
+
+	s, err := scanner.New(scanner.Opt{Tool: scanner.ToolTrivy, FailOn: "high"})
+	require.Nil(t, err)
+	vs := newVulnScanner(s)
+	vs.layers[0] = []layerVulnerability{
+		{Vulnerability: scanner.Vulnerability{ID: "CVE-1", Package: "libc6", Version: "2.31-13", Severity: scanner.SeverityCritical, Class: scanner.ClassOS}, Layer: 0},
+		{Vulnerability: scanner.Vulnerability{ID: "CVE-2", Package: "requests", Version: "2.19.0", Severity: scanner.SeverityMedium, Class: scanner.ClassLang}, Layer: 0},
+	}
+	vs.layers[1] = []layerVulnerability{
+		{Vulnerability: scanner.Vulnerability{ID: "CVE-3", Package: "libc6", Version: "2.36-9+deb12u1", Severity: scanner.SeverityLow, Class: scanner.ClassOS}, Layer: 1},
+		{Vulnerability: scanner.Vulnerability{ID: "CVE-2", Package: "requests", Version: "2.19.0", Severity: scanner.SeverityMedium, Class: scanner.ClassLang}, Layer: 1},
+	}
+
+	layers := []*buildLayer{{index: 0}, {index: 1}}
+	report, err := vs.Report(context.Background(), "localhost:5000/app:nydus", r, layers)
+	require.Nil(t, err)
+	assert.Equal(t, "localhost:5000/app:nydus", report.Image)
+	assert.Equal(t, scanner.SeverityHigh, report.FailOn)
+	assert.Equal(t, map[string]int{scanner.SeverityMedium: 2, scanner.SeverityLow: 1}, report.Summary)
+	// The vulnerability of the upgraded libc6 is dropped, the upper layer
+	// goes first for the same vulnerability
+	require.Len(t, report.Vulnerabilities, 3)
+	assert.Equal(t, "CVE-2", report.Vulnerabilities[0].ID)
+	assert.Equal(t, 1, report.Vulnerabilities[0].Layer)
+	assert.Equal(t, 0, report.Vulnerabilities[1].Layer)
+	assert.Equal(t, "CVE-3", report.Vulnerabilities[2].ID)
+	assert.Nil(t, vs.Check(report))
+
+	// The vulnerabilities of distro packages are kept without package
+	// database in rootfs
+	report, err = vs.Report(context.Background(), "localhost:5000/app:nydus", rootfs{}, layers)
+	require.Nil(t, err)
+	require.Len(t, report.Vulnerabilities, 4)
+	assert.Equal(t, "CVE-1", report.Vulnerabilities[0].ID)
+	assert.True(t, errors.Is(vs.Check(report), scanner.ErrVulnerable))
+}
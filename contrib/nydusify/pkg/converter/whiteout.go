@@ -0,0 +1,282 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	// WhiteoutSpecAuto selects whiteout spec by the consumer of target
+	// image, `overlayfs` for RAFS v6, otherwise by how the source layer is
+	// presented to builder, `overlayfs` for the layer mounted by containerd
+	// snapshotter, `oci` for the unpacked OCI layer.
+	WhiteoutSpecAuto = "auto"
+	// WhiteoutSpecOCI handles `.wh.` prefixed files as whiteouts.
+	WhiteoutSpecOCI = "oci"
+	// WhiteoutSpecOverlayfs handles 0/0 character devices and directories
+	// with `trusted.overlay.opaque` xattr as whiteouts.
+	WhiteoutSpecOverlayfs = "overlayfs"
+
+	ociWhiteoutPrefix  = ".wh."
+	ociWhiteoutOpaque  = ".wh..wh..opq"
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+	// paxOverlayOpaque is the PAX record of overlayfs opaque xattr in tar.
+	paxOverlayOpaque = "SCHILY.xattr." + overlayOpaqueXattr
+)
+
+// ErrIncompatibleWhiteout is returned when the source layer contains
+// whiteouts can't be recognized by the chosen whiteout spec, building
+// it anyway leads to a Nydus image with unexpected files.
+var ErrIncompatibleWhiteout = errors.New("Incompatible whiteout")
+
+func validWhiteoutSpec(spec string) bool {
+	switch spec {
+	case "", WhiteoutSpecAuto, WhiteoutSpecOCI, WhiteoutSpecOverlayfs:
+		return true
+	}
+	return false
+}
+
+// sourceWhiteoutSpec returns the whiteout spec of the source mount, the
+// spec detected from mount type is used in auto mode.
+func sourceWhiteoutSpec(spec string, mount *sourceMount) string {
+	if spec == "" || spec == WhiteoutSpecAuto {
+		return mount.WhiteoutSpec
+	}
+	return spec
+}
+
+// consumerWhiteoutSpec returns the whiteout spec required by the consumer
+// of Nydus image in fsVersion, or empty if any spec is accepted. The RAFS
+// v6 layers may be mounted by EROFS and stacked by kernel overlayfs, which
+// only recognizes overlayfs whiteouts, while nydusd merges the RAFS v5
+// layers by itself.
+func consumerWhiteoutSpec(fsVersion string) string {
+	if fsVersion == FsVersionV6 {
+		return WhiteoutSpecOverlayfs
+	}
+	return ""
+}
+
+// selectWhiteoutSpec returns the whiteout spec used to build the source
+// mount for the consumer of fsVersion. In auto mode, the spec required by
+// consumer is preferred, then the spec detected from mount type.
+func selectWhiteoutSpec(spec string, mount *sourceMount, fsVersion string) string {
+	if spec == "" || spec == WhiteoutSpecAuto {
+		if consumer := consumerWhiteoutSpec(fsVersion); consumer != "" {
+			return consumer
+		}
+	}
+	return sourceWhiteoutSpec(spec, mount)
+}
+
+// convertOCIWhiteouts converts the OCI whiteouts in the unpacked source
+// layer to overlayfs whiteouts, `.wh.<name>` is replaced by 0/0 character
+// device `<name>`, and the directory containing `.wh..wh..opq` is marked
+// by overlayfs opaque xattr.
+func convertOCIWhiteouts(dir string) error {
+	whiteouts := []string{}
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ociWhiteoutPrefix) {
+			whiteouts = append(whiteouts, path)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, whiteout := range whiteouts {
+		parent, name := filepath.Split(whiteout)
+		if err := os.Remove(whiteout); err != nil {
+			return errors.Wrapf(err, "Remove whiteout %s", whiteout)
+		}
+		if name == ociWhiteoutOpaque {
+			if err := xattr.LSet(parent, overlayOpaqueXattr, []byte("y")); err != nil {
+				return errors.Wrapf(err, "Mark opaque directory %s", parent)
+			}
+			continue
+		}
+		target := filepath.Join(parent, strings.TrimPrefix(name, ociWhiteoutPrefix))
+		if err := syscall.Mknod(target, syscall.S_IFCHR, 0); err != nil {
+			return errors.Wrapf(err, "Create overlayfs whiteout %s", target)
+		}
+	}
+	return nil
+}
+
+func isOverlayWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func isOverlayOpaque(path string) bool {
+	data, err := xattr.LGet(path, overlayOpaqueXattr)
+	return err == nil && string(data) == "y"
+}
+
+// validateWhiteouts walks through the source layer directory, returns
+// ErrIncompatibleWhiteout if any whiteout doesn't match the whiteout spec.
+func validateWhiteouts(dir, spec string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		var found string
+		switch spec {
+		case WhiteoutSpecOCI:
+			if isOverlayWhiteout(info) {
+				found = "overlayfs whiteout"
+			} else if info.IsDir() && isOverlayOpaque(path) {
+				found = "overlayfs opaque directory"
+			}
+		case WhiteoutSpecOverlayfs:
+			if strings.HasPrefix(info.Name(), ociWhiteoutPrefix) {
+				found = "oci whiteout"
+			}
+		}
+
+		return incompatibleWhiteout(found, rel, spec)
+	})
+}
+
+func incompatibleWhiteout(found, rel, spec string) error {
+	if found == "" {
+		return nil
+	}
+	return errors.Wrapf(
+		ErrIncompatibleWhiteout, "found %s /%s with whiteout spec %s", found, rel, spec,
+	)
+}
+
+// validateTarWhiteouts reads through the (compressed) tar stream of source
+// layer, returns ErrIncompatibleWhiteout if any whiteout entry doesn't match
+// the whiteout spec. The malformed stream is left to builder to report.
+func validateTarWhiteouts(reader io.Reader, spec string) error {
+	rdr, err := utils.DecompressStream(reader)
+	if err != nil {
+		return nil
+	}
+	defer rdr.Close()
+
+	tr := tar.NewReader(rdr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil
+		}
+
+		rel := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		var found string
+		switch spec {
+		case WhiteoutSpecOCI:
+			if hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0 {
+				found = "overlayfs whiteout"
+			} else if hdr.Typeflag == tar.TypeDir && hdr.PAXRecords[paxOverlayOpaque] == "y" {
+				found = "overlayfs opaque directory"
+			}
+		case WhiteoutSpecOverlayfs:
+			if strings.HasPrefix(path.Base(rel), ociWhiteoutPrefix) {
+				found = "oci whiteout"
+			}
+		}
+		if err := incompatibleWhiteout(found, rel, spec); err != nil {
+			return err
+		}
+	}
+}
+
+// tarWhiteoutValidator validates the whiteouts in the tar stream of source
+// layer while builder is reading it, the reading fails once any whiteout
+// doesn't match the whiteout spec, so that no broken Nydus layer is built.
+type tarWhiteoutValidator struct {
+	reader io.Reader
+	pw     *io.PipeWriter
+	result chan error
+	done   bool
+	err    error
+}
+
+func newTarWhiteoutValidator(reader io.Reader, spec string) *tarWhiteoutValidator {
+	pr, pw := io.Pipe()
+	validator := &tarWhiteoutValidator{
+		reader: io.TeeReader(reader, pw),
+		pw:     pw,
+		result: make(chan error, 1),
+	}
+	go func() {
+		validator.result <- validateTarWhiteouts(pr, spec)
+		// Drain the rest of stream being read by builder
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return validator
+}
+
+// check returns the validating result, waits for it if block is true.
+func (validator *tarWhiteoutValidator) check(block bool) error {
+	if validator.done {
+		return nil
+	}
+	if block {
+		validator.err = <-validator.result
+	} else {
+		select {
+		case validator.err = <-validator.result:
+		default:
+			return nil
+		}
+	}
+	validator.done = true
+	return validator.err
+}
+
+func (validator *tarWhiteoutValidator) Read(p []byte) (int, error) {
+	if validator.err != nil {
+		return 0, validator.err
+	}
+	n, err := validator.reader.Read(p)
+	if err == io.EOF {
+		validator.pw.Close()
+		if err := validator.check(true); err != nil {
+			return n, err
+		}
+	} else if err != nil {
+		validator.pw.CloseWithError(err)
+	} else if err := validator.check(false); err != nil {
+		return n, err
+	}
+	return n, err
+}
+
+// Close stops validating the stream not read to the end, returns the
+// incompatible whiteout found in the read part.
+func (validator *tarWhiteoutValidator) Close() error {
+	validator.pw.Close()
+	validator.check(true)
+	return validator.err
+}
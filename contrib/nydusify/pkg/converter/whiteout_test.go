@@ -0,0 +1,150 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectWhiteoutSpec(t *testing.T) {
+	ociMount := &sourceMount{WhiteoutSpec: WhiteoutSpecOCI}
+	overlayMount := &sourceMount{WhiteoutSpec: WhiteoutSpecOverlayfs}
+
+	assert.Equal(t, WhiteoutSpecOCI, selectWhiteoutSpec("", ociMount, ""))
+	assert.Equal(t, WhiteoutSpecOverlayfs, selectWhiteoutSpec(WhiteoutSpecAuto, overlayMount, FsVersionV5))
+	assert.Equal(t, WhiteoutSpecOverlayfs, selectWhiteoutSpec(WhiteoutSpecOverlayfs, ociMount, ""))
+	// RAFS v6 requires overlayfs whiteouts unless specified explicitly
+	assert.Equal(t, WhiteoutSpecOverlayfs, selectWhiteoutSpec(WhiteoutSpecAuto, ociMount, FsVersionV6))
+	assert.Equal(t, WhiteoutSpecOCI, selectWhiteoutSpec(WhiteoutSpecOCI, ociMount, FsVersionV6))
+	assert.Equal(t, WhiteoutSpecOCI, sourceWhiteoutSpec(WhiteoutSpecAuto, ociMount))
+
+	assert.True(t, validWhiteoutSpec(WhiteoutSpecAuto))
+	assert.False(t, validWhiteoutSpec("aufs"))
+}
+
+func TestValidateWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-whiteout-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "etc"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "etc", "hosts"), []byte("hosts"), 0644))
+	assert.Nil(t, validateWhiteouts(dir, WhiteoutSpecOCI))
+	assert.Nil(t, validateWhiteouts(dir, WhiteoutSpecOverlayfs))
+
+	// OCI whiteout can't be recognized by overlayfs spec
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "etc", ".wh.passwd"), nil, 0644))
+	assert.Nil(t, validateWhiteouts(dir, WhiteoutSpecOCI))
+	err = validateWhiteouts(dir, WhiteoutSpecOverlayfs)
+	assert.Equal(t, ErrIncompatibleWhiteout, errors.Cause(err))
+	assert.Contains(t, err.Error(), "/etc/.wh.passwd")
+	require.Nil(t, os.Remove(filepath.Join(dir, "etc", ".wh.passwd")))
+
+	// Overlayfs whiteout can't be recognized by OCI spec
+	if err := syscall.Mknod(filepath.Join(dir, "etc", "passwd"), syscall.S_IFCHR, 0); err != nil {
+		t.Skipf("Create overlayfs whiteout: %s", err)
+	}
+	assert.Nil(t, validateWhiteouts(dir, WhiteoutSpecOverlayfs))
+	err = validateWhiteouts(dir, WhiteoutSpecOCI)
+	assert.Equal(t, ErrIncompatibleWhiteout, errors.Cause(err))
+	assert.Contains(t, err.Error(), "/etc/passwd")
+}
+
+func TestConvertOCIWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-whiteout-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "etc"), 0755))
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "var"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "etc", ".wh.passwd"), nil, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "var", ".wh..wh..opq"), nil, 0644))
+	if err := convertOCIWhiteouts(dir); err != nil {
+		t.Skipf("Convert OCI whiteouts: %s", err)
+	}
+
+	info, err := os.Lstat(filepath.Join(dir, "etc", "passwd"))
+	require.Nil(t, err)
+	assert.True(t, isOverlayWhiteout(info))
+	assert.True(t, isOverlayOpaque(filepath.Join(dir, "var")))
+	assert.Nil(t, validateWhiteouts(dir, WhiteoutSpecOverlayfs))
+
+	// The OCI whiteout conflicts with existing file
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "etc", "hosts"), []byte("hosts"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "etc", ".wh.hosts"), nil, 0644))
+	assert.NotNil(t, convertOCIWhiteouts(dir))
+}
+
+func TestTarWhiteoutValidator(t *testing.T) {
+	buildTar := func(hdrs ...*tar.Header) []byte {
+		buf := bytes.Buffer{}
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			require.Nil(t, tw.WriteHeader(hdr))
+		}
+		require.Nil(t, tw.Close())
+		return buf.Bytes()
+	}
+	validate := func(data []byte, spec string) error {
+		validator := newTarWhiteoutValidator(bytes.NewReader(data), spec)
+		read, err := ioutil.ReadAll(validator)
+		if err == nil {
+			assert.Equal(t, data, read)
+		}
+		closeErr := validator.Close()
+		if err == nil {
+			return closeErr
+		}
+		assert.Equal(t, err, closeErr)
+		return err
+	}
+
+	etc := &tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}
+	hosts := &tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644}
+	ociWhiteout := &tar.Header{Name: "etc/.wh.passwd", Typeflag: tar.TypeReg, Mode: 0644}
+	overlayWhiteout := &tar.Header{Name: "etc/passwd", Typeflag: tar.TypeChar}
+	overlayOpaque := &tar.Header{
+		Name: "var/", Typeflag: tar.TypeDir, Mode: 0755,
+		PAXRecords: map[string]string{paxOverlayOpaque: "y"},
+	}
+
+	data := buildTar(etc, hosts)
+	assert.Nil(t, validate(data, WhiteoutSpecOCI))
+	assert.Nil(t, validate(data, WhiteoutSpecOverlayfs))
+
+	data = buildTar(etc, ociWhiteout, hosts)
+	assert.Nil(t, validate(data, WhiteoutSpecOCI))
+	err := validate(data, WhiteoutSpecOverlayfs)
+	assert.Equal(t, ErrIncompatibleWhiteout, errors.Cause(err))
+	assert.Contains(t, err.Error(), "/etc/.wh.passwd")
+
+	data = buildTar(etc, overlayWhiteout)
+	assert.Nil(t, validate(data, WhiteoutSpecOverlayfs))
+	err = validate(data, WhiteoutSpecOCI)
+	assert.Equal(t, ErrIncompatibleWhiteout, errors.Cause(err))
+	assert.Contains(t, err.Error(), "/etc/passwd")
+
+	data = buildTar(overlayOpaque)
+	assert.Nil(t, validate(data, WhiteoutSpecOverlayfs))
+	err = validate(data, WhiteoutSpecOCI)
+	assert.Contains(t, err.Error(), "overlayfs opaque directory /var")
+
+	// The validator stops on close if the stream isn't read to the end
+	validator := newTarWhiteoutValidator(bytes.NewReader(buildTar(etc, hosts)), WhiteoutSpecOCI)
+	_, err = io.ReadFull(validator, make([]byte, 512))
+	require.Nil(t, err)
+	assert.Nil(t, validator.Close())
+}
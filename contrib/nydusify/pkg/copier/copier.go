@@ -0,0 +1,566 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package copier
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const defaultConcurrency = 5
+
+// Opt defines Nydus image copier options.
+type Opt struct {
+	WorkDir        string
+	Source         string
+	Target         string
+	SourceInsecure bool
+	TargetInsecure bool
+	// The storage backend of source image, it's required if the
+	// blobs of source image aren't stored in source registry.
+	SourceBackendType   string
+	SourceBackendConfig string
+	// The storage backend of target image, the blobs are relocated
+	// if it's different with the storage backend of source image.
+	BackendType   string
+	BackendConfig string
+	// Concurrency is the count of blobs transferred concurrently.
+	Concurrency uint
+	// ManifestOnly rewrites the manifests without copying config and
+	// layers, so target must be in the same repository with source. The
+	// blobs are kept in the storage backend of source image if BackendType
+	// is empty, otherwise they're relocated to the storage backend.
+	ManifestOnly bool
+	// Annotations are merged into the annotations of Nydus manifest, the
+	// annotation with empty value is removed.
+	Annotations map[string]string
+	// Format converts the media types of manifest, index, config and
+	// layers to the format if it's specified, possible values: oci, docker.
+	Format string
+	// HTTPCacheDir caches the manifest and config responses from registry
+	// in the directory if it's specified.
+	HTTPCacheDir string
+}
+
+const (
+	FormatOCI    = "oci"
+	FormatDocker = "docker"
+)
+
+// ociToDocker maps the OCI media types to Docker image manifest v2,
+// schema 2 media types, the Nydus blob media type is kept.
+var ociToDocker = map[string]string{
+	ocispec.MediaTypeImageManifest:  images.MediaTypeDockerSchema2Manifest,
+	ocispec.MediaTypeImageIndex:     images.MediaTypeDockerSchema2ManifestList,
+	ocispec.MediaTypeImageConfig:    images.MediaTypeDockerSchema2Config,
+	ocispec.MediaTypeImageLayerGzip: images.MediaTypeDockerSchema2LayerGzip,
+	ocispec.MediaTypeImageLayer:     images.MediaTypeDockerSchema2Layer,
+}
+
+// Copier copies Nydus image (bootstrap, blobs, and the OCI manifests in
+// the same manifest index) between registries, and relocates the blobs
+// between storage backends, e.g. from registry to OSS.
+type Copier struct {
+	Opt
+	source        *remote.Remote
+	target        *remote.Remote
+	sourceBackend backend.Backend
+	targetBackend backend.Backend
+}
+
+// New creates Copier instance.
+func New(opt Opt) (*Copier, error) {
+	if opt.Concurrency == 0 {
+		opt.Concurrency = defaultConcurrency
+	}
+
+	source, err := provider.DefaultRemote(opt.Source, opt.SourceInsecure, provider.WithHTTPCache(opt.HTTPCacheDir))
+	if err != nil {
+		return nil, errors.Wrap(err, "Init source image parser")
+	}
+	target, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure, provider.WithHTTPCache(opt.HTTPCacheDir))
+	if err != nil {
+		return nil, errors.Wrap(err, "Init target image parser")
+	}
+
+	var sourceBackend backend.Backend
+	if opt.SourceBackendType != "" {
+		sourceBackend, err = backend.NewBackend(opt.SourceBackendType, []byte(opt.SourceBackendConfig), source)
+		if err != nil {
+			return nil, errors.Wrap(err, "Init source storage backend")
+		}
+	}
+	if opt.Format != "" && opt.Format != FormatOCI && opt.Format != FormatDocker {
+		return nil, fmt.Errorf("Unsupported format %s", opt.Format)
+	}
+	if opt.ManifestOnly {
+		sourceNamed, err := docker.ParseDockerRef(opt.Source)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parse source reference")
+		}
+		targetNamed, err := docker.ParseDockerRef(opt.Target)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parse target reference")
+		}
+		if sourceNamed.Name() != targetNamed.Name() {
+			return nil, fmt.Errorf("Target should be in the same repository with source for manifest only rewrite")
+		}
+	} else if opt.BackendType == "" {
+		opt.BackendType = "registry"
+	}
+	// The blobs are kept in place without target storage backend
+	var targetBackend backend.Backend
+	if opt.BackendType != "" {
+		targetBackend, err = backend.NewBackend(opt.BackendType, []byte(opt.BackendConfig), target)
+		if err != nil {
+			return nil, errors.Wrap(err, "Init target storage backend")
+		}
+	}
+
+	return &Copier{
+		Opt:           opt,
+		source:        source,
+		target:        target,
+		sourceBackend: sourceBackend,
+		targetBackend: targetBackend,
+	}, nil
+}
+
+func (cp *Copier) pull(ctx context.Context, desc ocispec.Descriptor) ([]byte, error) {
+	reader, err := cp.source.Pull(ctx, desc, true)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// copyBlob copies the blob between registries, the digest is verified
+// by content writer of target registry.
+func (cp *Copier) copyBlob(ctx context.Context, desc ocispec.Descriptor) error {
+	return utils.WithRetry(func() error {
+		reader, err := cp.source.Pull(ctx, desc, true)
+		if err != nil {
+			return errors.Wrapf(err, "Pull blob %s", desc.Digest)
+		}
+		defer reader.Close()
+		if err := cp.target.Push(ctx, desc, true, reader); err != nil {
+			return errors.Wrapf(err, "Push blob %s", desc.Digest)
+		}
+		return nil
+	})
+}
+
+// copyBlobs copies the blobs concurrently.
+func (cp *Copier) copyBlobs(ctx context.Context, descs []ocispec.Descriptor) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, cp.Concurrency)
+	for idx := range descs {
+		desc := descs[idx]
+		sem <- struct{}{}
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			return cp.copyBlob(ctx, desc)
+		})
+	}
+	return eg.Wait()
+}
+
+// fetchBlob downloads the Nydus blob to work directory from source
+// registry or source storage backend, and verifies the digest.
+func (cp *Copier) fetchBlob(ctx context.Context, blobID string, desc *ocispec.Descriptor) (string, int64, error) {
+	var reader io.ReadCloser
+	var err error
+	if desc != nil {
+		reader, err = cp.source.Pull(ctx, *desc, true)
+	} else if backendReader, ok := cp.sourceBackend.(backend.Reader); ok {
+		reader, err = backendReader.Reader(ctx, blobID)
+	} else {
+		return "", 0, fmt.Errorf("Blob %s isn't in source manifest, source storage backend is required", blobID)
+	}
+	if err != nil {
+		return "", 0, errors.Wrap(err, "Read blob")
+	}
+	defer reader.Close()
+
+	blobPath := filepath.Join(cp.WorkDir, blobID)
+	file, err := os.Create(blobPath)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "Create blob file")
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), reader)
+	if err != nil {
+		os.Remove(blobPath)
+		return "", 0, errors.Wrap(err, "Download blob")
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != blobID {
+		os.Remove(blobPath)
+		return "", 0, fmt.Errorf("Blob digest mismatch, expected %s, actual %s", blobID, actual)
+	}
+
+	return blobPath, size, nil
+}
+
+// relocateBlob stores the blob to target storage backend, returns
+// the blob descriptor for registry backend.
+func (cp *Copier) relocateBlob(ctx context.Context, blobID string, desc *ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	if cp.targetBackend.Type() != backend.RegistryBackend {
+		exist, err := cp.targetBackend.Check(blobID)
+		if err != nil {
+			return nil, errors.Wrap(err, "Check blob in target storage backend")
+		}
+		if exist {
+			return nil, nil
+		}
+	}
+
+	var result *ocispec.Descriptor
+	err := utils.WithRetry(func() error {
+		blobPath, size, err := cp.fetchBlob(ctx, blobID, desc)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(blobPath)
+		result, err = cp.targetBackend.Upload(ctx, blobID, blobPath, size)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Relocate blob %s", blobID)
+	}
+
+	return result, nil
+}
+
+// convertMediaType returns the media type in the format of Format.
+func (cp *Copier) convertMediaType(mediaType string) string {
+	switch cp.Format {
+	case FormatDocker:
+		if converted, ok := ociToDocker[mediaType]; ok {
+			return converted
+		}
+	case FormatOCI:
+		for oci, docker := range ociToDocker {
+			if mediaType == docker {
+				return oci
+			}
+		}
+	}
+	return mediaType
+}
+
+// convertManifest converts the media types of config and layers in
+// manifest to Format, returns true if any is changed.
+func (cp *Copier) convertManifest(manifest *ocispec.Manifest) bool {
+	changed := false
+	if mediaType := cp.convertMediaType(manifest.Config.MediaType); mediaType != manifest.Config.MediaType {
+		manifest.Config.MediaType = mediaType
+		changed = true
+	}
+	layers := make([]ocispec.Descriptor, len(manifest.Layers))
+	for idx, layer := range manifest.Layers {
+		layers[idx] = layer
+		if mediaType := cp.convertMediaType(layer.MediaType); mediaType != layer.MediaType {
+			layers[idx].MediaType = mediaType
+			changed = true
+		}
+	}
+	manifest.Layers = layers
+	return changed
+}
+
+// annotate merges Annotations into the annotations of manifest, returns
+// true if the annotations are changed.
+func (cp *Copier) annotate(manifest *ocispec.Manifest) bool {
+	if len(cp.Annotations) == 0 {
+		return false
+	}
+	annotations := map[string]string{}
+	for key, value := range manifest.Annotations {
+		annotations[key] = value
+	}
+	for key, value := range cp.Annotations {
+		if value == "" {
+			delete(annotations, key)
+		} else {
+			annotations[key] = value
+		}
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	if reflect.DeepEqual(annotations, manifest.Annotations) {
+		return false
+	}
+	manifest.Annotations = annotations
+	return true
+}
+
+// Find the Nydus bootstrap layer, it should be the topmost layer.
+func findBootstrap(manifest *ocispec.Manifest) *ocispec.Descriptor {
+	layers := manifest.Layers
+	if len(layers) != 0 && layers[len(layers)-1].Annotations[utils.LayerAnnotationNydusBootstrap] == "true" {
+		return &layers[len(layers)-1]
+	}
+	return nil
+}
+
+// copyNydusManifest copies the bootstrap and blobs of Nydus image, the
+// manifest is rewritten if the blobs are relocated to another backend.
+func (cp *Copier) copyNydusManifest(
+	ctx context.Context, manifest *ocispec.Manifest,
+) (*ocispec.Manifest, bool, error) {
+	if cp.targetBackend == nil {
+		return manifest, false, nil
+	}
+
+	bootstrap := *findBootstrap(manifest)
+
+	blobLayers := map[string]*ocispec.Descriptor{}
+	blobIDs := []string{}
+	for idx := range manifest.Layers {
+		layer := manifest.Layers[idx]
+		if layer.Annotations[utils.LayerAnnotationNydusBlob] == "true" {
+			// The digest of encrypted blob layer isn't the blob id
+			blobID := layer.Digest.Hex()
+			if id := layer.Annotations[utils.LayerAnnotationNydusBlobID]; id != "" {
+				if cp.targetBackend.Type() != backend.RegistryBackend {
+					return nil, false, fmt.Errorf("Encrypted blob %s can't be relocated", id)
+				}
+				blobID = id
+			}
+			blobLayers[blobID] = &layer
+			blobIDs = append(blobIDs, blobID)
+		}
+	}
+	if ids, ok := bootstrap.Annotations[utils.LayerAnnotationNydusBlobIDs]; ok {
+		blobIDs = []string{}
+		if err := json.Unmarshal([]byte(ids), &blobIDs); err != nil {
+			return nil, false, errors.Wrap(err, "Unmarshal blob list of bootstrap")
+		}
+	}
+
+	// Copy bootstrap layer and config
+	if !cp.ManifestOnly {
+		if err := cp.copyBlobs(ctx, []ocispec.Descriptor{manifest.Config, bootstrap}); err != nil {
+			return nil, false, err
+		}
+	}
+
+	newAnnotations := map[string]string{}
+	for key, value := range bootstrap.Annotations {
+		newAnnotations[key] = value
+	}
+	delete(newAnnotations, utils.LayerAnnotationNydusBackendType)
+	delete(newAnnotations, utils.LayerAnnotationNydusBackendConfig)
+	if hinter, ok := cp.targetBackend.(backend.ConfigHinter); ok {
+		hintBytes, err := json.Marshal(hinter.ConfigHint())
+		if err != nil {
+			return nil, false, errors.Wrap(err, "Marshal backend config hint")
+		}
+		newAnnotations[utils.LayerAnnotationNydusBackendType] = backend.TypeName(cp.targetBackend.Type())
+		newAnnotations[utils.LayerAnnotationNydusBackendConfig] = string(hintBytes)
+	}
+
+	// Copy blobs between registries directly if no relocation, otherwise
+	// download the blob and upload it to target storage backend.
+	blobDescs := make([]*ocispec.Descriptor, len(blobIDs))
+	eg, egCtx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, cp.Concurrency)
+	for idx := range blobIDs {
+		idx := idx
+		blobID := blobIDs[idx]
+		desc := blobLayers[blobID]
+		sem <- struct{}{}
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			logrus.Infof("Copying blob %s", blobID)
+			if desc != nil && cp.targetBackend.Type() == backend.RegistryBackend {
+				blobDescs[idx] = desc
+				if cp.ManifestOnly {
+					// The blob is already in the repository
+					return nil
+				}
+				return cp.copyBlob(egCtx, *desc)
+			}
+			var err error
+			blobDescs[idx], err = cp.relocateBlob(egCtx, blobID, desc)
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, false, err
+	}
+
+	layers := []ocispec.Descriptor{}
+	if cp.targetBackend.Type() == backend.RegistryBackend {
+		for _, desc := range blobDescs {
+			if desc != nil {
+				layers = append(layers, *desc)
+			}
+		}
+	}
+	bootstrap.Annotations = newAnnotations
+	layers = append(layers, bootstrap)
+
+	changed := !reflect.DeepEqual(layers, manifest.Layers)
+	newManifest := *manifest
+	newManifest.Layers = layers
+
+	return &newManifest, changed, nil
+}
+
+// copyManifest copies the image manifest with its config and layers,
+// returns the descriptor of manifest in target.
+func (cp *Copier) copyManifest(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (*ocispec.Descriptor, error) {
+	manifestBytes, err := cp.pull(ctx, desc)
+	if err != nil {
+		return nil, errors.Wrap(err, "Pull image manifest")
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal image manifest")
+	}
+
+	newManifest := manifest
+	changed := false
+	if findBootstrap(&manifest) == nil {
+		logrus.Infof("Copying OCI manifest %s", desc.Digest)
+		if !cp.ManifestOnly {
+			if err := cp.copyBlobs(ctx, append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...)); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		logrus.Infof("Copying Nydus manifest %s", desc.Digest)
+		_newManifest, _changed, err := cp.copyNydusManifest(ctx, &manifest)
+		if err != nil {
+			return nil, errors.Wrap(err, "Copy Nydus image")
+		}
+		newManifest = *_newManifest
+		changed = _changed
+		if cp.annotate(&newManifest) {
+			changed = true
+		}
+	}
+	mediaType := cp.convertMediaType(desc.MediaType)
+	if cp.convertManifest(&newManifest) || mediaType != desc.MediaType {
+		changed = true
+	}
+
+	if changed {
+		_desc, _manifestBytes, err := utils.MarshalToDesc(struct {
+			MediaType string `json:"mediaType,omitempty"`
+			ocispec.Manifest
+		}{
+			MediaType: mediaType,
+			Manifest:  newManifest,
+		}, mediaType)
+		if err != nil {
+			return nil, errors.Wrap(err, "Marshal image manifest")
+		}
+		manifestBytes = _manifestBytes
+		newDesc := desc
+		newDesc.MediaType = mediaType
+		newDesc.Digest = _desc.Digest
+		newDesc.Size = _desc.Size
+		desc = newDesc
+	}
+
+	if err := cp.target.Push(ctx, desc, byDigest, bytes.NewReader(manifestBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push image manifest")
+	}
+
+	return &desc, nil
+}
+
+// Copy copies source image to target.
+func (cp *Copier) Copy(ctx context.Context) error {
+	if err := os.MkdirAll(cp.WorkDir, 0755); err != nil {
+		return errors.Wrap(err, "Create work directory")
+	}
+
+	desc, err := cp.source.Resolve(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Resolve source image")
+	}
+
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		if _, err := cp.copyManifest(ctx, *desc, false); err != nil {
+			return err
+		}
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		indexBytes, err := cp.pull(ctx, *desc)
+		if err != nil {
+			return errors.Wrap(err, "Pull image manifest index")
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(indexBytes, &index); err != nil {
+			return errors.Wrap(err, "Unmarshal image manifest index")
+		}
+
+		indexMediaType := cp.convertMediaType(desc.MediaType)
+		changed := indexMediaType != desc.MediaType
+		for idx, manifestDesc := range index.Manifests {
+			newDesc, err := cp.copyManifest(ctx, manifestDesc, true)
+			if err != nil {
+				return err
+			}
+			if newDesc.Digest != manifestDesc.Digest {
+				index.Manifests[idx] = *newDesc
+				changed = true
+			}
+		}
+
+		indexDesc := *desc
+		if changed {
+			_indexDesc, _indexBytes, err := utils.MarshalToDesc(struct {
+				MediaType string `json:"mediaType,omitempty"`
+				ocispec.Index
+			}{
+				MediaType: indexMediaType,
+				Index:     index,
+			}, indexMediaType)
+			if err != nil {
+				return errors.Wrap(err, "Marshal image manifest index")
+			}
+			indexDesc = *_indexDesc
+			indexBytes = _indexBytes
+		}
+		if err := cp.target.Push(ctx, indexDesc, false, bytes.NewReader(indexBytes)); err != nil {
+			return errors.Wrap(err, "Push image manifest index")
+		}
+	default:
+		return fmt.Errorf("Unsupported media type %s of source image", desc.MediaType)
+	}
+
+	logrus.Infof("Copied %s to %s", cp.Source, cp.Target)
+
+	return nil
+}
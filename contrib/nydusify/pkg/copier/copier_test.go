@@ -0,0 +1,370 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package copier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// fakeRegistry is a minimal in-memory registry implements the blob and
+// manifest API used by containerd docker remote.
+type fakeRegistry struct {
+	sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	types     map[string]string
+	// uploads is the count of uploaded blobs
+	uploads int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+	}
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if req.URL.Path == "/v2/" {
+		return
+	}
+
+	switch {
+	case strings.Contains(path, "/blobs/uploads/"):
+		if req.Method == http.MethodPost {
+			w.Header().Set("Location", "/v2/"+path+"upload")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		data, _ := ioutil.ReadAll(req.Body)
+		dgst := req.URL.Query().Get("digest")
+		if digest.FromBytes(data).String() != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[dgst] = data
+		r.uploads++
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		data, ok := r.blobs[path[strings.LastIndex(path, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case strings.Contains(path, "/manifests/"):
+		if req.Method == http.MethodPut {
+			data, _ := ioutil.ReadAll(req.Body)
+			dgst := digest.FromBytes(data).String()
+			r.manifests[path] = data
+			r.manifests[path[:strings.LastIndex(path, "/")+1]+dgst] = data
+			r.types[dgst] = req.Header.Get("Content-Type")
+			w.Header().Set("Docker-Content-Digest", dgst)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		data, ok := r.manifests[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		dgst := digest.FromBytes(data).String()
+		w.Header().Set("Content-Type", r.types[dgst])
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *fakeRegistry) putBlob(data []byte) ocispec.Descriptor {
+	dgst := digest.FromBytes(data)
+	r.blobs[dgst.String()] = data
+	return ocispec.Descriptor{Digest: dgst, Size: int64(len(data))}
+}
+
+func (r *fakeRegistry) putManifest(path string, mediaType string, manifest interface{}) digest.Digest {
+	data, _ := json.Marshal(manifest)
+	dgst := digest.FromBytes(data)
+	r.manifests[path] = data
+	r.manifests[path[:strings.LastIndex(path, "/")+1]+dgst.String()] = data
+	r.types[dgst.String()] = mediaType
+	return dgst
+}
+
+func (r *fakeRegistry) getManifest(t *testing.T, path string) ocispec.Manifest {
+	var manifest ocispec.Manifest
+	require.Nil(t, json.Unmarshal(r.manifests[path], &manifest))
+	return manifest
+}
+
+// putNydusImage puts a Nydus image with two blobs to registry.
+func (r *fakeRegistry) putNydusImage(path string) ([]string, digest.Digest) {
+	config := r.putBlob([]byte(`{"architecture":"amd64","os":"linux"}`))
+	config.MediaType = ocispec.MediaTypeImageConfig
+	blobIDs := []string{}
+	layers := []ocispec.Descriptor{}
+	for _, data := range []string{"blob1", "blob2"} {
+		desc := r.putBlob([]byte(data))
+		desc.MediaType = utils.MediaTypeNydusBlob
+		desc.Annotations = map[string]string{
+			utils.LayerAnnotationNydusBlob:    "true",
+			utils.LayerAnnotationUncompressed: desc.Digest.String(),
+		}
+		layers = append(layers, desc)
+		blobIDs = append(blobIDs, desc.Digest.Hex())
+	}
+	blobIDsBytes, _ := json.Marshal(blobIDs)
+	bootstrap := r.putBlob([]byte("bootstrap"))
+	bootstrap.MediaType = ocispec.MediaTypeImageLayerGzip
+	bootstrap.Annotations = map[string]string{
+		utils.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationNydusBlobIDs:   string(blobIDsBytes),
+	}
+	layers = append(layers, bootstrap)
+	manifestDigest := r.putManifest(path, ocispec.MediaTypeImageManifest, struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Manifest: ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config:    config,
+			Layers:    layers,
+		},
+	})
+	return blobIDs, manifestDigest
+}
+
+func TestCopy(t *testing.T) {
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	workDir, err := ioutil.TempDir("", "nydusify-copier-")
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	blobIDs, manifestDigest := registry.putNydusImage("source/manifests/latest")
+	blobIDsBytes, _ := json.Marshal(blobIDs)
+
+	objects := newFakeS3()
+	s3Server := httptest.NewServer(objects)
+	defer s3Server.Close()
+	s3Config := fmt.Sprintf(`{
+		"scheme": "http",
+		"endpoint": "%s",
+		"bucket_name": "bucket",
+		"access_key_id": "ak",
+		"access_key_secret": "sk"
+	}`, strings.TrimPrefix(s3Server.URL, "http://"))
+
+	copy := func(source, target, sourceBackendType, backendType string) {
+		opt := Opt{
+			WorkDir:        workDir,
+			Source:         host + "/" + source,
+			Target:         host + "/" + target,
+			SourceInsecure: true,
+			TargetInsecure: true,
+			BackendType:    backendType,
+		}
+		if sourceBackendType == "s3" {
+			opt.SourceBackendType = "s3"
+			opt.SourceBackendConfig = s3Config
+		}
+		if backendType == "s3" {
+			opt.BackendConfig = s3Config
+		}
+		cp, err := New(opt)
+		require.Nil(t, err)
+		require.Nil(t, cp.Copy(context.Background()))
+	}
+
+	// Copy between registries keeps the manifest digest
+	copy("source:latest", "target:latest", "", "")
+	assert.Equal(t, registry.manifests["source/manifests/latest"], registry.manifests["target/manifests/latest"])
+	assert.NotNil(t, registry.manifests["target/manifests/"+manifestDigest.String()])
+
+	// Relocate blobs from registry to object storage
+	copy("source:latest", "target-s3:latest", "", "s3")
+	manifest := registry.getManifest(t, "target-s3/manifests/latest")
+	require.Equal(t, 1, len(manifest.Layers))
+	assert.Equal(t, "s3", manifest.Layers[0].Annotations[utils.LayerAnnotationNydusBackendType])
+	assert.Equal(t, string(blobIDsBytes), manifest.Layers[0].Annotations[utils.LayerAnnotationNydusBlobIDs])
+	assert.Equal(t, []byte("blob1"), objects.objects["/bucket/"+blobIDs[0]])
+	assert.Equal(t, []byte("blob2"), objects.objects["/bucket/"+blobIDs[1]])
+
+	// Relocate blobs from object storage back to registry
+	copy("target-s3:latest", "target-registry:latest", "s3", "")
+	assert.Equal(t, registry.getManifest(t, "source/manifests/latest"), registry.getManifest(t, "target-registry/manifests/latest"))
+
+	// The blob is verified by digest
+	objects.objects["/bucket/"+blobIDs[0]] = []byte("corrupted")
+	cp, err := New(Opt{
+		WorkDir:             workDir,
+		Source:              host + "/target-s3:latest",
+		Target:              host + "/target-corrupted:latest",
+		SourceInsecure:      true,
+		TargetInsecure:      true,
+		SourceBackendType:   "s3",
+		SourceBackendConfig: s3Config,
+	})
+	require.Nil(t, err)
+	err = cp.Copy(context.Background())
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Blob digest mismatch")
+}
+
+func TestCopyManifestOnly(t *testing.T) {
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	workDir, err := ioutil.TempDir("", "nydusify-copier-")
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	blobIDs, _ := registry.putNydusImage("app/manifests/latest")
+	source := registry.getManifest(t, "app/manifests/latest")
+
+	objects := newFakeS3()
+	s3Server := httptest.NewServer(objects)
+	defer s3Server.Close()
+
+	// The target must be in the same repository
+	_, err = New(Opt{
+		WorkDir:      workDir,
+		Source:       host + "/app:latest",
+		Target:       host + "/other:latest",
+		ManifestOnly: true,
+	})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "same repository")
+
+	// Re-annotate and convert to Docker media types in place
+	cp, err := New(Opt{
+		WorkDir:        workDir,
+		Source:         host + "/app:latest",
+		Target:         host + "/app:latest",
+		SourceInsecure: true,
+		TargetInsecure: true,
+		ManifestOnly:   true,
+		Annotations: map[string]string{
+			"org.opencontainers.image.base.name": "docker.io/library/nginx:latest",
+		},
+		Format: FormatDocker,
+	})
+	require.Nil(t, err)
+	require.Nil(t, cp.Copy(context.Background()))
+	assert.Equal(t, 0, registry.uploads)
+
+	data := registry.manifests["app/manifests/latest"]
+	assert.Equal(t, images.MediaTypeDockerSchema2Manifest, registry.types[digest.FromBytes(data).String()])
+	manifest := registry.getManifest(t, "app/manifests/latest")
+	assert.Equal(t, "docker.io/library/nginx:latest", manifest.Annotations["org.opencontainers.image.base.name"])
+	assert.Equal(t, images.MediaTypeDockerSchema2Config, manifest.Config.MediaType)
+	require.Len(t, manifest.Layers, 3)
+	assert.Equal(t, utils.MediaTypeNydusBlob, manifest.Layers[0].MediaType)
+	assert.Equal(t, images.MediaTypeDockerSchema2LayerGzip, manifest.Layers[2].MediaType)
+	assert.Equal(t, source.Layers[2].Digest, manifest.Layers[2].Digest)
+
+	// Relocate blobs to object storage without copying config and bootstrap
+	cp, err = New(Opt{
+		WorkDir:        workDir,
+		Source:         host + "/app:latest",
+		Target:         host + "/app:s3",
+		SourceInsecure: true,
+		TargetInsecure: true,
+		ManifestOnly:   true,
+		Annotations: map[string]string{
+			"org.opencontainers.image.base.name": "",
+		},
+		BackendType: "s3",
+		BackendConfig: fmt.Sprintf(`{
+			"scheme": "http",
+			"endpoint": "%s",
+			"bucket_name": "bucket",
+			"access_key_id": "ak",
+			"access_key_secret": "sk"
+		}`, strings.TrimPrefix(s3Server.URL, "http://")),
+		Format: FormatOCI,
+	})
+	require.Nil(t, err)
+	require.Nil(t, cp.Copy(context.Background()))
+	assert.Equal(t, 0, registry.uploads)
+	assert.Equal(t, []byte("blob1"), objects.objects["/bucket/"+blobIDs[0]])
+	assert.Equal(t, []byte("blob2"), objects.objects["/bucket/"+blobIDs[1]])
+
+	manifest = registry.getManifest(t, "app/manifests/s3")
+	assert.Nil(t, manifest.Annotations)
+	assert.Equal(t, ocispec.MediaTypeImageConfig, manifest.Config.MediaType)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, ocispec.MediaTypeImageLayerGzip, manifest.Layers[0].MediaType)
+	assert.Equal(t, "s3", manifest.Layers[0].Annotations[utils.LayerAnnotationNydusBackendType])
+}
+
+// fakeS3 is a minimal in-memory server of S3 object API.
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		s.objects[r.URL.Path] = data
+	case http.MethodHead, http.MethodGet:
+		data, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
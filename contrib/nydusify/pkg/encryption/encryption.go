@@ -0,0 +1,288 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package encryption encrypts image layers in the format defined by
+// ocicrypt (https://github.com/containers/ocicrypt), so that the layers
+// can be decrypted by the ocicrypt compatible tools, e.g. imgcrypt of
+// containerd. The layer is encrypted by AES_256_CTR_HMAC_SHA256 cipher
+// with a random symmetric key, the key is wrapped for each recipient by
+// JWE (RSA-OAEP, A256GCM) and recorded in layer annotations.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// The annotations defined by ocicrypt
+	AnnotationKeysJWE = "org.opencontainers.image.enc.keys.jwe"
+	AnnotationPubOpts = "org.opencontainers.image.enc.pubopts"
+
+	// MediaTypeSuffix is appended to the media type of encrypted layer
+	MediaTypeSuffix = "+encrypted"
+
+	cipherAESCTR  = "AES_256_CTR_HMAC_SHA256"
+	recipientJWE  = "jwe:"
+	symKeySize    = 32
+	ctrNonceSize  = aes.BlockSize
+	jweAlgorithm  = "RSA-OAEP"
+	jweEncryption = "A256GCM"
+)
+
+// publicOptions is the PublicLayerBlockCipherOptions of ocicrypt, it's
+// recorded in layer annotation without encryption.
+type publicOptions struct {
+	Cipher        string            `json:"cipher"`
+	Hmac          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// privateOptions is the PrivateLayerBlockCipherOptions of ocicrypt, it's
+// wrapped for each recipient.
+type privateOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        digest.Digest     `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// Encrypter encrypts layers for a set of recipients.
+type Encrypter struct {
+	recipients []*rsa.PublicKey
+}
+
+// New creates Encrypter instance, the recipient is in the form of
+// `jwe:<path of public key in PEM>`, the same as ocicrypt.
+func New(recipients []string) (*Encrypter, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("No encryption recipient specified")
+	}
+	keys := []*rsa.PublicKey{}
+	for _, recipient := range recipients {
+		if !strings.HasPrefix(recipient, recipientJWE) {
+			return nil, fmt.Errorf("Unsupported encryption recipient %s, only %s is supported", recipient, recipientJWE)
+		}
+		path := strings.TrimPrefix(recipient, recipientJWE)
+		pemBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "Read public key")
+		}
+		key, err := parsePublicKey(pemBytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Parse public key %s", path)
+		}
+		keys = append(keys, key)
+	}
+	return &Encrypter{recipients: keys}, nil
+}
+
+// parsePublicKey parses the RSA public key in PKIX or PKCS#1 PEM, or the
+// certificate in PEM.
+func parsePublicKey(pemBytes []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("Invalid PEM")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported public key type %T, only RSA is supported", key)
+	}
+	return rsaKey, nil
+}
+
+func base64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// wrapKeys wraps the private options for all recipients into a JWE
+// message in JSON serialization, in the same form as go-jose (used by
+// ocicrypt), the per-recipient header is merged into protected header
+// if there is only one recipient.
+func (enc *Encrypter) wrapKeys(plaintext []byte) ([]byte, error) {
+	cek := make([]byte, symKeySize)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+
+	type recipient struct {
+		Header       map[string]string `json:"header,omitempty"`
+		EncryptedKey string            `json:"encrypted_key,omitempty"`
+	}
+	recipients := []recipient{}
+	for _, key := range enc.recipients {
+		encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, cek, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "Encrypt content encryption key")
+		}
+		recipients = append(recipients, recipient{
+			Header:       map[string]string{"alg": jweAlgorithm},
+			EncryptedKey: base64URL(encryptedKey),
+		})
+	}
+
+	protected := map[string]string{"enc": jweEncryption}
+	if len(recipients) == 1 {
+		protected["alg"] = jweAlgorithm
+	}
+	protectedBytes, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	encodedProtected := base64URL(protectedBytes)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(encodedProtected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	message := struct {
+		Protected    string      `json:"protected"`
+		Recipients   []recipient `json:"recipients,omitempty"`
+		EncryptedKey string      `json:"encrypted_key,omitempty"`
+		IV           string      `json:"iv"`
+		Ciphertext   string      `json:"ciphertext"`
+		Tag          string      `json:"tag"`
+	}{
+		Protected:  encodedProtected,
+		IV:         base64URL(iv),
+		Ciphertext: base64URL(ciphertext),
+		Tag:        base64URL(tag),
+	}
+	if len(recipients) == 1 {
+		message.EncryptedKey = recipients[0].EncryptedKey
+	} else {
+		message.Recipients = recipients
+	}
+
+	return json.Marshal(message)
+}
+
+// Encrypt encrypts the layer data from reader to writer, desc is the
+// descriptor of unencrypted layer, returns the descriptor of encrypted
+// layer, the annotations of desc are kept.
+func (enc *Encrypter) Encrypt(reader io.Reader, writer io.Writer, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	symKey := make([]byte, symKeySize)
+	nonce := make([]byte, ctrNonceSize)
+	if _, err := rand.Read(symKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, err
+	}
+	stream := cipher.NewCTR(block, nonce)
+	mac := hmac.New(sha256.New, symKey)
+	digester := digest.Canonical.Digester()
+
+	// HMAC and digest are calculated on the encrypted data
+	size, err := io.Copy(io.MultiWriter(writer, mac, digester.Hash()), &cipher.StreamReader{S: stream, R: reader})
+	if err != nil {
+		return nil, errors.Wrap(err, "Encrypt layer")
+	}
+	if desc.Size > 0 && size != desc.Size {
+		return nil, fmt.Errorf("Unexpected layer size %d, expected %d", size, desc.Size)
+	}
+
+	privateBytes, err := json.Marshal(privateOptions{
+		SymmetricKey:  symKey,
+		Digest:        desc.Digest,
+		CipherOptions: map[string][]byte{"nonce": nonce},
+	})
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := enc.wrapKeys(privateBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Wrap layer key")
+	}
+	publicBytes, err := json.Marshal(publicOptions{
+		Cipher:        cipherAESCTR,
+		Hmac:          mac.Sum(nil),
+		CipherOptions: map[string][]byte{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{}
+	for key, value := range desc.Annotations {
+		annotations[key] = value
+	}
+	annotations[AnnotationKeysJWE] = base64.StdEncoding.EncodeToString(wrapped)
+	annotations[AnnotationPubOpts] = base64.StdEncoding.EncodeToString(publicBytes)
+
+	return &ocispec.Descriptor{
+		MediaType:   desc.MediaType + MediaTypeSuffix,
+		Digest:      digester.Digest(),
+		Size:        size,
+		Annotations: annotations,
+	}, nil
+}
+
+// EncryptFile encrypts the layer file src to dst, see Encrypt.
+func (enc *Encrypter) EncryptFile(src, dst string, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer dstFile.Close()
+
+	return enc.Encrypt(srcFile, dstFile, desc)
+}
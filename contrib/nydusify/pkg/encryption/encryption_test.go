@@ -0,0 +1,180 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decrypt decrypts the layer in the way of ocicrypt with the private key
+// of the recipient at index idx, it's verified against the layer encrypted
+// by ocicrypt in TestDecryptOcicryptLayer.
+func decrypt(t *testing.T, key *rsa.PrivateKey, idx int, data []byte, desc ocispec.Descriptor) ([]byte, privateOptions) {
+	wrapped, err := base64.StdEncoding.DecodeString(desc.Annotations[AnnotationKeysJWE])
+	require.Nil(t, err)
+	var message struct {
+		Protected  string `json:"protected"`
+		Recipients []struct {
+			Header       map[string]string `json:"header"`
+			EncryptedKey string            `json:"encrypted_key"`
+		} `json:"recipients"`
+		EncryptedKey string `json:"encrypted_key"`
+		IV           string `json:"iv"`
+		Ciphertext   string `json:"ciphertext"`
+		Tag          string `json:"tag"`
+	}
+	require.Nil(t, json.Unmarshal(wrapped, &message))
+
+	protectedBytes, err := base64.RawURLEncoding.DecodeString(message.Protected)
+	require.Nil(t, err)
+	protected := map[string]string{}
+	require.Nil(t, json.Unmarshal(protectedBytes, &protected))
+	assert.Equal(t, jweEncryption, protected["enc"])
+
+	encodedKey := message.EncryptedKey
+	if len(message.Recipients) > 0 {
+		assert.Equal(t, jweAlgorithm, message.Recipients[idx].Header["alg"])
+		encodedKey = message.Recipients[idx].EncryptedKey
+	} else {
+		assert.Equal(t, jweAlgorithm, protected["alg"])
+	}
+	encryptedKey, err := base64.RawURLEncoding.DecodeString(encodedKey)
+	require.Nil(t, err)
+	cek, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, encryptedKey, nil)
+	require.Nil(t, err)
+
+	iv, _ := base64.RawURLEncoding.DecodeString(message.IV)
+	ciphertext, _ := base64.RawURLEncoding.DecodeString(message.Ciphertext)
+	tag, _ := base64.RawURLEncoding.DecodeString(message.Tag)
+	block, err := aes.NewCipher(cek)
+	require.Nil(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.Nil(t, err)
+	privateBytes, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(message.Protected))
+	require.Nil(t, err)
+	var private privateOptions
+	require.Nil(t, json.Unmarshal(privateBytes, &private))
+
+	publicBytes, err := base64.StdEncoding.DecodeString(desc.Annotations[AnnotationPubOpts])
+	require.Nil(t, err)
+	var public publicOptions
+	require.Nil(t, json.Unmarshal(publicBytes, &public))
+	assert.Equal(t, cipherAESCTR, public.Cipher)
+	mac := hmac.New(sha256.New, private.SymmetricKey)
+	mac.Write(data)
+	assert.Equal(t, public.Hmac, mac.Sum(nil))
+
+	block, err = aes.NewCipher(private.SymmetricKey)
+	require.Nil(t, err)
+	plaintext := make([]byte, len(data))
+	cipher.NewCTR(block, private.CipherOptions["nonce"]).XORKeyStream(plaintext, data)
+
+	return plaintext, private
+}
+
+func writePublicKey(t *testing.T, dir, name string, key *rsa.PrivateKey, pkcs1 bool) string {
+	var block *pem.Block
+	if pkcs1 {
+		block = &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)}
+	} else {
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.Nil(t, err)
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	}
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(block), 0644))
+	return path
+}
+
+func TestEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-encryption-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	pub1 := writePublicKey(t, dir, "pub1.pem", key1, false)
+	pub2 := writePublicKey(t, dir, "pub2.pem", key2, true)
+
+	_, err = New(nil)
+	assert.NotNil(t, err)
+	_, err = New([]string{"pgp:someone@example.com"})
+	assert.NotNil(t, err)
+
+	data := bytes.Repeat([]byte("nydus blob"), 1000)
+	desc := ocispec.Descriptor{
+		MediaType:   "application/vnd.oci.image.layer.nydus.blob.v1",
+		Digest:      digest.FromBytes(data),
+		Size:        int64(len(data)),
+		Annotations: map[string]string{"containerd.io/snapshot/nydus-blob": "true"},
+	}
+
+	for _, recipients := range [][]string{{"jwe:" + pub1}, {"jwe:" + pub1, "jwe:" + pub2}} {
+		enc, err := New(recipients)
+		require.Nil(t, err)
+
+		encrypted := bytes.NewBuffer(nil)
+		encDesc, err := enc.Encrypt(bytes.NewReader(data), encrypted, desc)
+		require.Nil(t, err)
+		assert.Equal(t, desc.MediaType+MediaTypeSuffix, encDesc.MediaType)
+		assert.Equal(t, digest.FromBytes(encrypted.Bytes()), encDesc.Digest)
+		assert.Equal(t, desc.Size, encDesc.Size)
+		assert.Equal(t, "true", encDesc.Annotations["containerd.io/snapshot/nydus-blob"])
+		assert.NotEqual(t, data, encrypted.Bytes())
+
+		for idx, key := range []*rsa.PrivateKey{key1, key2}[:len(recipients)] {
+			plaintext, private := decrypt(t, key, idx, encrypted.Bytes(), *encDesc)
+			assert.Equal(t, data, plaintext)
+			assert.Equal(t, desc.Digest, private.Digest)
+		}
+	}
+}
+
+// TestDecryptOcicryptLayer decrypts the layer in testdata, which was
+// encrypted by ocicrypt v1.2.1 (AES_256_CTR_HMAC_SHA256 block cipher and
+// JWE key wrapper with go-jose) for the key in testdata/key.pem, so that
+// the layers verified by decrypt are compatible with ocicrypt.
+func TestDecryptOcicryptLayer(t *testing.T) {
+	pemBytes, err := ioutil.ReadFile("testdata/key.pem")
+	require.Nil(t, err)
+	block, _ := pem.Decode(pemBytes)
+	require.NotNil(t, block)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.Nil(t, err)
+
+	data, err := ioutil.ReadFile("testdata/layer.encrypted")
+	require.Nil(t, err)
+	descBytes, err := ioutil.ReadFile("testdata/layer.json")
+	require.Nil(t, err)
+	var desc ocispec.Descriptor
+	require.Nil(t, json.Unmarshal(descBytes, &desc))
+	assert.Equal(t, digest.FromBytes(data), desc.Digest)
+
+	plaintext, private := decrypt(t, key.(*rsa.PrivateKey), 0, data, desc)
+	assert.Equal(t, bytes.Repeat([]byte("nydus ocicrypt interop\n"), 100), plaintext)
+	assert.Equal(t, digest.FromBytes(plaintext), private.Digest)
+}
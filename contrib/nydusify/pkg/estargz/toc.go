@@ -0,0 +1,159 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package estargz writes eStargz layers, the gzip compressed tar layers
+// compatible with OCI image spec, in which every file can be fetched
+// lazily by the offset recorded in the TOC (table of contents) at the end
+// of layer, see https://github.com/containerd/stargz-snapshotter.
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TOCTarName is the name of the TOC entry in the last gzip member
+	// before footer.
+	TOCTarName = "stargz.index.json"
+	// FooterSize is the size of the footer, an empty gzip member with
+	// the offset of TOC in the extra field of gzip header.
+	FooterSize = 51
+
+	// PrefetchLandmark is the file separating the prioritized files from
+	// the others, the files before it are prefetched by the snapshotter.
+	PrefetchLandmark = ".prefetch.landmark"
+	// NoPrefetchLandmark is put at the beginning of layer if there isn't
+	// any prioritized file.
+	NoPrefetchLandmark = ".no.prefetch.landmark"
+	landmarkContents   = 0xf
+
+	// TOCDigestAnnotation is the layer annotation of the TOC digest, used
+	// by the snapshotter to verify the TOC.
+	TOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+	// UncompressedSizeAnnotation is the layer annotation of the size of
+	// the decompressed layer.
+	UncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+)
+
+// TOC is the table of contents of eStargz layer.
+type TOC struct {
+	Version int         `json:"version"`
+	Entries []*TOCEntry `json:"entries"`
+}
+
+// TOCEntry is an entry in TOC, a regular file larger than the chunk size
+// has multiple entries, the first one in type `reg` and the rest in type
+// `chunk`, each of them starts a gzip member at Offset.
+type TOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+// footerBytes returns the footer pointing to the TOC at tocOffset, it's
+// an empty gzip member with the `SG` subfield in extra field. The member
+// is assembled by hand since the size of the empty deflate block written
+// by compress/flate isn't guaranteed.
+func footerBytes(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	buf := bytes.NewBuffer(make([]byte, 0, FooterSize))
+	// Magic, deflate method, FEXTRA flag, zero mtime, XFL and unknown OS
+	buf.Write([]byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff})
+	binary.Write(buf, binary.LittleEndian, uint16(4+len(subfield)))
+	buf.Write([]byte{'S', 'G'})
+	binary.Write(buf, binary.LittleEndian, uint16(len(subfield)))
+	buf.WriteString(subfield)
+	// Final stored block without data, then zero CRC32 and ISIZE
+	buf.Write([]byte{1, 0, 0, 0xff, 0xff})
+	buf.Write(make([]byte, 8))
+	return buf.Bytes()
+}
+
+// ParseFooter returns the offset of TOC from the footer.
+func ParseFooter(footer []byte) (int64, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		return 0, errors.Wrap(err, "Read footer")
+	}
+	extra := gz.Header.Extra
+	if len(extra) != 4+16+len("STARGZ") || string(extra[:2]) != "SG" ||
+		int(binary.LittleEndian.Uint16(extra[2:4])) != len(extra)-4 ||
+		string(extra[4+16:]) != "STARGZ" {
+		return 0, errors.New("Invalid eStargz footer")
+	}
+	tocOffset, err := strconv.ParseInt(string(extra[4:4+16]), 16, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Parse TOC offset")
+	}
+	return tocOffset, nil
+}
+
+// ReadTOC reads the TOC from eStargz layer by the footer, returns the TOC
+// and the digest of TOC JSON.
+func ReadTOC(ra io.ReaderAt, size int64) (*TOC, digest.Digest, error) {
+	if size < FooterSize {
+		return nil, "", fmt.Errorf("Layer size %d is smaller than footer", size)
+	}
+	footer := make([]byte, FooterSize)
+	if _, err := ra.ReadAt(footer, size-FooterSize); err != nil {
+		return nil, "", errors.Wrap(err, "Read footer")
+	}
+	tocOffset, err := ParseFooter(footer)
+	if err != nil {
+		return nil, "", err
+	}
+	if tocOffset < 0 || tocOffset > size-FooterSize {
+		return nil, "", fmt.Errorf("Invalid TOC offset %d", tocOffset)
+	}
+
+	gz, err := gzip.NewReader(io.NewSectionReader(ra, tocOffset, size-FooterSize-tocOffset))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Read TOC")
+	}
+	tr := tar.NewReader(gz)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Read TOC")
+	}
+	if header.Name != TOCTarName {
+		return nil, "", fmt.Errorf("Unexpected TOC entry %s", header.Name)
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Read TOC")
+	}
+
+	var toc TOC
+	if err := json.Unmarshal(data, &toc); err != nil {
+		return nil, "", errors.Wrap(err, "Unmarshal TOC")
+	}
+
+	return &toc, digest.FromBytes(data), nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package estargz
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// DefaultChunkSize is the max size of file contents in a gzip member,
+// the larger file is split into chunks.
+const DefaultChunkSize = 4 << 20
+
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// Result is the metadata of written eStargz layer.
+type Result struct {
+	// TOCDigest is the digest of TOC JSON.
+	TOCDigest digest.Digest
+	// DiffID is the digest of decompressed layer.
+	DiffID digest.Digest
+	// UncompressedSize is the size of decompressed layer.
+	UncompressedSize int64
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Writer writes tar entries into eStargz layer, every regular file chunk
+// is compressed in a separate gzip member, so that it can be decompressed
+// independently from the offset in TOC.
+type Writer struct {
+	// ChunkSize is the max size of file contents in a gzip member.
+	ChunkSize int64
+
+	cw           *countWriter
+	gz           *gzip.Writer
+	diffID       digest.Digester
+	uncompressed int64
+	toc          TOC
+}
+
+// NewWriter creates eStargz writer, the layer isn't completed until
+// Close is called.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		ChunkSize: DefaultChunkSize,
+		cw:        &countWriter{w: w},
+		diffID:    digest.Canonical.Digester(),
+		toc:       TOC{Version: 1},
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// write writes decompressed data into current gzip member, the tar writer
+// of each entry writes through it.
+func (w *Writer) write(p []byte) (int, error) {
+	if w.gz == nil {
+		gz, err := gzip.NewWriterLevel(w.cw, gzip.DefaultCompression)
+		if err != nil {
+			return 0, err
+		}
+		w.gz = gz
+	}
+	n, err := w.gz.Write(p)
+	w.diffID.Hash().Write(p[:n])
+	w.uncompressed += int64(n)
+	return n, err
+}
+
+// closeGzip ends current gzip member, the next write starts a new one.
+func (w *Writer) closeGzip() error {
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz = nil
+	return err
+}
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Append appends a tar entry to layer, the contents of regular file are
+// read from reader.
+func (w *Writer) Append(header *tar.Header, reader io.Reader) error {
+	entry := &TOCEntry{
+		Name:  cleanEntryName(header.Name),
+		Mode:  header.Mode,
+		UID:   header.Uid,
+		GID:   header.Gid,
+		Uname: header.Uname,
+		Gname: header.Gname,
+	}
+	if !header.ModTime.IsZero() {
+		entry.ModTime3339 = header.ModTime.UTC().Round(time.Second).Format(time.RFC3339)
+	}
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, xattrPAXPrefix) {
+			if entry.Xattrs == nil {
+				entry.Xattrs = make(map[string][]byte)
+			}
+			entry.Xattrs[strings.TrimPrefix(key, xattrPAXPrefix)] = []byte(value)
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg:
+		entry.Type = "reg"
+		entry.Size = header.Size
+	case tar.TypeDir:
+		entry.Type = "dir"
+	case tar.TypeSymlink:
+		entry.Type = "symlink"
+		entry.LinkName = header.Linkname
+	case tar.TypeLink:
+		entry.Type = "hardlink"
+		entry.LinkName = cleanEntryName(header.Linkname)
+	case tar.TypeChar, tar.TypeBlock:
+		entry.Type = "char"
+		if header.Typeflag == tar.TypeBlock {
+			entry.Type = "block"
+		}
+		entry.DevMajor = int(header.Devmajor)
+		entry.DevMinor = int(header.Devminor)
+	case tar.TypeFifo:
+		entry.Type = "fifo"
+	default:
+		return fmt.Errorf("Unsupported tar entry type %q of %s", header.Typeflag, header.Name)
+	}
+
+	tw := tar.NewWriter(writerFunc(w.write))
+	if err := tw.WriteHeader(header); err != nil {
+		return errors.Wrapf(err, "Write tar header of %s", header.Name)
+	}
+	if header.Typeflag != tar.TypeReg {
+		w.toc.Entries = append(w.toc.Entries, entry)
+		return tw.Flush()
+	}
+
+	// Every chunk starts a new gzip member, the offset of the member is
+	// recorded for fetching the chunk independently
+	payloadDigester := digest.Canonical.Digester()
+	reader = io.TeeReader(reader, payloadDigester.Hash())
+	regEntry := entry
+	var written int64
+	for written < header.Size {
+		if err := w.closeGzip(); err != nil {
+			return err
+		}
+		chunkSize := w.ChunkSize
+		if remain := header.Size - written; remain < chunkSize {
+			chunkSize = remain
+		} else {
+			entry.ChunkSize = chunkSize
+		}
+		entry.Offset = w.cw.n
+		entry.ChunkOffset = written
+		chunkDigester := digest.Canonical.Digester()
+		if _, err := io.CopyN(tw, io.TeeReader(reader, chunkDigester.Hash()), chunkSize); err != nil {
+			return errors.Wrapf(err, "Write contents of %s", header.Name)
+		}
+		entry.ChunkDigest = chunkDigester.Digest().String()
+		w.toc.Entries = append(w.toc.Entries, entry)
+		written += chunkSize
+		entry = &TOCEntry{
+			Name: regEntry.Name,
+			Type: "chunk",
+		}
+	}
+	if header.Size == 0 {
+		w.toc.Entries = append(w.toc.Entries, entry)
+	}
+	regEntry.Digest = payloadDigester.Digest().String()
+
+	return tw.Flush()
+}
+
+// AppendLandmark appends the landmark file, PrefetchLandmark after the
+// prioritized files or NoPrefetchLandmark at the beginning of layer.
+func (w *Writer) AppendLandmark(prefetch bool) error {
+	name := NoPrefetchLandmark
+	if prefetch {
+		name = PrefetchLandmark
+	}
+	contents := []byte{landmarkContents}
+	return w.Append(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+	}, strings.NewReader(string(contents)))
+}
+
+// Close writes the TOC and footer, completes the layer.
+func (w *Writer) Close() (*Result, error) {
+	if err := w.closeGzip(); err != nil {
+		return nil, err
+	}
+
+	tocJSON, err := json.MarshalIndent(w.toc, "", "\t")
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal TOC")
+	}
+	tocOffset := w.cw.n
+	tw := tar.NewWriter(writerFunc(w.write))
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return nil, errors.Wrap(err, "Write TOC header")
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return nil, errors.Wrap(err, "Write TOC")
+	}
+	// Terminate the decompressed tar stream
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "Close tar stream")
+	}
+	if err := w.closeGzip(); err != nil {
+		return nil, err
+	}
+
+	if _, err := w.cw.Write(footerBytes(tocOffset)); err != nil {
+		return nil, errors.Wrap(err, "Write footer")
+	}
+
+	return &Result{
+		TOCDigest:        digest.FromBytes(tocJSON),
+		DiffID:           w.diffID.Digest(),
+		UncompressedSize: w.uncompressed,
+	}, nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	large := strings.Repeat("0123456789", 10)
+	buf := bytes.NewBuffer(nil)
+	w := NewWriter(buf)
+	w.ChunkSize = 32
+
+	require.Nil(t, w.Append(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755}, nil))
+	require.Nil(t, w.Append(&tar.Header{
+		Typeflag: tar.TypeReg, Name: "etc/large", Mode: 0644, Size: int64(len(large)),
+	}, strings.NewReader(large)))
+	require.Nil(t, w.AppendLandmark(true))
+	require.Nil(t, w.Append(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.empty"}, nil))
+	require.Nil(t, w.Append(&tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/link", Linkname: "large"}, nil))
+	require.Nil(t, w.Append(&tar.Header{Typeflag: tar.TypeLink, Name: "etc/hardlink", Linkname: "./etc/large"}, nil))
+	result, err := w.Close()
+	require.Nil(t, err)
+
+	blob := buf.Bytes()
+	toc, tocDigest, err := ReadTOC(bytes.NewReader(blob), int64(len(blob)))
+	require.Nil(t, err)
+	assert.Equal(t, result.TOCDigest, tocDigest)
+
+	names := []string{}
+	for _, entry := range toc.Entries {
+		names = append(names, entry.Type+":"+entry.Name)
+	}
+	assert.Equal(t, []string{
+		"dir:etc", "reg:etc/large", "chunk:etc/large", "chunk:etc/large", "chunk:etc/large",
+		"reg:" + PrefetchLandmark, "reg:etc/.wh.empty", "symlink:etc/link", "hardlink:etc/hardlink",
+	}, names)
+	assert.Equal(t, digest.FromString(large).String(), toc.Entries[1].Digest)
+	assert.Equal(t, "etc/large", toc.Entries[8].LinkName)
+
+	// Every chunk can be decompressed from its own offset
+	var contents string
+	for _, entry := range toc.Entries[1:5] {
+		gz, err := gzip.NewReader(bytes.NewReader(blob[entry.Offset:]))
+		require.Nil(t, err)
+		gz.Multistream(false)
+		size := entry.ChunkSize
+		if size == 0 {
+			size = int64(len(large)) - entry.ChunkOffset
+		}
+		chunk := make([]byte, size)
+		_, err = io.ReadFull(gz, chunk)
+		require.Nil(t, err)
+		assert.Equal(t, entry.ChunkDigest, digest.FromBytes(chunk).String())
+		contents += string(chunk)
+	}
+	assert.Equal(t, large, contents)
+
+	// The decompressed layer is a valid tar stream
+	gz, err := gzip.NewReader(bytes.NewReader(blob))
+	require.Nil(t, err)
+	decompressed, err := ioutil.ReadAll(gz)
+	require.Nil(t, err)
+	assert.Equal(t, result.DiffID, digest.FromBytes(decompressed))
+	assert.Equal(t, result.UncompressedSize, int64(len(decompressed)))
+	tr := tar.NewReader(bytes.NewReader(decompressed))
+	var last string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		if header.Name == "etc/large" {
+			data, err := ioutil.ReadAll(tr)
+			require.Nil(t, err)
+			assert.Equal(t, large, string(data))
+		}
+		last = header.Name
+	}
+	assert.Equal(t, TOCTarName, last)
+
+	assert.Equal(t, FooterSize, len(footerBytes(0)))
+	_, err = ParseFooter(make([]byte, FooterSize))
+	assert.NotNil(t, err)
+}
+
+// verifyChunks checks the layer in the way of the eStargz reader of
+// stargz-snapshotter: the TOC is located by footer and matches its digest,
+// and every chunk is a standalone gzip member ending at the next offset,
+// whose contents match the chunk digest.
+func verifyChunks(t *testing.T, blob []byte, tocDigest digest.Digest) {
+	tocOffset, err := ParseFooter(blob[len(blob)-FooterSize:])
+	require.Nil(t, err)
+	toc, dgst, err := ReadTOC(bytes.NewReader(blob), int64(len(blob)))
+	require.Nil(t, err)
+	require.Equal(t, tocDigest, dgst)
+	require.Equal(t, 1, toc.Version)
+
+	offsets := []int64{}
+	sizes := map[string]int64{}
+	for _, entry := range toc.Entries {
+		if entry.Type == "reg" {
+			sizes[entry.Name] = entry.Size
+		}
+		if entry.Offset > 0 {
+			offsets = append(offsets, entry.Offset)
+		}
+	}
+	offsets = append(offsets, tocOffset)
+
+	idx := 0
+	for _, entry := range toc.Entries {
+		if entry.Offset == 0 {
+			require.False(t, entry.Type == "chunk" || (entry.Type == "reg" && entry.Size > 0), entry.Name)
+			continue
+		}
+		section := blob[entry.Offset:offsets[idx+1]]
+		idx++
+		gz, err := gzip.NewReader(bytes.NewReader(section))
+		require.Nil(t, err)
+		gz.Multistream(false)
+		data, err := ioutil.ReadAll(gz)
+		require.Nil(t, err)
+		size := entry.ChunkSize
+		if size == 0 {
+			size = sizes[entry.Name] - entry.ChunkOffset
+		}
+		require.True(t, size <= int64(len(data)), entry.Name)
+		assert.Equal(t, entry.ChunkDigest, digest.FromBytes(data[:size]).String(), entry.Name)
+	}
+}
+
+func TestWriterVerify(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := NewWriter(buf)
+	w.ChunkSize = 16
+
+	files := map[string]string{
+		"bin/busybox": strings.Repeat("busybox", 20),
+		"etc/passwd":  "root:x:0:0:root:/root:/bin/sh\n",
+		"etc/empty":   "",
+	}
+	require.Nil(t, w.Append(&tar.Header{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0755}, nil))
+	require.Nil(t, w.Append(&tar.Header{
+		Typeflag: tar.TypeReg, Name: "bin/busybox", Mode: 0755, Size: int64(len(files["bin/busybox"])),
+	}, strings.NewReader(files["bin/busybox"])))
+	require.Nil(t, w.AppendLandmark(true))
+	require.Nil(t, w.Append(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755}, nil))
+	for _, name := range []string{"etc/passwd", "etc/empty"} {
+		require.Nil(t, w.Append(&tar.Header{
+			Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(files[name])),
+		}, strings.NewReader(files[name])))
+	}
+	require.Nil(t, w.Append(&tar.Header{Typeflag: tar.TypeSymlink, Name: "bin/sh", Linkname: "busybox"}, nil))
+	result, err := w.Close()
+	require.Nil(t, err)
+
+	verifyChunks(t, buf.Bytes(), result.TOCDigest)
+
+	// The file contents are assembled from chunks by TOC
+	toc, _, err := ReadTOC(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.Nil(t, err)
+	contents := map[string]string{}
+	for _, entry := range toc.Entries {
+		if entry.Offset == 0 {
+			continue
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(buf.Bytes()[entry.Offset:]))
+		require.Nil(t, err)
+		gz.Multistream(false)
+		size := entry.ChunkSize
+		if size == 0 {
+			size = int64(len(files[entry.Name])) - entry.ChunkOffset
+		}
+		if entry.Name == PrefetchLandmark {
+			size = 1
+		}
+		chunk := make([]byte, size)
+		_, err = io.ReadFull(gz, chunk)
+		require.Nil(t, err)
+		contents[entry.Name] += string(chunk)
+	}
+	assert.Equal(t, files["bin/busybox"], contents["bin/busybox"])
+	assert.Equal(t, files["etc/passwd"], contents["etc/passwd"])
+	assert.Equal(t, string([]byte{landmarkContents}), contents[PrefetchLandmark])
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package exporter adapts Nydus conversion to the exporter of BuildKit, so
+// that `docker buildx build --output type=nydus,name=<ref>` pushes Nydus
+// image directly from the layers in BuildKit snapshotter, without pushing
+// and pulling the OCI image for conversion. The exporter doesn't depend on
+// BuildKit, the glue in BuildKit mounts the immutable refs of built image
+// as provider.SnapshotLayer and calls Resolve and Export.
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+)
+
+// The attributes of `--output type=nydus,...`.
+const (
+	AttrName               = "name"
+	AttrPush               = "push"
+	AttrInsecure           = "registry.insecure"
+	AttrOCIMediaTypes      = "oci-mediatypes"
+	AttrCompression        = "compression"
+	AttrFsVersion          = "fs-version"
+	AttrChunkSize          = "chunk-size"
+	AttrPrefetchDir        = "prefetch-dir"
+	AttrBackendType        = "backend-type"
+	AttrBackendConfig      = "backend-config"
+	AttrBuildCache         = "build-cache"
+	AttrBuildCacheInsecure = "build-cache-insecure"
+)
+
+// The keys of export response, the same with the image exporter of
+// BuildKit, so that buildx prints the digest of pushed image.
+const (
+	ResponseImageName   = "image.name"
+	ResponseImageDigest = "containerimage.digest"
+)
+
+// Opt is the options of exporter shared by all exports.
+type Opt struct {
+	// WorkDir is the directory for the work directories of exports.
+	WorkDir        string
+	NydusImagePath string
+	Logger         provider.ProgressLogger
+}
+
+// Exporter exports the images built by BuildKit as Nydus images.
+type Exporter struct {
+	opt Opt
+}
+
+// Instance is an export resolved from the attributes of output.
+type Instance struct {
+	exporter *Exporter
+	target   string
+	opt      converter.ConvertOpt
+}
+
+// Image is the image built by BuildKit.
+type Image struct {
+	// Config is the image config in JSON, the diff ids in it should match
+	// the layers.
+	Config []byte
+	Layers []provider.SnapshotLayer
+}
+
+// New creates an exporter.
+func New(opt Opt) (*Exporter, error) {
+	if opt.WorkDir == "" {
+		return nil, errors.New("work directory is required")
+	}
+	if opt.Logger == nil {
+		logger, err := provider.DefaultLogger()
+		if err != nil {
+			return nil, err
+		}
+		opt.Logger = logger
+	}
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create work directory")
+	}
+	return &Exporter{opt: opt}, nil
+}
+
+func parseBool(attrs map[string]string, key string, defaultValue bool) (bool, error) {
+	value, ok := attrs[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	// The attribute without value is treated as true, e.g. `push`
+	if value == "" {
+		return true, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid %s", key)
+	}
+	return parsed, nil
+}
+
+// Resolve parses the attributes of output into an export, the unknown
+// attributes are rejected.
+func (exp *Exporter) Resolve(ctx context.Context, attrs map[string]string) (*Instance, error) {
+	instance := &Instance{
+		exporter: exp,
+		opt: converter.ConvertOpt{
+			Opt: converter.Opt{
+				Logger:         exp.opt.Logger,
+				NydusImagePath: exp.opt.NydusImagePath,
+				BackendType:    "registry",
+			},
+		},
+	}
+	opt := &instance.opt
+
+	var err error
+	for key, value := range attrs {
+		switch key {
+		case AttrName:
+			if strings.Contains(value, ",") {
+				return nil, fmt.Errorf("only one image name is supported: %s", value)
+			}
+			instance.target = value
+		case AttrPush:
+			// Nydus image is always pushed, the attribute is accepted for
+			// the compatibility with image exporter
+			push, err := parseBool(attrs, key, true)
+			if err != nil {
+				return nil, err
+			}
+			if !push {
+				return nil, fmt.Errorf("nydus image can't be exported without pushing")
+			}
+		case AttrInsecure:
+			if opt.TargetInsecure, err = parseBool(attrs, key, false); err != nil {
+				return nil, err
+			}
+		case AttrOCIMediaTypes:
+			oci, err := parseBool(attrs, key, true)
+			if err != nil {
+				return nil, err
+			}
+			opt.DockerV2Format = !oci
+		case AttrCompression:
+			opt.Compressor = value
+		case AttrFsVersion:
+			opt.FsVersion = value
+		case AttrChunkSize:
+			if opt.ChunkSize, err = strconv.ParseUint(value, 0, 64); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", key)
+			}
+		case AttrPrefetchDir:
+			opt.PrefetchDir = value
+		case AttrBackendType:
+			opt.BackendType = value
+		case AttrBackendConfig:
+			opt.BackendConfig = value
+		case AttrBuildCache:
+			opt.BuildCache = value
+		case AttrBuildCacheInsecure:
+			if opt.BuildCacheInsecure, err = parseBool(attrs, key, false); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown attribute %s", key)
+		}
+	}
+	if instance.target == "" {
+		return nil, fmt.Errorf("attribute %s is required", AttrName)
+	}
+
+	return instance, nil
+}
+
+// Name returns the name of export shown in build progress.
+func (instance *Instance) Name() string {
+	return "exporting to nydus image"
+}
+
+// Export converts the layers of image in snapshotter to Nydus image and
+// pushes it, returns the name and digest of Nydus image.
+func (instance *Instance) Export(ctx context.Context, image *Image) (map[string]string, error) {
+	var config ocispec.Image
+	if err := json.Unmarshal(image.Config, &config); err != nil {
+		return nil, errors.Wrap(err, "unmarshal image config")
+	}
+	sourceProvider, err := provider.SnapshotSource(nil, config, image.Layers)
+	if err != nil {
+		return nil, err
+	}
+
+	workDir, err := ioutil.TempDir(instance.exporter.opt.WorkDir, "export-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create work directory")
+	}
+	defer os.RemoveAll(workDir)
+
+	opt := instance.opt.Opt
+	opt.WorkDir = workDir
+	opt.SourceProviders = []provider.SourceProvider{sourceProvider}
+	if opt.TargetRemote, err = converter.NewTargetRemote(instance.target, instance.opt.TargetInsecure, workDir); err != nil {
+		return nil, errors.Wrap(err, "parse target reference")
+	}
+	if instance.opt.BuildCache != "" {
+		if opt.CacheBackend, err = converter.NewCacheBackend(instance.opt.BuildCache, instance.opt.BuildCacheInsecure); err != nil {
+			return nil, err
+		}
+		opt.CacheMaxRecords = converter.DefaultCacheMaxRecords
+		opt.CacheVersion = converter.DefaultCacheVersion
+	}
+
+	cvt, err := converter.New(opt)
+	if err != nil {
+		return nil, err
+	}
+	if err := cvt.Convert(ctx); err != nil {
+		return nil, err
+	}
+	if err := provider.ExportLocalTarget(ctx, instance.target, workDir); err != nil {
+		return nil, err
+	}
+
+	response := map[string]string{ResponseImageName: instance.target}
+	if desc := cvt.TargetManifest(); desc != nil {
+		response[ResponseImageDigest] = desc.Digest.String()
+	}
+	return response, nil
+}
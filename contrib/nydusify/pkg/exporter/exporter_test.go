@@ -0,0 +1,103 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+)
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-exporter-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	exp, err := New(Opt{WorkDir: dir, NydusImagePath: "/usr/bin/nydus-image"})
+	require.Nil(t, err)
+
+	instance, err := exp.Resolve(context.Background(), map[string]string{
+		AttrName:          "localhost:5000/app:nydus",
+		AttrPush:          "true",
+		AttrInsecure:      "",
+		AttrOCIMediaTypes: "false",
+		AttrCompression:   "zstd",
+		AttrFsVersion:     "6",
+		AttrChunkSize:     "0x100000",
+		AttrBuildCache:    "dir://" + dir + "/cache",
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "localhost:5000/app:nydus", instance.target)
+	assert.True(t, instance.opt.TargetInsecure)
+	assert.True(t, instance.opt.DockerV2Format)
+	assert.Equal(t, "zstd", instance.opt.Compressor)
+	assert.Equal(t, uint64(0x100000), instance.opt.ChunkSize)
+	assert.Equal(t, "registry", instance.opt.BackendType)
+	assert.Equal(t, "/usr/bin/nydus-image", instance.opt.NydusImagePath)
+
+	for _, attrs := range []map[string]string{
+		{},
+		{AttrName: "localhost:5000/app:nydus,localhost:5000/app:latest"},
+		{AttrName: "localhost:5000/app:nydus", "unpack": "true"},
+		{AttrName: "localhost:5000/app:nydus", AttrPush: "false"},
+		{AttrName: "localhost:5000/app:nydus", AttrInsecure: "maybe"},
+		{AttrName: "localhost:5000/app:nydus", AttrChunkSize: "1MB"},
+	} {
+		_, err := exp.Resolve(context.Background(), attrs)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestSnapshotSource(t *testing.T) {
+	diffIDs := []digest.Digest{digest.FromString("layer1"), digest.FromString("layer2")}
+	config, err := json.Marshal(ocispec.Image{RootFS: ocispec.RootFS{Type: "layers", DiffIDs: diffIDs}})
+	require.Nil(t, err)
+
+	mountFunc := func(ctx context.Context) ([]mount.Mount, func() error, error) {
+		return []mount.Mount{{Type: "bind", Source: "/snapshot"}}, func() error { return nil }, nil
+	}
+	layers := []provider.SnapshotLayer{
+		{DiffID: diffIDs[0], Size: 100, Mount: mountFunc},
+		{DiffID: diffIDs[1], Size: 200, Mount: mountFunc},
+	}
+
+	var image ocispec.Image
+	require.Nil(t, json.Unmarshal(config, &image))
+	sp, err := provider.SnapshotSource(nil, image, layers)
+	require.Nil(t, err)
+	sourceLayers, err := sp.Layers(context.Background())
+	require.Nil(t, err)
+	require.Len(t, sourceLayers, 2)
+	assert.Nil(t, sourceLayers[0].ParentChainID())
+	assert.Equal(t, diffIDs[0], sourceLayers[0].ChainID())
+	assert.Equal(t, sourceLayers[0].ChainID(), *sourceLayers[1].ParentChainID())
+	assert.Equal(t, int64(200), sourceLayers[1].Size())
+
+	// The layers should match the diff ids in config
+	_, err = provider.SnapshotSource(nil, image, layers[:1])
+	assert.NotNil(t, err)
+	_, err = provider.SnapshotSource(nil, image, []provider.SnapshotLayer{layers[1], layers[0]})
+	assert.NotNil(t, err)
+
+	dir, err := ioutil.TempDir("", "nydusify-exporter-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	exp, err := New(Opt{WorkDir: dir})
+	require.Nil(t, err)
+	instance, err := exp.Resolve(context.Background(), map[string]string{AttrName: "localhost:5000/app:nydus"})
+	require.Nil(t, err)
+	_, err = instance.Export(context.Background(), &Image{Config: config, Layers: layers[:1]})
+	assert.Contains(t, err.Error(), "Mismatched snapshot layers")
+}
@@ -0,0 +1,320 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package gc collects the orphan Nydus blobs in object storage backend,
+// the blobs referenced by the Nydus images in registry are enumerated by
+// registry catalog API, and the blobs not referenced by any image and
+// older than a grace period are deleted.
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/mirror"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Opt defines GC options.
+type Opt struct {
+	// TargetRegistry is the registry host storing the Nydus images whose
+	// blobs are in Backend, all images referencing the blobs in Backend
+	// must be in it, otherwise their blobs are collected.
+	TargetRegistry string
+	TargetInsecure bool
+	Backend        backend.Collector
+	// GracePeriod protects the blobs uploaded by running conversions, the
+	// blobs modified within it are never deleted.
+	GracePeriod time.Duration
+	// DryRun only reports the orphan blobs without deleting them.
+	DryRun bool
+}
+
+// Result is the result of garbage collection.
+type Result struct {
+	// Images is the count of Nydus manifests found in registry.
+	Images int
+	// Blobs is the count of blobs found in backend.
+	Blobs   int
+	Orphans []backend.BlobObject
+	// Deleted is the count of deleted orphan blobs.
+	Deleted int
+}
+
+// GC collects orphan blobs in storage backend.
+type GC struct {
+	Opt
+	catalog *mirror.Catalog
+}
+
+// New creates GC instance.
+func New(opt Opt) (*GC, error) {
+	if opt.Backend == nil {
+		return nil, fmt.Errorf("storage backend is required")
+	}
+	catalog, err := mirror.NewCatalog(
+		opt.TargetRegistry, opt.TargetInsecure, provider.NewRegistryClient(opt.TargetRegistry), provider.DefaultCredential,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &GC{
+		Opt:     opt,
+		catalog: catalog,
+	}, nil
+}
+
+// manifestBlobs returns the blob IDs referenced by Nydus manifest, ok is
+// false if the manifest isn't a Nydus manifest.
+func manifestBlobs(manifest *ocispec.Manifest) ([]string, bool, error) {
+	if _, ok := manifest.Annotations[utils.ManifestNydusCache]; ok {
+		return cacheBlobs(manifest), true, nil
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, false, nil
+	}
+	bootstrap := manifest.Layers[len(manifest.Layers)-1]
+	if bootstrap.Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+		return nil, false, nil
+	}
+
+	blobIDs := []string{}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == utils.MediaTypeNydusBlob {
+			blobIDs = append(blobIDs, layer.Digest.Hex())
+		}
+	}
+	// The blobs in object storage backend are only recorded in the blob
+	// list annotation, it's the same with the blob table of bootstrap
+	blobList, ok := bootstrap.Annotations[utils.LayerAnnotationNydusBlobIDs]
+	if !ok {
+		if len(blobIDs) == 0 {
+			return nil, true, fmt.Errorf("no blob list found in bootstrap layer")
+		}
+		return blobIDs, true, nil
+	}
+	var listed []string
+	if err := json.Unmarshal([]byte(blobList), &listed); err != nil {
+		return nil, true, errors.Wrap(err, "unmarshal blob list of bootstrap layer")
+	}
+	return append(blobIDs, listed...), true, nil
+}
+
+// cacheBlobs returns the blob IDs referenced by the records of build cache
+// manifest, the blob of record is a blob layer if it's in registry, or
+// recorded in the annotation of bootstrap layer if it's in object storage
+// backend.
+func cacheBlobs(manifest *ocispec.Manifest) []string {
+	blobIDs := []string{}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == utils.MediaTypeNydusBlob {
+			blobIDs = append(blobIDs, layer.Digest.Hex())
+			continue
+		}
+		if dgst := digest.Digest(layer.Annotations[utils.LayerAnnotationNydusBlobDigest]); dgst.Validate() == nil {
+			blobIDs = append(blobIDs, dgst.Hex())
+		}
+	}
+	return blobIDs
+}
+
+// walker collects the blobs referenced by the manifests in a repository.
+type walker struct {
+	catalog    *mirror.Catalog
+	repository string
+	referenced map[string]bool
+	// visited avoids walking the manifest listed in both referrers API
+	// and referrers tag twice
+	visited map[digest.Digest]bool
+}
+
+// walk collects the blobs referenced by the manifest or index of desc, and
+// its referrers, and returns the count of Nydus manifests found.
+func (w *walker) walk(ctx context.Context, target *remote.Remote, desc ocispec.Descriptor) (int, error) {
+	var value interface{}
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		value = &ocispec.Manifest{}
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		value = &ocispec.Index{}
+	default:
+		// The artifacts like signatures don't reference Nydus blobs
+		return 0, nil
+	}
+	if w.visited[desc.Digest] {
+		return 0, nil
+	}
+	w.visited[desc.Digest] = true
+
+	reader, err := target.Pull(ctx, desc, true)
+	if err != nil {
+		return 0, errors.Wrapf(err, "pull %s", desc.Digest)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, errors.Wrapf(err, "read %s", desc.Digest)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return 0, errors.Wrapf(err, "unmarshal %s", desc.Digest)
+	}
+
+	children := []ocispec.Descriptor{}
+	count := 0
+	switch value := value.(type) {
+	case *ocispec.Index:
+		// All platforms and the referrers listed in the referrers tag
+		// are walked
+		children = append(children, value.Manifests...)
+	case *ocispec.Manifest:
+		blobIDs, ok, err := manifestBlobs(value)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Nydus manifest %s", desc.Digest)
+		}
+		if ok {
+			for _, blobID := range blobIDs {
+				w.referenced[blobID] = true
+			}
+			count++
+		}
+		// The Nydus manifest pushed by digest is recorded in the
+		// annotation of source manifest by AnnotationAssembler
+		if dgst := digest.Digest(value.Annotations[utils.ManifestAnnotationNydusManifest]); dgst.Validate() == nil {
+			nydusDesc, err := w.resolve(ctx, target, dgst)
+			if err != nil {
+				return 0, err
+			}
+			children = append(children, *nydusDesc)
+		}
+	}
+
+	// The referrers pushed to the registry supporting referrers API, e.g.
+	// the Nydus manifests pushed by `--referrer`, aren't tagged
+	referrers, _, err := w.catalog.Referrers(ctx, w.repository, desc.Digest)
+	if err != nil {
+		return 0, err
+	}
+	children = append(children, referrers...)
+
+	for _, child := range children {
+		found, err := w.walk(ctx, target, child)
+		if err != nil {
+			return 0, err
+		}
+		count += found
+	}
+	return count, nil
+}
+
+// resolve resolves the descriptor of manifest dgst in repository of target.
+func (w *walker) resolve(ctx context.Context, target *remote.Remote, dgst digest.Digest) (*ocispec.Descriptor, error) {
+	ref := target.DigestReference(dgst)
+	digestRemote, err := remote.NewWithProvider(ref, target.Provider())
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse reference %s", ref)
+	}
+	desc, err := digestRemote.Resolve(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %s", ref)
+	}
+	return desc, nil
+}
+
+// references enumerates all images in registry, and returns the blobs
+// referenced by Nydus images. Any failure aborts the collection, since
+// the blobs of the images failed to read would be deleted otherwise.
+func (gc *GC) references(ctx context.Context) (map[string]bool, int, error) {
+	repositories, err := gc.catalog.Repositories(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	referenced := map[string]bool{}
+	count := 0
+	for _, repository := range repositories {
+		tags, err := gc.catalog.Tags(ctx, repository)
+		if err != nil {
+			return nil, 0, err
+		}
+		w := &walker{
+			catalog:    gc.catalog,
+			repository: repository,
+			referenced: referenced,
+			visited:    map[digest.Digest]bool{},
+		}
+		for _, tag := range tags {
+			ref := fmt.Sprintf("%s/%s:%s", gc.TargetRegistry, repository, tag)
+			target, err := provider.DefaultRemote(ref, gc.TargetInsecure)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "parse reference %s", ref)
+			}
+			desc, err := target.Resolve(ctx)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "resolve %s", ref)
+			}
+			found, err := w.walk(ctx, target, *desc)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "walk %s", ref)
+			}
+			count += found
+		}
+	}
+
+	return referenced, count, nil
+}
+
+// Run lists the blobs in backend, enumerates the blobs referenced by the
+// images in registry, and deletes the orphan blobs out of grace period.
+func (gc *GC) Run(ctx context.Context) (*Result, error) {
+	// The blobs are listed before enumerating images, so the blobs
+	// uploaded afterwards are never considered
+	start := time.Now()
+	blobs, err := gc.Backend.List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list blobs in backend")
+	}
+	logrus.Infof("Found %d blobs in backend", len(blobs))
+
+	referenced, count, err := gc.references(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "enumerate referenced blobs")
+	}
+	logrus.Infof("Found %d Nydus manifests referencing %d blobs", count, len(referenced))
+
+	result := &Result{
+		Images:  count,
+		Blobs:   len(blobs),
+		Orphans: []backend.BlobObject{},
+	}
+	deadline := start.Add(-gc.GracePeriod)
+	for _, blob := range blobs {
+		if referenced[blob.BlobID] || !blob.LastModified.Before(deadline) {
+			continue
+		}
+		result.Orphans = append(result.Orphans, blob)
+		if gc.DryRun {
+			logrus.Infof("Found orphan blob %s", blob.BlobID)
+			continue
+		}
+		if err := gc.Backend.Delete(ctx, blob.BlobID); err != nil {
+			return result, errors.Wrapf(err, "delete blob %s", blob.BlobID)
+		}
+		result.Deleted++
+		logrus.Infof("Deleted orphan blob %s", blob.BlobID)
+	}
+
+	return result, nil
+}
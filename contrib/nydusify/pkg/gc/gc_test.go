@@ -0,0 +1,311 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+type manifestObject struct {
+	mediaType string
+	data      []byte
+}
+
+// fakeRegistry serves catalog, tags and manifests of registry API.
+type fakeRegistry struct {
+	// repositories maps repository to tags and digests
+	repositories map[string]map[string]digest.Digest
+	manifests    map[digest.Digest]manifestObject
+	// referrers maps subject to the referrers, the referrers API isn't
+	// supported if it's nil
+	referrers map[digest.Digest][]ocispec.Descriptor
+}
+
+func (registry *fakeRegistry) add(repository, tag string, mediaType string, value interface{}) ocispec.Descriptor {
+	data, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	dgst := digest.FromBytes(data)
+	registry.manifests[dgst] = manifestObject{mediaType: mediaType, data: data}
+	if registry.repositories[repository] == nil {
+		registry.repositories[repository] = map[string]digest.Digest{}
+	}
+	if tag != "" {
+		registry.repositories[repository][tag] = dgst
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+func (registry *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case path == "_catalog":
+		repositories := []string{}
+		for repository := range registry.repositories {
+			repositories = append(repositories, repository)
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": repositories})
+	case strings.HasSuffix(path, "/tags/list"):
+		repository := strings.TrimSuffix(path, "/tags/list")
+		tags := []string{}
+		for tag := range registry.repositories[repository] {
+			tags = append(tags, tag)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+	case strings.Contains(path, "/referrers/") && registry.referrers != nil:
+		parts := strings.SplitN(path, "/referrers/", 2)
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		json.NewEncoder(w).Encode(ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Manifests: registry.referrers[digest.Digest(parts[1])],
+		})
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		dgst, ok := registry.repositories[parts[0]][parts[1]]
+		if !ok {
+			dgst = digest.Digest(parts[1])
+		}
+		manifest, ok := registry.manifests[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", manifest.mediaType)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifest.data)))
+		if r.Method == http.MethodGet {
+			w.Write(manifest.data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// fakeCollector is an in-memory object storage backend.
+type fakeCollector struct {
+	blobs map[string]backend.BlobObject
+}
+
+func (collector *fakeCollector) List(ctx context.Context) ([]backend.BlobObject, error) {
+	blobs := []backend.BlobObject{}
+	for _, blob := range collector.blobs {
+		blobs = append(blobs, blob)
+	}
+	return blobs, nil
+}
+
+func (collector *fakeCollector) Delete(ctx context.Context, blobID string) error {
+	delete(collector.blobs, blobID)
+	return nil
+}
+
+func nydusManifest(blobIDs ...string) ocispec.Manifest {
+	blobList, _ := json.Marshal(blobIDs)
+	return ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Layers: []ocispec.Descriptor{
+			{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromString("bootstrap"),
+				Annotations: map[string]string{
+					utils.LayerAnnotationNydusBootstrap: "true",
+					utils.LayerAnnotationNydusBlobIDs:   string(blobList),
+				},
+			},
+		},
+	}
+}
+
+func blobID(c string) string {
+	return strings.Repeat(c, 64)
+}
+
+func TestGC(t *testing.T) {
+	registry := &fakeRegistry{
+		repositories: map[string]map[string]digest.Digest{},
+		manifests:    map[digest.Digest]manifestObject{},
+	}
+
+	// OCI image isn't a Nydus image
+	oci := registry.add("app", "v1", ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Layers:    []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer")}},
+	})
+	// Nydus manifests of multiple platforms in index
+	amd64 := registry.add("app", "", ocispec.MediaTypeImageManifest, nydusManifest(blobID("a")))
+	arm64 := registry.add("app", "", ocispec.MediaTypeImageManifest, nydusManifest(blobID("b")))
+	registry.add("app", "v1-nydus", ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{amd64, arm64},
+	})
+	// Nydus manifest pushed as referrer, listed in referrers tag
+	referrer := registry.add("app", "", ocispec.MediaTypeImageManifest, nydusManifest(blobID("c")))
+	registry.add("app", "sha256-"+oci.Digest.Hex(), ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{referrer},
+	})
+	// Unknown artifact is skipped
+	registry.add("other", "sig", "application/vnd.unknown.artifact", map[string]string{})
+
+	ts := httptest.NewServer(registry)
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	old := time.Now().Add(-48 * time.Hour)
+	collector := &fakeCollector{blobs: map[string]backend.BlobObject{}}
+	for _, c := range []string{"a", "b", "c", "d"} {
+		collector.blobs[blobID(c)] = backend.BlobObject{BlobID: blobID(c), Size: 1, LastModified: old}
+	}
+	// The blob uploaded recently is protected by grace period
+	collector.blobs[blobID("e")] = backend.BlobObject{BlobID: blobID("e"), Size: 1, LastModified: time.Now()}
+
+	gc, err := New(Opt{
+		TargetRegistry: host,
+		Backend:        collector,
+		GracePeriod:    24 * time.Hour,
+		DryRun:         true,
+	})
+	require.Nil(t, err)
+
+	result, err := gc.Run(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, 3, result.Images)
+	assert.Equal(t, 5, result.Blobs)
+	require.Len(t, result.Orphans, 1)
+	assert.Equal(t, blobID("d"), result.Orphans[0].BlobID)
+	assert.Equal(t, 0, result.Deleted)
+	assert.Len(t, collector.blobs, 5)
+
+	gc.DryRun = false
+	result, err = gc.Run(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, 1, result.Deleted)
+	assert.Len(t, collector.blobs, 4)
+	_, ok := collector.blobs[blobID("d")]
+	assert.False(t, ok)
+
+	// Abort if a Nydus manifest can't be read
+	delete(registry.manifests, arm64.Digest)
+	_, err = gc.Run(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestGCReferrersAndCache(t *testing.T) {
+	registry := &fakeRegistry{
+		repositories: map[string]map[string]digest.Digest{},
+		manifests:    map[digest.Digest]manifestObject{},
+		referrers:    map[digest.Digest][]ocispec.Descriptor{},
+	}
+
+	// Nydus manifest pushed as referrer on the registry with referrers
+	// API isn't tagged
+	oci := registry.add("app", "v1", ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Layers:    []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer")}},
+	})
+	referrer := registry.add("app", "", ocispec.MediaTypeImageManifest, nydusManifest(blobID("a")))
+	registry.referrers[oci.Digest] = []ocispec.Descriptor{referrer}
+	// Nydus manifest pushed by digest is recorded in the annotation of
+	// source manifest
+	annotated := registry.add("app", "", ocispec.MediaTypeImageManifest, nydusManifest(blobID("b")))
+	registry.add("app", "v2", ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		Layers:      []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer")}},
+		Annotations: map[string]string{utils.ManifestAnnotationNydusManifest: annotated.Digest.String()},
+	})
+	// Build cache records the blobs in object storage backend by the
+	// annotation of bootstrap layers
+	cache := registry.add("app", "", ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Layers: []ocispec.Descriptor{
+			{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromString("bootstrap-c"),
+				Annotations: map[string]string{
+					utils.LayerAnnotationNydusBootstrap:  "true",
+					utils.LayerAnnotationNydusBlobDigest: digest.NewDigestFromEncoded(digest.SHA256, blobID("c")).String(),
+				},
+			},
+			{
+				MediaType:   ocispec.MediaTypeImageLayerGzip,
+				Digest:      digest.FromString("bootstrap-empty"),
+				Annotations: map[string]string{utils.LayerAnnotationNydusBootstrap: "true"},
+			},
+		},
+		Annotations: map[string]string{utils.ManifestNydusCache: "v1"},
+	})
+	registry.add("app", "nydus-build-cache", ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{cache},
+	})
+
+	ts := httptest.NewServer(registry)
+	defer ts.Close()
+
+	old := time.Now().Add(-48 * time.Hour)
+	collector := &fakeCollector{blobs: map[string]backend.BlobObject{}}
+	for _, c := range []string{"a", "b", "c", "d"} {
+		collector.blobs[blobID(c)] = backend.BlobObject{BlobID: blobID(c), Size: 1, LastModified: old}
+	}
+
+	gc, err := New(Opt{
+		TargetRegistry: strings.TrimPrefix(ts.URL, "http://"),
+		Backend:        collector,
+		GracePeriod:    24 * time.Hour,
+	})
+	require.Nil(t, err)
+
+	result, err := gc.Run(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, 3, result.Images)
+	require.Len(t, result.Orphans, 1)
+	assert.Equal(t, blobID("d"), result.Orphans[0].BlobID)
+	assert.Len(t, collector.blobs, 3)
+}
+
+func TestManifestBlobs(t *testing.T) {
+	manifest := nydusManifest(blobID("a"))
+	manifest.Layers = append([]ocispec.Descriptor{{
+		MediaType: utils.MediaTypeNydusBlob,
+		Digest:    digest.NewDigestFromEncoded(digest.SHA256, blobID("b")),
+	}}, manifest.Layers...)
+	blobIDs, ok, err := manifestBlobs(&manifest)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{blobID("b"), blobID("a")}, blobIDs)
+
+	delete(manifest.Layers[1].Annotations, utils.LayerAnnotationNydusBlobIDs)
+	blobIDs, ok, err = manifestBlobs(&manifest)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{blobID("b")}, blobIDs)
+
+	manifest.Layers = manifest.Layers[1:]
+	_, _, err = manifestBlobs(&manifest)
+	assert.Contains(t, err.Error(), "no blob list")
+
+	_, ok, err = manifestBlobs(&ocispec.Manifest{})
+	require.Nil(t, err)
+	assert.False(t, ok)
+}
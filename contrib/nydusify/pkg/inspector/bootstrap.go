@@ -0,0 +1,404 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package inspector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// The on disk layout of RAFS v5 bootstrap, see rafs/src/metadata/layout.rs
+const (
+	rafsSuperMagic     = 0x52414653
+	rafsSuperVersionV5 = 0x500
+	rafsSuperblockSize = 8192
+	rafsAlignment      = 8
+	rafsRootInode      = 1
+
+	extendedBlobEntrySize = 32
+
+	superFlagCompressNone = 0x01
+	superFlagDigestSHA256 = 0x08
+	superFlagCompressGzip = 0x40
+	inodeFlagXattr        = 0x04
+	chunkFlagHole         = 0x02
+	inodeModeTypeMask     = 0170000
+	inodeModeTypeRegular  = 0100000
+	maxPathDepth          = 4096
+)
+
+type ondiskSuperBlock struct {
+	Magic                    uint32
+	FsVersion                uint32
+	SbSize                   uint32
+	BlockSize                uint32
+	Flags                    uint64
+	InodesCount              uint64
+	InodeTableOffset         uint64
+	PrefetchTableOffset      uint64
+	BlobTableOffset          uint64
+	InodeTableEntries        uint32
+	PrefetchTableEntries     uint32
+	BlobTableSize            uint32
+	ExtendedBlobTableEntries uint32
+	ExtendedBlobTableOffset  uint64
+}
+
+type ondiskInode struct {
+	Digest      [32]byte
+	Parent      uint64
+	Ino         uint64
+	UID         uint32
+	GID         uint32
+	ProjID      uint32
+	Mode        uint32
+	Size        uint64
+	Blocks      uint64
+	Flags       uint64
+	Nlink       uint32
+	ChildIndex  uint32
+	ChildCount  uint32
+	NameSize    uint16
+	SymlinkSize uint16
+	Rdev        uint32
+	Reserved    [20]byte
+}
+
+type ondiskChunkInfo struct {
+	BlockID          [32]byte
+	BlobIndex        uint32
+	Flags            uint32
+	CompressSize     uint32
+	DecompressSize   uint32
+	CompressOffset   uint64
+	DecompressOffset uint64
+	FileOffset       uint64
+	Index            uint32
+	Reserved         uint32
+}
+
+type ondiskExtendedBlobEntry struct {
+	ChunkCount    uint32
+	Reserved1     [4]byte
+	BlobCacheSize uint64
+	Reserved2     [16]byte
+}
+
+// Blob is an entry of the blob table in bootstrap, the sizes are summed
+// from the deduplicated chunks referenced by the files.
+type Blob struct {
+	ID               string `json:"id"`
+	ChunkCount       uint32 `json:"chunk_count"`
+	CompressedSize   uint64 `json:"compressed_size"`
+	UncompressedSize uint64 `json:"uncompressed_size"`
+	ReadaheadOffset  uint32 `json:"readahead_offset"`
+	ReadaheadSize    uint32 `json:"readahead_size"`
+}
+
+// PrefetchEntry is an inode in the prefetch table of bootstrap, the
+// descendants of a directory are prefetched too.
+type PrefetchEntry struct {
+	Inode uint32 `json:"inode"`
+	Path  string `json:"path"`
+}
+
+// Chunk is a data chunk referenced by files, the chunks shared by multiple
+// files are listed once.
+type Chunk struct {
+	// Digest is the hex digest of uncompressed chunk data by the digester
+	// of bootstrap.
+	Digest           string
+	BlobIndex        uint32
+	CompressedSize   uint32
+	UncompressedSize uint32
+}
+
+// File is a regular file, the hardlinks are listed once.
+type File struct {
+	Path string
+	Size uint64
+	// Chunks are the indexes of the file data in Bootstrap.Chunks.
+	Chunks []int
+}
+
+// Bootstrap is the metadata of Nydus bootstrap.
+type Bootstrap struct {
+	FsVersion     uint32          `json:"fs_version"`
+	ChunkSize     uint32          `json:"chunk_size"`
+	Compressor    string          `json:"compressor"`
+	Digester      string          `json:"digester"`
+	Inodes        uint64          `json:"inodes"`
+	Files         uint64          `json:"files"`
+	Blobs         []Blob          `json:"blobs"`
+	PrefetchTable []PrefetchEntry `json:"prefetch_table"`
+
+	// The chunks and files aren't printed as they may be huge, they are
+	// used for analyzing the data of image, e.g. by comparer.
+	Chunks       []Chunk `json:"-"`
+	RegularFiles []File  `json:"-"`
+}
+
+type inodeName struct {
+	parent uint64
+	name   string
+}
+
+type chunkKey struct {
+	blobIndex      uint32
+	compressOffset uint64
+}
+
+func alignToRafs(size uint64) uint64 {
+	return (size + rafsAlignment - 1) &^ (rafsAlignment - 1)
+}
+
+func compressor(flags uint64) string {
+	switch {
+	case flags&superFlagCompressNone != 0:
+		return "none"
+	case flags&superFlagCompressGzip != 0:
+		return "gzip"
+	default:
+		return "lz4_block"
+	}
+}
+
+func digester(flags uint64) string {
+	if flags&superFlagDigestSHA256 != 0 {
+		return "sha256"
+	}
+	return "blake3"
+}
+
+// parseBlobTable parses the blob table, each entry is laid out as
+// `readahead_offset: u32 | readahead_size: u32 | blob_id | '\0'`,
+// except that the last entry has no trailing '\0'.
+func parseBlobTable(data []byte) ([]Blob, error) {
+	blobs := []Blob{}
+	for pos := 0; pos < len(data) && alignToRafs(uint64(pos)) < uint64(len(data)); {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("truncated blob table entry at %d", pos)
+		}
+		blob := Blob{
+			ReadaheadOffset: binary.LittleEndian.Uint32(data[pos:]),
+			ReadaheadSize:   binary.LittleEndian.Uint32(data[pos+4:]),
+		}
+		pos += 8
+		end := bytes.IndexByte(data[pos:], 0)
+		if end < 0 {
+			end = len(data) - pos
+		}
+		blob.ID = string(data[pos : pos+end])
+		blobs = append(blobs, blob)
+		pos += end + 1
+	}
+	return blobs, nil
+}
+
+func readAt(r io.ReaderAt, offset uint64, size uint64) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, int64(offset)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ParseBootstrap parses the RAFS v5 bootstrap file, all inodes are walked
+// to count the files and the chunks of blobs.
+func ParseBootstrap(bootstrapPath string) (*Bootstrap, error) {
+	file, err := os.Open(bootstrapPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open bootstrap")
+	}
+	defer file.Close()
+
+	var sb ondiskSuperBlock
+	if err := binary.Read(io.NewSectionReader(file, 0, rafsSuperblockSize), binary.LittleEndian, &sb); err != nil {
+		return nil, errors.Wrap(err, "read superblock")
+	}
+	if sb.Magic != rafsSuperMagic || sb.SbSize != rafsSuperblockSize {
+		return nil, fmt.Errorf("invalid bootstrap superblock, magic %x", sb.Magic)
+	}
+	if sb.FsVersion != rafsSuperVersionV5 {
+		return nil, fmt.Errorf("unsupported RAFS version %x", sb.FsVersion)
+	}
+
+	bootstrap := Bootstrap{
+		FsVersion:     sb.FsVersion >> 8,
+		ChunkSize:     sb.BlockSize,
+		Compressor:    compressor(sb.Flags),
+		Digester:      digester(sb.Flags),
+		PrefetchTable: []PrefetchEntry{},
+		Chunks:        []Chunk{},
+		RegularFiles:  []File{},
+	}
+
+	// Blob table
+	if sb.BlobTableSize > 0 {
+		data, err := readAt(file, sb.BlobTableOffset, uint64(sb.BlobTableSize))
+		if err != nil {
+			return nil, errors.Wrap(err, "read blob table")
+		}
+		if bootstrap.Blobs, err = parseBlobTable(data); err != nil {
+			return nil, errors.Wrap(err, "parse blob table")
+		}
+	} else {
+		bootstrap.Blobs = []Blob{}
+	}
+	// The extended blob table isn't present in the bootstraps built by
+	// old nydus-image, the chunk count is summed from inodes then.
+	hasExtended := sb.ExtendedBlobTableOffset > 0 && sb.ExtendedBlobTableEntries > 0
+	if hasExtended {
+		if int(sb.ExtendedBlobTableEntries) < len(bootstrap.Blobs) {
+			return nil, fmt.Errorf("extended blob table (%d) is shorter than blob table (%d)", sb.ExtendedBlobTableEntries, len(bootstrap.Blobs))
+		}
+		reader := io.NewSectionReader(file, int64(sb.ExtendedBlobTableOffset), int64(sb.ExtendedBlobTableEntries)*extendedBlobEntrySize)
+		for idx := range bootstrap.Blobs {
+			var entry ondiskExtendedBlobEntry
+			if err := binary.Read(reader, binary.LittleEndian, &entry); err != nil {
+				return nil, errors.Wrap(err, "read extended blob table")
+			}
+			bootstrap.Blobs[idx].ChunkCount = entry.ChunkCount
+		}
+	}
+
+	// Inodes are laid out sequentially from the offset of first inode in
+	// inode table: inode | name | symlink | xattrs | chunks
+	data, err := readAt(file, sb.InodeTableOffset, 4)
+	if err != nil {
+		return nil, errors.Wrap(err, "read inode table")
+	}
+	firstInodeOffset := uint64(binary.LittleEndian.Uint32(data)) << 3
+	reader := bufio.NewReader(io.NewSectionReader(file, int64(firstInodeOffset), 1<<62))
+	// skip discards the field of size and its padding
+	skip := func(size uint64) error {
+		_, err := reader.Discard(int(alignToRafs(size)))
+		return err
+	}
+
+	names := map[uint64]inodeName{}
+	chunks := map[chunkKey]int{}
+	// The inode numbers of RegularFiles, resolved to paths at last
+	fileInodes := []uint64{}
+	for entries := uint32(0); entries < sb.InodeTableEntries; entries++ {
+		var inode ondiskInode
+		if err := binary.Read(reader, binary.LittleEndian, &inode); err != nil {
+			return nil, errors.Wrapf(err, "read inode %d", entries)
+		}
+		name := make([]byte, alignToRafs(uint64(inode.NameSize)))
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return nil, errors.Wrapf(err, "read name of inode %d", inode.Ino)
+		}
+		name = name[:inode.NameSize]
+		// The hardlinks share the inode number
+		_, linked := names[inode.Ino]
+		if !linked {
+			names[inode.Ino] = inodeName{parent: inode.Parent, name: string(name)}
+		}
+		if err := skip(uint64(inode.SymlinkSize)); err != nil {
+			return nil, errors.Wrapf(err, "read symlink of inode %d", inode.Ino)
+		}
+		if inode.Flags&inodeFlagXattr != 0 {
+			var xattrSize uint64
+			if err := binary.Read(reader, binary.LittleEndian, &xattrSize); err != nil {
+				return nil, errors.Wrapf(err, "read xattrs of inode %d", inode.Ino)
+			}
+			if err := skip(xattrSize); err != nil {
+				return nil, errors.Wrapf(err, "read xattrs of inode %d", inode.Ino)
+			}
+		}
+		if inode.Mode&inodeModeTypeMask != inodeModeTypeRegular {
+			continue
+		}
+
+		var file *File
+		if !linked {
+			bootstrap.Files++
+			bootstrap.RegularFiles = append(bootstrap.RegularFiles, File{Size: inode.Size, Chunks: []int{}})
+			fileInodes = append(fileInodes, inode.Ino)
+			file = &bootstrap.RegularFiles[len(bootstrap.RegularFiles)-1]
+		}
+		for idx := uint32(0); idx < inode.ChildCount; idx++ {
+			var chunk ondiskChunkInfo
+			if err := binary.Read(reader, binary.LittleEndian, &chunk); err != nil {
+				return nil, errors.Wrapf(err, "read chunks of inode %d", inode.Ino)
+			}
+			if chunk.Flags&chunkFlagHole != 0 {
+				continue
+			}
+			if int(chunk.BlobIndex) >= len(bootstrap.Blobs) {
+				return nil, fmt.Errorf("invalid blob index %d in inode %d", chunk.BlobIndex, inode.Ino)
+			}
+			// The chunks are deduplicated across files
+			key := chunkKey{blobIndex: chunk.BlobIndex, compressOffset: chunk.CompressOffset}
+			if chunkIdx, ok := chunks[key]; ok {
+				if file != nil {
+					file.Chunks = append(file.Chunks, chunkIdx)
+				}
+				continue
+			}
+			chunks[key] = len(bootstrap.Chunks)
+			if file != nil {
+				file.Chunks = append(file.Chunks, len(bootstrap.Chunks))
+			}
+			bootstrap.Chunks = append(bootstrap.Chunks, Chunk{
+				Digest:           hex.EncodeToString(chunk.BlockID[:]),
+				BlobIndex:        chunk.BlobIndex,
+				CompressedSize:   chunk.CompressSize,
+				UncompressedSize: chunk.DecompressSize,
+			})
+			blob := &bootstrap.Blobs[chunk.BlobIndex]
+			blob.CompressedSize += uint64(chunk.CompressSize)
+			blob.UncompressedSize += uint64(chunk.DecompressSize)
+			if !hasExtended {
+				blob.ChunkCount++
+			}
+		}
+	}
+	bootstrap.Inodes = uint64(len(names))
+	for idx, ino := range fileInodes {
+		bootstrap.RegularFiles[idx].Path = inodePath(names, ino)
+	}
+
+	// Prefetch table is an array of inode numbers
+	if sb.PrefetchTableEntries > 0 {
+		data, err := readAt(file, sb.PrefetchTableOffset, uint64(sb.PrefetchTableEntries)*4)
+		if err != nil {
+			return nil, errors.Wrap(err, "read prefetch table")
+		}
+		for idx := uint32(0); idx < sb.PrefetchTableEntries; idx++ {
+			ino := binary.LittleEndian.Uint32(data[idx*4:])
+			bootstrap.PrefetchTable = append(bootstrap.PrefetchTable, PrefetchEntry{
+				Inode: ino,
+				Path:  inodePath(names, uint64(ino)),
+			})
+		}
+	}
+
+	return &bootstrap, nil
+}
+
+// inodePath resolves the absolute path of inode by walking up the parents,
+// it returns empty string if the inode isn't found.
+func inodePath(names map[uint64]inodeName, ino uint64) string {
+	parts := []string{}
+	for depth := 0; ino != rafsRootInode; depth++ {
+		entry, ok := names[ino]
+		if !ok || depth > maxPathDepth {
+			return ""
+		}
+		parts = append([]string{entry.name}, parts...)
+		ino = entry.parent
+	}
+	return "/" + path.Join(parts...)
+}
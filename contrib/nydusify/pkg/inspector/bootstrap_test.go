@@ -0,0 +1,204 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package inspector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testInode struct {
+	ino     uint64
+	parent  uint64
+	mode    uint32
+	nlink   uint32
+	name    string
+	symlink string
+	xattrs  []byte
+	chunks  []ondiskChunkInfo
+}
+
+func pad(buf *bytes.Buffer) {
+	for buf.Len()%rafsAlignment != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+func write(buf *bytes.Buffer, data interface{}) {
+	if err := binary.Write(buf, binary.LittleEndian, data); err != nil {
+		panic(err)
+	}
+}
+
+// makeBootstrap lays out a RAFS v5 bootstrap the same as nydus-image:
+// superblock | inode table | prefetch table | blob table | extended blob
+// table | inodes
+func makeBootstrap(blobIDs []string, prefetch []uint32, inodes []testInode) []byte {
+	tables := bytes.Buffer{}
+	tableOffset := uint64(rafsSuperblockSize)
+
+	inodeTableOffset := tableOffset
+	inodeTableSize := alignToRafs(uint64(len(inodes) * 4))
+	prefetchTableOffset := inodeTableOffset + inodeTableSize
+	prefetchTableSize := alignToRafs(uint64(len(prefetch) * 4))
+
+	blobTable := bytes.Buffer{}
+	for idx, id := range blobIDs {
+		write(&blobTable, []uint32{uint32(idx) * 10, 100})
+		blobTable.WriteString(id)
+		if idx != len(blobIDs)-1 {
+			blobTable.WriteByte(0)
+		}
+	}
+	blobTableSize := blobTable.Len()
+	pad(&blobTable)
+	blobTableOffset := prefetchTableOffset + prefetchTableSize
+
+	extendedTable := bytes.Buffer{}
+	for idx := range blobIDs {
+		write(&extendedTable, ondiskExtendedBlobEntry{ChunkCount: uint32(idx) + 10, BlobCacheSize: 1000})
+	}
+	extendedTableOffset := blobTableOffset + uint64(blobTable.Len())
+	firstInodeOffset := extendedTableOffset + uint64(extendedTable.Len())
+
+	for idx := range inodes {
+		// Only the first entry is read by the parser
+		write(&tables, uint32(firstInodeOffset>>3)+uint32(idx))
+	}
+	pad(&tables)
+	write(&tables, prefetch)
+	pad(&tables)
+	tables.Write(blobTable.Bytes())
+	tables.Write(extendedTable.Bytes())
+
+	for _, inode := range inodes {
+		ondisk := ondiskInode{
+			Parent:      inode.parent,
+			Ino:         inode.ino,
+			Mode:        inode.mode,
+			Nlink:       inode.nlink,
+			ChildCount:  uint32(len(inode.chunks)),
+			NameSize:    uint16(len(inode.name)),
+			SymlinkSize: uint16(len(inode.symlink)),
+		}
+		if inode.xattrs != nil {
+			ondisk.Flags |= inodeFlagXattr
+		}
+		write(&tables, ondisk)
+		tables.WriteString(inode.name)
+		pad(&tables)
+		tables.WriteString(inode.symlink)
+		pad(&tables)
+		if inode.xattrs != nil {
+			write(&tables, uint64(len(inode.xattrs)))
+			tables.Write(inode.xattrs)
+			pad(&tables)
+		}
+		write(&tables, inode.chunks)
+	}
+
+	sb := ondiskSuperBlock{
+		Magic:                    rafsSuperMagic,
+		FsVersion:                rafsSuperVersionV5,
+		SbSize:                   rafsSuperblockSize,
+		BlockSize:                0x100000,
+		Flags:                    superFlagDigestSHA256 | superFlagCompressGzip,
+		InodesCount:              uint64(len(inodes)),
+		InodeTableOffset:         inodeTableOffset,
+		PrefetchTableOffset:      prefetchTableOffset,
+		BlobTableOffset:          blobTableOffset,
+		InodeTableEntries:        uint32(len(inodes)),
+		PrefetchTableEntries:     uint32(len(prefetch)),
+		BlobTableSize:            uint32(blobTableSize),
+		ExtendedBlobTableEntries: uint32(len(blobIDs)),
+		ExtendedBlobTableOffset:  extendedTableOffset,
+	}
+	bootstrap := bytes.Buffer{}
+	write(&bootstrap, sb)
+	bootstrap.Write(make([]byte, rafsSuperblockSize-bootstrap.Len()))
+	bootstrap.Write(tables.Bytes())
+
+	return bootstrap.Bytes()
+}
+
+func TestParseBootstrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-inspector-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	shared := ondiskChunkInfo{BlockID: [32]byte{3}, BlobIndex: 1, CompressSize: 30, DecompressSize: 60, CompressOffset: 0}
+	inodes := []testInode{
+		{ino: 1, mode: 040755, nlink: 2, name: "/"},
+		{ino: 2, parent: 1, mode: 040755, nlink: 2, name: "usr"},
+		{ino: 3, parent: 2, mode: 0100644, nlink: 1, name: "file-a", chunks: []ondiskChunkInfo{
+			{BlockID: [32]byte{1}, BlobIndex: 0, CompressSize: 10, DecompressSize: 20, CompressOffset: 0},
+			{BlockID: [32]byte{2}, BlobIndex: 0, CompressSize: 15, DecompressSize: 20, CompressOffset: 10},
+			shared,
+		}},
+		{ino: 4, parent: 1, mode: 0100644, nlink: 2, name: "file-b", xattrs: []byte("\x0cuser.key\x00val"), chunks: []ondiskChunkInfo{
+			shared,
+			{BlobIndex: 1, Flags: chunkFlagHole},
+		}},
+		{ino: 4, parent: 2, mode: 0100644, nlink: 2, name: "file-b-link", chunks: []ondiskChunkInfo{shared}},
+		{ino: 5, parent: 1, mode: 0120777, nlink: 1, name: "link", symlink: "file-b"},
+	}
+	bootstrapPath := filepath.Join(dir, "bootstrap")
+	require.Nil(t, ioutil.WriteFile(bootstrapPath, makeBootstrap(
+		[]string{"blob-a", "blob-b"}, []uint32{2, 4}, inodes,
+	), 0644))
+
+	bootstrap, err := ParseBootstrap(bootstrapPath)
+	require.Nil(t, err)
+	assert.Equal(t, &Bootstrap{
+		FsVersion:  5,
+		ChunkSize:  0x100000,
+		Compressor: "gzip",
+		Digester:   "sha256",
+		Inodes:     5,
+		Files:      2,
+		Blobs: []Blob{
+			{ID: "blob-a", ChunkCount: 10, CompressedSize: 25, UncompressedSize: 40, ReadaheadOffset: 0, ReadaheadSize: 100},
+			{ID: "blob-b", ChunkCount: 11, CompressedSize: 30, UncompressedSize: 60, ReadaheadOffset: 10, ReadaheadSize: 100},
+		},
+		PrefetchTable: []PrefetchEntry{
+			{Inode: 2, Path: "/usr"},
+			{Inode: 4, Path: "/file-b"},
+		},
+		Chunks: []Chunk{
+			{Digest: hex.EncodeToString([]byte{1, 31: 0}), BlobIndex: 0, CompressedSize: 10, UncompressedSize: 20},
+			{Digest: hex.EncodeToString([]byte{2, 31: 0}), BlobIndex: 0, CompressedSize: 15, UncompressedSize: 20},
+			{Digest: hex.EncodeToString([]byte{3, 31: 0}), BlobIndex: 1, CompressedSize: 30, UncompressedSize: 60},
+		},
+		RegularFiles: []File{
+			{Path: "/usr/file-a", Chunks: []int{0, 1, 2}},
+			{Path: "/file-b", Chunks: []int{2}},
+		},
+	}, bootstrap)
+
+	// Invalid superblock
+	require.Nil(t, ioutil.WriteFile(bootstrapPath, make([]byte, rafsSuperblockSize), 0644))
+	_, err = ParseBootstrap(bootstrapPath)
+	assert.NotNil(t, err)
+}
+
+func TestParseBlobTable(t *testing.T) {
+	blobs, err := parseBlobTable([]byte("\x01\x00\x00\x00\x02\x00\x00\x00blob-a\x00\x00\x00\x00\x00\x00\x00\x00\x00blob-b\x00\x00"))
+	require.Nil(t, err)
+	assert.Equal(t, []Blob{
+		{ID: "blob-a", ReadaheadOffset: 1, ReadaheadSize: 2},
+		{ID: "blob-b"},
+	}, blobs)
+
+	_, err = parseBlobTable([]byte("\x01\x00\x00"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package inspector pulls the bootstrap layer of a remote Nydus image and
+// parses its metadata, the blobs aren't pulled.
+package inspector
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Opt defines Inspector options.
+type Opt struct {
+	WorkDir        string
+	Target         string
+	TargetInsecure bool
+}
+
+// Inspector inspects the bootstrap of Nydus image.
+type Inspector struct {
+	Opt
+	parser *parser.Parser
+}
+
+// New creates Inspector instance, target is the Nydus image reference.
+func New(opt Opt) (*Inspector, error) {
+	targetRemote, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure)
+	if err != nil {
+		return nil, errors.Wrap(err, "init target image parser")
+	}
+	return &Inspector{
+		Opt:    opt,
+		parser: parser.New(targetRemote),
+	}, nil
+}
+
+// Inspect pulls the bootstrap of Nydus image to a temporary file in work
+// directory and parses it.
+func (inspector *Inspector) Inspect(ctx context.Context) (*Bootstrap, error) {
+	parsed, err := inspector.parser.Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse Nydus image")
+	}
+	if parsed.NydusImage == nil {
+		return nil, fmt.Errorf("not found Nydus image in %s", inspector.Target)
+	}
+
+	if err := os.MkdirAll(inspector.WorkDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create work directory")
+	}
+	bootstrapDir, err := ioutil.TempDir(inspector.WorkDir, "nydus-inspect-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create bootstrap directory")
+	}
+	defer os.RemoveAll(bootstrapDir)
+
+	bootstrapPath := filepath.Join(bootstrapDir, "nydus_bootstrap")
+	logrus.Infof("Pulling Nydus bootstrap of %s", inspector.Target)
+	bootstrapReader, err := inspector.parser.PullNydusBootstrap(ctx, parsed.NydusImage)
+	if err != nil {
+		return nil, errors.Wrap(err, "pull Nydus bootstrap layer")
+	}
+	defer bootstrapReader.Close()
+	if err := utils.UnpackFile(bootstrapReader, utils.BootstrapFileNameInLayer, bootstrapPath); err != nil {
+		return nil, errors.Wrap(err, "unpack Nydus bootstrap layer")
+	}
+
+	bootstrap, err := ParseBootstrap(bootstrapPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse Nydus bootstrap")
+	}
+	return bootstrap, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"encoding/json"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
+)
+
+// AuditRecord is the machine-readable record of a conversion, written as a
+// JSON line to audit log for the operational visibility of conversion farms.
+type AuditRecord struct {
+	// User is the user triggering the conversion, defaults to the user
+	// running nydusify, Host is the host name of the machine.
+	User string `json:"user"`
+	Host string `json:"host"`
+
+	Source       string `json:"source"`
+	SourceDigest string `json:"source_digest,omitempty"`
+	Target       string `json:"target"`
+	TargetDigest string `json:"target_digest,omitempty"`
+
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Duration  float64   `json:"duration_seconds"`
+
+	// BytesIn is the total bytes of the pulled source layers, BytesOut is
+	// the total bytes of the pushed Nydus layers.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	// The statistics of build cache, they are zero if build cache isn't
+	// used or the conversion failed.
+	CacheHits       int   `json:"cache_hits"`
+	CacheMisses     int   `json:"cache_misses"`
+	CacheBytesSaved int64 `json:"cache_bytes_saved"`
+
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Auditor collects the audit record of a conversion, it's safe for
+// concurrent use.
+type Auditor struct {
+	mu     sync.Mutex
+	record AuditRecord
+}
+
+// NewAuditor starts the audit of the conversion from source to target, the
+// user defaults to the user running nydusify if it's empty.
+func NewAuditor(userName, source, target string) *Auditor {
+	if userName == "" {
+		if u, err := user.Current(); err == nil {
+			userName = u.Username
+		}
+	}
+	host, _ := os.Hostname()
+	return &Auditor{
+		record: AuditRecord{
+			User:      userName,
+			Host:      host,
+			Source:    source,
+			Target:    target,
+			StartTime: time.Now().UTC(),
+		},
+	}
+}
+
+// Observe counts the bytes in and out from the end events of progress
+// tasks, it's used as the hook of progress reporter.
+func (auditor *Auditor) Observe(event progress.Event) {
+	if event.Type != progress.EventDone {
+		return
+	}
+	auditor.mu.Lock()
+	defer auditor.mu.Unlock()
+	switch event.Stage {
+	case progress.StagePull:
+		auditor.record.BytesIn += event.Current
+	case progress.StagePush:
+		auditor.record.BytesOut += event.Current
+	}
+}
+
+// Finish completes the record with the digests, the statistics of build
+// cache and the result of conversion.
+func (auditor *Auditor) Finish(sourceDigest, targetDigest string, hits, misses int, bytesSaved int64, err error) AuditRecord {
+	auditor.mu.Lock()
+	defer auditor.mu.Unlock()
+	record := auditor.record
+	record.SourceDigest = sourceDigest
+	record.TargetDigest = targetDigest
+	record.EndTime = time.Now().UTC()
+	record.Duration = record.EndTime.Sub(record.StartTime).Seconds()
+	record.CacheHits = hits
+	record.CacheMisses = misses
+	record.CacheBytesSaved = bytesSaved
+	record.Success = err == nil
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// The records of concurrent conversions in the same process are appended
+// to audit log one by one.
+var auditLogLock sync.Mutex
+
+// WriteAudit appends the record as a JSON line to the file, or writes it
+// to stdout if path is `-`.
+func WriteAudit(path string, record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+	if path == "-" {
+		_, err = os.Stdout.Write(line)
+		return err
+	}
+	// A single write to the file opened in append mode isn't interleaved
+	// with the records written by other processes
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics collects the metrics of a conversion run, e.g. the
+// durations and bytes of each stage, the cache hits and the result, and
+// pushes them to Prometheus Pushgateway, OTLP metrics endpoint or StatsD at
+// the end of run, since the CI jobs running nydusify are too short-lived to be
+// scraped.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
+)
+
+const (
+	// LayerBuilt is the result of the layer built from source layer.
+	LayerBuilt = "built"
+	// LayerCached is the result of the layer hit in build cache.
+	LayerCached = "cached"
+	// LayerReused is the result of the layer reused from previous image.
+	LayerReused = "reused"
+)
+
+const (
+	defaultJob     = "nydusify"
+	defaultTimeout = 10 * time.Second
+)
+
+type Opt struct {
+	// PushGateway is the URL of Prometheus Pushgateway, e.g.
+	// `http://pushgateway:9091`.
+	PushGateway string
+	// OTLPEndpoint is the URL of OTLP/HTTP metrics endpoint, e.g.
+	// `http://collector:4318/v1/metrics`, the path defaults to `/v1/metrics`.
+	OTLPEndpoint string
+	// StatsD is the UDP address of StatsD server, e.g. `statsd:8125`, the
+	// labels are sent as DogStatsD tags.
+	StatsD string
+	// Job is the job name of Pushgateway grouping key, and the service
+	// name of OTLP resource, defaults to `nydusify`.
+	Job string
+	// Labels are the extra grouping labels of Pushgateway, and the extra
+	// attributes of OTLP resource, e.g. the pipeline and repository.
+	Labels map[string]string
+	// Timeout is the timeout of each push, defaults to 10s.
+	Timeout time.Duration
+}
+
+// Recorder records the metrics of a conversion run, it's safe for
+// concurrent use, and a nil Recorder discards all metrics.
+type Recorder struct {
+	Opt
+	registry *prometheus.Registry
+	client   *http.Client
+	start    time.Time
+
+	convertDuration  prometheus.Gauge
+	convertSuccess   prometheus.Gauge
+	convertTimestamp prometheus.Gauge
+	stageDuration    *prometheus.CounterVec
+	stageBytes       *prometheus.CounterVec
+	stageErrors      *prometheus.CounterVec
+	layers           *prometheus.CounterVec
+}
+
+func New(opt Opt) (*Recorder, error) {
+	if opt.PushGateway == "" && opt.OTLPEndpoint == "" && opt.StatsD == "" {
+		return nil, errors.New("Pushgateway, OTLP endpoint or StatsD address is required")
+	}
+	if opt.Job == "" {
+		opt.Job = defaultJob
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultTimeout
+	}
+
+	recorder := &Recorder{
+		Opt:      opt,
+		registry: prometheus.NewRegistry(),
+		client:   &http.Client{Timeout: opt.Timeout},
+		start:    time.Now(),
+
+		convertDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "nydusify_convert_duration_seconds",
+			Help: "Duration of the conversion in seconds.",
+		}),
+		convertSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "nydusify_convert_success",
+			Help: "Whether the conversion succeeded, 1 for success and 0 for failure.",
+		}),
+		convertTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "nydusify_convert_timestamp_seconds",
+			Help: "Unix time of the end of conversion.",
+		}),
+		stageDuration: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nydusify_stage_duration_seconds_total",
+			Help: "Total duration of the layer tasks in seconds by stage, the tasks run in parallel.",
+		}, []string{"stage"}),
+		stageBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nydusify_stage_bytes_total",
+			Help: "Total bytes of the finished layer tasks by stage.",
+		}, []string{"stage"}),
+		stageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nydusify_stage_errors_total",
+			Help: "Total number of the failed layer tasks by stage.",
+		}, []string{"stage"}),
+		layers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nydusify_layers_total",
+			Help: "Total number of the source layers by result, one of built, cached and reused.",
+		}, []string{"result"}),
+	}
+
+	recorder.registry.MustRegister(
+		recorder.convertDuration,
+		recorder.convertSuccess,
+		recorder.convertTimestamp,
+		recorder.stageDuration,
+		recorder.stageBytes,
+		recorder.stageErrors,
+		recorder.layers,
+	)
+
+	return recorder, nil
+}
+
+// Observe records the metrics from the end events of progress tasks, it's
+// used as the hook of progress reporter.
+func (recorder *Recorder) Observe(event progress.Event) {
+	if recorder == nil {
+		return
+	}
+	if event.Type != progress.EventDone && event.Type != progress.EventError {
+		return
+	}
+
+	if event.Stage == progress.StageConvert {
+		recorder.convertDuration.Set(event.Elapsed)
+		recorder.convertTimestamp.Set(float64(event.Time.Unix()))
+		if event.Type == progress.EventDone {
+			recorder.convertSuccess.Set(1)
+		} else {
+			recorder.convertSuccess.Set(0)
+		}
+		return
+	}
+
+	stage := string(event.Stage)
+	recorder.stageDuration.WithLabelValues(stage).Add(event.Elapsed)
+	if event.Type == progress.EventDone {
+		recorder.stageBytes.WithLabelValues(stage).Add(float64(event.Current))
+	} else {
+		recorder.stageErrors.WithLabelValues(stage).Inc()
+	}
+}
+
+// ObserveLayer records the result of a source layer, one of LayerBuilt,
+// LayerCached and LayerReused.
+func (recorder *Recorder) ObserveLayer(result string) {
+	if recorder == nil {
+		return
+	}
+	recorder.layers.WithLabelValues(result).Inc()
+}
+
+// Push pushes the recorded metrics to the configured Pushgateway, OTLP
+// endpoint and StatsD, the metrics of the previous run in the same Pushgateway group
+// are replaced.
+func (recorder *Recorder) Push(ctx context.Context) error {
+	if recorder == nil {
+		return nil
+	}
+
+	if recorder.PushGateway != "" {
+		pusher := push.New(recorder.PushGateway, recorder.Job).
+			Gatherer(recorder.registry).
+			Client(recorder.client)
+		for name, value := range recorder.Labels {
+			pusher = pusher.Grouping(name, value)
+		}
+		if err := pusher.Push(); err != nil {
+			return errors.Wrap(err, "Push metrics to Pushgateway")
+		}
+	}
+
+	if recorder.OTLPEndpoint != "" {
+		if err := recorder.pushOTLP(ctx); err != nil {
+			return errors.Wrap(err, "Push metrics to OTLP endpoint")
+		}
+	}
+
+	if recorder.StatsD != "" {
+		if err := recorder.pushStatsD(); err != nil {
+			return errors.Wrap(err, "Push metrics to StatsD")
+		}
+	}
+
+	return nil
+}
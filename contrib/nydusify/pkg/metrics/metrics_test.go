@@ -0,0 +1,245 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
+)
+
+func observe(recorder *Recorder) {
+	now := time.Unix(1622505600, 0)
+	recorder.Observe(progress.Event{Time: now, Type: progress.EventStart, Stage: progress.StagePull})
+	recorder.Observe(progress.Event{Time: now, Type: progress.EventDone, Stage: progress.StagePull, Current: 100, Elapsed: 2})
+	recorder.Observe(progress.Event{Time: now, Type: progress.EventDone, Stage: progress.StagePull, Current: 50, Elapsed: 1})
+	recorder.Observe(progress.Event{Time: now, Type: progress.EventError, Stage: progress.StagePush, Current: 10, Elapsed: 1})
+	recorder.Observe(progress.Event{Time: now, Type: progress.EventError, Stage: progress.StageConvert, Elapsed: 5})
+	recorder.ObserveLayer(LayerBuilt)
+	recorder.ObserveLayer(LayerCached)
+	recorder.ObserveLayer(LayerCached)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Opt{})
+	assert.NotNil(t, err)
+
+	recorder, err := New(Opt{PushGateway: "http://localhost:9091"})
+	require.Nil(t, err)
+	assert.Equal(t, defaultJob, recorder.Job)
+	assert.Equal(t, defaultTimeout, recorder.Timeout)
+
+	// Nil recorder discards all metrics
+	var nilRecorder *Recorder
+	observe(nilRecorder)
+	assert.Nil(t, nilRecorder.Push(context.Background()))
+}
+
+func TestPushGateway(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		path = r.URL.Path
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	recorder, err := New(Opt{
+		PushGateway: server.URL,
+		Labels:      map[string]string{"pipeline": "build"},
+	})
+	require.Nil(t, err)
+	observe(recorder)
+	require.Nil(t, recorder.Push(context.Background()))
+
+	assert.Equal(t, "/metrics/job/nydusify/pipeline/build", path)
+	// The body is in protobuf delimited format by default
+	for _, name := range []string{
+		"nydusify_convert_duration_seconds",
+		"nydusify_convert_success",
+		"nydusify_stage_bytes_total",
+		"nydusify_layers_total",
+	} {
+		assert.True(t, strings.Contains(body, name), name)
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	var req otlpRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, otlpMetricsPath, r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	recorder, err := New(Opt{
+		OTLPEndpoint: server.URL,
+		Job:          "ci",
+		Labels:       map[string]string{"repo": "library/busybox"},
+	})
+	require.Nil(t, err)
+	observe(recorder)
+	require.Nil(t, recorder.Push(context.Background()))
+
+	require.Len(t, req.ResourceMetrics, 1)
+	assert.Equal(t, []otlpAttribute{
+		{Key: "repo", Value: otlpAttributeValue{StringValue: "library/busybox"}},
+		{Key: "service.name", Value: otlpAttributeValue{StringValue: "ci"}},
+	}, req.ResourceMetrics[0].Resource.Attributes)
+
+	require.Len(t, req.ResourceMetrics[0].ScopeMetrics, 1)
+	metrics := map[string]otlpMetric{}
+	for _, metric := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+
+	success := metrics["nydusify_convert_success"]
+	require.NotNil(t, success.Gauge)
+	assert.Equal(t, float64(0), success.Gauge.DataPoints[0].AsDouble)
+	assert.Equal(t, float64(5), metrics["nydusify_convert_duration_seconds"].Gauge.DataPoints[0].AsDouble)
+	assert.Equal(t, float64(1622505600), metrics["nydusify_convert_timestamp_seconds"].Gauge.DataPoints[0].AsDouble)
+
+	stageBytes := metrics["nydusify_stage_bytes_total"]
+	require.NotNil(t, stageBytes.Sum)
+	assert.True(t, stageBytes.Sum.IsMonotonic)
+	assert.Equal(t, otlpCumulative, stageBytes.Sum.AggregationTemporality)
+	require.Len(t, stageBytes.Sum.DataPoints, 1)
+	assert.Equal(t, "pull", stageBytes.Sum.DataPoints[0].Attributes[0].Value.StringValue)
+	assert.Equal(t, float64(150), stageBytes.Sum.DataPoints[0].AsDouble)
+	assert.NotEmpty(t, stageBytes.Sum.DataPoints[0].StartTimeUnixNano)
+
+	stageDuration := metrics["nydusify_stage_duration_seconds_total"]
+	require.Len(t, stageDuration.Sum.DataPoints, 2)
+
+	stageErrors := metrics["nydusify_stage_errors_total"]
+	require.Len(t, stageErrors.Sum.DataPoints, 1)
+	assert.Equal(t, "push", stageErrors.Sum.DataPoints[0].Attributes[0].Value.StringValue)
+
+	layers := map[string]float64{}
+	for _, point := range metrics["nydusify_layers_total"].Sum.DataPoints {
+		layers[point.Attributes[0].Value.StringValue] = point.AsDouble
+	}
+	assert.Equal(t, map[string]float64{LayerBuilt: 1, LayerCached: 2}, layers)
+}
+
+func TestOTLPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("bad metrics"))
+	}))
+	defer server.Close()
+
+	recorder, err := New(Opt{OTLPEndpoint: server.URL + "/otlp/v1/metrics"})
+	require.Nil(t, err)
+	err = recorder.Push(context.Background())
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad metrics")
+}
+
+func TestOTLPURL(t *testing.T) {
+	u, err := otlpURL("http://collector:4318")
+	require.Nil(t, err)
+	assert.Equal(t, "http://collector:4318/v1/metrics", u)
+
+	u, err = otlpURL("https://collector/otlp/v1/metrics")
+	require.Nil(t, err)
+	assert.Equal(t, "https://collector/otlp/v1/metrics", u)
+}
+
+func TestStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	recorder, err := New(Opt{
+		StatsD: conn.LocalAddr().String(),
+		Labels: map[string]string{"pipeline": "build"},
+	})
+	require.Nil(t, err)
+	observe(recorder)
+	require.Nil(t, recorder.Push(context.Background()))
+
+	buf := make([]byte, statsdMaxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.Nil(t, err)
+	lines := strings.Split(string(buf[:n]), "\n")
+	assert.Contains(t, lines, "nydusify_convert_success:0|g|#job:nydusify,pipeline:build")
+	assert.Contains(t, lines, "nydusify_convert_duration_seconds:5|g|#job:nydusify,pipeline:build")
+	assert.Contains(t, lines, "nydusify_stage_bytes_total:150|c|#job:nydusify,pipeline:build,stage:pull")
+	assert.Contains(t, lines, "nydusify_layers_total:2|c|#job:nydusify,pipeline:build,result:cached")
+}
+
+func TestStatsDPackets(t *testing.T) {
+	line := strings.Repeat("a", statsdMaxPacketSize/2)
+	packets := statsdPackets([]string{line, line, "b"})
+	require.Len(t, packets, 2)
+	assert.Equal(t, line, string(packets[0]))
+	assert.Equal(t, line+"\nb", string(packets[1]))
+}
+
+func TestAudit(t *testing.T) {
+	auditor := NewAuditor("ci-bot", "busybox:latest", "busybox:latest-nydus")
+	now := time.Now()
+	auditor.Observe(progress.Event{Time: now, Type: progress.EventDone, Stage: progress.StagePull, Current: 100})
+	auditor.Observe(progress.Event{Time: now, Type: progress.EventDone, Stage: progress.StagePull, Current: 50})
+	auditor.Observe(progress.Event{Time: now, Type: progress.EventError, Stage: progress.StagePull, Current: 10})
+	auditor.Observe(progress.Event{Time: now, Type: progress.EventDone, Stage: progress.StageBuild, Current: 70})
+	auditor.Observe(progress.Event{Time: now, Type: progress.EventDone, Stage: progress.StagePush, Current: 80})
+
+	dir, err := ioutil.TempDir("", "nydusify-audit-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	record := auditor.Finish("sha256:source", "sha256:target", 1, 2, 30, nil)
+	require.Nil(t, WriteAudit(path, record))
+	failed := NewAuditor("", "nginx:latest", "nginx:latest-nydus").Finish("", "", 0, 0, 0, errors.New("pull failed"))
+	require.Nil(t, WriteAudit(path, failed))
+
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	var got AuditRecord
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &got))
+	assert.Equal(t, "ci-bot", got.User)
+	assert.Equal(t, "busybox:latest", got.Source)
+	assert.Equal(t, "sha256:source", got.SourceDigest)
+	assert.Equal(t, "busybox:latest-nydus", got.Target)
+	assert.Equal(t, "sha256:target", got.TargetDigest)
+	assert.Equal(t, int64(150), got.BytesIn)
+	assert.Equal(t, int64(80), got.BytesOut)
+	assert.Equal(t, 1, got.CacheHits)
+	assert.Equal(t, 2, got.CacheMisses)
+	assert.Equal(t, int64(30), got.CacheBytesSaved)
+	assert.True(t, got.Success)
+	assert.False(t, got.EndTime.Before(got.StartTime))
+
+	got = AuditRecord{}
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &got))
+	assert.False(t, got.Success)
+	assert.Equal(t, "pull failed", got.Error)
+	assert.NotEmpty(t, got.User)
+}
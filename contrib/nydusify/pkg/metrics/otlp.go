@@ -0,0 +1,208 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const otlpMetricsPath = "/v1/metrics"
+
+// The cumulative aggregation temporality of OTLP sum.
+const otlpCumulative = 2
+
+// The OTLP metrics in JSON encoding of OTLP/HTTP, only the gauge and
+// monotonic sum used by Recorder are defined.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpAttribute struct {
+	Key   string             `json:"key"`
+	Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpAttributes(labels map[string]string) []otlpAttribute {
+	attrs := []otlpAttribute{}
+	for key, value := range labels {
+		attrs = append(attrs, otlpAttribute{Key: key, Value: otlpAttributeValue{StringValue: value}})
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].Key < attrs[j].Key
+	})
+	return attrs
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpMetrics converts the gathered Prometheus metric families to OTLP
+// metrics, the gauges are mapped to gauges and the counters are mapped to
+// cumulative monotonic sums.
+func otlpMetrics(families []*dto.MetricFamily, start, now time.Time) []otlpMetric {
+	metrics := []otlpMetric{}
+	for _, family := range families {
+		metric := otlpMetric{
+			Name:        family.GetName(),
+			Description: family.GetHelp(),
+		}
+		points := []otlpDataPoint{}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, pair := range m.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			point := otlpDataPoint{
+				Attributes:   otlpAttributes(labels),
+				TimeUnixNano: unixNano(now),
+			}
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				point.AsDouble = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				point.StartTimeUnixNano = unixNano(start)
+				point.AsDouble = m.GetCounter().GetValue()
+			default:
+				continue
+			}
+			points = append(points, point)
+		}
+		switch family.GetType() {
+		case dto.MetricType_GAUGE:
+			metric.Gauge = &otlpGauge{DataPoints: points}
+		case dto.MetricType_COUNTER:
+			metric.Sum = &otlpSum{
+				DataPoints:             points,
+				AggregationTemporality: otlpCumulative,
+				IsMonotonic:            true,
+			}
+		default:
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// otlpURL appends the default metrics path to endpoint without path.
+func otlpURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpMetricsPath
+	}
+	return u.String(), nil
+}
+
+func (recorder *Recorder) pushOTLP(ctx context.Context) error {
+	families, err := recorder.registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	resource := map[string]string{}
+	for key, value := range recorder.Labels {
+		resource[key] = value
+	}
+	resource["service.name"] = recorder.Job
+
+	body, err := json.Marshal(otlpRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{Attributes: otlpAttributes(resource)},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: defaultJob},
+				Metrics: otlpMetrics(families, recorder.start, time.Now()),
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := otlpURL(recorder.OTLPEndpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := recorder.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Unexpected status code %d: %s", resp.StatusCode, msg)
+	}
+
+	return nil
+}
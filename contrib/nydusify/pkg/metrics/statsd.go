@@ -0,0 +1,111 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The maximum size of a StatsD packet, which fits in the MTU of common
+// networks without fragmentation.
+const statsdMaxPacketSize = 1432
+
+// statsdTags formats the labels as DogStatsD tags, which are accepted by
+// the StatsD servers supporting tags, e.g. Datadog agent and Telegraf.
+func statsdTags(labels map[string]string) string {
+	tags := []string{}
+	for key, value := range labels {
+		tags = append(tags, key+":"+value)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ",")
+}
+
+// statsdLines converts the gathered Prometheus metric families to StatsD
+// lines, the gauges are mapped to gauges and the counters are mapped to
+// counters, since the registry is only for a conversion run, the value of
+// counter is the delta of the run.
+func statsdLines(families []*dto.MetricFamily, labels map[string]string) []string {
+	lines := []string{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			tags := map[string]string{}
+			for key, value := range labels {
+				tags[key] = value
+			}
+			for _, pair := range m.GetLabel() {
+				tags[pair.GetName()] = pair.GetValue()
+			}
+			var value float64
+			var typ string
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				value, typ = m.GetGauge().GetValue(), "g"
+			case dto.MetricType_COUNTER:
+				value, typ = m.GetCounter().GetValue(), "c"
+			default:
+				continue
+			}
+			line := fmt.Sprintf("%s:%s|%s", family.GetName(), strconv.FormatFloat(value, 'f', -1, 64), typ)
+			if len(tags) > 0 {
+				line += "|#" + statsdTags(tags)
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// statsdPackets packs the lines into packets separated by newline.
+func statsdPackets(lines []string) [][]byte {
+	packets := [][]byte{}
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacketSize {
+			packets = append(packets, packet)
+			packet = nil
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+func (recorder *Recorder) pushStatsD() error {
+	families, err := recorder.registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	labels := map[string]string{}
+	for key, value := range recorder.Labels {
+		labels[key] = value
+	}
+	labels["job"] = recorder.Job
+
+	conn, err := net.DialTimeout("udp", recorder.StatsD, recorder.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, packet := range statsdPackets(statsdLines(families, labels)) {
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// catalogPageSize is the count of entries requested in a page of catalog
+// and tags list, the registry may return fewer entries.
+const catalogPageSize = 1000
+
+// The rate limited requests (429) are retried after the delay in the
+// `Retry-After` header of response, or the exponential backoff from
+// defaultRetryAfter if it's missing, the delay is capped by maxRetryAfter.
+const (
+	maxRateLimitRetries = 5
+	defaultRetryAfter   = time.Second
+	maxRetryAfter       = 5 * time.Minute
+)
+
+// linkNextPattern matches the next page in `Link` header of registry
+// response, e.g. `</v2/_catalog?last=b&n=100>; rel="next"`.
+var linkNextPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// statusError is the unexpected status of registry response.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// Catalog enumerates the repositories and tags of a registry by the
+// catalog and tags list API of distribution spec.
+type Catalog struct {
+	host       string
+	scheme     string
+	client     *http.Client
+	authorizer docker.Authorizer
+}
+
+// NewCatalog creates Catalog for registry host, plain http is used for
+// localhost or if insecure is true, credFunc returns the username and
+// password of the host.
+func NewCatalog(host string, insecure bool, client *http.Client, credFunc func(string) (string, string, error)) (*Catalog, error) {
+	scheme := "https"
+	local, err := docker.MatchLocalhost(host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid registry host %s", host)
+	}
+	if local || insecure {
+		scheme = "http"
+	}
+	return &Catalog{
+		host:       host,
+		scheme:     scheme,
+		client:     client,
+		authorizer: docker.NewAuthorizer(client, credFunc),
+	}, nil
+}
+
+// retryAfter returns the delay before retrying the rate limited request,
+// the `Retry-After` header is either seconds or a HTTP date.
+func retryAfter(header string, retries int, now time.Time) time.Duration {
+	delay := defaultRetryAfter << uint(retries)
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay
+}
+
+// do sends the GET request to registry, retries it once with the
+// authorization for the challenge if it's unauthorized, and retries it
+// after the delay if it's rate limited.
+func (catalog *Catalog) do(ctx context.Context, u string) (*http.Response, error) {
+	retried := false
+	rateLimited := 0
+	for {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Accept", "application/json")
+		if err := catalog.authorizer.Authorize(ctx, req); err != nil {
+			return nil, errors.Wrap(err, "authorize request")
+		}
+		resp, err := catalog.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && !retried {
+			retried = true
+			err := catalog.authorizer.AddResponses(ctx, []*http.Response{resp})
+			resp.Body.Close()
+			if err != nil {
+				return nil, errors.Wrap(err, "handle authorization challenge")
+			}
+			continue
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && rateLimited < maxRateLimitRetries {
+			delay := retryAfter(resp.Header.Get("Retry-After"), rateLimited, time.Now())
+			resp.Body.Close()
+			rateLimited++
+			logrus.Warnf("Rate limited by registry on %s, retrying in %s", req.URL.Path, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return nil, &statusError{
+				code: resp.StatusCode,
+				msg:  fmt.Sprintf("unexpected status %s of %s: %s", resp.Status, req.URL.Path, body),
+			}
+		}
+		return resp, nil
+	}
+}
+
+// page requests the page link of path, the first page is requested if link
+// is empty. It returns the entries in the field key of page, and the link of
+// next page relative to registry host, which is empty for the last page.
+func (catalog *Catalog) page(ctx context.Context, path, key, link string) ([]string, string, error) {
+	base := &url.URL{Scheme: catalog.scheme, Host: catalog.host}
+	if link == "" {
+		link = (&url.URL{
+			Path:     path,
+			RawQuery: fmt.Sprintf("n=%d", catalogPageSize),
+		}).String()
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "parse link %s", link)
+	}
+	resp, err := catalog.do(ctx, base.ResolveReference(ref).String())
+	if err != nil {
+		return nil, "", err
+	}
+	page := map[string]json.RawMessage{}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "decode response of %s", path)
+	}
+	entries := []string{}
+	if data, ok := page[key]; ok {
+		var pageEntries []string
+		if err := json.Unmarshal(data, &pageEntries); err != nil {
+			return nil, "", errors.Wrapf(err, "decode %s of %s", key, path)
+		}
+		entries = append(entries, pageEntries...)
+	}
+
+	next, err := nextLink(base, resp)
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, next, nil
+}
+
+// nextLink returns the link of next page in `Link` header of resp relative
+// to registry host, which is empty for the last page.
+func nextLink(base *url.URL, resp *http.Response) (string, error) {
+	matches := linkNextPattern.FindStringSubmatch(resp.Header.Get("Link"))
+	if matches == nil {
+		return "", nil
+	}
+	nextURL, err := url.Parse(matches[1])
+	if err != nil {
+		return "", errors.Wrapf(err, "parse link %s", matches[1])
+	}
+	// Keep the link relative, so that it's still valid in state file
+	// if the registry is accessed by another scheme
+	nextURL = base.ResolveReference(nextURL)
+	return (&url.URL{Path: nextURL.Path, RawPath: nextURL.RawPath, RawQuery: nextURL.RawQuery}).String(), nil
+}
+
+// list requests all pages from path, and returns the concatenated entries
+// in the field key of pages.
+func (catalog *Catalog) list(ctx context.Context, path, key string) ([]string, error) {
+	entries := []string{}
+	for link := ""; ; {
+		pageEntries, next, err := catalog.page(ctx, path, key, link)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, pageEntries...)
+		if next == "" {
+			return entries, nil
+		}
+		link = next
+	}
+}
+
+// Repositories returns all repositories in registry.
+func (catalog *Catalog) Repositories(ctx context.Context) ([]string, error) {
+	repositories, err := catalog.list(ctx, "/v2/_catalog", "repositories")
+	if err != nil {
+		return nil, errors.Wrap(err, "list repositories")
+	}
+	return repositories, nil
+}
+
+// Tags returns all tags of repository.
+func (catalog *Catalog) Tags(ctx context.Context, repository string) ([]string, error) {
+	tags, err := catalog.list(ctx, fmt.Sprintf("/v2/%s/tags/list", repository), "tags")
+	if err != nil {
+		return nil, errors.Wrapf(err, "list tags of %s", repository)
+	}
+	return tags, nil
+}
+
+// TagsPage returns the tags in the page link of repository, the first page
+// is requested if link is empty, and the link of next page is returned,
+// which is empty for the last page. The links can be persisted to resume
+// listing the tags of huge repositories.
+func (catalog *Catalog) TagsPage(ctx context.Context, repository, link string) ([]string, string, error) {
+	tags, next, err := catalog.page(ctx, fmt.Sprintf("/v2/%s/tags/list", repository), "tags", link)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "list tags of %s", repository)
+	}
+	return tags, next, nil
+}
+
+// Referrers returns the manifests referring to dgst in repository by OCI
+// referrers API, ok is false if the registry doesn't support the API.
+func (catalog *Catalog) Referrers(ctx context.Context, repository string, dgst digest.Digest) ([]ocispec.Descriptor, bool, error) {
+	base := &url.URL{Scheme: catalog.scheme, Host: catalog.host}
+	referrers := []ocispec.Descriptor{}
+	for link := fmt.Sprintf("/v2/%s/referrers/%s", repository, dgst); link != ""; {
+		ref, err := url.Parse(link)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "parse link %s", link)
+		}
+		resp, err := catalog.do(ctx, base.ResolveReference(ref).String())
+		if err != nil {
+			var statusErr *statusError
+			if errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound {
+				return nil, false, nil
+			}
+			return nil, false, errors.Wrapf(err, "list referrers of %s in %s", dgst, repository)
+		}
+		var index ocispec.Index
+		err = json.NewDecoder(resp.Body).Decode(&index)
+		resp.Body.Close()
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "decode referrers of %s in %s", dgst, repository)
+		}
+		referrers = append(referrers, index.Manifests...)
+		if link, err = nextLink(base, resp); err != nil {
+			return nil, false, err
+		}
+	}
+	return referrers, true, nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mirror converts the images in a source registry to a target
+// registry in bulk, the repositories and tags are enumerated by registry
+// catalog API, and the converted images are recorded in a state file to
+// be skipped on re-runs.
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/batch"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+)
+
+// Opt defines Mirror options.
+type Opt struct {
+	SourceRegistry string
+	SourceInsecure bool
+	// TargetRegistry is the registry host with an optional namespace, e.g.
+	// `myregistry/nydus`, the image `<repository>:<tag>` in source registry
+	// is converted to `<target registry>/<repository>:<tag><target suffix>`.
+	TargetRegistry string
+	TargetSuffix   string
+	// Include and Exclude are matched against `<repository>:<tag>` of
+	// source images, an image is converted if it matches any of Include
+	// or Include is empty, and doesn't match any of Exclude.
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+	// StatePath is the path of state file, the state isn't saved if it's
+	// empty.
+	StatePath string
+	Workers   uint
+	// HTTPCacheDir caches the manifest and config responses from registry
+	// in the directory if it's specified.
+	HTTPCacheDir string
+}
+
+// Mirror converts the images in source registry to target registry.
+type Mirror struct {
+	Opt
+	catalog *Catalog
+	state   *State
+}
+
+// image is a source image to be converted with its manifest digest.
+type image struct {
+	batch.Image
+	digest digest.Digest
+}
+
+// New creates Mirror instance.
+func New(opt Opt) (*Mirror, error) {
+	if opt.SourceRegistry == opt.TargetRegistry && opt.TargetSuffix == "" {
+		return nil, fmt.Errorf("target suffix is required if source and target registry are the same")
+	}
+	catalog, err := NewCatalog(opt.SourceRegistry, opt.SourceInsecure, provider.NewRegistryClient(opt.SourceRegistry), provider.DefaultCredential)
+	if err != nil {
+		return nil, err
+	}
+	state, err := LoadState(opt.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		Opt:     opt,
+		catalog: catalog,
+		state:   state,
+	}, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// selected returns true if the image `<repository>:<tag>` is selected by
+// include and exclude patterns.
+func (mirror *Mirror) selected(name string) bool {
+	if len(mirror.Include) > 0 && !matchAny(mirror.Include, name) {
+		return false
+	}
+	return !matchAny(mirror.Exclude, name)
+}
+
+// plan resolves the images selected in a page of tags of repository, and
+// returns the images not converted yet with the count of skipped images.
+func (mirror *Mirror) plan(ctx context.Context, repository string, tags []string) ([]image, int, error) {
+	images := []image{}
+	skipped := 0
+	for _, tag := range tags {
+		name := fmt.Sprintf("%s:%s", repository, tag)
+		if !mirror.selected(name) {
+			continue
+		}
+		source := fmt.Sprintf("%s/%s", mirror.SourceRegistry, name)
+		target := fmt.Sprintf("%s/%s%s", mirror.TargetRegistry, name, mirror.TargetSuffix)
+
+		sourceRemote, err := provider.DefaultRemote(source, mirror.SourceInsecure, provider.WithHTTPCache(mirror.HTTPCacheDir))
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "parse source reference %s", source)
+		}
+		desc, err := sourceRemote.Resolve(ctx)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "resolve source image %s", source)
+		}
+		if mirror.state.Converted(source, desc.Digest, target) {
+			skipped++
+			continue
+		}
+		images = append(images, image{
+			Image:  batch.Image{Source: source, Target: target},
+			digest: desc.Digest,
+		})
+	}
+	return images, skipped, nil
+}
+
+// convert converts the images by convert, and records the converted images
+// in state file, offset is the count of images converted before.
+func (mirror *Mirror) convert(ctx context.Context, images []image, offset int, convert batch.ConvertFunc) []batch.Result {
+	batchImages := []batch.Image{}
+	for _, image := range images {
+		batchImages = append(batchImages, image.Image)
+	}
+	return batch.Run(ctx, batchImages, mirror.Workers, func(ctx context.Context, index int, batchImage batch.Image) error {
+		if err := convert(ctx, offset+index, batchImage); err != nil {
+			return err
+		}
+		if err := mirror.state.Record(batchImage.Source, images[index].digest, batchImage.Target); err != nil {
+			return errors.Wrap(err, "record converted image")
+		}
+		return nil
+	})
+}
+
+// resumeFrom returns the index of repository and the tags page to resume
+// from by the cursor in state file.
+func (mirror *Mirror) resumeFrom(repositories []string) (int, string) {
+	cursor := mirror.state.GetCursor()
+	if cursor == nil {
+		return 0, ""
+	}
+	for idx, repository := range repositories {
+		if repository == cursor.Repository {
+			logrus.Infof("Resuming from repository %s of interrupted run", repository)
+			return idx, cursor.Page
+		}
+	}
+	logrus.Warnf("Repository %s of interrupted run isn't found, starting over", cursor.Repository)
+	return 0, ""
+}
+
+// Run converts the images not converted yet in source registry by convert,
+// and records the converted images in state file. The tags are listed and
+// converted page by page, and the position is recorded in state file after
+// each page, so that an interrupted run is resumed from the page instead
+// of listing and resolving all the tags again. The images failed are
+// retried by the next run going through all repositories.
+func (mirror *Mirror) Run(ctx context.Context, convert batch.ConvertFunc) ([]batch.Result, error) {
+	repositories, err := mirror.catalog.Repositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []batch.Result{}
+	skipped := 0
+	start, page := mirror.resumeFrom(repositories)
+	for idx := start; idx < len(repositories); idx++ {
+		repository := repositories[idx]
+		for {
+			tags, next, err := mirror.catalog.TagsPage(ctx, repository, page)
+			if err != nil {
+				return nil, err
+			}
+			images, pageSkipped, err := mirror.plan(ctx, repository, tags)
+			if err != nil {
+				return nil, err
+			}
+			skipped += pageSkipped
+			results = append(results, mirror.convert(ctx, images, len(results), convert)...)
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			// Move to the next page, or the first page of next repository
+			cursor := &Cursor{Repository: repository, Page: next}
+			if next == "" {
+				cursor = nil
+				if idx+1 < len(repositories) {
+					cursor = &Cursor{Repository: repositories[idx+1]}
+				}
+			}
+			if err := mirror.state.SetCursor(cursor); err != nil {
+				return nil, errors.Wrap(err, "record position")
+			}
+			if page = next; page == "" {
+				break
+			}
+		}
+	}
+	logrus.Infof("Found %d images to convert, %d images skipped as converted", len(results), skipped)
+
+	return results, nil
+}
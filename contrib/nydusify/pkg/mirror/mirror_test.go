@@ -0,0 +1,255 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/batch"
+)
+
+func TestCatalog(t *testing.T) {
+	rateLimited := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/_catalog":
+			if !rateLimited {
+				rateLimited = true
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", `</v2/_catalog?last=library%2Fbusybox&n=1000>; rel="next"`)
+				json.NewEncoder(w).Encode(map[string][]string{"repositories": {"library/busybox"}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]string{"repositories": {"library/nginx"}})
+		case "/v2/library/nginx/tags/list":
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": "library/nginx", "tags": []string{"1.19", "latest"}})
+		case "/v2/library/empty/tags/list":
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": "library/empty", "tags": nil})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	catalog, err := NewCatalog(host, false, server.Client(), func(string) (string, string, error) {
+		return "user", "pass", nil
+	})
+	require.Nil(t, err)
+
+	repositories, err := catalog.Repositories(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, []string{"library/busybox", "library/nginx"}, repositories)
+
+	tags, err := catalog.Tags(context.Background(), "library/nginx")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1.19", "latest"}, tags)
+
+	tags, err = catalog.Tags(context.Background(), "library/empty")
+	require.Nil(t, err)
+	assert.Empty(t, tags)
+
+	_, err = catalog.Tags(context.Background(), "library/unknown")
+	assert.Contains(t, err.Error(), "404")
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 30*time.Second, retryAfter("30", 0, now))
+	assert.Equal(t, maxRetryAfter, retryAfter("3600", 0, now))
+	assert.Equal(t, defaultRetryAfter, retryAfter("", 0, now))
+	assert.Equal(t, 4*defaultRetryAfter, retryAfter("soon", 2, now))
+	date := now.Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	delay := retryAfter(date, 0, now)
+	assert.True(t, delay > 8*time.Second && delay <= 10*time.Second)
+	assert.Equal(t, time.Duration(0), retryAfter(now.Add(-time.Minute).UTC().Format(http.TimeFormat), 0, now))
+}
+
+// fakeRegistry serves the catalog, the paged tags list and the manifest
+// digests of repositories.
+type fakeRegistry struct {
+	sync.Mutex
+	tags map[string][]string
+	// requests are the paths and queries of requests to tags list API
+	requests []string
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case req.URL.Path == "/v2/":
+	case path == "_catalog":
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": {"app/a", "app/b"}})
+	case strings.HasSuffix(path, "/tags/list"):
+		r.requests = append(r.requests, req.URL.RequestURI())
+		repository := strings.TrimSuffix(path, "/tags/list")
+		tags := r.tags[repository]
+		// Two tags per page
+		start := 0
+		if last := req.URL.Query().Get("last"); last != "" {
+			for idx, tag := range tags {
+				if tag == last {
+					start = idx + 1
+				}
+			}
+		}
+		end := start + 2
+		if end < len(tags) {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?last=%s&n=2>; rel="next"`, repository, tags[end-1]))
+		} else {
+			end = len(tags)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags[start:end]})
+	case strings.Contains(path, "/manifests/"):
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromString(path).String())
+		w.Header().Set("Content-Length", "2")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-mirror-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	registry := &fakeRegistry{tags: map[string][]string{
+		"app/a": {"v1", "v2", "v3", "v4", "v5"},
+		"app/b": {"v1"},
+	}}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	statePath := filepath.Join(dir, "state.json")
+	newMirror := func() *Mirror {
+		mirror, err := New(Opt{
+			SourceRegistry: host,
+			TargetRegistry: "target",
+			StatePath:      statePath,
+			Workers:        1,
+		})
+		require.Nil(t, err)
+		return mirror
+	}
+
+	// The run is interrupted while converting the second page of app/a
+	converted := []string{}
+	var mu sync.Mutex
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = newMirror().Run(ctx, func(ctx context.Context, index int, image batch.Image) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if image.Source == host+"/app/a:v4" {
+			cancel()
+			return ctx.Err()
+		}
+		converted = append(converted, strings.TrimPrefix(image.Source, host+"/"))
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"app/a:v1", "app/a:v2", "app/a:v3"}, converted)
+	state, err := LoadState(statePath)
+	require.Nil(t, err)
+	assert.Equal(t, &Cursor{Repository: "app/a", Page: "/v2/app/a/tags/list?last=v2&n=2"}, state.Cursor)
+
+	// The run is resumed from the second page of app/a
+	registry.requests = nil
+	converted = []string{}
+	results, err := newMirror().Run(context.Background(), func(ctx context.Context, index int, image batch.Image) error {
+		mu.Lock()
+		defer mu.Unlock()
+		converted = append(converted, strings.TrimPrefix(image.Source, host+"/"))
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Len(t, results, 3)
+	assert.Equal(t, []string{"app/a:v4", "app/a:v5", "app/b:v1"}, converted)
+	assert.Equal(t, "/v2/app/a/tags/list?last=v2&n=2", registry.requests[0])
+	state, err = LoadState(statePath)
+	require.Nil(t, err)
+	assert.Nil(t, state.Cursor)
+	assert.Len(t, state.Images, 6)
+}
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-mirror-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	statePath := filepath.Join(dir, "state.json")
+	state, err := LoadState(statePath)
+	require.Nil(t, err)
+	assert.False(t, state.Converted("registry/nginx:latest", "sha256:aaa", "target/nginx:latest"))
+	require.Nil(t, state.Record("registry/nginx:latest", "sha256:aaa", "target/nginx:latest"))
+
+	state, err = LoadState(statePath)
+	require.Nil(t, err)
+	assert.True(t, state.Converted("registry/nginx:latest", "sha256:aaa", "target/nginx:latest"))
+	// The tag is updated
+	assert.False(t, state.Converted("registry/nginx:latest", "sha256:bbb", "target/nginx:latest"))
+	// The target is changed
+	assert.False(t, state.Converted("registry/nginx:latest", "sha256:aaa", "other/nginx:latest"))
+
+	// The cursor is saved along with converted images
+	assert.Nil(t, state.GetCursor())
+	require.Nil(t, state.SetCursor(&Cursor{Repository: "library/nginx", Page: "/v2/library/nginx/tags/list?last=1.19&n=100"}))
+	state, err = LoadState(statePath)
+	require.Nil(t, err)
+	assert.Equal(t, &Cursor{Repository: "library/nginx", Page: "/v2/library/nginx/tags/list?last=1.19&n=100"}, state.GetCursor())
+	assert.True(t, state.Converted("registry/nginx:latest", "sha256:aaa", "target/nginx:latest"))
+	require.Nil(t, state.SetCursor(nil))
+	state, err = LoadState(statePath)
+	require.Nil(t, err)
+	assert.Nil(t, state.GetCursor())
+
+	// The state isn't saved without path
+	state, err = LoadState("")
+	require.Nil(t, err)
+	require.Nil(t, state.Record("registry/nginx:latest", "sha256:aaa", "target/nginx:latest"))
+}
+
+func TestSelected(t *testing.T) {
+	mirror := &Mirror{Opt: Opt{
+		Include: []*regexp.Regexp{regexp.MustCompile(`^library/`)},
+		Exclude: []*regexp.Regexp{regexp.MustCompile(`:.*-nydus$`), regexp.MustCompile(`^library/busybox:`)},
+	}}
+	assert.True(t, mirror.selected("library/nginx:latest"))
+	assert.False(t, mirror.selected("library/nginx:latest-nydus"))
+	assert.False(t, mirror.selected("library/busybox:latest"))
+	assert.False(t, mirror.selected("app/web:v1"))
+
+	mirror.Include = nil
+	assert.True(t, mirror.selected("app/web:v1"))
+}
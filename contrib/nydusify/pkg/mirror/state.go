@@ -0,0 +1,132 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mirror
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// StateRecord is the converted image recorded in state file.
+type StateRecord struct {
+	Digest digest.Digest `json:"digest"`
+	Target string        `json:"target"`
+}
+
+// Cursor is the position of an interrupted run in source registry.
+type Cursor struct {
+	Repository string `json:"repository"`
+	// Page is the link of the tags page of repository to be converted next,
+	// it's the first page if empty.
+	Page string `json:"page,omitempty"`
+}
+
+// State records the digests of source images converted, which are skipped
+// on re-runs unless the tag is updated or the target is changed.
+type State struct {
+	path string
+	mu   sync.Mutex
+	// Images maps source image reference to the converted record.
+	Images map[string]StateRecord `json:"images"`
+	// Cursor is the position to resume the interrupted run from, it's
+	// removed once the run goes through all repositories.
+	Cursor *Cursor `json:"cursor,omitempty"`
+}
+
+// LoadState loads the state file in path, the state is empty if the file
+// doesn't exist, and isn't saved if path is empty.
+func LoadState(path string) (*State, error) {
+	state := &State{
+		path:   path,
+		Images: map[string]StateRecord{},
+	}
+	if path == "" {
+		return state, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read state file")
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrap(err, "unmarshal state file")
+	}
+	if state.Images == nil {
+		state.Images = map[string]StateRecord{}
+	}
+	return state, nil
+}
+
+// Converted returns true if the source image of digest has been converted
+// to target.
+func (state *State) Converted(source string, dgst digest.Digest, target string) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	record, ok := state.Images[source]
+	return ok && record.Digest == dgst && record.Target == target
+}
+
+// Record records the converted image and saves the state file.
+func (state *State) Record(source string, dgst digest.Digest, target string) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.Images[source] = StateRecord{Digest: dgst, Target: target}
+	return state.save()
+}
+
+// GetCursor returns the position to resume from, or nil if the last run
+// isn't interrupted.
+func (state *State) GetCursor() *Cursor {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.Cursor == nil {
+		return nil
+	}
+	cursor := *state.Cursor
+	return &cursor
+}
+
+// SetCursor records the position to resume from and saves the state file,
+// the cursor is removed if it's nil.
+func (state *State) SetCursor(cursor *Cursor) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.Cursor = cursor
+	return state.save()
+}
+
+// save replaces the state file atomically so it isn't broken if nydusify
+// is interrupted, the caller must hold the lock.
+func (state *State) save() error {
+	if state.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal state")
+	}
+	file, err := ioutil.TempFile(filepath.Dir(state.path), ".nydusify-state-")
+	if err != nil {
+		return errors.Wrap(err, "create state file")
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return errors.Wrap(err, "write state file")
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "close state file")
+	}
+	return errors.Wrap(os.Rename(file.Name(), state.path), "rename state file")
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mounter mounts a remote Nydus image to local mountpoint by
+// nydusd for inspection, the blobs are lazily pulled from storage backend
+// on access.
+package mounter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Opt defines Mounter options.
+type Opt struct {
+	WorkDir        string
+	Target         string
+	TargetInsecure bool
+	Mountpoint     string
+	NydusdPath     string
+	// BackendType and BackendConfig specify the storage backend of Nydus
+	// blobs, the blobs are pulled from target registry if it's empty.
+	BackendType   string
+	BackendConfig string
+}
+
+// Mounter pulls the bootstrap of Nydus image, and mounts the image by
+// nydusd with the blobs in storage backend.
+type Mounter struct {
+	Opt
+	parser *parser.Parser
+	nydusd *tool.Nydusd
+}
+
+// registryConfig is the registry backend config of nydusd.
+type registryConfig struct {
+	Scheme     string `json:"scheme"`
+	Host       string `json:"host"`
+	Repo       string `json:"repo"`
+	Auth       string `json:"auth,omitempty"`
+	SkipVerify bool   `json:"skip_verify"`
+}
+
+// New creates Mounter instance, target is the Nydus image reference.
+func New(opt Opt) (*Mounter, error) {
+	if opt.Mountpoint == "" {
+		return nil, errors.New("mountpoint is required")
+	}
+	targetRemote, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure)
+	if err != nil {
+		return nil, errors.Wrap(err, "init target image parser")
+	}
+	return &Mounter{
+		Opt:    opt,
+		parser: parser.New(targetRemote),
+	}, nil
+}
+
+// makeRegistryConfig generates the registry backend config of nydusd for
+// ref, the auth is read by the default credential chain.
+func makeRegistryConfig(ref string, insecure bool) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse reference %s", ref)
+	}
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+
+	scheme := "https"
+	localhost, err := docker.MatchLocalhost(host)
+	if err != nil {
+		return "", err
+	}
+	if insecure || localhost {
+		scheme = "http"
+	}
+
+	config := registryConfig{
+		Scheme:     scheme,
+		Host:       host,
+		Repo:       reference.Path(named),
+		SkipVerify: insecure,
+	}
+	username, password, err := provider.DefaultCredential(host)
+	if err != nil {
+		return "", errors.Wrap(err, "get registry auth")
+	}
+	if username == "" && password != "" {
+		// nydusd only accepts basic auth or bearer token
+		logrus.Warnf("Identity token of %s isn't supported by nydusd, use anonymous access", host)
+	} else if username != "" {
+		config.Auth = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Mount pulls the bootstrap of Nydus image to work directory, and starts
+// nydusd to mount the image read-only to mountpoint, nydusd keeps running
+// until Umount is called.
+func (mounter *Mounter) Mount(ctx context.Context) error {
+	parsed, err := mounter.parser.Parse(ctx)
+	if err != nil {
+		return errors.Wrap(err, "parse Nydus image")
+	}
+	if parsed.NydusImage == nil {
+		return fmt.Errorf("not found Nydus image in %s", mounter.Target)
+	}
+
+	if err := os.RemoveAll(mounter.WorkDir); err != nil {
+		return errors.Wrap(err, "clean up work directory")
+	}
+	blobCacheDir := filepath.Join(mounter.WorkDir, "blobs")
+	if err := os.MkdirAll(blobCacheDir, 0755); err != nil {
+		return errors.Wrap(err, "create work directory")
+	}
+	if err := os.MkdirAll(mounter.Mountpoint, 0755); err != nil {
+		return errors.Wrap(err, "create mountpoint")
+	}
+
+	bootstrapPath := filepath.Join(mounter.WorkDir, "nydus_bootstrap")
+	logrus.Infof("Pulling Nydus bootstrap to %s", bootstrapPath)
+	bootstrapReader, err := mounter.parser.PullNydusBootstrap(ctx, parsed.NydusImage)
+	if err != nil {
+		return errors.Wrap(err, "pull Nydus bootstrap layer")
+	}
+	defer bootstrapReader.Close()
+	if err := utils.UnpackFile(bootstrapReader, utils.BootstrapFileNameInLayer, bootstrapPath); err != nil {
+		return errors.Wrap(err, "unpack Nydus bootstrap layer")
+	}
+
+	backendType, backendConfig := mounter.BackendType, mounter.BackendConfig
+	if backendType == "" {
+		backendType = "registry"
+		if backendConfig, err = makeRegistryConfig(mounter.Target, mounter.TargetInsecure); err != nil {
+			return errors.Wrap(err, "generate registry backend config")
+		}
+	}
+
+	nydusd, err := tool.NewNydusd(tool.NydusdConfig{
+		NydusdPath:    mounter.NydusdPath,
+		BackendType:   backendType,
+		BackendConfig: backendConfig,
+		BootstrapPath: bootstrapPath,
+		ConfigPath:    filepath.Join(mounter.WorkDir, "nydusd_config.json"),
+		BlobCacheDir:  blobCacheDir,
+		MountPath:     mounter.Mountpoint,
+		APISockPath:   filepath.Join(mounter.WorkDir, "nydusd_api.sock"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "create Nydusd daemon")
+	}
+
+	logrus.Infof("Mounting Nydus image %s to %s", mounter.Target, mounter.Mountpoint)
+	if err := nydusd.Mount(); err != nil {
+		// Clean up the mountpoint if nydusd fails to get ready in time
+		if err := nydusd.Umount(); err != nil {
+			logrus.Warnf("Failed to umount Nydus image: %s", err)
+		}
+		return errors.Wrap(err, "mount Nydus image")
+	}
+	mounter.nydusd = nydusd
+
+	return nil
+}
+
+// Umount umounts the image and stops nydusd, it's no-op if the image
+// isn't mounted.
+func (mounter *Mounter) Umount() error {
+	if mounter.nydusd == nil {
+		return nil
+	}
+	logrus.Infof("Umounting Nydus image from %s", mounter.Mountpoint)
+	if err := mounter.nydusd.Umount(); err != nil {
+		return errors.Wrap(err, "umount Nydus image")
+	}
+	mounter.nydusd = nil
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mounter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeRegistryConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-mounter-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	require.Nil(t, ioutil.WriteFile(
+		filepath.Join(dir, "config.json"),
+		[]byte(`{"auths":{"myregistry.com":{"auth":"`+auth+`"}}}`),
+		0644,
+	))
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer os.Unsetenv("DOCKER_CONFIG")
+
+	parse := func(ref string, insecure bool) registryConfig {
+		b, err := makeRegistryConfig(ref, insecure)
+		require.Nil(t, err)
+		var config registryConfig
+		require.Nil(t, json.Unmarshal([]byte(b), &config))
+		return config
+	}
+
+	assert.Equal(t, registryConfig{
+		Scheme: "https",
+		Host:   "myregistry.com",
+		Repo:   "team/app",
+		Auth:   auth,
+	}, parse("myregistry.com/team/app:latest-nydus", false))
+
+	assert.Equal(t, registryConfig{
+		Scheme: "https",
+		Host:   "registry-1.docker.io",
+		Repo:   "library/busybox",
+	}, parse("busybox", false))
+
+	assert.Equal(t, registryConfig{
+		Scheme:     "http",
+		Host:       "insecure.com:5000",
+		Repo:       "app",
+		SkipVerify: true,
+	}, parse("insecure.com:5000/app", true))
+
+	assert.Equal(t, "http", parse("localhost:5000/app", false).Scheme)
+}
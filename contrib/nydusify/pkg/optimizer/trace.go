@@ -0,0 +1,112 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package optimizer parses the file access trace of a running container,
+// which is turned into the prefetch hint to rebuild the Nydus image, so
+// that the files accessed at startup are put in front of blobs and
+// prefetched by nydusd.
+package optimizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AccessPattern is a file access record exported by nydusd API
+// `/api/v1/metrics/pattern` with `access_pattern` enabled in config.
+type AccessPattern struct {
+	FilePath string `json:"file_path"`
+	NrRead   uint64 `json:"nr_read"`
+	// FirstAccessTime is in unit of seconds.
+	FirstAccessTime uint64 `json:"first_access_time"`
+}
+
+// ParseTrace parses the access trace and returns the absolute paths of
+// accessed files in order of first access. The trace is either the access
+// patterns in JSON exported by nydusd, or a file list with one absolute
+// path per line, in which the empty lines and `#` comments are ignored.
+func ParseTrace(r io.Reader) ([]string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read trace")
+	}
+
+	var paths []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if paths, err = parseAccessPatterns(trimmed); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			paths = append(paths, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, "read file list")
+		}
+	}
+
+	// Deduplicate the paths and keep the first occurrence
+	result := []string{}
+	seen := map[string]struct{}{}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, errors.Errorf("path %s in trace should be absolute", p)
+		}
+		p = path.Clean(p)
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// parseAccessPatterns sorts the access patterns by first access time, the
+// patterns accessed at the same second are sorted by read count.
+func parseAccessPatterns(data []byte) ([]string, error) {
+	var patterns []AccessPattern
+	if err := json.Unmarshal(data, &patterns); err != nil {
+		return nil, errors.Wrap(err, "unmarshal access patterns")
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		if patterns[i].FirstAccessTime != patterns[j].FirstAccessTime {
+			return patterns[i].FirstAccessTime < patterns[j].FirstAccessTime
+		}
+		if patterns[i].NrRead != patterns[j].NrRead {
+			return patterns[i].NrRead > patterns[j].NrRead
+		}
+		return patterns[i].FilePath < patterns[j].FilePath
+	})
+	paths := []string{}
+	for _, pattern := range patterns {
+		if pattern.NrRead == 0 {
+			continue
+		}
+		paths = append(paths, pattern.FilePath)
+	}
+	return paths, nil
+}
+
+// PrefetchHint makes the prefetch hint passed to nydus-image from paths,
+// at most limit paths are kept if limit is greater than 0.
+func PrefetchHint(paths []string, limit int) string {
+	if limit > 0 && len(paths) > limit {
+		paths = paths[:limit]
+	}
+	return strings.Join(paths, "\n")
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package optimizer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFileList(t *testing.T) {
+	paths, err := ParseTrace(strings.NewReader(`
+# startup files
+/usr/bin/python3
+/etc/hosts
+
+/usr/lib/../lib/libc.so
+/etc/hosts
+`))
+	require.Nil(t, err)
+	assert.Equal(t, []string{"/usr/bin/python3", "/etc/hosts", "/usr/lib/libc.so"}, paths)
+
+	_, err = ParseTrace(strings.NewReader("etc/hosts\n"))
+	assert.Contains(t, err.Error(), "should be absolute")
+
+	paths, err = ParseTrace(strings.NewReader(""))
+	require.Nil(t, err)
+	assert.Empty(t, paths)
+}
+
+func TestParseAccessPatterns(t *testing.T) {
+	paths, err := ParseTrace(strings.NewReader(`[
+  {"file_path":"/app/main.py","nr_read":2,"first_access_time":1600000002},
+  {"file_path":"/usr/lib/libc.so","nr_read":1,"first_access_time":1600000001},
+  {"file_path":"/usr/bin/python3","nr_read":5,"first_access_time":1600000001},
+  {"file_path":"/tmp/unused","nr_read":0,"first_access_time":0}
+]`))
+	require.Nil(t, err)
+	assert.Equal(t, []string{"/usr/bin/python3", "/usr/lib/libc.so", "/app/main.py"}, paths)
+
+	_, err = ParseTrace(strings.NewReader(`[{"file_path":`))
+	assert.Contains(t, err.Error(), "unmarshal access patterns")
+}
+
+func TestPrefetchHint(t *testing.T) {
+	paths := []string{"/a", "/b", "/c"}
+	assert.Equal(t, "/a\n/b\n/c", PrefetchHint(paths, 0))
+	assert.Equal(t, "/a\n/b", PrefetchHint(paths, 2))
+}
@@ -0,0 +1,299 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package packer packs an arbitrary directory, e.g. a dataset or model,
+// into a standalone RAFS filesystem and distributes it as an OCI artifact
+// over registry, and unpacks the artifact back to a directory.
+package packer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/mounter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// The whiteout spec of source directory, the files in a plain directory
+// are never whiteouts except the unusual 0/0 character devices.
+const sourceWhiteoutSpec = "overlayfs"
+
+// ArtifactConfig is the config of RAFS artifact, it's referenced by the
+// manifest with media type utils.MediaTypeNydusArtifactConfig.
+type ArtifactConfig struct {
+	Created    *time.Time `json:"created,omitempty"`
+	FsVersion  string     `json:"fs_version,omitempty"`
+	Compressor string     `json:"compressor,omitempty"`
+	// FileCount and Size are the count of files and the total size of
+	// regular files in source directory.
+	FileCount int   `json:"file_count"`
+	Size      int64 `json:"size"`
+}
+
+// PackOpt defines the options of packing directory.
+type PackOpt struct {
+	WorkDir        string
+	NydusImagePath string
+	SourceDir      string
+	TargetRemote   *remote.Remote
+	// Compressor, FsVersion and ChunkSize are passed to nydus-image, see
+	// build.BuilderOption.
+	Compressor string
+	FsVersion  string
+	ChunkSize  uint64
+}
+
+// built is the RAFS filesystem built from source directory.
+type built struct {
+	bootstrapPath string
+	// blobPath is empty if there is no regular file in source directory.
+	blobPath  string
+	blobSize  int64
+	fileCount int
+	size      int64
+}
+
+// Pack builds the bootstrap and blob of source directory, and pushes them
+// as an OCI artifact, the manifest descriptor is returned.
+func Pack(ctx context.Context, opt PackOpt) (*ocispec.Descriptor, error) {
+	info, err := os.Stat(opt.SourceDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Stat source directory")
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Source %s isn't a directory", opt.SourceDir)
+	}
+
+	if err := os.RemoveAll(opt.WorkDir); err != nil {
+		return nil, errors.Wrap(err, "Clean up work directory")
+	}
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Create work directory")
+	}
+	defer os.RemoveAll(opt.WorkDir)
+
+	workflow, err := build.NewWorkflow(build.WorkflowOption{
+		TargetDir:      opt.WorkDir,
+		NydusImagePath: opt.NydusImagePath,
+		Compressor:     opt.Compressor,
+		FsVersion:      opt.FsVersion,
+		ChunkSize:      opt.ChunkSize,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Create build workflow")
+	}
+
+	bootstrapPath := filepath.Join(opt.WorkDir, "bootstrap")
+	logrus.Infof("Building RAFS filesystem from %s", opt.SourceDir)
+	result, err := workflow.Build(opt.SourceDir, sourceWhiteoutSpec, "", bootstrapPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Build RAFS filesystem")
+	}
+	logrus.Infof("Built RAFS filesystem with %d files in %s", result.FileCount, result.Duration)
+
+	return push(ctx, opt, built{
+		bootstrapPath: bootstrapPath,
+		blobPath:      result.BlobPath,
+		blobSize:      result.BlobSize,
+		fileCount:     result.FileCount,
+		size:          result.UncompressedSize,
+	})
+}
+
+// push pushes the blob, bootstrap layer, config and manifest of artifact.
+func push(ctx context.Context, opt PackOpt, fs built) (*ocispec.Descriptor, error) {
+	layers := []ocispec.Descriptor{}
+
+	if fs.blobPath != "" {
+		blobDesc := ocispec.Descriptor{
+			MediaType: utils.MediaTypeNydusBlob,
+			Digest:    digest.NewDigestFromEncoded(digest.SHA256, filepath.Base(fs.blobPath)),
+			Size:      fs.blobSize,
+			Annotations: map[string]string{
+				utils.LayerAnnotationNydusBlob: "true",
+			},
+		}
+		if opt.Compressor != "" {
+			blobDesc.Annotations[utils.LayerAnnotationNydusCompressor] = opt.Compressor
+		}
+		logrus.Infof("Pushing RAFS blob %s", blobDesc.Digest)
+		if err := utils.WithRetry(func() error {
+			blobFile, err := os.Open(fs.blobPath)
+			if err != nil {
+				return errors.Wrap(err, "Open blob file")
+			}
+			defer blobFile.Close()
+			return opt.TargetRemote.PushBlob(ctx, blobDesc, blobFile)
+		}); err != nil {
+			return nil, errors.Wrap(err, "Push blob layer")
+		}
+		layers = append(layers, blobDesc)
+	}
+
+	bootstrapDesc, err := pushBootstrap(ctx, opt, fs.bootstrapPath)
+	if err != nil {
+		return nil, err
+	}
+	layers = append(layers, *bootstrapDesc)
+
+	created := time.Now().UTC()
+	config := ArtifactConfig{
+		Created:    &created,
+		FsVersion:  opt.FsVersion,
+		Compressor: opt.Compressor,
+		FileCount:  fs.fileCount,
+		Size:       fs.size,
+	}
+	configDesc, configBytes, err := utils.MarshalToDesc(config, utils.MediaTypeNydusArtifactConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal artifact config")
+	}
+	if err := opt.TargetRemote.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push artifact config")
+	}
+
+	manifest := struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Manifest: ocispec.Manifest{
+			Versioned: specs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: *configDesc,
+			Layers: layers,
+			Annotations: map[string]string{
+				ocispec.AnnotationCreated: created.Format(time.RFC3339),
+			},
+		},
+	}
+	manifestDesc, manifestBytes, err := utils.MarshalToDesc(manifest, ocispec.MediaTypeImageManifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal artifact manifest")
+	}
+	if err := opt.TargetRemote.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push artifact manifest")
+	}
+
+	return manifestDesc, nil
+}
+
+// pushBootstrap pushes the bootstrap in the same layer format as Nydus
+// image, so that the artifact can be mounted by the tools for image.
+func pushBootstrap(ctx context.Context, opt PackOpt, bootstrapPath string) (*ocispec.Descriptor, error) {
+	compressedDigest, compressedSize, err := utils.PackTargzInfo(bootstrapPath, utils.BootstrapFileNameInLayer, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Calculate compressed bootstrap digest")
+	}
+	uncompressedDigest, _, err := utils.PackTargzInfo(bootstrapPath, utils.BootstrapFileNameInLayer, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "Calculate uncompressed bootstrap digest")
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    compressedDigest,
+		Size:      compressedSize,
+		Annotations: map[string]string{
+			utils.LayerAnnotationUncompressed:   uncompressedDigest.String(),
+			utils.LayerAnnotationNydusBootstrap: "true",
+		},
+	}
+	if opt.Compressor != "" {
+		desc.Annotations[utils.LayerAnnotationNydusCompressor] = opt.Compressor
+	}
+	if opt.FsVersion != "" {
+		desc.Annotations[utils.LayerAnnotationNydusFsVersion] = opt.FsVersion
+	}
+
+	if err := utils.WithRetry(func() error {
+		reader, err := utils.PackTargz(bootstrapPath, utils.BootstrapFileNameInLayer, true)
+		if err != nil {
+			return errors.Wrap(err, "Compress bootstrap layer")
+		}
+		defer reader.Close()
+		return opt.TargetRemote.Push(ctx, desc, true, reader)
+	}); err != nil {
+		return nil, errors.Wrap(err, "Push bootstrap layer")
+	}
+
+	return &desc, nil
+}
+
+// UnpackOpt defines the options of unpacking artifact.
+type UnpackOpt struct {
+	WorkDir        string
+	Source         string
+	SourceInsecure bool
+	TargetDir      string
+	NydusdPath     string
+	// BackendType and BackendConfig specify the storage backend of blob,
+	// the blob is pulled from source registry if it's empty.
+	BackendType   string
+	BackendConfig string
+}
+
+// Unpack mounts the RAFS artifact by nydusd, and copies all the files in
+// it to target directory.
+func Unpack(ctx context.Context, opt UnpackOpt) error {
+	if err := os.MkdirAll(opt.TargetDir, 0755); err != nil {
+		return errors.Wrap(err, "Create target directory")
+	}
+
+	mountpoint := filepath.Join(opt.WorkDir, "mnt")
+	m, err := mounter.New(mounter.Opt{
+		WorkDir:        filepath.Join(opt.WorkDir, "nydus"),
+		Target:         opt.Source,
+		TargetInsecure: opt.SourceInsecure,
+		Mountpoint:     mountpoint,
+		NydusdPath:     opt.NydusdPath,
+		BackendType:    opt.BackendType,
+		BackendConfig:  opt.BackendConfig,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Create mounter")
+	}
+	if err := m.Mount(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.Umount(); err != nil {
+			logrus.Warnf("Failed to umount artifact: %s", err)
+		}
+		os.RemoveAll(opt.WorkDir)
+	}()
+
+	logrus.Infof("Unpacking %s to %s", opt.Source, opt.TargetDir)
+	return copyDir(ctx, mountpoint, opt.TargetDir)
+}
+
+// copyDir copies the files in source to target by a tar stream, the
+// owners, modes, xattrs and hardlinks are kept.
+func copyDir(ctx context.Context, source, target string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(archive.WriteDiff(ctx, writer, "", source))
+	}()
+	defer reader.Close()
+
+	if _, err := archive.Apply(ctx, target, reader); err != nil {
+		return errors.Wrap(err, "Copy files to target directory")
+	}
+	return nil
+}
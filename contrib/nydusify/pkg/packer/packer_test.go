@@ -0,0 +1,113 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package packer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-packer-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	blob := []byte("blob data")
+	blobPath := filepath.Join(dir, digest.FromBytes(blob).Hex())
+	require.Nil(t, ioutil.WriteFile(blobPath, blob, 0644))
+	bootstrapPath := filepath.Join(dir, "bootstrap")
+	require.Nil(t, ioutil.WriteFile(bootstrapPath, []byte("bootstrap"), 0644))
+
+	ctx := context.Background()
+	layout, err := remote.NewLayout(filepath.Join(dir, "layout"), "v1")
+	require.Nil(t, err)
+	desc, err := push(ctx, PackOpt{TargetRemote: layout, Compressor: "zstd", FsVersion: "6"}, built{
+		bootstrapPath: bootstrapPath,
+		blobPath:      blobPath,
+		blobSize:      int64(len(blob)),
+		fileCount:     3,
+		size:          100,
+	})
+	require.Nil(t, err)
+
+	// The artifact is recognized as Nydus image
+	imageParser := parser.New(layout)
+	parsed, err := imageParser.Parse(ctx)
+	require.Nil(t, err)
+	require.NotNil(t, parsed.NydusImage)
+	assert.Equal(t, desc.Digest, parsed.NydusImage.Desc.Digest)
+	manifest := parsed.NydusImage.Manifest
+	assert.Equal(t, utils.MediaTypeNydusArtifactConfig, manifest.Config.MediaType)
+	require.Len(t, manifest.Layers, 2)
+	assert.Equal(t, utils.MediaTypeNydusBlob, manifest.Layers[0].MediaType)
+	assert.Equal(t, digest.FromBytes(blob), manifest.Layers[0].Digest)
+	assert.Equal(t, "6", manifest.Layers[1].Annotations[utils.LayerAnnotationNydusFsVersion])
+
+	reader, err := layout.Pull(ctx, manifest.Config, true)
+	require.Nil(t, err)
+	var config ArtifactConfig
+	require.Nil(t, json.NewDecoder(reader).Decode(&config))
+	reader.Close()
+	assert.Equal(t, 3, config.FileCount)
+	assert.Equal(t, int64(100), config.Size)
+	assert.Equal(t, "zstd", config.Compressor)
+
+	reader, err = imageParser.PullNydusBootstrap(ctx, parsed.NydusImage)
+	require.Nil(t, err)
+	defer reader.Close()
+	pulledPath := filepath.Join(dir, "pulled")
+	require.Nil(t, utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, pulledPath))
+	pulled, err := ioutil.ReadFile(pulledPath)
+	require.Nil(t, err)
+	assert.Equal(t, "bootstrap", string(pulled))
+
+	// Only bootstrap for the directory without regular file
+	layout, err = remote.NewLayout(filepath.Join(dir, "empty"), "v1")
+	require.Nil(t, err)
+	_, err = push(ctx, PackOpt{TargetRemote: layout}, built{bootstrapPath: bootstrapPath})
+	require.Nil(t, err)
+	parsed, err = parser.New(layout).Parse(ctx)
+	require.Nil(t, err)
+	require.NotNil(t, parsed.NydusImage)
+	assert.Len(t, parsed.NydusImage.Manifest.Layers, 1)
+}
+
+func TestCopyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-packer-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	require.Nil(t, os.MkdirAll(filepath.Join(source, "models", "v1"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(source, "models", "v1", "weights.bin"), []byte("weights"), 0600))
+	require.Nil(t, os.Link(filepath.Join(source, "models", "v1", "weights.bin"), filepath.Join(source, "models", "latest.bin")))
+	require.Nil(t, os.Symlink("v1", filepath.Join(source, "models", "current")))
+
+	target := filepath.Join(dir, "target")
+	require.Nil(t, os.MkdirAll(target, 0755))
+	require.Nil(t, copyDir(context.Background(), source, target))
+
+	data, err := ioutil.ReadFile(filepath.Join(target, "models", "current", "weights.bin"))
+	require.Nil(t, err)
+	assert.Equal(t, "weights", string(data))
+	info, err := os.Stat(filepath.Join(target, "models", "v1", "weights.bin"))
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	linked, err := os.Stat(filepath.Join(target, "models", "latest.bin"))
+	require.Nil(t, err)
+	assert.True(t, os.SameFile(info, linked))
+}
@@ -57,7 +57,8 @@ func findNydusBootstrapDesc(manifest *ocispec.Manifest) *ocispec.Descriptor {
 	if len(layers) != 0 {
 		desc := &layers[len(layers)-1]
 		if (desc.MediaType == ocispec.MediaTypeImageLayerGzip ||
-			desc.MediaType == images.MediaTypeDockerSchema2LayerGzip) &&
+			desc.MediaType == images.MediaTypeDockerSchema2LayerGzip ||
+			desc.MediaType == utils.MediaTypeImageLayerZstd) &&
 			desc.Annotations[utils.LayerAnnotationNydusBootstrap] == "true" {
 			return desc
 		}
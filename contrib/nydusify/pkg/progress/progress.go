@@ -0,0 +1,330 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package progress reports the structured progress of conversion, e.g.
+// the pulled, built and pushed bytes of each layer, to the terminal in
+// human readable lines, and optionally to a JSON event stream with one
+// event per line, so that the CI systems and UIs embedding nydusify can
+// render the progress instead of parsing logs.
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// Stage is the stage of conversion that a task belongs to.
+type Stage string
+
+const (
+	StageConvert Stage = "convert"
+	StagePull    Stage = "pull"
+	StageBuild   Stage = "build"
+	StagePush    Stage = "push"
+)
+
+const (
+	EventStart    = "start"
+	EventProgress = "progress"
+	EventDone     = "done"
+	EventError    = "error"
+)
+
+const defaultInterval = time.Second
+
+// Event is the progress event of a task.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Stage Stage     `json:"stage"`
+	// ID identifies the task in stage, it's the digest of layer for the
+	// layer tasks, or the image reference for convert stage.
+	ID string `json:"id"`
+	// Current and Total are in bytes, Total is 0 if it's unknown.
+	Current int64   `json:"current"`
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent"`
+	// ETA is the estimated seconds to finish the task, it's 0 if unknown.
+	ETA     float64 `json:"eta,omitempty"`
+	Elapsed float64 `json:"elapsed"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type Opt struct {
+	// Terminal receives the human readable progress lines, e.g. stderr.
+	Terminal io.Writer
+	// JSON receives the JSON event stream.
+	JSON io.Writer
+	// Interval is the minimum interval between the progress events of a
+	// task, defaults to 1s, the start and end events are always emitted.
+	Interval time.Duration
+	// Hook receives every event, e.g. for collecting metrics.
+	Hook func(Event)
+}
+
+// Reporter emits the progress events of tasks, it's safe for concurrent
+// use, and a nil Reporter discards all events.
+type Reporter struct {
+	Opt
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func New(opt Opt) *Reporter {
+	if opt.Interval <= 0 {
+		opt.Interval = defaultInterval
+	}
+	reporter := &Reporter{Opt: opt}
+	if opt.JSON != nil {
+		reporter.encoder = json.NewEncoder(opt.JSON)
+	}
+	return reporter
+}
+
+// WithHook returns a reporter emitting events to the same targets as
+// reporter, and to hook after the hook of reporter. It returns a reporter
+// emitting events to hook only if reporter is nil.
+func (reporter *Reporter) WithHook(hook func(Event)) *Reporter {
+	if reporter == nil {
+		return New(Opt{Hook: hook})
+	}
+	opt := reporter.Opt
+	if parent := reporter.Hook; parent != nil {
+		opt.Hook = func(event Event) {
+			parent(event)
+			hook(event)
+		}
+	} else {
+		opt.Hook = hook
+	}
+	return New(opt)
+}
+
+// Open opens the JSON event stream target, in format `fd://<number>` for
+// an inherited file descriptor, `unix://<path>` for a unix socket to
+// connect, or a file path to append.
+func Open(target string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasPrefix(target, "fd://"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, "fd://"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("Invalid file descriptor %s", target)
+		}
+		return os.NewFile(uintptr(fd), target), nil
+	case strings.HasPrefix(target, "unix://"):
+		conn, err := net.Dial("unix", strings.TrimPrefix(target, "unix://"))
+		if err != nil {
+			return nil, errors.Wrap(err, "Connect progress socket")
+		}
+		return conn, nil
+	default:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "Open progress file")
+		}
+		return file, nil
+	}
+}
+
+// Start starts a task of stage, total is the size in bytes of the task,
+// 0 if it's unknown.
+func (reporter *Reporter) Start(stage Stage, id string, total int64) *Task {
+	if reporter == nil {
+		return nil
+	}
+	task := &Task{
+		reporter: reporter,
+		stage:    stage,
+		id:       id,
+		total:    total,
+		start:    time.Now(),
+	}
+	task.emit(EventStart, nil)
+	return task
+}
+
+func (reporter *Reporter) emit(event Event) {
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+
+	if reporter.Terminal != nil {
+		fmt.Fprintln(reporter.Terminal, formatEvent(event))
+	}
+	if reporter.encoder != nil {
+		// The progress is best effort, the conversion goes on if the
+		// receiver is gone.
+		_ = reporter.encoder.Encode(event)
+	}
+	if reporter.Hook != nil {
+		reporter.Hook(event)
+	}
+}
+
+func formatEvent(event Event) string {
+	line := fmt.Sprintf("[%s] %s %s", strings.ToUpper(string(event.Stage)), event.ID, event.Type)
+	switch event.Type {
+	case EventStart:
+		if event.Total > 0 {
+			line += fmt.Sprintf(" %s", humanize.Bytes(uint64(event.Total)))
+		}
+	case EventProgress:
+		if event.Total > 0 {
+			line += fmt.Sprintf(" %.1f%% %s/%s", event.Percent,
+				humanize.Bytes(uint64(event.Current)), humanize.Bytes(uint64(event.Total)))
+		} else {
+			line += fmt.Sprintf(" %s", humanize.Bytes(uint64(event.Current)))
+		}
+		if event.ETA > 0 {
+			line += fmt.Sprintf(" ETA %s", time.Duration(event.ETA*float64(time.Second)).Round(time.Second))
+		}
+	case EventDone:
+		line += fmt.Sprintf(" in %s", time.Duration(event.Elapsed*float64(time.Second)).Round(time.Millisecond))
+	case EventError:
+		line += fmt.Sprintf(": %s", event.Error)
+	}
+	return line
+}
+
+// Task is a unit of work in stage, a nil Task discards all updates.
+type Task struct {
+	reporter *Reporter
+	stage    Stage
+	id       string
+	total    int64
+	start    time.Time
+
+	mu       sync.Mutex
+	current  int64
+	lastEmit time.Time
+}
+
+func (task *Task) emit(typ string, err error) {
+	task.mu.Lock()
+	elapsed := time.Since(task.start)
+	event := Event{
+		Time:    time.Now(),
+		Type:    typ,
+		Stage:   task.stage,
+		ID:      task.id,
+		Current: task.current,
+		Total:   task.total,
+		Elapsed: elapsed.Seconds(),
+	}
+	task.lastEmit = event.Time
+	task.mu.Unlock()
+
+	if event.Total > 0 {
+		event.Percent = float64(event.Current) * 100 / float64(event.Total)
+		if event.Current > 0 && event.Current < event.Total && typ == EventProgress {
+			rate := float64(event.Current) / elapsed.Seconds()
+			event.ETA = float64(event.Total-event.Current) / rate
+		}
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	task.reporter.emit(event)
+}
+
+// Add adds the finished bytes of task.
+func (task *Task) Add(n int64) {
+	if task == nil || n <= 0 {
+		return
+	}
+	task.mu.Lock()
+	task.current += n
+	due := time.Since(task.lastEmit) >= task.reporter.Interval
+	task.mu.Unlock()
+
+	if due {
+		task.emit(EventProgress, nil)
+	}
+}
+
+// Reset clears the finished bytes, e.g. when the task is retried.
+func (task *Task) Reset() {
+	if task == nil {
+		return
+	}
+	task.mu.Lock()
+	task.current = 0
+	task.mu.Unlock()
+}
+
+// Done ends the task, the task is failed if err isn't nil, it returns err
+// as it is.
+func (task *Task) Done(err error) error {
+	if task == nil {
+		return err
+	}
+	if err != nil {
+		task.emit(EventError, err)
+		return err
+	}
+	task.mu.Lock()
+	if task.total > 0 {
+		task.current = task.total
+	}
+	task.mu.Unlock()
+	task.emit(EventDone, nil)
+	return nil
+}
+
+type reader struct {
+	io.Reader
+	task *Task
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.task.Add(int64(n))
+	return n, err
+}
+
+// Reader counts the bytes read from r as the progress of task.
+func (task *Task) Reader(r io.Reader) io.Reader {
+	if task == nil {
+		return r
+	}
+	return &reader{Reader: r, task: task}
+}
+
+type reporterKey struct{}
+type taskKey struct{}
+
+// WithReporter attaches reporter to ctx, so that the source providers and
+// storage backends can report progress.
+func WithReporter(ctx context.Context, reporter *Reporter) context.Context {
+	return context.WithValue(ctx, reporterKey{}, reporter)
+}
+
+// FromContext returns the reporter attached to ctx, or nil.
+func FromContext(ctx context.Context) *Reporter {
+	reporter, _ := ctx.Value(reporterKey{}).(*Reporter)
+	return reporter
+}
+
+// WithTask attaches task to ctx, so that the callee doing the transfer can
+// report the bytes of task started by caller.
+func WithTask(ctx context.Context, task *Task) context.Context {
+	return context.WithValue(ctx, taskKey{}, task)
+}
+
+// TaskFromContext returns the task attached to ctx, or nil.
+func TaskFromContext(ctx context.Context) *Task {
+	task, _ := ctx.Value(taskKey{}).(*Task)
+	return task
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package progress
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeEvents(t *testing.T, data []byte) []Event {
+	events := []Event{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var event Event
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestReporter(t *testing.T) {
+	var terminal, stream bytes.Buffer
+	reporter := New(Opt{Terminal: &terminal, JSON: &stream, Interval: -1})
+	// The interval defaults to 1s
+	assert.Equal(t, defaultInterval, reporter.Interval)
+	reporter.Interval = 1
+
+	task := reporter.Start(StagePull, "sha256:aaa", 10)
+	data, err := ioutil.ReadAll(task.Reader(strings.NewReader("hello")))
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+	require.Nil(t, task.Done(nil))
+
+	failed := reporter.Start(StagePush, "sha256:bbb", 0)
+	assert.EqualError(t, failed.Done(fmt.Errorf("broken pipe")), "broken pipe")
+
+	events := decodeEvents(t, stream.Bytes())
+	require.Len(t, events, 5)
+
+	assert.Equal(t, EventStart, events[0].Type)
+	assert.Equal(t, StagePull, events[0].Stage)
+	assert.Equal(t, "sha256:aaa", events[0].ID)
+	assert.Equal(t, int64(10), events[0].Total)
+
+	assert.Equal(t, EventProgress, events[1].Type)
+	assert.Equal(t, int64(5), events[1].Current)
+	assert.Equal(t, float64(50), events[1].Percent)
+
+	assert.Equal(t, EventDone, events[2].Type)
+	assert.Equal(t, int64(10), events[2].Current)
+	assert.Equal(t, float64(100), events[2].Percent)
+
+	assert.Equal(t, EventStart, events[3].Type)
+	assert.Equal(t, StagePush, events[3].Stage)
+	assert.Equal(t, EventError, events[4].Type)
+	assert.Equal(t, "broken pipe", events[4].Error)
+
+	lines := strings.Split(strings.TrimSpace(terminal.String()), "\n")
+	require.Len(t, lines, 5)
+	assert.Equal(t, "[PULL] sha256:aaa start 10 B", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "[PULL] sha256:aaa progress 50.0% 5 B/10 B"))
+	assert.Equal(t, "[PUSH] sha256:bbb error: broken pipe", lines[4])
+}
+
+func TestReporterInterval(t *testing.T) {
+	var stream bytes.Buffer
+	reporter := New(Opt{JSON: &stream})
+
+	task := reporter.Start(StageBuild, "sha256:aaa", 0)
+	for i := 0; i < 100; i++ {
+		task.Add(1)
+	}
+	task.Reset()
+	task.Add(3)
+	require.Nil(t, task.Done(nil))
+
+	// The progress events are throttled, only the start and end events are
+	// emitted in one interval
+	events := decodeEvents(t, stream.Bytes())
+	require.Len(t, events, 2)
+	assert.Equal(t, EventDone, events[1].Type)
+	assert.Equal(t, int64(3), events[1].Current)
+}
+
+func TestNilReporter(t *testing.T) {
+	var reporter *Reporter
+	task := reporter.Start(StageConvert, "busybox", 0)
+	assert.Nil(t, task)
+
+	task.Add(1)
+	task.Reset()
+	r := strings.NewReader("hello")
+	assert.Equal(t, r, task.Reader(r))
+	assert.Nil(t, task.Done(nil))
+	assert.EqualError(t, task.Done(fmt.Errorf("failed")), "failed")
+
+	ctx := context.Background()
+	assert.Nil(t, FromContext(ctx))
+	assert.Nil(t, TaskFromContext(ctx))
+}
+
+func TestContext(t *testing.T) {
+	reporter := New(Opt{})
+	task := reporter.Start(StagePush, "sha256:aaa", 0)
+
+	ctx := WithTask(WithReporter(context.Background(), reporter), task)
+	assert.Equal(t, reporter, FromContext(ctx))
+	assert.Equal(t, task, TaskFromContext(ctx))
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-progress")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "progress.jsonl")
+	require.Nil(t, ioutil.WriteFile(path, []byte("{}\n"), 0644))
+
+	w, err := Open(path)
+	require.Nil(t, err)
+	reporter := New(Opt{JSON: w})
+	require.Nil(t, reporter.Start(StageConvert, "busybox", 0).Done(nil))
+	require.Nil(t, w.Close())
+
+	// The events are appended to the existing file
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	events := decodeEvents(t, data)
+	require.Len(t, events, 3)
+	assert.Equal(t, EventStart, events[1].Type)
+	assert.Equal(t, EventDone, events[2].Type)
+
+	_, err = Open("fd://abc")
+	assert.NotNil(t, err)
+	_, err = Open("unix://" + filepath.Join(dir, "nonexistent.sock"))
+	assert.NotNil(t, err)
+}
+
+func TestWithHook(t *testing.T) {
+	events := []string{}
+	hook := func(name string) func(Event) {
+		return func(event Event) {
+			events = append(events, name+" "+event.Type)
+		}
+	}
+
+	var reporter *Reporter
+	require.Nil(t, reporter.WithHook(hook("first")).Start(StageConvert, "busybox", 0).Done(nil))
+	assert.Equal(t, []string{"first start", "first done"}, events)
+
+	var stream bytes.Buffer
+	events = []string{}
+	reporter = New(Opt{JSON: &stream, Hook: hook("first")}).WithHook(hook("second"))
+	require.Nil(t, reporter.Start(StageConvert, "busybox", 0).Done(nil))
+	assert.Equal(t, []string{"first start", "second start", "first done", "second done"}, events)
+	assert.Len(t, decodeEvents(t, stream.Bytes()), 2)
+}
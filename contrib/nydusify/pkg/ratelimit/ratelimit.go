@@ -0,0 +1,130 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ratelimit caps the bandwidth of pulling and pushing, the limit is
+// shared by all concurrent transfers, so that the conversions running on
+// shared build hosts don't saturate the uplink to registry.
+package ratelimit
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// The maximum bytes taken from limiter at a time, the transfer larger than
+// it waits for the limiter in chunks, so that the concurrent transfers share
+// the bandwidth fairly.
+const maxChunk = 64 * 1024
+
+// Limiter limits the bytes per second of transfers, a nil Limiter doesn't
+// limit anything.
+type Limiter struct {
+	limiter *rate.Limiter
+	chunk   int
+}
+
+// New creates a limiter of bytesPerSec, it returns nil if bytesPerSec isn't
+// positive.
+func New(bytesPerSec int64) *Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	chunk := maxChunk
+	if bytesPerSec < int64(chunk) {
+		chunk = int(bytesPerSec)
+	}
+	return &Limiter{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSec), chunk),
+		chunk:   chunk,
+	}
+}
+
+// Wait blocks until the limiter permits n bytes to be transferred, or ctx
+// is done.
+func (limiter *Limiter) Wait(ctx context.Context, n int64) error {
+	if limiter == nil {
+		return nil
+	}
+	for n > 0 {
+		chunk := limiter.chunk
+		if n < int64(chunk) {
+			chunk = int(n)
+		}
+		if err := limiter.limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= int64(chunk)
+	}
+	return nil
+}
+
+type reader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	// Read at most one chunk at a time to keep the transfer smooth
+	if len(p) > r.limiter.chunk {
+		p = p[:r.limiter.chunk]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if werr := r.limiter.Wait(r.ctx, int64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Reader limits the bytes read from r.
+func (limiter *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &reader{ctx: ctx, reader: r, limiter: limiter}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ReadCloser limits the bytes read from rc.
+func (limiter *Limiter) ReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if limiter == nil {
+		return rc
+	}
+	return &readCloser{Reader: limiter.Reader(ctx, rc), Closer: rc}
+}
+
+type pullKey struct{}
+type pushKey struct{}
+
+// WithPullLimiter attaches the limiter of pulling to ctx, so that the
+// remotes pulling blobs share it.
+func WithPullLimiter(ctx context.Context, limiter *Limiter) context.Context {
+	return context.WithValue(ctx, pullKey{}, limiter)
+}
+
+// PullLimiter returns the limiter of pulling attached to ctx, or nil.
+func PullLimiter(ctx context.Context) *Limiter {
+	limiter, _ := ctx.Value(pullKey{}).(*Limiter)
+	return limiter
+}
+
+// WithPushLimiter attaches the limiter of pushing to ctx, so that the
+// remotes and storage backends pushing blobs share it.
+func WithPushLimiter(ctx context.Context, limiter *Limiter) context.Context {
+	return context.WithValue(ctx, pushKey{}, limiter)
+}
+
+// PushLimiter returns the limiter of pushing attached to ctx, or nil.
+func PushLimiter(ctx context.Context) *Limiter {
+	limiter, _ := ctx.Value(pushKey{}).(*Limiter)
+	return limiter
+}
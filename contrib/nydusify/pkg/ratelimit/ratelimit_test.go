@@ -0,0 +1,83 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNilLimiter(t *testing.T) {
+	assert.Nil(t, New(0))
+	assert.Nil(t, New(-1))
+
+	var limiter *Limiter
+	r := strings.NewReader("hello")
+	assert.Equal(t, r, limiter.Reader(context.Background(), r))
+	rc := ioutil.NopCloser(r)
+	assert.Equal(t, rc, limiter.ReadCloser(context.Background(), rc))
+	assert.Nil(t, limiter.Wait(context.Background(), 1<<30))
+
+	ctx := context.Background()
+	assert.Nil(t, PullLimiter(ctx))
+	assert.Nil(t, PushLimiter(ctx))
+}
+
+func TestReader(t *testing.T) {
+	limiter := New(1000)
+	data := bytes.Repeat([]byte("a"), 1500)
+
+	// The first 1000 bytes are taken from the initial burst, and the rest
+	// 500 bytes take 0.5s
+	start := time.Now()
+	read, err := ioutil.ReadAll(limiter.Reader(context.Background(), bytes.NewReader(data)))
+	require.Nil(t, err)
+	assert.Equal(t, data, read)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, elapsed)
+	assert.True(t, elapsed < 2*time.Second, elapsed)
+}
+
+func TestSharedLimiter(t *testing.T) {
+	limiter := New(2000)
+	ctx := WithPushLimiter(context.Background(), limiter)
+	assert.Equal(t, limiter, PushLimiter(ctx))
+	assert.Nil(t, PullLimiter(ctx))
+
+	// The concurrent readers share the limit, 4000 bytes in total take 1s
+	// after the initial burst
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc := PushLimiter(ctx).ReadCloser(ctx, ioutil.NopCloser(bytes.NewReader(make([]byte, 2000))))
+			defer rc.Close()
+			_, err := ioutil.ReadAll(rc)
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 900*time.Millisecond, elapsed)
+}
+
+func TestWaitCanceled(t *testing.T) {
+	limiter := New(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := ioutil.ReadAll(limiter.Reader(ctx, bytes.NewReader(make([]byte, 1000))))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxDrainSize is the maximum size of content left unread, which is read
+// out on closing for committing the blob.
+const maxDrainSize = 1 << 20
+
+// ContentStore stores blobs on local disk in `blobs/<algorithm>/<hex>`
+// like containerd content store, it's shared across conversions to avoid
+// pulling the same blobs from registry again. The modification time of
+// blob file is updated on each access, the least recently used blobs are
+// removed once the total size of blobs exceeds the capacity.
+type ContentStore struct {
+	dir      string
+	capacity int64
+	// Serialize the garbage collections in process, the blobs removed by
+	// another process are treated as missing.
+	mu sync.Mutex
+}
+
+// NewContentStore creates a content store in dir, the store is unlimited
+// if capacity is 0.
+func NewContentStore(dir string, capacity int64) (*ContentStore, error) {
+	for _, sub := range []string{"blobs", "ingest"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, errors.Wrap(err, "Create content store directory")
+		}
+	}
+	return &ContentStore{
+		dir:      dir,
+		capacity: capacity,
+	}, nil
+}
+
+func (store *ContentStore) blobPath(dgst digest.Digest) string {
+	return filepath.Join(store.dir, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// Reader opens the blob of desc, the blob whose size mismatches desc is
+// treated as missing. The blob is marked as used right now.
+func (store *ContentStore) Reader(desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	path := store.blobPath(desc.Digest)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() != desc.Size {
+		file.Close()
+		return nil, errors.Errorf("mismatched size of blob %s in content store", desc.Digest)
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		logrus.Debugf("Update access time of blob %s: %s", desc.Digest, err)
+	}
+	return file, nil
+}
+
+// Tee returns a reader reading from reader, the content read is written to
+// the content store, and is committed as the blob of desc when the reader
+// is closed after reading all content in matched digest and size.
+func (store *ContentStore) Tee(desc ocispec.Descriptor, reader io.ReadCloser) io.ReadCloser {
+	if err := desc.Digest.Validate(); err != nil {
+		return reader
+	}
+	file, err := ioutil.TempFile(filepath.Join(store.dir, "ingest"), desc.Digest.Hex()+"-")
+	if err != nil {
+		logrus.Warnf("Create ingest file of blob %s: %s", desc.Digest, err)
+		return reader
+	}
+	return &teeReader{
+		store:    store,
+		desc:     desc,
+		reader:   reader,
+		file:     file,
+		digester: desc.Digest.Algorithm().Digester(),
+	}
+}
+
+type teeReader struct {
+	store    *ContentStore
+	desc     ocispec.Descriptor
+	reader   io.ReadCloser
+	file     *os.File
+	digester digest.Digester
+	size     int64
+	err      error
+}
+
+func (tee *teeReader) Read(p []byte) (int, error) {
+	n, err := tee.reader.Read(p)
+	if n > 0 && tee.err == nil {
+		if _, tee.err = tee.file.Write(p[:n]); tee.err == nil {
+			tee.digester.Hash().Write(p[:n])
+			tee.size += int64(n)
+		}
+	}
+	return n, err
+}
+
+func (tee *teeReader) Close() error {
+	// The tar reader stops at the end of archive, the padding and gzip
+	// trailer left are small
+	if remaining := tee.desc.Size - tee.size; tee.err == nil && remaining > 0 && remaining <= maxDrainSize {
+		io.Copy(ioutil.Discard, tee)
+	}
+	err := tee.reader.Close()
+
+	path := tee.file.Name()
+	defer os.Remove(path)
+	if closeErr := tee.file.Close(); tee.err == nil {
+		tee.err = closeErr
+	}
+	if tee.err != nil || tee.size != tee.desc.Size || tee.digester.Digest() != tee.desc.Digest {
+		// The blob isn't fully read or is corrupted
+		return err
+	}
+
+	if commitErr := tee.store.commit(path, tee.desc.Digest); commitErr != nil {
+		logrus.Warnf("Commit blob %s to content store: %s", tee.desc.Digest, commitErr)
+	} else if gcErr := tee.store.GC(); gcErr != nil {
+		logrus.Warnf("Garbage collect content store: %s", gcErr)
+	}
+
+	return err
+}
+
+func (store *ContentStore) commit(path string, dgst digest.Digest) error {
+	target := store.blobPath(dgst)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, target)
+}
+
+type storedBlob struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// GC removes the least recently used blobs until the total size of blobs
+// doesn't exceed the capacity.
+func (store *ContentStore) GC() error {
+	if store.capacity <= 0 {
+		return nil
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	blobs := []storedBlob{}
+	total := int64(0)
+	err := filepath.Walk(filepath.Join(store.dir, "blobs"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The blob may be removed by another process
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		blobs = append(blobs, storedBlob{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "Walk content store")
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].modTime.Before(blobs[j].modTime)
+	})
+	for _, blob := range blobs {
+		if total <= store.capacity {
+			break
+		}
+		if err := os.Remove(blob.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Remove blob %s", blob.path)
+		}
+		logrus.Debugf("Removed blob %s from content store", blob.path)
+		total -= blob.size
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func storeBlob(t *testing.T, store *ContentStore, data []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+	reader := store.Tee(desc, ioutil.NopCloser(bytes.NewReader(data)))
+	read, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	assert.Equal(t, data, read)
+	require.Nil(t, reader.Close())
+	return desc
+}
+
+func TestContentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-content-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewContentStore(dir, 10)
+	require.Nil(t, err)
+
+	blob1 := storeBlob(t, store, []byte("blob1"))
+	reader, err := store.Reader(blob1)
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	reader.Close()
+	assert.Equal(t, []byte("blob1"), data)
+
+	// The blob isn't stored if it's not fully read
+	partial := []byte("partial")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(partial), Size: 2 << 20}
+	reader = store.Tee(desc, ioutil.NopCloser(bytes.NewReader(partial)))
+	require.Nil(t, reader.Close())
+	_, err = store.Reader(desc)
+	assert.True(t, os.IsNotExist(err))
+
+	// The blob in mismatched size is treated as missing
+	_, err = store.Reader(ocispec.Descriptor{Digest: blob1.Digest, Size: 1})
+	assert.NotNil(t, err)
+
+	// Blob 1 is used recently, blob 2 is the least recently used one when
+	// blob 3 exceeds the capacity
+	blob2 := storeBlob(t, store, []byte("blob2"))
+	past := time.Now().Add(-time.Hour)
+	require.Nil(t, os.Chtimes(store.blobPath(blob1.Digest), past, past))
+	require.Nil(t, os.Chtimes(store.blobPath(blob2.Digest), past.Add(-time.Hour), past.Add(-time.Hour)))
+	reader, err = store.Reader(blob1)
+	require.Nil(t, err)
+	reader.Close()
+	blob3 := storeBlob(t, store, []byte("blob3"))
+
+	for _, desc := range []ocispec.Descriptor{blob1, blob3} {
+		reader, err := store.Reader(desc)
+		require.Nil(t, err)
+		reader.Close()
+	}
+	_, err = store.Reader(blob2)
+	assert.True(t, os.IsNotExist(err))
+
+	// The ingest files are cleaned up
+	files, err := ioutil.ReadDir(dir + "/ingest")
+	require.Nil(t, err)
+	assert.Empty(t, files)
+}
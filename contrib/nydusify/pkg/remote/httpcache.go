@@ -0,0 +1,210 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Manifest and config are small json objects, the response body larger than
+// the limit will not be cached to avoid eating up the memory.
+const maxCachedResponseSize = 4 << 20
+
+const mediaTypeFileSuffix = ".mediatype"
+
+// CachedTransport is a http.RoundTripper which caches the manifest and config
+// GET responses on local disk. Only the responses that can be addressed by a
+// digest are cached: the digest is taken from the request path, or from the
+// `Docker-Content-Digest` header for a tag request, and the response body is
+// verified against it before being stored. Content addressed by digest is
+// immutable, so a cache entry never needs to be invalidated.
+type CachedTransport struct {
+	dir       string
+	transport http.RoundTripper
+}
+
+// NewCachedTransport creates a CachedTransport storing responses in `dir`,
+// requests missing the cache are delegated to `transport`.
+func NewCachedTransport(dir string, transport http.RoundTripper) (*CachedTransport, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Create http cache directory")
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &CachedTransport{
+		dir:       dir,
+		transport: transport,
+	}, nil
+}
+
+func isCacheableMediaType(mediaType string) bool {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2ManifestList,
+		ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex,
+		images.MediaTypeDockerSchema2Config, ocispec.MediaTypeImageConfig:
+		return true
+	}
+	return false
+}
+
+// parseRegistryPath parses the path in format `/v2/<name>/<kind>/<reference>`,
+// kind is `manifests` or `blobs`.
+func parseRegistryPath(path string) (string, string, bool) {
+	if !strings.HasPrefix(path, "/v2/") {
+		return "", "", false
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) < 5 {
+		return "", "", false
+	}
+	kind := parts[len(parts)-2]
+	if kind != "manifests" && kind != "blobs" {
+		return "", "", false
+	}
+	return kind, parts[len(parts)-1], true
+}
+
+// acceptedMediaType returns the first media type in the `Accept` header,
+// containerd fetcher puts the media type of descriptor in that place.
+func acceptedMediaType(req *http.Request) string {
+	accept := strings.Split(req.Header.Get("Accept"), ",")
+	return strings.TrimSpace(accept[0])
+}
+
+// originRequest finds the registry request which caused the redirects,
+// the blob request may be redirected to a storage service.
+func originRequest(req *http.Request) *http.Request {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req
+}
+
+func (t *CachedTransport) path(dgst digest.Digest) string {
+	return filepath.Join(t.dir, dgst.Algorithm().String(), dgst.Hex())
+}
+
+func (t *CachedTransport) load(req *http.Request, dgst digest.Digest) (*http.Response, error) {
+	data, err := ioutil.ReadFile(t.path(dgst))
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := ioutil.ReadFile(t.path(dgst) + mediaTypeFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	// The cache file may be corrupted by an unexpected write
+	if digest.FromBytes(data) != dgst {
+		return nil, fmt.Errorf("mismatched digest for cache %s", dgst)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", string(mediaType))
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	header.Set("Docker-Content-Digest", dgst.String())
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+func (t *CachedTransport) store(dgst digest.Digest, mediaType string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(t.path(dgst)), 0755); err != nil {
+		return err
+	}
+	// Write media type file first, the cache entry takes effect only
+	// when the data file is renamed to target path.
+	if err := utils.WriteFileAtomic(t.path(dgst)+mediaTypeFileSuffix, []byte(mediaType)); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(t.path(dgst), data)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *CachedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	origin := originRequest(req)
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return t.transport.RoundTrip(req)
+	}
+
+	kind, reference, ok := parseRegistryPath(origin.URL.Path)
+	if !ok {
+		return t.transport.RoundTrip(req)
+	}
+
+	mediaType := acceptedMediaType(origin)
+	if kind == "blobs" && !isCacheableMediaType(mediaType) {
+		return t.transport.RoundTrip(req)
+	}
+
+	// A tag is mutable, we can't serve the request from the cache,
+	// but the response can still be stored by its content digest.
+	dgst, err := digest.Parse(reference)
+	if err != nil {
+		dgst = ""
+	} else if resp, err := t.load(req, dgst); err == nil {
+		logrus.Debugf("Hit http cache for %s", origin.URL)
+		return resp, nil
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	if dgst == "" {
+		dgst, err = digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+		if err != nil {
+			return resp, nil
+		}
+	}
+	if resp.ContentLength > maxCachedResponseSize {
+		return resp, nil
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	if len(data) > maxCachedResponseSize || digest.FromBytes(data) != dgst {
+		return resp, nil
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType = contentType
+	}
+	if err := t.store(dgst, mediaType, data); err != nil {
+		logrus.Warnf("Store http cache for %s: %s", origin.URL, err)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedTransport(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	manifestDigest := digest.FromBytes(manifest)
+	layer := []byte("layer")
+	layerDigest := digest.FromBytes(layer)
+
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/v2/library/foo/manifests/latest", "/v2/library/foo/manifests/" + manifestDigest.String():
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+			w.Write(manifest)
+		case "/v2/library/foo/blobs/" + layerDigest.String():
+			w.Write(layer)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "nydusify-http-cache-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	transport, err := NewCachedTransport(dir, http.DefaultTransport)
+	assert.Nil(t, err)
+	client := &http.Client{Transport: transport}
+
+	get := func(path, mediaType string) []byte {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Accept", mediaType+", */*")
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		data, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return data
+	}
+
+	// Tag request is always sent to registry, but the response is
+	// stored by the digest in `Docker-Content-Digest` header.
+	assert.Equal(t, manifest, get("/v2/library/foo/manifests/latest", ocispec.MediaTypeImageManifest))
+	assert.Equal(t, manifest, get("/v2/library/foo/manifests/latest", ocispec.MediaTypeImageManifest))
+	assert.Equal(t, 2, requests["/v2/library/foo/manifests/latest"])
+
+	assert.Equal(t, manifest, get("/v2/library/foo/manifests/"+manifestDigest.String(), ocispec.MediaTypeImageManifest))
+	assert.Equal(t, 0, requests["/v2/library/foo/manifests/"+manifestDigest.String()])
+
+	// Layer blob should never be cached
+	assert.Equal(t, layer, get("/v2/library/foo/blobs/"+layerDigest.String(), ocispec.MediaTypeImageLayerGzip))
+	assert.Equal(t, layer, get("/v2/library/foo/blobs/"+layerDigest.String(), ocispec.MediaTypeImageLayerGzip))
+	assert.Equal(t, 2, requests["/v2/library/foo/blobs/"+layerDigest.String()])
+}
@@ -0,0 +1,301 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// layoutName is the repository name of the image in OCI image layout,
+// only the tag of reference is used to find image in index.json.
+const layoutName = "oci-layout"
+
+// layoutResolver implements containerd remote resolver on a directory in
+// OCI image layout, the images are referenced by the tag annotation
+// `org.opencontainers.image.ref.name` in index.json.
+type layoutResolver struct {
+	dir string
+	// Protect the updates of index.json
+	mu sync.Mutex
+}
+
+// NewLayout creates remote instance accessing the image tagged in a local
+// directory in OCI image layout, the directory is created if it doesn't
+// exist, so that it can be used for both pulling and pushing image without
+// registry, e.g. in an air-gapped environment.
+func NewLayout(dir, tag string) (*Remote, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Create image layout directory")
+	}
+	layoutPath := filepath.Join(dir, ocispec.ImageLayoutFile)
+	if _, err := os.Stat(layoutPath); os.IsNotExist(err) {
+		layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+		if err != nil {
+			return nil, errors.Wrap(err, "Marshal image layout")
+		}
+		if err := ioutil.WriteFile(layoutPath, layout, 0644); err != nil {
+			return nil, errors.Wrap(err, "Write image layout")
+		}
+	}
+
+	resolver := &layoutResolver{dir: dir}
+	remote, err := New(fmt.Sprintf("%s:%s", layoutName, tag), func() remotes.Resolver {
+		return resolver
+	})
+	if err != nil {
+		return nil, err
+	}
+	remote.Ref = fmt.Sprintf("oci://%s:%s", dir, tag)
+
+	return remote, nil
+}
+
+func (resolver *layoutResolver) blobPath(dgst digest.Digest) string {
+	return filepath.Join(resolver.dir, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+func (resolver *layoutResolver) indexPath() string {
+	return filepath.Join(resolver.dir, "index.json")
+}
+
+func layoutTag(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ""
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return ""
+}
+
+func (resolver *layoutResolver) readIndex() (*ocispec.Index, error) {
+	data, err := ioutil.ReadFile(resolver.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &ocispec.Index{
+				Versioned: specs.Versioned{
+					SchemaVersion: 2,
+				},
+			}, nil
+		}
+		return nil, err
+	}
+
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal index of image layout")
+	}
+
+	return &index, nil
+}
+
+// Resolve finds the descriptor tagged in index.json.
+func (resolver *layoutResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	tag := layoutTag(ref)
+
+	resolver.mu.Lock()
+	index, err := resolver.readIndex()
+	resolver.mu.Unlock()
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+
+	for _, desc := range index.Manifests {
+		if desc.Annotations[ocispec.AnnotationRefName] == tag {
+			desc.Annotations = nil
+			return ref, desc, nil
+		}
+	}
+
+	return "", ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrNotFound, "image %s in %s", tag, resolver.dir)
+}
+
+// Fetcher returns a fetcher opening the blob files.
+func (resolver *layoutResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return remotes.FetcherFunc(func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		file, err := os.Open(resolver.blobPath(desc.Digest))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, errors.Wrapf(errdefs.ErrNotFound, "blob %s", desc.Digest)
+			}
+			return nil, err
+		}
+		return file, nil
+	}), nil
+}
+
+// Pusher returns a pusher writing the blob files, the manifest or index
+// pushed by tag is referenced by index.json.
+func (resolver *layoutResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	tag := layoutTag(ref)
+
+	return remotes.PusherFunc(func(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+		if _, err := os.Stat(resolver.blobPath(desc.Digest)); err == nil {
+			if err := resolver.tag(desc, tag); err != nil {
+				return nil, err
+			}
+			return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "blob %s", desc.Digest)
+		}
+
+		blobDir := filepath.Dir(resolver.blobPath(desc.Digest))
+		if err := os.MkdirAll(blobDir, 0755); err != nil {
+			return nil, err
+		}
+		file, err := ioutil.TempFile(blobDir, ".tmp-")
+		if err != nil {
+			return nil, err
+		}
+
+		return &layoutWriter{
+			resolver:  resolver,
+			file:      file,
+			desc:      desc,
+			tag:       tag,
+			digester:  desc.Digest.Algorithm().Digester(),
+			startedAt: time.Now(),
+		}, nil
+	}), nil
+}
+
+// tag references the manifest or index by tag in index.json, the
+// existing descriptor with the same tag is replaced.
+func (resolver *layoutResolver) tag(desc ocispec.Descriptor, tag string) error {
+	if tag == "" {
+		return nil
+	}
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex,
+		images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2ManifestList:
+	default:
+		return nil
+	}
+
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+
+	index, err := resolver.readIndex()
+	if err != nil {
+		return err
+	}
+
+	desc.Annotations = map[string]string{
+		ocispec.AnnotationRefName: tag,
+	}
+	manifests := []ocispec.Descriptor{}
+	for _, existing := range index.Manifests {
+		if existing.Annotations[ocispec.AnnotationRefName] != tag {
+			manifests = append(manifests, existing)
+		}
+	}
+	index.Manifests = append(manifests, desc)
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "Marshal index of image layout")
+	}
+	tmp := resolver.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, resolver.indexPath())
+}
+
+// layoutWriter writes the blob to a temporary file, the file is renamed
+// to the blob path after the digest is verified on commit.
+type layoutWriter struct {
+	resolver  *layoutResolver
+	file      *os.File
+	desc      ocispec.Descriptor
+	tag       string
+	digester  digest.Digester
+	offset    int64
+	startedAt time.Time
+}
+
+func (w *layoutWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.digester.Hash().Write(p[:n])
+	w.offset += int64(n)
+	return n, err
+}
+
+func (w *layoutWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	w.file.Close()
+	os.Remove(w.file.Name())
+	w.file = nil
+	return nil
+}
+
+func (w *layoutWriter) Digest() digest.Digest {
+	return w.digester.Digest()
+}
+
+func (w *layoutWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	defer w.Close()
+
+	if size > 0 && size != w.offset {
+		return fmt.Errorf("Unexpected blob size %d, expected %d", w.offset, size)
+	}
+	if expected != "" && expected != w.Digest() {
+		return fmt.Errorf("Unexpected blob digest %s, expected %s", w.Digest(), expected)
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.resolver.blobPath(w.desc.Digest)); err != nil {
+		return err
+	}
+	w.file = nil
+
+	return w.resolver.tag(w.desc, w.tag)
+}
+
+func (w *layoutWriter) Status() (content.Status, error) {
+	return content.Status{
+		Ref:       w.desc.Digest.String(),
+		Offset:    w.offset,
+		Total:     w.desc.Size,
+		StartedAt: w.startedAt,
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+func (w *layoutWriter) Truncate(size int64) error {
+	if size != 0 {
+		return errors.Wrap(errdefs.ErrNotImplemented, "Truncate to non-zero size")
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.digester = w.desc.Digest.Algorithm().Digester()
+	w.offset = 0
+	return nil
+}
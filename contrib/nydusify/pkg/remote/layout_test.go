@@ -0,0 +1,87 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-layout-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	layout, err := NewLayout(dir, "v1")
+	require.Nil(t, err)
+	assert.Equal(t, "oci://"+dir+":v1", layout.Ref)
+
+	_, err = layout.Resolve(ctx)
+	assert.True(t, errdefs.IsNotFound(err))
+
+	layer := []byte("layer")
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+	// Verify the content on commit
+	assert.NotNil(t, layout.Push(ctx, layerDesc, true, bytes.NewReader([]byte("corrupted"))))
+	_, err = layout.Pull(ctx, layerDesc, true)
+	assert.True(t, errdefs.IsNotFound(err))
+
+	require.Nil(t, layout.Push(ctx, layerDesc, true, bytes.NewReader(layer)))
+	require.Nil(t, layout.Push(ctx, layerDesc, true, bytes.NewReader(layer)))
+	reader, err := layout.Pull(ctx, layerDesc, true)
+	require.Nil(t, err)
+	pulled, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.Nil(t, err)
+	assert.Equal(t, layer, pulled)
+
+	pushManifest := func(remote *Remote, manifest string) ocispec.Descriptor {
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString(manifest),
+			Size:      int64(len(manifest)),
+		}
+		require.Nil(t, remote.Push(ctx, desc, false, bytes.NewReader([]byte(manifest))))
+		return desc
+	}
+
+	v1 := pushManifest(layout, `{"schemaVersion":2}`)
+	v2Layout, err := layout.WithTag("v2")
+	require.Nil(t, err)
+	v2 := pushManifest(v2Layout, `{"schemaVersion":2,"layers":[]}`)
+	// Retag the existing manifest
+	v1 = pushManifest(layout, `{"schemaVersion":2,"layers":[]}`)
+
+	desc, err := layout.Resolve(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, v1, *desc)
+	desc, err = v2Layout.Resolve(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, v2, *desc)
+
+	indexBytes, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	require.Nil(t, err)
+	var index ocispec.Index
+	require.Nil(t, json.Unmarshal(indexBytes, &index))
+	assert.Equal(t, 2, len(index.Manifests))
+	_, err = os.Stat(filepath.Join(dir, ocispec.ImageLayoutFile))
+	assert.Nil(t, err)
+}
@@ -6,54 +6,124 @@ package remote
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"sync"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/ratelimit"
 )
 
+// RemoteProvider provides the clients accessing registry for Remote, it can
+// be implemented to plug in custom resolvers, e.g. the ones getting token
+// from an internal token service or redirecting blobs to signed URLs.
+type RemoteProvider interface {
+	// Resolver creates the resolver for image pull or fetches requests. The
+	// best practice in containerd is that each resolver instance is used
+	// only once for a request and is destroyed when the request completes.
+	// When a registry token expires, the resolver does not re-apply for a
+	// new token, so a new resolver instance is created for each request.
+	Resolver() remotes.Resolver
+	// Hosts creates the registry hosts for the requests not covered by
+	// resolver, e.g. the chunked blob upload, it returns nil if the remote
+	// isn't a registry, then the requests fall back to resolver.
+	Hosts() docker.RegistryHosts
+}
+
+// ResolverFunc provides the resolver created by the function, the remote
+// isn't regarded as a registry.
+type ResolverFunc func() remotes.Resolver
+
+// Resolver implements RemoteProvider.
+func (f ResolverFunc) Resolver() remotes.Resolver {
+	return f()
+}
+
+// Hosts implements RemoteProvider.
+func (f ResolverFunc) Hosts() docker.RegistryHosts {
+	return nil
+}
+
+// HostsFunc provides the registry hosts created by the function, and the
+// docker resolver accessing the hosts.
+type HostsFunc func() docker.RegistryHosts
+
+// Resolver implements RemoteProvider.
+func (f HostsFunc) Resolver() remotes.Resolver {
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: f(),
+	})
+}
+
+// Hosts implements RemoteProvider.
+func (f HostsFunc) Hosts() docker.RegistryHosts {
+	return f()
+}
+
 // Remote provides the ability to access remote registry
 type Remote struct {
 	// `Ref` is pointing to a remote image in formatted string host[:port]/[namespace/]repo[:tag]
-	Ref    string
-	parsed reference.Named
-	// The resolver is used for image pull or fetches requests. The best practice
-	// in containerd is that each resolver instance is used only once for a request
-	// and is destroyed when the request completes. When a registry token expires,
-	// the resolver does not re-apply for a new token, so it's better to create a
-	// new resolver instance using resolverFunc for each request.
-	resolverFunc func() remotes.Resolver
-	pushed       sync.Map
+	Ref      string
+	parsed   reference.Named
+	provider RemoteProvider
+	pushed   sync.Map
 }
 
 // New creates remote instance from docker remote resolver
 func New(ref string, resolverFunc func() remotes.Resolver) (*Remote, error) {
+	return NewWithProvider(ref, ResolverFunc(resolverFunc))
+}
+
+// NewWithHosts creates remote instance accessing registry by the registry
+// hosts, a new hosts instance is created by hostsFunc for each request.
+func NewWithHosts(ref string, hostsFunc func() docker.RegistryHosts) (*Remote, error) {
+	return NewWithProvider(ref, HostsFunc(hostsFunc))
+}
+
+// NewWithProvider creates remote instance accessing registry by the clients
+// of provider.
+func NewWithProvider(ref string, provider RemoteProvider) (*Remote, error) {
 	parsed, err := reference.ParseNormalizedNamed(ref)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Remote{
-		Ref:          ref,
-		parsed:       parsed,
-		resolverFunc: resolverFunc,
+		Ref:      ref,
+		parsed:   parsed,
+		provider: provider,
 	}, nil
 }
 
+// Provider returns the provider of registry clients.
+func (remote *Remote) Provider() RemoteProvider {
+	return remote.provider
+}
+
+// lock returns the ref key leveled mutex of pushing desc.
+func (remote *Remote) lock(ctx context.Context, desc ocispec.Descriptor) *sync.Mutex {
+	refKey := remotes.MakeRefKey(ctx, desc)
+	lock, _ := remote.pushed.LoadOrStore(refKey, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
 // Push pushes blob to registry
 func (remote *Remote) Push(ctx context.Context, desc ocispec.Descriptor, byDigest bool, reader io.Reader) error {
 	// Concurrently push blob with same digest using containerd
 	// docker remote client will cause error:
 	// `failed commit on ref: unexpected size x, expected y`
 	// use ref key leveled mutex lock to avoid the issue.
-	refKey := remotes.MakeRefKey(ctx, desc)
-	lock, _ := remote.pushed.LoadOrStore(refKey, &sync.Mutex{})
-	lock.(*sync.Mutex).Lock()
-	defer lock.(*sync.Mutex).Unlock()
+	lock := remote.lock(ctx, desc)
+	lock.Lock()
+	defer lock.Unlock()
 
 	var ref string
 	if byDigest {
@@ -63,7 +133,7 @@ func (remote *Remote) Push(ctx context.Context, desc ocispec.Descriptor, byDiges
 	}
 
 	// Create a new resolver instance for the request
-	pusher, err := remote.resolverFunc().Pusher(ctx, ref)
+	pusher, err := remote.provider.Resolver().Pusher(ctx, ref)
 	if err != nil {
 		return err
 	}
@@ -77,6 +147,8 @@ func (remote *Remote) Push(ctx context.Context, desc ocispec.Descriptor, byDiges
 	}
 	defer writer.Close()
 
+	reader = ratelimit.PushLimiter(ctx).Reader(ctx, reader)
+
 	return content.Copy(ctx, writer, reader, desc.Size, desc.Digest)
 }
 
@@ -90,7 +162,7 @@ func (remote *Remote) Pull(ctx context.Context, desc ocispec.Descriptor, byDiges
 	}
 
 	// Create a new resolver instance for the request
-	puller, err := remote.resolverFunc().Fetcher(ctx, ref)
+	puller, err := remote.provider.Resolver().Fetcher(ctx, ref)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +172,38 @@ func (remote *Remote) Pull(ctx context.Context, desc ocispec.Descriptor, byDiges
 		return nil, err
 	}
 
-	return reader, nil
+	return ratelimit.PullLimiter(ctx).ReadCloser(ctx, reader), nil
+}
+
+// BlobExists checks if the blob of desc exists in repository by a HEAD
+// request without fetching its content. It falls back to opening the blob
+// by Pull if the remote isn't a registry.
+func (remote *Remote) BlobExists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	registryHosts := remote.provider.Hosts()
+	if registryHosts == nil {
+		reader, err := remote.Pull(ctx, desc, true)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		reader.Close()
+		return true, nil
+	}
+
+	hosts, err := registryHosts(reference.Domain(remote.parsed))
+	if err != nil {
+		return false, errors.Wrap(err, "Get registry hosts")
+	}
+	for _, host := range hosts {
+		if host.Capabilities.Has(docker.HostCapabilityPull) {
+			checker := &blobUploader{host: host, repo: reference.Path(remote.parsed)}
+			ctx = docker.WithScope(ctx, fmt.Sprintf("repository:%s:pull", checker.repo))
+			return checker.exists(ctx, desc.Digest)
+		}
+	}
+	return false, errors.New("No registry host to pull")
 }
 
 // Resolve parses descriptor for given image reference
@@ -108,10 +211,33 @@ func (remote *Remote) Resolve(ctx context.Context) (*ocispec.Descriptor, error)
 	ref := reference.TagNameOnly(remote.parsed).String()
 
 	// Create a new resolver instance for the request
-	_, desc, err := remote.resolverFunc().Resolve(ctx, ref)
+	_, desc, err := remote.provider.Resolver().Resolve(ctx, ref)
 	if err != nil {
 		return nil, err
 	}
 
 	return &desc, nil
 }
+
+// WithTag returns a remote instance points to another tag in the same repository
+func (remote *Remote) WithTag(tag string) (*Remote, error) {
+	tagged, err := reference.WithTag(reference.TrimNamed(remote.parsed), tag)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithProvider(tagged.String(), remote.provider)
+}
+
+// Tag returns the tag of remote, or empty if it isn't tagged.
+func (remote *Remote) Tag() string {
+	if tagged, ok := remote.parsed.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return ""
+}
+
+// DigestReference returns the reference of the content by digest in the
+// same repository, in formatted string host[:port]/[namespace/]repo@digest
+func (remote *Remote) DigestReference(dgst digest.Digest) string {
+	return fmt.Sprintf("%s@%s", remote.parsed.Name(), dgst)
+}
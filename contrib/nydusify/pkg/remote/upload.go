@@ -0,0 +1,424 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/ratelimit"
+)
+
+var (
+	// uploadChunkSize is the size of each PATCH request of upload session,
+	// the upload is resumed from the last committed chunk on failure.
+	uploadChunkSize int64 = 32 * 1024 * 1024
+	// uploadRetries is the maximum number of consecutive failed requests
+	// of an upload before giving up.
+	uploadRetries = 5
+	// uploadBackoff and uploadMaxBackoff are the initial and maximum
+	// interval of exponential backoff between retries.
+	uploadBackoff    = time.Second
+	uploadMaxBackoff = 30 * time.Second
+)
+
+// statusError is the unexpected response of registry.
+type statusError struct {
+	method string
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d: %s", e.method, e.status, e.body)
+}
+
+// retryable checks if the failed request may succeed on retry, i.e. the
+// network errors, server errors and throttling.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status >= 500 || se.status == http.StatusTooManyRequests || se.status == http.StatusRequestTimeout
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// blobUploader uploads blob by the chunked upload session of registry:
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-a-blob-in-chunks
+type blobUploader struct {
+	host docker.RegistryHost
+	repo string
+}
+
+func (u *blobUploader) url(path string) string {
+	return fmt.Sprintf("%s://%s%s/%s%s", u.host.Scheme, u.host.Host, u.host.Path, u.repo, path)
+}
+
+// do sends the request with authorization, the request is rebuilt by
+// newReq to retry once with the challenge of unauthorized response.
+func (u *blobUploader) do(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for key, values := range u.host.Header {
+			req.Header[key] = append(req.Header[key], values...)
+		}
+		if u.host.Authorizer != nil {
+			if err := u.host.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, errors.Wrap(err, "Authorize request")
+			}
+		}
+		client := u.host.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && u.host.Authorizer != nil && attempt == 0 {
+			resp.Body.Close()
+			if err := u.host.Authorizer.AddResponses(ctx, []*http.Response{resp}); err != nil {
+				return nil, errors.Wrap(err, "Add unauthorized response")
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
+
+func (u *blobUploader) check(resp *http.Response, method string, expected ...int) error {
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &statusError{method: method, status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+}
+
+// location resolves the upload location in response, which may be relative.
+func (u *blobUploader) location(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("Missing upload location")
+	}
+	loc, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return "", errors.Wrap(err, "Parse upload location")
+	}
+	return loc.String(), nil
+}
+
+// exists checks if the blob exists in repository.
+func (u *blobUploader) exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	resp, err := u.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, u.url("/blobs/"+dgst.String()), nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := u.check(resp, "Check blob", http.StatusOK); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// start opens an upload session.
+func (u *blobUploader) start(ctx context.Context) (string, error) {
+	resp, err := u.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, u.url("/blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := u.check(resp, "Start upload", http.StatusAccepted); err != nil {
+		return "", err
+	}
+	return u.location(resp)
+}
+
+// parseRange parses the `Range: 0-<end>` header of upload session, it
+// returns the number of committed bytes.
+func parseRange(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid range %s", value)
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid range %s", value)
+	}
+	// The empty session is reported as `0-0` by some registries, resending
+	// the first byte is safer than skipping it
+	if end <= 0 {
+		return 0, nil
+	}
+	return end + 1, nil
+}
+
+// status queries the committed offset of upload session.
+func (u *blobUploader) status(ctx context.Context, location string) (string, int64, error) {
+	resp, err := u.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, location, nil)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if err := u.check(resp, "Get upload status", http.StatusNoContent); err != nil {
+		return "", 0, err
+	}
+	offset, err := parseRange(resp.Header.Get("Range"))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.Header.Get("Location") != "" {
+		if location, err = u.location(resp); err != nil {
+			return "", 0, err
+		}
+	}
+	return location, offset, nil
+}
+
+// patch uploads the chunk at offset, it returns the location for the next
+// request of upload session.
+func (u *blobUploader) patch(ctx context.Context, location string, newChunk func() io.Reader, offset, size int64) (string, error) {
+	resp, err := u.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPatch, location, newChunk())
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+size-1))
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := u.check(resp, "Upload chunk", http.StatusAccepted); err != nil {
+		return "", err
+	}
+	return u.location(resp)
+}
+
+// commit closes the upload session with the digest of blob.
+func (u *blobUploader) commit(ctx context.Context, location string, dgst digest.Digest) error {
+	loc, err := url.Parse(location)
+	if err != nil {
+		return errors.Wrap(err, "Parse upload location")
+	}
+	query := loc.Query()
+	query.Set("digest", dgst.String())
+	loc.RawQuery = query.Encode()
+
+	resp, err := u.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, loc.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = 0
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return u.check(resp, "Commit upload", http.StatusCreated)
+}
+
+// upload uploads the blob read from ra in chunks, the transient failures
+// are retried with exponential backoff, and the upload is resumed from the
+// committed offset of session, or restarted if the session is gone.
+func (u *blobUploader) upload(ctx context.Context, desc ocispec.Descriptor, ra io.ReaderAt) error {
+	task := progress.TaskFromContext(ctx)
+	limiter := ratelimit.PushLimiter(ctx)
+
+	var (
+		location string
+		offset   int64
+		failures int
+		backoff  = uploadBackoff
+	)
+
+	for {
+		err := func() error {
+			if location == "" {
+				var err error
+				if location, err = u.start(ctx); err != nil {
+					return err
+				}
+				offset = 0
+				task.Reset()
+			}
+			for offset < desc.Size {
+				size := uploadChunkSize
+				if offset+size > desc.Size {
+					size = desc.Size - offset
+				}
+				newChunk := func() io.Reader {
+					return limiter.Reader(ctx, io.NewSectionReader(ra, offset, size))
+				}
+				next, err := u.patch(ctx, location, newChunk, offset, size)
+				if err != nil {
+					return err
+				}
+				location = next
+				offset += size
+				task.Add(size)
+				failures = 0
+				backoff = uploadBackoff
+			}
+			return u.commit(ctx, location, desc.Digest)
+		}()
+		if err == nil {
+			return nil
+		}
+
+		failures++
+		if !retryable(err) || failures > uploadRetries {
+			return err
+		}
+		logrus.Warnf("Retry to upload blob %s from offset %d in %s due to error: %s", desc.Digest, offset, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > uploadMaxBackoff {
+			backoff = uploadMaxBackoff
+		}
+
+		// Resume from the committed offset of session, restart the upload
+		// if the session is unknown
+		if location != "" {
+			next, committed, err := u.status(ctx, location)
+			if err != nil {
+				logrus.Warnf("Restart to upload blob %s since the upload session is lost: %s", desc.Digest, err)
+				location = ""
+				continue
+			}
+			location = next
+			offset = committed
+			task.Reset()
+			task.Add(offset)
+		}
+	}
+}
+
+// PushBlob pushes the blob of desc read from ra to registry in chunks, the
+// transient failures are retried with exponential backoff, and the upload
+// is resumed from the last committed offset instead of restarting the whole
+// blob. It falls back to Push if the remote isn't a registry.
+func (remote *Remote) PushBlob(ctx context.Context, desc ocispec.Descriptor, ra io.ReaderAt) error {
+	registryHosts := remote.provider.Hosts()
+	if registryHosts == nil {
+		task := progress.TaskFromContext(ctx)
+		task.Reset()
+		return remote.Push(ctx, desc, true, task.Reader(io.NewSectionReader(ra, 0, desc.Size)))
+	}
+
+	lock := remote.lock(ctx, desc)
+	lock.Lock()
+	defer lock.Unlock()
+
+	hosts, err := registryHosts(reference.Domain(remote.parsed))
+	if err != nil {
+		return errors.Wrap(err, "Get registry hosts")
+	}
+	var uploader *blobUploader
+	for _, host := range hosts {
+		if host.Capabilities.Has(docker.HostCapabilityPush) {
+			uploader = &blobUploader{host: host, repo: reference.Path(remote.parsed)}
+			break
+		}
+	}
+	if uploader == nil {
+		return errors.New("No registry host to push")
+	}
+
+	ctx = docker.WithScope(ctx, fmt.Sprintf("repository:%s:pull,push", uploader.repo))
+	if exists, err := uploader.exists(ctx, desc.Digest); err != nil {
+		logrus.Warnf("Failed to check blob %s: %s", desc.Digest, err)
+	} else if exists {
+		return nil
+	}
+
+	return uploader.upload(ctx, desc, ra)
+}
+
+// PushManifest pushes the manifest of desc by digest, it returns the
+// `OCI-Subject` header of response, which is set by the registry supporting
+// referrers API if the manifest refers to a subject. It falls back to Push
+// and returns empty subject if the remote isn't a registry.
+func (remote *Remote) PushManifest(ctx context.Context, desc ocispec.Descriptor, data []byte) (digest.Digest, error) {
+	registryHosts := remote.provider.Hosts()
+	if registryHosts == nil {
+		return "", remote.Push(ctx, desc, true, bytes.NewReader(data))
+	}
+
+	lock := remote.lock(ctx, desc)
+	lock.Lock()
+	defer lock.Unlock()
+
+	hosts, err := registryHosts(reference.Domain(remote.parsed))
+	if err != nil {
+		return "", errors.Wrap(err, "Get registry hosts")
+	}
+	for _, host := range hosts {
+		if !host.Capabilities.Has(docker.HostCapabilityPush) {
+			continue
+		}
+		uploader := &blobUploader{host: host, repo: reference.Path(remote.parsed)}
+		ctx = docker.WithScope(ctx, fmt.Sprintf("repository:%s:pull,push", uploader.repo))
+		resp, err := uploader.do(ctx, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPut, uploader.url("/manifests/"+desc.Digest.String()), bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			req.ContentLength = int64(len(data))
+			req.Header.Set("Content-Type", desc.MediaType)
+			return req, nil
+		})
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if err := uploader.check(resp, "Push manifest", http.StatusCreated); err != nil {
+			return "", err
+		}
+		return digest.Digest(resp.Header.Get("OCI-Subject")), nil
+	}
+	return "", errors.New("No registry host to push")
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistry implements the blob upload session of registry, fail is
+// called before handling each request to inject failures.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*bytes.Buffer
+	blobs    map[digest.Digest][]byte
+	requests map[string]int
+	fail     func(r *http.Request, committed int) int
+	nextID   int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		sessions: map[string]*bytes.Buffer{},
+		blobs:    map[digest.Digest][]byte{},
+		requests: map[string]int{},
+	}
+}
+
+func (reg *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.requests[r.Method]++
+	const prefix = "/v2/library/foo/blobs/"
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	session := reg.sessions[strings.TrimPrefix(path, "uploads/")]
+
+	if reg.fail != nil {
+		committed := 0
+		if session != nil {
+			committed = session.Len()
+		}
+		if status := reg.fail(r, committed); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodHead:
+		if _, ok := reg.blobs[digest.Digest(path)]; ok {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPost && path == "uploads/":
+		reg.nextID++
+		id := fmt.Sprintf("session-%d", reg.nextID)
+		reg.sessions[id] = &bytes.Buffer{}
+		w.Header().Set("Location", prefix+"uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case session == nil:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodGet:
+		w.Header().Set("Location", r.URL.Path)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", session.Len()-1))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPatch:
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != session.Len() {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || len(data) != end-start+1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		session.Write(data)
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut:
+		dgst := digest.Digest(r.URL.Query().Get("digest"))
+		if digest.FromBytes(session.Bytes()) != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reg.blobs[dgst] = session.Bytes()
+		delete(reg.sessions, strings.TrimPrefix(path, "uploads/"))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newUploadRemote(t *testing.T, reg *fakeRegistry) (*Remote, func()) {
+	chunkSize, backoff := uploadChunkSize, uploadBackoff
+	uploadChunkSize, uploadBackoff = 4, time.Millisecond
+
+	server := httptest.NewServer(reg)
+	host := strings.TrimPrefix(server.URL, "http://")
+	remote, err := NewWithHosts(host+"/library/foo:latest", func() docker.RegistryHosts {
+		return func(string) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client:       server.Client(),
+				Host:         host,
+				Scheme:       "http",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve | docker.HostCapabilityPush,
+			}}, nil
+		}
+	})
+	require.Nil(t, err)
+
+	return remote, func() {
+		server.Close()
+		uploadChunkSize, uploadBackoff = chunkSize, backoff
+	}
+}
+
+func blobDesc(data []byte) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+}
+
+func TestPushBlobResume(t *testing.T) {
+	reg := newFakeRegistry()
+	// Fail the chunk after 8 bytes are committed for twice
+	failures := 0
+	reg.fail = func(r *http.Request, committed int) int {
+		if r.Method == http.MethodPatch && committed == 8 && failures < 2 {
+			failures++
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+	remote, cleanup := newUploadRemote(t, reg)
+	defer cleanup()
+
+	data := []byte("hello nydus blob")
+	desc := blobDesc(data)
+	require.Nil(t, remote.PushBlob(context.Background(), desc, bytes.NewReader(data)))
+	assert.Equal(t, data, reg.blobs[desc.Digest])
+	// Only one session is opened, and the committed chunks aren't resent
+	assert.Equal(t, 1, reg.requests[http.MethodPost])
+	assert.Equal(t, 6, reg.requests[http.MethodPatch])
+	assert.Equal(t, 2, reg.requests[http.MethodGet])
+
+	// The existing blob is skipped
+	require.Nil(t, remote.PushBlob(context.Background(), desc, bytes.NewReader(data)))
+	assert.Equal(t, 1, reg.requests[http.MethodPost])
+}
+
+func TestPushBlobRestart(t *testing.T) {
+	reg := newFakeRegistry()
+	// The session is lost after the first chunk failed
+	lost := false
+	reg.fail = func(r *http.Request, committed int) int {
+		if r.Method == http.MethodPatch && committed == 4 && !lost {
+			lost = true
+			for id := range reg.sessions {
+				delete(reg.sessions, id)
+			}
+			return http.StatusBadGateway
+		}
+		return 0
+	}
+	remote, cleanup := newUploadRemote(t, reg)
+	defer cleanup()
+
+	data := []byte("0123456789")
+	desc := blobDesc(data)
+	require.Nil(t, remote.PushBlob(context.Background(), desc, bytes.NewReader(data)))
+	assert.Equal(t, data, reg.blobs[desc.Digest])
+	assert.Equal(t, 2, reg.requests[http.MethodPost])
+}
+
+func TestPushBlobFailure(t *testing.T) {
+	// The client errors aren't retried
+	reg := newFakeRegistry()
+	reg.fail = func(r *http.Request, committed int) int {
+		if r.Method == http.MethodPatch {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	remote, cleanup := newUploadRemote(t, reg)
+	defer cleanup()
+
+	data := []byte("0123456789")
+	err := remote.PushBlob(context.Background(), blobDesc(data), bytes.NewReader(data))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "403")
+	assert.Equal(t, 1, reg.requests[http.MethodPatch])
+
+	// The server errors are retried until uploadRetries is exceeded
+	reg.fail = func(r *http.Request, committed int) int {
+		if r.Method == http.MethodPatch {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	reg.requests = map[string]int{}
+	err = remote.PushBlob(context.Background(), blobDesc(data), bytes.NewReader(data))
+	require.NotNil(t, err)
+	assert.Equal(t, uploadRetries+1, reg.requests[http.MethodPatch])
+}
+
+func TestParseRange(t *testing.T) {
+	for value, expected := range map[string]int64{"": 0, "0-0": 0, "0-3": 4, "0-1023": 1024} {
+		offset, err := parseRange(value)
+		require.Nil(t, err)
+		assert.Equal(t, expected, offset, value)
+	}
+	_, err := parseRange("bytes")
+	assert.NotNil(t, err)
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(&statusError{status: http.StatusServiceUnavailable}))
+	assert.True(t, retryable(&statusError{status: http.StatusTooManyRequests}))
+	assert.False(t, retryable(&statusError{status: http.StatusNotFound}))
+	assert.True(t, retryable(fmt.Errorf("connection reset by peer")))
+	assert.False(t, retryable(context.Canceled))
+}
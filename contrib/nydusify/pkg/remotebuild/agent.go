@@ -0,0 +1,296 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package remotebuild dispatches the layer building of conversion to a pool
+// of remote builder agents over gRPC, the layer tar stream is shipped to an
+// agent with the parent bootstrap, and the built bootstrap and blob are
+// shipped back, so that a thin CLI drives conversion on build machines.
+package remotebuild
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remotebuild/api"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// AgentOpt defines builder agent options.
+type AgentOpt struct {
+	NydusImagePath string
+	// WorkDir stores the files of the layers being built.
+	WorkDir string
+	// Concurrency is the max number of layers built at the same time, the
+	// other requests wait, defaults to 1.
+	Concurrency int
+	// TLSCertFile and TLSKeyFile serve the builder service over TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile requires the client certificates signed by the CA,
+	// it requires TLS.
+	TLSClientCAFile string
+	// Token requires the requests to carry the bearer token, it requires
+	// TLS.
+	Token string
+}
+
+// Agent builds the layers requested by Pool with local nydus-image, it
+// implements api.BuilderServer.
+type Agent struct {
+	AgentOpt
+	builder *build.Builder
+	slots   chan struct{}
+	options []grpc.ServerOption
+}
+
+// NewAgent creates Agent instance.
+func NewAgent(opt AgentOpt) (*Agent, error) {
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = 1
+	}
+	if opt.TLSCertFile == "" && (opt.TLSClientCAFile != "" || opt.Token != "") {
+		return nil, fmt.Errorf("Client CA and token require TLS certificate")
+	}
+	var options []grpc.ServerOption
+	if opt.TLSCertFile != "" {
+		config, err := serverTLSConfig(opt.TLSCertFile, opt.TLSKeyFile, opt.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	}
+	if opt.Token != "" {
+		token := tokenAuth(opt.Token)
+		options = append(options, grpc.UnaryInterceptor(token.unary), grpc.StreamInterceptor(token.stream))
+	}
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Create work directory")
+	}
+	return &Agent{
+		AgentOpt: opt,
+		builder:  build.NewBuilder(opt.NydusImagePath),
+		slots:    make(chan struct{}, opt.Concurrency),
+		options:  options,
+	}, nil
+}
+
+// Serve serves builder service on listener until it's closed.
+func (agent *Agent) Serve(listener net.Listener) error {
+	server := grpc.NewServer(agent.options...)
+	api.RegisterBuilderServer(server, agent)
+	logrus.Infof("Serving builder agent on %s", listener.Addr())
+	return server.Serve(listener)
+}
+
+// Probe returns the features of nydus-image on agent.
+func (agent *Agent) Probe(ctx context.Context, req *api.ProbeRequest) (*api.ProbeResponse, error) {
+	features, err := agent.builder.Probe()
+	if err != nil {
+		return &api.ProbeResponse{Error: toAPIError(err)}, nil
+	}
+	return &api.ProbeResponse{Features: toAPIFeatures(features)}, nil
+}
+
+// acquire waits for a build slot, the slot is released by calling the
+// returned function.
+func (agent *Agent) acquire(ctx context.Context) (func(), error) {
+	select {
+	case agent.slots <- struct{}{}:
+		return func() { <-agent.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sendError ends the response with the failure of nydus-image.
+func sendError(stream frameSender, err error) error {
+	return stream.Send(&api.Frame{Kind: api.Frame_ERROR, Error: toAPIError(err)})
+}
+
+// Build builds the layer in the frames of request with nydus-image.
+func (agent *Agent) Build(stream api.Builder_BuildServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.Kind != api.Frame_OPTION || req.Option == nil {
+		return errors.Errorf("Expect option frame, got %s", req.Kind)
+	}
+	option := req.Option
+	if option.Source != SourceTar && option.Source != SourceDir {
+		return errors.Errorf("Unsupported source %s", option.Source)
+	}
+
+	release, err := agent.acquire(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	dir, err := ioutil.TempDir(agent.WorkDir, "layer-")
+	if err != nil {
+		return errors.Wrap(err, "Create layer directory")
+	}
+	defer os.RemoveAll(dir)
+
+	builderOption := build.BuilderOption{
+		BootstrapPath:  filepath.Join(dir, "bootstrap"),
+		BlobPath:       filepath.Join(dir, "blob"),
+		OutputJSONPath: filepath.Join(dir, "output.json"),
+		WhiteoutSpec:   option.WhiteoutSpec,
+		PrefetchDir:    option.PrefetchDir,
+		Compressor:     option.Compressor,
+		FsVersion:      option.FsVersion,
+		ChunkSize:      option.ChunkSize,
+		BatchSize:      option.BatchSize,
+	}
+	inputs := newFileWriter(map[api.Frame_Kind]string{
+		api.Frame_PARENT_BOOTSTRAP: filepath.Join(dir, "parent-bootstrap"),
+		api.Frame_CHUNK_DICT:       filepath.Join(dir, "chunk-dict"),
+	})
+	defer inputs.close()
+
+	// The layer tar is piped into nydus-image, or unpacked to directory
+	// before building, once the first source frame is received
+	tarReader, tarWriter := io.Pipe()
+	defer tarReader.Close()
+	buildErr := make(chan error, 1)
+	started := false
+	start := func() error {
+		started = true
+		if err := inputs.close(); err != nil {
+			return err
+		}
+		if _, ok := inputs.files[api.Frame_PARENT_BOOTSTRAP]; ok {
+			builderOption.ParentBootstrapPath = inputs.paths[api.Frame_PARENT_BOOTSTRAP]
+		}
+		if _, ok := inputs.files[api.Frame_CHUNK_DICT]; ok {
+			builderOption.ChunkDictPath = inputs.paths[api.Frame_CHUNK_DICT]
+		}
+		go func() {
+			if option.Source == SourceTar {
+				builderOption.Tar = tarReader
+			} else {
+				rootfsPath := filepath.Join(dir, "rootfs")
+				if err := utils.UnpackTargz(context.Background(), rootfsPath, tarReader); err != nil {
+					tarReader.CloseWithError(err)
+					buildErr <- errors.Wrap(err, "Unpack layer tar")
+					return
+				}
+				builderOption.RootfsPath = rootfsPath
+			}
+			err := agent.builder.Run(builderOption)
+			// Unblock the receiving of source frames if nydus-image exits
+			// without reading the whole tar
+			tarReader.CloseWithError(io.ErrClosedPipe)
+			buildErr <- err
+		}()
+		return nil
+	}
+
+	for {
+		frame, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tarWriter.CloseWithError(err)
+			if started {
+				<-buildErr
+			}
+			return err
+		}
+		if frame.Kind != api.Frame_SOURCE {
+			if started {
+				return errors.Errorf("Unexpected %s frame after source frames", frame.Kind)
+			}
+			if err := inputs.write(frame); err != nil {
+				return errors.Wrapf(err, "Write %s", frame.Kind)
+			}
+			continue
+		}
+		if !started {
+			if err := start(); err != nil {
+				return errors.Wrap(err, "Write input files")
+			}
+		}
+		if _, err := tarWriter.Write(frame.Data); err != nil && err != io.ErrClosedPipe {
+			return errors.Wrap(err, "Stream layer tar")
+		}
+	}
+	if !started {
+		// An empty layer
+		if err := start(); err != nil {
+			return errors.Wrap(err, "Write input files")
+		}
+	}
+	tarWriter.Close()
+
+	if err := <-buildErr; err != nil {
+		logrus.WithError(err).Warn("Failed to build layer")
+		return sendError(stream, err)
+	}
+	for _, file := range []struct {
+		kind api.Frame_Kind
+		path string
+	}{
+		{api.Frame_OUTPUT, builderOption.OutputJSONPath},
+		{api.Frame_BOOTSTRAP, builderOption.BootstrapPath},
+		{api.Frame_BLOB, builderOption.BlobPath},
+	} {
+		if err := sendFile(stream, file.kind, file.path); err != nil {
+			return errors.Wrapf(err, "Send %s", file.kind)
+		}
+	}
+	return stream.Send(&api.Frame{Kind: api.Frame_DONE})
+}
+
+// Check dumps the blob and chunk digest list of the bootstrap in the
+// frames of request with nydus-image.
+func (agent *Agent) Check(stream api.Builder_CheckServer) error {
+	dir, err := ioutil.TempDir(agent.WorkDir, "check-")
+	if err != nil {
+		return errors.Wrap(err, "Create check directory")
+	}
+	defer os.RemoveAll(dir)
+
+	bootstrapPath := filepath.Join(dir, "bootstrap")
+	inputs := newFileWriter(map[api.Frame_Kind]string{api.Frame_BOOTSTRAP: bootstrapPath})
+	defer inputs.close()
+	for {
+		frame, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := inputs.write(frame); err != nil {
+			return errors.Wrapf(err, "Write %s", frame.Kind)
+		}
+	}
+	if err := inputs.close(); err != nil {
+		return errors.Wrap(err, "Write bootstrap")
+	}
+
+	outputJSONPath := filepath.Join(dir, "output.json")
+	if err := agent.builder.Check(bootstrapPath, outputJSONPath); err != nil {
+		return sendError(stream, err)
+	}
+	if err := sendFile(stream, api.Frame_OUTPUT, outputJSONPath); err != nil {
+		return errors.Wrap(err, "Send output")
+	}
+	return stream.Send(&api.Frame{Kind: api.Frame_DONE})
+}
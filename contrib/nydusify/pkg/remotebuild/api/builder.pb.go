@@ -0,0 +1,1021 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.24.0
+// 	protoc        (unknown)
+// source: builder.proto
+
+package api
+
+import (
+	context "context"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// This is a compile-time assertion that a sufficiently up-to-date version
+// of the legacy proto package is being used.
+const _ = proto.ProtoPackageIsVersion4
+
+type Frame_Kind int32
+
+const (
+	Frame_UNKNOWN Frame_Kind = 0
+	// OPTION carries the build option, it's the first frame of build
+	// request.
+	Frame_OPTION Frame_Kind = 1
+	// PARENT_BOOTSTRAP, CHUNK_DICT and SOURCE carry the data of parent
+	// bootstrap, chunk dictionary and layer tar of build request, in
+	// order.
+	Frame_PARENT_BOOTSTRAP Frame_Kind = 2
+	Frame_CHUNK_DICT       Frame_Kind = 3
+	Frame_SOURCE           Frame_Kind = 4
+	// BOOTSTRAP, BLOB and OUTPUT carry the data of built bootstrap,
+	// blob and output json of nydus-image, BOOTSTRAP carries the
+	// bootstrap to check in check request as well.
+	Frame_BOOTSTRAP Frame_Kind = 5
+	Frame_BLOB      Frame_Kind = 6
+	Frame_OUTPUT    Frame_Kind = 7
+	// ERROR carries the failure of nydus-image, it ends response.
+	Frame_ERROR Frame_Kind = 8
+	// DONE ends the response of a succeeded request.
+	Frame_DONE Frame_Kind = 9
+)
+
+// Enum value maps for Frame_Kind.
+var (
+	Frame_Kind_name = map[int32]string{
+		0: "UNKNOWN",
+		1: "OPTION",
+		2: "PARENT_BOOTSTRAP",
+		3: "CHUNK_DICT",
+		4: "SOURCE",
+		5: "BOOTSTRAP",
+		6: "BLOB",
+		7: "OUTPUT",
+		8: "ERROR",
+		9: "DONE",
+	}
+	Frame_Kind_value = map[string]int32{
+		"UNKNOWN":          0,
+		"OPTION":           1,
+		"PARENT_BOOTSTRAP": 2,
+		"CHUNK_DICT":       3,
+		"SOURCE":           4,
+		"BOOTSTRAP":        5,
+		"BLOB":             6,
+		"OUTPUT":           7,
+		"ERROR":            8,
+		"DONE":             9,
+	}
+)
+
+func (x Frame_Kind) Enum() *Frame_Kind {
+	p := new(Frame_Kind)
+	*p = x
+	return p
+}
+
+func (x Frame_Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Frame_Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_builder_proto_enumTypes[0].Descriptor()
+}
+
+func (Frame_Kind) Type() protoreflect.EnumType {
+	return &file_builder_proto_enumTypes[0]
+}
+
+func (x Frame_Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Frame_Kind.Descriptor instead.
+func (Frame_Kind) EnumDescriptor() ([]byte, []int) {
+	return file_builder_proto_rawDescGZIP(), []int{5, 0}
+}
+
+type ProbeRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *ProbeRequest) Reset() {
+	*x = ProbeRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_builder_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ProbeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProbeRequest) ProtoMessage() {}
+
+func (x *ProbeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_builder_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProbeRequest.ProtoReflect.Descriptor instead.
+func (*ProbeRequest) Descriptor() ([]byte, []int) {
+	return file_builder_proto_rawDescGZIP(), []int{0}
+}
+
+type ProbeResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Features *Features `protobuf:"bytes,1,opt,name=features,proto3" json:"features,omitempty"`
+	// error is set if nydus-image fails to be probed.
+	Error *Error `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *ProbeResponse) Reset() {
+	*x = ProbeResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_builder_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ProbeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProbeResponse) ProtoMessage() {}
+
+func (x *ProbeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_builder_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProbeResponse.ProtoReflect.Descriptor instead.
+func (*ProbeResponse) Descriptor() ([]byte, []int) {
+	return file_builder_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ProbeResponse) GetFeatures() *Features {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+func (x *ProbeResponse) GetError() *Error {
+	if x != nil {
+		return x.Error
+	}
+	return nil
+}
+
+// Features is build.Features of nydus-image on agent.
+type Features struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version    string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	FsVersion6 bool   `protobuf:"varint,2,opt,name=fs_version6,json=fsVersion6,proto3" json:"fs_version6,omitempty"`
+	ChunkSize  bool   `protobuf:"varint,3,opt,name=chunk_size,json=chunkSize,proto3" json:"chunk_size,omitempty"`
+	BatchSize  bool   `protobuf:"varint,4,opt,name=batch_size,json=batchSize,proto3" json:"batch_size,omitempty"`
+	Encrypt    bool   `protobuf:"varint,5,opt,name=encrypt,proto3" json:"encrypt,omitempty"`
+	Compressor bool   `protobuf:"varint,6,opt,name=compressor,proto3" json:"compressor,omitempty"`
+	Zstd       bool   `protobuf:"varint,7,opt,name=zstd,proto3" json:"zstd,omitempty"`
+	ChunkDict  bool   `protobuf:"varint,8,opt,name=chunk_dict,json=chunkDict,proto3" json:"chunk_dict,omitempty"`
+	TarRafs    bool   `protobuf:"varint,9,opt,name=tar_rafs,json=tarRafs,proto3" json:"tar_rafs,omitempty"`
+}
+
+func (x *Features) Reset() {
+	*x = Features{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_builder_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Features) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Features) ProtoMessage() {}
+
+func (x *Features) ProtoReflect() protoreflect.Message {
+	mi := &file_builder_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Features.ProtoReflect.Descriptor instead.
+func (*Features) Descriptor() ([]byte, []int) {
+	return file_builder_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Features) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *Features) GetFsVersion6() bool {
+	if x != nil {
+		return x.FsVersion6
+	}
+	return false
+}
+
+func (x *Features) GetChunkSize() bool {
+	if x != nil {
+		return x.ChunkSize
+	}
+	return false
+}
+
+func (x *Features) GetBatchSize() bool {
+	if x != nil {
+		return x.BatchSize
+	}
+	return false
+}
+
+func (x *Features) GetEncrypt() bool {
+	if x != nil {
+		return x.Encrypt
+	}
+	return false
+}
+
+func (x *Features) GetCompressor() bool {
+	if x != nil {
+		return x.Compressor
+	}
+	return false
+}
+
+func (x *Features) GetZstd() bool {
+	if x != nil {
+		return x.Zstd
+	}
+	return false
+}
+
+func (x *Features) GetChunkDict() bool {
+	if x != nil {
+		return x.ChunkDict
+	}
+	return false
+}
+
+func (x *Features) GetTarRafs() bool {
+	if x != nil {
+		return x.TarRafs
+	}
+	return false
+}
+
+// Option is the build option shipped to agent, the paths of
+// build.BuilderOption are replaced by frames.
+type Option struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// source is "tar" to build layer from the tar stream by tar-rafs, or
+	// "dir" to unpack the tar stream to a directory before building.
+	Source       string `protobuf:"bytes,1,opt,name=source,proto3" json:"source,omitempty"`
+	WhiteoutSpec string `protobuf:"bytes,2,opt,name=whiteout_spec,json=whiteoutSpec,proto3" json:"whiteout_spec,omitempty"`
+	PrefetchDir  string `protobuf:"bytes,3,opt,name=prefetch_dir,json=prefetchDir,proto3" json:"prefetch_dir,omitempty"`
+	Compressor   string `protobuf:"bytes,4,opt,name=compressor,proto3" json:"compressor,omitempty"`
+	FsVersion    string `protobuf:"bytes,5,opt,name=fs_version,json=fsVersion,proto3" json:"fs_version,omitempty"`
+	ChunkSize    uint64 `protobuf:"varint,6,opt,name=chunk_size,json=chunkSize,proto3" json:"chunk_size,omitempty"`
+	BatchSize    uint64 `protobuf:"varint,7,opt,name=batch_size,json=batchSize,proto3" json:"batch_size,omitempty"`
+}
+
+func (x *Option) Reset() {
+	*x = Option{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_builder_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Option) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Option) ProtoMessage() {}
+
+func (x *Option) ProtoReflect() protoreflect.Message {
+	mi := &file_builder_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Option.ProtoReflect.Descriptor instead.
+func (*Option) Descriptor() ([]byte, []int) {
+	return file_builder_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Option) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *Option) GetWhiteoutSpec() string {
+	if x != nil {
+		return x.WhiteoutSpec
+	}
+	return ""
+}
+
+func (x *Option) GetPrefetchDir() string {
+	if x != nil {
+		return x.PrefetchDir
+	}
+	return ""
+}
+
+func (x *Option) GetCompressor() string {
+	if x != nil {
+		return x.Compressor
+	}
+	return ""
+}
+
+func (x *Option) GetFsVersion() string {
+	if x != nil {
+		return x.FsVersion
+	}
+	return ""
+}
+
+func (x *Option) GetChunkSize() uint64 {
+	if x != nil {
+		return x.ChunkSize
+	}
+	return 0
+}
+
+func (x *Option) GetBatchSize() uint64 {
+	if x != nil {
+		return x.BatchSize
+	}
+	return 0
+}
+
+// Error is the failure of nydus-image on agent, classified by its output.
+type Error struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// kind is build.ErrorKind.
+	Kind    string `protobuf:"bytes,1,opt,name=kind,proto3" json:"kind,omitempty"`
+	Message string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Err     string `protobuf:"bytes,3,opt,name=err,proto3" json:"err,omitempty"`
+}
+
+func (x *Error) Reset() {
+	*x = Error{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_builder_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Error) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Error) ProtoMessage() {}
+
+func (x *Error) ProtoReflect() protoreflect.Message {
+	mi := &file_builder_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Error.ProtoReflect.Descriptor instead.
+func (*Error) Descriptor() ([]byte, []int) {
+	return file_builder_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Error) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *Error) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *Error) GetErr() string {
+	if x != nil {
+		return x.Err
+	}
+	return ""
+}
+
+// Frame is a piece of build and check request or response, the files and
+// the layer tar are split into frames of their kinds.
+type Frame struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Kind   Frame_Kind `protobuf:"varint,1,opt,name=kind,proto3,enum=nydusify.builder.v1.Frame_Kind" json:"kind,omitempty"`
+	Option *Option    `protobuf:"bytes,2,opt,name=option,proto3" json:"option,omitempty"`
+	Error  *Error     `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	Data   []byte     `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (x *Frame) Reset() {
+	*x = Frame{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_builder_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Frame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Frame) ProtoMessage() {}
+
+func (x *Frame) ProtoReflect() protoreflect.Message {
+	mi := &file_builder_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Frame.ProtoReflect.Descriptor instead.
+func (*Frame) Descriptor() ([]byte, []int) {
+	return file_builder_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Frame) GetKind() Frame_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return Frame_UNKNOWN
+}
+
+func (x *Frame) GetOption() *Option {
+	if x != nil {
+		return x.Option
+	}
+	return nil
+}
+
+func (x *Frame) GetError() *Error {
+	if x != nil {
+		return x.Error
+	}
+	return nil
+}
+
+func (x *Frame) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+var File_builder_proto protoreflect.FileDescriptor
+
+var file_builder_proto_rawDesc = []byte{
+	0x0a, 0x0d, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x65, 0x72, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
+	0x13, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2e, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x65,
+	0x72, 0x2e, 0x76, 0x31, 0x22, 0x0e, 0x0a, 0x0c, 0x50, 0x72, 0x6f, 0x62, 0x65, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x22, 0x7c, 0x0a, 0x0d, 0x50, 0x72, 0x6f, 0x62, 0x65, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x39, 0x0a, 0x08, 0x66, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65,
+	0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69,
+	0x66, 0x79, 0x2e, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x46, 0x65,
+	0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x52, 0x08, 0x66, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73,
+	0x12, 0x30, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x1a, 0x2e, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2e, 0x62, 0x75, 0x69, 0x6c, 0x64,
+	0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x52, 0x05, 0x65, 0x72, 0x72,
+	0x6f, 0x72, 0x22, 0x8b, 0x02, 0x0a, 0x08, 0x46, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x12,
+	0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x66, 0x73, 0x5f,
+	0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x36, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a,
+	0x66, 0x73, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x36, 0x12, 0x1d, 0x0a, 0x0a, 0x63, 0x68,
+	0x75, 0x6e, 0x6b, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09,
+	0x63, 0x68, 0x75, 0x6e, 0x6b, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x62, 0x61, 0x74,
+	0x63, 0x68, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x62,
+	0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x65, 0x6e, 0x63, 0x72,
+	0x79, 0x70, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x65, 0x6e, 0x63, 0x72, 0x79,
+	0x70, 0x74, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x6f, 0x72,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73,
+	0x6f, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x7a, 0x73, 0x74, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x08,
+	0x52, 0x04, 0x7a, 0x73, 0x74, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x63, 0x68, 0x75, 0x6e, 0x6b, 0x5f,
+	0x64, 0x69, 0x63, 0x74, 0x18, 0x08, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x63, 0x68, 0x75, 0x6e,
+	0x6b, 0x44, 0x69, 0x63, 0x74, 0x12, 0x19, 0x0a, 0x08, 0x74, 0x61, 0x72, 0x5f, 0x72, 0x61, 0x66,
+	0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x74, 0x61, 0x72, 0x52, 0x61, 0x66, 0x73,
+	0x22, 0xe5, 0x01, 0x0a, 0x06, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x73,
+	0x6f, 0x75, 0x72, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x73, 0x6f, 0x75,
+	0x72, 0x63, 0x65, 0x12, 0x23, 0x0a, 0x0d, 0x77, 0x68, 0x69, 0x74, 0x65, 0x6f, 0x75, 0x74, 0x5f,
+	0x73, 0x70, 0x65, 0x63, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x77, 0x68, 0x69, 0x74,
+	0x65, 0x6f, 0x75, 0x74, 0x53, 0x70, 0x65, 0x63, 0x12, 0x21, 0x0a, 0x0c, 0x70, 0x72, 0x65, 0x66,
+	0x65, 0x74, 0x63, 0x68, 0x5f, 0x64, 0x69, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b,
+	0x70, 0x72, 0x65, 0x66, 0x65, 0x74, 0x63, 0x68, 0x44, 0x69, 0x72, 0x12, 0x1e, 0x0a, 0x0a, 0x63,
+	0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x6f, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0a, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x6f, 0x72, 0x12, 0x1d, 0x0a, 0x0a, 0x66,
+	0x73, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x09, 0x66, 0x73, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1d, 0x0a, 0x0a, 0x63, 0x68,
+	0x75, 0x6e, 0x6b, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09,
+	0x63, 0x68, 0x75, 0x6e, 0x6b, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x62, 0x61, 0x74,
+	0x63, 0x68, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x62,
+	0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x22, 0x47, 0x0a, 0x05, 0x45, 0x72, 0x72, 0x6f,
+	0x72, 0x12, 0x12, 0x0a, 0x04, 0x6b, 0x69, 0x6e, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x6b, 0x69, 0x6e, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12,
+	0x10, 0x0a, 0x03, 0x65, 0x72, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x65, 0x72,
+	0x72, 0x22, 0xc5, 0x02, 0x0a, 0x05, 0x46, 0x72, 0x61, 0x6d, 0x65, 0x12, 0x33, 0x0a, 0x04, 0x6b,
+	0x69, 0x6e, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1f, 0x2e, 0x6e, 0x79, 0x64, 0x75,
+	0x73, 0x69, 0x66, 0x79, 0x2e, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e,
+	0x46, 0x72, 0x61, 0x6d, 0x65, 0x2e, 0x4b, 0x69, 0x6e, 0x64, 0x52, 0x04, 0x6b, 0x69, 0x6e, 0x64,
+	0x12, 0x33, 0x0a, 0x06, 0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x1b, 0x2e, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2e, 0x62, 0x75, 0x69, 0x6c,
+	0x64, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x06, 0x6f,
+	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x30, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2e,
+	0x62, 0x75, 0x69, 0x6c, 0x64, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x45, 0x72, 0x72, 0x6f, 0x72,
+	0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x22, 0x8b, 0x01, 0x0a, 0x04,
+	0x4b, 0x69, 0x6e, 0x64, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10,
+	0x00, 0x12, 0x0a, 0x0a, 0x06, 0x4f, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x10, 0x01, 0x12, 0x14, 0x0a,
+	0x10, 0x50, 0x41, 0x52, 0x45, 0x4e, 0x54, 0x5f, 0x42, 0x4f, 0x4f, 0x54, 0x53, 0x54, 0x52, 0x41,
+	0x50, 0x10, 0x02, 0x12, 0x0e, 0x0a, 0x0a, 0x43, 0x48, 0x55, 0x4e, 0x4b, 0x5f, 0x44, 0x49, 0x43,
+	0x54, 0x10, 0x03, 0x12, 0x0a, 0x0a, 0x06, 0x53, 0x4f, 0x55, 0x52, 0x43, 0x45, 0x10, 0x04, 0x12,
+	0x0d, 0x0a, 0x09, 0x42, 0x4f, 0x4f, 0x54, 0x53, 0x54, 0x52, 0x41, 0x50, 0x10, 0x05, 0x12, 0x08,
+	0x0a, 0x04, 0x42, 0x4c, 0x4f, 0x42, 0x10, 0x06, 0x12, 0x0a, 0x0a, 0x06, 0x4f, 0x55, 0x54, 0x50,
+	0x55, 0x54, 0x10, 0x07, 0x12, 0x09, 0x0a, 0x05, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x10, 0x08, 0x12,
+	0x08, 0x0a, 0x04, 0x44, 0x4f, 0x4e, 0x45, 0x10, 0x09, 0x32, 0xe3, 0x01, 0x0a, 0x07, 0x42, 0x75,
+	0x69, 0x6c, 0x64, 0x65, 0x72, 0x12, 0x4e, 0x0a, 0x05, 0x50, 0x72, 0x6f, 0x62, 0x65, 0x12, 0x21,
+	0x2e, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2e, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x65,
+	0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x62, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x22, 0x2e, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2e, 0x62, 0x75, 0x69,
+	0x6c, 0x64, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x72, 0x6f, 0x62, 0x65, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x43, 0x0a, 0x05, 0x42, 0x75, 0x69, 0x6c, 0x64, 0x12, 0x1a,
+	0x2e, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2e, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x65,
+	0x72, 0x2e, 0x76, 0x31, 0x2e, 0x46, 0x72, 0x61, 0x6d, 0x65, 0x1a, 0x1a, 0x2e, 0x6e, 0x79, 0x64,
+	0x75, 0x73, 0x69, 0x66, 0x79, 0x2e, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x65, 0x72, 0x2e, 0x76, 0x31,
+	0x2e, 0x46, 0x72, 0x61, 0x6d, 0x65, 0x28, 0x01, 0x30, 0x01, 0x12, 0x43, 0x0a, 0x05, 0x43, 0x68,
+	0x65, 0x63, 0x6b, 0x12, 0x1a, 0x2e, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2e, 0x62,
+	0x75, 0x69, 0x6c, 0x64, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x46, 0x72, 0x61, 0x6d, 0x65, 0x1a,
+	0x1a, 0x2e, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2e, 0x62, 0x75, 0x69, 0x6c, 0x64,
+	0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x46, 0x72, 0x61, 0x6d, 0x65, 0x28, 0x01, 0x30, 0x01, 0x42,
+	0x50, 0x5a, 0x4e, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x64, 0x72,
+	0x61, 0x67, 0x6f, 0x6e, 0x66, 0x6c, 0x79, 0x6f, 0x73, 0x73, 0x2f, 0x69, 0x6d, 0x61, 0x67, 0x65,
+	0x2d, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2f, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x69, 0x62,
+	0x2f, 0x6e, 0x79, 0x64, 0x75, 0x73, 0x69, 0x66, 0x79, 0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x72, 0x65,
+	0x6d, 0x6f, 0x74, 0x65, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x2f, 0x61, 0x70, 0x69, 0x3b, 0x61, 0x70,
+	0x69, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_builder_proto_rawDescOnce sync.Once
+	file_builder_proto_rawDescData = file_builder_proto_rawDesc
+)
+
+func file_builder_proto_rawDescGZIP() []byte {
+	file_builder_proto_rawDescOnce.Do(func() {
+		file_builder_proto_rawDescData = protoimpl.X.CompressGZIP(file_builder_proto_rawDescData)
+	})
+	return file_builder_proto_rawDescData
+}
+
+var file_builder_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_builder_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_builder_proto_goTypes = []interface{}{
+	(Frame_Kind)(0),       // 0: nydusify.builder.v1.Frame.Kind
+	(*ProbeRequest)(nil),  // 1: nydusify.builder.v1.ProbeRequest
+	(*ProbeResponse)(nil), // 2: nydusify.builder.v1.ProbeResponse
+	(*Features)(nil),      // 3: nydusify.builder.v1.Features
+	(*Option)(nil),        // 4: nydusify.builder.v1.Option
+	(*Error)(nil),         // 5: nydusify.builder.v1.Error
+	(*Frame)(nil),         // 6: nydusify.builder.v1.Frame
+}
+var file_builder_proto_depIdxs = []int32{
+	3, // 0: nydusify.builder.v1.ProbeResponse.features:type_name -> nydusify.builder.v1.Features
+	5, // 1: nydusify.builder.v1.ProbeResponse.error:type_name -> nydusify.builder.v1.Error
+	0, // 2: nydusify.builder.v1.Frame.kind:type_name -> nydusify.builder.v1.Frame.Kind
+	4, // 3: nydusify.builder.v1.Frame.option:type_name -> nydusify.builder.v1.Option
+	5, // 4: nydusify.builder.v1.Frame.error:type_name -> nydusify.builder.v1.Error
+	1, // 5: nydusify.builder.v1.Builder.Probe:input_type -> nydusify.builder.v1.ProbeRequest
+	6, // 6: nydusify.builder.v1.Builder.Build:input_type -> nydusify.builder.v1.Frame
+	6, // 7: nydusify.builder.v1.Builder.Check:input_type -> nydusify.builder.v1.Frame
+	2, // 8: nydusify.builder.v1.Builder.Probe:output_type -> nydusify.builder.v1.ProbeResponse
+	6, // 9: nydusify.builder.v1.Builder.Build:output_type -> nydusify.builder.v1.Frame
+	6, // 10: nydusify.builder.v1.Builder.Check:output_type -> nydusify.builder.v1.Frame
+	8, // [8:11] is the sub-list for method output_type
+	5, // [5:8] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_builder_proto_init() }
+func file_builder_proto_init() {
+	if File_builder_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_builder_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ProbeRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_builder_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ProbeResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_builder_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Features); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_builder_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Option); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_builder_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Error); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_builder_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Frame); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_builder_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_builder_proto_goTypes,
+		DependencyIndexes: file_builder_proto_depIdxs,
+		EnumInfos:         file_builder_proto_enumTypes,
+		MessageInfos:      file_builder_proto_msgTypes,
+	}.Build()
+	File_builder_proto = out.File
+	file_builder_proto_rawDesc = nil
+	file_builder_proto_goTypes = nil
+	file_builder_proto_depIdxs = nil
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// BuilderClient is the client API for Builder service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type BuilderClient interface {
+	// Probe returns the features of nydus-image on agent.
+	Probe(ctx context.Context, in *ProbeRequest, opts ...grpc.CallOption) (*ProbeResponse, error)
+	// Build receives the option, parent bootstrap, chunk dictionary and
+	// layer tar frames, and responds the output, bootstrap and blob frames,
+	// ended by a done or error frame.
+	Build(ctx context.Context, opts ...grpc.CallOption) (Builder_BuildClient, error)
+	// Check receives the bootstrap frames, and responds the output frames,
+	// ended by a done or error frame.
+	Check(ctx context.Context, opts ...grpc.CallOption) (Builder_CheckClient, error)
+}
+
+type builderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBuilderClient(cc grpc.ClientConnInterface) BuilderClient {
+	return &builderClient{cc}
+}
+
+func (c *builderClient) Probe(ctx context.Context, in *ProbeRequest, opts ...grpc.CallOption) (*ProbeResponse, error) {
+	out := new(ProbeResponse)
+	err := c.cc.Invoke(ctx, "/nydusify.builder.v1.Builder/Probe", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *builderClient) Build(ctx context.Context, opts ...grpc.CallOption) (Builder_BuildClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Builder_serviceDesc.Streams[0], "/nydusify.builder.v1.Builder/Build", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &builderBuildClient{stream}
+	return x, nil
+}
+
+type Builder_BuildClient interface {
+	Send(*Frame) error
+	Recv() (*Frame, error)
+	grpc.ClientStream
+}
+
+type builderBuildClient struct {
+	grpc.ClientStream
+}
+
+func (x *builderBuildClient) Send(m *Frame) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *builderBuildClient) Recv() (*Frame, error) {
+	m := new(Frame)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *builderClient) Check(ctx context.Context, opts ...grpc.CallOption) (Builder_CheckClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Builder_serviceDesc.Streams[1], "/nydusify.builder.v1.Builder/Check", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &builderCheckClient{stream}
+	return x, nil
+}
+
+type Builder_CheckClient interface {
+	Send(*Frame) error
+	Recv() (*Frame, error)
+	grpc.ClientStream
+}
+
+type builderCheckClient struct {
+	grpc.ClientStream
+}
+
+func (x *builderCheckClient) Send(m *Frame) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *builderCheckClient) Recv() (*Frame, error) {
+	m := new(Frame)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// BuilderServer is the server API for Builder service.
+type BuilderServer interface {
+	// Probe returns the features of nydus-image on agent.
+	Probe(context.Context, *ProbeRequest) (*ProbeResponse, error)
+	// Build receives the option, parent bootstrap, chunk dictionary and
+	// layer tar frames, and responds the output, bootstrap and blob frames,
+	// ended by a done or error frame.
+	Build(Builder_BuildServer) error
+	// Check receives the bootstrap frames, and responds the output frames,
+	// ended by a done or error frame.
+	Check(Builder_CheckServer) error
+}
+
+// UnimplementedBuilderServer can be embedded to have forward compatible implementations.
+type UnimplementedBuilderServer struct {
+}
+
+func (*UnimplementedBuilderServer) Probe(context.Context, *ProbeRequest) (*ProbeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Probe not implemented")
+}
+func (*UnimplementedBuilderServer) Build(Builder_BuildServer) error {
+	return status.Errorf(codes.Unimplemented, "method Build not implemented")
+}
+func (*UnimplementedBuilderServer) Check(Builder_CheckServer) error {
+	return status.Errorf(codes.Unimplemented, "method Check not implemented")
+}
+
+func RegisterBuilderServer(s *grpc.Server, srv BuilderServer) {
+	s.RegisterService(&_Builder_serviceDesc, srv)
+}
+
+func _Builder_Probe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProbeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BuilderServer).Probe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nydusify.builder.v1.Builder/Probe",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BuilderServer).Probe(ctx, req.(*ProbeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Builder_Build_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BuilderServer).Build(&builderBuildServer{stream})
+}
+
+type Builder_BuildServer interface {
+	Send(*Frame) error
+	Recv() (*Frame, error)
+	grpc.ServerStream
+}
+
+type builderBuildServer struct {
+	grpc.ServerStream
+}
+
+func (x *builderBuildServer) Send(m *Frame) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *builderBuildServer) Recv() (*Frame, error) {
+	m := new(Frame)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Builder_Check_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BuilderServer).Check(&builderCheckServer{stream})
+}
+
+type Builder_CheckServer interface {
+	Send(*Frame) error
+	Recv() (*Frame, error)
+	grpc.ServerStream
+}
+
+type builderCheckServer struct {
+	grpc.ServerStream
+}
+
+func (x *builderCheckServer) Send(m *Frame) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *builderCheckServer) Recv() (*Frame, error) {
+	m := new(Frame)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Builder_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "nydusify.builder.v1.Builder",
+	HandlerType: (*BuilderServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Probe",
+			Handler:    _Builder_Probe_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Build",
+			Handler:       _Builder_Build_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Check",
+			Handler:       _Builder_Check_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "builder.proto",
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remotebuild
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remotebuild/api"
+)
+
+// frameDataSize is the max size of data in a frame, the files and the
+// layer tar are split into frames of this size.
+const frameDataSize = 1 << 20
+
+// The source of layer in build request.
+const (
+	// SourceTar builds layer from the tar stream by tar-rafs.
+	SourceTar = "tar"
+	// SourceDir unpacks the tar stream to a directory on agent and builds
+	// layer from the directory, the whiteouts are kept as they are.
+	SourceDir = "dir"
+)
+
+func toAPIFeatures(features *build.Features) *api.Features {
+	return &api.Features{
+		Version:    features.Version,
+		FsVersion6: features.FsVersion6,
+		ChunkSize:  features.ChunkSize,
+		BatchSize:  features.BatchSize,
+		Encrypt:    features.Encrypt,
+		Compressor: features.Compressor,
+		Zstd:       features.Zstd,
+		ChunkDict:  features.ChunkDict,
+		TarRafs:    features.TarRafs,
+	}
+}
+
+func fromAPIFeatures(features *api.Features) *build.Features {
+	return &build.Features{
+		Version:    features.Version,
+		FsVersion6: features.FsVersion6,
+		ChunkSize:  features.ChunkSize,
+		BatchSize:  features.BatchSize,
+		Encrypt:    features.Encrypt,
+		Compressor: features.Compressor,
+		Zstd:       features.Zstd,
+		ChunkDict:  features.ChunkDict,
+		TarRafs:    features.TarRafs,
+	}
+}
+
+// toAPIError converts the failure of nydus-image to the error frame.
+func toAPIError(err error) *api.Error {
+	var buildErr *build.BuildError
+	if errors.As(err, &buildErr) {
+		return &api.Error{Kind: string(buildErr.Kind), Message: buildErr.Message, Err: buildErr.Err.Error()}
+	}
+	return &api.Error{Kind: string(build.ErrorKindUnknown), Err: err.Error()}
+}
+
+// fromAPIError converts the error frame to build.BuildError.
+func fromAPIError(err *api.Error) error {
+	return &build.BuildError{
+		Kind:    build.ErrorKind(err.Kind),
+		Message: err.Message,
+		Err:     errors.New(err.Err),
+	}
+}
+
+// frameSender sends frames by a stream of builder service.
+type frameSender interface {
+	Send(*api.Frame) error
+}
+
+// frameReceiver receives frames by a stream of builder service.
+type frameReceiver interface {
+	Recv() (*api.Frame, error)
+}
+
+// sendReader splits the data of reader into frames of kind.
+func sendReader(stream frameSender, kind api.Frame_Kind, reader io.Reader) error {
+	buf := make([]byte, frameDataSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			if err := stream.Send(&api.Frame{Kind: kind, Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendFile sends the file in frames of kind, nothing is sent if path is
+// empty or the file doesn't exist.
+func sendFile(stream frameSender, kind api.Frame_Kind, path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return sendReader(stream, kind, file)
+}
+
+// fileWriter appends the data of frames to the files by kind, the file
+// is created on the first frame of its kind.
+type fileWriter struct {
+	paths map[api.Frame_Kind]string
+	files map[api.Frame_Kind]*os.File
+}
+
+func newFileWriter(paths map[api.Frame_Kind]string) *fileWriter {
+	return &fileWriter{paths: paths, files: map[api.Frame_Kind]*os.File{}}
+}
+
+func (w *fileWriter) write(frame *api.Frame) error {
+	file, ok := w.files[frame.Kind]
+	if !ok {
+		path, ok := w.paths[frame.Kind]
+		if !ok {
+			return errors.Errorf("unexpected %s frame", frame.Kind)
+		}
+		var err error
+		if file, err = os.Create(path); err != nil {
+			return err
+		}
+		w.files[frame.Kind] = file
+	}
+	_, err := file.Write(frame.Data)
+	return err
+}
+
+func (w *fileWriter) close() error {
+	var closeErr error
+	for _, file := range w.files {
+		if err := file.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
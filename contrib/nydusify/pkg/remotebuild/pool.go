@@ -0,0 +1,317 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remotebuild
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remotebuild/api"
+)
+
+// agentConn is the connection to a builder agent.
+type agentConn struct {
+	address string
+	conn    *grpc.ClientConn
+	client  api.BuilderClient
+	// inflight is the number of requests being served by agent.
+	inflight int
+}
+
+// Pool dispatches the requests of build workflow to builder agents, it
+// implements build.Runner. Each request is dispatched to the agent serving
+// the least requests, so the layers of the images converted concurrently
+// are spread over agents.
+type Pool struct {
+	mu     sync.Mutex
+	agents []*agentConn
+
+	probeOnce sync.Once
+	features  *build.Features
+	probeErr  error
+}
+
+// PoolOpt defines builder agent pool options.
+type PoolOpt struct {
+	// Addresses are the agents in host:port.
+	Addresses []string
+	// TLS connects the agents over TLS, the agent certificates are verified
+	// by the CA in TLSCAFile in addition to system ones.
+	TLS       bool
+	TLSCAFile string
+	// TLSCertFile and TLSKeyFile are the client certificate presented to
+	// the agents requiring mutual TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// Token is the bearer token sent to the agents, it requires TLS.
+	Token string
+}
+
+// NewPool creates Pool connecting to the agents, the connections are
+// established lazily.
+func NewPool(opt PoolOpt) (*Pool, error) {
+	if len(opt.Addresses) == 0 {
+		return nil, fmt.Errorf("No builder agent address")
+	}
+	if !opt.TLS && (opt.TLSCAFile != "" || opt.TLSCertFile != "" || opt.Token != "") {
+		return nil, fmt.Errorf("Builder agent CA, certificate and token require TLS")
+	}
+	dialOpts := []grpc.DialOption{grpc.WithInsecure()}
+	if opt.TLS {
+		config, err := clientTLSConfig(opt.TLSCAFile, opt.TLSCertFile, opt.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(config))}
+	}
+	if opt.Token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(tokenCredentials(opt.Token)))
+	}
+	pool := &Pool{}
+	for _, address := range opt.Addresses {
+		conn, err := grpc.Dial(address, dialOpts...)
+		if err != nil {
+			pool.Close()
+			return nil, errors.Wrapf(err, "Dial builder agent %s", address)
+		}
+		pool.agents = append(pool.agents, &agentConn{
+			address: address,
+			conn:    conn,
+			client:  api.NewBuilderClient(conn),
+		})
+	}
+	return pool, nil
+}
+
+// Close closes the connections to agents.
+func (pool *Pool) Close() error {
+	var closeErr error
+	for _, agent := range pool.agents {
+		if err := agent.conn.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+// pick returns the agent serving the least requests except the tried
+// ones, the returned agent should be released by done.
+func (pool *Pool) pick(tried map[*agentConn]bool) *agentConn {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	var picked *agentConn
+	for _, agent := range pool.agents {
+		if tried[agent] {
+			continue
+		}
+		if picked == nil || agent.inflight < picked.inflight {
+			picked = agent
+		}
+	}
+	if picked != nil {
+		picked.inflight++
+	}
+	return picked
+}
+
+func (pool *Pool) done(agent *agentConn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	agent.inflight--
+}
+
+// frameStream is the client stream of build and check requests.
+type frameStream interface {
+	frameSender
+	frameReceiver
+	CloseSend() error
+}
+
+// stream opens a stream by open on an agent, the agents refusing the
+// stream are skipped, as nothing is sent yet.
+func (pool *Pool) stream(open func(client api.BuilderClient) (frameStream, error)) (frameStream, *agentConn, error) {
+	tried := map[*agentConn]bool{}
+	var lastErr error
+	for {
+		agent := pool.pick(tried)
+		if agent == nil {
+			return nil, nil, errors.Wrap(lastErr, "No available builder agent")
+		}
+		stream, err := open(agent.client)
+		if err == nil {
+			return stream, agent, nil
+		}
+		pool.done(agent)
+		tried[agent] = true
+		lastErr = err
+		logrus.Warnf("Builder agent %s is unavailable: %s", agent.address, err)
+	}
+}
+
+// Probe returns the features supported by all agents, as a layer may be
+// built by any of them, the version is of the first agent.
+func (pool *Pool) Probe() (*build.Features, error) {
+	pool.probeOnce.Do(func() {
+		var features *build.Features
+		for _, agent := range pool.agents {
+			resp, err := agent.client.Probe(context.Background(), &api.ProbeRequest{})
+			if err != nil {
+				pool.probeErr = errors.Wrapf(err, "Probe builder agent %s", agent.address)
+				return
+			}
+			if resp.Error != nil {
+				pool.probeErr = errors.Errorf("Probe builder agent %s: %s", agent.address, resp.Error.Err)
+				return
+			}
+			if resp.Features == nil {
+				pool.probeErr = errors.Errorf("Probe builder agent %s: no features", agent.address)
+				return
+			}
+			agentFeatures := fromAPIFeatures(resp.Features)
+			if features == nil {
+				features = agentFeatures
+				continue
+			}
+			features.FsVersion6 = features.FsVersion6 && agentFeatures.FsVersion6
+			features.ChunkSize = features.ChunkSize && agentFeatures.ChunkSize
+			features.BatchSize = features.BatchSize && agentFeatures.BatchSize
+			features.Encrypt = features.Encrypt && agentFeatures.Encrypt
+			features.Compressor = features.Compressor && agentFeatures.Compressor
+			features.Zstd = features.Zstd && agentFeatures.Zstd
+			features.ChunkDict = features.ChunkDict && agentFeatures.ChunkDict
+			features.TarRafs = features.TarRafs && agentFeatures.TarRafs
+		}
+		pool.features = features
+		logrus.Debugf("Detected features of builder agents: %+v", *features)
+	})
+	return pool.features, pool.probeErr
+}
+
+// receive writes the frames of response to the files by kind until the
+// response is done, the failure of nydus-image on agent is returned as
+// build.BuildError.
+func receive(stream frameReceiver, paths map[api.Frame_Kind]string) error {
+	outputs := newFileWriter(paths)
+	defer outputs.close()
+	for {
+		frame, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("Response ended without done frame")
+			}
+			return err
+		}
+		switch frame.Kind {
+		case api.Frame_DONE:
+			return outputs.close()
+		case api.Frame_ERROR:
+			if frame.Error == nil {
+				return errors.New("Unknown error of builder agent")
+			}
+			return fromAPIError(frame.Error)
+		default:
+			if err := outputs.write(frame); err != nil {
+				return errors.Wrapf(err, "Write %s", frame.Kind)
+			}
+		}
+	}
+}
+
+// Run builds layer by option on an agent, the layer tar is streamed from
+// option.Tar, or packed from option.RootfsPath and unpacked on agent.
+func (pool *Pool) Run(option build.BuilderOption) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, agent, err := pool.stream(func(client api.BuilderClient) (frameStream, error) {
+		return client.Build(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	defer pool.done(agent)
+	logrus.Debugf("Building layer on builder agent %s", agent.address)
+
+	source := SourceTar
+	tarReader := option.Tar
+	if tarReader == nil {
+		source = SourceDir
+		diff := archive.Diff(ctx, "", option.RootfsPath)
+		defer diff.Close()
+		tarReader = diff
+	}
+
+	sendErr := func() error {
+		if err := stream.Send(&api.Frame{Kind: api.Frame_OPTION, Option: &api.Option{
+			Source:       source,
+			WhiteoutSpec: option.WhiteoutSpec,
+			PrefetchDir:  option.PrefetchDir,
+			Compressor:   option.Compressor,
+			FsVersion:    option.FsVersion,
+			ChunkSize:    option.ChunkSize,
+			BatchSize:    option.BatchSize,
+		}}); err != nil {
+			return err
+		}
+		if err := sendFile(stream, api.Frame_PARENT_BOOTSTRAP, option.ParentBootstrapPath); err != nil {
+			return err
+		}
+		if err := sendFile(stream, api.Frame_CHUNK_DICT, option.ChunkDictPath); err != nil {
+			return err
+		}
+		if err := sendReader(stream, api.Frame_SOURCE, tarReader); err != nil {
+			return err
+		}
+		return stream.CloseSend()
+	}()
+	// The agent ends the stream early on failure, the error is received
+	// from the stream instead
+	if sendErr != nil && sendErr != io.EOF {
+		return errors.Wrapf(sendErr, "Send layer to builder agent %s", agent.address)
+	}
+
+	if err := receive(stream, map[api.Frame_Kind]string{
+		api.Frame_OUTPUT:    option.OutputJSONPath,
+		api.Frame_BOOTSTRAP: option.BootstrapPath,
+		api.Frame_BLOB:      option.BlobPath,
+	}); err != nil {
+		return errors.Wrapf(err, "Build layer on builder agent %s", agent.address)
+	}
+	return nil
+}
+
+// Check dumps the blob and chunk digest list of bootstrap on an agent.
+func (pool *Pool) Check(bootstrapPath, outputJSONPath string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, agent, err := pool.stream(func(client api.BuilderClient) (frameStream, error) {
+		return client.Check(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	defer pool.done(agent)
+
+	if err := sendFile(stream, api.Frame_BOOTSTRAP, bootstrapPath); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "Send bootstrap to builder agent %s", agent.address)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	if err := receive(stream, map[api.Frame_Kind]string{api.Frame_OUTPUT: outputJSONPath}); err != nil {
+		return errors.Wrapf(err, "Check bootstrap on builder agent %s", agent.address)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remotebuild
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
+)
+
+// The fake nydus-image dumps the tar stream or the file list of directory
+// as blob, and appends a line to parent bootstrap as bootstrap.
+const fakeNydusImage = `#!/bin/sh
+if [ "$1" = --version ]; then echo 'Version: 2.0.0'; exit 0; fi
+if [ "$2" = --help ]; then echo '--chunk-dict <chunk-dict>'; echo '--source-type <source-type> [possible values: directory, tar-rafs]'; exit 0; fi
+cmd=$1; shift
+while [ $# -gt 0 ]; do
+  case "$1" in
+    --bootstrap) bootstrap=$2; shift 2;;
+    --blob) blob=$2; shift 2;;
+    --output-json) output=$2; shift 2;;
+    --parent-bootstrap) parent=$2; shift 2;;
+    --source-type) type=$2; shift 2;;
+    --*) shift 2;;
+    *) source=$1; shift;;
+  esac
+done
+if [ "$cmd" = check ]; then echo '{"Blobs":["blob"],"Chunks":["chunk"]}' > "$output"; exit 0; fi
+cat > /dev/null
+if [ "$type" = tar-rafs ]; then cat "$source" > "$blob"; else (cd "$source" && find . | sort) > "$blob"; fi
+if grep -q fail "$blob"; then echo 'File name too long (os error 36)' >&2; exit 1; fi
+{ if [ -n "$parent" ]; then cat "$parent"; fi; echo layer; } > "$bootstrap"
+echo '{"Blobs":["blob"]}' > "$output"
+`
+
+func startAgent(t *testing.T, dir string, opt AgentOpt) string {
+	binary := filepath.Join(dir, "nydus-image")
+	require.Nil(t, ioutil.WriteFile(binary, []byte(fakeNydusImage), 0755))
+	opt.NydusImagePath = binary
+	opt.WorkDir = filepath.Join(dir, "agent")
+	agent, err := NewAgent(opt)
+	require.Nil(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go agent.Serve(listener)
+	return listener.Addr().String()
+}
+
+func TestPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-remotebuild-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	address := startAgent(t, dir, AgentOpt{})
+	// The unavailable agent is skipped
+	unavailable, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	unavailable.Close()
+	pool, err := NewPool(PoolOpt{Addresses: []string{unavailable.Addr().String(), address}})
+	require.Nil(t, err)
+	defer pool.Close()
+
+	features, err := (&Pool{agents: pool.agents[1:]}).Probe()
+	require.Nil(t, err)
+	assert.Equal(t, build.Features{Version: "2.0.0", ChunkDict: true, TarRafs: true}, *features)
+
+	output := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.Nil(t, err)
+		return string(data)
+	}
+
+	// Build from tar stream on top of parent bootstrap
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "parent-bootstrap"), []byte("parent\n"), 0644))
+	option := build.BuilderOption{
+		ParentBootstrapPath: filepath.Join(dir, "parent-bootstrap"),
+		BootstrapPath:       filepath.Join(dir, "bootstrap"),
+		BlobPath:            filepath.Join(dir, "blob"),
+		OutputJSONPath:      filepath.Join(dir, "output.json"),
+		WhiteoutSpec:        "oci",
+		Tar:                 bytes.NewReader(bytes.Repeat([]byte("layer data "), frameDataSize/4)),
+	}
+	require.Nil(t, pool.Run(option))
+	assert.Equal(t, "parent\nlayer\n", output("bootstrap"))
+	assert.Equal(t, string(bytes.Repeat([]byte("layer data "), frameDataSize/4)), output("blob"))
+	assert.Equal(t, "{\"Blobs\":[\"blob\"]}\n", output("output.json"))
+	for _, agent := range pool.agents {
+		assert.Equal(t, 0, agent.inflight)
+	}
+
+	// Build from directory
+	rootfs := filepath.Join(dir, "rootfs")
+	require.Nil(t, os.MkdirAll(filepath.Join(rootfs, "sub"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootfs, "sub", ".wh.removed"), nil, 0644))
+	option.ParentBootstrapPath = ""
+	option.Tar = nil
+	option.RootfsPath = rootfs
+	require.Nil(t, pool.Run(option))
+	assert.Equal(t, "layer\n", output("bootstrap"))
+	assert.Equal(t, ".\n./sub\n./sub/.wh.removed\n", output("blob"))
+
+	// The failure of nydus-image is classified
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.Nil(t, tw.WriteHeader(&tar.Header{Name: "fail", Mode: 0644, Typeflag: tar.TypeReg}))
+	require.Nil(t, tw.Close())
+	option.Tar = &buf
+	err = pool.Run(option)
+	var buildErr *build.BuildError
+	require.True(t, errors.As(err, &buildErr))
+	assert.Equal(t, build.ErrorKindPathTooLong, buildErr.Kind)
+
+	require.Nil(t, pool.Check(option.BootstrapPath, filepath.Join(dir, "check.json")))
+	assert.Equal(t, "{\"Blobs\":[\"blob\"],\"Chunks\":[\"chunk\"]}\n", output("check.json"))
+
+	// The layer directories are removed from agent
+	files, err := ioutil.ReadDir(filepath.Join(dir, "agent"))
+	require.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key, it
+// serves as the CA of itself.
+func writeCert(t *testing.T, certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nydusify"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyData, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600))
+	require.Nil(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyData}), 0600))
+}
+
+func TestPoolAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-remotebuild-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert := filepath.Join(dir, "server.crt")
+	serverKey := filepath.Join(dir, "server.key")
+	writeCert(t, serverCert, serverKey)
+	clientCert := filepath.Join(dir, "client.crt")
+	clientKey := filepath.Join(dir, "client.key")
+	writeCert(t, clientCert, clientKey)
+
+	// Client CA and token require TLS
+	_, err = NewAgent(AgentOpt{WorkDir: filepath.Join(dir, "agent"), Token: "secret"})
+	assert.NotNil(t, err)
+	_, err = NewPool(PoolOpt{Addresses: []string{"127.0.0.1:8090"}, Token: "secret"})
+	assert.NotNil(t, err)
+
+	address := startAgent(t, dir, AgentOpt{
+		TLSCertFile:     serverCert,
+		TLSKeyFile:      serverKey,
+		TLSClientCAFile: clientCert,
+		Token:           "secret",
+	})
+	probe := func(opt PoolOpt) error {
+		opt.Addresses = []string{address}
+		pool, err := NewPool(opt)
+		require.Nil(t, err)
+		defer pool.Close()
+		_, err = pool.Probe()
+		return err
+	}
+
+	// Plain text connection
+	assert.NotNil(t, probe(PoolOpt{}))
+	// Unknown CA
+	assert.NotNil(t, probe(PoolOpt{TLS: true, TLSCertFile: clientCert, TLSKeyFile: clientKey, Token: "secret"}))
+	// No client certificate
+	assert.NotNil(t, probe(PoolOpt{TLS: true, TLSCAFile: serverCert, Token: "secret"}))
+	// Unknown client certificate
+	assert.NotNil(t, probe(PoolOpt{TLS: true, TLSCAFile: serverCert, TLSCertFile: serverCert, TLSKeyFile: serverKey, Token: "secret"}))
+	// Invalid token
+	err = probe(PoolOpt{TLS: true, TLSCAFile: serverCert, TLSCertFile: clientCert, TLSKeyFile: clientKey, Token: "invalid"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid builder token")
+
+	assert.Nil(t, probe(PoolOpt{TLS: true, TLSCAFile: serverCert, TLSCertFile: clientCert, TLSKeyFile: clientKey, Token: "secret"}))
+}
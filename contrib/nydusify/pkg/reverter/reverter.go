@@ -0,0 +1,223 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package reverter converts a Nydus image back to OCI image, the Nydus
+// image is mounted by nydusd and its rootfs is packed into a gzip tar layer.
+package reverter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/mounter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Opt defines Reverter options.
+type Opt struct {
+	WorkDir        string
+	Source         string
+	SourceInsecure bool
+	TargetRemote   *remote.Remote
+	NydusdPath     string
+	// BackendType and BackendConfig specify the storage backend of Nydus
+	// blobs in source image, the blobs are pulled from source registry if
+	// it's empty.
+	BackendType    string
+	BackendConfig  string
+	DockerV2Format bool
+}
+
+// Reverter converts Nydus image to OCI image with a single layer, the
+// layers of original OCI image can't be restored since they are merged
+// into one bootstrap.
+type Reverter struct {
+	Opt
+	parser *parser.Parser
+}
+
+// New creates Reverter instance, source is the Nydus image reference.
+func New(opt Opt) (*Reverter, error) {
+	sourceRemote, err := provider.DefaultRemote(opt.Source, opt.SourceInsecure)
+	if err != nil {
+		return nil, errors.Wrap(err, "init source image parser")
+	}
+	return &Reverter{
+		Opt:    opt,
+		parser: parser.New(sourceRemote),
+	}, nil
+}
+
+// packLayer packs the rootfs into gzip tar layer file, and returns the
+// digest of compressed layer and the diff id of uncompressed tar.
+func packLayer(ctx context.Context, rootfs, layerPath string) (digest.Digest, digest.Digest, error) {
+	file, err := os.Create(layerPath)
+	if err != nil {
+		return "", "", errors.Wrap(err, "create layer file")
+	}
+	defer file.Close()
+
+	layerDigester := digest.Canonical.Digester()
+	gw := gzip.NewWriter(io.MultiWriter(file, layerDigester.Hash()))
+	diffIDDigester := digest.Canonical.Digester()
+	tw := io.MultiWriter(gw, diffIDDigester.Hash())
+
+	// The whole rootfs is regarded as added files without lower directory
+	if err := archive.WriteDiff(ctx, tw, "", rootfs); err != nil {
+		return "", "", errors.Wrap(err, "write rootfs to tar")
+	}
+	if err := gw.Close(); err != nil {
+		return "", "", errors.Wrap(err, "close gzip writer")
+	}
+	if err := file.Sync(); err != nil {
+		return "", "", errors.Wrap(err, "sync layer file")
+	}
+
+	return layerDigester.Digest(), diffIDDigester.Digest(), nil
+}
+
+// makeConfig replaces the Nydus layers in config with the reverted layer.
+func makeConfig(config ocispec.Image, diffID digest.Digest, source string) ocispec.Image {
+	created := time.Now().UTC()
+	config.RootFS = ocispec.RootFS{
+		Type:    "layers",
+		DiffIDs: []digest.Digest{diffID},
+	}
+	config.History = []ocispec.History{{
+		Created:   &created,
+		CreatedBy: "nydusify convert --reverse",
+		Comment:   fmt.Sprintf("reverted from Nydus image %s", source),
+	}}
+	return config
+}
+
+// Revert mounts the Nydus image, packs its rootfs into an OCI layer, and
+// pushes the OCI image to target.
+func (reverter *Reverter) Revert(ctx context.Context) (*ocispec.Descriptor, error) {
+	parsed, err := reverter.parser.Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse source image")
+	}
+	if parsed.NydusImage == nil {
+		return nil, fmt.Errorf("not found Nydus image in %s", reverter.Source)
+	}
+
+	if err := os.RemoveAll(reverter.WorkDir); err != nil {
+		return nil, errors.Wrap(err, "clean up work directory")
+	}
+	if err := os.MkdirAll(reverter.WorkDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create work directory")
+	}
+	defer os.RemoveAll(reverter.WorkDir)
+
+	rootfs := filepath.Join(reverter.WorkDir, "rootfs")
+	m, err := mounter.New(mounter.Opt{
+		WorkDir:        filepath.Join(reverter.WorkDir, "nydus"),
+		Target:         reverter.Source,
+		TargetInsecure: reverter.SourceInsecure,
+		Mountpoint:     rootfs,
+		NydusdPath:     reverter.NydusdPath,
+		BackendType:    reverter.BackendType,
+		BackendConfig:  reverter.BackendConfig,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "create mounter")
+	}
+	if err := m.Mount(ctx); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := m.Umount(); err != nil {
+			logrus.Warnf("Failed to umount source image: %s", err)
+		}
+	}()
+
+	layerPath := filepath.Join(reverter.WorkDir, "layer.tar.gz")
+	logrus.Infof("Packing rootfs of %s to OCI layer", reverter.Source)
+	layerDigest, diffID, err := packLayer(ctx, rootfs, layerPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "pack OCI layer")
+	}
+	// The blobs are read by nydusd during packing only
+	if err := m.Umount(); err != nil {
+		return nil, err
+	}
+
+	layerMediaType := ocispec.MediaTypeImageLayerGzip
+	configMediaType := ocispec.MediaTypeImageConfig
+	manifestMediaType := ocispec.MediaTypeImageManifest
+	if reverter.DockerV2Format {
+		layerMediaType = images.MediaTypeDockerSchema2LayerGzip
+		configMediaType = images.MediaTypeDockerSchema2Config
+		manifestMediaType = images.MediaTypeDockerSchema2Manifest
+	}
+
+	layerFile, err := os.Open(layerPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open layer file")
+	}
+	defer layerFile.Close()
+	info, err := layerFile.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat layer file")
+	}
+	layerDesc := ocispec.Descriptor{
+		MediaType: layerMediaType,
+		Digest:    layerDigest,
+		Size:      info.Size(),
+	}
+	logrus.Infof("Pushing OCI layer %s", layerDigest)
+	if err := reverter.TargetRemote.PushBlob(ctx, layerDesc, layerFile); err != nil {
+		return nil, errors.Wrap(err, "push OCI layer")
+	}
+
+	config := makeConfig(parsed.NydusImage.Config, diffID, reverter.Source)
+	configDesc, configBytes, err := utils.MarshalToDesc(config, configMediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal OCI image config")
+	}
+	if err := reverter.TargetRemote.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return nil, errors.Wrap(err, "push OCI image config")
+	}
+
+	manifest := struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{
+		MediaType: manifestMediaType,
+		Manifest: ocispec.Manifest{
+			Versioned: specs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: *configDesc,
+			Layers: []ocispec.Descriptor{layerDesc},
+		},
+	}
+	manifestDesc, manifestBytes, err := utils.MarshalToDesc(manifest, manifestMediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal OCI image manifest")
+	}
+	if err := reverter.TargetRemote.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
+		return nil, errors.Wrap(err, "push OCI image manifest")
+	}
+
+	return manifestDesc, nil
+}
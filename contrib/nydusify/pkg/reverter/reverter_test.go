@@ -0,0 +1,90 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package reverter
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-reverter-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	require.Nil(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootfs, "etc", "hosts"), []byte("127.0.0.1 localhost"), 0644))
+	require.Nil(t, os.Symlink("etc/hosts", filepath.Join(rootfs, "hosts")))
+
+	layerPath := filepath.Join(dir, "layer.tar.gz")
+	layerDigest, diffID, err := packLayer(context.Background(), rootfs, layerPath)
+	require.Nil(t, err)
+
+	layerFile, err := os.Open(layerPath)
+	require.Nil(t, err)
+	defer layerFile.Close()
+	actualDigest, err := digest.FromReader(layerFile)
+	require.Nil(t, err)
+	assert.Equal(t, actualDigest, layerDigest)
+
+	_, err = layerFile.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+	gr, err := gzip.NewReader(layerFile)
+	require.Nil(t, err)
+	diffIDDigester := digest.Canonical.Digester()
+	tr := tar.NewReader(io.TeeReader(gr, diffIDDigester.Hash()))
+	entries := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.Nil(t, err)
+		entries[hdr.Name] = string(data) + hdr.Linkname
+	}
+	_, err = io.Copy(ioutil.Discard, gr)
+	require.Nil(t, err)
+	assert.Equal(t, diffIDDigester.Digest(), diffID)
+	assert.Equal(t, map[string]string{
+		"etc/":      "",
+		"etc/hosts": "127.0.0.1 localhost",
+		"hosts":     "etc/hosts",
+	}, entries)
+}
+
+func TestMakeConfig(t *testing.T) {
+	config := ocispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		Config: ocispec.ImageConfig{
+			Entrypoint: []string{"/bin/sh"},
+		},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{"sha256:aaa", "sha256:bbb"},
+		},
+	}
+	reverted := makeConfig(config, "sha256:ccc", "myregistry/repo:tag-nydus")
+	assert.Equal(t, []digest.Digest{"sha256:ccc"}, reverted.RootFS.DiffIDs)
+	assert.Len(t, reverted.History, 1)
+	assert.Equal(t, []string{"/bin/sh"}, reverted.Config.Entrypoint)
+	assert.Equal(t, "amd64", reverted.Architecture)
+	// The original config isn't modified
+	assert.Len(t, config.RootFS.DiffIDs, 2)
+}
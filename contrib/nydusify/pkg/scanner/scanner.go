@@ -0,0 +1,286 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package scanner scans the vulnerabilities of the packages installed in
+// a directory by `trivy` or `grype` binary, the findings of both tools
+// are normalized into the same report.
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ToolTrivy = "trivy"
+	ToolGrype = "grype"
+)
+
+// The severities of vulnerabilities in ascending order.
+const (
+	SeverityUnknown  = "UNKNOWN"
+	SeverityLow      = "LOW"
+	SeverityMedium   = "MEDIUM"
+	SeverityHigh     = "HIGH"
+	SeverityCritical = "CRITICAL"
+)
+
+var severities = []string{SeverityUnknown, SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical}
+
+// The classes of vulnerable packages.
+const (
+	// ClassOS is the package installed by distro package manager.
+	ClassOS = "os"
+	// ClassLang is the package of language ecosystem, e.g. jar and wheel.
+	ClassLang = "lang"
+)
+
+// ErrVulnerable is returned if vulnerabilities at or above the fail
+// severity are found.
+var ErrVulnerable = errors.New("Vulnerabilities found")
+
+// severityLevel returns the order of severity, the unrecognized severity
+// is regarded as unknown.
+func severityLevel(severity string) int {
+	for idx, s := range severities {
+		if s == severity {
+			return idx
+		}
+	}
+	return 0
+}
+
+// normalizeSeverity maps the severity reported by tools to the severities
+// above, e.g. `Negligible` of grype is regarded as low.
+func normalizeSeverity(severity string) string {
+	severity = strings.ToUpper(severity)
+	if severity == "NEGLIGIBLE" {
+		return SeverityLow
+	}
+	for _, s := range severities {
+		if s == severity {
+			return s
+		}
+	}
+	return SeverityUnknown
+}
+
+// Opt defines scanner options.
+type Opt struct {
+	// Tool is the scanning tool, one of `trivy` and `grype`.
+	Tool string
+	// ToolPath is the path of scanning tool binary, the tool is looked
+	// up in $PATH if it's empty.
+	ToolPath string
+	// FailOn is the minimum severity failing the scan, one of `low`,
+	// `medium`, `high` and `critical`, the scan never fails by the found
+	// vulnerabilities if it's empty.
+	FailOn string
+}
+
+// Vulnerability is a vulnerability of an installed package.
+type Vulnerability struct {
+	ID           string `json:"id"`
+	Package      string `json:"package"`
+	Version      string `json:"version"`
+	FixedVersion string `json:"fixed_version,omitempty"`
+	Severity     string `json:"severity"`
+	Class        string `json:"class"`
+	Title        string `json:"title,omitempty"`
+}
+
+// Scanner scans vulnerabilities by scanning tool.
+type Scanner struct {
+	Opt
+}
+
+// New creates Scanner instance.
+func New(opt Opt) (*Scanner, error) {
+	switch opt.Tool {
+	case ToolTrivy, ToolGrype:
+	default:
+		return nil, fmt.Errorf("Invalid scanning tool %s", opt.Tool)
+	}
+	if opt.FailOn != "" {
+		failOn := strings.ToUpper(opt.FailOn)
+		if failOn == SeverityUnknown || normalizeSeverity(failOn) != failOn {
+			return nil, fmt.Errorf("Invalid fail severity %s", opt.FailOn)
+		}
+		opt.FailOn = failOn
+	}
+	if opt.ToolPath == "" {
+		opt.ToolPath = opt.Tool
+	}
+	return &Scanner{Opt: opt}, nil
+}
+
+func (scanner *Scanner) args(dir string) []string {
+	if scanner.Tool == ToolGrype {
+		return []string{"dir:" + dir, "--output", "json", "--quiet"}
+	}
+	return []string{"rootfs", "--format", "json", "--quiet", dir}
+}
+
+// Scan scans the packages installed in directory, and returns the found
+// vulnerabilities ordered by severity from high to low.
+func (scanner *Scanner) Scan(ctx context.Context, dir string) ([]Vulnerability, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, scanner.ToolPath, scanner.args(dir)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	logrus.Debugf("Scanning %s by %s", dir, scanner.Tool)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Run %s: %s: %s", scanner.Tool, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var vulns []Vulnerability
+	var err error
+	if scanner.Tool == ToolGrype {
+		vulns, err = parseGrype(stdout.Bytes())
+	} else {
+		vulns, err = parseTrivy(stdout.Bytes())
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Parse %s output", scanner.Tool)
+	}
+	Sort(vulns)
+	return vulns, nil
+}
+
+// Check returns ErrVulnerable if any vulnerability is at or above the fail
+// severity.
+func (scanner *Scanner) Check(vulns []Vulnerability) error {
+	if scanner.FailOn == "" {
+		return nil
+	}
+	failed := 0
+	for _, vuln := range vulns {
+		if severityLevel(vuln.Severity) >= severityLevel(scanner.FailOn) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Wrapf(ErrVulnerable, "%d vulnerabilities at or above %s", failed, scanner.FailOn)
+	}
+	return nil
+}
+
+// Less orders the vulnerabilities by severity from high to low, then by
+// package and ID.
+func Less(a, b *Vulnerability) bool {
+	if la, lb := severityLevel(a.Severity), severityLevel(b.Severity); la != lb {
+		return la > lb
+	}
+	if a.Package != b.Package {
+		return a.Package < b.Package
+	}
+	return a.ID < b.ID
+}
+
+// Sort sorts the vulnerabilities in the order of Less.
+func Sort(vulns []Vulnerability) {
+	sort.SliceStable(vulns, func(i, j int) bool {
+		return Less(&vulns[i], &vulns[j])
+	})
+}
+
+// Summarize counts the vulnerabilities by severity.
+func Summarize(vulns []Vulnerability) map[string]int {
+	summary := map[string]int{}
+	for _, vuln := range vulns {
+		summary[vuln.Severity]++
+	}
+	return summary
+}
+
+type trivyReport struct {
+	Results []struct {
+		Class           string
+		Vulnerabilities []struct {
+			VulnerabilityID  string
+			PkgName          string
+			InstalledVersion string
+			FixedVersion     string
+			Severity         string
+			Title            string
+		}
+	}
+}
+
+func parseTrivy(output []byte) ([]Vulnerability, error) {
+	var report trivyReport
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, err
+	}
+	vulns := []Vulnerability{}
+	for _, result := range report.Results {
+		class := ClassLang
+		if result.Class == "os-pkgs" {
+			class = ClassOS
+		}
+		for _, v := range result.Vulnerabilities {
+			vulns = append(vulns, Vulnerability{
+				ID:           v.VulnerabilityID,
+				Package:      v.PkgName,
+				Version:      v.InstalledVersion,
+				FixedVersion: v.FixedVersion,
+				Severity:     normalizeSeverity(v.Severity),
+				Class:        class,
+				Title:        v.Title,
+			})
+		}
+	}
+	return vulns, nil
+}
+
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID          string `json:"id"`
+			Severity    string `json:"severity"`
+			Description string `json:"description"`
+			Fix         struct {
+				Versions []string `json:"versions"`
+			} `json:"fix"`
+		} `json:"vulnerability"`
+		Artifact struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			Type    string `json:"type"`
+		} `json:"artifact"`
+	} `json:"matches"`
+}
+
+func parseGrype(output []byte) ([]Vulnerability, error) {
+	var report grypeReport
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, err
+	}
+	vulns := []Vulnerability{}
+	for _, match := range report.Matches {
+		class := ClassLang
+		switch match.Artifact.Type {
+		case "deb", "apk", "rpm":
+			class = ClassOS
+		}
+		vulns = append(vulns, Vulnerability{
+			ID:           match.Vulnerability.ID,
+			Package:      match.Artifact.Name,
+			Version:      match.Artifact.Version,
+			FixedVersion: strings.Join(match.Vulnerability.Fix.Versions, ", "),
+			Severity:     normalizeSeverity(match.Vulnerability.Severity),
+			Class:        class,
+			Title:        match.Vulnerability.Description,
+		})
+	}
+	return vulns, nil
+}
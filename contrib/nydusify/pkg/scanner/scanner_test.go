@@ -0,0 +1,139 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const trivyOutput = `{
+  "Results": [
+    {
+      "Target": "rootfs (debian 11.6)",
+      "Class": "os-pkgs",
+      "Vulnerabilities": [
+        {"VulnerabilityID": "CVE-2022-0001", "PkgName": "zlib1g", "InstalledVersion": "1:1.2.11.dfsg-2", "FixedVersion": "1:1.2.11.dfsg-2+deb11u2", "Severity": "CRITICAL"},
+        {"VulnerabilityID": "CVE-2022-0002", "PkgName": "libc6", "InstalledVersion": "2.31-13", "Severity": "LOW"}
+      ]
+    },
+    {
+      "Target": "app/requirements.txt",
+      "Class": "lang-pkgs",
+      "Vulnerabilities": [
+        {"VulnerabilityID": "CVE-2022-0003", "PkgName": "requests", "InstalledVersion": "2.19.0", "FixedVersion": "2.20.0", "Severity": "MEDIUM"}
+      ]
+    }
+  ]
+}`
+
+const grypeOutput = `{
+  "matches": [
+    {
+      "vulnerability": {"id": "CVE-2022-0004", "severity": "Negligible", "fix": {"versions": []}},
+      "artifact": {"name": "busybox", "version": "1.35.0-r17", "type": "apk"}
+    },
+    {
+      "vulnerability": {"id": "GHSA-xxxx", "severity": "High", "fix": {"versions": ["1.2.3", "2.0.1"]}},
+      "artifact": {"name": "lodash", "version": "1.0.0", "type": "npm"}
+    }
+  ]
+}`
+
+func TestNew(t *testing.T) {
+	_, err := New(Opt{Tool: "clair"})
+	assert.NotNil(t, err)
+	_, err = New(Opt{Tool: ToolTrivy, FailOn: "unknown"})
+	assert.NotNil(t, err)
+	_, err = New(Opt{Tool: ToolTrivy, FailOn: "severe"})
+	assert.NotNil(t, err)
+
+	s, err := New(Opt{Tool: ToolGrype, FailOn: "high"})
+	require.Nil(t, err)
+	assert.Equal(t, ToolGrype, s.ToolPath)
+	assert.Equal(t, SeverityHigh, s.FailOn)
+	assert.Equal(t, []string{"dir:/rootfs", "--output", "json", "--quiet"}, s.args("/rootfs"))
+
+	s, err = New(Opt{Tool: ToolTrivy, ToolPath: "/usr/local/bin/trivy"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"rootfs", "--format", "json", "--quiet", "/rootfs"}, s.args("/rootfs"))
+}
+
+func TestParse(t *testing.T) {
+	vulns, err := parseTrivy([]byte(trivyOutput))
+	require.Nil(t, err)
+	require.Len(t, vulns, 3)
+	assert.Equal(t, Vulnerability{
+		ID:           "CVE-2022-0001",
+		Package:      "zlib1g",
+		Version:      "1:1.2.11.dfsg-2",
+		FixedVersion: "1:1.2.11.dfsg-2+deb11u2",
+		Severity:     SeverityCritical,
+		Class:        ClassOS,
+	}, vulns[0])
+	assert.Equal(t, ClassLang, vulns[2].Class)
+
+	vulns, err = parseGrype([]byte(grypeOutput))
+	require.Nil(t, err)
+	require.Len(t, vulns, 2)
+	assert.Equal(t, SeverityLow, vulns[0].Severity)
+	assert.Equal(t, ClassOS, vulns[0].Class)
+	assert.Equal(t, "1.2.3, 2.0.1", vulns[1].FixedVersion)
+	assert.Equal(t, ClassLang, vulns[1].Class)
+
+	_, err = parseTrivy([]byte("not json"))
+	assert.NotNil(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	vulns, err := parseTrivy([]byte(trivyOutput))
+	require.Nil(t, err)
+	Sort(vulns)
+	assert.Equal(t, []string{"CVE-2022-0001", "CVE-2022-0003", "CVE-2022-0002"}, []string{vulns[0].ID, vulns[1].ID, vulns[2].ID})
+	assert.Equal(t, map[string]int{SeverityCritical: 1, SeverityMedium: 1, SeverityLow: 1}, Summarize(vulns))
+
+	s, err := New(Opt{Tool: ToolTrivy})
+	require.Nil(t, err)
+	assert.Nil(t, s.Check(vulns))
+
+	s, err = New(Opt{Tool: ToolTrivy, FailOn: "critical"})
+	require.Nil(t, err)
+	assert.True(t, errors.Is(s.Check(vulns), ErrVulnerable))
+	assert.Nil(t, s.Check(vulns[1:]))
+
+	s, err = New(Opt{Tool: ToolTrivy, FailOn: "medium"})
+	require.Nil(t, err)
+	assert.NotNil(t, s.Check(vulns[1:]))
+	assert.Nil(t, s.Check(vulns[2:]))
+}
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-scanner-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "output.json")
+	require.Nil(t, ioutil.WriteFile(output, []byte(grypeOutput), 0644))
+	tool := filepath.Join(dir, "grype")
+	require.Nil(t, ioutil.WriteFile(tool, []byte("#!/bin/sh\n[ \"$1\" = \"dir:/rootfs\" ] || { echo \"bad target $1\" >&2; exit 1; }\ncat "+output+"\n"), 0755))
+
+	s, err := New(Opt{Tool: ToolGrype, ToolPath: tool})
+	require.Nil(t, err)
+	vulns, err := s.Scan(context.Background(), "/rootfs")
+	require.Nil(t, err)
+	require.Len(t, vulns, 2)
+	assert.Equal(t, "GHSA-xxxx", vulns[0].ID)
+
+	_, err = s.Scan(context.Background(), "/other")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad target dir:/other")
+}
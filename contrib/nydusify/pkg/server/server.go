@@ -0,0 +1,386 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package server runs conversion jobs submitted by REST API with a job
+// queue and a worker pool, so that Nydusify can be deployed as a service,
+// e.g. triggered by registry webhooks.
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// JobStatus is the status of conversion job.
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+)
+
+// maxFinishedJobs is the count of finished jobs kept for querying, the
+// oldest finished jobs are dropped beyond it.
+const maxFinishedJobs = 1000
+
+var (
+	// ErrQueueFull is returned if the job queue is full.
+	ErrQueueFull = errors.New("job queue is full")
+	// ErrJobNotFound is returned if the job doesn't exist.
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobFinished is returned when canceling a finished job.
+	ErrJobFinished = errors.New("job is finished")
+)
+
+// Job is a conversion job.
+type Job struct {
+	ID         string     `json:"id"`
+	Source     string     `json:"source"`
+	Target     string     `json:"target"`
+	Status     JobStatus  `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+func (job *Job) finished() bool {
+	return job.Status == JobSucceeded || job.Status == JobFailed || job.Status == JobCanceled
+}
+
+// ConvertFunc converts source image to target image, it should return
+// once ctx is canceled.
+type ConvertFunc func(ctx context.Context, source, target string) error
+
+// ResolveFunc validates the job and resolves target if it's empty.
+type ResolveFunc func(source, target string) (string, error)
+
+// Opt defines Server options.
+type Opt struct {
+	Convert ConvertFunc
+	// Resolve is called when submitting job, the job is rejected if it
+	// returns error, the target is required if it's nil.
+	Resolve   ResolveFunc
+	Workers   uint
+	QueueSize uint
+	// Token is the expected value of `Authorization` header of job API
+	// requests, it isn't checked if it's empty.
+	Token string
+	// Webhook enables the webhook receivers of registry push events, the
+	// pushed images are converted with the target resolved by Resolve.
+	Webhook *WebhookOpt
+}
+
+// Server runs the conversion jobs.
+type Server struct {
+	Opt
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	finished []string
+	queue    chan *Job
+}
+
+// New creates Server instance.
+func New(opt Opt) *Server {
+	if opt.Workers == 0 {
+		opt.Workers = 1
+	}
+	return &Server{
+		Opt:   opt,
+		jobs:  map[string]*Job{},
+		queue: make(chan *Job, opt.QueueSize),
+	}
+}
+
+// copyJob returns a snapshot of job for responding, it should be called
+// with lock held.
+func copyJob(job *Job) *Job {
+	copied := *job
+	copied.cancel = nil
+	return &copied
+}
+
+// Submit queues a conversion job.
+func (server *Server) Submit(source, target string) (*Job, error) {
+	if source == "" {
+		return nil, fmt.Errorf("source is required")
+	}
+	if server.Resolve != nil {
+		resolved, err := server.Resolve(source, target)
+		if err != nil {
+			return nil, err
+		}
+		target = resolved
+	} else if target == "" {
+		return nil, fmt.Errorf("target is required")
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	job := &Job{
+		ID:        uuid.New().String(),
+		Source:    source,
+		Target:    target,
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+	}
+	select {
+	case server.queue <- job:
+	default:
+		return nil, ErrQueueFull
+	}
+	server.jobs[job.ID] = job
+	logrus.Infof("Queued job %s: %s -> %s", job.ID, source, target)
+	return copyJob(job), nil
+}
+
+// Get returns the job of id.
+func (server *Server) Get(id string) (*Job, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	job, ok := server.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return copyJob(job), nil
+}
+
+// List returns all jobs in order of creation.
+func (server *Server) List() []*Job {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	jobs := []*Job{}
+	for _, job := range server.jobs {
+		jobs = append(jobs, copyJob(job))
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// Cancel cancels the queued or running job of id.
+func (server *Server) Cancel(id string) (*Job, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	job, ok := server.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	switch {
+	case job.finished():
+		return nil, ErrJobFinished
+	case job.Status == JobQueued:
+		// The worker skips the canceled job in queue
+		server.finish(job, JobCanceled, nil)
+	case job.cancel != nil:
+		job.cancel()
+	}
+	logrus.Infof("Canceled job %s", job.ID)
+	return copyJob(job), nil
+}
+
+// finish updates the status of finished job and drops the oldest finished
+// jobs, it should be called with lock held.
+func (server *Server) finish(job *Job, status JobStatus, err error) {
+	now := time.Now()
+	job.Status = status
+	job.FinishedAt = &now
+	job.cancel = nil
+	if err != nil {
+		job.Error = err.Error()
+	}
+	server.finished = append(server.finished, job.ID)
+	for len(server.finished) > maxFinishedJobs {
+		delete(server.jobs, server.finished[0])
+		server.finished = server.finished[1:]
+	}
+}
+
+func (server *Server) run(ctx context.Context, job *Job) {
+	server.mu.Lock()
+	if job.Status != JobQueued {
+		server.mu.Unlock()
+		return
+	}
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	now := time.Now()
+	job.Status = JobRunning
+	job.StartedAt = &now
+	job.cancel = cancel
+	server.mu.Unlock()
+
+	logrus.Infof("Running job %s: %s -> %s", job.ID, job.Source, job.Target)
+	err := server.Convert(jobCtx, job.Source, job.Target)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	switch {
+	case jobCtx.Err() != nil:
+		server.finish(job, JobCanceled, err)
+		logrus.Infof("Job %s is canceled", job.ID)
+	case err != nil:
+		server.finish(job, JobFailed, err)
+		logrus.Errorf("Job %s failed: %s", job.ID, err)
+	default:
+		server.finish(job, JobSucceeded, nil)
+		logrus.Infof("Job %s succeeded", job.ID)
+	}
+}
+
+// Start starts the workers running queued jobs until ctx is canceled, the
+// running jobs are canceled then.
+func (server *Server) Start(ctx context.Context) {
+	for idx := uint(0); idx < server.Workers; idx++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-server.queue:
+					server.run(ctx, job)
+				}
+			}
+		}()
+	}
+}
+
+type submitRequest struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch err {
+	case ErrJobNotFound:
+		status = http.StatusNotFound
+	case ErrJobFinished:
+		status = http.StatusConflict
+	case ErrQueueFull:
+		status = http.StatusServiceUnavailable
+	}
+	utils.WriteJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// CheckAddress refuses to serve the job API without token on the address
+// which isn't loopback, otherwise anyone reaching it can submit jobs with
+// the registry credentials of server.
+func CheckAddress(addr, token string) error {
+	if token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %s", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("API token is required to listen on %s, which isn't a loopback address", addr)
+}
+
+// authorized returns whether the `Authorization` header of request is
+// token, it's always true if token is empty.
+func authorized(r *http.Request, token string) bool {
+	return token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(token)) == 1
+}
+
+// authorize rejects the job API requests unauthorized by token.
+func (server *Server) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, server.Token) {
+			utils.WriteJSON(w, http.StatusUnauthorized, errorResponse{Error: "invalid authorization"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Handler returns the handler of REST API:
+//
+//	POST   /api/v1/jobs       submit job by {"source":"...","target":"..."}
+//	GET    /api/v1/jobs       list jobs
+//	GET    /api/v1/jobs/<id>  query job
+//	DELETE /api/v1/jobs/<id>  cancel job
+//
+// which require the `Authorization` header of token if it's specified, and
+// the webhook receivers if webhook is enabled:
+//
+//	POST   /api/v1/webhooks/harbor    Harbor webhook
+//	POST   /api/v1/webhooks/registry  docker distribution notification
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	if server.Webhook != nil {
+		mux.HandleFunc("/api/v1/webhooks/harbor", server.webhookHandler(server.Webhook, parseHarborEvent))
+		mux.HandleFunc("/api/v1/webhooks/registry", server.webhookHandler(server.Webhook, parseRegistryEvents))
+	}
+	mux.HandleFunc("/api/v1/jobs", server.authorize(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			utils.WriteJSON(w, http.StatusOK, server.List())
+		case http.MethodPost:
+			var req submitRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, fmt.Errorf("invalid request: %s", err))
+				return
+			}
+			job, err := server.Submit(req.Source, req.Target)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			utils.WriteJSON(w, http.StatusAccepted, job)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/api/v1/jobs/", server.authorize(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/jobs/")
+		var job *Job
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			job, err = server.Get(id)
+		case http.MethodDelete:
+			job, err = server.Cancel(id)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		utils.WriteJSON(w, http.StatusOK, job)
+	}))
+	return mux
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitStatus(t *testing.T, server *Server, id string, status JobStatus) *Job {
+	for retry := 0; retry < 100; retry++ {
+		job, err := server.Get(id)
+		require.Nil(t, err)
+		if job.Status == status {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s isn't %s", id, status)
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	release := make(chan struct{})
+	server := New(Opt{
+		Convert: func(ctx context.Context, source, target string) error {
+			switch source {
+			case "failed":
+				return errors.New("unauthorized")
+			case "blocked":
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-release:
+				}
+			}
+			return nil
+		},
+		Resolve: func(source, target string) (string, error) {
+			if target == "" {
+				return source + "-nydus", nil
+			}
+			return target, nil
+		},
+		Workers:   1,
+		QueueSize: 2,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := server.Submit("", "")
+	assert.Contains(t, err.Error(), "source is required")
+
+	// The queued jobs before starting workers
+	blocked, err := server.Submit("blocked", "")
+	require.Nil(t, err)
+	assert.Equal(t, "blocked-nydus", blocked.Target)
+	assert.Equal(t, JobQueued, blocked.Status)
+	canceled, err := server.Submit("canceled", "target")
+	require.Nil(t, err)
+	_, err = server.Submit("rejected", "target")
+	assert.Equal(t, ErrQueueFull, err)
+
+	server.Start(ctx)
+	waitStatus(t, server, blocked.ID, JobRunning)
+	job, err := server.Cancel(canceled.ID)
+	require.Nil(t, err)
+	assert.Equal(t, JobCanceled, job.Status)
+	_, err = server.Cancel(canceled.ID)
+	assert.Equal(t, ErrJobFinished, err)
+
+	// Cancel the running job
+	_, err = server.Cancel(blocked.ID)
+	require.Nil(t, err)
+	job = waitStatus(t, server, blocked.ID, JobCanceled)
+	assert.Contains(t, job.Error, "context canceled")
+
+	failed, err := server.Submit("failed", "")
+	require.Nil(t, err)
+	job = waitStatus(t, server, failed.ID, JobFailed)
+	assert.Equal(t, "unauthorized", job.Error)
+	assert.NotNil(t, job.StartedAt)
+	assert.NotNil(t, job.FinishedAt)
+
+	succeeded, err := server.Submit("blocked", "")
+	require.Nil(t, err)
+	close(release)
+	waitStatus(t, server, succeeded.ID, JobSucceeded)
+
+	jobs := server.List()
+	require.Len(t, jobs, 4)
+	assert.Equal(t, blocked.ID, jobs[0].ID)
+	assert.Equal(t, succeeded.ID, jobs[3].ID)
+
+	_, err = server.Get("unknown")
+	assert.Equal(t, ErrJobNotFound, err)
+}
+
+func TestHandler(t *testing.T) {
+	server := New(Opt{
+		Convert: func(ctx context.Context, source, target string) error {
+			return nil
+		},
+		QueueSize: 1,
+	})
+	server.Start(context.Background())
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	// Target is required without resolver
+	resp, err := http.Post(ts.URL+"/api/v1/jobs", "application/json", strings.NewReader(`{"source":"a"}`))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/api/v1/jobs", "application/json", strings.NewReader(`{"source":"a","target":"b"}`))
+	require.Nil(t, err)
+	var job Job
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&job))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "b", job.Target)
+	waitStatus(t, server, job.ID, JobSucceeded)
+
+	resp, err = http.Get(fmt.Sprintf("%s/api/v1/jobs/%s", ts.URL, job.ID))
+	require.Nil(t, err)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&job))
+	resp.Body.Close()
+	assert.Equal(t, JobSucceeded, job.Status)
+
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/v1/jobs/%s", ts.URL, job.ID), nil)
+	require.Nil(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/api/v1/jobs/unknown")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/api/v1/jobs")
+	require.Nil(t, err)
+	jobs := []Job{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	resp.Body.Close()
+	assert.Len(t, jobs, 1)
+}
+
+func TestHandlerToken(t *testing.T) {
+	server := New(Opt{
+		Convert: func(ctx context.Context, source, target string) error {
+			return nil
+		},
+		QueueSize: 1,
+		Token:     "Bearer secret",
+	})
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	do := func(method, path, token string) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(`{"source":"a","target":"b"}`))
+		require.Nil(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/api/v1/jobs", ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/api/v1/jobs", "Bearer invalid"))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/jobs", ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodDelete, "/api/v1/jobs/unknown", ""))
+	assert.Empty(t, server.List())
+
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, "/api/v1/jobs", "Bearer secret"))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/jobs", "Bearer secret"))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/api/v1/jobs/unknown", "Bearer secret"))
+}
+
+func TestCheckAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:8080", "[::1]:8080", "localhost:8080"} {
+		assert.Nil(t, CheckAddress(addr, ""), addr)
+	}
+	for _, addr := range []string{":8080", "0.0.0.0:8080", "10.0.0.1:8080", "example.com:8080", "8080"} {
+		assert.NotNil(t, CheckAddress(addr, ""), addr)
+	}
+	assert.Nil(t, CheckAddress(":8080", "Bearer secret"))
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// maxEventSize is the maximum size of webhook request body.
+const maxEventSize = 1 << 20
+
+// WebhookOpt defines the options of webhook receiver.
+type WebhookOpt struct {
+	// Token is the expected value of `Authorization` header of webhook
+	// requests, it isn't checked if it's empty.
+	Token string
+	// Registries are the registry hosts whose pushed images are converted,
+	// the host in event is from the payload, so the images in the other
+	// registries are skipped to not pull from the host of sender's choice.
+	Registries []string
+	// Include and Exclude are matched against `<repository>:<tag>` of
+	// pushed images, an image is converted if it matches any of Include
+	// or Include is empty, and doesn't match any of Exclude.
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+}
+
+// pushedImage is an image pushed to registry in webhook event.
+type pushedImage struct {
+	Host       string
+	Repository string
+	Tag        string
+}
+
+// harborEvent is the payload of Harbor webhook, only PUSH_ARTIFACT event
+// is handled.
+type harborEvent struct {
+	Type      string `json:"type"`
+	EventData struct {
+		Resources []struct {
+			Digest      string `json:"digest"`
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+// registryEnvelope is the payload of notification of docker distribution
+// registry, only push event of manifest is handled.
+type registryEnvelope struct {
+	Events []struct {
+		Action string `json:"action"`
+		Target struct {
+			MediaType  string `json:"mediaType"`
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+			URL        string `json:"url"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+	} `json:"events"`
+}
+
+func parseHarborEvent(data []byte) ([]pushedImage, error) {
+	var event harborEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	images := []pushedImage{}
+	if event.Type != "PUSH_ARTIFACT" {
+		return images, nil
+	}
+	for _, resource := range event.EventData.Resources {
+		// The resource url is in format <host>/<repository>:<tag>
+		host := strings.SplitN(resource.ResourceURL, "/", 2)[0]
+		images = append(images, pushedImage{
+			Host:       host,
+			Repository: event.EventData.Repository.RepoFullName,
+			Tag:        resource.Tag,
+		})
+	}
+	return images, nil
+}
+
+func parseRegistryEvents(data []byte) ([]pushedImage, error) {
+	var envelope registryEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	images := []pushedImage{}
+	for _, event := range envelope.Events {
+		// The blobs are pushed before manifest with push events as well
+		if event.Action != "push" || !strings.Contains(event.Target.MediaType, "manifest") {
+			continue
+		}
+		host := event.Request.Host
+		if u, err := url.Parse(event.Target.URL); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		images = append(images, pushedImage{
+			Host:       host,
+			Repository: event.Target.Repository,
+			Tag:        event.Target.Tag,
+		})
+	}
+	return images, nil
+}
+
+// selected returns true if the pushed image should be converted.
+func (opt *WebhookOpt) selected(image pushedImage) bool {
+	// The manifests pushed by digest, e.g. the Nydus manifest pushed as
+	// referrer, are skipped
+	if image.Host == "" || image.Repository == "" || image.Tag == "" {
+		return false
+	}
+	if !opt.allowed(image.Host) {
+		return false
+	}
+	name := fmt.Sprintf("%s:%s", image.Repository, image.Tag)
+	if len(opt.Include) > 0 && !matchAny(opt.Include, name) {
+		return false
+	}
+	return !matchAny(opt.Exclude, name)
+}
+
+func (opt *WebhookOpt) allowed(host string) bool {
+	for _, registry := range opt.Registries {
+		if strings.EqualFold(registry, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []*regexp.Regexp, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookHandler handles the webhook events parsed by parse, and submits
+// the jobs converting the selected images.
+func (server *Server) webhookHandler(opt *WebhookOpt, parse func([]byte) ([]pushedImage, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, opt.Token) {
+			utils.WriteJSON(w, http.StatusUnauthorized, errorResponse{Error: "invalid authorization"})
+			return
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEventSize))
+		if err != nil {
+			status := http.StatusBadRequest
+			if len(data) >= maxEventSize {
+				status = http.StatusRequestEntityTooLarge
+			}
+			utils.WriteJSON(w, status, errorResponse{Error: fmt.Sprintf("read event: %s", err)})
+			return
+		}
+		images, err := parse(data)
+		if err != nil {
+			writeError(w, fmt.Errorf("invalid event: %s", err))
+			return
+		}
+
+		jobs := []*Job{}
+		for _, image := range images {
+			source := fmt.Sprintf("%s/%s:%s", image.Host, image.Repository, image.Tag)
+			if !opt.selected(image) {
+				logrus.Debugf("Skip pushed image %s", source)
+				continue
+			}
+			job, err := server.Submit(source, "")
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			jobs = append(jobs, job)
+		}
+		utils.WriteJSON(w, http.StatusAccepted, jobs)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const harborPayload = `{
+  "type": "PUSH_ARTIFACT",
+  "occur_at": 1600000000,
+  "operator": "admin",
+  "event_data": {
+    "resources": [
+      {"digest": "sha256:aaa", "tag": "1.19", "resource_url": "harbor.example.com/library/nginx:1.19"},
+      {"digest": "sha256:bbb", "tag": "1.19-nydus", "resource_url": "harbor.example.com/library/nginx:1.19-nydus"}
+    ],
+    "repository": {"name": "nginx", "namespace": "library", "repo_full_name": "library/nginx", "repo_type": "private"}
+  }
+}`
+
+const registryPayload = `{
+  "events": [
+    {
+      "action": "push",
+      "target": {"mediaType": "application/octet-stream", "repository": "app/web", "url": "http://registry:5000/v2/app/web/blobs/sha256:ccc"},
+      "request": {"host": "registry:5000", "method": "PUT"}
+    },
+    {
+      "action": "push",
+      "target": {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "repository": "app/web", "tag": "v1", "url": "http://registry:5000/v2/app/web/manifests/sha256:ddd"},
+      "request": {"host": "registry:5000", "method": "PUT"}
+    },
+    {
+      "action": "push",
+      "target": {"mediaType": "application/vnd.oci.image.manifest.v1+json", "repository": "app/web", "url": "http://registry:5000/v2/app/web/manifests/sha256:eee"},
+      "request": {"host": "registry:5000", "method": "PUT"}
+    },
+    {
+      "action": "pull",
+      "target": {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "repository": "app/web", "tag": "v1"},
+      "request": {"host": "registry:5000", "method": "GET"}
+    }
+  ]
+}`
+
+func TestParseEvents(t *testing.T) {
+	images, err := parseHarborEvent([]byte(harborPayload))
+	require.Nil(t, err)
+	assert.Equal(t, []pushedImage{
+		{Host: "harbor.example.com", Repository: "library/nginx", Tag: "1.19"},
+		{Host: "harbor.example.com", Repository: "library/nginx", Tag: "1.19-nydus"},
+	}, images)
+
+	images, err = parseHarborEvent([]byte(`{"type":"DELETE_ARTIFACT"}`))
+	require.Nil(t, err)
+	assert.Empty(t, images)
+
+	images, err = parseRegistryEvents([]byte(registryPayload))
+	require.Nil(t, err)
+	assert.Equal(t, []pushedImage{
+		{Host: "registry:5000", Repository: "app/web", Tag: "v1"},
+		{Host: "registry:5000", Repository: "app/web"},
+	}, images)
+}
+
+func TestWebhook(t *testing.T) {
+	server := New(Opt{
+		Convert: func(ctx context.Context, source, target string) error {
+			return nil
+		},
+		Resolve: func(source, target string) (string, error) {
+			return source + "-nydus", nil
+		},
+		QueueSize: 10,
+		Webhook: &WebhookOpt{
+			Token:      "Bearer secret",
+			Registries: []string{"harbor.example.com", "registry:5000"},
+			Exclude:    []*regexp.Regexp{regexp.MustCompile(`:.*-nydus$`)},
+		},
+	})
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	post := func(path, token, payload string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(payload))
+		require.Nil(t, err)
+		req.Header.Set("Authorization", token)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+
+	resp := post("/api/v1/webhooks/harbor", "Bearer wrong", harborPayload)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The Nydus image pushed by conversion is skipped
+	resp = post("/api/v1/webhooks/harbor", "Bearer secret", harborPayload)
+	jobs := []Job{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "harbor.example.com/library/nginx:1.19", jobs[0].Source)
+	assert.Equal(t, "harbor.example.com/library/nginx:1.19-nydus", jobs[0].Target)
+
+	// The manifest pushed by digest is skipped
+	resp = post("/api/v1/webhooks/registry", "Bearer secret", registryPayload)
+	jobs = []Job{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	resp.Body.Close()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "registry:5000/app/web:v1", jobs[0].Source)
+
+	resp = post("/api/v1/webhooks/registry", "Bearer secret", "{")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// The image in the registry not allowed is skipped
+	resp = post("/api/v1/webhooks/harbor", "Bearer secret", strings.Replace(harborPayload, "harbor.example.com", "evil.example.com", -1))
+	jobs = []Job{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Empty(t, jobs)
+
+	// The huge event is rejected
+	resp = post("/api/v1/webhooks/harbor", "Bearer secret", harborPayload+strings.Repeat(" ", maxEventSize))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// Webhook isn't enabled
+	ts2 := httptest.NewServer(New(Opt{}).Handler())
+	defer ts2.Close()
+	resp, err := http.Post(ts2.URL+"/api/v1/webhooks/harbor", "application/json", strings.NewReader(harborPayload))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
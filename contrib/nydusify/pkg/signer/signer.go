@@ -0,0 +1,124 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package signer signs and verifies the image manifest in registry by
+// `cosign` or `notation` binary, the signature is pushed to the same
+// repository with image in the way of the signing tool.
+package signer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ToolCosign   = "cosign"
+	ToolNotation = "notation"
+)
+
+// Opt defines signer options.
+type Opt struct {
+	// Tool is the signing tool, one of `cosign` and `notation`.
+	Tool string
+	// ToolPath is the path of signing tool binary, the tool is looked
+	// up in $PATH if it's empty.
+	ToolPath string
+	// Key is the private key to sign (or the public key to verify) for
+	// cosign, in any form accepted by `cosign --key`, e.g. a file path
+	// or a KMS URI. It's the key name in notation, and is ignored in
+	// verification since notation verifies by trust policy.
+	Key string
+	// Insecure allows http/insecure registry communication.
+	Insecure bool
+}
+
+// Signer signs and verifies image manifest by signing tool.
+type Signer struct {
+	Opt
+}
+
+// New creates Signer instance.
+func New(opt Opt) (*Signer, error) {
+	switch opt.Tool {
+	case ToolCosign:
+		if opt.Key == "" {
+			return nil, errors.New("Key is required by cosign")
+		}
+	case ToolNotation:
+	default:
+		return nil, fmt.Errorf("Invalid signing tool %s", opt.Tool)
+	}
+	if opt.ToolPath == "" {
+		opt.ToolPath = opt.Tool
+	}
+	return &Signer{Opt: opt}, nil
+}
+
+func (signer *Signer) signArgs(ref string) []string {
+	args := []string{"sign"}
+	if signer.Key != "" {
+		args = append(args, "--key", signer.Key)
+	}
+	if signer.Tool == ToolCosign {
+		// Skip the confirmation of uploading to transparency log
+		args = append(args, "--yes")
+	}
+	return append(args, append(signer.insecureArgs(), ref)...)
+}
+
+func (signer *Signer) verifyArgs(ref string) []string {
+	args := []string{"verify"}
+	if signer.Tool == ToolCosign {
+		args = append(args, "--key", signer.Key)
+	}
+	return append(args, append(signer.insecureArgs(), ref)...)
+}
+
+func (signer *Signer) insecureArgs() []string {
+	if !signer.Insecure {
+		return nil
+	}
+	if signer.Tool == ToolCosign {
+		return []string{"--allow-insecure-registry"}
+	}
+	return []string{"--insecure-registry"}
+}
+
+func (signer *Signer) run(ctx context.Context, args []string) error {
+	path, err := exec.LookPath(signer.ToolPath)
+	if err != nil {
+		return errors.Wrapf(err, "Find %s binary", signer.Tool)
+	}
+
+	logrus.Debugf("\tCommand: %s %s", path, strings.Join(args, " "))
+
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "Run %s: %s", signer.Tool, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// Sign signs the manifest referenced by digest, e.g. `repo@sha256:xxx`,
+// the manifest should be pushed by digest rather than tag, so that the
+// signature isn't put on the content that the tag points to later.
+func (signer *Signer) Sign(ctx context.Context, ref string) error {
+	return signer.run(ctx, signer.signArgs(ref))
+}
+
+// Verify verifies the signature of the manifest referenced by digest.
+func (signer *Signer) Verify(ctx context.Context, ref string) error {
+	return signer.run(ctx, signer.verifyArgs(ref))
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package signer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRef = "localhost:5000/app@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+func TestSignerArgs(t *testing.T) {
+	_, err := New(Opt{Tool: ToolCosign})
+	assert.NotNil(t, err)
+	_, err = New(Opt{Tool: "gpg"})
+	assert.NotNil(t, err)
+
+	cosign, err := New(Opt{Tool: ToolCosign, Key: "cosign.key", Insecure: true})
+	require.Nil(t, err)
+	assert.Equal(t, ToolCosign, cosign.ToolPath)
+	assert.Equal(t, []string{
+		"sign", "--key", "cosign.key", "--yes", "--allow-insecure-registry", testRef,
+	}, cosign.signArgs(testRef))
+	assert.Equal(t, []string{
+		"verify", "--key", "cosign.key", "--allow-insecure-registry", testRef,
+	}, cosign.verifyArgs(testRef))
+
+	notation, err := New(Opt{Tool: ToolNotation, ToolPath: "/usr/local/bin/notation", Key: "release"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"sign", "--key", "release", testRef}, notation.signArgs(testRef))
+	assert.Equal(t, []string{"verify", testRef}, notation.verifyArgs(testRef))
+}
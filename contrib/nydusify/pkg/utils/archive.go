@@ -13,7 +13,6 @@ import (
 	"path/filepath"
 
 	"github.com/containerd/containerd/archive"
-	"github.com/containerd/containerd/archive/compression"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -130,7 +129,7 @@ func PackTargzInfo(src, name string, compress bool) (digest.Digest, int64, error
 
 // UnpackTargz unpacks .tar(.gz) stream, and write to dst path
 func UnpackTargz(ctx context.Context, dst string, r io.Reader) error {
-	ds, err := compression.DecompressStream(r)
+	ds, err := DecompressStream(r)
 	if err != nil {
 		return err
 	}
@@ -8,8 +8,17 @@ const (
 	ManifestOSFeatureNydus   = "nydus.remoteimage.v1"
 	MediaTypeNydusBlob       = "application/vnd.oci.image.layer.nydus.blob.v1"
 	BootstrapFileNameInLayer = "image/image.boot"
+	ArtifactTypeNydusImage   = "application/vnd.nydus.image.manifest.v1+json"
+	// The config of standalone RAFS filesystem packed from a directory
+	MediaTypeNydusArtifactConfig = "application/vnd.nydus.rafs.config.v1+json"
+	// MediaTypeImageLayerZstd isn't defined in image-spec v1.0.1 yet
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
 
-	ManifestNydusCache = "containerd.io/snapshot/nydus-cache"
+	ManifestNydusCache       = "containerd.io/snapshot/nydus-cache"
+	ManifestNydusCacheSchema = "containerd.io/snapshot/nydus-cache-schema"
+	ManifestNydusCachePage   = "containerd.io/snapshot/nydus-cache-page"
+	// The digest of Nydus manifest annotated in the OCI manifest
+	ManifestAnnotationNydusManifest = "containerd.io/snapshot/nydus-manifest"
 
 	LayerAnnotationNydusBlob          = "containerd.io/snapshot/nydus-blob"
 	LayerAnnotationNydusBlobDigest    = "containerd.io/snapshot/nydus-blob-digest"
@@ -17,6 +26,23 @@ const (
 	LayerAnnotationNydusBlobIDs       = "containerd.io/snapshot/nydus-blob-ids"
 	LayerAnnotationNydusBootstrap     = "containerd.io/snapshot/nydus-bootstrap"
 	LayerAnnotationNydusSourceChainID = "containerd.io/snapshot/nydus-source-chainid"
+	LayerAnnotationNydusChunkBloom    = "containerd.io/snapshot/nydus-chunk-bloom"
+	LayerAnnotationNydusBackendType   = "containerd.io/snapshot/nydus-backend-type"
+	LayerAnnotationNydusBackendConfig = "containerd.io/snapshot/nydus-backend-config"
+	LayerAnnotationNydusSourceLayers  = "containerd.io/snapshot/nydus-source-layers"
+	LayerAnnotationNydusCompressor    = "containerd.io/snapshot/nydus-compressor"
+	LayerAnnotationNydusFsVersion     = "containerd.io/snapshot/nydus-fs-version"
+	// The time when the cache record was last recorded, in RFC3339
+	LayerAnnotationNydusCacheTimestamp = "containerd.io/snapshot/nydus-cache-timestamp"
+	// The blob id of encrypted blob layer, whose digest is the digest
+	// of encrypted data rather than blob id
+	LayerAnnotationNydusBlobID = "containerd.io/snapshot/nydus-blob-id"
+	// The total size of blobs referenced by bootstrap, for runtime to tune
+	// the IO concurrency by the size of image
+	LayerAnnotationNydusImageSize = "containerd.io/snapshot/nydus-image-size"
+	// The digest and diff id of source layer producing the blob layer
+	LayerAnnotationNydusSourceDigest = "containerd.io/snapshot/nydus-source-digest"
+	LayerAnnotationNydusSourceDiffID = "containerd.io/snapshot/nydus-source-diff-id"
 
 	LayerAnnotationUncompressed = "containerd.io/uncompressed"
 )
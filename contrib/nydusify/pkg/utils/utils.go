@@ -9,11 +9,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"time"
 
-	"github.com/containerd/containerd/archive/compression"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
@@ -57,6 +59,36 @@ func MarshalToDesc(data interface{}, mediaType string) (*ocispec.Descriptor, []b
 	return &desc, bytes, nil
 }
 
+// WriteFileAtomic writes data to a temporary file in the same directory
+// and renames it to path, so that the readers never see a partial file.
+func WriteFileAtomic(path string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// WriteJSON writes value as the JSON response body in status, the
+// Content-Type defaults to application/json unless it's set by caller.
+func WriteJSON(w http.ResponseWriter, status int, value interface{}) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logrus.Warnf("Failed to write response: %s", err)
+	}
+}
+
 func IsSupportedPlatform(os, arch string) bool {
 	// Default we assume that empty OS/Arch should be
 	// a supported platform likes linux/amd64
@@ -89,7 +121,7 @@ func IsNydusPlatform(platform *ocispec.Platform) bool {
 }
 
 func UnpackFile(reader io.Reader, source, target string) error {
-	rdr, err := compression.DecompressStream(reader)
+	rdr, err := DecompressStream(reader)
 	if err != nil {
 		return err
 	}
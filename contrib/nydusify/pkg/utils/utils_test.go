@@ -0,0 +1,35 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-utils-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "index.json")
+	require.Nil(t, WriteFileAtomic(path, []byte("v1")))
+	require.Nil(t, WriteFileAtomic(path, []byte("v2")))
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "v2", string(data))
+
+	// No temporary file is left
+	entries, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	assert.NotNil(t, WriteFileAtomic(filepath.Join(dir, "missing", "index.json"), []byte("v1")))
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os/exec"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// The zstd stream is compressed and decompressed by the `zstd` binary,
+// like containerd does with `unpigz` for gzip stream, so that nydusify
+// can be kept as a static binary without cgo.
+const zstdBinary = "zstd"
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// ZstdAvailable checks whether the `zstd` binary is found in $PATH.
+func ZstdAvailable() bool {
+	_, err := exec.LookPath(zstdBinary)
+	return err == nil
+}
+
+// zstdStream pipes the reader through `zstd` binary with the args, the
+// source reader is closed once the returned reader is closed.
+func zstdStream(src io.ReadCloser, args ...string) (io.ReadCloser, error) {
+	path, err := exec.LookPath(zstdBinary)
+	if err != nil {
+		src.Close()
+		return nil, errors.Wrap(err, "Find zstd binary")
+	}
+
+	reader, writer := io.Pipe()
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.Command(path, append([]string{"-q", "-c"}, args...)...)
+	cmd.Stdin = src
+	cmd.Stdout = writer
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		src.Close()
+		return nil, errors.Wrap(err, "Start zstd")
+	}
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			err = errors.Wrapf(err, "Run zstd: %s", stderr.String())
+		}
+		writer.CloseWithError(err)
+	}()
+
+	return &readCloser{Reader: reader, close: func() error {
+		reader.Close()
+		return src.Close()
+	}}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc *readCloser) Close() error {
+	return rc.close()
+}
+
+// PackTarZstd makes .tar.zst stream of file named `name` and return reader
+func PackTarZstd(src string, name string) (io.ReadCloser, error) {
+	reader, err := PackTargz(src, name, false)
+	if err != nil {
+		return nil, err
+	}
+	return zstdStream(reader)
+}
+
+// PackTarZstdInfo makes .tar.zst stream of file named `name` and return
+// digest and size
+func PackTarZstdInfo(src, name string) (digest.Digest, int64, error) {
+	reader, err := PackTarZstd(src, name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(digester.Hash(), reader)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return digester.Digest(), size, nil
+}
+
+// DecompressStream decompresses the zstd stream by `zstd` binary, other
+// streams are handed over to containerd, which only supports gzip.
+func DecompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err == nil && bytes.Equal(magic, zstdMagic) {
+		return zstdStream(&readCloser{Reader: br, close: func() error { return nil }}, "-d")
+	}
+	return compression.DecompressStream(br)
+}
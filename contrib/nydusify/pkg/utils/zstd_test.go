@@ -0,0 +1,55 @@
+// Copyright 2020 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackTarZstd(t *testing.T) {
+	if !ZstdAvailable() {
+		t.Skip("zstd binary isn't found")
+	}
+
+	dir, err := ioutil.TempDir("", "nydusify-zstd-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "bootstrap")
+	content := bytes.Repeat([]byte("nydus"), 1024)
+	require.Nil(t, ioutil.WriteFile(src, content, 0644))
+
+	dgst, size, err := PackTarZstdInfo(src, BootstrapFileNameInLayer)
+	require.Nil(t, err)
+
+	reader, err := PackTarZstd(src, BootstrapFileNameInLayer)
+	require.Nil(t, err)
+	compressed, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	require.Nil(t, reader.Close())
+	assert.Equal(t, dgst, digest.FromBytes(compressed))
+	assert.Equal(t, size, int64(len(compressed)))
+
+	// The stream is recognized as zstd and unpacked like tar.gz
+	target := filepath.Join(dir, "unpacked")
+	require.Nil(t, UnpackFile(bytes.NewReader(compressed), BootstrapFileNameInLayer, target))
+	unpacked, err := ioutil.ReadFile(target)
+	require.Nil(t, err)
+	assert.Equal(t, content, unpacked)
+
+	// The gzip stream is still handed over to containerd
+	reader, err = PackTargz(src, BootstrapFileNameInLayer, true)
+	require.Nil(t, err)
+	defer reader.Close()
+	require.Nil(t, UnpackFile(reader, BootstrapFileNameInLayer, target))
+}
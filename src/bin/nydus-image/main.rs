@@ -58,6 +58,8 @@ use validator::Validator;
 #[derive(Serialize, Default)]
 pub struct ResultOutput {
     blobs: Vec<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    chunks: Vec<String>,
     trace: serde_json::Map<String, serde_json::Value>,
 }
 
@@ -70,7 +72,11 @@ impl ResultOutput {
     }
 }
 
-fn dump_result_output(matches: &clap::ArgMatches, blob_ids: Vec<String>) -> Result<()> {
+fn dump_result_output(
+    matches: &clap::ArgMatches,
+    blob_ids: Vec<String>,
+    chunk_digests: Vec<String>,
+) -> Result<()> {
     let output_json: Option<PathBuf> = matches
         .value_of("output-json")
         .map(|o| o.to_string().into());
@@ -88,6 +94,7 @@ fn dump_result_output(matches: &clap::ArgMatches, blob_ids: Vec<String>) -> Resu
         ResultOutput {
             trace,
             blobs: blob_ids,
+            chunks: chunk_digests,
         }
         .dump(w)?;
     }
@@ -444,7 +451,7 @@ fn main() -> Result<()> {
             )?;
         }
 
-        dump_result_output(matches, blob_ids.clone())?;
+        dump_result_output(matches, blob_ids.clone(), Vec::new())?;
 
         info!(
             "Image build(size={}Bytes) successfully. Blobs table: {:?}",
@@ -455,13 +462,13 @@ fn main() -> Result<()> {
     if let Some(matches) = cmd.subcommand_matches("check") {
         let bootstrap_path = Path::new(matches.value_of("bootstrap").unwrap());
         let mut validator = Validator::new(bootstrap_path)?;
-        let blob_ids = validator
+        let (blob_ids, chunk_digests) = validator
             .check(true)
             .with_context(|| format!("failed to check bootstrap {:?}", bootstrap_path))?;
 
         info!("bootstrap is valid, blobs: {:?}", blob_ids);
 
-        dump_result_output(matches, blob_ids)?;
+        dump_result_output(matches, blob_ids, chunk_digests)?;
     }
 
     Ok(())
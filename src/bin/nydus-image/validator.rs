@@ -5,6 +5,8 @@
 //! Validator for RAFS format
 
 use anyhow::{Context, Result};
+use std::cell::RefCell;
+use std::collections::BTreeSet;
 use std::fs::OpenOptions;
 use std::path::Path;
 
@@ -33,7 +35,9 @@ impl Validator {
         Ok(Self { f_bootstrap })
     }
 
-    pub fn check(&mut self, verbosity: bool) -> Result<Vec<String>> {
+    /// Validate the bootstrap, return the blob list in blob table and
+    /// the deduplicated chunk digest list referenced by bootstrap.
+    pub fn check(&mut self, verbosity: bool) -> Result<(Vec<String>, Vec<String>)> {
         let err = "failed to load bootstrap for validator";
         let mut rs = RafsSuper {
             mode: RafsMode::Direct,
@@ -42,13 +46,17 @@ impl Validator {
         };
         rs.load(&mut self.f_bootstrap).context(err)?;
 
+        let chunk_digests = RefCell::new(BTreeSet::new());
         let tree = Tree::from_bootstrap(&rs, None).context(err)?;
         tree.iterate(&|node| {
             if verbosity {
                 info!("{}", node);
-                for chunk in &node.chunks {
+            }
+            for chunk in &node.chunks {
+                if verbosity {
                     debug!("chunk {}", chunk);
                 }
+                chunk_digests.borrow_mut().insert(chunk.block_id.to_string());
             }
             true
         })?;
@@ -61,6 +69,6 @@ impl Validator {
             .map(|entry| entry.blob_id.to_string())
             .collect::<Vec<String>>();
 
-        Ok(blob_ids)
+        Ok((blob_ids, chunk_digests.into_inner().into_iter().collect()))
     }
 }
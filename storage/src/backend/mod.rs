@@ -66,6 +66,7 @@ pub struct CommonConfig {
     timeout: u64,
     connect_timeout: u64,
     retry_limit: u8,
+    skip_verify: bool,
 }
 
 impl Default for CommonConfig {
@@ -75,6 +76,7 @@ impl Default for CommonConfig {
             timeout: 5,
             connect_timeout: 5,
             retry_limit: 0,
+            skip_verify: false,
         }
     }
 }